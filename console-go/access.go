@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// screenReader is set by --screen-reader: no colours or decoration, and
+// events are announced as plain sentences that read well aloud.
+var screenReader bool
+
+// announce describes a message in conversation key as a sentence, e.g.
+// "Message from alice at 14:05: see you soon".
+func (a *app) announce(key string, m Message) string {
+	at := time.UnixMilli(m.When)
+	when := at.Format("15:04")
+	if at.YearDay() != time.Now().YearDay() || at.Year() != time.Now().Year() {
+		when = at.Format("January 2 at 15:04")
+	}
+	self := m.From == a.h.ID().String()
+	from := a.conversationLabel(m.From)
+	switch {
+	case m.Room != "" && self:
+		return fmt.Sprintf("You said in room %s at %s: %s", m.Room, when, m.Body)
+	case m.Room != "":
+		return fmt.Sprintf("In room %s, %s said at %s: %s", m.Room, from, when, m.Body)
+	case self:
+		return fmt.Sprintf("You said to %s at %s: %s", a.conversationLabel(key), when, m.Body)
+	default:
+		return fmt.Sprintf("Message from %s at %s: %s", from, when, m.Body)
+	}
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "reread",
+		Aliases: []string{"last"},
+		Usage:   "[n] [<peerID|contact|#room>]",
+		Summary: "read the last n messages again (default 5), of the open conversation or the given one, else of all",
+		Run: func(a *app, inv *invocation) error {
+			n := 5
+			args := inv.Args
+			if len(args) > 0 {
+				if _, err := fmt.Sscan(args[0], &n); err == nil {
+					args = args[1:]
+				}
+			}
+			key, _ := a.convs.active()
+			if len(args) > 0 {
+				key = args[0]
+				if !strings.HasPrefix(key, "#") {
+					key = a.contacts.peerID(key)
+				}
+			}
+			entries := a.scroll.latest(key, max(n, 1))
+			if len(entries) == 0 {
+				fmt.Println("No messages yet.")
+				return nil
+			}
+			for _, e := range entries {
+				fmt.Println(a.announce(e.key, e.m))
+			}
+			return nil
+		},
+	})
+}
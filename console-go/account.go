@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"p2p-chat/paths"
+)
+
+// accountSwitch is returned by 'account switch' to end the session; the
+// next one runs as profile.
+type accountSwitch struct {
+	profile string // "" for the default account
+}
+
+func (s *accountSwitch) Error() string { return "switching to account " + accountName(s.profile) }
+
+// defaultAccount names the account kept in the data directory itself.
+const defaultAccount = "default"
+
+func accountName(profile string) string {
+	if profile == "" {
+		return defaultAccount
+	}
+	return profile
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "account",
+		Usage:   "[switch <profile> | new <profile>]",
+		Summary: "switch to another account (identity, state and config kept apart) without restarting, or create one and switch to it; alone, list the accounts",
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) == 0 {
+				profiles, err := a.base.Profiles()
+				if err != nil {
+					return err
+				}
+				names := append([]string{defaultAccount}, profiles...)
+				if jsonOutput {
+					printJSON(map[string]any{"accounts": names, "current": accountName(a.account), "peer": a.h.ID().String()})
+					return nil
+				}
+				for _, name := range names {
+					if name == accountName(a.account) {
+						fmt.Printf(" * %s (%s)\n", name, a.h.ID())
+						continue
+					}
+					fmt.Println("   " + name)
+				}
+				return nil
+			}
+			if (inv.Args[0] != "switch" && inv.Args[0] != "new") || len(inv.Args) != 2 {
+				return errors.New("usage: account switch <profile> | new <profile>")
+			}
+			profile := inv.Args[1]
+			if profile == defaultAccount {
+				profile = ""
+			}
+			if profile == a.account {
+				return fmt.Errorf("already using account %s", accountName(profile))
+			}
+			if profile != "" {
+				if !paths.ValidProfile(profile) {
+					return fmt.Errorf("invalid profile %q: use letters, digits, '-' and '_'", profile)
+				}
+				_, err := os.Stat(a.base.Profile(profile).Data)
+				switch {
+				case inv.Args[0] == "switch" && err != nil:
+					return fmt.Errorf("no account %s; 'account new %s' creates it", profile, profile)
+				case inv.Args[0] == "new" && err == nil:
+					return fmt.Errorf("account %s already exists; 'account switch %s' uses it", profile, profile)
+				}
+			}
+			return &accountSwitch{profile: profile}
+		},
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// aliasesFile holds user-defined aliases and macros, one per line:
+//
+//	alias m = msg alice
+//	macro morning = join dev; say dev good morning $*; unread
+//
+// An alias's expansion gets the rest of the line appended. A macro runs
+// each ';'-separated command in turn, with $1..$9 replaced by its
+// arguments and $* by all of them. Lines starting with # are comments.
+const aliasesFile = "p2pchat_aliases.conf"
+
+// maxAliasDepth stops aliases that expand to each other.
+const maxAliasDepth = 8
+
+type alias struct {
+	macro     bool
+	expansion string
+}
+
+// aliasTable is the set of aliases and macros the dispatcher falls back to
+// for names that aren't commands.
+type aliasTable struct {
+	mu     sync.Mutex
+	path   string
+	byName map[string]alias
+}
+
+func loadAliases(path string) (*aliasTable, error) {
+	t := &aliasTable{path: path, byName: make(map[string]alias)}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, def, _ := strings.Cut(line, " ")
+		if err := t.define(kind, def); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return t, sc.Err()
+}
+
+// define parses "<name> = <expansion>" as an alias or macro (kind).
+func (t *aliasTable) define(kind, def string) error {
+	if kind != "alias" && kind != "macro" {
+		return fmt.Errorf("expected 'alias' or 'macro', got %q", kind)
+	}
+	name, expansion, ok := strings.Cut(def, "=")
+	name, expansion = strings.TrimSpace(name), strings.TrimSpace(expansion)
+	if !ok || name == "" || expansion == "" || strings.ContainsAny(name, " \t/") {
+		return fmt.Errorf("expected '%s <name> = <command>'", kind)
+	}
+	if commands.lookup(name) != nil {
+		return fmt.Errorf("%q is a built-in command", name)
+	}
+	t.mu.Lock()
+	t.byName[name] = alias{macro: kind == "macro", expansion: expansion}
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *aliasTable) remove(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.byName[name]
+	delete(t.byName, name)
+	return ok
+}
+
+// expand returns the command lines name stands for, given the text after
+// it, or false if name isn't an alias or macro.
+func (t *aliasTable) expand(name, text string) ([]string, bool) {
+	t.mu.Lock()
+	al, ok := t.byName[name]
+	t.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if !al.macro {
+		return []string{strings.TrimSpace(al.expansion + " " + text)}, true
+	}
+	args := strings.Fields(text)
+	var lines []string
+	for _, cmd := range strings.Split(al.expansion, ";") {
+		cmd = strings.ReplaceAll(cmd, "$*", text)
+		for i := 9; i >= 1; i-- {
+			arg := ""
+			if i <= len(args) {
+				arg = args[i-1]
+			}
+			cmd = strings.ReplaceAll(cmd, "$"+strconv.Itoa(i), arg)
+		}
+		if cmd = strings.TrimSpace(cmd); cmd != "" {
+			lines = append(lines, cmd)
+		}
+	}
+	return lines, true
+}
+
+// list returns every alias and macro in the file's syntax.
+func (t *aliasTable) list() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := make([]string, 0, len(t.byName))
+	for name, al := range t.byName {
+		lines = append(lines, al.String(name))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func (al alias) String(name string) string {
+	kind := "alias"
+	if al.macro {
+		kind = "macro"
+	}
+	return kind + " " + name + " = " + al.expansion
+}
+
+// save rewrites the aliases file.
+func (t *aliasTable) save() error {
+	lines := t.list()
+	data := "# peep-chat aliases and macros, managed with the alias and macro commands\n" + strings.Join(lines, "\n") + "\n"
+	return os.WriteFile(t.path, []byte(data), 0600)
+}
+
+func init() {
+	for _, kind := range []string{"alias", "macro"} {
+		kind := kind
+		summary := "define an alias: the expansion gets the rest of the line appended"
+		if kind == "macro" {
+			summary = "define a macro: ';'-separated commands, $1..$9 and $* are its arguments"
+		}
+		commands.mustRegister(&command{
+			Name:    kind,
+			Usage:   "[<name> = <command>] | -d <name>",
+			Summary: summary + " (saved to the config dir; no arguments lists them)",
+			Run: func(a *app, inv *invocation) error {
+				if len(inv.Args) == 0 {
+					lines := a.aliases.list()
+					if len(lines) == 0 {
+						fmt.Println("no aliases or macros")
+					}
+					for _, l := range lines {
+						fmt.Println(" ", l)
+					}
+					return nil
+				}
+				if inv.Args[0] == "-d" && len(inv.Args) == 2 {
+					if !a.aliases.remove(inv.Args[1]) {
+						fmt.Println("no alias or macro named", inv.Args[1])
+						return nil
+					}
+					return a.aliases.save()
+				}
+				if err := a.aliases.define(kind, inv.text); err != nil {
+					return err
+				}
+				return a.aliases.save()
+			},
+		})
+	}
+}
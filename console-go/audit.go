@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"p2p-chat/node"
+)
+
+const auditFile = "p2pchat_audit.log"
+
+// Audit event names.
+const (
+	auditFirstContact    = "first_contact"     // a peer's key was pinned
+	auditIdentityChanged = "identity_changed"  // a peer no longer matches its pin
+	auditTrusted         = "trusted"           // a change was accepted with 'trust'
+	auditRevocation      = "revocation"        // a peer's key revocation arrived
+	auditUntrusted       = "untrusted_message" // a message from a revoked key
+	auditBadSignature    = "bad_signature"     // signed input failed verification
+	auditInvalidMessage  = "invalid_message"   // a message failed validation
+	auditBlocked         = "blocked"           // an access attempt was refused
+	auditE2ERefused      = "e2e_refused"       // a require-e2e contact's traffic wasn't end-to-end encrypted
+)
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Peer   string    `json:"peer,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// auditLog appends security-relevant events to auditFile in the data
+// directory as JSON lines. The file is only ever appended to.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, f: f}, nil
+}
+
+func (l *auditLog) record(event, peerID, detail string) {
+	b, _ := json.Marshal(auditEntry{Time: time.Now().UTC(), Event: event, Peer: peerID, Detail: detail})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		logger.Warnf("audit log: %s", err)
+	}
+}
+
+func (l *auditLog) Close() error { return l.f.Close() }
+
+// entries reads the log back, keeping the last n entries that match peer
+// and event (empty matches all).
+func (l *auditLog) entries(n int, peerID, event string) ([]auditEntry, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []auditEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e auditEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue
+		}
+		if (peerID != "" && e.Peer != peerID) || (event != "" && e.Event != event) {
+			continue
+		}
+		out = append(out, e)
+		if len(out) > n {
+			out = out[1:]
+		}
+	}
+	return out, sc.Err()
+}
+
+// auditTracer records room messages gossipsub rejects for their signature.
+type auditTracer struct{ a *app }
+
+func (t auditTracer) RejectMessage(msg *pubsub.Message, reason string) {
+	switch reason {
+	case pubsub.RejectInvalidSignature, pubsub.RejectMissingSignature, pubsub.RejectUnexpectedSignature:
+		t.a.audit.record(auditBadSignature, msg.GetFrom().String(), "room "+msg.GetTopic()+": "+reason)
+		// The author can't be told from a bad signature; whoever passed
+		// the message on is charged.
+		t.a.node.Report(msg.ReceivedFrom, node.OffenseBadSignature, "room "+msg.GetTopic())
+	}
+}
+
+func (auditTracer) AddPeer(peer.ID, protocol.ID)         {}
+func (auditTracer) RemovePeer(peer.ID)                   {}
+func (auditTracer) Join(string)                          {}
+func (auditTracer) Leave(string)                         {}
+func (auditTracer) Graft(peer.ID, string)                {}
+func (auditTracer) Prune(peer.ID, string)                {}
+func (auditTracer) ValidateMessage(*pubsub.Message)      {}
+func (auditTracer) DeliverMessage(*pubsub.Message)       {}
+func (auditTracer) DuplicateMessage(*pubsub.Message)     {}
+func (auditTracer) ThrottlePeer(peer.ID)                 {}
+func (auditTracer) RecvRPC(*pubsub.RPC)                  {}
+func (auditTracer) SendRPC(*pubsub.RPC, peer.ID)         {}
+func (auditTracer) DropRPC(*pubsub.RPC, peer.ID)         {}
+func (auditTracer) UndeliverableMessage(*pubsub.Message) {}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "audit",
+		Usage:   "[-n entries] [-event name] [<peerID|contact>]",
+		Summary: "review the security audit log: first contacts, key changes, revocations, bad signatures, refused access and refused plaintext",
+		Flags: func(fs *flag.FlagSet) {
+			fs.Int("n", 20, "show at most this many of the latest entries")
+			fs.String("event", "", "only this event, e.g. identity_changed")
+		},
+		Run: func(a *app, inv *invocation) error {
+			var peerID string
+			if len(inv.Args) > 0 {
+				peerID = a.contacts.peerID(inv.Args[0])
+			}
+			entries, err := a.audit.entries(inv.Int("n"), peerID, inv.String("event"))
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				printJSON(map[string]any{"audit": entries})
+				return nil
+			}
+			if len(entries) == 0 {
+				fmt.Println("no audit entries")
+			}
+			for _, e := range entries {
+				line := e.Time.Local().Format(time.DateTime) + "  " + e.Event
+				if e.Peer != "" {
+					line += "  " + a.conversationLabel(e.Peer)
+				}
+				if e.Detail != "" {
+					line += "  " + e.Detail
+				}
+				fmt.Println(line)
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// commandInput returns the lines the session runs and whether it is a
+// batch: --exec (commands separated by ';'), --exec-file ('-' is stdin),
+// or stdin when it isn't a terminal. Otherwise it's the interactive
+// prompt on stdin.
+func commandInput(execCmds, execFile string) (<-chan string, bool, error) {
+	switch {
+	case execCmds != "":
+		return feedLines(strings.NewReader(strings.ReplaceAll(execCmds, ";", "\n"))), true, nil
+	case execFile == "-":
+		return feedLines(os.Stdin), true, nil
+	case execFile != "":
+		f, err := os.Open(execFile)
+		if err != nil {
+			return nil, false, err
+		}
+		return feedLines(f), true, nil
+	}
+	return feedLines(os.Stdin), !isTerminal(os.Stdin), nil
+}
+
+// feedLines sends r's lines on the returned channel, closing it (and r,
+// if it's a file other than stdin) at the end of input.
+func feedLines(r io.Reader) <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		if f, ok := r.(*os.File); ok && f != os.Stdin {
+			defer f.Close()
+		}
+		reader := bufio.NewReader(r)
+		for {
+			text, err := reader.ReadString('\n')
+			if text != "" {
+				lines <- text
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return lines
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+// blocksDir holds the content-addressed blocks: room messages and the
+// chunks and manifests of attached files.
+const blocksDir = node.BlocksDir
+
+// historyFile indexes the blockstore: each room's messages in order, and
+// who sent each file so its blocks can be fetched from them.
+const historyFile = "p2pchat_history.json"
+
+// historyPerRoom caps how many message CIDs are kept per room.
+const historyPerRoom = 5000
+
+// blockIndex is the historyFile contents.
+type blockIndex struct {
+	mu      sync.Mutex
+	path    string
+	Rooms   map[string][]node.HistoryEntry `json:"rooms"`   // oldest first
+	Sources map[string]string              `json:"sources"` // file CID -> sender peer ID
+}
+
+// loadBlockIndex reads the index.
+func loadBlockIndex(path string) (*blockIndex, error) {
+	x := &blockIndex{path: path, Rooms: make(map[string][]node.HistoryEntry), Sources: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return x, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, x); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if x.Rooms == nil {
+		x.Rooms = make(map[string][]node.HistoryEntry)
+	}
+	if x.Sources == nil {
+		x.Sources = make(map[string]string)
+	}
+	return x, nil
+}
+
+// save writes the index; callers hold x.mu.
+func (x *blockIndex) save() {
+	data, err := json.MarshalIndent(x, "", "  ")
+	if err == nil {
+		err = os.WriteFile(x.path, data, 0600)
+	}
+	if err != nil {
+		logger.Warnf("saving history index: %s", err)
+	}
+}
+
+// recordBlocks stores a room message as a block and notes where its
+// files come from. Receiving the same message twice changes nothing.
+func (a *app) recordBlocks(m Message) {
+	if m.Room == "" && len(m.Files) == 0 {
+		return
+	}
+	x := a.history
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, f := range m.Files {
+		if _, ok := x.Sources[f.CID]; !ok {
+			x.Sources[f.CID] = m.From
+		}
+	}
+	if m.Room != "" {
+		c, err := a.blocks.PutMessage(m)
+		if err != nil {
+			logger.Warnf("storing message block: %s", err)
+			return
+		}
+		x.add(m.Room, node.HistoryEntry{CID: c.String(), When: m.When})
+	}
+	x.save()
+}
+
+// add puts e into a room's history in time order, unless it is there
+// already; callers hold x.mu.
+func (x *blockIndex) add(room string, e node.HistoryEntry) {
+	hist := x.Rooms[room]
+	if slices.ContainsFunc(hist, func(h node.HistoryEntry) bool { return h.CID == e.CID }) {
+		return
+	}
+	i := sort.Search(len(hist), func(i int) bool { return hist[i].When > e.When })
+	hist = slices.Insert(hist, i, e)
+	if len(hist) > historyPerRoom {
+		hist = hist[len(hist)-historyPerRoom:]
+	}
+	x.Rooms[room] = hist
+}
+
+// entries returns a copy of a room's history.
+func (x *blockIndex) entries(room string) []node.HistoryEntry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return slices.Clone(x.Rooms[room])
+}
+
+// roomHistory returns the last n messages of a room from the blockstore.
+func (a *app) roomHistory(room string, n int) ([]Message, error) {
+	hist := a.history.entries(room)
+	if len(hist) > n {
+		hist = hist[len(hist)-n:]
+	}
+	msgs := make([]Message, 0, len(hist))
+	for _, e := range hist {
+		c, err := cid.Decode(e.CID)
+		if err != nil {
+			return nil, err
+		}
+		m, err := a.blocks.GetMessage(c)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// fileSource is who sent the file, or "" if we don't know.
+func (a *app) fileSource(c string) string {
+	a.history.mu.Lock()
+	defer a.history.mu.Unlock()
+	return a.history.Sources[c]
+}
+
+// attachFile stores the file at path as blocks.
+func (a *app) attachFile(path string) (node.FileRef, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return node.FileRef{}, err
+	}
+	defer f.Close()
+	return a.blocks.PutFile(filepath.Base(path), f)
+}
+
+// blockPeers are who we ask for blocks: the sender, if known, and every
+// connected peer that serves blocks, room members included.
+func (a *app) blockPeers(sender string) []peer.ID {
+	var out []peer.ID
+	if p, err := peer.Decode(sender); err == nil && p != a.h.ID() {
+		out = append(out, p)
+	}
+	for _, p := range a.h.Network().Peers() {
+		if slices.Contains(out, p) {
+			continue
+		}
+		if ok, _ := a.h.Peerstore().SupportsProtocols(p, node.BlockProtocolID); len(ok) > 0 {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// getBlocks fetches blocks from connected peers; room messages among them
+// are added to that room's history.
+func (a *app) getBlocks(cids []cid.Cid) error {
+	peers := a.blockPeers("")
+	if len(peers) == 0 {
+		return errors.New("no connected peers serve blocks")
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, 2*time.Minute)
+	defer cancel()
+	err := a.node.FetchBlocks(ctx, peers, cids)
+	for _, c := range cids {
+		if c.Type() != cid.DagJSON || !a.blocks.Has(c) {
+			continue
+		}
+		if m, merr := a.blocks.GetMessage(c); merr == nil && m.Room != "" {
+			a.recordBlocks(m)
+		}
+	}
+	return err
+}
+
+// saveFile writes the file whose manifest is c to path, fetching missing
+// blocks first from its sender and any connected peer that has them.
+func (a *app) saveFile(c cid.Cid, path string) (node.FileManifest, error) {
+	man, err := a.blocks.Manifest(c)
+	complete := err == nil
+	if complete {
+		for _, s := range man.Chunks {
+			if cc, err := cid.Decode(s); err != nil || !a.blocks.Has(cc) {
+				complete = false
+				break
+			}
+		}
+	}
+	if !complete {
+		peers := a.blockPeers(a.fileSource(c.String()))
+		if len(peers) == 0 {
+			return node.FileManifest{}, fmt.Errorf("don't have %s and nobody to ask for it", c)
+		}
+		ctx, cancel := context.WithTimeout(a.ctx, 5*time.Minute)
+		man, err = a.node.FetchFile(ctx, peers, node.FileRef{CID: c.String()})
+		cancel()
+		if err != nil {
+			return node.FileManifest{}, err
+		}
+	}
+	if path == "" {
+		path = man.Name
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, man.Name)
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return node.FileManifest{}, err
+	}
+	if err := a.blocks.WriteFile(c, out); err != nil {
+		out.Close()
+		os.Remove(path)
+		return node.FileManifest{}, err
+	}
+	return man, out.Close()
+}
+
+// fileLines describes a message's attachments, one line each.
+func fileLines(m Message) string {
+	var b strings.Builder
+	for _, f := range m.Files {
+		fmt.Fprintf(&b, "\n  [file] %s (%s) - save %s", f.Name, formatBytes(float64(f.Size)), f.CID)
+	}
+	return b.String()
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:       "attach",
+		Usage:      "<peerID|contact|#room> <file> [caption]",
+		Summary:    "send a file, stored as content-addressed blocks the receiver fetches from you",
+		MinArgs:    2,
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			ref, err := a.attachFile(inv.Args[1])
+			if err != nil {
+				return err
+			}
+			caption := inv.Tail(2)
+			var (
+				m      Message
+				target string // empty for a room
+				asText bool   // the peer's client can't take files
+			)
+			if room, ok := strings.CutPrefix(inv.Args[0], "#"); ok {
+				m, err = a.rooms.post(inv.Context(), room, Message{Body: caption, Files: []node.FileRef{ref}})
+			} else {
+				target = a.contacts.peerID(inv.Args[0])
+				if err = a.e2eReady(target); err == nil {
+					ctx, cancel := context.WithTimeout(inv.Context(), 30*time.Second)
+					if asText = !a.supports(target, node.FeatureFiles); asText {
+						m, err = a.node.Send(ctx, target, strings.TrimSpace(caption+"\n[file not sent: "+ref.Name+", "+formatBytes(float64(ref.Size))+"; your client can't receive files]"))
+					} else {
+						m, err = a.node.SendFiles(ctx, target, caption, []node.FileRef{ref})
+					}
+					cancel()
+				}
+			}
+			if err != nil {
+				return err
+			}
+			a.messageSent(target, m)
+			a.deliveries.advance(m.ID(), stateDelivered, "", "")
+			if asText {
+				printResult(map[string]any{"sent": inv.Args[0], "file": ref, "as_text": true},
+					fmt.Sprintf("%s's client can't receive files; told them about %s instead", a.conversationLabel(target), ref.Name))
+				return nil
+			}
+			printResult(map[string]any{"sent": inv.Args[0], "file": ref}, fmt.Sprintf("sent %s (%s) as %s", ref.Name, formatBytes(float64(ref.Size)), ref.CID))
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "save",
+		Usage:   "<cid> [path]",
+		Summary: "save an attached file, fetching and verifying its blocks from the sender if needed",
+		MinArgs: 1,
+		Run: func(a *app, inv *invocation) error {
+			c, err := cid.Decode(inv.Args[0])
+			if err != nil {
+				return fmt.Errorf("invalid CID %q", inv.Args[0])
+			}
+			path := ""
+			if len(inv.Args) > 1 {
+				path = inv.Tail(1)
+			}
+			man, err := a.saveFile(c, path)
+			if err != nil {
+				return err
+			}
+			printResult(map[string]any{"cid": c.String(), "name": man.Name, "size": man.Size}, fmt.Sprintf("saved %s (%s)", man.Name, formatBytes(float64(man.Size))))
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "blocks",
+		Usage:   "[verify | get <cid>...]",
+		Summary: "show the local blockstore, rehash every block to check it, or fetch blocks from any connected peer that has them",
+		Run: func(a *app, inv *invocation) error {
+			switch {
+			case len(inv.Args) == 0:
+				cids, size, err := a.blocks.List()
+				if err != nil {
+					return err
+				}
+				printResult(map[string]any{"blocks": len(cids), "bytes": size}, fmt.Sprintf("%d blocks, %s", len(cids), formatBytes(float64(size))))
+			case inv.Args[0] == "verify":
+				bad, err := a.blocks.Verify()
+				if err != nil {
+					return err
+				}
+				if jsonOutput {
+					printJSON(map[string]any{"corrupt": bad})
+					return nil
+				}
+				if len(bad) == 0 {
+					fmt.Println("all blocks match their CIDs")
+				}
+				for _, c := range bad {
+					fmt.Printf(" - %s is corrupt\n", c)
+				}
+			case inv.Args[0] == "get" && len(inv.Args) > 1:
+				var cids []cid.Cid
+				for _, s := range inv.Args[1:] {
+					c, err := cid.Decode(s)
+					if err != nil {
+						return fmt.Errorf("invalid CID %q", s)
+					}
+					cids = append(cids, c)
+				}
+				if err := a.getBlocks(cids); err != nil {
+					return err
+				}
+				printResult(map[string]any{"fetched": len(cids)}, fmt.Sprintf("have all %d blocks", len(cids)))
+			default:
+				fmt.Println("usage: blocks [verify | get <cid>...]")
+			}
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "history",
+		Usage:   "<room> [n]",
+		Summary: "show a room's last n messages (default 20) from the blockstore",
+		MinArgs: 1,
+		Run: func(a *app, inv *invocation) error {
+			n := 20
+			if len(inv.Args) > 1 {
+				v, err := strconv.Atoi(inv.Args[1])
+				if err != nil || v < 1 {
+					return fmt.Errorf("invalid count %q", inv.Args[1])
+				}
+				n = v
+			}
+			msgs, err := a.roomHistory(strings.TrimPrefix(inv.Args[0], "#"), n)
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				printJSON(map[string]any{"messages": msgs})
+				return nil
+			}
+			if len(msgs) == 0 {
+				fmt.Println("no history for that room")
+			}
+			for _, m := range msgs {
+				when := time.UnixMilli(m.When).Format(time.RFC3339)
+				fmt.Printf("<%s from=%s when=%s> %s%s\n", styles.room("#"+m.Room), styles.peer(m.From, m.From), styles.dim(when), styles.body(m.Body), fileLines(m)+locationLines(m))
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,219 @@
+// Package bot is a small framework for writing chat bots on top of a
+// peep-chat node. Bots register handlers for incoming messages and use the
+// reply/send/schedule helpers; the node supplies a Client and feeds every
+// incoming message to Dispatch. Nothing here touches libp2p directly.
+//
+//	b := bot.New(client)
+//	b.Command("!ping", func(c *bot.Context) { c.Reply("pong") })
+//	b.Every(time.Hour, func(b *bot.Bot) { b.Send(ctx, owner, "still alive") })
+package bot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnsupported is returned by helpers the underlying Client can't provide.
+var ErrUnsupported = errors.New("bot: not supported by this client")
+
+// Message is an incoming chat message as seen by a bot.
+type Message struct {
+	From string // sender peer ID
+	Room string // room name, empty for direct messages
+	Body string
+	When time.Time
+}
+
+// Client is the part of a chat node a bot needs: sending direct messages.
+type Client interface {
+	SelfID() string
+	Send(ctx context.Context, to, body string) error
+}
+
+// RoomSender is implemented by clients that support rooms.
+type RoomSender interface {
+	SendRoom(ctx context.Context, room, body string) error
+}
+
+// FileSender is implemented by clients that can transfer files.
+type FileSender interface {
+	SendFile(ctx context.Context, to, path string) error
+}
+
+// HandlerFunc handles one incoming message.
+type HandlerFunc func(c *Context)
+
+// MatchFunc decides whether a handler applies to a message.
+type MatchFunc func(m Message) bool
+
+type route struct {
+	match   MatchFunc
+	handler HandlerFunc
+}
+
+// Bot routes incoming messages to handlers and runs scheduled jobs.
+type Bot struct {
+	client Client
+
+	mu     sync.RWMutex
+	routes []route
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a bot that talks through client.
+func New(client Client) *Bot {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Bot{client: client, ctx: ctx, cancel: cancel}
+}
+
+// Handle registers h for messages accepted by match. Handlers run in
+// registration order and every matching handler is called.
+func (b *Bot) Handle(match MatchFunc, h HandlerFunc) {
+	b.mu.Lock()
+	b.routes = append(b.routes, route{match: match, handler: h})
+	b.mu.Unlock()
+}
+
+// OnMessage registers h for every incoming message.
+func (b *Bot) OnMessage(h HandlerFunc) {
+	b.Handle(func(Message) bool { return true }, h)
+}
+
+// Command registers h for messages whose first word is name (e.g. "!roll").
+// Context.Args holds the remaining words.
+func (b *Bot) Command(name string, h HandlerFunc) {
+	b.Handle(func(m Message) bool {
+		first, _, _ := strings.Cut(strings.TrimSpace(m.Body), " ")
+		return first == name
+	}, h)
+}
+
+// Dispatch delivers an incoming message to the matching handlers. Messages
+// the bot sent itself are ignored so reply loops can't happen.
+func (b *Bot) Dispatch(m Message) {
+	if m.From == b.client.SelfID() {
+		return
+	}
+	b.mu.RLock()
+	routes := append([]route(nil), b.routes...)
+	b.mu.RUnlock()
+	for _, r := range routes {
+		if !r.match(m) {
+			continue
+		}
+		var args []string
+		if f := strings.Fields(m.Body); len(f) > 1 {
+			args = f[1:]
+		}
+		r.handler(&Context{Context: b.ctx, Message: m, Args: args, Bot: b})
+	}
+}
+
+// Send sends a direct message.
+func (b *Bot) Send(ctx context.Context, to, body string) error {
+	return b.client.Send(ctx, to, body)
+}
+
+// SendRoom posts into a room, if the client supports rooms.
+func (b *Bot) SendRoom(ctx context.Context, room, body string) error {
+	rs, ok := b.client.(RoomSender)
+	if !ok {
+		return ErrUnsupported
+	}
+	return rs.SendRoom(ctx, room, body)
+}
+
+// SendFile sends a file to a peer, if the client supports file transfer.
+func (b *Bot) SendFile(ctx context.Context, to, path string) error {
+	fs, ok := b.client.(FileSender)
+	if !ok {
+		return ErrUnsupported
+	}
+	return fs.SendFile(ctx, to, path)
+}
+
+// At runs job once at t. The returned function cancels it.
+func (b *Bot) At(t time.Time, job func(b *Bot)) (cancel func()) {
+	timer := time.NewTimer(time.Until(t))
+	done := make(chan struct{})
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		select {
+		case <-timer.C:
+			job(b)
+		case <-done:
+			timer.Stop()
+		case <-b.ctx.Done():
+			timer.Stop()
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Every runs job every interval until cancelled or the bot is closed.
+func (b *Bot) Every(interval time.Duration, job func(b *Bot)) (cancel func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				job(b)
+			case <-done:
+				return
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Close stops all scheduled jobs and waits for running ones to finish.
+func (b *Bot) Close() {
+	b.cancel()
+	b.wg.Wait()
+}
+
+// Context is passed to handlers for a single incoming message.
+type Context struct {
+	context.Context
+	Message Message
+	Args    []string // words after the first one
+	Bot     *Bot
+}
+
+// Reply answers in the conversation the message came from: the room for
+// room messages, the sender otherwise.
+func (c *Context) Reply(body string) error {
+	if c.Message.Room != "" {
+		return c.Bot.SendRoom(c, c.Message.Room, body)
+	}
+	return c.Bot.Send(c, c.Message.From, body)
+}
+
+// ReplyFile sends a file back to the sender.
+func (c *Context) ReplyFile(path string) error {
+	return c.Bot.SendFile(c, c.Message.From, path)
+}
+
+// ReplyAt schedules a reply for later, e.g. for reminders.
+func (c *Context) ReplyAt(t time.Time, body string) (cancel func()) {
+	m := c.Message
+	return c.Bot.At(t, func(b *Bot) {
+		rc := &Context{Context: b.ctx, Message: m, Bot: b}
+		_ = rc.Reply(body)
+	})
+}
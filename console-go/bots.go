@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"p2p-chat/bot"
+)
+
+// botClient adapts the running node to bot.Client.
+type botClient struct{ a *app }
+
+func (c botClient) SelfID() string { return c.a.h.ID().String() }
+
+func (c botClient) Send(ctx context.Context, to, body string) error {
+	m, err := c.a.node.Send(ctx, to, body)
+	if err != nil {
+		return err
+	}
+	c.a.messageSent(to, m)
+	return nil
+}
+
+func (c botClient) SendRoom(ctx context.Context, room, body string) error {
+	m, err := c.a.rooms.publish(ctx, room, body)
+	if err != nil {
+		return err
+	}
+	c.a.messageSent("", m)
+	return nil
+}
+
+// builtinBots are the bots that can be switched on with --bots.
+var builtinBots = map[string]func(b *bot.Bot){
+	"echo": func(b *bot.Bot) {
+		b.Command("!echo", func(c *bot.Context) {
+			_ = c.Reply(strings.Join(c.Args, " "))
+		})
+	},
+	"remind": func(b *bot.Bot) {
+		// !remind 10m take the bread out
+		b.Command("!remind", func(c *bot.Context) {
+			if len(c.Args) < 2 {
+				_ = c.Reply("usage: !remind <duration> <text>")
+				return
+			}
+			d, err := time.ParseDuration(c.Args[0])
+			if err != nil {
+				_ = c.Reply("bad duration: " + err.Error())
+				return
+			}
+			c.ReplyAt(time.Now().Add(d), "reminder: "+strings.Join(c.Args[1:], " "))
+			_ = c.Reply("ok, I'll remind you in " + d.String())
+		})
+	},
+}
+
+// startBots creates the node's bot and enables the named built-in bots.
+func startBots(a *app, names string) (*bot.Bot, error) {
+	b := bot.New(botClient{a})
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		setup, ok := builtinBots[name]
+		if !ok {
+			b.Close()
+			return nil, fmt.Errorf("unknown bot %q", name)
+		}
+		setup(b)
+	}
+	return b, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// commandTimeout bounds each command (--command-timeout); 0 means none.
+var commandTimeout = 5 * time.Minute
+
+// errInterrupted is why a command's context ends on Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+// running holds the cancel funcs of the commands in progress, so Ctrl-C
+// stops them rather than the client.
+var running = &runningCommands{cancels: make(map[int]context.CancelCauseFunc)}
+
+type runningCommands struct {
+	mu      sync.Mutex
+	next    int
+	cancels map[int]context.CancelCauseFunc
+}
+
+// start gives a command its context: parent's, under commandTimeout and
+// cancelled by interrupt. Call done when the command returns.
+func (r *runningCommands) start(parent context.Context) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	stopTimer := func() bool { return false }
+	if commandTimeout > 0 {
+		t := time.AfterFunc(commandTimeout, func() {
+			cancel(fmt.Errorf("timed out after %s (--command-timeout)", commandTimeout))
+		})
+		stopTimer = t.Stop
+	}
+	r.mu.Lock()
+	id := r.next
+	r.next++
+	r.cancels[id] = cancel
+	r.mu.Unlock()
+	return ctx, func() {
+		stopTimer()
+		r.mu.Lock()
+		delete(r.cancels, id)
+		r.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// interrupt cancels every command in progress, reporting whether there
+// were any.
+func (r *runningCommands) interrupt() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cancel := range r.cancels {
+		cancel(errInterrupted)
+	}
+	return len(r.cancels) > 0
+}
+
+// Context is the command's context: the session's, bounded by
+// --command-timeout and cancelled by Ctrl-C. Work that outlives the
+// command uses a.ctx instead.
+func (inv *invocation) Context() context.Context {
+	if inv.ctx == nil {
+		return context.Background()
+	}
+	return inv.ctx
+}
+
+// commandError explains err by why the command's context ended, if it did.
+func commandError(ctx context.Context, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+	if cause := context.Cause(ctx); cause != nil && cause != ctx.Err() {
+		return cause
+	}
+	return err
+}
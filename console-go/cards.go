@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"p2p-chat/node"
+)
+
+// maxPendingCards bounds the contact cards waiting for 'accept'; the
+// oldest goes first.
+const maxPendingCards = 20
+
+// pendingCards holds received contact cards until they're accepted. They
+// aren't persisted: a card not accepted this session can be sent again.
+type pendingCards struct {
+	mu    sync.Mutex
+	cards []node.ContactCard
+}
+
+func (p *pendingCards) add(c node.ContactCard) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, old := range p.cards {
+		if old.Peer == c.Peer && old.Introducer == c.Introducer {
+			p.cards = append(p.cards[:i], p.cards[i+1:]...)
+			break
+		}
+	}
+	if len(p.cards) == maxPendingCards {
+		p.cards = p.cards[1:]
+	}
+	p.cards = append(p.cards, c)
+}
+
+func (p *pendingCards) list() []node.ContactCard {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]node.ContactCard(nil), p.cards...)
+}
+
+// take removes and returns the card numbered s in list order, or the one
+// suggesting the name s.
+func (p *pendingCards) take(s string) (node.ContactCard, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.cards {
+		if strconv.Itoa(i+1) == s || c.Name == s || c.Peer == s {
+			p.cards = append(p.cards[:i], p.cards[i+1:]...)
+			return c, true
+		}
+	}
+	return node.ContactCard{}, false
+}
+
+// cardLines describes a received contact card under its message.
+func cardLines(m Message) string {
+	if m.Card == nil {
+		return ""
+	}
+	if m.Card.Name == "" {
+		return "\n  [contact card] 'accept -as <name> " + m.Card.Peer + "' to add it"
+	}
+	return "\n  [contact card] 'accept " + m.Card.Name + "' to add it"
+}
+
+// cardReceived keeps a received contact card for 'accept'.
+func (a *app) cardReceived(m Message) {
+	if m.Card != nil && m.Card.Peer != a.node.ID().String() {
+		a.cards.add(*m.Card)
+	}
+}
+
+// contactCard makes a card for the contact, peer ID or multiaddr s: the
+// addresses we know it by and its profile, asked of it if connected.
+func (a *app) contactCard(s string) (node.ContactCard, error) {
+	pi, err := a.contacts.resolve(s)
+	if err != nil {
+		return node.ContactCard{}, err
+	}
+	pi.Addrs = ma.Unique(append(pi.Addrs, a.h.Peerstore().Addrs(pi.ID)...))
+	prof := node.Profile{Mailboxes: a.contacts.mailboxesOf(pi.ID.String())}
+	if len(a.h.Network().ConnsToPeer(pi.ID)) > 0 {
+		ctx, cancel := context.WithTimeout(a.ctx, 10*time.Second)
+		if p, err := a.node.FetchProfile(ctx, pi.ID); err == nil {
+			prof = p
+		}
+		cancel()
+	}
+	return a.node.NewContactCard(a.contacts.nameOf(pi.ID.String()), pi, prof)
+}
+
+// acceptCard adds the peer a card introduces as a contact named name.
+func (a *app) acceptCard(c node.ContactCard, name string) (contact, error) {
+	pi, err := c.AddrInfo()
+	if err != nil {
+		return contact{}, err
+	}
+	ct := contact{Peer: c.Peer, Addrs: c.Addrs, Mailboxes: c.Profile.Mailboxes}
+	if ct, err = a.contacts.put(name, ct); err != nil {
+		return ct, err
+	}
+	a.spam.learnedPoW(c.Peer, c.Profile.PoW)
+	if len(pi.Addrs) > 0 {
+		a.h.Peerstore().AddAddrs(pi.ID, pi.Addrs, time.Hour)
+	}
+	return ct, nil
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:       "share-contact",
+		Usage:      "<peerID|contact> <contact|peerID|multiaddr>",
+		Summary:    "send a peer a contact card, signed by you, for a third party: its peer ID, addresses and profile, added with 'accept'",
+		MinArgs:    2,
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			to := a.contacts.peerID(inv.Args[0])
+			if _, err := peer.Decode(to); err != nil {
+				return fmt.Errorf("%q is not a contact or peer ID", inv.Args[0])
+			}
+			card, err := a.contactCard(inv.Args[1])
+			if err != nil {
+				return err
+			}
+			if card.Peer == to {
+				return errors.New("that's a card for the peer it would go to")
+			}
+			if err := a.e2eReady(to); err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(inv.Context(), 30*time.Second)
+			defer cancel()
+			body := "[contact card] " + card.Peer
+			if card.Name != "" {
+				body = "[contact card] " + card.Name + " " + card.Peer
+			}
+			m, err := a.node.SendContactCard(ctx, to, body, card)
+			if err != nil {
+				return err
+			}
+			a.messageSent(to, m)
+			printResult(map[string]any{"sent": to, "card": card},
+				fmt.Sprintf("sent %s a contact card for %s", a.conversationLabel(to), a.conversationLabel(card.Peer)))
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "accept",
+		Usage:   "[[-as <name>] <n|name|peerID>]",
+		Summary: "add the peer a received contact card introduces as a contact; alone, list cards waiting",
+		Flags: func(fs *flag.FlagSet) {
+			fs.String("as", "", "contact name, instead of the one the card suggests")
+		},
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) == 0 {
+				cards := a.cards.list()
+				if jsonOutput {
+					printJSON(map[string]any{"cards": cards})
+					return nil
+				}
+				if len(cards) == 0 {
+					fmt.Println("no contact cards waiting")
+				}
+				for i, c := range cards {
+					name := c.Name
+					if name == "" {
+						name = "(no name)"
+					}
+					fmt.Printf("%d) %s %s, %d addresses, from %s\n", i+1, name, c.Peer, len(c.Addrs), a.conversationLabel(c.Introducer))
+				}
+				return nil
+			}
+			c, ok := a.cards.take(inv.Args[0])
+			if !ok {
+				return fmt.Errorf("no contact card %s waiting; 'accept' lists them", inv.Args[0])
+			}
+			name := inv.String("as")
+			if name == "" {
+				name = c.Name
+			}
+			if name == "" {
+				a.cards.add(c)
+				return errors.New("the card suggests no name; give one with -as <name>")
+			}
+			ct, err := a.acceptCard(c, name)
+			if err != nil {
+				a.cards.add(c)
+				return err
+			}
+			printResult(map[string]any{"name": name, "contact": ct}, fmt.Sprintf("%s = %s (introduced by %s)", name, ct.Peer, a.conversationLabel(c.Introducer)))
+			return nil
+		},
+	})
+}
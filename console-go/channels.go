@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+const channelsFile = "p2pchat_channels.json"
+
+// Channel upkeep: how long after startup, and then how often, heads of
+// our channels are republished and followed ones checked for missed
+// posts; and how many missed posts one catch-up fetches at most.
+const (
+	channelSyncWait     = 20 * time.Second
+	channelSyncInterval = time.Hour
+	maxChannelCatchUp   = 200
+)
+
+// channelState is how far a channel has got: the latest post we have.
+type channelState struct {
+	Seq  uint64 `json:"seq"`
+	Head string `json:"head,omitempty"` // CID of post Seq
+}
+
+// channelBook is the channels we publish and follow, persisted to
+// channelsFile in the data directory.
+type channelBook struct {
+	mu        sync.Mutex
+	path      string
+	Own       map[string]channelState `json:"own"`       // by name
+	Following map[string]channelState `json:"following"` // by channel ID
+}
+
+func loadChannels(path string) (*channelBook, error) {
+	b := &channelBook{path: path, Own: make(map[string]channelState), Following: make(map[string]channelState)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+// save writes the book; callers hold b.mu.
+func (b *channelBook) save() {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err == nil {
+		err = os.WriteFile(b.path, data, 0600)
+	}
+	if err != nil {
+		logger.Warnf("saving channels: %s", err)
+	}
+}
+
+// advance records post seq, c, of a followed channel if it's newer than
+// what we have; it reports whether it was.
+func (b *channelBook) advance(id string, seq uint64, c cid.Cid) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.Following[id]
+	if !ok || seq <= st.Seq {
+		return false
+	}
+	b.Following[id] = channelState{Seq: seq, Head: c.String()}
+	b.save()
+	return true
+}
+
+// snapshot copies the states of our channels and of followed ones.
+func (b *channelBook) snapshot() (own map[string]channelState, following map[string]channelState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	own = make(map[string]channelState, len(b.Own))
+	for k, v := range b.Own {
+		own[k] = v
+	}
+	following = make(map[string]channelState, len(b.Following))
+	for k, v := range b.Following {
+		following[k] = v
+	}
+	return own, following
+}
+
+func (b *channelBook) following(id string) (channelState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.Following[id]
+	return st, ok
+}
+
+// channelSubs are the pubsub topics of channels we publish or follow.
+type channelSubs struct {
+	mu   sync.Mutex
+	subs map[string]*room // by channel ID
+}
+
+// channelTopic joins a channel's topic, reading posts from it if we
+// follow the channel.
+func (a *app) channelTopic(id string, follow bool) (*pubsub.Topic, error) {
+	cs := a.channelSubs
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if r, ok := cs.subs[id]; ok {
+		return r.topic, nil
+	}
+	topic, err := a.rooms.ps.Join(node.ChannelTopicPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(a.ctx)
+	r := &room{name: id, topic: topic, cancel: cancel}
+	// A publisher subscribes too, so it's part of the topic's mesh.
+	if r.sub, err = topic.Subscribe(); err != nil {
+		cancel()
+		topic.Close()
+		return nil, err
+	}
+	cs.subs[id] = r
+	if follow {
+		go a.readChannel(ctx, r)
+	}
+	return topic, nil
+}
+
+func (a *app) leaveChannelTopic(id string) {
+	cs := a.channelSubs
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if r, ok := cs.subs[id]; ok {
+		r.cancel()
+		r.sub.Cancel()
+		r.topic.Close()
+		delete(cs.subs, id)
+	}
+}
+
+func (a *app) readChannel(ctx context.Context, r *room) {
+	for {
+		msg, err := r.sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		if msg.ReceivedFrom == a.h.ID() {
+			continue
+		}
+		p, err := node.DecodeChannelPost(msg.Data)
+		if err != nil || p.Channel != r.name {
+			logger.Debugf("invalid post in channel %s from %s: %v", r.name, msg.ReceivedFrom, err)
+			continue
+		}
+		st, ok := a.channels.following(r.name)
+		if !ok || p.Seq <= st.Seq {
+			continue
+		}
+		c, err := a.blocks.PutChannelPost(p)
+		if err != nil {
+			logger.Warnf("storing channel post: %s", err)
+			continue
+		}
+		if p.Seq == st.Seq+1 {
+			a.channelPosts(r.name, []node.ChannelPost{p}, c)
+			continue
+		}
+		// Posts were missed: walk back to the last one we have.
+		go a.catchUpChannel(r.name, c, msg.ReceivedFrom)
+	}
+}
+
+// catchUpChannel fetches the posts of channel id between the one we have
+// and head, from its publisher, via, and anyone serving blocks.
+func (a *app) catchUpChannel(id string, head cid.Cid, via peer.ID) (int, error) {
+	st, ok := a.channels.following(id)
+	if !ok {
+		return 0, fmt.Errorf("not following %s", id)
+	}
+	pub, _, _ := node.ParseChannelID(id)
+	peers := a.blockPeers(pub.String())
+	if via != "" && via != pub && via != a.h.ID() {
+		peers = append(peers, via)
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, 2*time.Minute)
+	defer cancel()
+	// Posts beyond the catch-up limit, the oldest, are skipped.
+	posts, err := a.node.FetchChannelPosts(ctx, peers, id, head, st.Seq, maxChannelCatchUp)
+	if len(posts) > 0 {
+		last, _ := a.blocks.PutChannelPost(posts[len(posts)-1])
+		a.channelPosts(id, posts, last)
+	}
+	return len(posts), err
+}
+
+// channelPosts shows new posts of channel id, oldest first, and records
+// the last, c, as the latest we have.
+func (a *app) channelPosts(id string, posts []node.ChannelPost, c cid.Cid) {
+	if !a.channels.advance(id, posts[len(posts)-1].Seq, c) {
+		return
+	}
+	pub, name, _ := node.ParseChannelID(id)
+	label := a.conversationLabel(pub.String()) + "/" + name
+	for _, p := range posts {
+		if jsonOutput {
+			printJSON(map[string]any{"event": "channel_post", "post": p})
+			continue
+		}
+		when := time.UnixMilli(p.When).Format(time.RFC3339)
+		fmt.Printf("\n<channel %s #%d when=%s> %s%s\n%s", styles.room(label), p.Seq, styles.dim(when), styles.body(p.Body), fileLines(Message{Files: p.Files}), a.prompt())
+	}
+}
+
+// syncChannel catches up with a followed channel's head in the DHT.
+func (a *app) syncChannel(id string) (int, error) {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Minute)
+	h, err := a.node.ResolveChannelHead(ctx, id)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	st, ok := a.channels.following(id)
+	if !ok || h.Seq <= st.Seq {
+		return 0, nil
+	}
+	head, err := cid.Decode(h.Head)
+	if err != nil {
+		return 0, err
+	}
+	return a.catchUpChannel(id, head, "")
+}
+
+func (a *app) publishChannelHead(name string, st channelState) {
+	head, err := cid.Decode(st.Head)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, time.Minute)
+	defer cancel()
+	if err := a.node.PublishChannelHead(ctx, name, st.Seq, head); err != nil {
+		logger.Debugf("publishing head of channel %s: %s", name, err)
+	}
+}
+
+// startChannels joins the topics of our channels and followed ones, and
+// keeps heads published and followed channels caught up.
+func (a *app) startChannels() {
+	own, followed := a.channels.snapshot()
+	for name := range own {
+		if _, err := a.channelTopic(node.ChannelID(a.h.ID(), name), false); err != nil {
+			logger.Warnf("channel %s: %s", name, err)
+		}
+	}
+	for id := range followed {
+		if _, err := a.channelTopic(id, true); err != nil {
+			logger.Warnf("channel %s: %s", id, err)
+		}
+	}
+	go func() {
+		wait := channelSyncWait
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			wait = channelSyncInterval
+			own, followed := a.channels.snapshot()
+			for name, st := range own {
+				a.publishChannelHead(name, st)
+			}
+			for id := range followed {
+				if _, err := a.syncChannel(id); err != nil {
+					logger.Debugf("catching up with channel %s: %s", id, err)
+				}
+			}
+		}
+	}()
+}
+
+// postToChannel signs the next post of our channel name, creating it on
+// the first post, announces it and publishes the new head.
+func (a *app) postToChannel(name, body string) (node.ChannelPost, error) {
+	a.channels.mu.Lock()
+	st := a.channels.Own[name]
+	prev := cid.Undef
+	if st.Head != "" {
+		prev, _ = cid.Decode(st.Head)
+	}
+	p, err := a.node.NewChannelPost(name, st.Seq+1, prev, body, nil)
+	if err != nil {
+		a.channels.mu.Unlock()
+		return p, err
+	}
+	c, err := a.blocks.PutChannelPost(p)
+	if err != nil {
+		a.channels.mu.Unlock()
+		return p, err
+	}
+	st = channelState{Seq: p.Seq, Head: c.String()}
+	a.channels.Own[name] = st
+	a.channels.save()
+	a.channels.mu.Unlock()
+
+	topic, err := a.channelTopic(p.Channel, false)
+	if err != nil {
+		return p, err
+	}
+	b, _ := json.Marshal(p)
+	if err := topic.Publish(a.ctx, b); err != nil {
+		return p, err
+	}
+	go a.publishChannelHead(name, st)
+	return p, nil
+}
+
+// channelID resolves "<publisher>/<name>", where the publisher may be a
+// contact name, or the bare name of one of our own channels.
+func (a *app) channelID(s string) (string, error) {
+	pub, name, ok := strings.Cut(s, "/")
+	if !ok {
+		pub, name = a.h.ID().String(), s
+	}
+	id := a.contacts.peerID(pub) + "/" + name
+	if _, _, err := node.ParseChannelID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// channelLog reads the last n posts of channel id we have, oldest first.
+func (a *app) channelLog(id string, n int) ([]node.ChannelPost, error) {
+	pub, name, _ := node.ParseChannelID(id)
+	a.channels.mu.Lock()
+	st, ok := a.channels.Following[id]
+	if pub == a.h.ID() {
+		st, ok = a.channels.Own[name]
+	}
+	a.channels.mu.Unlock()
+	if !ok || st.Head == "" {
+		return nil, fmt.Errorf("no posts of %s", id)
+	}
+	var posts []node.ChannelPost
+	for s := st.Head; s != "" && len(posts) < n; {
+		c, err := cid.Decode(s)
+		if err != nil {
+			break
+		}
+		p, err := a.blocks.ChannelPost(c)
+		if err != nil {
+			break
+		}
+		posts = append(posts, p)
+		s = p.Prev
+	}
+	for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+		posts[i], posts[j] = posts[j], posts[i]
+	}
+	return posts, nil
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "channel",
+		Usage:   "post <name> <text> | follow <publisher>/<name> | unfollow <publisher>/<name> | read <[publisher/]name> [n] | sync",
+		Summary: "broadcast channels: one-to-many feeds of signed posts you publish, or follow by publisher and name; alone, list them",
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) == 0 {
+				own, following := a.channels.snapshot()
+				if jsonOutput {
+					printJSON(map[string]any{"own": own, "following": following})
+					return nil
+				}
+				if len(own)+len(following) == 0 {
+					fmt.Println("no channels; 'channel post <name> <text>' starts one, 'channel follow <publisher>/<name>' follows one")
+				}
+				var lines []string
+				for name, st := range own {
+					lines = append(lines, fmt.Sprintf(" - %s (yours, %d posts): %s", name, st.Seq, node.ChannelID(a.h.ID(), name)))
+				}
+				for id, st := range following {
+					pub, name, _ := node.ParseChannelID(id)
+					lines = append(lines, fmt.Sprintf(" - %s/%s (following, at #%d)", a.conversationLabel(pub.String()), name, st.Seq))
+				}
+				sort.Strings(lines)
+				for _, l := range lines {
+					fmt.Println(l)
+				}
+				return nil
+			}
+			switch inv.Args[0] {
+			case "post":
+				if len(inv.Args) < 3 {
+					return errors.New("usage: channel post <name> <text>")
+				}
+				p, err := a.postToChannel(inv.Args[1], inv.Tail(2))
+				if err != nil {
+					return err
+				}
+				printResult(map[string]any{"post": p}, fmt.Sprintf("posted #%d to %s", p.Seq, p.Channel))
+				return nil
+			case "follow", "unfollow":
+				if len(inv.Args) != 2 {
+					return fmt.Errorf("usage: channel %s <publisher>/<name>", inv.Args[0])
+				}
+				id, err := a.channelID(inv.Args[1])
+				if err != nil {
+					return err
+				}
+				if pub, _, _ := node.ParseChannelID(id); pub == a.h.ID() {
+					return errors.New("that's your own channel")
+				}
+				a.channels.mu.Lock()
+				if inv.Args[0] == "follow" {
+					if _, ok := a.channels.Following[id]; !ok {
+						a.channels.Following[id] = channelState{}
+					}
+				} else {
+					delete(a.channels.Following, id)
+				}
+				a.channels.save()
+				a.channels.mu.Unlock()
+				if inv.Args[0] == "unfollow" {
+					a.leaveChannelTopic(id)
+					fmt.Println("unfollowed", id)
+					return nil
+				}
+				if _, err := a.channelTopic(id, true); err != nil {
+					return err
+				}
+				fmt.Println("following", id)
+				go func() {
+					if _, err := a.syncChannel(id); err != nil {
+						logger.Debugf("catching up with channel %s: %s", id, err)
+					}
+				}()
+				return nil
+			case "read":
+				if len(inv.Args) < 2 {
+					return errors.New("usage: channel read <[publisher/]name> [n]")
+				}
+				id, err := a.channelID(inv.Args[1])
+				if err != nil {
+					return err
+				}
+				n := 20
+				if len(inv.Args) > 2 {
+					if n, err = strconv.Atoi(inv.Args[2]); err != nil || n < 1 {
+						return fmt.Errorf("bad count %q", inv.Args[2])
+					}
+				}
+				posts, err := a.channelLog(id, n)
+				if err != nil {
+					return err
+				}
+				if jsonOutput {
+					printJSON(map[string]any{"channel": id, "posts": posts})
+					return nil
+				}
+				for _, p := range posts {
+					when := time.UnixMilli(p.When).Format(time.RFC3339)
+					fmt.Printf("#%d %s %s%s\n", p.Seq, styles.dim(when), styles.body(p.Body), fileLines(Message{Files: p.Files}))
+				}
+				return nil
+			case "sync":
+				_, followed := a.channels.snapshot()
+				total := 0
+				for id := range followed {
+					added, err := a.syncChannel(id)
+					if err != nil {
+						fmt.Printf("%s: %s\n", id, err)
+					}
+					total += added
+				}
+				printResult(map[string]int{"fetched": total}, fmt.Sprintf("fetched %d missed posts", total))
+				return nil
+			}
+			return fmt.Errorf("unknown channel subcommand %q", inv.Args[0])
+		},
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// subcommand is a first-argument command of the binary. Without one the
+// binary runs the chat client.
+type subcommand struct {
+	name    string
+	usage   string // argument synopsis after the flags, e.g. "<peer> <message>"
+	summary string
+	details string // extra help text, e.g. exit codes
+	hidden  bool   // left out of help and completion
+	// flags defines the subcommand's flags; completion and help use it
+	// on a scratch FlagSet.
+	flags func(fs *flag.FlagSet)
+	// args names what positional arguments complete to: "contacts",
+	// "shells" or nothing.
+	args string
+	run  func(args []string) int
+}
+
+// subcommands is filled in init, since the run functions look their own
+// entries up for help.
+var subcommands []subcommand
+
+func init() {
+	subcommands = []subcommand{
+		{
+			name:    "init",
+			summary: "set up an identity, listen options and relays interactively, and print an invite",
+			flags:   func(fs *flag.FlagSet) { setupFlags(fs) },
+			run:     setupWizard,
+		},
+		{
+			name:    "identity",
+			usage:   "show | export | import [file|-] | revoke-cert",
+			summary: "show the identity's fingerprint, export/import it, or make a revocation certificate",
+			details: "export asks before writing the key; import shows both fingerprints and asks before replacing, keeping the old key as a .bak file",
+			flags:   func(fs *flag.FlagSet) { new(identityOptions).flags(fs) },
+			run:     identityCmd,
+		},
+		{
+			name:    "send",
+			usage:   "<peerID|contact|multiaddr> <message|->",
+			summary: "deliver one message, wait for the acknowledgement and exit",
+			details: "a message of - is read from standard input; one over 64 KiB can only be stored, split into parts (up to 1 MiB)\nexit status: 0 delivered, 1 failed, 2 usage error, 3 stored for offline delivery",
+			flags:   func(fs *flag.FlagSet) { new(sendOptions).flags(fs) },
+			args:    "contacts",
+			run:     sendOnce,
+		},
+		{
+			name:    "serve-relay",
+			summary: "run a headless relay (with --supernode: mailboxes and rendezvous too)",
+			flags:   func(fs *flag.FlagSet) { new(relayConfig).flags(fs) },
+			run:     serveRelay,
+		},
+		{
+			name:    "simulate",
+			summary: "run nodes on an in-memory network and check message delivery",
+			flags:   func(fs *flag.FlagSet) { new(simOptions).flags(fs) },
+			run:     simulate,
+		},
+		{
+			name:    "completion",
+			usage:   "bash|zsh|fish",
+			summary: "print a shell completion script",
+			args:    "shells",
+			run:     completion,
+		},
+		{
+			name:    "help",
+			usage:   "[subcommand]",
+			summary: "show the subcommands, or one subcommand's flags",
+			run:     subcommandHelp,
+		},
+		{name: "__complete", hidden: true, run: completeQuery},
+	}
+}
+
+func lookupSubcommand(name string) *subcommand {
+	for i := range subcommands {
+		if subcommands[i].name == name {
+			return &subcommands[i]
+		}
+	}
+	return nil
+}
+
+func visibleSubcommands() []subcommand {
+	var out []subcommand
+	for _, sc := range subcommands {
+		if !sc.hidden {
+			out = append(out, sc)
+		}
+	}
+	return out
+}
+
+func progName() string { return filepath.Base(os.Args[0]) }
+
+// subcommandFlags returns the FlagSet a subcommand parses its arguments
+// with; -h prints the same help as 'help <name>'.
+func subcommandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		if sc := lookupSubcommand(name); sc != nil {
+			sc.printHelp(fs)
+		}
+	}
+	return fs
+}
+
+// printHelp prints usage, summary and the flags defined on fs.
+func (sc *subcommand) printHelp(fs *flag.FlagSet) {
+	out := fs.Output()
+	synopsis := progName() + " " + sc.name
+	hasFlags := false
+	fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		synopsis += " [flags]"
+	}
+	if sc.usage != "" {
+		synopsis += " " + sc.usage
+	}
+	fmt.Fprintf(out, "usage: %s\n\n%s\n", synopsis, sc.summary)
+	if sc.details != "" {
+		fmt.Fprintf(out, "%s\n", sc.details)
+	}
+	if hasFlags {
+		fmt.Fprintln(out, "\nflags:")
+		fs.PrintDefaults()
+	}
+}
+
+// subcommandHelp runs 'help [subcommand]'.
+func subcommandHelp(args []string) int {
+	if len(args) > 0 {
+		sc := lookupSubcommand(args[0])
+		if sc == nil || sc.hidden {
+			fmt.Printf("unknown subcommand %q\n", args[0])
+			return exitUsage
+		}
+		fs := flag.NewFlagSet(sc.name, flag.ContinueOnError)
+		fs.SetOutput(os.Stdout)
+		if sc.flags != nil {
+			sc.flags(fs)
+		}
+		sc.printHelp(fs)
+		return exitOK
+	}
+	prog := progName()
+	fmt.Printf("usage: %s [flags]                 start the chat client ('%s -h' lists its flags)\n", prog, prog)
+	fmt.Printf("       %s <subcommand> [flags] ...\n\nsubcommands:\n", prog)
+	for _, sc := range visibleSubcommands() {
+		fmt.Printf("  %-12s %s\n", sc.name, sc.summary)
+	}
+	fmt.Printf("\n'%s help <subcommand>' or '%s <subcommand> -h' shows its flags.\n", prog, prog)
+	fmt.Println("Inside the client, 'help' lists commands and 'help <command>' explains one.")
+	return exitOK
+}
+
+// clientUsage is the chat client's -h output.
+func clientUsage() {
+	prog := progName()
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags]\n\nStarts the chat client. '%s help' lists the subcommands.\n\nflags:\n", prog, prog)
+	flag.PrintDefaults()
+}
+
+// runSubcommand runs args[0] if it names a subcommand; any other word is
+// an error. Old releases took
+// --supernode as the first flag, so that still means 'serve-relay --supernode'.
+func runSubcommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	if args[0] == "--supernode" || args[0] == "-supernode" {
+		return serveRelay(args), true
+	}
+	if strings.HasPrefix(args[0], "-") {
+		return 0, false
+	}
+	sc := lookupSubcommand(args[0])
+	if sc == nil {
+		fmt.Printf("unknown subcommand %q; see '%s help'\n", args[0], progName())
+		return exitUsage, true
+	}
+	return sc.run(args[1:]), true
+}
@@ -0,0 +1,394 @@
+// Command peep-gui is a desktop front end for peep-chat built on Fyne. It
+// runs the same node package as the console client and, by default, the
+// same identity file, so both show up as the same peer.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	fyneapp "fyne.io/fyne/v2/app"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/widget"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+	"p2p-chat/paths"
+)
+
+// conversation is the history with one peer, as shown.
+type conversation struct {
+	lines  []string
+	unread int
+}
+
+// ui holds the window state. Everything under mu is touched from libp2p
+// goroutines as well as the Fyne event loop.
+type ui struct {
+	ctx  context.Context
+	n    *node.Node
+	app  fyne.App
+	win  fyne.Window
+	self string
+	// log and blocks are the console client's chat log and blockstore.
+	log    *node.ChatLog
+	blocks *node.Blockstore
+
+	mu       sync.Mutex
+	convs    map[string]*conversation
+	contacts []string
+	current  string
+
+	contactList *widget.List
+	history     *widget.List
+	input       *widget.Entry
+}
+
+func main() {
+	identity := flag.String("identity", paths.DefaultIdentityPath(), "identity key file (shared with the console client)")
+	flag.Parse()
+
+	ctx := context.Background()
+	n, err := node.New(ctx, node.Options{IdentityPath: *identity, Passphrase: node.EnvPassphrase})
+	if err != nil {
+		fmt.Println("failed to start node:", err)
+		return
+	}
+	defer n.Close()
+	log, entries, err := node.OpenChatLog(node.ChatLogPath(*identity))
+	if err != nil {
+		fmt.Println("failed to load chat log:", err)
+		return
+	}
+	blocks, err := node.OpenBlockstore(filepath.Join(filepath.Dir(*identity), node.BlocksDir))
+	if err != nil {
+		fmt.Println("failed to open blockstore:", err)
+		return
+	}
+	n.ServeBlocks(blocks)
+
+	a := fyneapp.NewWithID("chat.peep.gui")
+	u := &ui{ctx: ctx, n: n, app: a, self: n.ID().String(), log: log, blocks: blocks, convs: make(map[string]*conversation)}
+	u.win = a.NewWindow("peep-chat — " + shortID(u.self))
+	u.build()
+	for _, e := range entries {
+		// Rooms are the console client's alone.
+		if !strings.HasPrefix(e.Conversation, "#") {
+			u.addContact(e.Conversation)
+			u.appendLine(e.Conversation, e.Message, "")
+		}
+	}
+
+	n.OnMessage(func(from peer.ID, m node.Message) { u.received(from.String(), m) })
+	held, err := node.TakeHeld(node.HeldPath(*identity))
+	if err != nil {
+		fmt.Println("reading held messages:", err)
+	}
+	for _, m := range held {
+		u.received(m.From, m)
+	}
+	n.Host().Network().Notify(&network.NotifyBundle{
+		ConnectedF:    func(_ network.Network, c network.Conn) { u.addContact(c.RemotePeer().String()) },
+		DisconnectedF: func(_ network.Network, _ network.Conn) { u.refresh() },
+	})
+
+	u.win.Resize(fyne.NewSize(800, 520))
+	u.win.ShowAndRun()
+}
+
+func (u *ui) build() {
+	u.contactList = widget.NewList(
+		func() int {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			return len(u.contacts)
+		},
+		func() fyne.CanvasObject { return widget.NewLabel("") },
+		func(i widget.ListItemID, o fyne.CanvasObject) {
+			o.(*widget.Label).SetText(u.contactLabel(i))
+		},
+	)
+	u.contactList.OnSelected = func(i widget.ListItemID) {
+		u.mu.Lock()
+		if i < len(u.contacts) {
+			u.current = u.contacts[i]
+			u.conv(u.current).unread = 0
+		}
+		u.mu.Unlock()
+		u.refresh()
+	}
+
+	u.history = widget.NewList(
+		func() int {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			if u.current == "" {
+				return 0
+			}
+			return len(u.conv(u.current).lines)
+		},
+		func() fyne.CanvasObject {
+			l := widget.NewLabel("")
+			l.Wrapping = fyne.TextWrapWord
+			return l
+		},
+		func(i widget.ListItemID, o fyne.CanvasObject) {
+			u.mu.Lock()
+			var text string
+			if lines := u.conv(u.current).lines; i < len(lines) {
+				text = lines[i]
+			}
+			u.mu.Unlock()
+			o.(*widget.Label).SetText(text)
+		},
+	)
+
+	u.input = widget.NewEntry()
+	u.input.SetPlaceHolder("Type a message, or drop files here")
+	u.input.OnSubmitted = func(string) { u.sendInput() }
+	send := widget.NewButton("Send", u.sendInput)
+
+	toolbar := container.NewHBox(
+		widget.NewButton("Connect…", u.showConnect),
+		widget.NewButton("Copy invite", u.copyInvite),
+		widget.NewButton("Fetch offline", u.fetchOffline),
+	)
+	right := container.NewBorder(nil, container.NewBorder(nil, nil, nil, send, u.input), nil, nil, u.history)
+	split := container.NewHSplit(u.contactList, right)
+	split.Offset = 0.3
+	u.win.SetContent(container.NewBorder(toolbar, nil, nil, nil, split))
+	u.win.SetOnDropped(u.dropped)
+}
+
+// conv returns the conversation with peerID; callers hold u.mu.
+func (u *ui) conv(peerID string) *conversation {
+	c, ok := u.convs[peerID]
+	if !ok {
+		c = &conversation{}
+		u.convs[peerID] = c
+	}
+	return c
+}
+
+func (u *ui) contactLabel(i int) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if i >= len(u.contacts) {
+		return ""
+	}
+	id := u.contacts[i]
+	label := shortID(id)
+	if u.n.Host().Network().Connectedness(peerIDOrEmpty(id)) != network.Connected {
+		label += " (offline)"
+	}
+	if c := u.conv(id); c.unread > 0 {
+		label += fmt.Sprintf(" • %d", c.unread)
+	}
+	return label
+}
+
+func (u *ui) addContact(peerID string) {
+	u.mu.Lock()
+	if _, ok := u.convs[peerID]; !ok {
+		u.conv(peerID)
+		u.contacts = append(u.contacts, peerID)
+		sort.Strings(u.contacts)
+	}
+	u.mu.Unlock()
+	u.refresh()
+}
+
+// appendLine shows m in the conversation with peerID, with note after it.
+func (u *ui) appendLine(peerID string, m node.Message, note string) {
+	who := shortID(m.From)
+	if m.From == u.self {
+		who = "me"
+	}
+	line := fmt.Sprintf("[%s] %s: %s%s", time.UnixMilli(m.When).Format("15:04"), who, m.Body, note)
+	for _, f := range m.Files {
+		line += fmt.Sprintf("\n  [file] %s (%d bytes)", f.Name, f.Size)
+	}
+	u.mu.Lock()
+	c := u.conv(peerID)
+	c.lines = append(c.lines, line)
+	u.mu.Unlock()
+}
+
+// record shows m and adds it to the chat log.
+func (u *ui) record(peerID string, m node.Message, note string) {
+	u.appendLine(peerID, m, note)
+	if err := u.log.Append(peerID, m); err != nil {
+		fmt.Println("saving chat log:", err)
+	}
+}
+
+func (u *ui) received(peerID string, m node.Message) {
+	u.addContact(peerID)
+	u.record(peerID, m, "")
+	u.mu.Lock()
+	focused := u.current == peerID
+	if !focused {
+		u.conv(peerID).unread++
+	}
+	u.mu.Unlock()
+	if !focused {
+		u.app.SendNotification(fyne.NewNotification("Message from "+shortID(peerID), m.Body))
+	}
+	u.refresh()
+}
+
+func (u *ui) refresh() {
+	u.contactList.Refresh()
+	u.history.Refresh()
+	u.history.ScrollToBottom()
+}
+
+func (u *ui) target() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.current
+}
+
+func (u *ui) sendInput() {
+	body := strings.TrimSpace(u.input.Text)
+	if body == "" {
+		return
+	}
+	if u.send(body) {
+		u.input.SetText("")
+	}
+}
+
+// send delivers body to the selected contact, falling back to the mailbox
+// their DHT inbox pointer names when they're offline.
+func (u *ui) send(body string) bool {
+	to := u.target()
+	if to == "" {
+		dialog.ShowInformation("No contact selected", "Pick a contact on the left first.", u.win)
+		return false
+	}
+	m, err := u.n.Send(u.ctx, to, body)
+	note := ""
+	if err != nil {
+		if m, err = u.n.StoreOffline(u.ctx, to, body); err != nil {
+			dialog.ShowError(err, u.win)
+			return false
+		}
+		note = " (stored for offline delivery)"
+	}
+	u.record(to, m, note)
+	u.refresh()
+	return true
+}
+
+// dropped sends dropped files to the selected contact in one message. They
+// go into the blockstore, which the peer fetches them from while we're
+// online, as with the console client's attach.
+func (u *ui) dropped(_ fyne.Position, uris []fyne.URI) {
+	to := u.target()
+	if to == "" {
+		dialog.ShowInformation("No contact selected", "Pick a contact on the left first.", u.win)
+		return
+	}
+	var refs []node.FileRef
+	for _, uri := range uris {
+		r, err := storage.Reader(uri)
+		if err != nil {
+			dialog.ShowError(err, u.win)
+			continue
+		}
+		ref, err := u.blocks.PutFile(uri.Name(), r)
+		r.Close()
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("%s: %w", uri.Name(), err), u.win)
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	if len(refs) == 0 {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(u.ctx, 30*time.Second)
+		defer cancel()
+		m, err := u.n.SendFiles(ctx, to, "", refs)
+		if err != nil {
+			dialog.ShowError(err, u.win)
+			return
+		}
+		u.record(to, m, "")
+		u.refresh()
+	}()
+}
+
+func (u *ui) showConnect() {
+	entry := widget.NewEntry()
+	entry.SetPlaceHolder("/ip4/…/p2p/12D3KooW…")
+	dialog.ShowForm("Connect to peer", "Connect", "Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Invite", entry)},
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			go func() {
+				id, err := u.n.Connect(u.ctx, strings.TrimSpace(entry.Text))
+				if err != nil {
+					dialog.ShowError(err, u.win)
+					return
+				}
+				u.addContact(id.String())
+			}()
+		}, u.win)
+}
+
+func (u *ui) copyInvite() {
+	invites := u.n.InviteAddrs()
+	if len(invites) == 0 {
+		dialog.ShowInformation("No invite", "No listen addresses available.", u.win)
+		return
+	}
+	u.win.Clipboard().SetContent(invites[0])
+	dialog.ShowInformation("Invite copied", invites[0], u.win)
+}
+
+func (u *ui) fetchOffline() {
+	go func() {
+		msgs, err := u.n.FetchOffline(u.ctx, u.self)
+		if err != nil {
+			dialog.ShowError(err, u.win)
+			return
+		}
+		for _, f := range msgs {
+			u.addContact(f.From)
+			if f.Verification != node.Verified {
+				// Shown as a warning, never kept.
+				u.appendLine(f.From, f.Message, " (invalid: "+f.Problem+")")
+				continue
+			}
+			u.record(f.From, f.Message, "")
+		}
+		u.refresh()
+	}()
+}
+
+func peerIDOrEmpty(s string) peer.ID {
+	id, _ := peer.Decode(s)
+	return id
+}
+
+func shortID(id string) string {
+	if len(id) <= 12 {
+		return id
+	}
+	return id[:6] + "…" + id[len(id)-6:]
+}
@@ -0,0 +1,200 @@
+// Command peep-tray keeps a peep-chat node online from the system tray, so
+// you stay reachable without a terminal open. What arrives is held in
+// node.HeldFile, next to the identity, and the tray shows how many messages
+// are waiting; opening the GUI or the console client hands the identity
+// over to it, it shows the held messages, and the agent takes the identity
+// back once that front end exits.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"fyne.io/systray"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+	"p2p-chat/paths"
+)
+
+type agent struct {
+	ctx      context.Context
+	identity string
+
+	mu     sync.Mutex
+	n      *node.Node
+	unread map[string]int
+
+	status *systray.MenuItem
+}
+
+func main() {
+	identity := flag.String("identity", paths.DefaultIdentityPath(), "identity key file (shared with the console client and GUI)")
+	gui := flag.String("gui", "peep-gui", "command that starts the GUI")
+	console := flag.String("console", defaultConsole(), "command that opens the console client in a terminal")
+	flag.Parse()
+
+	ag := &agent{ctx: context.Background(), identity: *identity, unread: make(map[string]int)}
+	if err := ag.start(); err != nil {
+		fmt.Println("failed to start node:", err)
+		return
+	}
+	systray.Run(func() { ag.ready(*gui, *console) }, ag.stop)
+}
+
+func (ag *agent) ready(gui, console string) {
+	systray.SetTitle("peep")
+	ag.status = systray.AddMenuItem("", "")
+	ag.status.Disable()
+	systray.AddSeparator()
+	openGUI := systray.AddMenuItem("Open GUI", "Hand the node over to peep-gui")
+	openConsole := systray.AddMenuItem("Open console", "Hand the node over to the console client")
+	systray.AddSeparator()
+	quit := systray.AddMenuItem("Quit", "Take the node offline")
+	ag.update()
+
+	go func() {
+		for {
+			select {
+			case <-openGUI.ClickedCh:
+				ag.handOver(gui)
+			case <-openConsole.ClickedCh:
+				ag.handOver(console)
+			case <-quit.ClickedCh:
+				systray.Quit()
+				return
+			}
+		}
+	}()
+}
+
+func (ag *agent) start() error {
+	n, err := node.New(ag.ctx, node.Options{IdentityPath: ag.identity, Passphrase: node.EnvPassphrase})
+	if err != nil {
+		return err
+	}
+	n.OnMessage(func(from peer.ID, m node.Message) {
+		if err := node.HoldMessage(node.HeldPath(ag.identity), m); err != nil {
+			fmt.Println("holding message from", from, "failed:", err)
+			return
+		}
+		ag.mu.Lock()
+		ag.unread[from.String()]++
+		ag.mu.Unlock()
+		ag.update()
+	})
+	ag.mu.Lock()
+	ag.n = n
+	ag.mu.Unlock()
+	return nil
+}
+
+func (ag *agent) stop() {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.n != nil {
+		ag.n.Close()
+		ag.n = nil
+	}
+}
+
+// handOver stops our node, runs cmdline until it exits, then brings the
+// node back. Running both at once would put two hosts on the same peer ID.
+func (ag *agent) handOver(cmdline string) {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return
+	}
+	ag.stop()
+	ag.mu.Lock()
+	ag.unread = make(map[string]int)
+	ag.mu.Unlock()
+	ag.setStatus("Handed over to " + args[0])
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Println("front end error:", err)
+	}
+	if err := ag.start(); err != nil {
+		fmt.Println("failed to restart node:", err)
+		ag.setStatus("Offline: " + err.Error())
+		return
+	}
+	ag.update()
+}
+
+func (ag *agent) update() {
+	ag.mu.Lock()
+	total, convs := 0, len(ag.unread)
+	for _, c := range ag.unread {
+		total += c
+	}
+	online := ag.n != nil
+	ag.mu.Unlock()
+
+	switch {
+	case !online:
+		ag.setStatus("Offline")
+	case total == 0:
+		ag.setStatus("Online, no new messages")
+	default:
+		ag.setStatus(fmt.Sprintf("%d new messages from %d peers", total, convs))
+	}
+	if total > 0 {
+		systray.SetTitle(fmt.Sprintf("peep (%d)", total))
+	} else {
+		systray.SetTitle("peep")
+	}
+	systray.SetIcon(trayIcon(total > 0))
+}
+
+func (ag *agent) setStatus(s string) {
+	if ag.status != nil {
+		ag.status.SetTitle(s)
+	}
+	systray.SetTooltip("peep-chat: " + s)
+}
+
+// trayIcon draws the tray icon: a blue dot, with a red badge when there
+// are unread messages.
+func trayIcon(badge bool) []byte {
+	const size = 32
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	disc := func(cx, cy, r int, c color.Color) {
+		for y := cy - r; y <= cy+r; y++ {
+			for x := cx - r; x <= cx+r; x++ {
+				if (x-cx)*(x-cx)+(y-cy)*(y-cy) <= r*r {
+					img.Set(x, y, c)
+				}
+			}
+		}
+	}
+	disc(15, 16, 13, color.NRGBA{0x2d, 0x7f, 0xf9, 0xff})
+	if badge {
+		disc(24, 8, 7, color.NRGBA{0xe5, 0x39, 0x35, 0xff})
+	}
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func defaultConsole() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "open -W -a Terminal p2p-chat"
+	case "windows":
+		return "cmd /C start /WAIT p2p-chat"
+	}
+	return "x-terminal-emulator -e p2p-chat"
+}
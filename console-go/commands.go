@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+// errQuit is returned by a command handler to end the interactive session.
+var errQuit = errors.New("quit")
+
+// errCommandFailed is returned by dispatch for unknown commands and bad
+// arguments; the message has already been printed.
+var errCommandFailed = errors.New("command failed")
+
+// command is one entry in the interactive command registry. Modules register
+// their commands from init(); plugins may register more at runtime.
+type command struct {
+	Name    string
+	Aliases []string
+	Usage   string // argument synopsis shown after the name, e.g. "<peerID> <message>"
+	Summary string
+	MinArgs int
+	// Flags declares the command's flags, if any. It's called on a fresh
+	// FlagSet for every invocation.
+	Flags func(fs *flag.FlagSet)
+	Run   func(a *app, inv *invocation) error
+	// Background commands wait on the network; typed at the prompt they
+	// run in a worker so the prompt comes straight back.
+	Background bool
+}
+
+func (c *command) synopsis() string {
+	if c.Usage == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Usage
+}
+
+// invocation is a parsed command line handed to a command's Run.
+type invocation struct {
+	Name  string
+	Args  []string      // positional arguments (after flag parsing)
+	Flags *flag.FlagSet // nil if the command declares no flags
+	text  string        // raw text after the command name
+	ctx   context.Context
+}
+
+// Int returns the value of an int flag the command declared in Flags.
+func (inv *invocation) Int(name string) int {
+	return inv.Flags.Lookup(name).Value.(flag.Getter).Get().(int)
+}
+
+// Bool returns the value of a bool flag the command declared in Flags.
+func (inv *invocation) Bool(name string) bool {
+	return inv.Flags.Lookup(name).Value.(flag.Getter).Get().(bool)
+}
+
+// Duration returns the value of a duration flag the command declared in Flags.
+func (inv *invocation) Duration(name string) time.Duration {
+	return inv.Flags.Lookup(name).Value.(flag.Getter).Get().(time.Duration)
+}
+
+// String returns the value of a string flag the command declared in Flags.
+func (inv *invocation) String(name string) string {
+	return inv.Flags.Lookup(name).Value.String()
+}
+
+// Tail returns the raw remainder of the line after the first n positional
+// arguments, preserving the user's spacing. It's how commands like msg take
+// a free-form message body.
+func (inv *invocation) Tail(n int) string {
+	return strings.TrimSpace(skipFields(inv.text, n))
+}
+
+// skipFields returns s after its first n whitespace-separated fields, the
+// ones strings.Fields would return, with the spacing after them intact.
+func skipFields(s string, n int) string {
+	for i := 0; i < n; i++ {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		j := strings.IndexFunc(s, unicode.IsSpace)
+		if j < 0 {
+			return ""
+		}
+		s = s[j:]
+	}
+	return s
+}
+
+// commandRegistry maps command names and aliases to their definitions.
+type commandRegistry struct {
+	mu     sync.RWMutex
+	byName map[string]*command
+	order  []*command
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{byName: make(map[string]*command)}
+}
+
+// commands is the registry the interactive prompt dispatches through.
+var commands = newCommandRegistry()
+
+// register adds c to the registry. Registering a name twice is an error so
+// plugins can't silently shadow built-in commands.
+func (r *commandRegistry) register(c *command) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := append([]string{c.Name}, c.Aliases...)
+	for _, n := range names {
+		if _, ok := r.byName[n]; ok {
+			return fmt.Errorf("command %q already registered", n)
+		}
+	}
+	for _, n := range names {
+		r.byName[n] = c
+	}
+	r.order = append(r.order, c)
+	return nil
+}
+
+// mustRegister is register for built-in commands, where a clash is a bug.
+func (r *commandRegistry) mustRegister(c *command) {
+	if err := r.register(c); err != nil {
+		panic(err)
+	}
+}
+
+// unregister removes a command and its aliases.
+func (r *commandRegistry) unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.byName[name]
+	if !ok {
+		return
+	}
+	delete(r.byName, c.Name)
+	for _, al := range c.Aliases {
+		delete(r.byName, al)
+	}
+	for i, o := range r.order {
+		if o == c {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (r *commandRegistry) lookup(name string) *command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byName[name]
+}
+
+// all returns the registered commands sorted by name.
+func (r *commandRegistry) all() []*command {
+	r.mu.RLock()
+	cmds := append([]*command(nil), r.order...)
+	r.mu.RUnlock()
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// dispatch parses line and runs the matching command. Failures are
+// printed; the returned error only tells batch mode that one happened.
+func (r *commandRegistry) dispatch(a *app, line string) error {
+	return r.dispatchDepth(a, line, 0)
+}
+
+// dispatchDepth is dispatch inside depth alias expansions; names that
+// aren't commands fall back to the user's aliases and macros.
+func (r *commandRegistry) dispatchDepth(a *app, line string, depth int) error {
+	name, text, _ := strings.Cut(strings.TrimSpace(line), " ")
+	c := r.lookup(name)
+	if c == nil && a.aliases != nil {
+		if lines, ok := a.aliases.expand(name, text); ok {
+			if depth == maxAliasDepth {
+				printError(name, name+": aliases nested too deeply")
+				return errCommandFailed
+			}
+			for _, l := range lines {
+				if err := r.dispatchDepth(a, l, depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	if c == nil {
+		printError(name, "unknown command. type 'help'")
+		return errCommandFailed
+	}
+	inv := &invocation{Name: name, Args: strings.Fields(text), text: text}
+	if t := strings.TrimSpace(text); t == "-h" || t == "-help" || t == "--help" {
+		printCommandHelp(c)
+		return nil
+	}
+	if c.Flags != nil {
+		fs := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		c.Flags(fs)
+		if err := fs.Parse(inv.Args); err != nil {
+			printError(c.Name, fmt.Sprintf("%s: %s\nusage: %s", c.Name, err, c.synopsis()))
+			return errCommandFailed
+		}
+		// The raw text goes on after the last word the flags took.
+		inv.text = skipFields(inv.text, len(inv.Args)-fs.NArg())
+		inv.Flags = fs
+		inv.Args = fs.Args()
+	}
+	if len(inv.Args) < c.MinArgs {
+		printError(c.Name, "usage: "+c.synopsis())
+		return errCommandFailed
+	}
+	ctx, done := running.start(a.ctx)
+	defer done()
+	inv.ctx = ctx
+	recent.note("command %s", c.Name)
+	err := a.runCommand(c, inv)
+	if err != nil && err != errQuit {
+		err = commandError(ctx, err)
+	}
+	if _, switching := err.(*accountSwitch); err != nil && err != errQuit && !switching {
+		printError(c.Name, fmt.Sprintf("%s error: %s", c.Name, err))
+	}
+	return err
+}
+
+// printError reports a failed command: the text as is, or an error event
+// in --json mode.
+func printError(command, text string) {
+	if jsonOutput {
+		printJSON(errorEvent{Event: "error", Command: command, Error: text})
+		return
+	}
+	fmt.Println(styles.err(text))
+}
+
+func printHelp() {
+	fmt.Println("commands:")
+	for _, c := range commands.all() {
+		fmt.Printf("  %-22s - %s\n", c.synopsis(), c.Summary)
+	}
+	fmt.Println("'help <command>' or '<command> -h' explains one.")
+}
+
+// printCommandHelp prints a command's synopsis, summary, aliases and flags.
+func printCommandHelp(c *command) {
+	fmt.Println("usage:", c.synopsis())
+	fmt.Println(c.Summary)
+	if len(c.Aliases) > 0 {
+		fmt.Println("aliases:", strings.Join(c.Aliases, ", "))
+	}
+	if c.Flags != nil {
+		fs := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+		fs.SetOutput(os.Stdout)
+		c.Flags(fs)
+		fmt.Println("flags:")
+		fs.PrintDefaults()
+	}
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "help",
+		Usage:   "[command]",
+		Summary: "list commands, or explain one",
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) == 0 {
+				printHelp()
+				return nil
+			}
+			c := commands.lookup(inv.Args[0])
+			if c == nil {
+				if lines, ok := a.aliases.expand(inv.Args[0], ""); ok {
+					fmt.Printf("%s is an alias for: %s\n", inv.Args[0], strings.Join(lines, "; "))
+					return nil
+				}
+				return fmt.Errorf("unknown command %q", inv.Args[0])
+			}
+			printCommandHelp(c)
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "quit",
+		Aliases: []string{"exit"},
+		Summary: "exit",
+		Run: func(a *app, inv *invocation) error {
+			fmt.Println("bye")
+			return errQuit
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "id",
+		Summary: "print your peer id",
+		Run: func(a *app, inv *invocation) error {
+			printResult(map[string]string{"peer_id": a.h.ID().String()}, a.h.ID().String())
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "peers",
+		Summary: "list connected peers",
+		Run: func(a *app, inv *invocation) error {
+			listPeers(a.h, a.unread)
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "invite",
+		Summary: "print invite multiaddr",
+		Run: func(a *app, inv *invocation) error {
+			printInvite(a.node)
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "connect",
+		Usage:   "<multiaddr>",
+		Summary: "connect to a peer using their invite string",
+		MinArgs: 1,
+		Run: func(a *app, inv *invocation) error {
+			return connectPeer(inv.Context(), a.node, inv.Args[0])
+		},
+	})
+	commands.mustRegister(&command{
+		Name:       "send",
+		Aliases:    []string{"msg", "store"}, // deprecated; each used to take one path only
+		Usage:      "<peerID|contact> <message>",
+		Summary:    "send a message however it can go: directly, else stored at a mailbox for when the peer is back, else by email, contacts or the outbox",
+		MinArgs:    2,
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			if inv.Name != "send" {
+				logger.Warnf("%s is deprecated and now sends like send", inv.Name)
+			}
+			_, err := a.send(inv.Context(), a.contacts.peerID(inv.Args[0]), inv.Tail(1))
+			return err
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "fetch",
+		Usage:   "[-show-invalid] <peerID>",
+		Summary: "collect your stored messages from your mailboxes (found through your DHT inbox pointer if you have none), each marked verified or invalid; for another peer, show its inbox pointer",
+		MinArgs: 1,
+		Flags: func(fs *flag.FlagSet) {
+			fs.Bool("show-invalid", false, "show the bodies of messages whose sender signature is invalid")
+		},
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			if mailboxes := a.mailbox.list(); len(mailboxes) > 0 && inv.Args[0] == a.h.ID().String() {
+				for _, mb := range mailboxes {
+					msgs, err := a.node.FetchMailbox(inv.Context(), mb)
+					if err != nil {
+						if len(mailboxes) == 1 {
+							return err
+						}
+						fmt.Printf("mailbox %s error: %s\n", shortID(mb.String()), err)
+						continue
+					}
+					if !jsonOutput {
+						fmt.Print("mailbox: ")
+					}
+					printFetched("mailbox", a.screenFetched(msgs), a.fetchedUntrusted, a.e2eFetched, inv.Bool("show-invalid"))
+				}
+				return nil
+			}
+			return fetchOfflineMessages(inv.Context(), a.node, inv.Args[0], a.screenFetched, a.fetchedUntrusted, a.e2eFetched, inv.Bool("show-invalid"))
+		},
+	})
+}
+
+// send gets body to target, a peer ID, however it can go: directly, else
+// stored at a mailbox, else as sendLater does. m is the message if it went
+// directly.
+func (a *app) send(ctx context.Context, target, body string) (m Message, err error) {
+	m, later, err := a.sendDirect(ctx, target, body)
+	if !later {
+		return m, err
+	}
+	logger.Debugf("send to %s: %s", target, err)
+	if a.contacts.requiresE2E(target) {
+		// Stored messages aren't end-to-end encrypted.
+		return Message{}, a.sendLater(target, body, err)
+	}
+	if storeErr := a.storeFor(ctx, target, body); storeErr != nil {
+		logger.Debugf("storing for %s: %s", target, storeErr)
+		return Message{}, a.sendLater(target, body, err)
+	}
+	return Message{}, nil
+}
+
+// sendDirect sends body to target over the chat stream we keep open to it,
+// opening one if need be. If it fails,
+// later says whether target is only unreachable, so the message can go
+// another way, rather than the message or target being at fault.
+func (a *app) sendDirect(ctx context.Context, target, body string) (m Message, later bool, err error) {
+	if _, err := peer.Decode(target); err != nil {
+		return m, false, fmt.Errorf("%q is not a contact or peer ID", target)
+	}
+	if err := a.e2eReady(target); err != nil {
+		return m, errors.Is(err, errNoDirectPath), err
+	}
+	done := a.noticeSlowSend(target)
+	m, err = a.node.Send(ctx, target, body)
+	done()
+	if err != nil {
+		return m, !errors.Is(err, node.ErrInvalidMessage) && !errors.Is(err, node.ErrBackpressure), err
+	}
+	printResult(map[string]any{"sent": target, "via": "direct", "message": m}, "sent")
+	a.messageSent(target, m)
+	return m, false, nil
+}
+
+// sendLater gets body to target, which err says can't be reached now, by
+// encrypted email, else through contacts, else the outbox.
+func (a *app) sendLater(target, body string, err error) error {
+	// Email is PGP encrypted, so it still suits require-e2e.
+	if a.email == nil || !a.email.canReach(target) {
+		if a.tryForward(target, body) {
+			a.sentIndirectly(target, body, "contacts, to forward")
+		} else {
+			a.queueMessage(target, body, err)
+		}
+		return nil
+	}
+	if mailErr := a.email.send(target, body); mailErr != nil {
+		return fmt.Errorf("%s (email fallback: %s)", err, mailErr)
+	}
+	printResult(map[string]string{"sent": target, "via": "email"}, "peer unreachable; sent by encrypted email")
+	a.sentIndirectly(target, body, "encrypted email")
+	a.push.wake(target, a.h.ID().String())
+	return nil
+}
+
+// storeFor leaves body for to where it said to: its profile's mailboxes,
+// else its DHT inbox pointer's. Our own mailbox is the last resort.
+func (a *app) storeFor(ctx context.Context, to, body string) error {
+	var via string
+	if mb, err := a.depositAtTheirMailbox(ctx, to, body); err == nil {
+		via = a.conversationLabel(to) + "'s mailbox " + shortID(mb.String())
+		printResult(map[string]string{"stored": "mailbox", "mailbox": mb.String()}, "stored for offline delivery (at "+via+")")
+	} else if err := a.storeAtInbox(ctx, to, body); err == nil {
+		via = "the mailbox its DHT inbox pointer names"
+		printResult(map[string]string{"stored": "inbox"}, "stored for offline delivery (at "+via+")")
+	} else {
+		mailbox := a.mailbox.primary()
+		if mailbox == "" {
+			return err
+		}
+		logger.Debugf("inbox pointer of %s: %s", to, err)
+		if _, err := a.node.Deposit(ctx, mailbox, to, body); err != nil {
+			return err
+		}
+		via = "mailbox " + shortID(mailbox.String())
+		printResult(map[string]string{"stored": "mailbox", "mailbox": mailbox.String()}, "stored for offline delivery (at "+via+")")
+	}
+	a.sentIndirectly(to, body, via)
+	a.push.wake(to, a.h.ID().String())
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"p2p-chat/paths"
+)
+
+// Flags whose values complete to file names, and fixed value lists.
+var (
+	fileFlags  = []string{"data-dir", "exec-file", "plugins", "scripts", "log-file"}
+	flagValues = map[string][]string{
+		"theme":     {"dark", "light", "mono"},
+		"log-level": {"debug", "info", "warn", "error"},
+	}
+)
+
+// flagNames returns the flags define adds, as "--name".
+func flagNames(define func(fs *flag.FlagSet)) []string {
+	if define == nil {
+		return nil
+	}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	define(fs)
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, "--"+f.Name) })
+	return names
+}
+
+// clientFlagNames are the chat client's flags. Defining them on a scratch
+// FlagSet would rebind --json and --screen-reader, so they're saved first.
+func clientFlagNames() []string {
+	json, reader := jsonOutput, screenReader
+	defer func() { jsonOutput, screenReader = json, reader }()
+	return flagNames(func(fs *flag.FlagSet) { new(clientOptions).flags(fs) })
+}
+
+// completion runs 'completion bash|zsh|fish', printing a script that
+// completes subcommands, flags and, for 'send', contact names (asked of
+// the binary through the hidden '__complete' subcommand).
+func completion(args []string) int {
+	fs := subcommandFlags("completion")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	args = fs.Args()
+	prog := filepath.Base(os.Args[0])
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion(prog))
+	case "zsh":
+		fmt.Printf("# zsh completion for %s; load with: source <(%s completion zsh)\n", prog, prog)
+		fmt.Println("autoload -U +X bashcompinit && bashcompinit")
+		fmt.Print(bashCompletion(prog))
+	case "fish":
+		fmt.Print(fishCompletion(prog))
+	default:
+		fmt.Printf("unknown shell %q (have bash, zsh, fish)\n", args[0])
+		return exitUsage
+	}
+	return exitOK
+}
+
+func bashCompletion(prog string) string {
+	fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(prog)
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for %s; load with: source <(%s completion bash)\n", prog, prog)
+	fmt.Fprintf(&b, "%s() {\n", fn)
+	b.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\" sub=\"${COMP_WORDS[1]}\" words i\n")
+	b.WriteString("    local dd=()\n")
+	b.WriteString("    for ((i = 1; i < COMP_CWORD; i++)); do\n")
+	b.WriteString("        [[ ${COMP_WORDS[i]} == --data-dir || ${COMP_WORDS[i]} == -data-dir ]] && dd=(--data-dir \"${COMP_WORDS[i+1]}\")\n")
+	b.WriteString("    done\n")
+	b.WriteString("    case \"$prev\" in\n")
+	for _, f := range fileFlags {
+		fmt.Fprintf(&b, "    --%s|-%s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", f, f)
+	}
+	for _, f := range sortedKeys(flagValues) {
+		fmt.Fprintf(&b, "    --%s|-%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", f, f, strings.Join(flagValues[f], " "))
+	}
+	b.WriteString("    esac\n")
+	b.WriteString("    case \"$sub\" in\n")
+	for _, sc := range visibleSubcommands() {
+		fmt.Fprintf(&b, "    %s)\n", sc.name)
+		switch sc.args {
+		case "contacts":
+			fmt.Fprintf(&b, "        if [[ $cur != -* ]]; then COMPREPLY=($(compgen -W \"$(%s __complete \"${dd[@]}\" contacts 2>/dev/null)\" -- \"$cur\")); return; fi\n", prog)
+		case "shells":
+			b.WriteString("        COMPREPLY=($(compgen -W \"bash zsh fish\" -- \"$cur\")); return\n")
+		}
+		fmt.Fprintf(&b, "        words=%q ;;\n", strings.Join(flagNames(sc.flags), " "))
+	}
+	var first []string
+	for _, sc := range visibleSubcommands() {
+		first = append(first, sc.name)
+	}
+	client := strings.Join(clientFlagNames(), " ")
+	b.WriteString("    *)\n")
+	fmt.Fprintf(&b, "        if ((COMP_CWORD == 1)); then words=%q; else words=%q; fi ;;\n", strings.Join(first, " ")+" "+client, client)
+	b.WriteString("    esac\n")
+	b.WriteString("    COMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	b.WriteString("}\n")
+	fmt.Fprintf(&b, "complete -o default -F %s %s\n", fn, prog)
+	return b.String()
+}
+
+func fishCompletion(prog string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s; load with: %s completion fish | source\n", prog, prog)
+	fmt.Fprintf(&b, "complete -c %s -f\n", prog)
+	describe := func(cond string, define func(fs *flag.FlagSet)) {
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		define(fs)
+		fs.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(&b, "complete -c %s -n %q -l %s -d %q", prog, cond, f.Name, firstClause(f.Usage))
+			if vals, ok := flagValues[f.Name]; ok {
+				fmt.Fprintf(&b, " -x -a %q", strings.Join(vals, " "))
+			} else if slices.Contains(fileFlags, f.Name) {
+				b.WriteString(" -r -F")
+			} else if _, isBool := f.Value.(interface{ IsBoolFlag() bool }); !isBool {
+				b.WriteString(" -r")
+			}
+			b.WriteString("\n")
+		})
+	}
+	for _, sc := range visibleSubcommands() {
+		fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -a %s -d %q\n", prog, sc.name, sc.summary)
+		cond := "__fish_seen_subcommand_from " + sc.name
+		if sc.flags != nil {
+			describe(cond, sc.flags)
+		}
+		switch sc.args {
+		case "contacts":
+			fmt.Fprintf(&b, "complete -c %s -n %q -a '(%s __complete contacts 2>/dev/null)'\n", prog, cond, prog)
+		case "shells":
+			fmt.Fprintf(&b, "complete -c %s -n %q -a 'bash zsh fish'\n", prog, cond)
+		}
+	}
+	json, reader := jsonOutput, screenReader
+	describe("__fish_use_subcommand", func(fs *flag.FlagSet) { new(clientOptions).flags(fs) })
+	jsonOutput, screenReader = json, reader
+	return b.String()
+}
+
+// completeQuery runs the hidden '__complete [--data-dir dir] contacts|rooms'
+// that completion scripts call: it prints one name per line. Rooms are
+// those the read state knows, i.e. ones that have had messages.
+func completeQuery(args []string) int {
+	fs := subcommandFlags("__complete")
+	dataDir := fs.String("data-dir", "", "")
+	if fs.Parse(args) != nil || fs.NArg() != 1 {
+		return exitUsage
+	}
+	dirs, err := paths.Resolve(*dataDir)
+	if err != nil {
+		return exitFailed
+	}
+	switch fs.Arg(0) {
+	case "contacts":
+		book, err := loadContacts(dirs.ConfigFile(contactsFile))
+		if err != nil {
+			return exitFailed
+		}
+		for _, n := range book.names() {
+			fmt.Println(n)
+		}
+	case "rooms":
+		u, err := loadUnreadTracker(dirs.DataFile(readStateFile))
+		if err != nil {
+			return exitFailed
+		}
+		for _, key := range u.keys() {
+			if strings.HasPrefix(key, "#") {
+				fmt.Println(key)
+			}
+		}
+	default:
+		return exitUsage
+	}
+	return exitOK
+}
+
+// firstClause shortens a flag's usage for fish's one-line descriptions.
+func firstClause(usage string) string {
+	if i := strings.IndexAny(usage, "(;"); i > 0 {
+		usage = usage[:i]
+	}
+	return strings.TrimSpace(usage)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const contactsFile = "p2pchat_contacts.json"
+
+// contact is an address-book entry: a short name for a peer, plus the
+// addresses it was added with so it can be dialled without the DHT.
+type contact struct {
+	Peer  string   `json:"peer"`
+	Addrs []string `json:"addrs,omitempty"`
+	// RequireE2E refuses anything to or from the peer that isn't end-to-end
+	// encrypted: stored offline copies and plaintext email.
+	RequireE2E bool `json:"require_e2e,omitempty"`
+	// Mailboxes are where the peer's profile says to leave offline
+	// messages, learned when it was last connected.
+	Mailboxes []string `json:"mailboxes,omitempty"`
+}
+
+// contactBook maps names to peers; it's persisted to contactsFile in the
+// config directory.
+type contactBook struct {
+	mu     sync.Mutex
+	path   string
+	byName map[string]contact
+}
+
+func loadContacts(path string) (*contactBook, error) {
+	b := &contactBook{path: path, byName: make(map[string]contact)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.byName); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+// add saves name for target, a peer ID or a /p2p multiaddr.
+func (b *contactBook) add(name, target string) (contact, error) {
+	c, err := parseContact(target)
+	if err != nil {
+		return contact{}, err
+	}
+	return b.put(name, c)
+}
+
+// put saves c as name, keeping the settings of an entry for the same peer.
+func (b *contactBook) put(name string, c contact) (contact, error) {
+	if name == "" || strings.ContainsAny(name, " /") {
+		return contact{}, fmt.Errorf("invalid contact name %q", name)
+	}
+	if _, err := peer.Decode(name); err == nil {
+		return contact{}, errors.New("contact name can't be a peer ID")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old := b.byName[name]; old.Peer == c.Peer {
+		c.RequireE2E = old.RequireE2E
+		if len(c.Mailboxes) == 0 {
+			c.Mailboxes = old.Mailboxes
+		}
+	}
+	b.byName[name] = c
+	return c, b.save()
+}
+
+// setRequireE2E turns the require-e2e setting of a contact on or off.
+func (b *contactBook) setRequireE2E(name string, on bool) (contact, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.byName[name]
+	if !ok {
+		return contact{}, fmt.Errorf("no contact named %s", name)
+	}
+	c.RequireE2E = on
+	b.byName[name] = c
+	return c, b.save()
+}
+
+// requiresE2E reports whether peerID is a contact with require-e2e set.
+func (b *contactBook) requiresE2E(peerID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.byName {
+		if c.Peer == peerID && c.RequireE2E {
+			return true
+		}
+	}
+	return false
+}
+
+// setMailboxes records the mailboxes of the contacts with peerID, saving
+// the book only if they changed.
+func (b *contactBook) setMailboxes(peerID string, addrs []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	changed := false
+	for name, c := range b.byName {
+		if c.Peer == peerID && !slices.Equal(c.Mailboxes, addrs) {
+			c.Mailboxes = addrs
+			b.byName[name] = c
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return b.save()
+}
+
+// mailboxesOf returns the mailboxes recorded for peerID.
+func (b *contactBook) mailboxesOf(peerID string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.byName {
+		if c.Peer == peerID && len(c.Mailboxes) > 0 {
+			return c.Mailboxes
+		}
+	}
+	return nil
+}
+
+func (b *contactBook) remove(name string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.byName[name]; !ok {
+		return false, nil
+	}
+	delete(b.byName, name)
+	return true, b.save()
+}
+
+// names returns the contact names, sorted.
+func (b *contactBook) names() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := make([]string, 0, len(b.byName))
+	for n := range b.byName {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolve turns a contact name, peer ID or /p2p multiaddr into a peer and
+// whatever addresses are known for it. A bare peer ID gets the addresses
+// of the contact with that ID.
+func (b *contactBook) resolve(s string) (peer.AddrInfo, error) {
+	b.mu.Lock()
+	c, ok := b.byName[s]
+	if !ok {
+		var err error
+		if c, err = parseContact(s); err != nil {
+			b.mu.Unlock()
+			return peer.AddrInfo{}, fmt.Errorf("%q is not a contact, peer ID or multiaddr", s)
+		}
+		for _, known := range b.byName {
+			if len(c.Addrs) == 0 && known.Peer == c.Peer {
+				c.Addrs = known.Addrs
+			}
+		}
+	}
+	b.mu.Unlock()
+	pid, err := peer.Decode(c.Peer)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	pi := peer.AddrInfo{ID: pid}
+	for _, s := range c.Addrs {
+		if addr, err := ma.NewMultiaddr(s); err == nil {
+			pi.Addrs = append(pi.Addrs, addr)
+		}
+	}
+	return pi, nil
+}
+
+// peerID is resolve for callers that only need the ID; anything that
+// doesn't resolve is passed through for the caller to reject.
+func (b *contactBook) peerID(s string) string {
+	if pi, err := b.resolve(s); err == nil {
+		return pi.ID.String()
+	}
+	return s
+}
+
+// nameOf returns the contact name for a peer ID, or "".
+func (b *contactBook) nameOf(peerID string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, c := range b.byName {
+		if c.Peer == peerID {
+			return name
+		}
+	}
+	return ""
+}
+
+func parseContact(target string) (contact, error) {
+	if strings.HasPrefix(target, "/") {
+		pi, err := peer.AddrInfoFromString(target)
+		if err != nil {
+			return contact{}, err
+		}
+		c := contact{Peer: pi.ID.String()}
+		for _, addr := range pi.Addrs {
+			c.Addrs = append(c.Addrs, addr.String())
+		}
+		return c, nil
+	}
+	if _, err := peer.Decode(target); err != nil {
+		return contact{}, err
+	}
+	return contact{Peer: target}, nil
+}
+
+// save writes the book to disk; callers hold b.mu.
+func (b *contactBook) save() error {
+	data, err := json.MarshalIndent(b.byName, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(b.path, data, 0600)
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "contact",
+		Usage:   "add <name> <peerID|multiaddr> | rm <name> | set <name> require-e2e on|off",
+		Summary: "name a peer so msg, store and 'send' accept the name; require-e2e refuses anything not end-to-end encrypted with it",
+		MinArgs: 2,
+		Run: func(a *app, inv *invocation) error {
+			switch inv.Args[0] {
+			case "add":
+				if len(inv.Args) < 3 {
+					fmt.Println("usage: contact add <name> <peerID|multiaddr>")
+					return nil
+				}
+				c, err := a.contacts.add(inv.Args[1], inv.Args[2])
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s = %s\n", inv.Args[1], c.Peer)
+			case "rm":
+				ok, err := a.contacts.remove(inv.Args[1])
+				if err != nil {
+					return err
+				}
+				if !ok {
+					fmt.Println("no contact named", inv.Args[1])
+				}
+			case "set":
+				if len(inv.Args) != 4 || inv.Args[2] != "require-e2e" || (inv.Args[3] != "on" && inv.Args[3] != "off") {
+					fmt.Println("usage: contact set <name> require-e2e on|off")
+					return nil
+				}
+				c, err := a.contacts.setRequireE2E(inv.Args[1], inv.Args[3] == "on")
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s: require-e2e %s\n", inv.Args[1], inv.Args[3])
+				if c.RequireE2E {
+					a.warnE2ESupport(c.Peer)
+				}
+			default:
+				fmt.Println("usage: contact add <name> <peerID|multiaddr> | contact rm <name> | contact set <name> require-e2e on|off")
+			}
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "contacts",
+		Summary: "list named peers and whether each is online",
+		Run: func(a *app, inv *invocation) error {
+			names := a.contacts.names()
+			if jsonOutput {
+				byName := make(map[string]string, len(names))
+				online := []string{}
+				for _, n := range names {
+					pi, _ := a.contacts.resolve(n)
+					byName[n] = pi.ID.String()
+					if a.online(pi.ID) {
+						online = append(online, n)
+					}
+				}
+				printJSON(map[string]any{"contacts": byName, "online": online})
+				return nil
+			}
+			if len(names) == 0 {
+				fmt.Println("no contacts; add one with 'contact add <name> <peerID>'")
+				return nil
+			}
+			for _, n := range names {
+				pi, _ := a.contacts.resolve(n)
+				note := " offline"
+				if a.online(pi.ID) {
+					note = " online"
+				}
+				if a.contacts.requiresE2E(pi.ID.String()) {
+					note += " (require-e2e)"
+				}
+				fmt.Printf(" - %s: %s%s\n", n, pi.ID, note)
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// switchKey is what a line holds when Ctrl-] is typed on its own and
+// followed by Enter; the prompt treats it as 'switch'.
+const switchKey = "\x1d"
+
+// conversations tracks the chats opened with 'open' (and any that got a
+// message while another was current). While one is current, plain lines at
+// the prompt are sent to it and commands need a leading '/'; messages for
+// the others only show as badges on the prompt.
+type conversations struct {
+	mu      sync.Mutex
+	open    []string // conversation keys: a peer ID or "#<room>"
+	current int      // index into open, -1 for none
+}
+
+func newConversations() *conversations {
+	return &conversations{current: -1}
+}
+
+// focus makes key current, opening it if needed.
+func (c *conversations) focus(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = c.index(key)
+}
+
+// background reports whether a message for key should be held back
+// because a different conversation is current. key is then opened, so
+// 'switch' reaches it.
+func (c *conversations) background(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current < 0 {
+		return false
+	}
+	return c.index(key) != c.current
+}
+
+// next cycles to the following open conversation.
+func (c *conversations) next() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.open) == 0 {
+		return "", false
+	}
+	c.current = (c.current + 1) % len(c.open)
+	return c.open[c.current], true
+}
+
+// close closes the current conversation, returning to plain commands.
+func (c *conversations) close() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current < 0 {
+		return "", false
+	}
+	key := c.open[c.current]
+	c.open = append(c.open[:c.current], c.open[c.current+1:]...)
+	c.current = -1
+	return key, true
+}
+
+// active returns the current conversation and the other open ones.
+func (c *conversations) active() (current string, others []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, key := range c.open {
+		if i == c.current {
+			current = key
+			continue
+		}
+		others = append(others, key)
+	}
+	return current, others
+}
+
+// index returns key's position, opening it if needed; callers hold c.mu.
+func (c *conversations) index(key string) int {
+	for i, k := range c.open {
+		if k == key {
+			return i
+		}
+	}
+	c.open = append(c.open, key)
+	return len(c.open) - 1
+}
+
+// prompt is the input prompt: the current conversation, if any, with
+// unread badges for the other open ones.
+func (a *app) prompt() string {
+	current, others := a.convs.active()
+	if current == "" {
+		return "> "
+	}
+	var b strings.Builder
+	b.WriteString("[" + a.conversationLabel(current) + a.sendingLabel(current))
+	for _, key := range others {
+		if n := a.unread.count(key); n > 0 {
+			fmt.Fprintf(&b, " %s:%d", a.conversationLabel(key), n)
+		}
+	}
+	b.WriteString("]> ")
+	return b.String()
+}
+
+// conversationLabel names a conversation for display: the room, the
+// contact name, or an abbreviated peer ID.
+func (a *app) conversationLabel(key string) string {
+	if strings.HasPrefix(key, "#") {
+		return key
+	}
+	if name := a.contacts.nameOf(key); name != "" {
+		return name
+	}
+	return shortID(key)
+}
+
+// conversationLine turns a prompt line into a command line: Ctrl-] is
+// 'switch', PageUp/PageDown are 'more', a leading '/' marks a command, and anything else typed while a
+// conversation is current is a message to it.
+func (a *app) conversationLine(text string) string {
+	if text == switchKey {
+		return "switch"
+	}
+	if cmd := scrollKeyLine(text); cmd != text {
+		return cmd
+	}
+	if cmd, ok := strings.CutPrefix(text, "/"); ok {
+		return cmd
+	}
+	current, _ := a.convs.active()
+	switch {
+	case current == "":
+		return text
+	case strings.HasPrefix(current, "#"):
+		return "say " + current + " " + text
+	default:
+		return "send " + current + " " + text
+	}
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "open",
+		Usage:   "<peerID|contact|#room>",
+		Summary: "switch the prompt into a conversation; plain lines are sent there, /commands still work",
+		MinArgs: 1,
+		Run: func(a *app, inv *invocation) error {
+			key := inv.Args[0]
+			if strings.HasPrefix(key, "#") {
+				if err := a.joinRoom(strings.TrimPrefix(key, "#")); err != nil {
+					return err
+				}
+			} else {
+				key = a.contacts.peerID(key)
+				if _, err := peer.Decode(key); err != nil {
+					return fmt.Errorf("%q is not a contact or peer ID (rooms start with #)", inv.Args[0])
+				}
+			}
+			a.convs.focus(key)
+			fmt.Println("talking to", a.conversationLabel(key)+"; /close to leave, /switch or Ctrl-] Enter for the next")
+			a.showUnread(key)
+			a.markRead(key)
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "switch",
+		Summary: "cycle to the next open conversation (also Ctrl-] then Enter)",
+		Run: func(a *app, inv *invocation) error {
+			key, ok := a.convs.next()
+			if !ok {
+				fmt.Println("no open conversations; use 'open <peer|#room>'")
+				return nil
+			}
+			a.showUnread(key)
+			a.markRead(key)
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "close",
+		Summary: "close the current conversation and go back to plain commands",
+		Run: func(a *app, inv *invocation) error {
+			if _, ok := a.convs.close(); !ok {
+				fmt.Println("no conversation is open")
+			}
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "conversations",
+		Summary: "list open conversations with unread counts",
+		Run: func(a *app, inv *invocation) error {
+			current, others := a.convs.active()
+			if current == "" && len(others) == 0 {
+				fmt.Println("no open conversations")
+				return nil
+			}
+			if current != "" {
+				fmt.Printf(" * %s\n", a.conversationLabel(current))
+			}
+			for _, key := range others {
+				if n := a.unread.count(key); n > 0 {
+					fmt.Printf(" - %s (%d unread)\n", a.conversationLabel(key), n)
+					continue
+				}
+				fmt.Println(" -", a.conversationLabel(key))
+			}
+			return nil
+		},
+	})
+}
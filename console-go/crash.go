@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// crashesDir holds crash reports, under the data directory.
+const crashesDir = "crashes"
+
+// recentKept is how many recent events crash reports and 'report' include.
+const recentKept = 100
+
+// recent is what the client did lately, for crash reports: command names
+// and event types with peer IDs, never message text.
+var recent = &eventRing{max: recentKept}
+
+// eventRing keeps the last max lines noted.
+type eventRing struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+}
+
+func (r *eventRing) note(format string, args ...any) {
+	line := time.Now().UTC().Format("15:04:05.000 ") + fmt.Sprintf(format, args...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) == r.max {
+		r.lines = append(r.lines[:0], r.lines[1:]...)
+	}
+	r.lines = append(r.lines, line)
+}
+
+func (r *eventRing) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// crashReporter writes a report for each panic the client survives.
+type crashReporter struct {
+	dir string
+}
+
+// save writes a report of v, raised in where, and returns its path.
+func (c *crashReporter) save(where string, v any, stack []byte) (string, error) {
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	var b strings.Builder
+	fmt.Fprintln(&b, "peep-chat crash report")
+	fmt.Fprintln(&b, "time:   ", now.Format(time.RFC3339))
+	fmt.Fprintln(&b, "version:", agentVersion())
+	fmt.Fprintln(&b, "go:     ", runtime.Version(), runtime.GOOS+"/"+runtime.GOARCH)
+	fmt.Fprintln(&b, "where:  ", where)
+	fmt.Fprintln(&b, "panic:  ", v)
+	fmt.Fprintf(&b, "\nstack:\n%s\nrecent events:\n", stack)
+	for _, l := range recent.list() {
+		fmt.Fprintln(&b, " ", l)
+	}
+	path := filepath.Join(c.dir, "crash-"+now.Format("20060102-150405.000")+".txt")
+	return path, os.WriteFile(path, []byte(b.String()), 0o600)
+}
+
+// reports lists the saved crash reports, oldest first.
+func (c *crashReporter) reports() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "crash-*.txt"))
+	return paths, err // Glob names sort by time
+}
+
+// crashed records a recovered panic and returns it as an error saying
+// where the report went.
+func (a *app) crashed(where string, v any, stack []byte) error {
+	recent.note("panic in %s: %v", where, v)
+	path, err := a.crashes.save(where, v, stack)
+	if err != nil {
+		logger.Errorf("writing crash report: %s", err)
+		return fmt.Errorf("internal error in %s: %v (the client is still running)", where, v)
+	}
+	return fmt.Errorf("internal error in %s: %v (the client is still running; report saved to %s, 'report' bundles it for a bug report)", where, v, path)
+}
+
+// safely runs fn, surviving a panic in it with a crash report.
+func (a *app) safely(where string, fn func()) {
+	defer func() {
+		if v := recover(); v != nil {
+			logger.Errorf("panic in %s: %v", where, v)
+			printError("", a.crashed(where, v, debug.Stack()).Error())
+		}
+	}()
+	fn()
+}
+
+// runCommand runs c, turning a panic in it into an error with a crash
+// report.
+func (a *app) runCommand(c *command, inv *invocation) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			logger.Errorf("panic in command %s: %v", c.Name, v)
+			err = a.crashed("command "+c.Name, v, debug.Stack())
+		}
+	}()
+	return c.Run(a, inv)
+}
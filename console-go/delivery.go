@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+// Delivery states of a direct message we sent, in the order they're
+// reached; failed can follow any of the first two.
+const (
+	stateQueued    = "queued"    // in the outbox, waiting for a retry
+	stateSent      = "sent"      // written to the peer, or handed to a mailbox, relay or email
+	stateDelivered = "delivered" // acknowledged by the peer, or its delivered receipt
+	stateRead      = "read"      // its read receipt
+	stateFailed    = "failed"    // given up on
+)
+
+var stateOrder = map[string]int{stateQueued: 0, stateSent: 1, stateFailed: 2, stateDelivered: 3, stateRead: 4}
+
+// deliveriesKept is how many sent messages' states are remembered.
+const deliveriesKept = 1000
+
+// receiptDelay batches the receipts owed to a peer.
+const receiptDelay = time.Second
+
+// delivery is what became of a direct message we sent.
+type delivery struct {
+	ID       string           `json:"id"`
+	To       string           `json:"to"`
+	Body     string           `json:"body"`
+	State    string           `json:"state"`
+	Via      string           `json:"via,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	OutboxID int              `json:"outbox_id,omitempty"`
+	Times    map[string]int64 `json:"times"` // when each state was reached, unix ms
+}
+
+// deliveries tracks the state of the messages we send this session, and
+// of those still in the outbox.
+type deliveries struct {
+	mu    sync.Mutex
+	byID  map[string]*delivery // by message ID, and a queued message's first ID
+	order []*delivery          // oldest first
+}
+
+func newDeliveries() *deliveries {
+	return &deliveries{byID: make(map[string]*delivery)}
+}
+
+// track starts following message id to to.
+func (d *deliveries) track(id, to, body, state, via string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.byID[id]; ok {
+		return
+	}
+	r := &delivery{ID: id, To: to, Body: body, State: state, Via: via, Times: map[string]int64{state: time.Now().UnixMilli()}}
+	d.byID[id] = r
+	d.order = append(d.order, r)
+	if len(d.order) > deliveriesKept {
+		old := d.order[0]
+		d.order = d.order[1:]
+		for k, v := range d.byID {
+			if v == old {
+				delete(d.byID, k)
+			}
+		}
+	}
+}
+
+// advance moves message id to state, never back; via and errText replace
+// what's recorded if set. It reports whether the state changed.
+func (d *deliveries) advance(id, state, via, errText string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.byID[id]
+	if !ok || stateOrder[state] < stateOrder[r.State] {
+		return false
+	}
+	if via != "" {
+		r.Via = via
+	}
+	r.Error = errText
+	if r.State == state {
+		return false
+	}
+	r.State = state
+	r.Times[state] = time.Now().UnixMilli()
+	return true
+}
+
+// alias renames message id to, the ID it was finally sent with; it
+// stays findable by the old one.
+func (d *deliveries) alias(id, to string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.byID[id]; ok {
+		r.ID = to
+		d.byID[to] = r
+	}
+}
+
+// queued notes that outbox entry outboxID holds message id.
+func (d *deliveries) queued(id string, outboxID int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.byID[id]; ok {
+		r.OutboxID = outboxID
+	}
+}
+
+// get finds a message by its ID, or the send time that ends it.
+func (d *deliveries) get(id string) (delivery, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.byID[id]
+	if !ok {
+		for i := len(d.order) - 1; i >= 0; i-- {
+			if strings.HasSuffix(d.order[i].ID, "/"+id) {
+				r, ok = d.order[i], true
+				break
+			}
+		}
+	}
+	if !ok {
+		return delivery{}, false
+	}
+	return *r, true
+}
+
+// latest returns the last n messages, to peer to if it's set.
+func (d *deliveries) latest(to string, n int) []delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []delivery
+	for i := len(d.order) - 1; i >= 0 && len(out) < n; i-- {
+		if to == "" || d.order[i].To == to {
+			out = append([]delivery{*d.order[i]}, out...)
+		}
+	}
+	return out
+}
+
+// stateMark is how a state shows after a message in the conversation view.
+func stateMark(state string) string {
+	if screenReader {
+		return " (" + state + ")"
+	}
+	switch state {
+	case stateQueued:
+		return styles.dim(" ⏳ queued")
+	case stateSent:
+		return styles.dim(" ✓")
+	case stateDelivered:
+		return styles.dim(" ✓✓")
+	case stateRead:
+		return styles.system(" ✓✓ read")
+	case stateFailed:
+		return styles.err(" ✗ failed")
+	}
+	return ""
+}
+
+// mark is the state mark of message id, if we sent it.
+func (d *deliveries) mark(id string) string {
+	d.mu.Lock()
+	r, ok := d.byID[id]
+	state := ""
+	if ok {
+		state = r.State
+	}
+	d.mu.Unlock()
+	return stateMark(state)
+}
+
+// receipts batches the delivered and read receipts we owe peers.
+type receipts struct {
+	mu      sync.Mutex
+	pending map[string]map[string]string // peer -> message ID -> status
+	unread  map[string][]string          // peer -> IDs delivered but not yet read
+	timer   *time.Timer
+}
+
+// readReceipts is --read-receipts: whether peers are told when we've read
+// their messages, rather than only that they arrived.
+var readReceipts = true
+
+// oweReceipt queues a receipt to peerID for message id, unless its client
+// doesn't take receipts.
+func (a *app) oweReceipt(peerID, id, status string) {
+	if !a.supports(peerID, node.FeatureReceipts) {
+		return
+	}
+	rc := a.receipts
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.pending == nil {
+		rc.pending = make(map[string]map[string]string)
+		rc.unread = make(map[string][]string)
+	}
+	if status == "delivered" {
+		rc.unread[peerID] = append(rc.unread[peerID], id)
+		if len(rc.unread[peerID]) > scrollbackLines {
+			rc.unread[peerID] = rc.unread[peerID][1:]
+		}
+	}
+	if status == "read" && !readReceipts {
+		return
+	}
+	if rc.pending[peerID] == nil {
+		rc.pending[peerID] = make(map[string]string)
+	}
+	if rc.pending[peerID][id] != "read" {
+		rc.pending[peerID][id] = status
+	}
+	if rc.timer == nil {
+		rc.timer = time.AfterFunc(receiptDelay, a.sendReceipts)
+	}
+}
+
+// messageShown owes m's sender a receipt: read if it was shown, else
+// delivered, and read once its conversation is.
+func (a *app) messageShown(peerID string, m Message, shown bool) {
+	if m.Room != "" || m.From != peerID {
+		return
+	}
+	if shown {
+		a.oweReceipt(peerID, m.ID(), "read")
+	} else {
+		a.oweReceipt(peerID, m.ID(), "delivered")
+	}
+}
+
+// markRead marks conversation key read, owing read receipts for what
+// arrived in it unseen.
+func (a *app) markRead(key string) {
+	a.unread.markRead(key)
+	rc := a.receipts
+	rc.mu.Lock()
+	ids := rc.unread[key]
+	delete(rc.unread, key)
+	rc.mu.Unlock()
+	for _, id := range ids {
+		a.oweReceipt(key, id, "read")
+	}
+}
+
+// sendReceipts sends what's owed, one message per peer and status. They're
+// best effort: a peer that's gone won't miss them.
+func (a *app) sendReceipts() {
+	rc := a.receipts
+	rc.mu.Lock()
+	pending := rc.pending
+	rc.pending, rc.timer = make(map[string]map[string]string), nil
+	rc.mu.Unlock()
+	for p, byID := range pending {
+		byStatus := make(map[string][]string)
+		for id, status := range byID {
+			byStatus[status] = append(byStatus[status], id)
+		}
+		for status, ids := range byStatus {
+			for len(ids) > 0 {
+				batch := ids[:min(len(ids), node.MaxReceiptTargets)]
+				ids = ids[len(batch):]
+				ctx, cancel := context.WithTimeout(a.ctx, 10*time.Second)
+				_, err := a.node.SendTyped(ctx, p, node.TypeReceipt, "", node.Receipt{Targets: batch, Status: status})
+				cancel()
+				if err != nil {
+					logger.Debugf("%s receipt to %s: %s", status, p, err)
+				}
+			}
+		}
+	}
+}
+
+// receiptReceived moves the messages r names along, if they went to from.
+func (a *app) receiptReceived(from string, r node.Receipt) {
+	for _, id := range r.Targets {
+		if d, ok := a.deliveries.get(id); ok && d.To == from {
+			a.deliveries.advance(id, r.Status, "", "")
+		}
+	}
+}
+
+// queuedID is the ID a message in the outbox goes by until it's sent.
+func (a *app) queuedID(e outboxEntry) string {
+	return a.h.ID().String() + "/" + strconv.FormatInt(e.Queued, 10)
+}
+
+// showQueued puts outbox entry e in its conversation, marked queued.
+func (a *app) showQueued(e outboxEntry) {
+	id := a.queuedID(e)
+	a.deliveries.track(id, e.To, e.Body, stateQueued, "")
+	a.deliveries.queued(id, e.ID)
+	a.scroll.add(e.To, Message{From: a.h.ID().String(), When: e.Queued, Body: e.Body})
+}
+
+// sentIndirectly puts a message handed to someone else to deliver in its
+// conversation, marked sent via them.
+func (a *app) sentIndirectly(to, body, via string) {
+	m := Message{From: a.h.ID().String(), When: time.Now().UnixMilli(), Body: body}
+	a.deliveries.track(m.ID(), to, body, stateSent, via)
+	a.scroll.add(to, m)
+}
+
+// describeDelivery explains where d is, and for one that's stuck, why.
+func (a *app) describeDelivery(d delivery) []string {
+	at := func(state string) string {
+		return time.UnixMilli(d.Times[state]).Format("15:04:05")
+	}
+	to := a.conversationLabel(d.To)
+	lines := []string{fmt.Sprintf("to %s: %s", to, quote(d.Body))}
+	for _, s := range []string{stateQueued, stateSent, stateDelivered, stateRead, stateFailed} {
+		if _, ok := d.Times[s]; ok {
+			lines = append(lines, fmt.Sprintf("  %-9s %s", s, at(s)))
+		}
+	}
+	if d.Via != "" {
+		lines = append(lines, "via "+d.Via)
+	}
+	switch d.State {
+	case stateQueued:
+		lines = append(lines, fmt.Sprintf("stuck: %s couldn't be reached", to))
+		for _, e := range a.outbox.list() {
+			if e.ID == d.OutboxID {
+				lines = append(lines, fmt.Sprintf("  outbox #%d, tried %d times, last error: %s", e.ID, e.Attempts, e.LastErr),
+					fmt.Sprintf("  next retry in %s, or when %s connects ('outbox flush' retries now)",
+						time.Until(time.UnixMilli(e.Next)).Round(time.Second), to))
+			}
+		}
+	case stateSent:
+		if strings.HasPrefix(d.Via, "direct") {
+			lines = append(lines, fmt.Sprintf("waiting: no receipt from %s yet; its client may not send them", to))
+		} else {
+			lines = append(lines, fmt.Sprintf("waiting: %s picks it up when it comes online", to))
+		}
+	case stateDelivered:
+		if p, err := peer.Decode(d.To); err == nil && !a.online(p) {
+			lines = append(lines, "waiting: "+to+" went offline before reading it")
+		}
+	case stateFailed:
+		lines = append(lines, "failed: "+d.Error)
+	}
+	return lines
+}
+
+var errNoSuchMessage = errors.New("no message with that ID was sent this session (see 'status')")
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "status",
+		Usage:   "[-n <n>] [<messageID>|<peer>]",
+		Summary: "delivery state of the messages you sent (queued, sent, delivered, read or failed), or where one is stuck",
+		Flags: func(fs *flag.FlagSet) {
+			fs.Int("n", 10, "how many recent messages to list")
+		},
+		Run: func(a *app, inv *invocation) error {
+			to := ""
+			if len(inv.Args) > 0 {
+				if d, ok := a.deliveries.get(inv.Args[0]); ok {
+					if jsonOutput {
+						printJSON(d)
+						return nil
+					}
+					fmt.Println(strings.Join(a.describeDelivery(d), "\n"))
+					return nil
+				}
+				to = a.contacts.peerID(inv.Args[0])
+				if _, err := peer.Decode(to); err != nil {
+					return errNoSuchMessage
+				}
+			}
+			list := a.deliveries.latest(to, max(inv.Int("n"), 1))
+			if jsonOutput {
+				printJSON(list)
+				return nil
+			}
+			if len(list) == 0 {
+				fmt.Println("no messages sent yet")
+			}
+			for _, d := range list {
+				_, when, _ := strings.Cut(d.ID, "/")
+				via := ""
+				if d.Via != "" {
+					via = styles.dim(" via " + d.Via)
+				}
+				fmt.Printf("  %s  to %-16s %-9s %s%s\n", when, a.conversationLabel(d.To), d.State, quote(d.Body), via)
+			}
+			return nil
+		},
+	})
+}
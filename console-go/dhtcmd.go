@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+
+	"p2p-chat/node"
+)
+
+// dhtQueryTimeout bounds the dht subcommands.
+const dhtQueryTimeout = 30 * time.Second
+
+// queryStats counts the routing events of one DHT query, so failures can
+// be told apart: no peers asked at all, or peers asked and all erroring.
+type queryStats struct {
+	queried, responded, errors int
+	done                       chan struct{}
+}
+
+func watchQuery(ctx context.Context) (context.Context, *queryStats) {
+	ctx, events := routing.RegisterForQueryEvents(ctx)
+	qs := &queryStats{done: make(chan struct{})}
+	go func() {
+		defer close(qs.done)
+		for ev := range events {
+			switch ev.Type {
+			case routing.SendingQuery:
+				qs.queried++
+			case routing.PeerResponse:
+				qs.responded++
+			case routing.QueryError:
+				qs.errors++
+			}
+		}
+	}()
+	return ctx, qs
+}
+
+func (qs *queryStats) String() string {
+	<-qs.done
+	return fmt.Sprintf("%d peers queried, %d responded, %d errors", qs.queried, qs.responded, qs.errors)
+}
+
+func dhtRoutingTable(a *app) {
+	rt := a.dht.RoutingTable()
+	peers := rt.ListPeers()
+	fmt.Printf("%d peers in routing table\n", len(peers))
+	for _, p := range peers {
+		state := "not connected"
+		if a.h.Network().Connectedness(p) == network.Connected {
+			state = "connected"
+		}
+		if rtt := a.h.Peerstore().LatencyEWMA(p); rtt > 0 {
+			state += ", " + rtt.Round(time.Millisecond).String()
+		}
+		fmt.Printf(" - %s (%s)\n", p, state)
+	}
+}
+
+func dhtGet(ctx context.Context, a *app, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, dhtQueryTimeout)
+	defer cancel()
+	qctx, qs := watchQuery(ctx)
+	start := time.Now()
+	val, err := a.dht.GetValue(qctx, key)
+	cancel()
+	if err != nil {
+		fmt.Printf("%s after %s (%s)\n", err, time.Since(start).Round(time.Millisecond), qs)
+		return nil
+	}
+	fmt.Printf("%d bytes in %s (%s)\n", len(val), time.Since(start).Round(time.Millisecond), qs)
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, val, "", "  ") == nil {
+		fmt.Println(pretty.String())
+	} else {
+		fmt.Printf("%q\n", val)
+	}
+	return nil
+}
+
+func dhtPut(ctx context.Context, a *app, key, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, dhtQueryTimeout)
+	defer cancel()
+	results, err := a.node.PutValueVerbose(ctx, key, []byte(value))
+	if err != nil {
+		return err
+	}
+	accepted := 0
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Printf(" - %s: rejected: %s\n", r.Peer, r.Err)
+			continue
+		}
+		accepted++
+		fmt.Printf(" - %s: accepted\n", r.Peer)
+	}
+	fmt.Printf("%d of %d peers accepted the record\n", accepted, len(results))
+	return nil
+}
+
+func dhtProviders(ctx context.Context, a *app, arg string) error {
+	c, err := cid.Decode(arg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dhtQueryTimeout)
+	defer cancel()
+	qctx, qs := watchQuery(ctx)
+	found := 0
+	for pi := range a.dht.FindProvidersAsync(qctx, c, 20) {
+		found++
+		fmt.Printf(" - %s %v\n", pi.ID, pi.Addrs)
+	}
+	cancel()
+	fmt.Printf("%d providers (%s)\n", found, qs)
+	return nil
+}
+
+// migrationKeys are the current-layout keys dht migrate looks at: the
+// inbox pointer, revocation and directory record of each peer, and, when
+// no peers are named, ours and our contacts' plus our own and followed
+// channels' heads.
+func (a *app) migrationKeys(peers []string) ([]string, error) {
+	all := len(peers) == 0
+	if all {
+		peers = append(peers, a.h.ID().String())
+		for _, name := range a.contacts.names() {
+			peers = append(peers, a.contacts.peerID(name))
+		}
+	}
+	var keys []string
+	for _, s := range peers {
+		id, err := peer.Decode(a.contacts.peerID(s))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a contact or peer ID", s)
+		}
+		for _, prefix := range []string{node.DHTInboxPrefix, node.DHTRevocationPrefix, node.DHTDirectoryPrefix} {
+			keys = append(keys, prefix+id.String())
+		}
+	}
+	if all {
+		own, following := a.channels.snapshot()
+		for name := range own {
+			keys = append(keys, node.DHTChannelPrefix+node.ChannelID(a.h.ID(), name))
+		}
+		for id := range following {
+			keys = append(keys, node.DHTChannelPrefix+id)
+		}
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys), nil
+}
+
+// dhtMigrate republishes legacy records in the current layout.
+func dhtMigrate(ctx context.Context, a *app, peers []string) error {
+	keys, err := a.migrationKeys(peers)
+	if err != nil {
+		return err
+	}
+	type result struct {
+		Key    string `json:"key"`
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+	var results []result
+	migrated := 0
+	for _, key := range keys {
+		kctx, cancel := context.WithTimeout(ctx, dhtQueryTimeout)
+		st, err := a.node.MigrateRecord(kctx, key)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r := result{Key: key, Status: string(st)}
+		if err != nil {
+			r.Status, r.Error = "failed", err.Error()
+		}
+		if st == node.Migrated {
+			migrated++
+		}
+		results = append(results, r)
+		if !jsonOutput && st != node.NoLegacy {
+			if err != nil {
+				fmt.Printf(" - %s: %s\n", key, err)
+			} else {
+				fmt.Printf(" - %s: %s\n", key, st)
+			}
+		}
+	}
+	printResult(map[string]any{"records": results, "migrated": migrated}, fmt.Sprintf("%d of %d records migrated to %s", migrated, len(keys), node.DHTNamespace))
+	return nil
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:       "dht",
+		Usage:      "routing-table | get <key> | put <key> <value> | providers <cid> | migrate [<peer>...]",
+		Summary:    "inspect the DHT: routing table, raw get/put (with per-peer results), providers; migrate republishes legacy records (yours and your contacts', or the named peers') under " + node.DHTNamespace,
+		MinArgs:    1,
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			args := inv.Args
+			switch {
+			case args[0] == "routing-table" || args[0] == "rt":
+				dhtRoutingTable(a)
+				return nil
+			case args[0] == "get" && len(args) == 2:
+				return dhtGet(inv.Context(), a, args[1])
+			case args[0] == "put" && len(args) >= 3:
+				return dhtPut(inv.Context(), a, args[1], inv.Tail(2))
+			case args[0] == "providers" && len(args) == 2:
+				return dhtProviders(inv.Context(), a, args[1])
+			case args[0] == "migrate":
+				return dhtMigrate(inv.Context(), a, args[1:])
+			}
+			fmt.Println("usage: dht routing-table | get <key> | put <key> <value> | providers <cid> | migrate [<peer>...]")
+			return nil
+		},
+	})
+}
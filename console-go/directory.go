@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-chat/node"
+)
+
+const directoryFile = "p2pchat_directory.json"
+
+// Directory upkeep: how long after startup, and then how often, our
+// listings are republished with fresh member counts; and how many
+// publishers a browse asks at most.
+const (
+	directoryWait      = 30 * time.Second
+	directoryInterval  = 6 * time.Hour
+	maxDirectoryPeers  = 50
+	directoryQueryTime = time.Minute
+)
+
+// directoryBook is what we've opted to list in the public directory,
+// persisted to directoryFile in the data directory. Member counts are
+// filled in when the listings are published.
+type directoryBook struct {
+	mu       sync.Mutex
+	path     string
+	Listings []node.Listing `json:"listings"`
+}
+
+func loadDirectory(path string) (*directoryBook, error) {
+	b := &directoryBook{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+// save writes the book; callers hold b.mu.
+func (b *directoryBook) save() {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err == nil {
+		err = os.WriteFile(b.path, data, 0600)
+	}
+	if err != nil {
+		logger.Warnf("saving directory listings: %s", err)
+	}
+}
+
+// set adds or replaces the listing of kind and name.
+func (b *directoryBook) set(l node.Listing) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, old := range b.Listings {
+		if old.Kind == l.Kind && old.Name == l.Name {
+			b.Listings[i] = l
+			b.save()
+			return nil
+		}
+	}
+	if len(b.Listings) >= node.MaxListings {
+		return fmt.Errorf("already listing %d rooms and channels, the limit", node.MaxListings)
+	}
+	b.Listings = append(b.Listings, l)
+	b.save()
+	return nil
+}
+
+// remove drops the listing of kind and name, reporting whether there was one.
+func (b *directoryBook) remove(kind, name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, l := range b.Listings {
+		if l.Kind == kind && l.Name == name {
+			b.Listings = append(b.Listings[:i], b.Listings[i+1:]...)
+			b.save()
+			return true
+		}
+	}
+	return false
+}
+
+func (b *directoryBook) list() []node.Listing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]node.Listing(nil), b.Listings...)
+}
+
+// counted fills in the member counts of our listings: peers in a room we're
+// in, or subscribed to our channel's topic, plus us.
+func (a *app) counted(ls []node.Listing) []node.Listing {
+	for i, l := range ls {
+		switch l.Kind {
+		case "room":
+			if a.rooms.joined(l.Name) {
+				ls[i].Members = len(a.rooms.members(l.Name)) + 1
+			}
+		case "channel":
+			id := node.ChannelID(a.h.ID(), l.Name)
+			a.channelSubs.mu.Lock()
+			if r, ok := a.channelSubs.subs[id]; ok {
+				ls[i].Members = len(r.topic.ListPeers()) + 1
+			}
+			a.channelSubs.mu.Unlock()
+		}
+	}
+	return ls
+}
+
+// publishDirectory publishes our listings as they stand.
+func (a *app) publishDirectory(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	return a.node.PublishDirectory(ctx, a.counted(a.directory.list()))
+}
+
+// startDirectory republishes our listings, if we have any, so they don't
+// expire and their member counts stay current.
+func (a *app) startDirectory() {
+	go func() {
+		wait := directoryWait
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			wait = directoryInterval
+			if len(a.directory.list()) == 0 {
+				continue
+			}
+			if err := a.publishDirectory(a.ctx); err != nil {
+				logger.Debugf("publishing directory listings: %s", err)
+			}
+		}
+	}()
+}
+
+// listedEntry is a listing found browsing, with who listed it.
+type listedEntry struct {
+	node.Listing
+	Peer string `json:"peer"`
+}
+
+// browseDirectory fetches everyone's listings, most members first, keeping
+// those matching query (all of them if it's empty).
+func (a *app) browseDirectory(ctx context.Context, query string) ([]listedEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, directoryQueryTime)
+	defer cancel()
+	records, err := a.node.BrowseDirectory(ctx, maxDirectoryPeers)
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(query)
+	var out []listedEntry
+	for _, r := range records {
+		for _, l := range r.Listings {
+			if query != "" && !strings.Contains(strings.ToLower(l.Name+" "+l.Description), query) {
+				continue
+			}
+			out = append(out, listedEntry{Listing: l, Peer: r.Peer})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Members != out[j].Members {
+			return out[i].Members > out[j].Members
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+// listingTarget parses "#room" or "channel <name>" into a listing's kind
+// and name, returning how many arguments it took.
+func listingTarget(args []string) (kind, name string, used int, err error) {
+	if len(args) > 0 {
+		if room, ok := strings.CutPrefix(args[0], "#"); ok && room != "" {
+			return "room", room, 1, nil
+		}
+		if args[0] == "channel" && len(args) > 1 {
+			return "channel", args[1], 2, nil
+		}
+	}
+	return "", "", 0, errors.New("name a #room or 'channel <name>'")
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:       "directory",
+		Usage:      "publish <#room|channel <name>> <description> | unpublish <#room|channel <name>> | list | search <text>",
+		Summary:    "the public directory of rooms and channels: list yours (opt-in) or browse everyone's; alone, show what you list",
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) == 0 {
+				ls := a.directory.list()
+				if jsonOutput {
+					printJSON(map[string]any{"listings": ls})
+					return nil
+				}
+				if len(ls) == 0 {
+					fmt.Println("nothing listed; 'directory publish #room <description>' lists a room")
+				}
+				for _, l := range ls {
+					fmt.Printf(" - %s: %s\n", listingLabel(l, a.h.ID().String()), l.Description)
+				}
+				return nil
+			}
+			switch inv.Args[0] {
+			case "publish":
+				kind, name, used, err := listingTarget(inv.Args[1:])
+				if err != nil {
+					return err
+				}
+				desc := strings.TrimSpace(inv.Tail(1 + used))
+				switch {
+				case kind == "room" && !a.rooms.joined(name):
+					return fmt.Errorf("not in room %s (use 'join %s')", name, name)
+				case kind == "channel":
+					if own, _ := a.channels.snapshot(); own[name].Seq == 0 {
+						return fmt.Errorf("no channel of yours called %s", name)
+					}
+				}
+				if len(desc) > node.MaxListingDescLength {
+					return fmt.Errorf("description of %d bytes, limit %d", len(desc), node.MaxListingDescLength)
+				}
+				if err := a.directory.set(node.Listing{Kind: kind, Name: name, Description: desc}); err != nil {
+					return err
+				}
+				if err := a.publishDirectory(inv.Context()); err != nil {
+					return fmt.Errorf("saved, but publishing failed (will retry): %w", err)
+				}
+				printResult(map[string]any{"listed": kind, "name": name}, "listed "+listingLabel(node.Listing{Kind: kind, Name: name}, a.h.ID().String())+" in the public directory")
+				return nil
+			case "unpublish":
+				kind, name, _, err := listingTarget(inv.Args[1:])
+				if err != nil {
+					return err
+				}
+				if !a.directory.remove(kind, name) {
+					return fmt.Errorf("%s %s isn't listed", kind, name)
+				}
+				if err := a.publishDirectory(inv.Context()); err != nil {
+					return fmt.Errorf("removed, but publishing failed (will retry): %w", err)
+				}
+				printResult(map[string]any{"unlisted": kind, "name": name}, "unlisted "+kind+" "+name)
+				return nil
+			case "list", "search":
+				query := ""
+				if inv.Args[0] == "search" {
+					if len(inv.Args) < 2 {
+						return errors.New("usage: directory search <text>")
+					}
+					query = inv.Tail(1)
+				}
+				found, err := a.browseDirectory(inv.Context(), query)
+				if err != nil {
+					return err
+				}
+				if jsonOutput {
+					printJSON(map[string]any{"listings": found})
+					return nil
+				}
+				if len(found) == 0 {
+					fmt.Println("nothing found")
+				}
+				for _, e := range found {
+					fmt.Printf(" - %s (%d members, listed by %s): %s\n", listingLabel(e.Listing, e.Peer), e.Members, a.conversationLabel(e.Peer), e.Description)
+				}
+				return nil
+			}
+			return fmt.Errorf("unknown directory subcommand %q", inv.Args[0])
+		},
+	})
+}
+
+// listingLabel is how a listing is joined: "#room", or the channel's ID to
+// follow.
+func listingLabel(l node.Listing, publisher string) string {
+	if l.Kind == "room" {
+		return "#" + l.Name
+	}
+	return "channel " + publisher + "/" + l.Name
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dndMode is do-not-disturb: while active, desktop notifications are held
+// back and summarised when it ends, our presence isn't broadcast, and peers
+// optionally get an auto-reply.
+type dndMode struct {
+	// quiet is told when DND starts (true) and ends (false).
+	quiet func(on bool)
+
+	mu       sync.Mutex
+	on       bool
+	until    time.Time // zero means "until turned off"
+	status   string    // auto-reply text; empty disables auto-replies
+	replied  map[string]bool
+	missed   map[string]int // peerID -> messages received while active
+	reported bool
+}
+
+func newDND() *dndMode {
+	return &dndMode{replied: make(map[string]bool), missed: make(map[string]int)}
+}
+
+// active reports whether DND is currently in effect, expiring it if its
+// deadline has passed.
+func (d *dndMode) active() bool {
+	d.mu.Lock()
+	expired := d.on && !d.until.IsZero() && time.Now().After(d.until)
+	if expired {
+		d.on = false
+	}
+	on := d.on
+	d.mu.Unlock()
+	if expired {
+		d.setQuiet(false)
+	}
+	return on
+}
+
+func (d *dndMode) setQuiet(on bool) {
+	if d.quiet != nil {
+		d.quiet(on)
+	}
+}
+
+// hold records a message that arrived while DND was active. It returns the
+// auto-reply to send back, or "" if the peer has already been answered.
+func (d *dndMode) hold(m Message) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.missed[m.From]++
+	d.reported = false
+	if d.status == "" || d.replied[m.From] {
+		return ""
+	}
+	d.replied[m.From] = true
+	return "[auto-reply] " + d.status
+}
+
+// summary returns (and clears) the queued notification summary once DND has
+// ended, or "" if there is nothing to report.
+func (d *dndMode) summary() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.on || d.reported || len(d.missed) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	total := 0
+	for p, n := range d.missed {
+		total += n
+		fmt.Fprintf(&b, "\n  %s: %d", p, n)
+	}
+	d.missed = make(map[string]int)
+	d.replied = make(map[string]bool)
+	d.reported = true
+	return fmt.Sprintf("%d message(s) arrived while do-not-disturb was on:%s", total, b.String())
+}
+
+// command handles `dnd on [status]`, `dnd until <time> [status]` and `dnd off`.
+func (d *dndMode) command(args string) {
+	verb, rest, _ := strings.Cut(strings.TrimSpace(args), " ")
+	rest = strings.TrimSpace(rest)
+	switch verb {
+	case "", "status":
+	case "on":
+		d.mu.Lock()
+		d.on, d.until, d.status = true, time.Time{}, rest
+		d.mu.Unlock()
+		d.setQuiet(true)
+	case "until":
+		when, status, _ := strings.Cut(rest, " ")
+		t, err := parseUntil(when, time.Now())
+		if err != nil {
+			fmt.Println("dnd:", err)
+			return
+		}
+		d.mu.Lock()
+		d.on, d.until, d.status = true, t, strings.TrimSpace(status)
+		d.mu.Unlock()
+		d.setQuiet(true)
+		// Noticing the end is what announces our presence again.
+		time.AfterFunc(time.Until(t)+time.Second, func() { d.active() })
+	case "off":
+		d.mu.Lock()
+		was := d.on
+		d.on = false
+		d.mu.Unlock()
+		if was {
+			d.setQuiet(false)
+		}
+	default:
+		fmt.Println("usage: dnd on [status] | dnd until <HH:MM|duration|RFC3339> [status] | dnd off")
+		return
+	}
+	if !d.active() {
+		fmt.Println("do-not-disturb: off")
+		if s := d.summary(); s != "" {
+			fmt.Println(s)
+		}
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	line := "do-not-disturb: on"
+	if !d.until.IsZero() {
+		line += " until " + d.until.Format(time.Kitchen)
+	}
+	if d.status != "" {
+		line += fmt.Sprintf(" (auto-reply: %q)", d.status)
+	}
+	fmt.Println(line)
+}
+
+// parseUntil accepts a wall-clock time ("18:30"), a duration ("2h") or a
+// full RFC3339 timestamp.
+func parseUntil(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("15:04", s, now.Location()); err == nil {
+		t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("can't parse time %q", s)
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "dnd",
+		Usage:   "on [status] | until <time> [status] | off",
+		Summary: "do-not-disturb: hold notifications, stop broadcasting presence, optionally auto-reply with status",
+		Run: func(a *app, inv *invocation) error {
+			a.dnd.command(inv.Tail(0))
+			return nil
+		},
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	network "github.com/libp2p/go-libp2p/core/network"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// relayHopProtocol is spoken by peers that offer circuit relay service.
+const relayHopProtocol = "/libp2p/circuit/relay/0.2.0/hop"
+
+// clockCheckURL is asked for its Date header to estimate clock skew.
+const clockCheckURL = "https://www.cloudflare.com"
+
+type checkResult struct {
+	name   string
+	status string // ok, warn, fail, skip
+	detail string
+	advice string
+}
+
+// runDoctor checks the things that make connect and store fail without a
+// useful error, and says what to do about each.
+func runDoctor(ctx context.Context, a *app) []checkResult {
+	var out []checkResult
+	add := func(name, status, detail, advice string) {
+		out = append(out, checkResult{name, status, detail, advice})
+	}
+
+	addrs := a.h.Addrs()
+	public := 0
+	for _, addr := range addrs {
+		if manet.IsPublicAddr(addr) {
+			public++
+		}
+	}
+	switch {
+	case len(addrs) == 0:
+		add("listen addresses", "fail", "none", "the host isn't listening; check that the ports aren't blocked or in use")
+	case public == 0:
+		add("listen addresses", "warn", fmt.Sprintf("%d, all private", len(addrs)), "invites only work on your LAN unless you forward a port or use a relay")
+	default:
+		add("listen addresses", "ok", fmt.Sprintf("%d (%d public)", len(addrs), public), "")
+	}
+
+	switch r := reachability(a); r {
+	case network.ReachabilityPublic:
+		add("NAT reachability", "ok", "public", "")
+	case network.ReachabilityPrivate:
+		add("NAT reachability", "warn", "behind NAT", "peers can't dial you directly; forward a port or connect through a relay")
+	default:
+		add("NAT reachability", "skip", "unknown", "autonat needs a few connected peers before it can tell")
+	}
+
+	relays := 0
+	for _, p := range a.h.Network().Peers() {
+		if ok, _ := a.h.Peerstore().SupportsProtocols(p, relayHopProtocol); len(ok) > 0 {
+			relays++
+		}
+	}
+	if relays > 0 {
+		add("relays", "ok", fmt.Sprintf("%d connected peers offer relay", relays), "")
+	} else {
+		add("relays", "warn", "no connected relay", "if you're behind NAT, connect to a peer running as a relay")
+	}
+
+	peers := len(a.h.Network().Peers())
+	if peers == 0 {
+		add("connectivity", "fail", "no connected peers", "run 'connect <invite>' with a friend's invite; there are no public bootstrap nodes")
+	} else {
+		add("connectivity", "ok", fmt.Sprintf("%d connected peers", peers), "")
+	}
+
+	if size := a.dht.RoutingTable().Size(); size == 0 {
+		add("DHT routing table", "fail", "empty", "store/fetch need DHT peers; connect to at least one other peep-chat node")
+	} else if size < 3 {
+		add("DHT routing table", "warn", fmt.Sprintf("%d peers", size), "offline messages are only as durable as the few peers holding them")
+	} else {
+		add("DHT routing table", "ok", fmt.Sprintf("%d peers", size), "")
+	}
+
+	if skew, err := clockSkew(ctx); err != nil {
+		add("clock skew", "skip", err.Error(), "")
+	} else if skew > time.Minute || skew < -time.Minute {
+		add("clock skew", "warn", skew.Round(time.Second).String(), "message timestamps will be off; enable NTP")
+	} else {
+		add("clock skew", "ok", skew.Round(time.Second).String(), "")
+	}
+	return out
+}
+
+// reachability returns the host's last reachability verdict. The event is
+// stateful, so a fresh subscription receives the current value at once.
+func reachability(a *app) network.Reachability {
+	sub, err := a.h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return network.ReachabilityUnknown
+	}
+	defer sub.Close()
+	select {
+	case ev := <-sub.Out():
+		return ev.(event.EvtLocalReachabilityChanged).Reachability
+	case <-time.After(100 * time.Millisecond):
+		return network.ReachabilityUnknown
+	}
+}
+
+// clockSkew estimates how far our clock is ahead of an HTTP server's.
+func clockSkew(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, clockCheckURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't reach %s", clockCheckURL)
+	}
+	resp.Body.Close()
+	server, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no Date header from %s", clockCheckURL)
+	}
+	// Date has one-second resolution; compare against the request midpoint.
+	mid := start.Add(time.Since(start) / 2)
+	return mid.Sub(server), nil
+}
+
+// writeDoctor prints results with their advice.
+func writeDoctor(w io.Writer, results []checkResult) {
+	for _, r := range results {
+		fmt.Fprintf(w, "[%-4s] %-18s %s\n", r.status, r.name, r.detail)
+		if r.advice != "" && r.status != "ok" {
+			fmt.Fprintf(w, "       %-18s -> %s\n", "", r.advice)
+		}
+	}
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "doctor",
+		Summary: "check listen addresses, NAT, relays, DHT and clock, with advice",
+		Run: func(a *app, inv *invocation) error {
+			writeDoctor(os.Stdout, runDoctor(inv.Context(), a))
+			return nil
+		},
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+// errNoDirectPath means a require-e2e contact can't be reached directly.
+// Only a channel that is itself end-to-end encrypted may stand in.
+var errNoDirectPath = errors.New("no direct connection")
+
+// checkEncrypted reports why our connections to p don't carry end-to-end
+// encrypted messages, or nil if they do. A message sent on a libp2p
+// connection is encrypted for p itself, relayed or not, as long as the
+// connection is secured.
+func checkEncrypted(h host.Host, p peer.ID) error {
+	conns := h.Network().ConnsToPeer(p)
+	if len(conns) == 0 {
+		return errNoDirectPath
+	}
+	for _, c := range conns {
+		if node.ConnSecurity(c) == "" {
+			return fmt.Errorf("the connection over %s is not encrypted", c.RemoteMultiaddr())
+		}
+	}
+	return nil
+}
+
+// e2eReady connects to peerID if it is a require-e2e contact and checks
+// that a direct send would be encrypted end to end. It returns an error
+// wrapping errNoDirectPath if the peer can't be reached.
+func (a *app) e2eReady(peerID string) error {
+	if !a.contacts.requiresE2E(peerID) {
+		return nil
+	}
+	pi, err := a.contacts.resolve(peerID)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, 30*time.Second)
+	defer cancel()
+	if err := dialPeer(ctx, a.node, pi); err != nil {
+		return fmt.Errorf("%w: %s", errNoDirectPath, err)
+	}
+	if err := checkEncrypted(a.h, pi.ID); err != nil {
+		a.audit.record(auditE2ERefused, peerID, err.Error())
+		return fmt.Errorf("%s requires end-to-end encryption: %w", a.conversationLabel(peerID), err)
+	}
+	return nil
+}
+
+// refuseE2E reports, and audits, something to or from a require-e2e
+// contact that was refused for not being end-to-end encrypted.
+func (a *app) refuseE2E(peerID, what string) {
+	a.audit.record(auditE2ERefused, peerID, what)
+	if jsonOutput {
+		printJSON(map[string]string{"event": "e2e_refused", "peer": peerID, "what": what})
+		return
+	}
+	fmt.Printf("\n%s\n%s", styles.err("refused "+what+" for "+a.conversationLabel(peerID)+": it requires end-to-end encryption"), a.prompt())
+}
+
+// warnE2ESupport warns, when require-e2e is turned on, if the peer can't
+// currently take end-to-end encrypted messages from us.
+func (a *app) warnE2ESupport(peerID string) {
+	p, err := peer.Decode(peerID)
+	if err != nil {
+		return
+	}
+	switch err := checkEncrypted(a.h, p); {
+	case errors.Is(err, errNoDirectPath):
+		fmt.Println("note: not connected to it now; messages go only directly, or by encrypted email if registered")
+		return
+	case err != nil:
+		fmt.Println("warning:", err)
+		return
+	}
+	if protos, _ := a.h.Peerstore().SupportsProtocols(p, node.ProtocolID); len(protos) == 0 {
+		fmt.Println("warning: it doesn't offer direct messages (" + node.ProtocolID + "), so nothing can reach it end to end")
+	}
+}
+
+// e2eFetched tells whether a stored message must be withheld: stored
+// copies are never end-to-end encrypted.
+func (a *app) e2eFetched(m Message) bool {
+	return a.contacts.requiresE2E(m.From)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/emersion/go-imap"
+	imapclient "github.com/emersion/go-imap/client"
+)
+
+// emailSubjectTag marks gateway mail so replies can be found in the inbox.
+const emailSubjectTag = "[peep]"
+
+// emailConfig is read from emailConfigFile; the gateway is enabled when the
+// file exists.
+type emailConfig struct {
+	SMTP struct {
+		Addr     string `json:"addr"` // host:port, STARTTLS is used when offered
+		Username string `json:"username"`
+		Password string `json:"password"`
+		From     string `json:"from"`
+	} `json:"smtp"`
+	IMAP struct {
+		Addr     string `json:"addr"` // host:port, TLS
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Mailbox  string `json:"mailbox"`
+		Poll     string `json:"poll"` // poll interval, default 1m
+	} `json:"imap"`
+	// PrivateKey is our armored OpenPGP private key, used to sign what we
+	// mail and to decrypt replies.
+	PrivateKey string `json:"private_key"`
+	Passphrase string `json:"passphrase"`
+	// Contacts maps peer IDs to the email address and armored OpenPGP
+	// public key file they registered. Mail is only sent encrypted, and
+	// replies are only taken encrypted and signed with that key.
+	Contacts map[string]emailContact `json:"contacts"`
+}
+
+type emailContact struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"public_key"`
+}
+
+// emailGateway delivers messages for unreachable contacts as encrypted
+// email and feeds their replies back into the conversation.
+type emailGateway struct {
+	a       *app
+	cfg     emailConfig
+	keys    map[string]openpgp.EntityList // peerID -> recipient key
+	private openpgp.EntityList
+
+	mu      sync.Mutex
+	threads map[string]string // peerID -> Message-ID of the first mail, for threading
+
+	stop chan struct{}
+}
+
+func loadEmailConfig(path string) (*emailConfig, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := &emailConfig{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.SMTP.Addr == "" || cfg.SMTP.From == "" {
+		return nil, fmt.Errorf("%s: smtp.addr and smtp.from are required", path)
+	}
+	return cfg, nil
+}
+
+func startEmailGateway(a *app, cfg emailConfig) (*emailGateway, error) {
+	g := &emailGateway{
+		a:       a,
+		cfg:     cfg,
+		keys:    make(map[string]openpgp.EntityList),
+		threads: make(map[string]string),
+		stop:    make(chan struct{}),
+	}
+	for peerID, c := range cfg.Contacts {
+		if c.Address == "" || c.PublicKey == "" {
+			return nil, fmt.Errorf("email contact %s needs address and public_key", peerID)
+		}
+		keys, err := readArmoredKeyFile(c.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("email contact %s: %w", peerID, err)
+		}
+		g.keys[peerID] = keys
+	}
+	if cfg.PrivateKey != "" {
+		keys, err := readArmoredKeyFile(cfg.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("email private key: %w", err)
+		}
+		for _, e := range keys {
+			if err := decryptEntity(e, []byte(cfg.Passphrase)); err != nil {
+				return nil, fmt.Errorf("email private key: %w", err)
+			}
+		}
+		g.private = keys
+	}
+	if cfg.IMAP.Addr != "" {
+		poll := time.Minute
+		if cfg.IMAP.Poll != "" {
+			d, err := time.ParseDuration(cfg.IMAP.Poll)
+			if err != nil {
+				return nil, fmt.Errorf("imap.poll: %w", err)
+			}
+			poll = d
+		}
+		go g.pollLoop(poll)
+	}
+	return g, nil
+}
+
+func readArmoredKeyFile(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return openpgp.ReadArmoredKeyRing(f)
+}
+
+func decryptEntity(e *openpgp.Entity, pass []byte) error {
+	if e.PrivateKey != nil && e.PrivateKey.Encrypted {
+		if err := e.PrivateKey.Decrypt(pass); err != nil {
+			return err
+		}
+	}
+	for _, sub := range e.Subkeys {
+		if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+			if err := sub.PrivateKey.Decrypt(pass); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// canReach reports whether peerID registered an email address.
+func (g *emailGateway) canReach(peerID string) bool {
+	_, ok := g.keys[peerID]
+	return ok
+}
+
+// send encrypts body to the contact's key, signed with ours if we have
+// one, and mails it.
+func (g *emailGateway) send(peerID, body string) error {
+	keys, ok := g.keys[peerID]
+	if !ok {
+		return fmt.Errorf("%s has no registered email address", peerID)
+	}
+	contact := g.cfg.Contacts[peerID]
+
+	var armored bytes.Buffer
+	aw, err := armor.Encode(&armored, "PGP MESSAGE", nil)
+	if err != nil {
+		return err
+	}
+	var signer *openpgp.Entity
+	if len(g.private) > 0 {
+		signer = g.private[0]
+	}
+	w, err := openpgp.Encrypt(aw, keys, signer, nil, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := aw.Close(); err != nil {
+		return err
+	}
+
+	self := g.a.h.ID().String()
+	msgID := fmt.Sprintf("<%d.%s@peep-chat>", time.Now().UnixNano(), shortID(self))
+	g.mu.Lock()
+	first, threaded := g.threads[peerID]
+	if !threaded {
+		g.threads[peerID] = msgID
+	}
+	g.mu.Unlock()
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", g.cfg.SMTP.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", contact.Address)
+	fmt.Fprintf(&msg, "Subject: %s message from %s\r\n", emailSubjectTag, self)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: %s\r\n", msgID)
+	if threaded {
+		fmt.Fprintf(&msg, "In-Reply-To: %s\r\nReferences: %s\r\n", first, first)
+	}
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString("You were offline, so this peep-chat message was sent by email. Reply, encrypted and signed with your key, to answer.\r\n\r\n")
+	msg.Write(bytes.ReplaceAll(armored.Bytes(), []byte("\n"), []byte("\r\n")))
+	msg.WriteString("\r\n")
+
+	var auth smtp.Auth
+	if g.cfg.SMTP.Username != "" {
+		host, _, _ := strings.Cut(g.cfg.SMTP.Addr, ":")
+		auth = smtp.PlainAuth("", g.cfg.SMTP.Username, g.cfg.SMTP.Password, host)
+	}
+	return smtp.SendMail(g.cfg.SMTP.Addr, auth, g.cfg.SMTP.From, []string{contact.Address}, msg.Bytes())
+}
+
+func (g *emailGateway) pollLoop(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		if err := g.poll(); err != nil {
+			logger.Warnf("email gateway: %s", err)
+		}
+		select {
+		case <-t.C:
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// poll ingests unseen replies to gateway mail from registered contacts.
+func (g *emailGateway) poll() error {
+	c, err := imapclient.DialTLS(g.cfg.IMAP.Addr, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+	if err := c.Login(g.cfg.IMAP.Username, g.cfg.IMAP.Password); err != nil {
+		return err
+	}
+	mailbox := g.cfg.IMAP.Mailbox
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	if _, err := c.Select(mailbox, false); err != nil {
+		return err
+	}
+	crit := imap.NewSearchCriteria()
+	crit.WithoutFlags = []string{imap.SeenFlag}
+	crit.Header.Add("Subject", emailSubjectTag)
+	uids, err := c.UidSearch(crit)
+	if err != nil || len(uids) == 0 {
+		return err
+	}
+	seq := new(imap.SeqSet)
+	seq.AddNum(uids...)
+	section := &imap.BodySectionName{}
+	msgs := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() { done <- c.UidFetch(seq, []imap.FetchItem{section.FetchItem()}, msgs) }()
+	for msg := range msgs {
+		if r := msg.GetBody(section); r != nil {
+			g.ingest(r)
+		}
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	return c.UidStore(seq, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.SeenFlag}, nil)
+}
+
+// ingest turns one reply mail into an incoming message in the sender's
+// conversation. Only mail encrypted to us and signed with the contact's
+// registered key is taken; From alone proves nothing.
+func (g *emailGateway) ingest(r io.Reader) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return
+	}
+	peerID := ""
+	for id, c := range g.cfg.Contacts {
+		if strings.EqualFold(c.Address, from.Address) {
+			peerID = id
+			break
+		}
+	}
+	if peerID == "" {
+		logger.Debugf("email gateway: ignoring mail from unregistered %s", from.Address)
+		return
+	}
+	text, err := plainTextBody(msg)
+	if err != nil {
+		logger.Warnf("email gateway: reading mail from %s: %s", from.Address, err)
+		return
+	}
+	if !strings.Contains(text, "-----BEGIN PGP MESSAGE-----") {
+		if g.a.contacts.requiresE2E(peerID) {
+			g.a.refuseE2E(peerID, "an unencrypted email")
+		} else {
+			logger.Warnf("email gateway: dropping unencrypted mail from %s", from.Address)
+		}
+		return
+	}
+	if text, err = g.decrypt(peerID, text); err != nil {
+		logger.Warnf("email gateway: dropping mail from %s: %s", from.Address, err)
+		return
+	}
+	text = stripQuotedReply(text)
+	if text == "" {
+		return
+	}
+	when := time.Now()
+	if d, err := msg.Header.Date(); err == nil {
+		when = d
+	}
+	m := Message{From: peerID, When: when.UnixMilli(), Body: "[email] " + text}
+	g.a.post(func() { g.a.messageReceived(peerID, m, false) })
+}
+
+// decrypt opens the armored message in text and checks it was signed with
+// peerID's registered key.
+func (g *emailGateway) decrypt(peerID, text string) (string, error) {
+	if g.private == nil {
+		return "", errors.New("no private_key configured")
+	}
+	start := strings.Index(text, "-----BEGIN PGP MESSAGE-----")
+	block, err := armor.Decode(strings.NewReader(text[start:]))
+	if err != nil {
+		return "", err
+	}
+	contact := g.keys[peerID]
+	keyring := append(append(openpgp.EntityList{}, g.private...), contact...)
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	// The signature is only checked once the body has been read to the end.
+	b, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case !md.IsSigned:
+		return "", errors.New("not signed")
+	case md.SignedBy == nil:
+		return "", fmt.Errorf("signed with unknown key %X", md.SignedByKeyId)
+	case md.SignatureError != nil:
+		return "", fmt.Errorf("bad signature: %w", md.SignatureError)
+	case !slices.Contains(contact, md.SignedBy.Entity):
+		return "", fmt.Errorf("signed with key %X, not the contact's", md.SignedByKeyId)
+	}
+	return string(b), nil
+}
+
+// plainTextBody returns the first text/plain part of msg, decoded.
+func plainTextBody(msg *mail.Message) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		b, err := io.ReadAll(decodeTransfer(msg.Body, msg.Header.Get("Content-Transfer-Encoding")))
+		return string(b), err
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return "", errors.New("no text/plain part")
+		}
+		if err != nil {
+			return "", err
+		}
+		ct, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if ct == "" || ct == "text/plain" {
+			b, err := io.ReadAll(decodeTransfer(p, p.Header.Get("Content-Transfer-Encoding")))
+			return string(b), err
+		}
+	}
+}
+
+func decodeTransfer(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	}
+	return r
+}
+
+// stripQuotedReply drops quoted text and the "On ..., X wrote:" line mail
+// clients put above it.
+func stripQuotedReply(text string) string {
+	var lines []string
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		if strings.HasPrefix(line, "On ") && strings.HasSuffix(line, "wrote:") {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func (g *emailGateway) close() {
+	close(g.stop)
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "email",
+		Summary: "list contacts reachable through the email gateway (" + emailConfigFile + ")",
+		Run: func(a *app, inv *invocation) error {
+			if a.email == nil {
+				fmt.Println("email gateway not configured")
+				return nil
+			}
+			for id, c := range a.email.cfg.Contacts {
+				fmt.Printf(" - %s: %s\n", id, c.Address)
+			}
+			return nil
+		},
+	})
+}
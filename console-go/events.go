@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// uiQueue is how many network events may wait for the console to show
+// them.
+const uiQueue = 256
+
+// startUI runs the console's event loop: what arrives from the network is
+// shown from this one goroutine, in order, while the prompt keeps reading
+// commands.
+func (a *app) startUI() {
+	go func() {
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case fn := <-a.ui:
+				a.safely("event loop", fn)
+			}
+		}
+	}()
+}
+
+// post queues fn for the event loop.
+func (a *app) post(fn func()) {
+	select {
+	case a.ui <- fn:
+	case <-a.ctx.Done():
+	}
+}
+
+// lanes runs queued work in the background, one goroutine per key, in the
+// order it was queued; a lane's goroutine exits once it's empty.
+type lanes struct {
+	mu     sync.Mutex
+	queued map[string][]func()
+}
+
+func (l *lanes) run(key string, fn func()) {
+	l.mu.Lock()
+	q, busy := l.queued[key]
+	if l.queued == nil {
+		l.queued = make(map[string][]func())
+	}
+	l.queued[key] = append(q, fn)
+	l.mu.Unlock()
+	if busy {
+		return
+	}
+	go func() {
+		for {
+			l.mu.Lock()
+			q := l.queued[key]
+			if len(q) == 0 {
+				delete(l.queued, key)
+				l.mu.Unlock()
+				return
+			}
+			fn := q[0]
+			l.queued[key] = q[1:]
+			l.mu.Unlock()
+			fn()
+		}
+	}()
+}
+
+// dispatchInteractive runs a typed command line. Background commands go
+// to a worker lane so the prompt comes back at once; lines to the same
+// target share a lane and keep their order.
+func (a *app) dispatchInteractive(line string) error {
+	name, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if c := commands.lookup(name); c == nil || !c.Background {
+		return commands.dispatch(a, line)
+	}
+	key := name
+	if target, _, _ := strings.Cut(strings.TrimSpace(rest), " "); target != "" {
+		key = target
+	}
+	a.work.run(key, func() {
+		commands.dispatch(a, line)
+		if !jsonOutput {
+			fmt.Print(a.prompt())
+		}
+	})
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+const forwardFile = "p2pchat_forwarding.json"
+
+// Limits on what we carry for contacts: how long a sealed message is kept,
+// how many one sender may leave with us, and how many contacts a sender
+// hands each message to.
+const (
+	forwardTTL       = 7 * 24 * time.Hour
+	forwardPerSender = 50
+	forwardCopies    = 2
+)
+
+// heldSealed is a sealed message we carry for a contact.
+type heldSealed struct {
+	Sealed node.Sealed `json:"sealed"`
+	Held   int64       `json:"held"` // unix ms
+}
+
+// forwardStore holds sealed messages between contacts until the recipient
+// connects, persisted to forwardFile in the data directory. It also
+// remembers which sealed messages reached us, since each goes out in more
+// than one copy.
+type forwardStore struct {
+	mu     sync.Mutex
+	path   string
+	held   []heldSealed
+	opened map[string]bool
+}
+
+func loadForwardStore(path string) (*forwardStore, error) {
+	f := &forwardStore{path: path, opened: make(map[string]bool)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.held); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+// hold keeps s for its recipient, within the per-sender limit.
+func (f *forwardStore) hold(s node.Sealed) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire()
+	n := 0
+	for _, h := range f.held {
+		if h.Sealed.ID == s.ID {
+			return nil
+		}
+		if h.Sealed.From == s.From {
+			n++
+		}
+	}
+	if n >= forwardPerSender {
+		return fmt.Errorf("already holding %d messages from you", n)
+	}
+	f.held = append(f.held, heldSealed{Sealed: s, Held: time.Now().UnixMilli()})
+	f.save()
+	return nil
+}
+
+// pendingFor returns what we hold for recipient.
+func (f *forwardStore) pendingFor(recipient string) []node.Sealed {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire()
+	var out []node.Sealed
+	for _, h := range f.held {
+		if h.Sealed.To == recipient {
+			out = append(out, h.Sealed)
+		}
+	}
+	return out
+}
+
+// handedOver drops a message its recipient took.
+func (f *forwardStore) handedOver(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, h := range f.held {
+		if h.Sealed.ID == id {
+			f.held = append(f.held[:i], f.held[i+1:]...)
+			f.save()
+			return
+		}
+	}
+}
+
+// firstCopy reports whether a sealed message reaching us is new.
+func (f *forwardStore) firstCopy(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.opened[id] {
+		return false
+	}
+	f.opened[id] = true
+	return true
+}
+
+// expire drops messages held longer than forwardTTL or past their own
+// expiry; callers hold f.mu.
+func (f *forwardStore) expire() {
+	now := time.Now().UnixMilli()
+	cutoff := now - forwardTTL.Milliseconds()
+	kept := f.held[:0]
+	for _, h := range f.held {
+		if h.Held >= cutoff && (h.Sealed.Expires == 0 || h.Sealed.Expires >= now) {
+			kept = append(kept, h)
+		}
+	}
+	if len(kept) != len(f.held) {
+		f.held = kept
+		f.save()
+	}
+}
+
+// save writes the held messages; callers hold f.mu.
+func (f *forwardStore) save() {
+	data, err := json.MarshalIndent(f.held, "", "  ")
+	if err == nil {
+		err = os.WriteFile(f.path, data, 0600)
+	}
+	if err != nil {
+		logger.Warnf("saving forwarded messages: %s", err)
+	}
+}
+
+// forwardRequested decides whether to carry a sealed message: only
+// between two of our contacts, and not for a revoked key.
+func (a *app) forwardRequested(from peer.ID, s node.Sealed) error {
+	if a.contacts.nameOf(from.String()) == "" || a.contacts.nameOf(s.To) == "" {
+		return errors.New("only forwarding between mutual contacts")
+	}
+	if _, bad := a.revoked.untrusted(from.String(), time.Now().UnixMilli()); bad {
+		return errors.New("sender's key is revoked")
+	}
+	if err := a.forwards.hold(s); err != nil {
+		return err
+	}
+	logger.Infof("holding a sealed message from %s for %s", from, s.To)
+	// Usually the recipient is away and its next connection hands it over.
+	if to, err := peer.Decode(s.To); err == nil && len(a.h.Network().ConnsToPeer(to)) > 0 {
+		go a.handOverForwarded(to)
+	}
+	return nil
+}
+
+// handOverForwarded gives p whatever we hold for it.
+func (a *app) handOverForwarded(p peer.ID) {
+	for _, s := range a.forwards.pendingFor(p.String()) {
+		ctx, cancel := context.WithTimeout(a.ctx, 30*time.Second)
+		err := a.node.DeliverSealed(ctx, s)
+		cancel()
+		if err != nil {
+			logger.Debugf("handing sealed message to %s: %s", p, err)
+			return
+		}
+		a.forwards.handedOver(s.ID)
+	}
+}
+
+// forwardedReceived shows a sealed message a contact carried to us.
+func (a *app) forwardedReceived(via peer.ID, s node.Sealed, m Message) {
+	if !a.forwards.firstCopy(s.ID) {
+		return
+	}
+	logger.Infof("sealed message from %s forwarded by %s", m.From, via)
+	a.messageReceived(m.From, m, false)
+}
+
+// forwardViaContacts seals body for to and hands it to connected contacts
+// to pass on when to reappears. It returns the contacts that took it.
+func (a *app) forwardViaContacts(to, body string) ([]string, error) {
+	pid, err := peer.Decode(to)
+	if err != nil {
+		return nil, err
+	}
+	s, err := a.node.SealFor(pid, body)
+	if err != nil {
+		return nil, err
+	}
+	var carriers []string
+	for _, name := range a.contacts.names() {
+		pi, err := a.contacts.resolve(name)
+		if err != nil || pi.ID == pid || len(a.h.Network().ConnsToPeer(pi.ID)) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(a.ctx, 15*time.Second)
+		err = a.node.HoldForward(ctx, pi.ID, s)
+		cancel()
+		if err != nil {
+			logger.Debugf("%s won't forward to %s: %s", name, to, err)
+			continue
+		}
+		carriers = append(carriers, name)
+		if len(carriers) == forwardCopies {
+			break
+		}
+	}
+	if len(carriers) == 0 {
+		return nil, errors.New("no connected contact would forward it")
+	}
+	return carriers, nil
+}
+
+// tryForward hands body for to to contacts if --forward-via-contacts is
+// on and to's client can open sealed messages, reporting whether any took
+// it.
+func (a *app) tryForward(to, body string) bool {
+	if !a.forwardVia {
+		return false
+	}
+	if !a.supports(to, node.FeatureE2E) {
+		logger.Debugf("not forwarding to %s: its client can't open sealed messages", to)
+		return false
+	}
+	carriers, err := a.forwardViaContacts(to, body)
+	if err != nil {
+		logger.Debugf("forwarding to %s: %s", to, err)
+		return false
+	}
+	printResult(map[string]any{"sent": to, "via": "contacts", "carriers": carriers},
+		fmt.Sprintf("%s is offline; sealed and handed to %s to forward", a.conversationLabel(to), strings.Join(carriers, " and ")))
+	return true
+}
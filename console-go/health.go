@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// healthStatus is the JSON body of /healthz and /readyz.
+type healthStatus struct {
+	OK             bool     `json:"ok"`
+	PeerID         string   `json:"peer_id"`
+	ListenAddrs    int      `json:"listen_addrs"`
+	ConnectedPeers int      `json:"connected_peers"`
+	DHTRoutingSize int      `json:"dht_routing_table"`
+	Problems       []string `json:"problems,omitempty"`
+}
+
+func (a *app) healthStatus(ready bool) healthStatus {
+	st := healthStatus{
+		PeerID:         a.h.ID().String(),
+		ListenAddrs:    len(a.h.Addrs()),
+		ConnectedPeers: len(a.h.Network().Peers()),
+		DHTRoutingSize: a.dht.RoutingTable().Size(),
+	}
+	if st.ListenAddrs == 0 {
+		st.Problems = append(st.Problems, "host has no listen addresses")
+	}
+	// Readiness additionally needs the DHT to know at least one peer, or
+	// offline store/fetch can't work.
+	if ready && st.DHTRoutingSize == 0 {
+		st.Problems = append(st.Problems, "DHT routing table is empty (not bootstrapped)")
+	}
+	st.OK = len(st.Problems) == 0
+	return st
+}
+
+// serveHealth serves /healthz (the node is up and listening) and /readyz
+// (it is also connected to the DHT) on addr, answering 200 or 503.
+func serveHealth(a *app, addr string) *http.Server {
+	mux := http.NewServeMux()
+	handler := func(ready bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			st := a.healthStatus(ready)
+			w.Header().Set("Content-Type", "application/json")
+			if !st.OK {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			_ = json.NewEncoder(w).Encode(st)
+		}
+	}
+	mux.HandleFunc("/healthz", handler(false))
+	mux.HandleFunc("/readyz", handler(true))
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("health endpoint: %s", err)
+		}
+	}()
+	return srv
+}
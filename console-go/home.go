@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	peerstore "github.com/libp2p/go-libp2p/core/peerstore"
+
+	"p2p-chat/node"
+)
+
+// homeRedial is how often we check that our home node is connected and
+// dial it again if not.
+const homeRedial = time.Minute
+
+// homeTag protects the connection to our home node from the connection
+// manager's trimming.
+const homeTag = "home"
+
+// homeSync is how the last sync with our home node went.
+type homeSync struct {
+	running sync.Mutex // held while a sync runs
+
+	mu      sync.Mutex
+	last    time.Time
+	fetched int
+	err     error
+}
+
+// connectHome makes the home node at addr the first of s at startup; it
+// is dialled like any mailbox.
+func connectHome(ctx context.Context, h host.Host, s *mailboxSet, addr string) error {
+	id, err := connectMailbox(ctx, h, addr)
+	if err != nil {
+		return err
+	}
+	h.ConnManager().Protect(id, homeTag)
+	s.homeAddr, s.homeID = addr, id
+	return nil
+}
+
+// homeConnected syncs with our home node when p is it.
+func (a *app) homeConnected(p peer.ID) {
+	if _, id := a.mailbox.home(); id != "" && id == p {
+		go a.syncHome()
+	}
+}
+
+// syncHome collects what our home node held while we were away and shows
+// it as if it had just arrived. It returns how many messages that was.
+func (a *app) syncHome() (int, error) {
+	_, id := a.mailbox.home()
+	if id == "" {
+		return 0, errors.New("no home node; pair one with 'home pair <addr>'")
+	}
+	if !a.homeSync.running.TryLock() {
+		return 0, errors.New("already syncing")
+	}
+	defer a.homeSync.running.Unlock()
+	ctx, cancel := context.WithTimeout(a.ctx, time.Minute)
+	msgs, err := a.node.FetchMailbox(ctx, id)
+	cancel()
+	a.homeSync.mu.Lock()
+	a.homeSync.last, a.homeSync.fetched, a.homeSync.err = time.Now(), len(msgs), err
+	a.homeSync.mu.Unlock()
+	if err != nil {
+		logger.Debugf("syncing with home node %s: %s", id, err)
+		return 0, err
+	}
+	if len(msgs) > 0 {
+		logger.Infof("home node held %d messages while you were away", len(msgs))
+	}
+	for _, f := range msgs {
+		m := f.Message
+		if f.Verification == node.Invalid {
+			logger.Warnf("dropped a stored message claiming to be from %s: %s", m.From, f.Problem)
+			continue
+		}
+		if a.e2eFetched(m) {
+			logger.Warnf("withheld a stored message from %s: they require end-to-end encryption and stored copies aren't", m.From)
+			continue
+		}
+		a.post(func() { a.messageReceived(m.From, m, false) })
+	}
+	return len(msgs), nil
+}
+
+// keepHomeSynced stays connected to our home node, dialling it again when
+// the connection drops; each new connection syncs.
+func (a *app) keepHomeSynced() {
+	go func() {
+		if _, id := a.mailbox.home(); id != "" && len(a.h.Network().ConnsToPeer(id)) > 0 {
+			a.syncHome()
+		}
+		t := time.NewTicker(homeRedial)
+		defer t.Stop()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-t.C:
+			}
+			_, id := a.mailbox.home()
+			if id == "" || len(a.h.Network().ConnsToPeer(id)) > 0 {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(a.ctx, 30*time.Second)
+			if err := a.h.Connect(ctx, a.h.Peerstore().PeerInfo(id)); err != nil {
+				logger.Debugf("home node %s: %s", id, err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// pairHome checks that the node at addr is our home node and makes it our
+// first mailbox, here and in the client config.
+func (a *app) pairHome(ctx context.Context, addr string) (peer.ID, error) {
+	pi, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		return "", err
+	}
+	if pi.ID == a.h.ID() {
+		return "", errors.New("that's this node")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	a.h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
+	if err := a.h.Connect(ctx, *pi); err != nil {
+		return "", err
+	}
+	if err := a.node.PairHome(ctx, pi.ID); err != nil {
+		return "", fmt.Errorf("%w (start it with 'serve-relay --home %s')", err, a.h.ID())
+	}
+	if _, old := a.mailbox.home(); old != "" && old != pi.ID {
+		a.h.ConnManager().Unprotect(old, homeTag)
+	}
+	a.h.ConnManager().Protect(pi.ID, homeTag)
+	a.setHome(addr, pi.ID)
+	return pi.ID, nil
+}
+
+// setHome switches to the home node at addr, id ("" for none), telling
+// contacts through our profile and inbox pointer and recording it in the
+// client config.
+func (a *app) setHome(addr string, id peer.ID) {
+	a.mailbox.setHome(addr, id)
+	a.node.SetProfile(a.profile())
+	cfg, err := loadClientConfig(a.configPath)
+	if err == nil {
+		cfg.Home = addr
+		err = cfg.save(a.configPath)
+	}
+	if err != nil {
+		logger.Warnf("recording home node: %s", err)
+	}
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "home",
+		Usage:   "[pair <multiaddr> | unpair | sync]",
+		Summary: "pair with an always-on home node (serve-relay --home) that holds your offline messages and hands them over when you reconnect; alone, show it",
+		Run: func(a *app, inv *invocation) error {
+			addr, id := a.mailbox.home()
+			if len(inv.Args) == 0 {
+				a.homeSync.mu.Lock()
+				last, fetched, serr := a.homeSync.last, a.homeSync.fetched, a.homeSync.err
+				a.homeSync.mu.Unlock()
+				connected := id != "" && len(a.h.Network().ConnsToPeer(id)) > 0
+				if jsonOutput {
+					out := map[string]any{"home": addr, "connected": connected, "fetched": fetched}
+					if !last.IsZero() {
+						out["synced"] = last.UnixMilli()
+					}
+					if serr != nil {
+						out["error"] = serr.Error()
+					}
+					printJSON(out)
+					return nil
+				}
+				if id == "" {
+					fmt.Println("no home node; start one with 'serve-relay --home " + a.h.ID().String() + "' and run 'home pair <addr>'")
+					return nil
+				}
+				state := "not connected"
+				if connected {
+					state = "connected"
+				}
+				fmt.Printf("home node %s (%s)\n", addr, state)
+				switch {
+				case serr != nil:
+					fmt.Printf("last sync %s failed: %s\n", last.Format(time.TimeOnly), serr)
+				case !last.IsZero():
+					fmt.Printf("last synced %s: %d fetched\n", last.Format(time.TimeOnly), fetched)
+				}
+				return nil
+			}
+			switch inv.Args[0] {
+			case "pair":
+				if len(inv.Args) != 2 {
+					return errors.New("usage: home pair <multiaddr>")
+				}
+				id, err := a.pairHome(inv.Context(), inv.Args[1])
+				if err != nil {
+					return err
+				}
+				printResult(map[string]string{"home": inv.Args[1]}, "paired with home node "+shortID(id.String())+"; it holds your offline messages from now on")
+				go a.syncHome()
+				return nil
+			case "unpair":
+				if id == "" {
+					return errors.New("no home node")
+				}
+				a.h.ConnManager().Unprotect(id, homeTag)
+				a.setHome("", "")
+				printResult(map[string]string{"unpaired": addr}, "unpaired home node "+shortID(id.String()))
+				return nil
+			case "sync":
+				n, err := a.syncHome()
+				if err != nil {
+					return err
+				}
+				printResult(map[string]int{"fetched": n}, fmt.Sprintf("fetched %d messages from your home node", n))
+				return nil
+			}
+			return fmt.Errorf("unknown home subcommand %q", inv.Args[0])
+		},
+	})
+}
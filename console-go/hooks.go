@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types passed to the user hook.
+const (
+	eventMessageReceived  = "message.received"
+	eventMessageDelivered = "message.delivered"
+	eventPeerConnected    = "peer.connected"
+	eventPeerDisconnected = "peer.disconnected"
+	eventPeerOffline      = "peer.offline"
+)
+
+// hookTimeout bounds how long a single hook invocation may run.
+const hookTimeout = 10 * time.Second
+
+// hookWorkers caps how many hook processes run at once, and hookQueue how
+// many events may be running or waiting for one; a busy room drops the
+// events beyond that rather than forking a process per message.
+const (
+	hookWorkers = 4
+	hookQueue   = 256
+)
+
+// hookEvent is the JSON document written to the hook's stdin.
+type hookEvent struct {
+	Type    string   `json:"type"`
+	Peer    string   `json:"peer,omitempty"` // empty for messages we sent to a room
+	When    int64    `json:"when"`
+	Message *Message `json:"message,omitempty"`
+	// Transport and Relayed describe the connection, for peer.connected.
+	Transport string `json:"transport,omitempty"`
+	Relayed   bool   `json:"relayed,omitempty"`
+}
+
+// hookRunner executes a user-specified shell command for chat events, so
+// notifications, logging and automation can be wired up without patching
+// the client.
+type hookRunner struct {
+	mu      sync.Mutex
+	cmdline string
+	pending int           // events queued or running
+	slots   chan struct{} // one per running hook
+}
+
+func newHookRunner(command string) *hookRunner {
+	return &hookRunner{cmdline: command, slots: make(chan struct{}, hookWorkers)}
+}
+
+// fire runs the hook for ev in the background. It's a no-op when no hook is set.
+func (hr *hookRunner) fire(ev hookEvent) {
+	recent.note("%s %s", ev.Type, ev.Peer)
+	hr.mu.Lock()
+	command := hr.cmdline
+	full := hr.pending >= hookQueue
+	if command != "" && !full {
+		hr.pending++
+	}
+	hr.mu.Unlock()
+	if command == "" {
+		return
+	}
+	if full {
+		logger.Warnf("hook busy, dropped %s event", ev.Type)
+		return
+	}
+	if ev.When == 0 {
+		ev.When = time.Now().UnixMilli()
+	}
+	go func() {
+		hr.slots <- struct{}{}
+		defer func() {
+			<-hr.slots
+			hr.mu.Lock()
+			hr.pending--
+			hr.mu.Unlock()
+		}()
+		if err := runHook(command, ev); err != nil {
+			logger.Warnf("hook for %s failed: %s", ev.Type, err)
+		}
+	}()
+}
+
+func runHook(command string, ev hookEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "PEEP_EVENT="+ev.Type, "PEEP_PEER="+ev.Peer)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// command handles `hook`, `hook set <command>` and `hook off`.
+func (hr *hookRunner) command(args string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if rest, ok := strings.CutPrefix(args, "set "); ok && strings.TrimSpace(rest) != "" {
+		args = "set"
+		hr.cmdline = strings.TrimSpace(rest)
+	}
+	switch args {
+	case "", "status", "set":
+	case "off":
+		hr.cmdline = ""
+	default:
+		fmt.Println("usage: hook [status] | hook set <command> | hook off")
+		return
+	}
+	if hr.cmdline == "" {
+		fmt.Println("no hook configured")
+		return
+	}
+	fmt.Println("hook:", hr.cmdline)
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "hook",
+		Usage:   "[status] | set <command> | off",
+		Summary: "run a shell command on message/peer events (JSON on stdin)",
+		Run: func(a *app, inv *invocation) error {
+			a.hooks.command(inv.Tail(0))
+			return nil
+		},
+	})
+}
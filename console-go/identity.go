@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+	"p2p-chat/paths"
+)
+
+// PEM block types of an armored identity. A passphrase-protected key is
+// exported as it is stored, so it stays protected.
+const (
+	armorKey          = "PEEP PRIVATE KEY"
+	armorEncryptedKey = "PEEP ENCRYPTED PRIVATE KEY"
+)
+
+// identityOptions are the flags of 'identity'.
+type identityOptions struct {
+	dataDir string
+	armor   bool
+	out     string
+	yes     bool
+	reason  string
+	since   string
+}
+
+func (o *identityOptions) flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.dataDir, "data-dir", "", "use the identity in this directory instead of the OS defaults")
+	fs.BoolVar(&o.armor, "armor", false, "export: write ASCII armor (PEM) instead of the raw libp2p key")
+	fs.StringVar(&o.out, "out", "", "export, revoke-cert: write to this file instead of stdout")
+	fs.BoolVar(&o.yes, "yes", false, "don't ask for confirmation (needed when the key comes from stdin)")
+	fs.StringVar(&o.reason, "reason", "", "revoke-cert: reason stated in the certificate")
+	fs.StringVar(&o.since, "since", "", "revoke-cert: distrust messages from this time (RFC 3339) on; default: from when peers see the certificate")
+}
+
+// identityCmd runs 'identity show|export|import|revoke-cert', moving an
+// identity between machines as a raw libp2p key file or ASCII armor. The
+// action may come before or after the flags.
+func identityCmd(args []string) int {
+	fs := subcommandFlags("identity")
+	var opts identityOptions
+	opts.flags(fs)
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	rest := fs.Args()
+	if action == "" && len(rest) > 0 {
+		action, rest = rest[0], rest[1:]
+	}
+	dirs, err := paths.Open(opts.dataDir)
+	if err != nil {
+		fmt.Println("failed to set up data directory:", err)
+		return exitFailed
+	}
+	path := dirs.DataFile(identityFile)
+	w := &wizard{in: bufio.NewReader(os.Stdin)}
+	switch {
+	case action == "show" && len(rest) == 0:
+		return showIdentity(w, path)
+	case action == "export" && len(rest) == 0:
+		return exportIdentity(w, path, opts)
+	case action == "import" && len(rest) <= 1:
+		src := "-"
+		if len(rest) == 1 {
+			src = rest[0]
+		}
+		return importIdentity(w, path, src, opts)
+	case action == "revoke-cert" && len(rest) == 0:
+		return revocationCert(w, path, opts)
+	}
+	fs.Usage()
+	return exitUsage
+}
+
+// readIdentity loads the key file at path, asking for its passphrase if
+// it has one, and returns it with the file's contents.
+func readIdentity(w *wizard, path string) (crypto.PrivKey, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	priv, err := node.ParseIdentity(data, func() ([]byte, error) {
+		if p, err := node.EnvPassphrase(); err == nil {
+			return p, nil
+		}
+		return readPassphrase(w.in, "Passphrase: ")
+	})
+	return priv, data, err
+}
+
+// printIdentity shows the peer ID and fingerprint of priv.
+func printIdentity(label string, priv crypto.PrivKey) error {
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	fp, err := node.Fingerprint(priv.GetPublic())
+	if err != nil {
+		return err
+	}
+	fmt.Println(label)
+	fmt.Println("  peer ID:    ", id)
+	fmt.Println("  fingerprint:", fp)
+	return nil
+}
+
+func showIdentity(w *wizard, path string) int {
+	priv, data, err := readIdentity(w, path)
+	if err != nil {
+		fmt.Println("identity error:", err)
+		return exitFailed
+	}
+	if err := printIdentity("identity at "+path, priv); err != nil {
+		fmt.Println("identity error:", err)
+		return exitFailed
+	}
+	if node.IsEncryptedIdentity(data) {
+		fmt.Println("  protected by a passphrase")
+	}
+	return exitOK
+}
+
+func exportIdentity(w *wizard, path string, opts identityOptions) int {
+	priv, data, err := readIdentity(w, path)
+	if err != nil {
+		fmt.Println("identity error:", err)
+		return exitFailed
+	}
+	if opts.out == "" && !opts.armor && isTerminal(os.Stdout) {
+		fmt.Println("the raw key is binary; use --armor or --out <file>")
+		return exitUsage
+	}
+	// Prompts and notes go to stderr when the key itself goes to stdout.
+	msgs := os.Stdout
+	if opts.out == "" {
+		msgs = os.Stderr
+	}
+	id, _ := peer.IDFromPrivateKey(priv)
+	fp, err := node.Fingerprint(priv.GetPublic())
+	if err != nil {
+		fmt.Println("identity error:", err)
+		return exitFailed
+	}
+	fmt.Fprintf(msgs, "Exporting identity %s\n  fingerprint: %s\n", id, fp)
+	if !node.IsEncryptedIdentity(data) {
+		fmt.Fprintln(msgs, "The key isn't passphrase protected: whoever gets the export can be you.")
+	}
+	if !opts.yes && !confirm(w, msgs, "Export it?") {
+		fmt.Fprintln(msgs, "not exported")
+		return exitFailed
+	}
+	out := data
+	if opts.armor {
+		block := &pem.Block{Type: armorKey, Headers: map[string]string{"Peer-ID": id.String(), "Fingerprint": fp}}
+		if node.IsEncryptedIdentity(data) {
+			block.Type = armorEncryptedKey
+		}
+		block.Bytes = data
+		out = pem.EncodeToMemory(block)
+	}
+	if opts.out == "" {
+		os.Stdout.Write(out)
+		return exitOK
+	}
+	if err := os.WriteFile(opts.out, out, 0600); err != nil {
+		fmt.Println("export error:", err)
+		return exitFailed
+	}
+	fmt.Println("wrote", opts.out)
+	return exitOK
+}
+
+func importIdentity(w *wizard, path, src string, opts identityOptions) int {
+	var data []byte
+	var err error
+	if src == "-" {
+		if !opts.yes {
+			fmt.Println("reading the key from stdin leaves no way to confirm; pass --yes or a file name")
+			return exitUsage
+		}
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(src)
+	}
+	if err != nil {
+		fmt.Println("import error:", err)
+		return exitFailed
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != armorKey && block.Type != armorEncryptedKey {
+			fmt.Printf("import error: unexpected armor type %q\n", block.Type)
+			return exitFailed
+		}
+		data = block.Bytes
+	}
+	priv, err := node.ParseIdentity(data, func() ([]byte, error) {
+		if p, err := node.EnvPassphrase(); err == nil {
+			return p, nil
+		}
+		return readPassphrase(w.in, "Passphrase of the imported key: ")
+	})
+	if err != nil {
+		fmt.Println("import error:", err)
+		return exitFailed
+	}
+	if err := printIdentity("Importing", priv); err != nil {
+		fmt.Println("import error:", err)
+		return exitFailed
+	}
+	old, _, err := readIdentity(w, path)
+	switch {
+	case err == nil && old.Equals(priv):
+		fmt.Println("That is already your identity.")
+		return exitOK
+	case err == nil:
+		if err := printIdentity("It replaces", old); err != nil {
+			fmt.Println("import error:", err)
+			return exitFailed
+		}
+		fmt.Println("Peers will see you as the imported peer ID from now on.")
+	case errors.Is(err, fs.ErrNotExist):
+	default:
+		// An identity we can't open is still replaced, but kept as a backup.
+		fmt.Println("The current identity can't be read:", err)
+	}
+	if !opts.yes && !confirm(w, os.Stdout, "Import it?") {
+		fmt.Println("not imported")
+		return exitFailed
+	}
+	if _, err := os.Stat(path); err == nil {
+		backup, err := backupIdentity(path)
+		if err != nil {
+			fmt.Println("import error:", err)
+			return exitFailed
+		}
+		fmt.Println("Moved the old identity to", backup)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		fmt.Println("import error:", err)
+		return exitFailed
+	}
+	fmt.Println("imported into", path)
+	return exitOK
+}
+
+// revocationCert writes a revocation certificate for the identity, to be
+// kept safe and published with 'revocation publish' if the key is lost.
+func revocationCert(w *wizard, path string, opts identityOptions) int {
+	var since time.Time
+	if opts.since != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, opts.since); err != nil {
+			fmt.Println("invalid --since:", err)
+			return exitUsage
+		}
+	}
+	priv, _, err := readIdentity(w, path)
+	if err != nil {
+		fmt.Println("identity error:", err)
+		return exitFailed
+	}
+	r, err := node.NewRevocation(priv, opts.reason, since)
+	if err != nil {
+		fmt.Println("revocation error:", err)
+		return exitFailed
+	}
+	b, _ := json.MarshalIndent(r, "", "  ")
+	b = append(b, '\n')
+	if opts.out == "" {
+		os.Stdout.Write(b)
+		return exitOK
+	}
+	if err := os.WriteFile(opts.out, b, 0600); err != nil {
+		fmt.Println("revocation error:", err)
+		return exitFailed
+	}
+	fmt.Println("wrote", opts.out)
+	fmt.Println("Keep it offline. Anyone holding it can declare your identity compromised.")
+	return exitOK
+}
+
+// confirm asks a yes/no question defaulting to no, printing to out.
+func confirm(w *wizard, out *os.File, question string) bool {
+	fmt.Fprintf(out, "%s [y/N]: ", question)
+	line, _ := w.in.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// backupIdentity moves the key at path aside to a name with the time in
+// it and returns that name.
+func backupIdentity(path string) (string, error) {
+	backup := path + "." + time.Now().Format("20060102-150405") + ".bak"
+	return backup, os.Rename(path, backup)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ircConfig is read from ircConfigFile. The bridge is enabled when the file
+// exists.
+type ircConfig struct {
+	Server  string `json:"server"` // host:port
+	TLS     bool   `json:"tls"`
+	Nick    string `json:"nick"`
+	Channel string `json:"channel"` // e.g. "#peep"
+	Room    string `json:"room"`    // peep-chat room to mirror
+	// IRCPrefix is prepended to lines relayed from IRC into the room,
+	// PeepPrefix to lines relayed from the room into IRC.
+	IRCPrefix  string `json:"irc_prefix"`
+	PeepPrefix string `json:"peep_prefix"`
+	// Nicks maps peer IDs to the names shown on IRC; unmapped peers are
+	// shown by shortened peer ID.
+	Nicks map[string]string `json:"nicks"`
+}
+
+// ircBridge mirrors messages between an IRC channel and a room.
+type ircBridge struct {
+	a   *app
+	cfg ircConfig
+
+	mu   sync.Mutex
+	conn net.Conn
+
+	stop chan struct{}
+}
+
+func loadIRCConfig(path string) (*ircConfig, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ircConfig{IRCPrefix: "[irc] "}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Server == "" || cfg.Nick == "" || cfg.Channel == "" || cfg.Room == "" {
+		return nil, fmt.Errorf("%s: server, nick, channel and room are required", path)
+	}
+	return cfg, nil
+}
+
+// startIRCBridge joins the mirrored room and keeps an IRC connection up in
+// the background, reconnecting with backoff.
+func startIRCBridge(a *app, cfg ircConfig) (*ircBridge, error) {
+	if err := a.rooms.join(cfg.Room); err != nil {
+		return nil, err
+	}
+	b := &ircBridge{a: a, cfg: cfg, stop: make(chan struct{})}
+	go b.run()
+	return b, nil
+}
+
+func (b *ircBridge) run() {
+	backoff := time.Second
+	for {
+		err := b.session()
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+		logger.Warnf("irc bridge: %s (reconnecting in %s)", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-b.stop:
+			return
+		}
+		if backoff < 5*time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// session runs one IRC connection until it fails.
+func (b *ircBridge) session() error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if b.cfg.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", b.cfg.Server, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", b.cfg.Server)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	b.mu.Lock()
+	b.conn = conn
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.conn = nil
+		b.mu.Unlock()
+	}()
+
+	b.send("NICK " + b.cfg.Nick)
+	b.send("USER " + b.cfg.Nick + " 0 * :peep-chat bridge")
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		b.handleLine(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func (b *ircBridge) handleLine(line string) {
+	prefix, cmd, params := parseIRCLine(line)
+	switch cmd {
+	case "PING":
+		b.send("PONG :" + strings.Join(params, " "))
+	case "001": // welcome: registration finished
+		b.send("JOIN " + b.cfg.Channel)
+		logger.Infof("irc bridge: connected to %s, joining %s", b.cfg.Server, b.cfg.Channel)
+	case "433": // nick in use
+		b.cfg.Nick += "_"
+		b.send("NICK " + b.cfg.Nick)
+	case "PRIVMSG":
+		if len(params) < 2 || !strings.EqualFold(params[0], b.cfg.Channel) {
+			return
+		}
+		nick, _, _ := strings.Cut(prefix, "!")
+		text := params[1]
+		if action, ok := strings.CutPrefix(text, "\x01ACTION "); ok {
+			text = "* " + nick + " " + stripIRCFormatting(strings.TrimSuffix(action, "\x01"))
+		} else if strings.HasPrefix(text, "\x01") {
+			return // other CTCP requests aren't chat
+		} else {
+			text = "<" + nick + "> " + stripIRCFormatting(text)
+		}
+		if _, err := b.a.rooms.publish(b.a.ctx, b.cfg.Room, b.cfg.IRCPrefix+text); err != nil {
+			logger.Warnf("irc bridge: dropped %.80q from %s, not relayed to #%s: %s", text, nick, b.cfg.Room, err)
+		}
+	}
+}
+
+// stripIRCFormatting removes mIRC formatting codes: bold, italics,
+// underline, strikethrough, monospace, reverse and reset, and colours with
+// their foreground and background numbers (\x03) or hex values (\x04).
+// Peers reject messages with control characters, so formatted lines would
+// otherwise never reach the room.
+func stripIRCFormatting(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\x02', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		case '\x03', '\x04':
+			digit := isDigit
+			n := 2
+			if c == '\x04' {
+				digit, n = isHexDigit, 6
+			}
+			j := skipRun(s, i+1, n, digit)
+			if j > i+1 && j+1 < len(s) && s[j] == ',' && digit(s[j+1]) {
+				j = skipRun(s, j+1, n, digit)
+			}
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// skipRun returns the index after up to n bytes of s from i that match.
+func skipRun(s string, i, n int, match func(byte) bool) int {
+	for end := i + n; i < end && i < len(s) && match(s[i]); i++ {
+	}
+	return i
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// roomMessage relays a message from the mirrored room to IRC.
+func (b *ircBridge) roomMessage(m Message) {
+	if m.Room != b.cfg.Room {
+		return
+	}
+	nick := b.cfg.Nicks[m.From]
+	if nick == "" {
+		nick = shortID(m.From)
+	}
+	for _, line := range strings.Split(m.Body, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			b.send(fmt.Sprintf("PRIVMSG %s :%s<%s> %s", b.cfg.Channel, b.cfg.PeepPrefix, nick, line))
+		}
+	}
+}
+
+func (b *ircBridge) send(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return
+	}
+	// IRC lines are limited to 512 bytes including CRLF.
+	if len(line) > 510 {
+		line = line[:510]
+	}
+	b.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := b.conn.Write([]byte(line + "\r\n")); err != nil {
+		logger.Warnf("irc bridge: write: %s", err)
+	}
+}
+
+func (b *ircBridge) status() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := "disconnected"
+	if b.conn != nil {
+		state = "connected"
+	}
+	return fmt.Sprintf("%s %s <-> #%s (%s as %s)", b.cfg.Server, b.cfg.Channel, b.cfg.Room, state, b.cfg.Nick)
+}
+
+func (b *ircBridge) close() {
+	close(b.stop)
+	b.send("QUIT :bye")
+	b.mu.Lock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	b.mu.Unlock()
+}
+
+// parseIRCLine splits a raw IRC line into prefix, command and parameters,
+// with the trailing parameter (after " :") as the last element.
+func parseIRCLine(line string) (prefix, cmd string, params []string) {
+	if strings.HasPrefix(line, ":") {
+		prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return prefix, "", nil
+	}
+	cmd, params = strings.ToUpper(fields[0]), fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return prefix, cmd, params
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "irc",
+		Summary: "show IRC bridge status (configured in " + ircConfigFile + ")",
+		Run: func(a *app, inv *invocation) error {
+			if a.irc == nil {
+				fmt.Println("IRC bridge not configured")
+				return nil
+			}
+			fmt.Println(a.irc.status())
+			return nil
+		},
+	})
+}
@@ -0,0 +1,95 @@
+package itest
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBrowserRoundTrip builds the wasm node, runs it under Node.js (whose
+// WebSocket stands in for the browser's) and has it exchange messages with
+// a console peer listening on /ws. It's skipped without a node that has
+// WebSocket, built in from Node.js 22 or behind a flag from 20.10.
+func TestBrowserRoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts real processes; skipped with -short")
+	}
+	nodeArgs, ok := nodeWithWebSocket()
+	if !ok {
+		t.Skip("needs Node.js with WebSocket")
+	}
+	root := setup(t)
+	wasm := filepath.Join(root, "peep.wasm")
+	build := exec.Command("go", "build", "-o", wasm, "../wasm")
+	build.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building the wasm node: %s\n%s", err, out)
+	}
+	goroot, err := exec.Command("go", "env", "GOROOT").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	console, err := start("console", filepath.Join(root, "console"), "--listen", "/ip4/127.0.0.1/tcp/0/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := &proc{name: "browser"}
+	defer func() {
+		for _, p := range []*proc{console, browser} {
+			if p.cmd != nil {
+				p.cmd.Process.Kill()
+			}
+		}
+	}()
+	step := func(name string, err error) {
+		if err != nil {
+			for _, p := range []*proc{console, browser} {
+				t.Logf("--- %s (last lines)\n%s", p.name, p.tail(15))
+			}
+			t.Fatalf("%s: %s", name, err)
+		}
+		t.Log("ok  ", name)
+	}
+
+	m, err := console.expect(`Peer ID: (\S+)`)
+	if err == nil {
+		console.id = m[1]
+		m, err = console.expect(`(/ip4/127\.0\.0\.1/tcp/\d+/ws)`)
+	}
+	step("start console peer", err)
+	console.addr = m[1] + "/p2p/" + console.id
+
+	cmd := exec.Command("node", append(nodeArgs, "testdata/browser.js", wasm, console.addr)...)
+	cmd.Env = append(os.Environ(), "GOROOT="+strings.TrimSpace(string(goroot)))
+	err = browser.run(cmd)
+	if err == nil {
+		m, err = browser.expect(`wasm peer (\S+)`)
+	}
+	step("start wasm node", err)
+	browser.id = m[1]
+	_, err = browser.expect(`connected to ` + console.id)
+	step("connect over WebSocket", err)
+	_, err = console.expect(`<msg from=` + browser.id + ` .*> hello from the browser$`)
+	step("browser to console", err)
+	err = console.send("send " + browser.id + " hello back")
+	if err == nil {
+		_, err = browser.expect(`received from ` + console.id + `: hello back$`)
+	}
+	step("console to browser", err)
+	step("shutdown", console.quit())
+}
+
+// nodeWithWebSocket returns the node flags that give it a WebSocket
+// global, if any do.
+func nodeWithWebSocket() ([]string, bool) {
+	for _, args := range [][]string{nil, {"--experimental-websocket"}} {
+		check := append(args, "-e", `process.exit(typeof WebSocket === "function" ? 0 : 1)`)
+		if exec.Command("node", check...).Run() == nil {
+			return args, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,353 @@
+// Package itest is an end-to-end check against real p2p-chat processes on
+// localhost. It builds the binary (or takes one with -bin), starts a
+// supernode and three clients, each with its own data directory, drives
+// them through stdin and asserts on what they print: connect, direct
+// messages, rooms, offline store/fetch through the mailbox, and a restart
+// that must keep the identity.
+//
+//	go test ./itest
+//	go test ./itest -args -bin /usr/local/bin/p2p-chat -keep
+//
+// It takes a while, so -short skips it. A failing step prints the tail of
+// every node's output to help find out why.
+package itest
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	bin     = flag.String("bin", "", "p2p-chat binary to test; built from the source tree if empty")
+	timeout = flag.Duration("timeout", 20*time.Second, "how long to wait for each expected line")
+	keep    = flag.Bool("keep", false, "keep the data directories afterwards")
+)
+
+// proc is one running p2p-chat with its output collected line by line.
+type proc struct {
+	name  string
+	dir   string
+	args  []string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	mu    sync.Mutex
+	lines []string
+	seen  int // lines already consumed by expect
+	done  chan struct{}
+
+	id   string
+	addr string
+}
+
+func start(name, dir string, args ...string) (*proc, error) {
+	p := &proc{name: name, dir: dir, args: args}
+	return p, p.start()
+}
+
+func (p *proc) start() error {
+	return p.run(exec.Command(*bin, append(p.args, "--data-dir", p.dir)...))
+}
+
+// run starts cmd and collects its output.
+func (p *proc) run(cmd *exec.Cmd) error {
+	p.cmd = cmd
+	var err error
+	if p.stdin, err = p.cmd.StdinPipe(); err != nil {
+		return err
+	}
+	out, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	p.cmd.Stderr = p.cmd.Stdout
+	if err := p.cmd.Start(); err != nil {
+		return err
+	}
+	p.done = make(chan struct{})
+	go func() {
+		sc := bufio.NewScanner(out)
+		for sc.Scan() {
+			p.mu.Lock()
+			p.lines = append(p.lines, sc.Text())
+			p.mu.Unlock()
+		}
+		p.cmd.Wait()
+		close(p.done)
+	}()
+	return nil
+}
+
+// expect waits for a line matching pattern after the last one consumed
+// and returns its submatches.
+func (p *proc) expect(pattern string) ([]string, error) {
+	re := regexp.MustCompile(pattern)
+	deadline := time.Now().Add(*timeout)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		for i := p.seen; i < len(p.lines); i++ {
+			if m := re.FindStringSubmatch(p.lines[i]); m != nil {
+				p.seen = i + 1
+				p.mu.Unlock()
+				return m, nil
+			}
+		}
+		p.mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("%s: no line matching %q within %s", p.name, pattern, *timeout)
+}
+
+func (p *proc) send(line string) error {
+	_, err := fmt.Fprintln(p.stdin, line)
+	return err
+}
+
+// hello waits for the startup banner and records the peer ID and the
+// loopback TCP address.
+func (p *proc) hello() error {
+	m, err := p.expect(`Peer ID: (\S+)`)
+	if err != nil {
+		return err
+	}
+	p.id = m[1]
+	if m, err = p.expect(`(/ip4/127\.0\.0\.1/tcp/\d+)`); err != nil {
+		return err
+	}
+	p.addr = m[1] + "/p2p/" + p.id
+	return nil
+}
+
+// quit ends the process the way a user would and waits for it.
+func (p *proc) quit() error {
+	_ = p.send("quit")
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(10 * time.Second):
+		p.cmd.Process.Kill()
+		return fmt.Errorf("%s: did not exit after quit", p.name)
+	}
+}
+
+func (p *proc) tail(n int) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	from := len(p.lines) - n
+	if from < 0 {
+		from = 0
+	}
+	return strings.Join(p.lines[from:], "\n")
+}
+
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts real processes; skipped with -short")
+	}
+	root := setup(t)
+	var procs []*proc
+	defer func() {
+		for _, p := range procs {
+			p.cmd.Process.Kill()
+		}
+	}()
+	step := func(name string, fn func() error) {
+		if err := fn(); err != nil {
+			for _, p := range procs {
+				t.Logf("--- %s (last lines)\n%s", p.name, p.tail(15))
+			}
+			t.Fatalf("%s: %s", name, err)
+		}
+		t.Log("ok  ", name)
+	}
+
+	var super, a, b, c *proc
+	step("start supernode", func() error {
+		var err error
+		super, err = start("supernode", filepath.Join(root, "super"), "serve-relay", "--supernode", "--listen", "/ip4/127.0.0.1/tcp/0")
+		if err != nil {
+			return err
+		}
+		procs = append(procs, super)
+		m, err := super.expect(`--mailbox (/ip4/127\.0\.0\.1/tcp/\S+)`)
+		if err != nil {
+			return err
+		}
+		super.addr = m[1]
+		return nil
+	})
+	clients := make([]*proc, 3)
+	for i, name := range []string{"alice", "bob", "carol"} {
+		step("start "+name, func() error {
+			// TCP alone, like the supernode: the test is about peep-chat,
+			// not which transport a reconnect picks.
+			p, err := start(name, filepath.Join(root, name), "--mailbox", super.addr, "--listen", "/ip4/127.0.0.1/tcp/0")
+			if err != nil {
+				return err
+			}
+			procs = append(procs, p)
+			clients[i] = p
+			return p.hello()
+		})
+	}
+	a, b, c = clients[0], clients[1], clients[2]
+
+	step("connect", func() error {
+		for _, p := range []*proc{b, c} {
+			if err := p.send("connect " + a.addr); err != nil {
+				return err
+			}
+			if _, err := p.expect(`connected to ` + a.id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	step("direct message", func() error {
+		if err := b.send("send " + a.id + " hello from bob"); err != nil {
+			return err
+		}
+		_, err := a.expect(`<msg from=` + b.id + ` .*> hello from bob$`)
+		return err
+	})
+	step("room", func() error {
+		for _, p := range []*proc{a, b, c} {
+			if err := p.send("join itest"); err != nil {
+				return err
+			}
+			if _, err := p.expect(`joined #itest`); err != nil {
+				return err
+			}
+		}
+		// Give gossipsub a heartbeat to build the mesh.
+		time.Sleep(2 * time.Second)
+		if err := b.send("say itest hello room"); err != nil {
+			return err
+		}
+		for _, p := range []*proc{a, c} {
+			if _, err := p.expect(`<#itest from=` + b.id + ` .*> hello room$`); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	step("goodbye on quit", func() error {
+		if err := c.quit(); err != nil {
+			return err
+		}
+		_, err := a.expect(`\* ` + regexp.QuoteMeta(shortID(c.id)) + ` went offline`)
+		return err
+	})
+	step("store while offline", func() error {
+		if err := b.send("send " + c.id + " while you were away"); err != nil {
+			return err
+		}
+		_, err := b.expect(`stored for offline delivery`)
+		return err
+	})
+	step("restart keeps identity", func() error {
+		oldID := c.id
+		c.lines, c.seen = nil, 0
+		if err := c.start(); err != nil {
+			return err
+		}
+		if err := c.hello(); err != nil {
+			return err
+		}
+		if c.id != oldID {
+			return fmt.Errorf("peer ID changed from %s to %s", oldID, c.id)
+		}
+		return nil
+	})
+	step("fetch after restart", func() error {
+		if err := c.send("fetch " + c.id); err != nil {
+			return err
+		}
+		if _, err := c.expect(`^\d+\) from=` + b.id); err != nil {
+			return err
+		}
+		_, err := c.expect(`^\s+while you were away$`)
+		return err
+	})
+	step("reconnect after restart", func() error {
+		if err := c.send("connect " + a.addr); err != nil {
+			return err
+		}
+		if _, err := c.expect(`connected to ` + a.id); err != nil {
+			return err
+		}
+		if err := c.send("send " + a.id + " back again"); err != nil {
+			return err
+		}
+		_, err := a.expect(`<msg from=` + c.id + ` .*> back again$`)
+		return err
+	})
+	step("shutdown", func() error {
+		for _, p := range []*proc{a, b, c} {
+			if err := p.quit(); err != nil {
+				return err
+			}
+		}
+		super.cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-super.done:
+			return nil
+		case <-time.After(10 * time.Second):
+			return fmt.Errorf("supernode did not exit on SIGINT")
+		}
+	})
+}
+
+// setup makes the directory the test's data directories go in, and builds
+// p2p-chat once per run unless -bin names one.
+func setup(t *testing.T) string {
+	root, err := os.MkdirTemp("", "peep-itest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *keep {
+		t.Logf("data directories kept in %s", root)
+	} else {
+		t.Cleanup(func() { os.RemoveAll(root) })
+	}
+	if *bin == "" {
+		if buildDir, err = os.MkdirTemp("", "peep-itest-bin"); err != nil {
+			t.Fatal(err)
+		}
+		*bin = filepath.Join(buildDir, "p2p-chat")
+		if out, err := exec.Command("go", "build", "-o", *bin, "..").CombinedOutput(); err != nil {
+			t.Fatalf("building p2p-chat: %s\n%s", err, out)
+		}
+	}
+	return root
+}
+
+// buildDir holds the binary setup built, for every test in the run.
+var buildDir string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	code := m.Run()
+	if buildDir != "" {
+		os.RemoveAll(buildDir)
+	}
+	os.Exit(code)
+}
+
+// shortID matches the console client's abbreviation.
+func shortID(id string) string {
+	if len(id) <= 12 {
+		return id
+	}
+	return id[:6] + "…" + id[len(id)-6:]
+}
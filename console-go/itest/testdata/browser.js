@@ -0,0 +1,30 @@
+"use strict";
+// Runs the wasm build of a peep node the way a page would, under Node.js
+// with a WebSocket global standing in for the browser's:
+//
+//	GOROOT=$(go env GOROOT) node browser.js peep.wasm <console peer's /ws multiaddr>
+//
+// It starts the node, connects, sends "hello from the browser" and prints
+// every message it receives.
+globalThis.require = require;
+globalThis.fs = require("fs");
+require(process.env.GOROOT + "/lib/wasm/wasm_exec.js");
+
+const [wasm, addr] = process.argv.slice(2);
+const go = new Go();
+WebAssembly.instantiate(fs.readFileSync(wasm), go.importObject).then((r) => {
+	go.run(r.instance);
+	return main();
+}).catch((err) => {
+	console.log("failed:", err.message);
+	process.exit(1);
+});
+
+async function main() {
+	const { peerId } = await peep.start("", (from, body) => console.log("received from " + from + ": " + body));
+	console.log("wasm peer " + peerId);
+	const id = await peep.connect(addr);
+	console.log("connected to " + id);
+	await peep.send(id, "hello from the browser");
+	console.log("sent");
+}
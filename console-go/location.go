@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-chat/node"
+)
+
+// Live location sharing is bounded: it lasts at most maxLiveLocation, and
+// updates go out no more often than minLiveEvery.
+const (
+	maxLiveLocation = 8 * time.Hour
+	minLiveEvery    = 10 * time.Second
+)
+
+// locationShare is a location about to be shared, or being shared live.
+type locationShare struct {
+	to     string // peer ID or #room
+	loc    node.Location
+	every  time.Duration
+	source string // command printing "lat,lon", for live shares
+	cancel context.CancelFunc
+}
+
+func (s *locationShare) describe(a *app) string {
+	what := locationText(s.loc)
+	if s.loc.Live != "" {
+		what += fmt.Sprintf(", live until %s", time.UnixMilli(s.loc.Until).Format("15:04"))
+	}
+	return what + " with " + a.conversationLabel(s.to)
+}
+
+// locationSharing holds the share awaiting 'loc confirm' and the live
+// shares running.
+type locationSharing struct {
+	mu      sync.Mutex
+	pending *locationShare
+	live    map[string]*locationShare // by Live ID
+}
+
+func newLocationSharing() *locationSharing {
+	return &locationSharing{live: make(map[string]*locationShare)}
+}
+
+// parseLocation reads "<lat>,<lon> [label]" or a bare label.
+func parseLocation(text string) (node.Location, error) {
+	first, rest, _ := strings.Cut(strings.TrimSpace(text), " ")
+	if p, err := parsePoint(first); err == nil {
+		return node.Location{Point: p, Label: strings.TrimSpace(rest)}, nil
+	}
+	if text = strings.TrimSpace(text); text == "" {
+		return node.Location{}, errors.New("expected <lat,lon> [label] or a label")
+	}
+	return node.Location{Label: text}, nil
+}
+
+func parsePoint(s string) ([]float64, error) {
+	lat, lon, ok := strings.Cut(strings.TrimSpace(s), ",")
+	la, err1 := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	lo, err2 := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	if !ok || err1 != nil || err2 != nil || la < -90 || la > 90 || lo < -180 || lo > 180 {
+		return nil, fmt.Errorf("not a lat,lon point: %q", s)
+	}
+	return []float64{la, lo}, nil
+}
+
+// locationText is how a location reads in text, e.g. in a message body.
+func locationText(l node.Location) string {
+	var parts []string
+	if l.Label != "" {
+		parts = append(parts, l.Label)
+	}
+	if len(l.Point) == 2 {
+		parts = append(parts, fmt.Sprintf("%.5f,%.5f", l.Point[0], l.Point[1]))
+	}
+	return "📍 " + strings.Join(parts, " ")
+}
+
+// locationLines describes a received location under its message.
+func locationLines(m Message) string {
+	l := m.Location
+	if l == nil {
+		return ""
+	}
+	s := "\n  [location] " + l.MapURL()
+	if l.Live != "" {
+		s += fmt.Sprintf(" (live until %s)", time.UnixMilli(l.Until).Format("15:04"))
+	}
+	return s
+}
+
+// sendLocation sends l to a peer or posts it to a #room.
+func (a *app) sendLocation(ctx context.Context, to string, l node.Location) error {
+	var (
+		m      Message
+		err    error
+		target string // empty for a room
+	)
+	body := locationText(l)
+	if room, ok := strings.CutPrefix(to, "#"); ok {
+		m, err = a.rooms.post(ctx, room, Message{Body: body, Location: &l})
+	} else {
+		target = to
+		if err = a.e2eReady(target); err == nil {
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			m, err = a.node.SendLocation(ctx, target, body, l)
+			cancel()
+		}
+	}
+	if err == nil {
+		a.messageSent(target, m)
+	}
+	return err
+}
+
+// readPosition runs a live share's source command for the current point.
+func readPosition(ctx context.Context, command string) ([]float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return parsePoint(strings.TrimSpace(string(out)))
+}
+
+// shareLive sends updates of a live share from its source until it ends
+// or is stopped.
+func (a *app) shareLive(ctx context.Context, s *locationShare) {
+	defer func() {
+		a.locations.mu.Lock()
+		delete(a.locations.live, s.loc.Live)
+		a.locations.mu.Unlock()
+	}()
+	end := time.UnixMilli(s.loc.Until)
+	t := time.NewTicker(s.every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if now.After(end) {
+				return
+			}
+		}
+		p, err := readPosition(ctx, s.source)
+		if err != nil {
+			logger.Warnf("live location source: %s", err)
+			continue
+		}
+		l := s.loc
+		l.Point = p
+		if err := a.sendLocation(ctx, s.to, l); err != nil {
+			logger.Warnf("live location update to %s: %s", a.conversationLabel(s.to), err)
+		}
+	}
+}
+
+// startLocationShare sends a confirmed share within ctx and, if it's live,
+// keeps it updated.
+func (a *app) startLocationShare(ctx context.Context, s *locationShare) error {
+	if err := a.sendLocation(ctx, s.to, s.loc); err != nil {
+		return err
+	}
+	if s.loc.Live == "" {
+		return nil
+	}
+	ctx, cancel := context.WithDeadline(a.ctx, time.UnixMilli(s.loc.Until))
+	s.cancel = cancel
+	a.locations.mu.Lock()
+	a.locations.live[s.loc.Live] = s
+	a.locations.mu.Unlock()
+	go func() {
+		defer cancel()
+		a.shareLive(ctx, s)
+	}()
+	return nil
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "loc",
+		Usage:   "[-live 15m -source <command> [-every 30s]] [-yes] <peer|#room> <lat,lon [label]|label> | confirm | cancel | stop [<peer|#room>]",
+		Summary: "share a location with a map link, after confirming; -live keeps it updated from -source for a while; alone, list live shares",
+		Flags: func(fs *flag.FlagSet) {
+			fs.Duration("live", 0, "keep sharing for this long, updated from -source")
+			fs.String("source", "", "command printing the current position as lat,lon, for -live")
+			fs.Duration("every", 30*time.Second, "how often to send live updates")
+			fs.Bool("yes", false, "share without asking for 'loc confirm'")
+		},
+		Run: func(a *app, inv *invocation) error {
+			ls := a.locations
+			if len(inv.Args) == 0 {
+				ls.mu.Lock()
+				shares := make([]string, 0, len(ls.live))
+				for _, s := range ls.live {
+					shares = append(shares, s.describe(a))
+				}
+				ls.mu.Unlock()
+				sort.Strings(shares)
+				if jsonOutput {
+					printJSON(map[string]any{"live": shares})
+					return nil
+				}
+				if len(shares) == 0 {
+					fmt.Println("not sharing a live location")
+				}
+				for _, s := range shares {
+					fmt.Println(" -", s)
+				}
+				return nil
+			}
+			switch inv.Args[0] {
+			case "confirm", "cancel":
+				ls.mu.Lock()
+				s := ls.pending
+				ls.pending = nil
+				ls.mu.Unlock()
+				if s == nil {
+					return errors.New("no location is waiting to be shared")
+				}
+				if inv.Args[0] == "cancel" {
+					fmt.Println("not shared")
+					return nil
+				}
+				if err := a.startLocationShare(inv.Context(), s); err != nil {
+					return err
+				}
+				fmt.Println("shared", s.describe(a))
+				return nil
+			case "stop":
+				to := ""
+				if len(inv.Args) > 1 {
+					if to = inv.Args[1]; !strings.HasPrefix(to, "#") {
+						to = a.contacts.peerID(to)
+					}
+				}
+				ls.mu.Lock()
+				stopped := 0
+				for _, s := range ls.live {
+					if to == "" || s.to == to {
+						s.cancel()
+						stopped++
+					}
+				}
+				ls.mu.Unlock()
+				text := fmt.Sprintf("stopped %d live shares", stopped)
+				if stopped == 1 {
+					text = "stopped 1 live share"
+				}
+				printResult(map[string]int{"stopped": stopped}, text)
+				return nil
+			}
+			if len(inv.Args) < 2 {
+				return errors.New("usage: loc <peer|#room> <lat,lon [label]|label>")
+			}
+			to := inv.Args[0]
+			if !strings.HasPrefix(to, "#") {
+				to = a.contacts.peerID(to)
+			}
+			loc, err := parseLocation(inv.Tail(1))
+			if err != nil {
+				return err
+			}
+			s := &locationShare{to: to, loc: loc, every: max(inv.Duration("every"), minLiveEvery), source: inv.String("source")}
+			if live := inv.Duration("live"); live > 0 {
+				if s.source == "" {
+					return errors.New("-live needs a -source command printing the position as lat,lon")
+				}
+				if live > maxLiveLocation {
+					return fmt.Errorf("live sharing lasts at most %s", maxLiveLocation)
+				}
+				var id [8]byte
+				if _, err := rand.Read(id[:]); err != nil {
+					return err
+				}
+				s.loc.Live, s.loc.Until = hex.EncodeToString(id[:]), time.Now().Add(live).UnixMilli()
+			}
+			if inv.Bool("yes") {
+				if err := a.startLocationShare(inv.Context(), s); err != nil {
+					return err
+				}
+				fmt.Println("shared", s.describe(a))
+				return nil
+			}
+			ls.mu.Lock()
+			ls.pending = s
+			ls.mu.Unlock()
+			fmt.Printf("share %s? 'loc confirm' to share, 'loc cancel' not to\n", s.describe(a))
+			return nil
+		},
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	logging "github.com/ipfs/go-log"
+	logging2 "github.com/ipfs/go-log/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logToFile sends all go-log output (ours and libp2p's) to path as JSON
+// lines instead of stderr, rotating the file at maxSizeMB and keeping
+// maxBackups old files, so diagnostics stay out of the chat console.
+// level ("debug", "info", "warn", "error") applies to every subsystem;
+// individual ones can still be changed afterwards.
+func logToFile(path string, maxSizeMB, maxBackups int, level string) error {
+	lvl, err := logging.LevelFromString(level)
+	if err != nil {
+		return err
+	}
+	w := &lumberjack.Logger{Filename: path, MaxSize: maxSizeMB, MaxBackups: maxBackups}
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	// The core passes everything; per-subsystem levels do the filtering.
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encCfg), zapcore.AddSync(w), zapcore.DebugLevel)
+	logging2.SetPrimaryCore(core)
+	logging.SetAllLoggers(lvl)
+	return nil
+}
+
+// setLogLevel sets level on subsystem and every subsystem under it, so
+// "dht" also covers "dht/RtRefreshManager" and "swarm" matches "swarm2".
+// It returns the subsystems that changed.
+func setLogLevel(subsystem, level string) ([]string, error) {
+	if _, err := logging.LevelFromString(level); err != nil {
+		return nil, err
+	}
+	re := regexp.MustCompile("^" + regexp.QuoteMeta(subsystem))
+	if subsystem == "*" {
+		re = regexp.MustCompile("")
+	}
+	var matched []string
+	for _, s := range logging.GetSubsystems() {
+		if re.MatchString(s) {
+			matched = append(matched, s)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no subsystem matches %q (try 'loglevel' for the list)", subsystem)
+	}
+	for _, s := range matched {
+		if err := logging.SetLogLevel(s, level); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(matched)
+	return matched, nil
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "loglevel",
+		Usage:   "[<subsystem> <level>]",
+		Summary: "list log subsystems, or set one's level (debug, info, warn, error; subsystem * for all)",
+		Run: func(a *app, inv *invocation) error {
+			switch len(inv.Args) {
+			case 0:
+				subs := logging.GetSubsystems()
+				sort.Strings(subs)
+				fmt.Println(strings.Join(subs, " "))
+				return nil
+			case 2:
+				changed, err := setLogLevel(inv.Args[0], inv.Args[1])
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s: %s\n", inv.Args[1], strings.Join(changed, " "))
+				return nil
+			}
+			fmt.Println("usage: loglevel [<subsystem> <level>]")
+			return nil
+		},
+	})
+}
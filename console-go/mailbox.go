@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	peerstore "github.com/libp2p/go-libp2p/core/peerstore"
+
+	"p2p-chat/node"
+)
+
+// Mailbox discovery: how many servers to pick by default, how long after
+// startup to look (so the routing table has filled), and how often to try
+// again while none are found.
+const (
+	defaultMailboxCount = 2
+	mailboxDiscoverWait = 30 * time.Second
+	mailboxDiscoverPoll = 10 * time.Minute
+)
+
+// Our DHT inbox pointer is republished this often, well within
+// node.InboxPointerTTL, and retried sooner after a failure.
+const (
+	inboxRepublish = 12 * time.Hour
+	inboxRetry     = 5 * time.Minute
+)
+
+// connectMailbox parses the --mailbox address and dials the supernode. An
+// unreachable mailbox is only logged; store and fetch report it when used.
+func connectMailbox(ctx context.Context, h host.Host, addr string) (peer.ID, error) {
+	if addr == "" {
+		return "", nil
+	}
+	pi, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		return "", err
+	}
+	h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
+	if err := h.Connect(ctx, *pi); err != nil {
+		logger.Warnf("connect to mailbox %s: %s", pi.ID, err)
+	}
+	return pi.ID, nil
+}
+
+// mailboxSet is where our offline messages are held: our home node if
+// we've paired one, then, nearest first, the --mailbox supernode or the
+// servers discovery picked. Store deposits at the first of those and meet
+// registers there; fetch empties them all, the home node included.
+type mailboxSet struct {
+	mu       sync.Mutex
+	homeAddr string // /p2p multiaddr of our home node
+	homeID   peer.ID
+	addrs    []string // /p2p multiaddrs
+	ids      []peer.ID
+	changed  chan struct{}
+}
+
+// connectMailboxes dials each address as connectMailbox does.
+func connectMailboxes(ctx context.Context, h host.Host, addrs []string) (*mailboxSet, error) {
+	s := &mailboxSet{changed: make(chan struct{}, 1)}
+	for _, addr := range addrs {
+		id, err := connectMailbox(ctx, h, addr)
+		if err != nil {
+			return nil, err
+		}
+		s.addrs = append(s.addrs, addr)
+		s.ids = append(s.ids, id)
+	}
+	return s, nil
+}
+
+// primary returns the nearest mailbox, or "" if we have none.
+func (s *mailboxSet) primary() peer.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ids) == 0 {
+		return ""
+	}
+	return s.ids[0]
+}
+
+func (s *mailboxSet) list() []peer.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.homeID != "" {
+		return append([]peer.ID{s.homeID}, slices.DeleteFunc(slices.Clone(s.ids), func(id peer.ID) bool { return id == s.homeID })...)
+	}
+	return slices.Clone(s.ids)
+}
+
+func (s *mailboxSet) set(found []node.FoundMailbox) {
+	s.mu.Lock()
+	s.addrs, s.ids = nil, nil
+	for _, m := range found {
+		s.addrs = append(s.addrs, mailboxAddr(m.AddrInfo))
+		s.ids = append(s.ids, m.ID)
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// setHome makes the home node at addr, id, our first mailbox, or with
+// id "" stops using one.
+func (s *mailboxSet) setHome(addr string, id peer.ID) {
+	s.mu.Lock()
+	s.homeAddr, s.homeID = addr, id
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *mailboxSet) home() (string, peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.homeAddr, s.homeID
+}
+
+func (s *mailboxSet) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// profile is what we tell peers about our mailboxes.
+func (s *mailboxSet) profile() node.Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.homeAddr != "" {
+		return node.Profile{Mailboxes: append([]string{s.homeAddr}, slices.DeleteFunc(slices.Clone(s.addrs), func(a string) bool { return a == s.homeAddr })...)}
+	}
+	return node.Profile{Mailboxes: slices.Clone(s.addrs)}
+}
+
+// mailboxAddr is the first /p2p multiaddr of pi, or its bare ID.
+func mailboxAddr(pi peer.AddrInfo) string {
+	if addrs, err := peer.AddrInfoToP2pAddrs(&pi); err == nil && len(addrs) > 0 {
+		return addrs[0].String()
+	}
+	return pi.ID.String()
+}
+
+// discoverMailboxes picks the count nearest mailbox servers, makes them
+// ours, names them in our profile and DHT inbox pointer, and records them
+// in the client config so the next start uses them too.
+func (a *app) discoverMailboxes(ctx context.Context, count int) ([]node.FoundMailbox, error) {
+	found, err := a.node.DiscoverMailboxes(ctx, count)
+	if err != nil {
+		return nil, err
+	}
+	a.mailbox.set(found)
+	a.node.SetProfile(a.profile())
+	cfg, err := loadClientConfig(a.configPath)
+	if err == nil {
+		cfg.Mailboxes = nil
+		for _, m := range found {
+			cfg.Mailboxes = append(cfg.Mailboxes, mailboxAddr(m.AddrInfo))
+		}
+		err = cfg.save(a.configPath)
+	}
+	if err != nil {
+		logger.Warnf("recording mailboxes: %s", err)
+	}
+	return found, nil
+}
+
+// autoDiscoverMailboxes looks for mailbox servers in the background when
+// we have none, until it finds some.
+func (a *app) autoDiscoverMailboxes(count int) {
+	go func() {
+		wait := mailboxDiscoverWait
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			ctx, cancel := context.WithTimeout(a.ctx, time.Minute)
+			found, err := a.discoverMailboxes(ctx, count)
+			cancel()
+			if err == nil {
+				logger.Infof("using %d mailbox servers for offline messages, nearest %s", len(found), found[0].ID)
+				return
+			}
+			logger.Debugf("mailbox discovery: %s", err)
+			wait = mailboxDiscoverPoll
+		}
+	}()
+}
+
+// keepInboxPublished publishes our DHT inbox pointer, naming our
+// mailboxes, shortly after startup and whenever they change, and
+// republishes it before it expires.
+func (a *app) keepInboxPublished() {
+	go func() {
+		wait := mailboxDiscoverWait
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-time.After(wait):
+			case <-a.mailbox.changed:
+			}
+			wait = inboxRepublish
+			mailboxes := a.mailbox.profile().Mailboxes
+			if len(mailboxes) == 0 {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(a.ctx, 2*time.Minute)
+			p, err := a.node.PublishInbox(ctx, mailboxes)
+			cancel()
+			if err != nil {
+				logger.Debugf("publishing inbox pointer: %s", err)
+				wait = inboxRetry
+				continue
+			}
+			logger.Debugf("published inbox pointer #%d", p.Seq)
+		}
+	}()
+}
+
+// learnFeatures fetches the profile of p, which isn't a contact, for the
+// features it lists; its agent version didn't say.
+func (a *app) learnFeatures(p peer.ID) {
+	ctx, cancel := context.WithTimeout(a.ctx, 15*time.Second)
+	defer cancel()
+	if _, err := a.node.FetchProfile(ctx, p); err != nil {
+		logger.Debugf("profile of %s: %s", p, err)
+	}
+}
+
+// learnProfile fetches a contact's profile and records its mailboxes and
+// the proof of work it asks for.
+func (a *app) learnProfile(p peer.ID) {
+	ctx, cancel := context.WithTimeout(a.ctx, 15*time.Second)
+	defer cancel()
+	prof, err := a.node.FetchProfile(ctx, p)
+	if err != nil {
+		logger.Debugf("profile of %s: %s", p, err)
+		return
+	}
+	a.spam.learnedPoW(p.String(), prof.PoW)
+	if err := a.contacts.setMailboxes(p.String(), prof.Mailboxes); err != nil {
+		logger.Warnf("saving mailboxes of %s: %s", p, err)
+	}
+}
+
+// depositAtTheirMailbox leaves body at the first of to's own mailboxes, as
+// its profile named them, that takes it.
+func (a *app) depositAtTheirMailbox(ctx context.Context, to, body string) (peer.ID, error) {
+	addrs := a.contacts.mailboxesOf(to)
+	if len(addrs) == 0 {
+		return "", errors.New("no known mailboxes")
+	}
+	var errs []error
+	for _, s := range addrs {
+		pi, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		a.h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.TempAddrTTL)
+		if _, err := a.node.Deposit(ctx, pi.ID, to, body); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", shortID(pi.ID.String()), err))
+			continue
+		}
+		return pi.ID, nil
+	}
+	return "", errors.Join(errs...)
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "meet",
+		Usage:   "<name>",
+		Summary: "register at the --mailbox supernode under name and connect to everyone else there",
+		MinArgs: 1,
+		Run: func(a *app, inv *invocation) error {
+			mailbox := a.mailbox.primary()
+			if mailbox == "" {
+				fmt.Println("meet needs a supernode: start with --mailbox <addr>")
+				return nil
+			}
+			peers, err := a.node.Meet(inv.Context(), mailbox, inv.Args[0])
+			if err != nil {
+				return err
+			}
+			if len(peers) == 0 {
+				fmt.Println("registered; nobody else is here yet")
+				return nil
+			}
+			for _, pi := range peers {
+				if err := a.h.Connect(inv.Context(), pi); err != nil {
+					fmt.Printf(" - %s: %s\n", shortID(pi.ID.String()), err)
+					continue
+				}
+				fmt.Printf(" - %s connected\n", pi.ID)
+			}
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "mailbox",
+		Usage:   "[discover [n]]",
+		Summary: "list the mailbox servers holding your offline messages, or find the n nearest through the DHT and use them",
+		Run: func(a *app, inv *invocation) error {
+			switch {
+			case len(inv.Args) == 0:
+				ids := a.mailbox.list()
+				if jsonOutput {
+					printJSON(map[string]any{"mailboxes": a.mailbox.profile().Mailboxes})
+					return nil
+				}
+				if len(ids) == 0 {
+					fmt.Println("no mailbox; start with --mailbox <addr> or run 'mailbox discover'")
+				}
+				for i, id := range ids {
+					state := "not connected"
+					if len(a.h.Network().ConnsToPeer(id)) > 0 {
+						state = "connected"
+					}
+					fmt.Printf(" %d. %s (%s)\n", i+1, id, state)
+				}
+			case inv.Args[0] == "discover" && len(inv.Args) <= 2:
+				count := defaultMailboxCount
+				if len(inv.Args) == 2 {
+					n, err := strconv.Atoi(inv.Args[1])
+					if err != nil || n < 1 {
+						return fmt.Errorf("invalid count %q", inv.Args[1])
+					}
+					count = n
+				}
+				ctx, cancel := context.WithTimeout(inv.Context(), time.Minute)
+				defer cancel()
+				found, err := a.discoverMailboxes(ctx, count)
+				if err != nil {
+					return err
+				}
+				if jsonOutput {
+					printJSON(map[string]any{"mailboxes": found})
+					return nil
+				}
+				for i, m := range found {
+					fmt.Printf(" %d. %s (rtt %s)\n", i+1, m.ID, m.RTT.Round(time.Microsecond))
+				}
+				fmt.Println("using these for offline messages; contacts learn them when you next connect")
+			default:
+				fmt.Println("usage: mailbox [discover [n]]")
+			}
+			return nil
+		},
+	})
+}
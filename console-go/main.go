@@ -1,317 +1,1131 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"crypto/rand"
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	logging "github.com/ipfs/go-log"
 	libp2p "github.com/libp2p/go-libp2p"
 	kaddht "github.com/libp2p/go-libp2p-kad-dht"
-	crypto "github.com/libp2p/go-libp2p/core/crypto"
 	host "github.com/libp2p/go-libp2p/core/host"
 	network "github.com/libp2p/go-libp2p/core/network"
 	peer "github.com/libp2p/go-libp2p/core/peer"
-	peerstore "github.com/libp2p/go-libp2p/core/peerstore"
-	ma "github.com/multiformats/go-multiaddr"
+
+	"p2p-chat/bot"
+	"p2p-chat/node"
+	"p2p-chat/paths"
 )
 
+// File names; state files live in the data directory and configuration in
+// the config directory (see package paths).
 const (
-	protocolID      = "/p2pchat/1.0.0"
-	dhtMsgKeyPrefix = "/p2pchat/messages/"
-	identityFile    = "p2pchat_id.key"
+	identityFile    = paths.IdentityFile
+	readStateFile   = "p2pchat_read.json"
+	webhooksFile    = "p2pchat_webhooks.json"
+	ircConfigFile   = "p2pchat_irc.json"
+	nostrConfigFile = "p2pchat_nostr.json"
+	nostrKeyFile    = "p2pchat_nostr.key"
+	mqttConfigFile  = "p2pchat_mqtt.json"
+	emailConfigFile = "p2pchat_email.json"
+	pushStateFile   = "p2pchat_push.json"
+	fetchedFile     = "p2pchat_fetched.json"
+	chatLogFile     = node.ChatLogFile
 )
 
 var logger = logging.Logger("p2pchat")
 
-type Message struct {
-	From string `json:"from"`
-	When int64  `json:"when"`
-	Body string `json:"body"`
-}
+// Message is the chat wire message; see package node.
+type Message = node.Message
 
 func main() {
-	logging.SetLogLevel("p2pchat", "info")
+	if code, ok := runSubcommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+	os.Exit(run())
+}
+
+// Exit codes of the chat client, so batch runs can be scripted.
+const (
+	exitOK     = 0
+	exitFailed = 1 // startup failed or a batch command failed
+	exitUsage  = 2
+	exitStored = 3 // 'send' stored the message for later instead of delivering it
+)
+
+// clientOptions are the chat client's command-line flags.
+type clientOptions struct {
+	hookCmd       string
+	botNames      string
+	dataDir       string
+	pluginDir     string
+	scriptDir     string
+	webhookListen string
+	webhookToken  string
+	otlpEndpoint  string
+	pprofAddr     string
+	healthListen  string
+	logFile       string
+	logLevel      string
+	logMaxSize    int
+	logBackups    int
+	mailboxAddr   string
+	mailboxCount  int
+	storeTTL      time.Duration
+	execCmds      string
+	execFile      string
+	keepGoing     bool
+	relayAddrs    string
+	listenAddrs   string
+	bootstrap     string
+	security      string
+	refusePlain   bool
+	forwardVia    bool
+	routers       string
+	themeName     string
+	noColor       bool
+	highlight     string
+	translator    string
+	translateURL  string
+	translateKey  string
+	showVersion   bool
+	profile       string
+	pacing        node.Pacing
+	peerEvents    string
+	dialing       node.Dialing
+}
+
+// flags defines the options on fs. --json and --screen-reader set the
+// package-level output modes directly.
+func (o *clientOptions) flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.hookCmd, "hook", "", "shell command run on message/peer events (event JSON on stdin)")
+	fs.StringVar(&o.botNames, "bots", "", "comma-separated built-in bots to enable (echo, remind)")
+	fs.StringVar(&o.dataDir, "data-dir", "", "keep identity, state and configuration in this directory instead of the OS defaults")
+	fs.StringVar(&o.profile, "profile", "", "start as this account: a separate identity, state and configuration under profiles/<name> (see 'account')")
+	fs.StringVar(&o.pluginDir, "plugins", "", "directory of WebAssembly plugins to load (default <config dir>/plugins)")
+	fs.StringVar(&o.scriptDir, "scripts", "", "directory of Starlark automation scripts to load (default <config dir>/scripts)")
+	fs.StringVar(&o.webhookListen, "webhook-listen", "", "serve the incoming webhook (POST /send) on this address, e.g. 127.0.0.1:8787")
+	fs.StringVar(&o.webhookToken, "webhook-token", os.Getenv("PEEP_WEBHOOK_TOKEN"), "bearer token required by the incoming webhook")
+	fs.StringVar(&o.otlpEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "export OpenTelemetry traces over OTLP/HTTP to this URL, e.g. http://localhost:4318")
+	fs.StringVar(&o.pprofAddr, "pprof", "", "serve Go pprof handlers on this address, e.g. localhost:6060 (opt-in; don't expose publicly)")
+	fs.StringVar(&o.healthListen, "health-listen", "", "serve /healthz and /readyz on this address, e.g. 127.0.0.1:8080")
+	fs.StringVar(&o.logFile, "log-file", "", "write JSON logs to this file (rotated) instead of stderr")
+	fs.StringVar(&o.logLevel, "log-level", "info", "log level for all subsystems when --log-file is set (debug, info, warn, error)")
+	fs.IntVar(&o.logMaxSize, "log-max-size", 10, "rotate the log file after this many megabytes")
+	fs.IntVar(&o.logBackups, "log-backups", 3, "number of rotated log files to keep")
+	fs.StringVar(&o.mailboxAddr, "mailbox", "", "supernode multiaddr that holds offline messages for you and serves rendezvous (see serve-relay --supernode)")
+	fs.DurationVar(&o.storeTTL, "store-ttl", node.DefaultStoreTTL, "how long messages you store for offline peers live before mailboxes and carriers discard them")
+	fs.IntVar(&o.mailboxCount, "discover-mailboxes", defaultMailboxCount, "without --mailbox, find this many nearby mailbox servers through the DHT and use them (0 to turn off)")
+	fs.StringVar(&o.execCmds, "exec", "", "run these ';'-separated commands instead of the prompt, then exit")
+	fs.StringVar(&o.execFile, "exec-file", "", "run commands from this file ('-' for stdin) instead of the prompt, then exit")
+	fs.BoolVar(&o.keepGoing, "keep-going", false, "in batch mode, run the remaining commands after one fails (still exit 1)")
+	fs.StringVar(&o.relayAddrs, "relay", "", "comma-separated relay multiaddrs (see serve-relay) to use when behind NAT")
+	fs.StringVar(&o.listenAddrs, "listen", "", "comma-separated multiaddrs to listen on (default: as set by init, else all interfaces on random ports)")
+	fs.StringVar(&o.bootstrap, "bootstrap", "", "comma-separated /p2p multiaddrs of peers to connect to at startup")
+	fs.StringVar(&o.security, "security", node.SecurityBoth, "security transports to offer: noise, tls or both (noise also drops QUIC, WebTransport and WebRTC, which bring their own TLS)")
+	fs.BoolVar(&o.refusePlain, "refuse-plaintext", false, "close any connection that isn't encrypted")
+	fs.StringVar(&o.routers, "delegated-routing", "", "comma-separated Delegated Routing V1 HTTP endpoints (e.g. https://delegated-ipfs.dev) to find peers and providers; the DHT then runs in client mode")
+	fs.Float64Var(&o.pacing.PerPeer, "pace-peer", 2, "messages per second to one peer or room before sends wait their turn (0: unlimited)")
+	fs.Float64Var(&o.pacing.Global, "pace-global", 10, "messages per second overall before sends wait their turn (0: unlimited)")
+	fs.Float64Var(&o.pacing.DHT, "pace-dht", 1, "DHT writes per second before they wait their turn (0: unlimited)")
+	fs.IntVar(&o.pacing.Burst, "pace-burst", 10, "sends that may go at once before pacing starts")
+	fs.DurationVar(&o.dialing.Timeout, "dial-timeout", 15*time.Second, "time limit for dialing a peer, all its addresses together")
+	fs.DurationVar(&o.dialing.RelayDelay, "dial-relay-delay", time.Second, "how long relayed addresses wait behind a peer's direct ones")
+	fs.BoolVar(&o.dialing.Parallel, "dial-parallel", false, "dial all of a peer's addresses at once instead of best first")
+	fs.DurationVar(&commandTimeout, "command-timeout", commandTimeout, "time limit for each command (0: none); Ctrl-C stops the commands running without quitting")
+	fs.StringVar(&o.peerEvents, "peer-events", peerEventsKnown, "which peers' connections and disconnections to announce: known (contacts and open conversations), all or none")
+	fs.BoolVar(&o.forwardVia, "forward-via-contacts", false, "hand sealed copies of messages for offline peers to mutual contacts to forward, and carry such copies for your contacts")
+	fs.BoolVar(&readReceipts, "read-receipts", true, "tell peers when you've read their messages (they're always told when messages arrive)")
+	fs.StringVar(&o.themeName, "theme", "dark", "colour theme: dark, light or mono")
+	fs.BoolVar(&o.noColor, "no-color", false, "plain output without colours (also NO_COLOR, or when stdout isn't a terminal)")
+	fs.StringVar(&o.highlight, "highlight", "", "comma-separated words that highlight a message as mentioning you (your peer ID always does)")
+	fs.StringVar(&o.translator, "translator", "", "shell command that translates its stdin into $PEEP_TRANSLATE_TO, for 'translate on'")
+	fs.StringVar(&o.translateURL, "translate-url", "", "LibreTranslate-compatible server to translate with, for 'translate on'")
+	fs.StringVar(&o.translateKey, "translate-key", os.Getenv("PEEP_TRANSLATE_KEY"), "API key for --translate-url")
+	fs.BoolVar(&screenReader, "screen-reader", false, "accessible output: no colours or decoration, events announced as plain sentences")
+	fs.BoolVar(&jsonOutput, "json", false, "print command results and incoming messages as JSON lines instead of text")
+	fs.BoolVar(&o.showVersion, "version", false, "print version information and exit")
+}
+
+// run is the chat client. Deferred cleanup runs before main exits with
+// the returned code.
+func run() int {
+	var opts clientOptions
+	opts.flags(flag.CommandLine)
+	flag.Usage = clientUsage
+	flag.Parse()
 
-	ctx := context.Background()
+	if opts.showVersion {
+		printVersion()
+		return exitOK
+	}
 
-	priv, err := loadOrCreateIdentity(identityFile)
+	dirs, err := paths.Open(opts.dataDir)
 	if err != nil {
-		fmt.Println("failed to load/create identity:", err)
-		return
+		fmt.Println("failed to set up data directory:", err)
+		return exitFailed
+	}
+	if opts.profile != "" && !paths.ValidProfile(opts.profile) {
+		fmt.Printf("invalid --profile %q: use letters, digits, '-' and '_'\n", opts.profile)
+		return exitUsage
+	}
+
+	if opts.logFile != "" {
+		if err := logToFile(opts.logFile, opts.logMaxSize, opts.logBackups, opts.logLevel); err != nil {
+			fmt.Println("failed to set up logging:", err)
+			return exitFailed
+		}
+	}
+	logging.SetLogLevel("p2pchat", opts.logLevel)
+
+	// Ctrl-C stops the commands in progress; with none, it and SIGTERM
+	// cancel ctx and the CLI loop then shuts down cleanly. stop restores
+	// default handling, so a second Ctrl-C during shutdown exits at once.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	stop := func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+	defer stop()
+	go func() {
+		for sig := range sigs {
+			if sig == os.Interrupt && running.interrupt() {
+				continue
+			}
+			cancel()
+		}
+	}()
+
+	if opts.otlpEndpoint != "" {
+		shutdown, err := startTracing(ctx, opts.otlpEndpoint)
+		if err != nil {
+			fmt.Println("failed to start tracing:", err)
+			return exitFailed
+		}
+		defer shutdown(context.Background())
 	}
 
-	// Create a libp2p host
-	h, err := libp2p.New(
-		libp2p.Identity(priv),
-	)
+	// Commands come from one stream for the whole process; 'account switch'
+	// ends a session and starts the next on another profile. Lines are
+	// read on their own goroutine so a signal can interrupt the wait. With
+	// --exec, --exec-file or piped stdin the session is a batch: no
+	// prompt, and the exit code says whether every command succeeded.
+	lines, batch, err := commandInput(opts.execCmds, opts.execFile)
 	if err != nil {
-		fmt.Println("failed to create libp2p host:", err)
-		return
+		fmt.Println("failed to read commands:", err)
+		return exitUsage
+	}
+	status, account := exitOK, opts.profile
+	for {
+		code, next := runSession(ctx, stop, opts, dirs, account, lines, batch)
+		if code != exitOK {
+			status = code
+		}
+		if next == nil {
+			return status
+		}
+		account = next.profile
 	}
+}
 
-	defer h.Close()
+// newClientNode starts the node for the account in dirs with o and the
+// identity, features and agent version that account always shows, so the
+// chat client and one-shot commands look the same to peers that pin them.
+func newClientNode(ctx context.Context, dirs paths.Dirs, o node.Options, relayOpts []libp2p.Option) (*node.Node, error) {
+	o.IdentityPath = dirs.DataFile(identityFile)
+	o.Passphrase = identityPassphrase
+	o.Features = node.AllFeatures
+	o.FetchedPath = dirs.DataFile(fetchedFile)
+	o.Libp2p = append([]libp2p.Option{libp2p.UserAgent(node.AgentVersion(agentVersion(), node.AllFeatures))}, relayOpts...)
+	return node.New(ctx, o)
+}
 
-	fmt.Println("Started host:")
-	fmt.Println("  Peer ID:", h.ID().String())
-	addrs := h.Addrs()
-	for _, a := range addrs {
-		fmt.Println("  -", a)
+// runSession runs the client as one account, the profile named account
+// ("" for the default) under base, until the input ends, 'quit', or
+// 'account switch', which it returns. Everything it starts is stopped
+// when it returns.
+func runSession(ctx context.Context, stop context.CancelFunc, opts clientOptions, base paths.Dirs, account string, lines <-chan string, batch bool) (int, *accountSwitch) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dirs := base.Profile(account)
+	if err := dirs.Ensure(); err != nil {
+		fmt.Println("failed to set up the account's directories:", err)
+		return exitFailed, nil
+	}
+	cfg, err := loadClientConfig(dirs.ConfigFile(clientConfigFile))
+	if err != nil {
+		fmt.Println("failed to load config:", err)
+		return exitFailed, nil
+	}
+	cfg.fill(&opts)
+	if opts.pluginDir == "" {
+		opts.pluginDir = dirs.ConfigFile("plugins")
+	}
+	if opts.scriptDir == "" {
+		opts.scriptDir = dirs.ConfigFile("scripts")
 	}
 
-	// Setup DHT
-	dht, err := kaddht.New(ctx, h)
+	relayOpts, relays, err := relayOptions(splitList(opts.relayAddrs))
 	if err != nil {
-		fmt.Println("failed to create DHT:", err)
-		return
+		fmt.Println("invalid --relay:", err)
+		return exitFailed, nil
+	}
+	n, err := newClientNode(ctx, dirs, node.Options{
+		ListenAddrs:      splitList(opts.listenAddrs),
+		Security:         opts.security,
+		RefusePlaintext:  opts.refusePlain,
+		DelegatedRouting: splitList(opts.routers),
+		StoreTTL:         opts.storeTTL,
+		Pacing:           opts.pacing,
+		Dialing:          opts.dialing,
+	}, relayOpts)
+	if err != nil {
+		fmt.Println("failed to start node:", err)
+		return exitFailed, nil
+	}
+	defer n.Close()
+	h := n.Host()
+	if err := setupStyles(opts.themeName, opts.noColor || screenReader, h.ID().String(), splitList(opts.highlight)); err != nil {
+		fmt.Println("invalid --theme:", err)
+		return exitUsage, nil
+	}
+	peerEvents, err := newPeerEvents(opts.peerEvents)
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage, nil
+	}
+	connectRelays(ctx, h, relays)
+	connectBootstrap(ctx, h, splitList(opts.bootstrap))
+	mailboxAddrs := cfg.Mailboxes
+	if opts.mailboxAddr != "" {
+		mailboxAddrs = []string{opts.mailboxAddr}
+	}
+	mailboxes, err := connectMailboxes(ctx, h, mailboxAddrs)
+	if err != nil {
+		fmt.Println("invalid --mailbox:", err)
+		return exitFailed, nil
+	}
+	if cfg.Home != "" {
+		if err := connectHome(ctx, h, mailboxes, cfg.Home); err != nil {
+			fmt.Println("invalid home node in the config:", err)
+			return exitFailed, nil
+		}
 	}
-	// Bootstrap the DHT (no external bootstrap nodes used for strict invite-only P2P)
-	if err := dht.Bootstrap(ctx); err != nil {
-		fmt.Println("warning: dht bootstrap error:", err)
+
+	if jsonOutput {
+		ev := startedEvent{Event: "started", PeerID: h.ID().String()}
+		for _, addr := range h.Addrs() {
+			ev.Addrs = append(ev.Addrs, addr.String())
+		}
+		printJSON(ev)
+	} else {
+		fmt.Println("Started host:")
+		fmt.Println("  Peer ID:", h.ID().String())
+		for _, addr := range h.Addrs() {
+			fmt.Println("  -", addr)
+		}
 	}
 
+	unread, err := loadUnreadTracker(dirs.DataFile(readStateFile))
+	if err != nil {
+		fmt.Println("failed to load read state:", err)
+		return exitFailed, nil
+	}
+	webhooks, err := loadWebhooks(dirs.ConfigFile(webhooksFile))
+	if err != nil {
+		fmt.Println("failed to load webhooks:", err)
+		return exitFailed, nil
+	}
+	contacts, err := loadContacts(dirs.ConfigFile(contactsFile))
+	if err != nil {
+		fmt.Println("failed to load contacts:", err)
+		return exitFailed, nil
+	}
+	push, err := loadPushRelay(dirs.DataFile(pushStateFile), contacts)
+	if err != nil {
+		fmt.Println("failed to load push endpoints:", err)
+		return exitFailed, nil
+	}
+	aliases, err := loadAliases(dirs.ConfigFile(aliasesFile))
+	if err != nil {
+		fmt.Println("failed to load aliases:", err)
+		return exitFailed, nil
+	}
+	revoked, err := loadRevocations(dirs.DataFile(revocationsFile))
+	if err != nil {
+		fmt.Println("failed to load revocations:", err)
+		return exitFailed, nil
+	}
+	pins, err := loadPins(dirs.DataFile(pinsFile))
+	if err != nil {
+		fmt.Println("failed to load key pins:", err)
+		return exitFailed, nil
+	}
+	audit, err := openAuditLog(dirs.DataFile(auditFile))
+	if err != nil {
+		fmt.Println("failed to open audit log:", err)
+		return exitFailed, nil
+	}
+	defer audit.Close()
+	outbox, err := loadOutbox(dirs.DataFile(outboxFile))
+	if err != nil {
+		fmt.Println("failed to load outbox:", err)
+		return exitFailed, nil
+	}
+	forwards, err := loadForwardStore(dirs.DataFile(forwardFile))
+	if err != nil {
+		fmt.Println("failed to load forwarded messages:", err)
+		return exitFailed, nil
+	}
+	roomBook, err := loadRooms(dirs.DataFile(roomsFile))
+	if err != nil {
+		fmt.Println("failed to load rooms:", err)
+		return exitFailed, nil
+	}
+	channels, err := loadChannels(dirs.DataFile(channelsFile))
+	if err != nil {
+		fmt.Println("failed to load channels:", err)
+		return exitFailed, nil
+	}
+	directory, err := loadDirectory(dirs.DataFile(directoryFile))
+	if err != nil {
+		fmt.Println("failed to load directory listings:", err)
+		return exitFailed, nil
+	}
+	watch, err := loadWatchList(dirs.ConfigFile(watchFile))
+	if err != nil {
+		fmt.Println("failed to load watch list:", err)
+		return exitFailed, nil
+	}
+	triggers, err := loadTriggers(dirs.ConfigFile(triggersFile))
+	if err != nil {
+		fmt.Println("failed to load triggers:", err)
+		return exitFailed, nil
+	}
+	translations, err := loadTranslations(dirs.DataFile(translateFile))
+	if err != nil {
+		fmt.Println("failed to load translation settings:", err)
+		return exitFailed, nil
+	}
+	stickers, err := loadStickers(dirs.DataFile(stickersFile))
+	if err != nil {
+		fmt.Println("failed to load sticker packs:", err)
+		return exitFailed, nil
+	}
+	spam, err := loadSpamFilter(dirs.ConfigFile(spamRulesFile), dirs.DataFile(spamFile))
+	if err != nil {
+		fmt.Println("failed to load spam rules:", err)
+		return exitFailed, nil
+	}
+	blocks, err := node.OpenBlockstore(dirs.DataFile(blocksDir))
+	if err != nil {
+		fmt.Println("failed to open blockstore:", err)
+		return exitFailed, nil
+	}
+	history, err := loadBlockIndex(dirs.DataFile(historyFile))
+	if err != nil {
+		fmt.Println("failed to load history index:", err)
+		return exitFailed, nil
+	}
+	chatLog, chatEntries, err := node.OpenChatLog(dirs.DataFile(chatLogFile))
+	if err != nil {
+		fmt.Println("failed to load chat log:", err)
+		return exitFailed, nil
+	}
+	reputation, err := loadReputation(dirs.DataFile(reputationFile))
+	if err != nil {
+		fmt.Println("failed to load reputation:", err)
+		return exitFailed, nil
+	}
+	n.RestoreReputations(reputation.saved)
+	n.ServeBlocks(blocks)
+	a := &app{
+		ui:       make(chan func(), uiQueue),
+		ctx:      ctx,
+		node:     n,
+		h:        h,
+		dht:      n.DHT(),
+		notes:    newNotifier(),
+		hooks:    newHookRunner(opts.hookCmd),
+		dnd:      newDND(),
+		unread:   unread,
+		webhooks: webhooks,
+		push:     push,
+		seen:     newSeenTracker(),
+		mailbox:  mailboxes,
+		contacts: contacts,
+		convs:    newConversations(),
+		scroll:   newScrollback(),
+		aliases:  aliases,
+		revoked:  revoked,
+		pins:     pins,
+		audit:    audit,
+		outbox:   outbox,
+		forwards: forwards,
+		spam:     spam,
+		watch:    watch,
+		triggers: triggers,
+		blocks:   blocks,
+		history:  history,
+		stickers: stickers,
+
+		locations:    newLocationSharing(),
+		cards:        &pendingCards{},
+		polls:        newPolls(),
+		roomBook:     roomBook,
+		channels:     channels,
+		channelSubs:  &channelSubs{subs: make(map[string]*room)},
+		directory:    directory,
+		homeSync:     new(homeSync),
+		peerEvents:   peerEvents,
+		reputation:   reputation,
+		crashes:      &crashReporter{dir: dirs.DataFile(crashesDir)},
+		deliveries:   newDeliveries(),
+		receipts:     new(receipts),
+		roomKeys:     newRoomKeys(),
+		logFile:      opts.logFile,
+		translator:   newTranslator(opts.translator, opts.translateURL, opts.translateKey),
+		translations: translations,
+
+		forwardVia: opts.forwardVia,
+		configPath: dirs.ConfigFile(clientConfigFile),
+		base:       base,
+		account:    account,
+	}
+	a.scroll.mark = a.deliveries.mark
+	a.scroll.load(chatLog, chatEntries)
+	if a.bot, err = startBots(a, opts.botNames); err != nil {
+		fmt.Println("failed to start bots:", err)
+		return exitFailed, nil
+	}
+	defer a.bot.Close()
+	if a.rooms, err = newRoomManager(a); err != nil {
+		fmt.Println("failed to start pubsub:", err)
+		return exitFailed, nil
+	}
+	if a.plugins, err = loadPlugins(ctx, a, opts.pluginDir); err != nil {
+		fmt.Println("failed to load plugins:", err)
+		return exitFailed, nil
+	}
+	defer a.plugins.close(ctx)
+	if a.scripts, err = loadScripts(a, opts.scriptDir); err != nil {
+		fmt.Println("failed to load scripts:", err)
+		return exitFailed, nil
+	}
+	defer a.scripts.close()
+	if cfg, err := loadIRCConfig(dirs.ConfigFile(ircConfigFile)); err != nil {
+		fmt.Println("failed to load IRC bridge config:", err)
+		return exitFailed, nil
+	} else if cfg != nil {
+		if a.irc, err = startIRCBridge(a, *cfg); err != nil {
+			fmt.Println("failed to start IRC bridge:", err)
+			return exitFailed, nil
+		}
+		defer a.irc.close()
+	}
+	if cfg, err := loadNostrConfig(dirs.ConfigFile(nostrConfigFile)); err != nil {
+		fmt.Println("failed to load Nostr bridge config:", err)
+		return exitFailed, nil
+	} else if cfg != nil {
+		key, err := loadOrCreateNostrKey(dirs.DataFile(nostrKeyFile))
+		if err != nil {
+			fmt.Println("failed to load Nostr key:", err)
+			return exitFailed, nil
+		}
+		if a.nostr, err = startNostrBridge(a, *cfg, key); err != nil {
+			fmt.Println("failed to start Nostr bridge:", err)
+			return exitFailed, nil
+		}
+		defer a.nostr.close()
+	}
+	if cfg, err := loadMQTTConfig(dirs.ConfigFile(mqttConfigFile)); err != nil {
+		fmt.Println("failed to load MQTT bridge config:", err)
+		return exitFailed, nil
+	} else if cfg != nil {
+		if a.mqtt, err = startMQTTBridge(a, *cfg); err != nil {
+			fmt.Println("failed to start MQTT bridge:", err)
+			return exitFailed, nil
+		}
+		defer a.mqtt.close()
+	}
+	if cfg, err := loadEmailConfig(dirs.ConfigFile(emailConfigFile)); err != nil {
+		fmt.Println("failed to load email gateway config:", err)
+		return exitFailed, nil
+	} else if cfg != nil {
+		if a.email, err = startEmailGateway(a, *cfg); err != nil {
+			fmt.Println("failed to start email gateway:", err)
+			return exitFailed, nil
+		}
+		defer a.email.close()
+	}
+	if opts.pprofAddr != "" {
+		defer servePprof(opts.pprofAddr).Close()
+		logger.Infof("pprof listening on %s", opts.pprofAddr)
+	}
+	if opts.healthListen != "" {
+		defer serveHealth(a, opts.healthListen).Close()
+		logger.Infof("health endpoints listening on %s", opts.healthListen)
+	}
+	if opts.webhookListen != "" {
+		srv, err := serveIncomingWebhook(a, opts.webhookListen, opts.webhookToken)
+		if err != nil {
+			fmt.Println("failed to start incoming webhook:", err)
+			return exitFailed, nil
+		}
+		defer srv.Close()
+		logger.Infof("incoming webhook listening on %s", opts.webhookListen)
+	}
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			a.seen.touch(c.RemotePeer())
+			a.outbox.peerConnected(c.RemotePeer().String())
+			go a.handOverForwarded(c.RemotePeer())
+			a.homeConnected(c.RemotePeer())
+			a.peerConnected(c)
+		},
+		DisconnectedF: func(_ network.Network, c network.Conn) {
+			a.seen.touch(c.RemotePeer())
+			a.peerDisconnected(c.RemotePeer())
+		},
+	})
+
 	// Handle incoming streams
-	h.SetStreamHandler(protocolID, func(s network.Stream) {
-		defer s.Close()
-		peerAddr := s.Conn().RemotePeer().String()
-		r := bufio.NewReader(s)
-		for {
-			line, err := r.ReadString('\n')
-			if err != nil {
-				if err != io.EOF {
-					fmt.Println("stream read err:", err)
-				}
-				return
-			}
-			line = strings.TrimSpace(line)
-			var m Message
-			if err := json.Unmarshal([]byte(line), &m); err != nil {
-				fmt.Println("invalid message from", peerAddr, "raw:", line)
-				continue
-			}
-			fmt.Printf("\n<msg from=%s when=%s> %s\n> ", m.From, time.UnixMilli(m.When).Format(time.RFC3339), m.Body)
+	n.OnMessage(func(from peer.ID, m Message) {
+		a.seen.touch(from)
+		if a.contacts.requiresE2E(from.String()) && checkEncrypted(a.h, from) != nil {
+			a.refuseE2E(from.String(), "a message on an unencrypted connection")
+			return
+		}
+		a.post(func() { a.messageReceived(from.String(), m, true) })
+	})
+	n.OnForwarded(func(via peer.ID, s node.Sealed, m Message) {
+		a.post(func() { a.forwardedReceived(via, s, m) })
+	})
+	if a.forwardVia {
+		n.OnForwardRequest(a.forwardRequested)
+	}
+	n.OnGoodbye(func(from peer.ID) {
+		a.seen.touch(from)
+		a.peerEvents.departing(from)
+		a.post(func() { a.wentOffline(from, "") })
+	})
+	n.OnOffline(func(id peer.ID) {
+		a.hooks.fire(hookEvent{Type: eventPeerOffline, Peer: id.String()})
+		a.peerEvents.departing(id)
+		a.post(func() { a.wentOffline(id, "stopped responding") })
+	})
+	node.OnPanic(func(where string, v any, stack []byte) {
+		err := a.crashed(where, v, stack)
+		a.post(func() { printError("", err.Error()) })
+	})
+	a.startUI()
+	a.startPresence()
+	a.showHeld(node.HeldPath(dirs.DataFile(identityFile)))
+	a.watchIdentify()
+	a.runOutbox()
+	a.serveHistory()
+	a.rejoinRooms()
+	a.keepHistorySynced()
+	a.startChannels()
+	a.startDirectory()
+	a.keepHomeSynced()
+	n.SetProfile(a.profile())
+	n.SetPoW(a.powFor)
+	a.keepInboxPublished()
+	if a.mailbox.primary() == "" && opts.mailboxCount > 0 {
+		a.autoDiscoverMailboxes(opts.mailboxCount)
+	}
+	n.OnRevocation(func(from peer.ID, r node.Revocation) {
+		a.revocationReceived(r)
+	})
+	n.OnReputation(a.reputationChanged)
+	n.OnRejected(func(from peer.ID, what string, err error) {
+		event := auditInvalidMessage
+		if what == "revocation" {
+			event = auditBadSignature
 		}
+		a.audit.record(event, from.String(), what+": "+err.Error())
 	})
+	h.SetStreamHandler(pushRegisterProtocol, node.Guard(a.push.handleRegister))
 
-	// CLI loop
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("Type 'help' for commands.")
+	// CLI loop; the end of input ends the session like 'quit'.
+	status := exitOK
+	prompt := !batch && !jsonOutput
+	if prompt {
+		fmt.Println("Type 'help' for commands.")
+	}
 	for {
-		fmt.Printf("> ")
-		text, _ := reader.ReadString('\n')
-		text = strings.TrimSpace(text)
-		if text == "" {
-			continue
-		}
-		parts := strings.SplitN(text, " ", 3)
-		switch parts[0] {
-		case "help":
-			printHelp()
-		case "peers":
-			listPeers(h)
-		case "invite":
-			printInvite(h)
-		case "connect":
-			if len(parts) < 2 {
-				fmt.Println("usage: connect <multiaddr>")
-				continue
-			}
-			if err := connectPeer(ctx, h, parts[1]); err != nil {
-				fmt.Println("connect error:", err)
-			}
-		case "msg":
-			if len(parts) < 3 {
-				fmt.Println("usage: msg <peerID> <message>")
-				continue
-			}
-			target := parts[1]
-			body := parts[2]
-			if err := sendMessage(ctx, h, target, body); err != nil {
-				fmt.Println("send error:", err)
+		if !a.dnd.active() {
+			if s := a.dnd.summary(); s != "" {
+				fmt.Println(s)
 			}
-		case "store":
-			if len(parts) < 3 {
-				fmt.Println("usage: store <peerID> <text>")
-				continue
-			}
-			target := parts[1]
-			body := parts[2]
-			if err := storeOfflineMessage(ctx, dht, target, h.ID().String(), body); err != nil {
-				fmt.Println("store error:", err)
+		}
+		if prompt {
+			fmt.Print(a.prompt())
+		}
+		var text string
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			a.shutdown(stop)
+			if batch {
+				return exitFailed, nil
 			}
-		case "fetch":
-			if len(parts) < 2 {
-				fmt.Println("usage: fetch <peerID>")
-				continue
+			return status, nil
+		case line, ok := <-lines:
+			if !ok {
+				a.shutdown(stop)
+				return status, nil
 			}
-			if err := fetchOfflineMessages(ctx, dht, parts[1]); err != nil {
-				fmt.Println("fetch error:", err)
+			text = strings.TrimSpace(line)
+		}
+		if text == "" || batch && strings.HasPrefix(text, "#") {
+			continue
+		}
+		a.notes.touch()
+		var err error
+		if batch {
+			err = commands.dispatch(a, a.conversationLine(text))
+		} else {
+			err = a.dispatchInteractive(a.conversationLine(text))
+		}
+		if err == errQuit {
+			a.shutdown(stop)
+			return status, nil
+		}
+		if sw, ok := err.(*accountSwitch); ok {
+			a.leave(sw.profile)
+			return status, sw
+		}
+		if err != nil && batch {
+			status = exitFailed
+			if !opts.keepGoing {
+				a.shutdown(stop)
+				return status, nil
 			}
-		case "id":
-			fmt.Println(h.ID().String())
-		case "quit", "exit":
-			fmt.Println("bye")
-			return
-		default:
-			fmt.Println("unknown command. type 'help'")
 		}
 	}
 }
 
-func printHelp() {
-	fmt.Println("commands:")
-	fmt.Println("  peers                  - list connected peers")
-	fmt.Println("  invite                 - print invite multiaddr")
-	fmt.Println("  connect <multiaddr>    - connect to a peer using their invite string")
-	fmt.Println("  msg <peerID> <message> - send immediate message to peer (if online)")
-	fmt.Println("  store <peerID> <text>  - append message to recipient's DHT inbox (offline delivery)")
-	fmt.Println("  fetch <peerID>         - fetch stored messages for peerID from DHT")
-	fmt.Println("  id                     - print your peer id")
-	fmt.Println("  help                   - help")
-	fmt.Println("  quit                   - exit")
+// shutdownTimeout bounds the goodbyes sent on exit.
+const shutdownTimeout = 3 * time.Second
+
+// shutdown runs before the session's deferred closers: it restores
+// default signal handling, so a second Ctrl-C exits at once, and says
+// goodbye to connected peers. The deferred Close calls then stop bridges,
+// plugins and the host, which closes streams cleanly.
+func (a *app) shutdown(stopSignals context.CancelFunc) {
+	// Pubsub stops with the context signals cancel.
+	a.saveRoomMembers()
+	stopSignals()
+	if !jsonOutput {
+		fmt.Println("shutting down...")
+	}
+	a.sayGoodbye()
 }
 
-func loadOrCreateIdentity(path string) (crypto.PrivKey, error) {
-	// If key exists, load it. Otherwise create and save.
-	if _, err := os.Stat(path); err == nil {
-		b, err := os.ReadFile(path)
-		if err != nil {
-			return nil, err
+// leave ends the session for 'account switch': like shutdown, but signals
+// keep ending the process cleanly, since another session follows.
+func (a *app) leave(profile string) {
+	a.saveRoomMembers()
+	if !jsonOutput {
+		fmt.Printf("switching to account %s...\n", accountName(profile))
+	}
+	a.sayGoodbye()
+}
+
+func (a *app) sayGoodbye() {
+	a.reputation.flush(a.node)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	a.node.SayGoodbye(ctx)
+}
+
+// app bundles the running node and the per-session state that commands and
+// stream handlers share.
+type app struct {
+	ctx      context.Context
+	node     *node.Node
+	h        host.Host
+	dht      *kaddht.IpfsDHT
+	notes    *notifier
+	hooks    *hookRunner
+	dnd      *dndMode
+	unread   *unreadTracker
+	bot      *bot.Bot
+	plugins  *pluginHost
+	scripts  *scriptHost
+	webhooks *webhookSender
+	rooms    *roomManager
+	irc      *ircBridge
+	nostr    *nostrBridge
+	mqtt     *mqttBridge
+	email    *emailGateway
+	push     *pushRelay
+	seen     *seenTracker
+	mailbox  *mailboxSet // where our offline messages are held
+	contacts *contactBook
+	convs    *conversations
+	scroll   *scrollback
+	aliases  *aliasTable
+	revoked  *revocationList
+	pins     *pinStore
+	audit    *auditLog
+	outbox   *outbox
+	forwards *forwardStore
+	spam     *spamFilter
+	watch    *watchList
+	triggers *triggerSet
+	blocks   *node.Blockstore
+	history  *blockIndex // room history and file senders in blocks
+	stickers *stickerIndex
+
+	translator   Translator // nil without --translator or --translate-url
+	translations *translations
+	locations    *locationSharing
+	cards        *pendingCards
+	polls        *polls
+	roomBook     *roomBook
+	channels     *channelBook
+	channelSubs  *channelSubs
+	directory    *directoryBook
+	homeSync     *homeSync
+	peerEvents   *peerEvents
+	reputation   *reputationBook
+	crashes      *crashReporter
+	deliveries   *deliveries
+	receipts     *receipts
+	roomKeys     *roomKeys
+	logFile      string // --log-file, bundled by 'report'
+
+	ui   chan func() // network events for the event loop (startUI)
+	work lanes       // background commands typed at the prompt
+
+	forwardVia bool       // --forward-via-contacts
+	configPath string     // clientConfigFile
+	base       paths.Dirs // of the default account; others are profiles under it
+	account    string     // the profile running, "" for the default
+}
+
+// wentOffline shows that from has gone offline: with a goodbye, or
+// without one for the reason given.
+func (a *app) wentOffline(from peer.ID, why string) {
+	if jsonOutput {
+		event := "goodbye"
+		if why != "" {
+			event = "offline"
 		}
-		priv, err := crypto.UnmarshalPrivateKey(b)
-		if err != nil {
-			return nil, err
+		printJSON(peerEvent{Event: event, Peer: from.String()})
+		return
+	}
+	note := ""
+	if why != "" {
+		note = " (" + why + ")"
+	}
+	if screenReader {
+		fmt.Printf("\n%s went offline%s.\n%s", a.conversationLabel(from.String()), note, a.prompt())
+		return
+	}
+	fmt.Printf("\n%s\n%s", styles.system("* "+shortID(from.String())+" went offline"+note), a.prompt())
+}
+
+// messageReceived runs an incoming message through the script filters and
+// spam rules, then accepts it. live is set for direct messages straight
+// from their sender, the only ones that can carry proof of work for us.
+// It runs on the event loop: everything else posts it there.
+func (a *app) messageReceived(peerID string, m Message, live bool) {
+	if !a.scripts.filter(peerID, m) {
+		return
+	}
+	if a.filterSpam(peerID, m, live) {
+		return
+	}
+	a.messageAccepted(peerID, m)
+}
+
+// messageAccepted displays a message and fans it out to unread tracking,
+// do-not-disturb, notifications, hooks, bots and plugins.
+func (a *app) messageAccepted(peerID string, m Message) {
+	// Judged by arrival time: whoever holds a revoked key can backdate.
+	if _, bad := a.revoked.untrusted(peerID, time.Now().UnixMilli()); bad {
+		a.untrustedMessage(peerID, m)
+		return
+	}
+	if p, err := peer.Decode(peerID); err == nil {
+		a.checkPin(p, "")
+	}
+	if a.pins.hold(peerID, m) {
+		return
+	}
+	if a.roomControl(peerID, m) {
+		return
+	}
+	when := time.UnixMilli(m.When).Format(time.RFC3339)
+	key := conversationKey(peerID, m)
+	if note, chat := a.handleTyped(key, m); !chat {
+		switch {
+		case jsonOutput:
+			printJSON(messageEvent{Event: "message", Message: m})
+		case note != "" && !a.convs.background(key):
+			fmt.Printf("\n%s\n%s", styles.system("* "+note), a.prompt())
 		}
-		return priv, nil
+		a.hooks.fire(hookEvent{Type: eventMessageReceived, Peer: peerID, When: m.When, Message: &m})
+		return
 	}
+	a.unread.received(key, m.When)
+	a.scroll.add(key, m)
+	a.messageShown(peerID, m, !jsonOutput && !a.convs.background(key))
+	a.recordBlocks(m)
+	watched := a.watch.match(key, m)
+	switch {
+	case jsonOutput:
+		printJSON(messageEvent{Event: "message", Message: m, Highlight: watched})
+	case a.convs.background(key):
+		// Counted as unread; the badge shows on the next prompt. A screen
+		// reader user can't glance at it, so they're told in a word.
+		if watched != "" {
+			a.highlighted(key, m)
+		} else if screenReader {
+			fmt.Printf("\nNew message in %s.\n%s", a.conversationLabel(key), a.prompt())
+		}
+	default:
+		if current, _ := a.convs.active(); current == key {
+			a.markRead(key)
+		}
+		if screenReader {
+			fmt.Printf("\n%s\n%s", a.announce(key, m), a.prompt())
+			break
+		}
+		from, when, body := styles.peer(m.From, m.From), styles.dim(when), styles.body(m.Body)
+		if watched != "" {
+			body = styles.highlight(m.Body)
+		}
+		body += fileLines(m) + locationLines(m) + cardLines(m)
+		if m.Room != "" {
+			fmt.Printf("\n<%s from=%s when=%s> %s\n%s", styles.room("#"+m.Room), from, when, body, a.prompt())
+		} else {
+			fmt.Printf("\n<msg from=%s when=%s> %s\n%s", from, when, body, a.prompt())
+		}
+	}
+	a.translateReceived(key, m)
+	a.stickerReceived(key, m)
+	a.cardReceived(m)
+	if a.dnd.active() {
+		if reply := a.dnd.hold(m); reply != "" && m.Room == "" {
+			// Off the event loop: an unreachable sender mustn't hold up
+			// showing everyone else's messages.
+			a.work.run(peerID, func() {
+				if _, err := a.node.Send(a.ctx, peerID, reply); err != nil {
+					logger.Warnf("dnd auto-reply to %s failed: %s", peerID, err)
+				}
+			})
+		}
+	} else {
+		a.notes.messageReceived(key, m, watched != "" || styles.mentioned(m.Body))
+	}
+	a.hooks.fire(hookEvent{Type: eventMessageReceived, Peer: peerID, When: m.When, Message: &m})
+	go a.runTriggers(peerID, key, m)
+	go a.bot.Dispatch(bot.Message{From: peerID, Room: m.Room, Body: m.Body, When: time.UnixMilli(m.When)})
+	go a.plugins.messageReceived(m)
+	a.webhooks.messageReceived(peerID, m)
+	if m.Room != "" {
+		a.bridgeRoomMessage(m)
+	}
+	if a.mqtt != nil {
+		a.mqtt.chatMessage(peerID, m)
+	}
+}
 
-	// generate ed25519 keypair
-	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.Ed25519, -1, rand.Reader)
-	if err != nil {
-		return nil, err
+// messageSent is called after we sent m, either directly to peerID or, with
+// peerID empty, to the room in m.Room.
+func (a *app) messageSent(peerID string, m Message) {
+	a.markRead(conversationKey(peerID, m))
+	if peerID != "" && m.Room == "" && m.Body != "" {
+		a.deliveries.track(m.ID(), peerID, m.Body, stateSent, "direct")
 	}
-	b, err := crypto.MarshalPrivateKey(priv)
-	if err != nil {
-		return nil, err
+	a.scroll.add(conversationKey(peerID, m), m)
+	a.recordBlocks(m)
+	a.hooks.fire(hookEvent{Type: eventMessageDelivered, Peer: peerID, When: m.When, Message: &m})
+	if m.Room != "" {
+		a.bridgeRoomMessage(m)
+	}
+	if a.mqtt != nil {
+		a.mqtt.chatMessage(a.h.ID().String(), m)
 	}
-	if err := os.WriteFile(path, b, 0600); err != nil {
-		return nil, err
+}
+
+// bridgeRoomMessage passes a room message to the configured bridges. Lines
+// the bridges themselves post into rooms don't come through here, which is
+// what keeps them from echoing.
+func (a *app) bridgeRoomMessage(m Message) {
+	if a.irc != nil {
+		a.irc.roomMessage(m)
+	}
+	if a.nostr != nil {
+		a.nostr.roomMessage(m)
 	}
-	return priv, nil
 }
 
-func printInvite(h host.Host) {
-	id := h.ID().String()
-	addrs := h.Addrs()
-	// choose the first address + /p2p/<peerid>
-	if len(addrs) == 0 {
+func printInvite(n *node.Node) {
+	invites := n.InviteAddrs()
+	if len(invites) == 0 {
 		fmt.Println("no listen addresses available. try running with an explicit listen addr or open firewall/port")
 		return
 	}
-	for _, a := range addrs {
-		fmt.Printf("%s/p2p/%s\n", a.String(), id)
+	for _, inv := range invites {
+		fmt.Println(inv)
 	}
 	fmt.Println("Share one of the lines above with peers as an invite. They can 'connect <that-line>'.")
 }
 
-func listPeers(h host.Host) {
+func listPeers(h host.Host, unread *unreadTracker) {
 	peers := h.Network().Peers()
+	if jsonOutput {
+		infos := make([]peerInfo, 0, len(peers))
+		for _, p := range peers {
+			info := peerInfo{Peer: p.String(), Unread: unread.count(p.String())}
+			if rtt := h.Peerstore().LatencyEWMA(p); rtt > 0 {
+				info.LatencyMS = float64(rtt.Microseconds()) / 1000
+			}
+			infos = append(infos, info)
+		}
+		printJSON(map[string]any{"peers": infos})
+		return
+	}
 	if len(peers) == 0 {
 		fmt.Println("no connected peers")
 		return
 	}
 	fmt.Println("connected peers:")
 	for _, p := range peers {
+		var notes []string
+		if rtt := h.Peerstore().LatencyEWMA(p); rtt > 0 {
+			notes = append(notes, rtt.Round(time.Millisecond).String())
+		}
+		if n := unread.count(p.String()); n > 0 {
+			notes = append(notes, fmt.Sprintf("%d unread", n))
+		}
+		if len(notes) > 0 {
+			fmt.Printf(" - %s (%s)\n", p, strings.Join(notes, ", "))
+			continue
+		}
 		fmt.Println(" -", p.String())
 	}
 }
 
-func connectPeer(ctx context.Context, h host.Host, addrStr string) error {
-	maddr, err := ma.NewMultiaddr(addrStr)
+func connectPeer(ctx context.Context, n *node.Node, addrStr string) error {
+	id, err := n.Connect(ctx, addrStr)
 	if err != nil {
-		// support the case where user passes full multiaddr that includes /p2p/<peerid>
-		// try to parse and connect
-		if strings.Contains(addrStr, "/p2p/") {
-			maddr, err = ma.NewMultiaddr(addrStr)
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
-	}
-	pi, err := peer.AddrInfoFromP2pAddr(maddr)
-	if err != nil {
-		return err
-	}
-	h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
-	if err := h.Connect(ctx, *pi); err != nil {
 		return err
 	}
-	fmt.Println("connected to", pi.ID.String())
+	printResult(map[string]string{"connected": id.String()}, "connected to "+id.String())
 	return nil
 }
 
-func sendMessage(ctx context.Context, h host.Host, peerIDStr string, body string) error {
-	pid, err := peer.Decode(peerIDStr)
+// storeAtInbox leaves body at the mailbox to's DHT inbox pointer names.
+func (a *app) storeAtInbox(ctx context.Context, to, body string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	_, err := a.node.StoreOffline(ctx, to, body)
+	return err
+}
+
+// showHeld shows the messages the tray agent received and held while it
+// kept the node online, as if they had just arrived.
+func (a *app) showHeld(path string) {
+	msgs, err := node.TakeHeld(path)
 	if err != nil {
-		return err
+		logger.Warnf("reading held messages: %s", err)
 	}
-	// open stream
-	s, err := h.NewStream(ctx, pid, protocolID)
-	if err != nil {
-		return err
+	if len(msgs) > 0 {
+		logger.Infof("%d messages arrived while the tray kept you online", len(msgs))
 	}
-	defer s.Close()
-	m := Message{From: h.ID().String(), When: time.Now().UnixMilli(), Body: body}
-	b, _ := json.Marshal(m)
-	b = append(b, '\n')
-	_, err = s.Write(b)
-	if err != nil {
-		return err
+	for _, m := range msgs {
+		a.post(func() { a.messageReceived(m.From, m, false) })
 	}
-	fmt.Println("sent")
-	return nil
 }
 
-func storeOfflineMessage(ctx context.Context, dht *kaddht.IpfsDHT, recipientPeerID string, from string, body string) error {
-	// Append message to DHT key: /p2pchat/messages/<recipientPeerID>
-	key := dhtMsgKeyPrefix + recipientPeerID
-	var msgs []Message
-	val, err := dht.GetValue(ctx, key)
-	if err == nil {
-		// existing value
-		_ = json.Unmarshal(val, &msgs)
-	}
-	msgs = append(msgs, Message{From: from, When: time.Now().UnixMilli(), Body: body})
-	n, _ := json.Marshal(msgs)
-	// Note: PutValue may be limited in size by network; large values won't replicate well.
-	if err := dht.PutValue(ctx, key, n); err != nil {
+// fetchOfflineMessages collects our own messages through our DHT inbox
+// pointer; for anyone else it shows where their pointer leads.
+func fetchOfflineMessages(ctx context.Context, n *node.Node, peerID string, screen func([]node.Fetched) []node.Fetched, untrusted, withheld func(Message) bool, showInvalid bool) error {
+	if peerID != n.Host().ID().String() {
+		p, err := n.ResolveInbox(ctx, peerID)
+		if err != nil {
+			return err
+		}
+		printResult(p, fmt.Sprintf("inbox pointer #%d, valid until %s, mailboxes:\n  %s", p.Seq,
+			time.UnixMilli(p.Expires).Format(time.DateTime), strings.Join(p.Mailboxes, "\n  ")))
+		return nil
+	}
+	msgs, err := n.FetchOffline(ctx, peerID)
+	if err != nil {
 		return err
 	}
-	fmt.Println("stored for offline delivery (in DHT key)")
+	printFetched("inbox", screen(msgs), untrusted, withheld, showInvalid)
 	return nil
 }
 
-func fetchOfflineMessages(ctx context.Context, dht *kaddht.IpfsDHT, peerID string) error {
-	key := dhtMsgKeyPrefix + peerID
-	val, err := dht.GetValue(ctx, key)
-	if err != nil {
-		return fmt.Errorf("no messages or error: %w", err)
-	}
-	var msgs []Message
-	if err := json.Unmarshal(val, &msgs); err != nil {
-		return err
+// printFetched lists stored messages with how their signatures checked
+// out. Those untrusted reports on (sent after the sender's key was
+// revoked) are flagged, and the bodies of those withheld reports on (from
+// require-e2e contacts) aren't shown, nor those of invalid ones unless
+// showInvalid.
+func printFetched(source string, msgs []node.Fetched, untrusted, withheld func(Message) bool, showInvalid bool) {
+	hidden := func(f node.Fetched) bool { return f.Verification == node.Invalid && !showInvalid }
+	if jsonOutput {
+		res := fetchResult{Source: source}
+		for i, f := range msgs {
+			m := f.Message
+			if untrusted(m) {
+				res.Untrusted = append(res.Untrusted, i)
+			}
+			if withheld(m) {
+				m.Body = ""
+				res.Withheld = append(res.Withheld, i)
+			}
+			if f.Verification == node.Invalid {
+				res.Invalid = append(res.Invalid, i)
+				if hidden(f) {
+					m.Body = ""
+				}
+			}
+			res.Messages = append(res.Messages, m)
+			res.Verification = append(res.Verification, f.Verification)
+		}
+		printJSON(res)
+		return
 	}
 	fmt.Printf("fetched %d messages:\n", len(msgs))
-	for i, m := range msgs {
-		fmt.Printf("%d) from=%s at=%s\n   %s\n", i+1, m.From, time.UnixMilli(m.When).Format(time.RFC3339), m.Body)
+	for i, f := range msgs {
+		m := f.Message
+		body := m.Body
+		switch {
+		case hidden(f):
+			body = styles.err("(hidden: its signature is invalid; 'fetch -show-invalid' would show it, but it's gone from the mailbox now)")
+		case withheld(m):
+			body = styles.err("(withheld: the sender requires end-to-end encryption and stored copies aren't)")
+		}
+		status := string(f.Verification)
+		if f.Problem != "" {
+			status += ": " + f.Problem
+		}
+		if f.Verification == node.Invalid {
+			status = styles.err("!!! " + status)
+		}
+		fmt.Printf("%d) from=%s at=%s [%s]\n   %s\n", i+1, m.From, time.UnixMilli(m.When).Format(time.RFC3339), status, body)
+		if m.Part != nil {
+			fmt.Println("  ", styles.err(fmt.Sprintf("(part %d of a split message; the rest hasn't arrived)", m.Part.Index+1)))
+		}
+		if untrusted(m) {
+			fmt.Println("  ", styles.err("!!! sent after the sender's key was revoked; not trusted"))
+		}
 	}
-	return nil
 }
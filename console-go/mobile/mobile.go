@@ -0,0 +1,163 @@
+// Package mobile exposes the peep-chat node to Android and iOS through
+// gomobile:
+//
+//	gomobile bind -target=android -o peep.aar p2p-chat/mobile
+//	gomobile bind -target=ios -o Peep.xcframework p2p-chat/mobile
+//
+// Only gomobile-friendly types cross the boundary (strings, int64, error,
+// and the Listener interface, which the app implements).
+package mobile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+// callTimeout bounds every blocking network call made from the app.
+const callTimeout = 30 * time.Second
+
+// Listener receives node events. Callbacks run on libp2p goroutines, so
+// implementations must hop to the UI thread themselves.
+type Listener interface {
+	OnMessage(from, body string, when int64)
+	OnPeerConnected(peerID string)
+	OnPeerDisconnected(peerID string)
+}
+
+// Node is a running node. Create one with Start and Stop it when the app
+// goes away.
+type Node struct {
+	n      *node.Node
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Start runs a node whose identity key lives in dataDir (the app's private
+// files directory). listener may be nil.
+func Start(dataDir string, listener Listener) (*Node, error) {
+	return StartWithRouting(dataDir, "", listener)
+}
+
+// StartWithRouting is Start for a lighter node: routers lists Delegated
+// Routing V1 HTTP endpoints, one per line, that find peers in place of
+// the node's own DHT lookups (which then run in client mode).
+func StartWithRouting(dataDir, routers string, listener Listener) (*Node, error) {
+	if dataDir == "" {
+		return nil, errors.New("dataDir is required")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n, err := node.New(ctx, node.Options{
+		IdentityPath:     filepath.Join(dataDir, "identity.key"),
+		DelegatedRouting: strings.Fields(routers),
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if listener != nil {
+		n.OnMessage(func(from peer.ID, m node.Message) {
+			listener.OnMessage(from.String(), m.Body, m.When)
+		})
+		n.Host().Network().Notify(&network.NotifyBundle{
+			ConnectedF: func(_ network.Network, c network.Conn) {
+				listener.OnPeerConnected(c.RemotePeer().String())
+			},
+			DisconnectedF: func(_ network.Network, c network.Conn) {
+				listener.OnPeerDisconnected(c.RemotePeer().String())
+			},
+		})
+	}
+	return &Node{n: n, ctx: ctx, cancel: cancel}, nil
+}
+
+// PeerID returns our peer ID.
+func (m *Node) PeerID() string { return m.n.ID().String() }
+
+// InviteAddrs returns the invite lines to share, one per line.
+func (m *Node) InviteAddrs() string { return strings.Join(m.n.InviteAddrs(), "\n") }
+
+// Connect dials an invite line and returns the peer's ID.
+func (m *Node) Connect(addr string) (string, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, callTimeout)
+	defer cancel()
+	id, err := m.n.Connect(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// FindPeer looks up a peer's addresses and returns them, one per line.
+func (m *Node) FindPeer(peerID string) (string, error) {
+	id, err := peer.Decode(peerID)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(m.ctx, callTimeout)
+	defer cancel()
+	pi, err := m.n.FindPeer(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	addrs := make([]string, len(pi.Addrs))
+	for i, addr := range pi.Addrs {
+		addrs[i] = addr.String()
+	}
+	return strings.Join(addrs, "\n"), nil
+}
+
+// Send delivers a direct message and returns its timestamp (Unix ms).
+func (m *Node) Send(peerID, body string) (int64, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, callTimeout)
+	defer cancel()
+	msg, err := m.n.Send(ctx, peerID, body)
+	if err != nil {
+		return 0, err
+	}
+	return msg.When, nil
+}
+
+// Store leaves a message in peerID's offline inbox.
+func (m *Node) Store(peerID, body string) error {
+	ctx, cancel := context.WithTimeout(m.ctx, callTimeout)
+	defer cancel()
+	_, err := m.n.StoreOffline(ctx, peerID, body)
+	return err
+}
+
+// Fetch collects the messages in peerID's offline inbox, which must be
+// this node's own, as a JSON array of {"from", "when", "body"} objects.
+func (m *Node) Fetch(peerID string) (string, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, callTimeout)
+	defer cancel()
+	msgs, err := m.n.FetchOffline(ctx, peerID)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(msgs)
+	return string(b), err
+}
+
+// Peers returns the connected peer IDs, one per line.
+func (m *Node) Peers() string {
+	var ids []string
+	for _, p := range m.n.Host().Network().Peers() {
+		ids = append(ids, p.String())
+	}
+	return strings.Join(ids, "\n")
+}
+
+// Stop shuts the node down.
+func (m *Node) Stop() error {
+	m.cancel()
+	return m.n.Close()
+}
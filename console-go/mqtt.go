@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttConfig is read from mqttConfigFile; the bridge is enabled when the
+// file exists.
+type mqttConfig struct {
+	Broker   string `json:"broker"` // e.g. tcp://localhost:1883 or ssl://host:8883
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Subscriptions forward MQTT payloads to peers and rooms.
+	Subscriptions []mqttSubscription `json:"subscriptions"`
+	// Chat messages starting with PublishPrefix ("<prefix><topic> <payload>")
+	// are published to MQTT, but only if the topic is under PublishRoot and
+	// the sender is us or listed in PublishFrom.
+	PublishPrefix string   `json:"publish_prefix"`
+	PublishRoot   string   `json:"publish_root"`
+	PublishFrom   []string `json:"publish_from"`
+}
+
+type mqttSubscription struct {
+	Topic string   `json:"topic"` // may contain + and # wildcards
+	QoS   byte     `json:"qos"`
+	To    []string `json:"to"`
+	Rooms []string `json:"rooms"`
+}
+
+// mqttBridge forwards MQTT messages into chat and chat commands to MQTT.
+type mqttBridge struct {
+	a      *app
+	cfg    mqttConfig
+	client mqtt.Client
+}
+
+func loadMQTTConfig(path string) (*mqttConfig, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := &mqttConfig{ClientID: "peep-chat", PublishPrefix: "!mqtt "}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Broker == "" {
+		return nil, fmt.Errorf("%s: broker is required", path)
+	}
+	return cfg, nil
+}
+
+func startMQTTBridge(a *app, cfg mqttConfig) (*mqttBridge, error) {
+	b := &mqttBridge{a: a, cfg: cfg}
+	for _, s := range cfg.Subscriptions {
+		for _, r := range s.Rooms {
+			if err := a.rooms.join(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(b.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Warnf("mqtt bridge: connection lost: %s", err)
+		})
+	b.client = mqtt.NewClient(opts)
+	// With ConnectRetry the token only completes once connected, so don't
+	// block startup on an unreachable broker.
+	b.client.Connect()
+	return b, nil
+}
+
+// subscribe (re)subscribes to every configured topic; it runs on each
+// successful connect.
+func (b *mqttBridge) subscribe(c mqtt.Client) {
+	logger.Infof("mqtt bridge: connected to %s", b.cfg.Broker)
+	for _, s := range b.cfg.Subscriptions {
+		s := s
+		tok := c.Subscribe(s.Topic, s.QoS, func(_ mqtt.Client, msg mqtt.Message) {
+			b.forward(s, msg.Topic(), msg.Payload())
+		})
+		if tok.WaitTimeout(10*time.Second) && tok.Error() != nil {
+			logger.Warnf("mqtt bridge: subscribing to %s: %s", s.Topic, tok.Error())
+		}
+	}
+}
+
+// forward delivers an MQTT payload to the subscription's peers and rooms.
+func (b *mqttBridge) forward(s mqttSubscription, topic string, payload []byte) {
+	body := fmt.Sprintf("[mqtt] %s: %s", topic, payload)
+	for _, to := range s.To {
+		m, err := b.a.node.Send(b.a.ctx, to, body)
+		if err != nil {
+			logger.Warnf("mqtt bridge: forwarding %s to %s: %s", topic, to, err)
+			continue
+		}
+		b.a.messageSent(to, m)
+	}
+	for _, r := range s.Rooms {
+		m, err := b.a.rooms.publish(b.a.ctx, r, body)
+		if err != nil {
+			logger.Warnf("mqtt bridge: forwarding %s to #%s: %s", topic, r, err)
+			continue
+		}
+		b.a.messageSent("", m)
+	}
+}
+
+// chatMessage publishes a chat message to MQTT if it's a publish command
+// from an allowed sender.
+func (b *mqttBridge) chatMessage(from string, m Message) {
+	rest, ok := strings.CutPrefix(m.Body, b.cfg.PublishPrefix)
+	if b.cfg.PublishPrefix == "" || !ok {
+		return
+	}
+	if from != b.a.h.ID().String() && !containsString(b.cfg.PublishFrom, from) {
+		logger.Warnf("mqtt bridge: %s is not allowed to publish", from)
+		return
+	}
+	topic, payload, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	if topic == "" || strings.ContainsAny(topic, "+#") || !strings.HasPrefix(topic, b.cfg.PublishRoot) {
+		logger.Warnf("mqtt bridge: refusing to publish to %q", topic)
+		return
+	}
+	tok := b.client.Publish(topic, 0, false, payload)
+	go func() {
+		if tok.WaitTimeout(10*time.Second) && tok.Error() != nil {
+			logger.Warnf("mqtt bridge: publishing to %s: %s", topic, tok.Error())
+		}
+	}()
+}
+
+func (b *mqttBridge) status() string {
+	state := "disconnected"
+	if b.client.IsConnectionOpen() {
+		state = "connected"
+	}
+	return fmt.Sprintf("%s (%s, %d subscriptions)", b.cfg.Broker, state, len(b.cfg.Subscriptions))
+}
+
+func (b *mqttBridge) close() {
+	b.client.Disconnect(250)
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "mqtt",
+		Summary: "show MQTT bridge status (configured in " + mqttConfigFile + ")",
+		Run: func(a *app, inv *invocation) error {
+			if a.mqtt == nil {
+				fmt.Println("MQTT bridge not configured")
+				return nil
+			}
+			fmt.Println(a.mqtt.status())
+			return nil
+		},
+	})
+}
@@ -0,0 +1,539 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Limits on content-addressed blocks and the files built from them.
+const (
+	// MaxBlockSize caps one block; files are cut into chunks this size.
+	MaxBlockSize = 256 << 10
+	// MaxFileSize caps an attached file.
+	MaxFileSize = 64 << 20
+	// MaxFiles caps the files attached to one message.
+	MaxFiles = 8
+)
+
+// BlockProtocolID asks a peer which blocks it has and fetches them by CID.
+const BlockProtocolID = "/p2pchat/block/1.0.0"
+
+// ErrBlockNotFound is returned for a block neither we nor the peer asked
+// have.
+var ErrBlockNotFound = errors.New("block not found")
+
+// BlockCID is the CIDv1 (SHA2-256) of data: raw for file chunks, DAG-JSON
+// for messages and file manifests.
+func BlockCID(codec uint64, data []byte) cid.Cid {
+	sum, _ := mh.Sum(data, mh.SHA2_256, -1)
+	return cid.NewCidV1(codec, sum)
+}
+
+// FileRef is how a message refers to an attached file: its manifest
+// block, and what to show before anyone fetches it.
+type FileRef struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	CID  string `json:"cid"`
+}
+
+// FileManifest is the DAG-JSON block a FileRef names: the file's raw
+// chunks, in order.
+type FileManifest struct {
+	Name   string   `json:"name"`
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks"`
+}
+
+// BlocksDir, in the data directory next to the identity file, is the
+// blockstore the console client and GUI share.
+const BlocksDir = "p2pchat_blocks"
+
+// Blockstore keeps content-addressed blocks, one file per CID under dir.
+// A block stored twice is kept once, and every read is checked against
+// its CID, so whatever a peer hands us can be verified.
+type Blockstore struct {
+	dir string
+}
+
+// OpenBlockstore opens the blockstore in dir, creating it if needed.
+func OpenBlockstore(dir string) (*Blockstore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Blockstore{dir: dir}, nil
+}
+
+func (bs *Blockstore) path(c cid.Cid) string {
+	return filepath.Join(bs.dir, c.String())
+}
+
+// Put stores data as a block of codec and returns its CID.
+func (bs *Blockstore) Put(codec uint64, data []byte) (cid.Cid, error) {
+	if len(data) > MaxBlockSize {
+		return cid.Undef, fmt.Errorf("block of %d bytes, limit %d", len(data), MaxBlockSize)
+	}
+	c := BlockCID(codec, data)
+	if bs.Has(c) {
+		return c, nil
+	}
+	tmp := bs.path(c) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return cid.Undef, err
+	}
+	return c, os.Rename(tmp, bs.path(c))
+}
+
+// Has reports whether the block is stored.
+func (bs *Blockstore) Has(c cid.Cid) bool {
+	_, err := os.Stat(bs.path(c))
+	return err == nil
+}
+
+// Get returns a block, checked against its CID.
+func (bs *Blockstore) Get(c cid.Cid) ([]byte, error) {
+	data, err := os.ReadFile(bs.path(c))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !BlockCID(c.Type(), data).Equals(c) {
+		return nil, fmt.Errorf("block %s is corrupt", c)
+	}
+	return data, nil
+}
+
+// putVerified stores data fetched for c, if it hashes to c.
+func (bs *Blockstore) putVerified(c cid.Cid, data []byte) error {
+	if !BlockCID(c.Type(), data).Equals(c) {
+		return fmt.Errorf("block %s doesn't match its CID", c)
+	}
+	_, err := bs.Put(c.Type(), data)
+	return err
+}
+
+// List returns the stored CIDs and their total size.
+func (bs *Blockstore) List() ([]cid.Cid, int64, error) {
+	entries, err := os.ReadDir(bs.dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var out []cid.Cid
+	var total int64
+	for _, e := range entries {
+		c, err := cid.Decode(e.Name())
+		if err != nil {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			total += info.Size()
+		}
+		out = append(out, c)
+	}
+	return out, total, nil
+}
+
+// Verify rehashes every block and returns the CIDs of corrupt ones.
+func (bs *Blockstore) Verify() ([]cid.Cid, error) {
+	cids, _, err := bs.List()
+	if err != nil {
+		return nil, err
+	}
+	var bad []cid.Cid
+	for _, c := range cids {
+		if _, err := bs.Get(c); err != nil {
+			bad = append(bad, c)
+		}
+	}
+	return bad, nil
+}
+
+// PutMessage stores m as a DAG-JSON block; its CID identifies the message.
+func (bs *Blockstore) PutMessage(m Message) (cid.Cid, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return bs.Put(cid.DagJSON, b)
+}
+
+// GetMessage reads and validates a message block.
+func (bs *Blockstore) GetMessage(c cid.Cid) (Message, error) {
+	b, err := bs.Get(c)
+	if err != nil {
+		return Message{}, err
+	}
+	var m Message
+	if err := unmarshalMessage(b, &m); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+// MessageCID is the CID m has as a block.
+func MessageCID(m Message) cid.Cid {
+	b, _ := json.Marshal(m)
+	return BlockCID(cid.DagJSON, b)
+}
+
+// PutFile cuts r into raw chunks, stores them and a manifest, and returns
+// the reference to attach to a message.
+func (bs *Blockstore) PutFile(name string, r io.Reader) (FileRef, error) {
+	man := FileManifest{Name: name}
+	buf := make([]byte, MaxBlockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			man.Size += int64(n)
+			if man.Size > MaxFileSize {
+				return FileRef{}, fmt.Errorf("file is over the %d MiB limit", MaxFileSize>>20)
+			}
+			c, perr := bs.Put(cid.Raw, buf[:n])
+			if perr != nil {
+				return FileRef{}, perr
+			}
+			man.Chunks = append(man.Chunks, c.String())
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return FileRef{}, err
+		}
+	}
+	b, err := json.Marshal(man)
+	if err != nil {
+		return FileRef{}, err
+	}
+	c, err := bs.Put(cid.DagJSON, b)
+	if err != nil {
+		return FileRef{}, err
+	}
+	return FileRef{Name: name, Size: man.Size, CID: c.String()}, nil
+}
+
+// Manifest reads the manifest block c.
+func (bs *Blockstore) Manifest(c cid.Cid) (FileManifest, error) {
+	b, err := bs.Get(c)
+	if err != nil {
+		return FileManifest{}, err
+	}
+	return decodeManifest(b)
+}
+
+func decodeManifest(b []byte) (FileManifest, error) {
+	var man FileManifest
+	if err := json.Unmarshal(b, &man); err != nil {
+		return FileManifest{}, fmt.Errorf("file manifest: %w", err)
+	}
+	if man.Size > MaxFileSize || int64(len(man.Chunks)) > MaxFileSize/MaxBlockSize+1 {
+		return FileManifest{}, errors.New("file manifest: too large")
+	}
+	return man, nil
+}
+
+// WriteFile writes the file whose manifest is c to w; every chunk must be
+// stored.
+func (bs *Blockstore) WriteFile(c cid.Cid, w io.Writer) error {
+	man, err := bs.Manifest(c)
+	if err != nil {
+		return err
+	}
+	for _, s := range man.Chunks {
+		cc, err := cid.Decode(s)
+		if err != nil {
+			return fmt.Errorf("file manifest: %w", err)
+		}
+		data, err := bs.Get(cc)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeBlocks answers BlockProtocolID requests from bs, and makes it the
+// store FetchBlocks fills.
+func (n *Node) ServeBlocks(bs *Blockstore) {
+	n.mu.Lock()
+	n.blocks = bs
+	n.mu.Unlock()
+	n.host.SetStreamHandler(BlockProtocolID, Guard(n.handleBlock))
+}
+
+// maxWants caps the CIDs one have query may ask about.
+const maxWants = 1024
+
+// fetchWorkers is how many blocks FetchBlocks downloads at once.
+const fetchWorkers = 4
+
+// blockRequest asks for one block's data (CID) or, want/have style, which
+// of a list of blocks the peer holds (Have).
+type blockRequest struct {
+	CID  string   `json:"cid,omitempty"`
+	Have []string `json:"have,omitempty"`
+}
+
+type blockResponse struct {
+	Error string   `json:"error,omitempty"`
+	Data  []byte   `json:"data,omitempty"`
+	Have  []string `json:"have,omitempty"`
+}
+
+func (n *Node) handleBlock(s network.Stream) {
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+	var req blockRequest
+	if err := readFrame(s, &req); err != nil {
+		log.Debugf("block request from %s: %s", s.Conn().RemotePeer(), err)
+		return
+	}
+	release, err := n.serve(s.Conn().RemotePeer())
+	if err != nil {
+		_ = writeFrame(s, blockResponse{Error: err.Error()})
+		return
+	}
+	defer release()
+	n.mu.RLock()
+	bs := n.blocks
+	n.mu.RUnlock()
+	var resp blockResponse
+	switch {
+	case len(req.Have) > maxWants:
+		resp.Error = fmt.Sprintf("asked about %d blocks, limit %d", len(req.Have), maxWants)
+	case req.Have != nil:
+		for _, s := range req.Have {
+			if c, err := cid.Decode(s); err == nil && bs.Has(c) {
+				resp.Have = append(resp.Have, s)
+			}
+		}
+	default:
+		c, err := cid.Decode(req.CID)
+		if err == nil {
+			resp.Data, err = bs.Get(c)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	}
+	_ = writeFrame(s, resp)
+}
+
+// blockRoundTrip sends req to p and reads the response.
+func (n *Node) blockRoundTrip(ctx context.Context, p peer.ID, req blockRequest) (blockResponse, error) {
+	s, err := n.host.NewStream(ctx, p, BlockProtocolID)
+	if err != nil {
+		return blockResponse{}, err
+	}
+	defer s.Close()
+	defer bindStream(ctx, s)()
+	if err := writeFrame(s, req); err != nil {
+		return blockResponse{}, err
+	}
+	var resp blockResponse
+	if err := readFrame(s, &resp); err != nil {
+		return blockResponse{}, err
+	}
+	return resp, nil
+}
+
+// HasBlocks asks p which of cids it holds.
+func (n *Node) HasBlocks(ctx context.Context, p peer.ID, cids []cid.Cid) ([]cid.Cid, error) {
+	req := blockRequest{Have: make([]string, 0, len(cids))}
+	for _, c := range cids {
+		req.Have = append(req.Have, c.String())
+	}
+	resp, err := n.blockRoundTrip(ctx, p, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("have query to %s: %s", p, resp.Error)
+	}
+	var out []cid.Cid
+	for _, s := range resp.Have {
+		if c, err := cid.Decode(s); err == nil {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// FetchBlock gets block c from p into our blockstore, unless it is there
+// already.
+func (n *Node) FetchBlock(ctx context.Context, p peer.ID, c cid.Cid) (err error) {
+	n.mu.RLock()
+	bs := n.blocks
+	n.mu.RUnlock()
+	if bs == nil {
+		return errors.New("no blockstore")
+	}
+	if bs.Has(c) {
+		return nil
+	}
+	ctx, span := tracer.Start(ctx, "node.FetchBlock", trace.WithAttributes(
+		attribute.String("peer.id", p.String()), attribute.String("cid", c.String())))
+	defer func() { endSpan(span, err) }()
+	resp, err := n.blockRoundTrip(ctx, p, blockRequest{CID: c.String()})
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		if strings.HasPrefix(resp.Error, ErrBlockNotFound.Error()) {
+			return fmt.Errorf("%w at %s: %s", ErrBlockNotFound, p, c)
+		}
+		return fmt.Errorf("block %s from %s: %s", c, p, resp.Error)
+	}
+	return bs.putVerified(c, resp.Data)
+}
+
+// FetchBlocks gets the blocks of cids we lack from whichever of peers have
+// them: it asks every peer which it holds, then downloads each block from
+// a holder, moving on to the next holder if one fails. Every block is
+// checked against its CID.
+func (n *Node) FetchBlocks(ctx context.Context, peers []peer.ID, cids []cid.Cid) (err error) {
+	n.mu.RLock()
+	bs := n.blocks
+	n.mu.RUnlock()
+	if bs == nil {
+		return errors.New("no blockstore")
+	}
+	var missing []cid.Cid
+	for _, c := range cids {
+		if !bs.Has(c) {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	ctx, span := tracer.Start(ctx, "node.FetchBlocks", trace.WithAttributes(
+		attribute.Int("peers", len(peers)), attribute.Int("blocks", len(missing))))
+	defer func() { endSpan(span, err) }()
+
+	holders := make(map[cid.Cid][]peer.ID)
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for start := 0; start < len(missing); start += maxWants {
+		batch := missing[start:min(start+maxWants, len(missing))]
+		for _, p := range peers {
+			wg.Add(1)
+			go func(p peer.ID) {
+				defer wg.Done()
+				have, err := n.HasBlocks(ctx, p, batch)
+				if err != nil {
+					log.Debugf("have query to %s: %s", p, err)
+					return
+				}
+				mu.Lock()
+				for _, c := range have {
+					holders[c] = append(holders[c], p)
+				}
+				mu.Unlock()
+			}(p)
+		}
+		wg.Wait()
+	}
+
+	jobs := make(chan cid.Cid)
+	var failed []error
+	for i := 0; i < fetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				err := fmt.Errorf("%w: nobody has %s", ErrBlockNotFound, c)
+				for _, p := range holders[c] {
+					if err = n.FetchBlock(ctx, p, c); err == nil {
+						break
+					}
+				}
+				if err != nil {
+					mu.Lock()
+					failed = append(failed, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, c := range missing {
+		jobs <- c
+	}
+	close(jobs)
+	wg.Wait()
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d blocks not fetched: %w", len(failed), len(missing), errors.Join(failed...))
+	}
+	return nil
+}
+
+// FetchFile gets the manifest and every chunk of the file ref names from
+// whichever of peers have them, and returns the manifest.
+func (n *Node) FetchFile(ctx context.Context, peers []peer.ID, ref FileRef) (FileManifest, error) {
+	c, err := cid.Decode(ref.CID)
+	if err != nil {
+		return FileManifest{}, err
+	}
+	if err := n.FetchBlocks(ctx, peers, []cid.Cid{c}); err != nil {
+		return FileManifest{}, err
+	}
+	man, err := n.blocks.Manifest(c)
+	if err != nil {
+		return FileManifest{}, err
+	}
+	chunks := make([]cid.Cid, 0, len(man.Chunks))
+	for _, s := range man.Chunks {
+		cc, err := cid.Decode(s)
+		if err != nil {
+			return FileManifest{}, fmt.Errorf("file manifest: %w", err)
+		}
+		chunks = append(chunks, cc)
+	}
+	return man, n.FetchBlocks(ctx, peers, chunks)
+}
+
+// validateFiles checks the file references of a message.
+func validateFiles(files []FileRef) error {
+	if len(files) > MaxFiles {
+		return fmt.Errorf("%d files, limit %d", len(files), MaxFiles)
+	}
+	for _, f := range files {
+		if f.Name == "" || len(f.Name) > 255 || strings.ContainsAny(f.Name, `/\`) {
+			return fmt.Errorf("bad file name %q", truncate(f.Name, 64))
+		}
+		if err := checkText(f.Name, ""); err != nil {
+			return fmt.Errorf("file name %s", err)
+		}
+		if f.Size < 0 || f.Size > MaxFileSize {
+			return fmt.Errorf("file size %d out of range", f.Size)
+		}
+		c, err := cid.Decode(f.CID)
+		if err != nil || c.Type() != cid.DagJSON {
+			return fmt.Errorf("bad file CID %q", truncate(f.CID, 100))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// cardContext is signed along with a contact card so the signature can't
+// be passed off as anything else.
+const cardContext = "peep-chat contact card:"
+
+// MaxCardAddrs bounds the addresses a contact card lists.
+const MaxCardAddrs = 16
+
+// ContactCard introduces a third party: its peer ID, the addresses to dial
+// it on and its profile, signed by the Introducer who vouches for them, so
+// a card passed along still says who made it.
+type ContactCard struct {
+	Peer       string   `json:"peer"`
+	Name       string   `json:"name,omitempty"` // the introducer's name for it, a suggestion
+	Addrs      []string `json:"addrs,omitempty"`
+	Profile    Profile  `json:"profile"`
+	Introducer string   `json:"introducer"`
+	Created    int64    `json:"created"` // unix ms
+	Sig        []byte   `json:"sig"`
+}
+
+// NewContactCard makes a card for p and signs it with our key.
+func (n *Node) NewContactCard(name string, p peer.AddrInfo, prof Profile) (ContactCard, error) {
+	c := ContactCard{Peer: p.ID.String(), Name: name, Profile: prof, Introducer: n.host.ID().String(), Created: time.Now().UnixMilli()}
+	for _, a := range p.Addrs {
+		if len(c.Addrs) == MaxCardAddrs {
+			break
+		}
+		c.Addrs = append(c.Addrs, a.String())
+	}
+	var err error
+	if c.Sig, err = n.host.Peerstore().PrivKey(n.host.ID()).Sign(c.signedBytes()); err != nil {
+		return ContactCard{}, err
+	}
+	return c, nil
+}
+
+func (c ContactCard) signedBytes() []byte {
+	c.Sig = nil
+	b, _ := json.Marshal(c)
+	return append([]byte(cardContext), b...)
+}
+
+// Verify checks that c is well formed and signed by its introducer.
+func (c ContactCard) Verify() error {
+	if _, err := peer.Decode(c.Peer); err != nil {
+		return fmt.Errorf("contact card: %w", err)
+	}
+	if len(c.Name) > 64 || strings.ContainsAny(c.Name, " /") || checkText(c.Name, "") != nil {
+		return fmt.Errorf("contact card: bad name %q", truncate(c.Name, 64))
+	}
+	if len(c.Addrs) > MaxCardAddrs || len(c.Profile.Mailboxes) > MaxCardAddrs {
+		return errors.New("contact card: too many addresses")
+	}
+	for _, s := range c.Addrs {
+		if _, err := ma.NewMultiaddr(s); err != nil {
+			return fmt.Errorf("contact card: address %q: %w", truncate(s, 100), err)
+		}
+	}
+	id, err := peer.Decode(c.Introducer)
+	if err != nil {
+		return fmt.Errorf("contact card: %w", err)
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("contact card: %w", err)
+	}
+	ok, err := pub.Verify(c.signedBytes(), c.Sig)
+	if err != nil {
+		return fmt.Errorf("contact card: %w", err)
+	}
+	if !ok {
+		return errors.New("contact card: bad signature")
+	}
+	return nil
+}
+
+// AddrInfo is the peer the card introduces, with its addresses.
+func (c ContactCard) AddrInfo() (peer.AddrInfo, error) {
+	id, err := peer.Decode(c.Peer)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	pi := peer.AddrInfo{ID: id}
+	for _, s := range c.Addrs {
+		if a, err := ma.NewMultiaddr(s); err == nil {
+			pi.Addrs = append(pi.Addrs, a)
+		}
+	}
+	return pi, nil
+}
+
+// SendContactCard sends a card to a peer, with body as the text clients
+// without contact cards show.
+func (n *Node) SendContactCard(ctx context.Context, to, body string, c ContactCard) (Message, error) {
+	return n.send(ctx, "node.SendContactCard", to, Message{Body: body, Card: &c}, true)
+}
+
+// validateCard checks a message's contact card, which its sender must
+// have made.
+func validateCard(c *ContactCard, from string) error {
+	if c == nil {
+		return nil
+	}
+	if c.Introducer != from {
+		return errors.New("contact card made by someone other than the sender")
+	}
+	return c.Verify()
+}
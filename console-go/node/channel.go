@@ -0,0 +1,288 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// DHTChannelPrefix is where a channel's head pointer is published:
+	// /p2pchat/v2/channel/<publisher>/<name>.
+	DHTChannelPrefix = DHTNamespace + "channel/"
+	// ChannelTopicPrefix namespaces the pubsub topics posts are announced
+	// on: /p2pchat/channels/<publisher>/<name>.
+	ChannelTopicPrefix = "/p2pchat/channels/"
+	// ChannelHeadTTL is how long a published head stays valid; publishers
+	// republish well before.
+	ChannelHeadTTL = 48 * time.Hour
+)
+
+// channelPostContext and channelHeadContext are signed along with posts
+// and heads so the signatures can't be passed off as anything else.
+const (
+	channelPostContext = "peep-chat channel post:"
+	channelHeadContext = "peep-chat channel head:"
+)
+
+// A channel is a one-to-many feed: one publisher signs a sequence of posts,
+// each a DAG-JSON block linking to the one before, and anyone can follow
+// it. Posts are announced over pubsub; the head pointer in the DHT lets
+// followers that were away catch up by walking the links back.
+
+// ChannelID names a channel: "<publisher peer ID>/<name>".
+func ChannelID(publisher peer.ID, name string) string {
+	return publisher.String() + "/" + name
+}
+
+// ParseChannelID splits a channel ID into its publisher and name.
+func ParseChannelID(id string) (peer.ID, string, error) {
+	pub, name, ok := strings.Cut(id, "/")
+	if !ok || !validChannelName(name) {
+		return "", "", fmt.Errorf("bad channel %q: want <publisher>/<name>", truncate(id, 100))
+	}
+	p, err := peer.Decode(pub)
+	if err != nil {
+		return "", "", fmt.Errorf("bad channel publisher: %w", err)
+	}
+	return p, name, nil
+}
+
+func validChannelName(s string) bool {
+	return s != "" && len(s) <= MaxRoomName && !strings.ContainsAny(s, " /#") && checkText(s, "") == nil
+}
+
+// ChannelPost is one post of a channel.
+type ChannelPost struct {
+	Channel string    `json:"channel"`
+	Seq     uint64    `json:"seq"`            // 1 for the first post
+	Prev    string    `json:"prev,omitempty"` // CID of post Seq-1
+	When    int64     `json:"when"`           // unix ms
+	Body    string    `json:"body"`
+	Files   []FileRef `json:"files,omitempty"`
+	Sig     []byte    `json:"sig"`
+}
+
+func (p ChannelPost) signedBytes() []byte {
+	p.Sig = nil
+	b, _ := json.Marshal(p)
+	return append([]byte(channelPostContext), b...)
+}
+
+// Verify checks that p is well formed and signed by its channel's
+// publisher.
+func (p ChannelPost) Verify() error {
+	pub, _, err := ParseChannelID(p.Channel)
+	if err != nil {
+		return fmt.Errorf("channel post: %w", err)
+	}
+	if p.Seq == 0 || (p.Seq == 1) != (p.Prev == "") {
+		return errors.New("channel post: bad sequence")
+	}
+	if p.Prev != "" {
+		if c, err := cid.Decode(p.Prev); err != nil || c.Type() != cid.DagJSON {
+			return errors.New("channel post: bad link")
+		}
+	}
+	if len(p.Body) > MaxBodySize {
+		return errors.New("channel post: body too long")
+	}
+	if err := checkText(p.Body, "\n\t"); err != nil {
+		return fmt.Errorf("channel post: body %s", err)
+	}
+	if err := validateFiles(p.Files); err != nil {
+		return fmt.Errorf("channel post: %w", err)
+	}
+	if err := verifyBy(pub, p.signedBytes(), p.Sig); err != nil {
+		return fmt.Errorf("channel post: %w", err)
+	}
+	return nil
+}
+
+// verifyBy checks sig over data against the key id embeds.
+func verifyBy(id peer.ID, data, sig []byte) error {
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(data, sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// DecodeChannelPost parses and verifies a post.
+func DecodeChannelPost(b []byte) (ChannelPost, error) {
+	if len(b) > MaxMessageSize {
+		return ChannelPost{}, errors.New("channel post: too large")
+	}
+	var p ChannelPost
+	if err := json.Unmarshal(b, &p); err != nil {
+		return ChannelPost{}, fmt.Errorf("channel post: %w", err)
+	}
+	return p, p.Verify()
+}
+
+// NewChannelPost signs post seq of our channel name, linking to prev, the
+// CID of post seq-1 (cid.Undef for the first).
+func (n *Node) NewChannelPost(name string, seq uint64, prev cid.Cid, body string, files []FileRef) (ChannelPost, error) {
+	if !validChannelName(name) {
+		return ChannelPost{}, fmt.Errorf("bad channel name %q", truncate(name, 64))
+	}
+	p := ChannelPost{Channel: ChannelID(n.host.ID(), name), Seq: seq, When: time.Now().UnixMilli(), Body: body, Files: files}
+	if prev.Defined() {
+		p.Prev = prev.String()
+	}
+	var err error
+	if p.Sig, err = n.host.Peerstore().PrivKey(n.host.ID()).Sign(p.signedBytes()); err != nil {
+		return ChannelPost{}, err
+	}
+	return p, p.Verify()
+}
+
+// PutChannelPost stores p as a block and returns its CID.
+func (bs *Blockstore) PutChannelPost(p ChannelPost) (cid.Cid, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return bs.Put(cid.DagJSON, b)
+}
+
+// ChannelPost reads and verifies the post block c.
+func (bs *Blockstore) ChannelPost(c cid.Cid) (ChannelPost, error) {
+	b, err := bs.Get(c)
+	if err != nil {
+		return ChannelPost{}, err
+	}
+	return DecodeChannelPost(b)
+}
+
+// ChannelHead points at a channel's latest post, signed by its publisher.
+type ChannelHead struct {
+	Channel string `json:"channel"`
+	Seq     uint64 `json:"seq"`
+	Head    string `json:"head"`    // CID of post Seq
+	Expires int64  `json:"expires"` // unix ms
+	Sig     []byte `json:"sig"`
+}
+
+func (h ChannelHead) signedBytes() []byte {
+	h.Sig = nil
+	b, _ := json.Marshal(h)
+	return append([]byte(channelHeadContext), b...)
+}
+
+// Verify checks that h is signed by the channel's publisher and hasn't
+// expired.
+func (h ChannelHead) Verify() error {
+	pub, _, err := ParseChannelID(h.Channel)
+	if err != nil {
+		return fmt.Errorf("channel head: %w", err)
+	}
+	if c, err := cid.Decode(h.Head); err != nil || c.Type() != cid.DagJSON || h.Seq == 0 {
+		return errors.New("channel head: bad head")
+	}
+	if err := verifyBy(pub, h.signedBytes(), h.Sig); err != nil {
+		return fmt.Errorf("channel head: %w", err)
+	}
+	if time.Now().UnixMilli() > h.Expires {
+		return errors.New("channel head: expired")
+	}
+	return nil
+}
+
+// DecodeChannelHead parses and verifies a head pointer.
+func DecodeChannelHead(b []byte) (ChannelHead, error) {
+	var h ChannelHead
+	if err := json.Unmarshal(b, &h); err != nil {
+		return ChannelHead{}, fmt.Errorf("channel head: %w", err)
+	}
+	return h, h.Verify()
+}
+
+// PublishChannelHead signs a pointer to post seq, head, of our channel
+// name and stores it in the DHT.
+func (n *Node) PublishChannelHead(ctx context.Context, name string, seq uint64, head cid.Cid) (err error) {
+	ctx, span := tracer.Start(ctx, "node.PublishChannelHead", trace.WithAttributes(attribute.String("channel.name", name)))
+	defer func() { endSpan(span, err) }()
+	h := ChannelHead{Channel: ChannelID(n.host.ID(), name), Seq: seq, Head: head.String(), Expires: time.Now().Add(ChannelHeadTTL).UnixMilli()}
+	if h.Sig, err = n.host.Peerstore().PrivKey(n.host.ID()).Sign(h.signedBytes()); err != nil {
+		return err
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return n.putRecord(ctx, DHTChannelPrefix+h.Channel, b)
+}
+
+// ResolveChannelHead looks up a channel's head pointer.
+func (n *Node) ResolveChannelHead(ctx context.Context, channel string) (ChannelHead, error) {
+	val, err := n.getRecord(ctx, DHTChannelPrefix+channel)
+	if err != nil {
+		return ChannelHead{}, err
+	}
+	h, err := DecodeChannelHead(val)
+	if err == nil && h.Channel != channel {
+		err = errors.New("channel head: stored under the wrong channel")
+	}
+	return h, err
+}
+
+// FetchChannelPosts walks channel posts back from head, fetching each
+// from peers, until it reaches post stop (exclusive) or the first, and
+// returns them oldest first. At most limit posts are fetched.
+func (n *Node) FetchChannelPosts(ctx context.Context, peers []peer.ID, channel string, head cid.Cid, stop uint64, limit int) ([]ChannelPost, error) {
+	n.mu.RLock()
+	bs := n.blocks
+	n.mu.RUnlock()
+	if bs == nil {
+		return nil, errors.New("no blockstore")
+	}
+	var posts []ChannelPost
+	for c := head; len(posts) < limit; {
+		if !bs.Has(c) {
+			if err := n.FetchBlocks(ctx, peers, []cid.Cid{c}); err != nil {
+				return reversed(posts), err
+			}
+		}
+		p, err := bs.ChannelPost(c)
+		if err != nil {
+			return reversed(posts), err
+		}
+		if p.Channel != channel {
+			return reversed(posts), errors.New("channel post links to another channel")
+		}
+		if p.Seq <= stop {
+			break
+		}
+		posts = append(posts, p)
+		if p.Prev == "" {
+			break
+		}
+		if c, err = cid.Decode(p.Prev); err != nil {
+			return reversed(posts), err
+		}
+	}
+	return reversed(posts), nil
+}
+
+func reversed(posts []ChannelPost) []ChannelPost {
+	for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+		posts[i], posts[j] = posts[j], posts[i]
+	}
+	return posts
+}
@@ -0,0 +1,132 @@
+package node
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ChatLogFile, next to the identity file, keeps the recent messages of
+// every conversation, sent and received, so the console client and GUI
+// both show them again after a restart.
+const ChatLogFile = "p2pchat_chatlog.jsonl"
+
+// ChatLogPerConversation caps the messages kept per conversation.
+const ChatLogPerConversation = 1000
+
+// ChatLogPath returns the chat log file that goes with identityPath.
+func ChatLogPath(identityPath string) string {
+	return filepath.Join(filepath.Dir(identityPath), ChatLogFile)
+}
+
+// ChatEntry is one message in the chat log and the conversation it
+// belongs to: a peer ID, or # and a room name.
+type ChatEntry struct {
+	Conversation string  `json:"conversation"`
+	Message      Message `json:"message"`
+}
+
+// ChatLog appends messages to a chat log file.
+type ChatLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+// OpenChatLog reads the chat log at path, oldest first, trimming each
+// conversation to ChatLogPerConversation, and opens it for appending.
+// Lines that don't decode are skipped.
+func OpenChatLog(path string) (*ChatLog, []ChatEntry, error) {
+	l := &ChatLog{path: path}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var all []ChatEntry
+	count := make(map[string]int)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64<<10), 2*MaxMessageSize)
+	for sc.Scan() {
+		var e ChatEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil || e.Conversation == "" {
+			log.Debugf("skipping chat log line: %v", err)
+			continue
+		}
+		if err := ValidateMessage(e.Message, time.Now()); err != nil {
+			log.Debugf("skipping chat log line: %s", err)
+			continue
+		}
+		all = append(all, e)
+		count[e.Conversation]++
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+	kept := all[:0]
+	for _, e := range all {
+		if count[e.Conversation] > ChatLogPerConversation {
+			count[e.Conversation]--
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if len(kept) < len(all) {
+		if err := l.rewrite(kept); err != nil {
+			return nil, nil, err
+		}
+	}
+	return l, kept, nil
+}
+
+// rewrite replaces the log with entries.
+func (l *ChatLog) rewrite(entries []ChatEntry) error {
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// Append adds m to conversation.
+func (l *ChatLog) Append(conversation string, m Message) error {
+	b, err := json.Marshal(ChatEntry{Conversation: conversation, Message: m})
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
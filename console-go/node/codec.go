@@ -0,0 +1,168 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Limits enforced on every message decoded from the network. Anything
+// larger or stranger is rejected before it reaches callbacks or the
+// terminal.
+const (
+	// MaxMessageSize caps one encoded message (a stream line).
+	MaxMessageSize = 96 << 10
+	// MaxBodySize caps the body in bytes.
+	MaxBodySize = 64 << 10
+	// MaxRoomName caps a room name.
+	MaxRoomName = 64
+	// MaxInboxSize caps a stored inbox (DHT value or mailbox response).
+	MaxInboxSize = 4 << 20
+	// maxClockSkew is how far in the future a timestamp may be.
+	maxClockSkew = 5 * time.Minute
+)
+
+// epoch is the earliest acceptable timestamp; peep-chat didn't exist
+// before it, so anything older is garbage.
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ErrInvalidMessage wraps every decoding and validation failure.
+var ErrInvalidMessage = errors.New("invalid message")
+
+// ErrUndecodable wraps the failures of input that isn't a message at all:
+// too large, not JSON, the wrong JSON types or trailing data. The rest of
+// ErrInvalidMessage is fields out of limits, a clock off or a type this
+// version doesn't know, which honest peers run into.
+var ErrUndecodable = fmt.Errorf("%w: undecodable", ErrInvalidMessage)
+
+// DecodeMessage parses one wire message and validates it.
+func DecodeMessage(b []byte) (Message, error) {
+	if len(b) > MaxMessageSize {
+		return Message{}, fmt.Errorf("%w: %d bytes, limit %d", ErrUndecodable, len(b), MaxMessageSize)
+	}
+	var m Message
+	if err := unmarshalMessage(b, &m); err != nil {
+		return Message{}, err
+	}
+	return m, ValidateMessage(m, time.Now())
+}
+
+// DecodeInbox parses a stored list of messages. Invalid entries are
+// dropped rather than failing the whole inbox, so one bad deposit can't
+// hide the rest; the number dropped is returned.
+func DecodeInbox(b []byte) ([]Message, int, error) {
+	if len(b) > MaxInboxSize {
+		return nil, 0, fmt.Errorf("%w: inbox of %d bytes, limit %d", ErrInvalidMessage, len(b), MaxInboxSize)
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrInvalidMessage, err)
+	}
+	now := time.Now()
+	msgs := make([]Message, 0, len(raw))
+	dropped := 0
+	for _, r := range raw {
+		var m Message
+		if unmarshalMessage(r, &m) != nil || ValidateMessage(m, now) != nil {
+			dropped++
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, dropped, nil
+}
+
+// unmarshalMessage decodes one message. Fields it doesn't know are
+// ignored, so newer peers can add some without older ones dropping their
+// messages; trailing data is not.
+func unmarshalMessage(b []byte, m *Message) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(m); err != nil {
+		return fmt.Errorf("%w: %s", ErrUndecodable, err)
+	}
+	if dec.More() {
+		return fmt.Errorf("%w: trailing data", ErrUndecodable)
+	}
+	return nil
+}
+
+// ValidateMessage checks field limits, encodings and the timestamp
+// against now.
+func ValidateMessage(m Message, now time.Time) error {
+	if _, err := peer.Decode(m.From); err != nil {
+		return fmt.Errorf("%w: bad sender %q", ErrInvalidMessage, truncate(m.From, 64))
+	}
+	when := time.UnixMilli(m.When)
+	if when.Before(epoch) || when.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("%w: timestamp %d out of range", ErrInvalidMessage, m.When)
+	}
+	if m.Expires != 0 && m.Expires < m.When {
+		return fmt.Errorf("%w: expires before it was sent", ErrInvalidMessage)
+	}
+	if len(m.Body) > MaxBodySize {
+		return fmt.Errorf("%w: body of %d bytes, limit %d", ErrInvalidMessage, len(m.Body), MaxBodySize)
+	}
+	if err := checkText(m.Body, "\n\t"); err != nil {
+		return fmt.Errorf("%w: body %s", ErrInvalidMessage, err)
+	}
+	if m.Room != "" {
+		if len(m.Room) > MaxRoomName || strings.ContainsAny(m.Room, " /#") {
+			return fmt.Errorf("%w: bad room name", ErrInvalidMessage)
+		}
+		if err := checkText(m.Room, ""); err != nil {
+			return fmt.Errorf("%w: room %s", ErrInvalidMessage, err)
+		}
+	}
+	if err := validateFiles(m.Files); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, err)
+	}
+	if err := validatePart(m.Part); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, err)
+	}
+	if err := validateSticker(m.Sticker); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, err)
+	}
+	if err := validateLocation(m.Location, m.When); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, err)
+	}
+	if err := validateCard(m.Card, m.From); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, err)
+	}
+	if err := validateCipher(m); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, err)
+	}
+	if err := validateType(m); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, err)
+	}
+	return nil
+}
+
+// checkText rejects invalid UTF-8 and control characters other than those
+// in allowed. Control characters include ESC, so a peer can't send
+// terminal escape sequences; bidi overrides and line separators are
+// refused too since they can disguise what a line says.
+func checkText(s, allowed string) error {
+	if !utf8.ValidString(s) {
+		return errors.New("is not valid UTF-8")
+	}
+	for _, r := range s {
+		if (unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) || r == '\u2028' || r == '\u2029') && !strings.ContainsRune(allowed, r) {
+			return fmt.Errorf("contains control character %U", r)
+		}
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
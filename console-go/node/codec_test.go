@@ -0,0 +1,162 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const testPeer = "12D3KooWGRUVh5kbu2Ywm3gMGHx6KoSJ3H2hRxaSmxKWP1QzxXzd"
+
+func messageJSON(extra string) []byte {
+	return []byte(fmt.Sprintf(`{"from":%q,"when":%d,"body":"hello"%s}`, testPeer, time.Now().UnixMilli(), extra))
+}
+
+func TestDecodeMessageUnknownFields(t *testing.T) {
+	m, err := DecodeMessage(messageJSON(`,"reactions":{"👍":2},"future":true`))
+	if err != nil {
+		t.Fatalf("message with unknown fields: %v", err)
+	}
+	if m.From != testPeer || m.Body != "hello" {
+		t.Fatalf("decoded %+v", m)
+	}
+}
+
+func TestDecodeMessageRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		b           []byte
+		undecodable bool
+	}{
+		{"not json", []byte("hello"), true},
+		{"wrong type", []byte(`{"from":1}`), true},
+		{"trailing data", append(messageJSON(""), `{}`...), true},
+		{"too large", messageJSON(`,"pad":"` + strings.Repeat("x", MaxMessageSize) + `"`), true},
+		{"bad sender", []byte(`{"from":"nobody","when":1735689600000,"body":"x"}`), false},
+		{"before epoch", []byte(fmt.Sprintf(`{"from":%q,"when":1000,"body":"x"}`, testPeer)), false},
+		{"from the future", []byte(fmt.Sprintf(`{"from":%q,"when":%d,"body":"x"}`, testPeer, time.Now().Add(time.Hour).UnixMilli())), false},
+		{"escape", messageJSON(`,"room":"a\u001b[2Jb"`), false},
+	} {
+		_, err := DecodeMessage(tc.b)
+		if !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%s: got %v, want ErrInvalidMessage", tc.name, err)
+		}
+		if errors.Is(err, ErrUndecodable) != tc.undecodable {
+			t.Errorf("%s: got %v, undecodable should be %v", tc.name, err, tc.undecodable)
+		}
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add(messageJSON(""))
+	f.Add(messageJSON(`,"room":"lobby","type":"x","payload":{"a":[1,2]}`))
+	f.Add(messageJSON(`,"unknown":1`))
+	f.Add([]byte(`{"from":"","when":0}`))
+	f.Add([]byte(`[]`))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := DecodeMessage(b)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidMessage) {
+				t.Fatalf("error %v doesn't wrap ErrInvalidMessage", err)
+			}
+			return
+		}
+		if err := ValidateMessage(m, time.Now()); err != nil {
+			t.Fatalf("decoded message doesn't validate: %v", err)
+		}
+		out, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := DecodeMessage(out)
+		if err != nil {
+			t.Fatalf("re-encoded message doesn't decode: %v\n%s", err, out)
+		}
+		if out2, _ := json.Marshal(again); !bytes.Equal(out, out2) {
+			t.Fatalf("round trip changed the message:\n%s\n%s", out, out2)
+		}
+	})
+}
+
+func FuzzDecodeInbox(f *testing.F) {
+	f.Add([]byte("[" + string(messageJSON("")) + "]"))
+	f.Add([]byte("[" + string(messageJSON("")) + `,{"from":"x"},` + string(messageJSON(`,"extra":1`)) + "]"))
+	f.Add([]byte(`[1,"a",null]`))
+	f.Add([]byte(`{}`))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msgs, dropped, err := DecodeInbox(b)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidMessage) {
+				t.Fatalf("error %v doesn't wrap ErrInvalidMessage", err)
+			}
+			return
+		}
+		var raw []json.RawMessage
+		if json.Unmarshal(b, &raw) == nil && len(msgs)+dropped != len(raw) {
+			t.Fatalf("%d kept + %d dropped of %d entries", len(msgs), dropped, len(raw))
+		}
+		for _, m := range msgs {
+			if err := ValidateMessage(m, time.Now()); err != nil {
+				t.Fatalf("kept message doesn't validate: %v", err)
+			}
+		}
+	})
+}
+
+func TestMailboxFrame(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	m := Message{From: from.String(), When: now.UnixMilli(), Body: "stored", Expires: now.Add(time.Hour).UnixMilli()}
+	ds, err := signDeposit(priv, testPeer, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	sent := mailboxResponse{Messages: []Message{m}, Signatures: []*DepositSignature{ds}, IDs: []string{"1"}, More: true}
+	if err := writeFrame(&buf, sent); err != nil {
+		t.Fatal(err)
+	}
+	var got mailboxResponse
+	if err := readFrame(&buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Messages) != 1 || len(got.Signatures) != 1 || !got.More || got.IDs[0] != "1" {
+		t.Fatalf("got %+v", got)
+	}
+	if err := verifyDeposit(testPeer, got.Messages[0], got.Signatures[0]); err != nil {
+		t.Fatalf("signature after the round trip: %v", err)
+	}
+	if err := verifyDeposit(from.String(), got.Messages[0], got.Signatures[0]); err == nil {
+		t.Fatal("signature verified for the wrong recipient")
+	}
+	altered := got.Messages[0]
+	altered.Body = "altered"
+	if err := verifyDeposit(testPeer, altered, got.Signatures[0]); err == nil {
+		t.Fatal("signature verified for an altered message")
+	}
+
+	// A frame must end in a newline within maxMailboxFrame.
+	big := `{"op":"deposit","to":"` + strings.Repeat("x", maxMailboxFrame) + "\"}\n"
+	if err := readFrame(strings.NewReader(big), &mailboxRequest{}); err == nil {
+		t.Fatal("read a frame over maxMailboxFrame")
+	}
+	if err := readFrame(strings.NewReader(`{"op":"challenge"}`), &mailboxRequest{}); err == nil {
+		t.Fatal("read a frame without its newline")
+	}
+}
@@ -0,0 +1,193 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrNotFound is returned when no router knows the peer or content.
+var ErrNotFound = errors.New("routing: not found")
+
+// maxRoutingResponse caps one delegated routing response.
+const maxRoutingResponse = 4 << 20
+
+// DelegatedRouter resolves peers and providers through Delegated Routing
+// V1 HTTP endpoints (GET /routing/v1/peers/{id} and /providers/{cid}), so
+// a lightweight node can find others without walking the DHT itself.
+// Endpoints are asked in order until one answers.
+type DelegatedRouter struct {
+	endpoints []string
+	client    *http.Client
+}
+
+// NewDelegatedRouter returns a router for the given base URLs, e.g.
+// https://delegated-ipfs.dev.
+func NewDelegatedRouter(endpoints []string) *DelegatedRouter {
+	r := &DelegatedRouter{client: &http.Client{Timeout: 30 * time.Second}}
+	for _, e := range endpoints {
+		r.endpoints = append(r.endpoints, strings.TrimRight(e, "/"))
+	}
+	return r
+}
+
+// routingRecord is a "peer" schema record of the API.
+type routingRecord struct {
+	Schema string   `json:"Schema"`
+	ID     string   `json:"ID"`
+	Addrs  []string `json:"Addrs"`
+}
+
+func (rec routingRecord) addrInfo() (peer.AddrInfo, error) {
+	id, err := peer.Decode(rec.ID)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	pi := peer.AddrInfo{ID: id}
+	for _, s := range rec.Addrs {
+		if addr, err := ma.NewMultiaddr(s); err == nil {
+			pi.Addrs = append(pi.Addrs, addr)
+		}
+	}
+	return pi, nil
+}
+
+// FindPeer returns the addresses routers know for id.
+func (r *DelegatedRouter) FindPeer(ctx context.Context, id peer.ID) (peer.AddrInfo, error) {
+	var resp struct {
+		Peers []routingRecord `json:"Peers"`
+	}
+	if err := r.get(ctx, "/routing/v1/peers/"+id.String(), &resp); err != nil {
+		return peer.AddrInfo{}, err
+	}
+	found := peer.AddrInfo{ID: id}
+	for _, rec := range resp.Peers {
+		if pi, err := rec.addrInfo(); err == nil && pi.ID == id {
+			found.Addrs = append(found.Addrs, pi.Addrs...)
+		}
+	}
+	if len(found.Addrs) == 0 {
+		return peer.AddrInfo{}, ErrNotFound
+	}
+	return found, nil
+}
+
+// FindProviders returns up to limit peers providing c.
+func (r *DelegatedRouter) FindProviders(ctx context.Context, c cid.Cid, limit int) ([]peer.AddrInfo, error) {
+	var resp struct {
+		Providers []routingRecord `json:"Providers"`
+	}
+	if err := r.get(ctx, "/routing/v1/providers/"+c.String(), &resp); err != nil {
+		return nil, err
+	}
+	var out []peer.AddrInfo
+	for _, rec := range resp.Providers {
+		if rec.Schema != "peer" {
+			continue
+		}
+		if pi, err := rec.addrInfo(); err == nil {
+			out = append(out, pi)
+		}
+		if len(out) == limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+// get asks each endpoint in turn; a 404 from all of them is ErrNotFound.
+func (r *DelegatedRouter) get(ctx context.Context, path string, v any) error {
+	if len(r.endpoints) == 0 {
+		return errors.New("routing: no delegated routing endpoints")
+	}
+	errs := make([]error, 0, len(r.endpoints))
+	notFound := 0
+	for _, e := range r.endpoints {
+		err := r.getFrom(ctx, e+path, v)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrNotFound) {
+			notFound++
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", e, err))
+	}
+	if notFound == len(r.endpoints) {
+		return ErrNotFound
+	}
+	return errors.Join(errs...)
+}
+
+func (r *DelegatedRouter) getFrom(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxRoutingResponse)).Decode(v)
+}
+
+// FindPeer looks up the addresses of id: first the peerstore, then the
+// delegated routers if configured, then the DHT.
+func (n *Node) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo, err error) {
+	if addrs := n.host.Peerstore().Addrs(id); len(addrs) > 0 {
+		return peer.AddrInfo{ID: id, Addrs: addrs}, nil
+	}
+	ctx, span := tracer.Start(ctx, "node.FindPeer", trace.WithAttributes(attribute.String("peer.id", id.String())))
+	defer func() { endSpan(span, err) }()
+	if n.delegated != nil {
+		pi, derr := n.delegated.FindPeer(ctx, id)
+		if derr == nil {
+			return pi, nil
+		}
+		log.Debugf("delegated routing for %s: %s", id, derr)
+		err = derr
+	}
+	pi, dhtErr := n.dht.FindPeer(ctx, id)
+	if dhtErr != nil {
+		if err != nil {
+			return peer.AddrInfo{}, fmt.Errorf("%w; DHT: %s", err, dhtErr)
+		}
+		return peer.AddrInfo{}, dhtErr
+	}
+	return pi, nil
+}
+
+// FindProviders returns up to limit providers of c, from the delegated
+// routers if configured and otherwise the DHT.
+func (n *Node) FindProviders(ctx context.Context, c cid.Cid, limit int) ([]peer.AddrInfo, error) {
+	if n.delegated != nil {
+		if pis, err := n.delegated.FindProviders(ctx, c, limit); err == nil && len(pis) > 0 {
+			return pis, nil
+		} else if err != nil {
+			log.Debugf("delegated providers of %s: %s", c, err)
+		}
+	}
+	pis, err := n.dht.FindProviders(ctx, c)
+	if len(pis) > limit {
+		pis = pis[:limit]
+	}
+	return pis, err
+}
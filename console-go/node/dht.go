@@ -0,0 +1,115 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
+	dhtpb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	record "github.com/libp2p/go-libp2p-record"
+	host "github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	protocol "github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-msgio"
+)
+
+// maxDHTMessage caps DHT responses read by kadSender, like kad-dht does.
+const maxDHTMessage = 4 << 20
+
+// DHTProtocolPrefix keeps our DHT apart from the public IPFS one, which
+// only takes /pk and /ipns records; ours also validates the "p2pchat"
+// namespace (see RecordValidator).
+const DHTProtocolPrefix = "/p2pchat"
+
+// DHTProtocol is the wire protocol of our DHT.
+const DHTProtocol = protocol.ID(DHTProtocolPrefix + "/kad/1.0.0")
+
+// DHTOptions are the options every peep-chat DHT, relays included, needs
+// to talk to the others.
+func DHTOptions() []kaddht.Option {
+	return []kaddht.Option{
+		kaddht.ProtocolPrefix(DHTProtocolPrefix),
+		kaddht.NamespacedValidator("p2pchat", RecordValidator{}),
+	}
+}
+
+// PutResult is one peer's answer to a PutValue.
+type PutResult struct {
+	Peer peer.ID
+	Err  error
+}
+
+// PutValueVerbose stores val under key on the closest peers to key, like
+// the DHT's PutValue, but reports each peer's answer instead of only
+// whether the lookup worked. A peer that rejects the record (e.g. no
+// validator for its namespace) shows up with an error.
+func (n *Node) PutValueVerbose(ctx context.Context, key string, val []byte) ([]PutResult, error) {
+	if err := n.pace.dhtWrite(ctx); err != nil {
+		return nil, err
+	}
+	peers, err := n.dht.GetClosestPeers(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	pm, err := dhtpb.NewProtocolMessenger(kadSender{n.host})
+	if err != nil {
+		return nil, err
+	}
+	rec := record.MakePutRecord(key, val)
+	rec.TimeReceived = time.Now().Format(time.RFC3339Nano)
+	results := make([]PutResult, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p peer.ID) {
+			defer wg.Done()
+			results[i] = PutResult{Peer: p, Err: pm.PutValue(ctx, p, rec)}
+		}(i, p)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// kadSender speaks the DHT wire protocol on one-shot streams; it lets us
+// see per-peer results that IpfsDHT keeps to itself.
+type kadSender struct{ h host.Host }
+
+func (s kadSender) SendRequest(ctx context.Context, p peer.ID, pmes *dhtpb.Message) (*dhtpb.Message, error) {
+	st, err := s.h.NewStream(ctx, p, DHTProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = st.SetDeadline(dl)
+	}
+	b, err := pmes.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if err := msgio.NewVarintWriter(st).WriteMsg(b); err != nil {
+		st.Reset()
+		return nil, err
+	}
+	resp, err := msgio.NewVarintReaderSize(st, maxDHTMessage).ReadMsg()
+	if err != nil {
+		st.Reset()
+		return nil, err
+	}
+	out := new(dhtpb.Message)
+	return out, out.Unmarshal(resp)
+}
+
+func (s kadSender) SendMessage(ctx context.Context, p peer.ID, pmes *dhtpb.Message) error {
+	st, err := s.h.NewStream(ctx, p, DHTProtocol)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	b, err := pmes.Marshal()
+	if err != nil {
+		return err
+	}
+	return msgio.NewVarintWriter(st).WriteMsg(b)
+}
@@ -0,0 +1,184 @@
+package node
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	peerstore "github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Dialing tunes how the host dials a peer's addresses. libp2p's ranking
+// already tries QUIC before TCP and direct addresses before relays; on
+// top of that the address that last worked goes first and ones that keep
+// failing go last.
+type Dialing struct {
+	// Timeout bounds dialing one peer, all its addresses together; 0
+	// keeps libp2p's default.
+	Timeout time.Duration
+	// RelayDelay is how long relayed addresses wait behind direct ones;
+	// 0 keeps libp2p's default (half a second, and only behind public
+	// addresses).
+	RelayDelay time.Duration
+	// Parallel dials every address at once instead of staggering them.
+	Parallel bool
+}
+
+// addrHistoryKey is the peerstore key under which a peer's AddrHistory is
+// kept, so it travels with the peer's other metadata.
+const addrHistoryKey = "p2pchat/addr-history"
+
+// failedDelay is how much later an address whose last dial failed is
+// tried, after the others had their chance; preferredLead is the head
+// start the address that last connected gets over the rest.
+const (
+	failedDelay   = time.Second
+	preferredLead = 250 * time.Millisecond
+)
+
+// AddrHistory is how dials to one address have gone.
+type AddrHistory struct {
+	Successes int       `json:"successes"`
+	Failures  int       `json:"failures"`
+	Last      time.Time `json:"last"`
+	LastOK    bool      `json:"last_ok"`
+}
+
+// dialHistory records dial outcomes by address for the ranker, which
+// isn't told whose addresses it ranks.
+type dialHistory struct {
+	opts Dialing
+	ps   peerstore.Peerstore
+
+	mu    sync.Mutex
+	addrs map[string]AddrHistory
+}
+
+func newDialHistory(opts Dialing) *dialHistory {
+	return &dialHistory{opts: opts, addrs: make(map[string]AddrHistory)}
+}
+
+// swarmOptions installs the ranker and dial timeout.
+func (d *dialHistory) swarmOptions() []swarm.Option {
+	opts := []swarm.Option{swarm.WithDialRanker(d.rank)}
+	if d.opts.Timeout > 0 {
+		opts = append(opts, swarm.WithDialTimeout(d.opts.Timeout))
+	}
+	return opts
+}
+
+// rank orders addrs for dialing: libp2p's ranking (or none, with
+// Parallel), then the address that last connected at once and those whose
+// last dial failed after the rest.
+func (d *dialHistory) rank(addrs []ma.Multiaddr) []network.AddrDelay {
+	var ranked []network.AddrDelay
+	if d.opts.Parallel {
+		ranked = swarm.NoDelayDialRanker(addrs)
+	} else {
+		ranked = swarm.DefaultDialRanker(addrs)
+	}
+	direct := false
+	for _, a := range addrs {
+		if !isRelayed(a) {
+			direct = true
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	preferred := false
+	for _, a := range addrs {
+		if d.addrs[a.String()].LastOK {
+			preferred = true
+		}
+	}
+	for i := range ranked {
+		if direct && isRelayed(ranked[i].Addr) && d.opts.RelayDelay > 0 {
+			ranked[i].Delay = max(ranked[i].Delay, d.opts.RelayDelay)
+		}
+		h := d.addrs[ranked[i].Addr.String()]
+		switch {
+		case h.LastOK:
+			ranked[i].Delay = 0
+		case h.Failures > 0:
+			ranked[i].Delay += failedDelay
+		case preferred:
+			ranked[i].Delay = max(ranked[i].Delay, preferredLead)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Delay < ranked[j].Delay })
+	return ranked
+}
+
+func isRelayed(a ma.Multiaddr) bool {
+	_, err := a.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// record notes a dial to p at addr succeeding or failing.
+func (d *dialHistory) record(p peer.ID, addr ma.Multiaddr, ok bool) {
+	if addr == nil {
+		return
+	}
+	key := addr.String()
+	d.mu.Lock()
+	h := d.addrs[key]
+	if ok {
+		h.Successes++
+	} else {
+		h.Failures++
+	}
+	h.Last, h.LastOK = time.Now(), ok
+	d.addrs[key] = h
+	d.mu.Unlock()
+	if d.ps == nil {
+		return
+	}
+	byAddr := make(map[string]AddrHistory)
+	if v, err := d.ps.Get(p, addrHistoryKey); err == nil {
+		if old, ok := v.(map[string]AddrHistory); ok {
+			for k, v := range old {
+				byAddr[k] = v
+			}
+		}
+	}
+	byAddr[key] = h
+	_ = d.ps.Put(p, addrHistoryKey, byAddr)
+}
+
+// noteDialError records the per-address failures in err, if it's a dial
+// error.
+func (d *dialHistory) noteDialError(err error) {
+	var de *swarm.DialError
+	if !errors.As(err, &de) {
+		return
+	}
+	for _, te := range de.DialErrors {
+		d.record(de.Peer, te.Address, false)
+	}
+}
+
+// watch records each outbound connection as a success for its address.
+func (d *dialHistory) watch(n network.Network) {
+	n.Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			if c.Stat().Direction == network.DirOutbound {
+				d.record(c.RemotePeer(), c.RemoteMultiaddr(), true)
+			}
+		},
+	})
+}
+
+// AddrHistory reports how dials to p's addresses have gone this session.
+func (n *Node) AddrHistory(p peer.ID) map[string]AddrHistory {
+	v, err := n.host.Peerstore().Get(p, addrHistoryKey)
+	if err != nil {
+		return nil
+	}
+	h, _ := v.(map[string]AddrHistory)
+	return h
+}
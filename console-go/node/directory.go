@@ -0,0 +1,180 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DHTDirectoryPrefix is where a peer publishes its directory listings:
+// /p2pchat/v2/dir/<peerID>.
+const DHTDirectoryPrefix = DHTNamespace + "dir/"
+
+// DirectoryCID is the well-known content ID peers with listings provide,
+// so browsers can find them; a DHT can't enumerate its keys.
+var DirectoryCID = func() cid.Cid {
+	sum, err := mh.Sum([]byte("peep-chat directory v1"), mh.SHA2_256, -1)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(cid.Raw, sum)
+}()
+
+// directoryContext is signed along with a record so the signature can't
+// be passed off as anything else.
+const directoryContext = "peep-chat directory:"
+
+// Directory limits: listings per peer and description length.
+const (
+	MaxListings          = 16
+	MaxListingDescLength = 280
+)
+
+// DirectoryTTL is how long a published record stays valid; publishers
+// republish well before.
+const DirectoryTTL = 48 * time.Hour
+
+// Listing advertises a room or channel in the public directory.
+type Listing struct {
+	Kind        string `json:"kind"` // "room" or "channel"
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Members     int    `json:"members"` // as the publisher last counted
+}
+
+// DirectoryRecord is all of one peer's listings, signed by that peer and
+// sequenced like an inbox pointer.
+type DirectoryRecord struct {
+	Peer     string    `json:"peer"`
+	Seq      uint64    `json:"seq"`
+	Listings []Listing `json:"listings"`
+	Expires  int64     `json:"expires"` // unix ms
+	Sig      []byte    `json:"sig"`
+}
+
+func (r DirectoryRecord) signedBytes() []byte {
+	r.Sig = nil
+	b, _ := json.Marshal(r)
+	return append([]byte(directoryContext), b...)
+}
+
+// Verify checks r's listings, that it's signed by the peer it names and
+// that it hasn't expired.
+func (r DirectoryRecord) Verify() error {
+	id, err := peer.Decode(r.Peer)
+	if err != nil {
+		return fmt.Errorf("directory: %w", err)
+	}
+	if len(r.Listings) > MaxListings {
+		return fmt.Errorf("directory: %d listings, limit %d", len(r.Listings), MaxListings)
+	}
+	for _, l := range r.Listings {
+		if l.Kind != "room" && l.Kind != "channel" {
+			return fmt.Errorf("directory: bad listing kind %q", truncate(l.Kind, 16))
+		}
+		if !validChannelName(l.Name) {
+			return fmt.Errorf("directory: bad listing name %q", truncate(l.Name, 64))
+		}
+		if len(l.Description) > MaxListingDescLength || checkText(l.Description, "") != nil {
+			return errors.New("directory: bad description")
+		}
+		if l.Members < 0 {
+			return errors.New("directory: bad member count")
+		}
+	}
+	if err := verifyBy(id, r.signedBytes(), r.Sig); err != nil {
+		return fmt.Errorf("directory: %w", err)
+	}
+	if time.Now().UnixMilli() > r.Expires {
+		return errors.New("directory: expired")
+	}
+	return nil
+}
+
+// DecodeDirectoryRecord parses and verifies a record.
+func DecodeDirectoryRecord(b []byte) (DirectoryRecord, error) {
+	var r DirectoryRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		return DirectoryRecord{}, fmt.Errorf("directory: %w", err)
+	}
+	return r, r.Verify()
+}
+
+// PublishDirectory signs our listings into the DHT and, if there are any,
+// provides DirectoryCID so browsers find them. Publishing none withdraws
+// what was listed.
+func (n *Node) PublishDirectory(ctx context.Context, listings []Listing) (err error) {
+	ctx, span := tracer.Start(ctx, "node.PublishDirectory", trace.WithAttributes(attribute.Int("listings", len(listings))))
+	defer func() { endSpan(span, err) }()
+	n.mu.Lock()
+	n.directorySeq = max(n.directorySeq+1, uint64(time.Now().UnixMilli()))
+	seq := n.directorySeq
+	n.mu.Unlock()
+	r := DirectoryRecord{Peer: n.host.ID().String(), Seq: seq, Listings: listings, Expires: time.Now().Add(DirectoryTTL).UnixMilli()}
+	if r.Sig, err = n.host.Peerstore().PrivKey(n.host.ID()).Sign(r.signedBytes()); err != nil {
+		return err
+	}
+	if err := r.Verify(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := n.putRecord(ctx, DHTDirectoryPrefix+r.Peer, b); err != nil {
+		return err
+	}
+	if len(listings) == 0 {
+		return nil
+	}
+	if err := n.pace.dhtWrite(ctx); err != nil {
+		return err
+	}
+	return n.dht.Provide(ctx, DirectoryCID, true)
+}
+
+// BrowseDirectory finds up to limit peers with listings and fetches their
+// records. Peers whose record can't be found or verified are left out.
+func (n *Node) BrowseDirectory(ctx context.Context, limit int) (_ []DirectoryRecord, err error) {
+	ctx, span := tracer.Start(ctx, "node.BrowseDirectory")
+	defer func() { endSpan(span, err) }()
+	pis, err := n.FindProviders(ctx, DirectoryCID, limit)
+	if err != nil && len(pis) == 0 {
+		return nil, err
+	}
+	var (
+		mu      sync.Mutex
+		records []DirectoryRecord
+		wg      sync.WaitGroup
+	)
+	for _, pi := range pis {
+		wg.Add(1)
+		go func(id peer.ID) {
+			defer wg.Done()
+			val, err := n.getRecord(ctx, DHTDirectoryPrefix+id.String())
+			if err != nil {
+				log.Debugf("directory of %s: %s", id, err)
+				return
+			}
+			r, err := DecodeDirectoryRecord(val)
+			if err != nil || r.Peer != id.String() {
+				log.Debugf("directory of %s: %v", id, err)
+				return
+			}
+			mu.Lock()
+			records = append(records, r)
+			mu.Unlock()
+		}(pi.ID)
+	}
+	wg.Wait()
+	return records, nil
+}
@@ -0,0 +1,167 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	mh "github.com/multiformats/go-multihash"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MailboxCID is the well-known content ID mailbox servers provide in the
+// DHT, so clients can find them without being told an address.
+var MailboxCID = func() cid.Cid {
+	sum, err := mh.Sum([]byte("peep-chat mailbox v1"), mh.SHA2_256, -1)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(cid.Raw, sum)
+}()
+
+// Provider records expire after 48 hours; mailboxes renew theirs well
+// before, and retry sooner while the routing table is still empty.
+const (
+	announceInterval = 12 * time.Hour
+	announceRetry    = time.Minute
+)
+
+// AnnounceMailbox provides MailboxCID through r until ctx is done.
+func AnnounceMailbox(ctx context.Context, r routing.ContentRouting) {
+	for {
+		wait := announceInterval
+		actx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		err := r.Provide(actx, MailboxCID, true)
+		cancel()
+		if err != nil {
+			log.Debugf("announcing mailbox: %s", err)
+			wait = announceRetry
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// FoundMailbox is a mailbox server found by DiscoverMailboxes.
+type FoundMailbox struct {
+	peer.AddrInfo
+	RTT time.Duration
+}
+
+// DiscoverMailboxes finds mailbox servers through the DHT (or delegated
+// routing), pings each, and returns the count nearest by round-trip time.
+// Servers that can't be reached are left out.
+func (n *Node) DiscoverMailboxes(ctx context.Context, count int) (_ []FoundMailbox, err error) {
+	ctx, span := tracer.Start(ctx, "node.DiscoverMailboxes", trace.WithAttributes(attribute.Int("count", count)))
+	defer func() { endSpan(span, err) }()
+	pis, err := n.FindProviders(ctx, MailboxCID, 20)
+	if err != nil && len(pis) == 0 {
+		return nil, err
+	}
+	var (
+		mu    sync.Mutex
+		found []FoundMailbox
+		wg    sync.WaitGroup
+	)
+	for _, pi := range pis {
+		if pi.ID == n.host.ID() {
+			continue
+		}
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			if err := n.host.Connect(pctx, pi); err != nil {
+				log.Debugf("mailbox %s: %s", pi.ID, err)
+				return
+			}
+			res := <-ping.Ping(pctx, n.host, pi.ID)
+			if res.Error != nil {
+				log.Debugf("mailbox %s: %s", pi.ID, res.Error)
+				return
+			}
+			if len(pi.Addrs) == 0 {
+				pi.Addrs = n.host.Peerstore().Addrs(pi.ID)
+			}
+			mu.Lock()
+			found = append(found, FoundMailbox{AddrInfo: pi, RTT: res.RTT})
+			mu.Unlock()
+		}(pi)
+	}
+	wg.Wait()
+	if len(found) == 0 {
+		return nil, errors.New("no reachable mailbox servers found")
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].RTT < found[j].RTT })
+	if len(found) > count {
+		found = found[:count]
+	}
+	return found, nil
+}
+
+// ProfileProtocolID answers with a peer's Profile: what others need to
+// reach it while it is away.
+const ProfileProtocolID = "/p2pchat/profile/1.0.0"
+
+// Profile is what a node tells peers about itself.
+type Profile struct {
+	// Mailboxes are /p2p multiaddrs of the mailbox servers holding the
+	// node's offline messages, nearest first.
+	Mailboxes []string `json:"mailboxes,omitempty"`
+	// PoW is the most proof of work, in bits, the node may ask of direct
+	// messages; senders stamp theirs to match.
+	PoW int `json:"pow,omitempty"`
+	// Features are the peep features the node supports; the node fills
+	// them in from Options.Features.
+	Features []Feature `json:"features,omitempty"`
+}
+
+// SetProfile sets the profile served to peers.
+func (n *Node) SetProfile(p Profile) {
+	n.mu.Lock()
+	n.profile = p
+	n.mu.Unlock()
+}
+
+func (n *Node) handleProfile(s network.Stream) {
+	defer s.Close()
+	n.mu.RLock()
+	p := n.profile
+	p.Features = n.features
+	n.mu.RUnlock()
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+	if err := writeFrame(s, p); err != nil {
+		log.Debugf("profile to %s: %s", s.Conn().RemotePeer(), err)
+	}
+}
+
+// FetchProfile asks p for its profile.
+func (n *Node) FetchProfile(ctx context.Context, p peer.ID) (_ Profile, err error) {
+	ctx, span := tracer.Start(ctx, "node.FetchProfile", trace.WithAttributes(attribute.String("peer.id", p.String())))
+	defer func() { endSpan(span, err) }()
+	s, err := n.host.NewStream(ctx, p, ProfileProtocolID)
+	if err != nil {
+		return Profile{}, err
+	}
+	defer s.Close()
+	defer bindStream(ctx, s)()
+	var prof Profile
+	if err := readFrame(s, &prof); err != nil {
+		return Profile{}, fmt.Errorf("profile: %w", err)
+	}
+	n.learnFeatures(p, prof.Features)
+	return prof, nil
+}
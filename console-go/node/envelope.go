@@ -0,0 +1,275 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+)
+
+// Message types. A message without a Type is typed by the fields it sets,
+// as messages were before types existed; see Kind.
+const (
+	TypeText     = "text"
+	TypeFile     = "file"
+	TypeLocation = "location"
+	TypeSticker  = "sticker"
+	TypeCard     = "card"
+	TypeReaction = "reaction"
+	TypeReceipt  = "receipt"
+	TypePoll     = "poll"
+)
+
+// MaxPayloadSize caps a message's typed payload.
+const MaxPayloadSize = 16 << 10
+
+// typeName is what a message type may be called: lowercase, with dots or
+// dashes for namespacing, e.g. "game.move".
+var typeName = regexp.MustCompile(`^[a-z][a-z0-9.-]{0,31}$`)
+
+var (
+	typesMu sync.RWMutex
+	types   = map[string]func(Message) error{}
+)
+
+// RegisterType makes messages of type name go through validate, which
+// checks the payload (and whatever fields the type uses) when a message is
+// decoded or sent. Types nobody registered are still accepted, with their
+// payload unchecked beyond its size, so a client can relay and show the
+// body of messages from newer ones.
+func RegisterType(name string, validate func(Message) error) {
+	if !typeName.MatchString(name) {
+		panic("node: bad message type name " + name)
+	}
+	typesMu.Lock()
+	defer typesMu.Unlock()
+	if _, dup := types[name]; dup {
+		panic("node: message type registered twice: " + name)
+	}
+	types[name] = validate
+}
+
+// KnownType reports whether a message type is registered.
+func KnownType(name string) bool {
+	typesMu.RLock()
+	defer typesMu.RUnlock()
+	_, ok := types[name]
+	return ok
+}
+
+// Kind is the message's type: Type if set, else the one its fields imply.
+func (m Message) Kind() string {
+	switch {
+	case m.Type != "":
+		return m.Type
+	case m.Cipher != nil:
+		return TypeEncrypted
+	case m.Sticker != nil:
+		return TypeSticker
+	case m.Location != nil:
+		return TypeLocation
+	case m.Card != nil:
+		return TypeCard
+	case len(m.Files) > 0:
+		return TypeFile
+	}
+	return TypeText
+}
+
+// ID names a message for reactions, receipts and votes to refer to: its
+// sender and send time.
+func (m Message) ID() string {
+	return fmt.Sprintf("%s/%d", m.From, m.When)
+}
+
+// DecodePayload unmarshals m's payload into v.
+func (m Message) DecodePayload(v any) error {
+	if len(m.Payload) == 0 {
+		return fmt.Errorf("%s message has no payload", m.Kind())
+	}
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return fmt.Errorf("%s payload: %w", m.Kind(), err)
+	}
+	return nil
+}
+
+// validateType checks m's type and, for a registered one, its payload.
+func validateType(m Message) error {
+	if len(m.Payload) > MaxPayloadSize {
+		return fmt.Errorf("payload of %d bytes, limit %d", len(m.Payload), MaxPayloadSize)
+	}
+	if m.Type == "" {
+		if len(m.Payload) != 0 {
+			return errors.New("payload without a type")
+		}
+		return nil
+	}
+	if !typeName.MatchString(m.Type) {
+		return fmt.Errorf("bad message type %q", truncate(m.Type, 32))
+	}
+	typesMu.RLock()
+	validate := types[m.Type]
+	typesMu.RUnlock()
+	if validate == nil {
+		return nil
+	}
+	if err := validate(m); err != nil {
+		return fmt.Errorf("%s message: %w", m.Type, err)
+	}
+	return nil
+}
+
+// Reaction is the payload of a reaction message: an emoji added to, or
+// with Remove taken off, the message Target names (see Message.ID).
+type Reaction struct {
+	Target string `json:"target"`
+	Emoji  string `json:"emoji"`
+	Remove bool   `json:"remove,omitempty"`
+}
+
+// Receipt is the payload of a receipt message: the messages Targets name
+// were delivered, or read.
+type Receipt struct {
+	Targets []string `json:"targets"`
+	Status  string   `json:"status"` // "delivered" or "read"
+}
+
+// MaxReceiptTargets is how many messages one receipt may name.
+const MaxReceiptTargets = 100
+
+// Poll is the payload of a poll message. The message that asks sets
+// Question and Options; a vote sets only ID and Choice, an index into the
+// options.
+type Poll struct {
+	ID       string   `json:"id"` // 16 hex digits, chosen by the asker
+	Question string   `json:"question,omitempty"`
+	Options  []string `json:"options,omitempty"`
+	Choice   *int     `json:"choice,omitempty"`
+}
+
+// MaxPollOptions bounds the options of a poll.
+const MaxPollOptions = 12
+
+func validTarget(s string) bool {
+	return s != "" && len(s) <= 128 && checkText(s, "") == nil
+}
+
+func init() {
+	RegisterType(TypeText, func(m Message) error {
+		if len(m.Payload) != 0 {
+			return errors.New("text messages have no payload")
+		}
+		return nil
+	})
+	RegisterType(TypeFile, func(m Message) error {
+		if len(m.Files) == 0 {
+			return errors.New("no files")
+		}
+		return nil
+	})
+	RegisterType(TypeLocation, func(m Message) error {
+		if m.Location == nil {
+			return errors.New("no location")
+		}
+		return nil
+	})
+	RegisterType(TypeSticker, func(m Message) error {
+		if m.Sticker == nil {
+			return errors.New("no sticker")
+		}
+		return nil
+	})
+	RegisterType(TypeCard, func(m Message) error {
+		if m.Card == nil {
+			return errors.New("no contact card")
+		}
+		return nil
+	})
+	RegisterType(TypeReaction, func(m Message) error {
+		var r Reaction
+		if err := m.DecodePayload(&r); err != nil {
+			return err
+		}
+		if !validTarget(r.Target) {
+			return errors.New("bad target")
+		}
+		if r.Emoji == "" || utf8.RuneCountInString(r.Emoji) > 8 || checkText(r.Emoji, "") != nil {
+			return errors.New("bad emoji")
+		}
+		return nil
+	})
+	RegisterType(TypeReceipt, func(m Message) error {
+		var r Receipt
+		if err := m.DecodePayload(&r); err != nil {
+			return err
+		}
+		if r.Status != "delivered" && r.Status != "read" {
+			return fmt.Errorf("bad status %q", truncate(r.Status, 16))
+		}
+		if len(r.Targets) == 0 || len(r.Targets) > MaxReceiptTargets {
+			return errors.New("receipt for no messages, or too many")
+		}
+		for _, t := range r.Targets {
+			if !validTarget(t) {
+				return errors.New("bad target")
+			}
+		}
+		return nil
+	})
+	RegisterType(TypePoll, func(m Message) error {
+		var p Poll
+		if err := m.DecodePayload(&p); err != nil {
+			return err
+		}
+		if len(p.ID) != 16 {
+			return errors.New("bad poll ID")
+		}
+		if p.Choice != nil {
+			if p.Question != "" || len(p.Options) != 0 {
+				return errors.New("a vote can't ask")
+			}
+			if *p.Choice < 0 || *p.Choice >= MaxPollOptions {
+				return errors.New("choice out of range")
+			}
+			return nil
+		}
+		if p.Question == "" || len(p.Question) > 500 || checkText(p.Question, "") != nil {
+			return errors.New("bad question")
+		}
+		if len(p.Options) < 2 || len(p.Options) > MaxPollOptions {
+			return fmt.Errorf("%d options, want 2 to %d", len(p.Options), MaxPollOptions)
+		}
+		for _, o := range p.Options {
+			if o == "" || len(o) > 200 || checkText(o, "") != nil {
+				return errors.New("bad option")
+			}
+		}
+		return nil
+	})
+}
+
+// SendTyped sends a message of type typ with payload, marshalled to JSON,
+// and body as the text clients that don't know the type show.
+func (n *Node) SendTyped(ctx context.Context, to, typ, body string, payload any) (Message, error) {
+	m, err := NewTyped(typ, body, payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return n.send(ctx, "node.SendTyped", to, m, true)
+}
+
+// NewTyped makes an unsent message of type typ, e.g. to post to a room.
+func NewTyped(typ, body string, payload any) (Message, error) {
+	m := Message{Type: typ, Body: body}
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return Message{}, err
+		}
+		m.Payload = b
+	}
+	return m, nil
+}
@@ -0,0 +1,116 @@
+package node
+
+import (
+	"slices"
+	"strings"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Feature is a peep feature a node supports. Nodes advertise theirs in
+// their identify agent version and profile, so senders can fall back for
+// peers that lack one.
+type Feature string
+
+const (
+	// FeatureChat is direct text messages; every node has it, so a node
+	// that advertises anything advertises at least this.
+	FeatureChat Feature = "chat"
+	// FeatureRooms is joining gossipsub rooms.
+	FeatureRooms Feature = "rooms"
+	// FeatureE2E is opening sealed messages and encrypted rooms.
+	FeatureE2E Feature = "e2e"
+	// FeatureFiles is fetching attachments as blocks.
+	FeatureFiles Feature = "files"
+	// FeatureReceipts is delivered and read receipts.
+	FeatureReceipts Feature = "receipts"
+)
+
+// AllFeatures is every feature, in the order they're shown.
+var AllFeatures = []Feature{FeatureChat, FeatureRooms, FeatureE2E, FeatureFiles, FeatureReceipts}
+
+// featuresKey is where the peerstore keeps the features a peer's profile
+// advertised.
+const featuresKey = "p2pchat.features"
+
+// agentFeatures introduces the features in an agent version.
+const agentFeatures = " (features: "
+
+// AgentVersion appends features to an identify agent version, e.g.
+// "peep-chat/v0.3.0 (features: chat,rooms,e2e,files,receipts)".
+func AgentVersion(agent string, fs []Feature) string {
+	names := make([]string, len(fs))
+	for i, f := range fs {
+		names[i] = string(f)
+	}
+	return agent + agentFeatures + strings.Join(names, ",") + ")"
+}
+
+// ParseAgentFeatures returns the features an agent version advertises;
+// ok is false if it advertises none, as with builds from before features
+// were advertised.
+func ParseAgentFeatures(agent string) (fs []Feature, ok bool) {
+	_, list, ok := strings.Cut(agent, agentFeatures)
+	if !ok || !strings.HasSuffix(list, ")") {
+		return nil, false
+	}
+	for _, name := range strings.Split(strings.TrimSuffix(list, ")"), ",") {
+		if name != "" {
+			fs = append(fs, Feature(name))
+		}
+	}
+	return fs, len(fs) > 0
+}
+
+// PeerFeatures are the features a peer advertised.
+type PeerFeatures struct {
+	// Known is false if the peer hasn't advertised any, in its agent
+	// version or its profile.
+	Known    bool      `json:"known"`
+	Features []Feature `json:"features,omitempty"`
+}
+
+// Supports reports whether the peer has f. Peers that never said are
+// assumed to, as every feature predates advertising them.
+func (pf PeerFeatures) Supports(f Feature) bool {
+	return !pf.Known || slices.Contains(pf.Features, f)
+}
+
+// Missing lists the features the peer advertised it lacks.
+func (pf PeerFeatures) Missing() []Feature {
+	var out []Feature
+	for _, f := range AllFeatures {
+		if !pf.Supports(f) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// PeerFeatures returns what p has advertised: from its profile if we've
+// fetched one that lists features, else from its identify agent version.
+func (n *Node) PeerFeatures(p peer.ID) PeerFeatures {
+	ps := n.host.Peerstore()
+	if v, err := ps.Get(p, featuresKey); err == nil {
+		if fs, _ := v.([]Feature); len(fs) > 0 {
+			return PeerFeatures{Known: true, Features: fs}
+		}
+	}
+	if v, err := ps.Get(p, "AgentVersion"); err == nil {
+		agent, _ := v.(string)
+		if fs, ok := ParseAgentFeatures(agent); ok {
+			return PeerFeatures{Known: true, Features: fs}
+		}
+	}
+	return PeerFeatures{}
+}
+
+// learnFeatures records the features p's profile listed.
+func (n *Node) learnFeatures(p peer.ID, fs []Feature) {
+	if len(fs) == 0 {
+		return
+	}
+	if err := n.host.Peerstore().Put(p, featuresKey, slices.Clone(fs)); err != nil {
+		log.Debugf("recording features of %s: %s", p, err)
+	}
+}
@@ -0,0 +1,79 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// fetchedLog remembers the messages collected from mailboxes until they
+// expire, so a mailbox handing out a copy again, or a second mailbox
+// holding the same deposit, can't deliver it twice. After a message
+// expires, fetchBatch drops copies of it anyway.
+type fetchedLog struct {
+	mu   sync.Mutex
+	path string           // "" keeps it in memory only
+	seen map[string]int64 // deposit digest -> the message's expiry, unix ms
+}
+
+func loadFetchedLog(path string) (*fetchedLog, error) {
+	fl := &fetchedLog{path: path, seen: make(map[string]int64)}
+	if path == "" {
+		return fl, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &fl.seen); err != nil {
+		return nil, err
+	}
+	return fl, nil
+}
+
+// fetchedDigest identifies a deposit of m for to: the bytes its sender
+// signed, hashed.
+func fetchedDigest(to string, m Message) string {
+	sum := sha256.Sum256(depositSignedBytes(to, m))
+	return hex.EncodeToString(sum[:])
+}
+
+// add records m as fetched; it reports false if it already was.
+func (fl *fetchedLog) add(to string, m Message) bool {
+	d := fetchedDigest(to, m)
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if _, ok := fl.seen[d]; ok {
+		return false
+	}
+	fl.seen[d] = m.Expires
+	return true
+}
+
+// save drops expired entries and writes the rest to disk.
+func (fl *fetchedLog) save() error {
+	now := time.Now().UnixMilli()
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	for d, exp := range fl.seen {
+		if exp < now {
+			delete(fl.seen, d)
+		}
+	}
+	if fl.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(fl.seen)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fl.path, b, 0600)
+}
@@ -0,0 +1,163 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ForwardProtocolID carries sealed messages through a third peer: the
+// sender asks a contact to hold one ("hold"), and the contact hands it to
+// the recipient when it reappears ("deliver"). Like the mailbox it doesn't
+// depend on DHT value semantics, and the carrier can't read what it holds.
+const ForwardProtocolID = "/p2pchat/forward/1.0.0"
+
+type forwardRequest struct {
+	Op     string `json:"op"` // "hold" or "deliver"
+	Sealed Sealed `json:"sealed"`
+}
+
+type forwardResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// OnForwardRequest sets the callback that decides whether to hold a sealed
+// message from a peer for its recipient; an error refuses it. Without a
+// callback every request is refused.
+func (n *Node) OnForwardRequest(fn func(from peer.ID, s Sealed) error) {
+	n.mu.Lock()
+	n.onForwardRequest = fn
+	n.mu.Unlock()
+}
+
+// OnForwarded sets the callback for sealed messages a carrier hands us,
+// verified and opened.
+func (n *Node) OnForwarded(fn func(via peer.ID, s Sealed, m Message)) {
+	n.mu.Lock()
+	n.onForwarded = fn
+	n.mu.Unlock()
+}
+
+func (n *Node) handleForward(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+	var req forwardRequest
+	if err := readFrame(s, &req); err != nil {
+		log.Debugf("forward from %s: %s", remote, err)
+		return
+	}
+	release, err := n.serve(remote)
+	if err != nil {
+		_ = writeFrame(s, forwardResponse{Error: err.Error()})
+		return
+	}
+	defer release()
+	switch req.Op {
+	case "hold":
+		err = n.holdForward(remote, req.Sealed)
+	case "deliver":
+		err = n.openForwarded(remote, req.Sealed)
+	default:
+		err = fmt.Errorf("unknown op %q", req.Op)
+	}
+	var resp forwardResponse
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	_ = writeFrame(s, resp)
+}
+
+func (n *Node) holdForward(remote peer.ID, s Sealed) error {
+	if err := s.Verify(); err != nil {
+		n.rejected(remote, "sealed message", err)
+		return err
+	}
+	if s.From != remote.String() {
+		return errors.New("only the sender can ask to forward its message")
+	}
+	if s.Expires != 0 && time.Now().UnixMilli() > s.Expires {
+		return errors.New("message has already expired")
+	}
+	n.mu.RLock()
+	fn := n.onForwardRequest
+	n.mu.RUnlock()
+	if fn == nil {
+		return errors.New("not forwarding messages")
+	}
+	return fn(remote, s)
+}
+
+func (n *Node) openForwarded(via peer.ID, s Sealed) error {
+	m, err := Open(n.host.Peerstore().PrivKey(n.host.ID()), s)
+	if err != nil {
+		n.rejected(via, "sealed message", err)
+		return err
+	}
+	if m.Expired(time.Now()) {
+		log.Debugf("expired sealed message from %s via %s", m.From, via)
+		return nil
+	}
+	n.mu.RLock()
+	fn := n.onForwarded
+	n.mu.RUnlock()
+	if fn != nil {
+		fn(via, s, m)
+	}
+	return nil
+}
+
+// SealFor seals body from this node for to.
+func (n *Node) SealFor(to peer.ID, body string) (Sealed, error) {
+	now := time.Now()
+	m := Message{From: n.host.ID().String(), When: now.UnixMilli(), Body: body, Expires: now.Add(n.storeTTL).UnixMilli()}
+	if err := ValidateMessage(m, now); err != nil {
+		return Sealed{}, err
+	}
+	return Seal(n.host.Peerstore().PrivKey(n.host.ID()), to, m)
+}
+
+// HoldForward asks via to hold s and forward it to its recipient.
+func (n *Node) HoldForward(ctx context.Context, via peer.ID, s Sealed) (err error) {
+	ctx, span := tracer.Start(ctx, "node.HoldForward", trace.WithAttributes(
+		attribute.String("peer.id", s.To), attribute.String("via.id", via.String())))
+	defer func() { endSpan(span, err) }()
+	return n.forwardCall(ctx, via, forwardRequest{Op: "hold", Sealed: s})
+}
+
+// DeliverSealed hands s, held for someone else, to its recipient.
+func (n *Node) DeliverSealed(ctx context.Context, s Sealed) (err error) {
+	ctx, span := tracer.Start(ctx, "node.DeliverSealed", trace.WithAttributes(attribute.String("peer.id", s.To)))
+	defer func() { endSpan(span, err) }()
+	to, err := peer.Decode(s.To)
+	if err != nil {
+		return err
+	}
+	return n.forwardCall(ctx, to, forwardRequest{Op: "deliver", Sealed: s})
+}
+
+func (n *Node) forwardCall(ctx context.Context, p peer.ID, req forwardRequest) error {
+	s, err := n.host.NewStream(ctx, p, ForwardProtocolID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	defer bindStream(ctx, s)()
+	if err := writeFrame(s, req); err != nil {
+		return err
+	}
+	var resp forwardResponse
+	if err := readFrame(s, &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("forward: %s", resp.Error)
+	}
+	return nil
+}
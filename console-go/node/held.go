@@ -0,0 +1,66 @@
+package node
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// HeldFile, next to the identity file, holds the direct messages a node
+// received while no front end was showing them: the tray agent keeps the
+// node online and appends to it, and the console client and GUI take what
+// it holds when they start.
+const HeldFile = "p2pchat_held.jsonl"
+
+// HeldPath returns the held messages file that goes with identityPath.
+func HeldPath(identityPath string) string {
+	return filepath.Join(filepath.Dir(identityPath), HeldFile)
+}
+
+// HoldMessage appends m to the held messages at path.
+func HoldMessage(path string, m Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// TakeHeld returns the messages held at path, oldest first, and empties
+// it. Lines that don't decode as messages are skipped.
+func TakeHeld(path string) ([]Message, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var msgs []Message
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64<<10), MaxMessageSize+1)
+	for sc.Scan() {
+		m, err := DecodeMessage(sc.Bytes())
+		if err != nil {
+			log.Debugf("skipping held message: %s", err)
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return msgs, os.Remove(path)
+}
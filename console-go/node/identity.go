@@ -0,0 +1,158 @@
+package node
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedKeyMagic starts an identity file whose key is sealed with a
+// passphrase; the rest of the file is an encryptedKey as JSON.
+const encryptedKeyMagic = "peep-encrypted-key v1\n"
+
+// ErrPassphraseRequired is returned when an identity is passphrase
+// protected and no passphrase source was given.
+var ErrPassphraseRequired = errors.New("identity is protected by a passphrase")
+
+// ErrBadPassphrase is returned when a passphrase doesn't open the key.
+var ErrBadPassphrase = errors.New("wrong passphrase")
+
+// encryptedKey is a marshalled libp2p key sealed with AES-256-GCM under a
+// key derived from the passphrase with scrypt.
+type encryptedKey struct {
+	KDF   string `json:"kdf"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// IsEncryptedIdentity reports whether data is a passphrase-protected
+// identity file.
+func IsEncryptedIdentity(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedKeyMagic))
+}
+
+// EncryptIdentity returns priv in the passphrase-protected file format.
+func EncryptIdentity(priv crypto.PrivKey, passphrase []byte) ([]byte, error) {
+	raw, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	k := encryptedKey{KDF: "scrypt", N: 1 << 15, R: 8, P: 1, Salt: make([]byte, 16)}
+	if _, err := rand.Read(k.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	k.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(k.Nonce); err != nil {
+		return nil, err
+	}
+	k.Data = aead.Seal(nil, k.Nonce, raw, []byte(encryptedKeyMagic))
+	body, err := json.Marshal(k)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(encryptedKeyMagic), append(body, '\n')...), nil
+}
+
+// DecryptIdentity opens a file written by EncryptIdentity.
+func DecryptIdentity(data, passphrase []byte) (crypto.PrivKey, error) {
+	if !IsEncryptedIdentity(data) {
+		return nil, errors.New("not a passphrase-protected identity")
+	}
+	var k encryptedKey
+	if err := json.Unmarshal(data[len(encryptedKeyMagic):], &k); err != nil {
+		return nil, fmt.Errorf("encrypted identity: %w", err)
+	}
+	if k.KDF != "scrypt" {
+		return nil, fmt.Errorf("encrypted identity: unsupported kdf %q", k.KDF)
+	}
+	aead, err := k.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.Nonce) != aead.NonceSize() {
+		return nil, errors.New("encrypted identity: bad nonce")
+	}
+	raw, err := aead.Open(nil, k.Nonce, k.Data, []byte(encryptedKeyMagic))
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	return crypto.UnmarshalPrivateKey(raw)
+}
+
+func (k *encryptedKey) aead(passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, k.Salt, k.N, k.R, k.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted identity: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ParseIdentity decodes an identity file, raw or passphrase protected.
+// passphrase is only called for protected files; if it is nil they fail
+// with ErrPassphraseRequired.
+func ParseIdentity(data []byte, passphrase func() ([]byte, error)) (crypto.PrivKey, error) {
+	if !IsEncryptedIdentity(data) {
+		return crypto.UnmarshalPrivateKey(data)
+	}
+	if passphrase == nil {
+		return nil, ErrPassphraseRequired
+	}
+	pass, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	return DecryptIdentity(data, pass)
+}
+
+// PassphraseEnv names the environment variable EnvPassphrase reads.
+const PassphraseEnv = "PEEP_PASSPHRASE"
+
+// EnvPassphrase is a Passphrase source for front ends that can't prompt:
+// it returns $PEEP_PASSPHRASE, or ErrPassphraseRequired if that's unset.
+func EnvPassphrase() ([]byte, error) {
+	p, ok := os.LookupEnv(PassphraseEnv)
+	if !ok {
+		return nil, fmt.Errorf("%w; set %s", ErrPassphraseRequired, PassphraseEnv)
+	}
+	return []byte(p), nil
+}
+
+// Fingerprint is a short, readable digest of a public key for comparing
+// identities by eye or over the phone: the first 16 bytes of the SHA-256
+// of the marshalled key, in groups of four hex digits.
+func Fingerprint(pub crypto.PubKey) (string, error) {
+	raw, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	h := strings.ToUpper(hex.EncodeToString(sum[:16]))
+	groups := make([]string, 0, len(h)/4)
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, " "), nil
+}
@@ -0,0 +1,254 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DHTInboxPrefix is where a peer publishes its inbox pointer:
+// /p2pchat/v2/inbox/<peerID>.
+const DHTInboxPrefix = DHTNamespace + "inbox/"
+
+// inboxContext is signed along with a pointer so the signature can't be
+// passed off as anything else.
+const inboxContext = "peep-chat inbox:"
+
+// InboxPointerTTL is how long a published pointer stays valid; owners
+// republish well before.
+const InboxPointerTTL = 48 * time.Hour
+
+// InboxPointer says where a peer's offline messages go, IPNS-style: signed
+// by the peer's own key and sequenced, so the DHT keeps the newest and
+// nobody else can redirect the inbox. Senders deposit at one of the
+// mailboxes; the messages themselves never go into the DHT.
+type InboxPointer struct {
+	Peer      string   `json:"peer"`
+	Seq       uint64   `json:"seq"`
+	Mailboxes []string `json:"mailboxes"` // /p2p multiaddrs, nearest first
+	Expires   int64    `json:"expires"`   // unix ms
+	// Key is the owner's public key, for key types the peer ID doesn't
+	// embed.
+	Key []byte `json:"key,omitempty"`
+	Sig []byte `json:"sig"`
+}
+
+// NewInboxPointer signs a pointer to mailboxes with priv, the owner's key.
+func NewInboxPointer(priv crypto.PrivKey, seq uint64, mailboxes []string, ttl time.Duration) (InboxPointer, error) {
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return InboxPointer{}, err
+	}
+	p := InboxPointer{Peer: id.String(), Seq: seq, Mailboxes: mailboxes, Expires: time.Now().Add(ttl).UnixMilli()}
+	if _, err := id.ExtractPublicKey(); err != nil {
+		if p.Key, err = crypto.MarshalPublicKey(priv.GetPublic()); err != nil {
+			return InboxPointer{}, err
+		}
+	}
+	if p.Sig, err = priv.Sign(p.signedBytes()); err != nil {
+		return InboxPointer{}, err
+	}
+	return p, nil
+}
+
+func (p InboxPointer) signedBytes() []byte {
+	p.Sig = nil
+	b, _ := json.Marshal(p)
+	return append([]byte(inboxContext), b...)
+}
+
+// Verify checks that p is signed by the peer it names and hasn't expired.
+func (p InboxPointer) Verify() error {
+	id, err := peer.Decode(p.Peer)
+	if err != nil {
+		return fmt.Errorf("inbox pointer: %w", err)
+	}
+	pub, err := p.publicKey(id)
+	if err != nil {
+		return fmt.Errorf("inbox pointer: %w", err)
+	}
+	ok, err := pub.Verify(p.signedBytes(), p.Sig)
+	if err != nil {
+		return fmt.Errorf("inbox pointer: %w", err)
+	}
+	if !ok {
+		return errors.New("inbox pointer: bad signature")
+	}
+	if time.Now().UnixMilli() > p.Expires {
+		return errors.New("inbox pointer: expired")
+	}
+	return nil
+}
+
+// publicKey is the key embedded in id, or else the one p carries, which
+// must hash to id.
+func (p InboxPointer) publicKey(id peer.ID) (crypto.PubKey, error) {
+	if len(p.Key) == 0 {
+		return id.ExtractPublicKey()
+	}
+	pub, err := crypto.UnmarshalPublicKey(p.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !id.MatchesPublicKey(pub) {
+		return nil, errors.New("key doesn't match the peer ID")
+	}
+	return pub, nil
+}
+
+// DecodeInboxPointer parses and verifies a pointer.
+func DecodeInboxPointer(b []byte) (InboxPointer, error) {
+	var p InboxPointer
+	if err := json.Unmarshal(b, &p); err != nil {
+		return InboxPointer{}, fmt.Errorf("inbox pointer: %w", err)
+	}
+	return p, p.Verify()
+}
+
+// RecordValidator checks the records peep-chat keeps in the DHT's
+// "p2pchat" namespace. Every node, relays included, needs it: the DHT
+// refuses records of namespaces it has no validator for.
+//
+//   - /p2pchat/v2/inbox/<peerID>: an InboxPointer signed by that peer; the
+//     highest sequence number wins.
+//   - /p2pchat/v2/revoked/<peerID>: that peer's revocation certificate.
+//   - /p2pchat/v2/channel/<peerID>/<name>: a ChannelHead signed by that
+//     peer; the highest sequence number wins.
+//   - /p2pchat/v2/dir/<peerID>: that peer's signed DirectoryRecord; the
+//     highest sequence number wins.
+//
+// Values under /p2pchat/v2/ are DHTEnvelopes around the record. The same
+// records, bare, are still accepted under their legacy keys
+// (/p2pchat/inbox/<peerID> and so on).
+type RecordValidator struct{}
+
+// Validate implements record.Validator.
+func (RecordValidator) Validate(key string, value []byte) error {
+	key, value, err := openRecord(key, value)
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(key, DHTInboxPrefix):
+		p, err := DecodeInboxPointer(value)
+		if err != nil {
+			return err
+		}
+		if p.Peer != strings.TrimPrefix(key, DHTInboxPrefix) {
+			return errors.New("inbox pointer: stored under the wrong peer")
+		}
+		return nil
+	case strings.HasPrefix(key, DHTRevocationPrefix):
+		r, err := DecodeRevocation(value)
+		if err != nil {
+			return err
+		}
+		if r.Peer != strings.TrimPrefix(key, DHTRevocationPrefix) {
+			return errors.New("revocation: stored under the wrong peer")
+		}
+		return nil
+	case strings.HasPrefix(key, DHTChannelPrefix):
+		h, err := DecodeChannelHead(value)
+		if err != nil {
+			return err
+		}
+		if h.Channel != strings.TrimPrefix(key, DHTChannelPrefix) {
+			return errors.New("channel head: stored under the wrong channel")
+		}
+		return nil
+	case strings.HasPrefix(key, DHTDirectoryPrefix):
+		r, err := DecodeDirectoryRecord(value)
+		if err != nil {
+			return err
+		}
+		if r.Peer != strings.TrimPrefix(key, DHTDirectoryPrefix) {
+			return errors.New("directory: stored under the wrong peer")
+		}
+		return nil
+	}
+	return fmt.Errorf("no p2pchat record type for key %q", key)
+}
+
+// Select implements record.Validator: the newest pointer, channel head or
+// directory record, or the first revocation (any valid one revokes the key).
+func (v RecordValidator) Select(key string, values [][]byte) (int, error) {
+	best, bestSeq := -1, uint64(0)
+	for i, val := range values {
+		if v.Validate(key, val) != nil {
+			continue
+		}
+		k, rec, _ := openRecord(key, val)
+		if strings.HasPrefix(k, DHTRevocationPrefix) {
+			return i, nil
+		}
+		// All the others carry their sequence number as "seq".
+		var p struct {
+			Seq uint64 `json:"seq"`
+		}
+		_ = json.Unmarshal(rec, &p)
+		if best < 0 || p.Seq > bestSeq {
+			best, bestSeq = i, p.Seq
+		}
+	}
+	if best < 0 {
+		return 0, errors.New("no valid record")
+	}
+	return best, nil
+}
+
+// PublishInbox signs a pointer to mailboxes and stores it in the DHT. Its
+// sequence number is the time in milliseconds, kept above the last one
+// this node published.
+func (n *Node) PublishInbox(ctx context.Context, mailboxes []string) (_ InboxPointer, err error) {
+	ctx, span := tracer.Start(ctx, "node.PublishInbox", trace.WithAttributes(attribute.Int("mailboxes", len(mailboxes))))
+	defer func() { endSpan(span, err) }()
+	n.mu.Lock()
+	n.inboxSeq = max(n.inboxSeq+1, uint64(time.Now().UnixMilli()))
+	seq := n.inboxSeq
+	n.mu.Unlock()
+	p, err := NewInboxPointer(n.host.Peerstore().PrivKey(n.host.ID()), seq, mailboxes, InboxPointerTTL)
+	if err != nil {
+		return InboxPointer{}, err
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return InboxPointer{}, err
+	}
+	return p, n.putRecord(ctx, DHTInboxPrefix+p.Peer, b)
+}
+
+// ResolveInbox looks up peerID's inbox pointer.
+func (n *Node) ResolveInbox(ctx context.Context, peerID string) (InboxPointer, error) {
+	val, err := n.getRecord(ctx, DHTInboxPrefix+peerID)
+	if err != nil {
+		return InboxPointer{}, err
+	}
+	p, err := DecodeInboxPointer(val)
+	if err == nil && p.Peer != peerID {
+		err = errors.New("inbox pointer: stored under the wrong peer")
+	}
+	return p, err
+}
+
+// inboxMailboxes adds the pointer's mailbox addresses to the peerstore and
+// returns their IDs.
+func (n *Node) inboxMailboxes(p InboxPointer) []peer.ID {
+	var ids []peer.ID
+	for _, s := range p.Mailboxes {
+		pi, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			continue
+		}
+		n.host.Peerstore().AddAddrs(pi.ID, pi.Addrs, time.Hour)
+		ids = append(ids, pi.ID)
+	}
+	return ids
+}
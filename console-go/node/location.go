@@ -0,0 +1,74 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+// Location is set on a message that shares a place: a point, a label, or
+// both. Live sharing sends updates with the same Live ID until Until.
+type Location struct {
+	Point []float64 `json:"point,omitempty"` // [latitude, longitude] in degrees
+	Label string    `json:"label,omitempty"`
+	Live  string    `json:"live,omitempty"`  // 16 hex digits, shared by a live share's updates
+	Until int64     `json:"until,omitempty"` // unix ms; live only
+}
+
+// MapURL links to the location on OpenStreetMap: the point if there is
+// one, else a search for the label.
+func (l Location) MapURL() string {
+	if len(l.Point) == 2 {
+		lat, lon := strconv.FormatFloat(l.Point[0], 'f', 6, 64), strconv.FormatFloat(l.Point[1], 'f', 6, 64)
+		return "https://www.openstreetmap.org/?mlat=" + lat + "&mlon=" + lon + "#map=16/" + lat + "/" + lon
+	}
+	return "https://www.openstreetmap.org/search?query=" + url.QueryEscape(l.Label)
+}
+
+// SendLocation sends a location to a peer, with body as the text clients
+// that don't know locations show.
+func (n *Node) SendLocation(ctx context.Context, to, body string, l Location) (Message, error) {
+	return n.send(ctx, "node.SendLocation", to, Message{Body: body, Location: &l}, true)
+}
+
+// validateLocation checks a message's location against its send time.
+func validateLocation(l *Location, when int64) error {
+	if l == nil {
+		return nil
+	}
+	if len(l.Point) == 0 && l.Label == "" {
+		return errors.New("location has neither a point nor a label")
+	}
+	if len(l.Point) != 0 {
+		if len(l.Point) != 2 {
+			return errors.New("location point isn't [latitude, longitude]")
+		}
+		lat, lon := l.Point[0], l.Point[1]
+		if math.IsNaN(lat) || math.IsNaN(lon) || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+			return fmt.Errorf("location %g,%g out of range", lat, lon)
+		}
+	}
+	if len(l.Label) > 200 {
+		return errors.New("location label too long")
+	}
+	if err := checkText(l.Label, ""); err != nil {
+		return fmt.Errorf("location label %s", err)
+	}
+	if l.Live == "" {
+		if l.Until != 0 {
+			return errors.New("only live locations expire")
+		}
+		return nil
+	}
+	if b, err := hex.DecodeString(l.Live); err != nil || len(b) != 8 {
+		return errors.New("bad live location ID")
+	}
+	if l.Until < when {
+		return errors.New("live location ends before it was sent")
+	}
+	return nil
+}
@@ -0,0 +1,934 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MailboxProtocolID is spoken with an always-on mailbox (a supernode) that
+// holds offline messages until their recipient collects them. Unlike DHT
+// inboxes it doesn't depend on DHT value semantics or record validators.
+const MailboxProtocolID = "/p2pchat/mailbox/1.0.0"
+
+// maxMailboxFrame caps one request or response on a mailbox stream.
+const maxMailboxFrame = 4 << 20
+
+// mailboxFetchBudget caps the messages one fetch response carries, so it
+// stays under maxMailboxFrame; the rest come in the next round.
+const mailboxFetchBudget = 3 << 20
+
+// Deposits are signed by their sender, and fetches by the mailbox's owner
+// over a challenge, under these contexts so neither signature can be
+// passed off as anything else.
+const (
+	depositContext = "peep-chat mailbox deposit:"
+	fetchContext   = "peep-chat mailbox fetch:"
+)
+
+// mailboxRequest is the JSON line a client writes. Op is "deposit"
+// (Message for To, with its sender's Signature), "challenge" (to fetch the
+// caller's own mailbox) or "home" (is this the caller's home node?).
+//
+// The answer to a challenge carries a Nonce; the client then writes a
+// "fetch" on the same stream with its Sig over it (see fetchSignedBytes),
+// and the messages come back. A fetch with Ack set leaves them in place
+// until the client answers with an "ack" naming the IDs it received.
+type mailboxRequest struct {
+	Op        string            `json:"op"`
+	To        string            `json:"to,omitempty"`
+	Message   *Message          `json:"message,omitempty"`
+	Signature *DepositSignature `json:"signature,omitempty"` // of a deposit
+	Sig       []byte            `json:"sig,omitempty"`       // of a fetch
+	Ack       bool              `json:"ack,omitempty"`
+	IDs       []string          `json:"ids,omitempty"`
+}
+
+type mailboxResponse struct {
+	Error      string              `json:"error,omitempty"`
+	Nonce      []byte              `json:"nonce,omitempty"` // the challenge to sign
+	Messages   []Message           `json:"messages,omitempty"`
+	Signatures []*DepositSignature `json:"signatures,omitempty"` // of Messages; nil for those stored unsigned, which are invalid
+	IDs        []string            `json:"ids,omitempty"`        // of Messages, for the ack
+	More       bool                `json:"more,omitempty"`       // more are waiting
+}
+
+// DepositSignature is a sender's signature over a message it left at a
+// mailbox for a recipient.
+type DepositSignature struct {
+	Sig []byte `json:"sig"`
+	// Key is the sender's public key, for key types the peer ID doesn't
+	// embed.
+	Key []byte `json:"key,omitempty"`
+}
+
+func depositSignedBytes(to string, m Message) []byte {
+	b, _ := json.Marshal(m)
+	return append([]byte(depositContext+to+"\x00"), b...)
+}
+
+// signDeposit signs a deposit of m for to with priv, the sender's key.
+func signDeposit(priv crypto.PrivKey, to string, m Message) (*DepositSignature, error) {
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	var ds DepositSignature
+	if _, err := id.ExtractPublicKey(); err != nil {
+		if ds.Key, err = crypto.MarshalPublicKey(priv.GetPublic()); err != nil {
+			return nil, err
+		}
+	}
+	ds.Sig, err = priv.Sign(depositSignedBytes(to, m))
+	return &ds, err
+}
+
+// verifyDeposit checks ds is m's sender's signature over a deposit of m
+// for to.
+func verifyDeposit(to string, m Message, ds *DepositSignature) error {
+	from, err := peer.Decode(m.From)
+	if err != nil {
+		return fmt.Errorf("deposit: sender: %w", err)
+	}
+	pub, err := InboxPointer{Key: ds.Key}.publicKey(from)
+	if err != nil {
+		return fmt.Errorf("deposit: %w", err)
+	}
+	if ok, err := pub.Verify(depositSignedBytes(to, m), ds.Sig); err != nil || !ok {
+		return errors.New("deposit: bad signature")
+	}
+	return nil
+}
+
+// Verification is how a fetched message's deposit signature checked out.
+type Verification string
+
+const (
+	// Verified messages were signed by their sender, for us, and are
+	// within the expiry they were signed with.
+	Verified Verification = "verified"
+	// Invalid messages are unsigned (stored before deposits were signed,
+	// or by a server that dropped the signature) or have a signature that
+	// doesn't check out: forged, altered, meant for someone else, or
+	// replayed without an expiry.
+	Invalid Verification = "invalid"
+)
+
+// Fetched is a message collected from a mailbox.
+type Fetched struct {
+	Message
+	Verification Verification `json:"verification"`
+	Problem      string       `json:"problem,omitempty"` // why it's invalid
+}
+
+// verifyFetched checks the deposit signature of m, a message for us.
+func (n *Node) verifyFetched(m Message, ds *DepositSignature) Fetched {
+	f := Fetched{Message: m, Verification: Verified}
+	switch {
+	case ds == nil:
+		f.Verification, f.Problem = Invalid, "not signed by its sender"
+	case verifyDeposit(n.host.ID().String(), m, ds) != nil:
+		f.Verification, f.Problem = Invalid, "signature doesn't match the sender"
+	case m.Expires == 0:
+		// Deposit always sets one; without it a copy could be handed out
+		// again forever.
+		f.Verification, f.Problem = Invalid, "signed without an expiry"
+	}
+	return f
+}
+
+// joinFetched reassembles split messages as JoinParts does; invalid parts
+// are never joined.
+func joinFetched(fs []Fetched) []Fetched {
+	sets := make(map[string][]Fetched) // by sender/part ID
+	for _, f := range fs {
+		if f.Part != nil && f.Verification != Invalid {
+			key := f.From + "/" + f.Part.ID
+			sets[key] = append(sets[key], f)
+		}
+	}
+	var out []Fetched
+	for _, f := range fs {
+		if f.Part == nil || f.Verification == Invalid {
+			out = append(out, f)
+			continue
+		}
+		key := f.From + "/" + f.Part.ID
+		set, ok := sets[key]
+		if !ok {
+			continue // joined already
+		}
+		delete(sets, key)
+		msgs := make([]Message, len(set))
+		for i, p := range set {
+			msgs[i] = p.Message
+		}
+		for _, m := range JoinParts(msgs) {
+			out = append(out, Fetched{Message: m, Verification: Verified})
+		}
+	}
+	return out
+}
+
+// fetchSignedBytes is what owner signs to fetch its mailbox at mailbox.
+func fetchSignedBytes(mailbox, owner peer.ID, nonce []byte) []byte {
+	return []byte(fetchContext + mailbox.String() + "\x00" + owner.String() + "\x00" + string(nonce))
+}
+
+// MailboxLimits bounds what a mailbox stores.
+type MailboxLimits struct {
+	// TotalBytes caps the disk used by all mailboxes together.
+	TotalBytes int64
+	// PerSender caps how many undelivered messages one peer may have
+	// waiting across all mailboxes.
+	PerSender int
+	// MaxMessage caps the size of one stored message body.
+	MaxMessage int
+	// MaxTTL is the longest a message is kept, whatever its own expiry.
+	MaxTTL time.Duration
+	// InboxBytes caps one recipient's mailbox. When a deposit would go
+	// over, the oldest messages of the sender using the most of it are
+	// rotated out, unless that is the depositor, who is refused.
+	InboxBytes int64
+	// SenderShare is the percentage of InboxBytes one sender may fill, so
+	// no peer can take a recipient's whole offline capacity.
+	SenderShare int
+	// Owner, if set, makes this a home node: it holds messages for that
+	// peer alone.
+	Owner peer.ID
+}
+
+// DefaultStoreTTL is how long stored messages live unless the sender
+// asks otherwise.
+const DefaultStoreTTL = 14 * 24 * time.Hour
+
+// mailboxSweep is how often Sweep removes expired messages.
+const mailboxSweep = time.Hour
+
+// Mailbox is the server side: a directory per recipient under dir, with
+// one file per message. Deposits only ever add a file and fetches remove
+// the ones the recipient acknowledged, so concurrent senders can't
+// overwrite each other and nothing is dropped before it is delivered.
+type Mailbox struct {
+	dir    string
+	limits MailboxLimits
+
+	mu        sync.Mutex
+	used      int64
+	perSender map[peer.ID]int
+	inboxes   map[string]*inboxUsage // by recipient
+	seq       uint64                 // disambiguates message IDs within a nanosecond
+}
+
+// inboxUsage is the bytes stored in one recipient's mailbox, in all and
+// per sender.
+type inboxUsage struct {
+	total  int64
+	sender map[peer.ID]int64
+}
+
+// inbox returns recipient's usage, creating it; callers hold mb.mu.
+func (mb *Mailbox) inbox(recipient string) *inboxUsage {
+	u := mb.inboxes[recipient]
+	if u == nil {
+		u = &inboxUsage{sender: make(map[peer.ID]int64)}
+		mb.inboxes[recipient] = u
+	}
+	return u
+}
+
+// account adds (or, with a negative size, removes) a message of size
+// bytes from sender in recipient's mailbox; callers hold mb.mu.
+func (mb *Mailbox) account(recipient string, sender peer.ID, size int64) {
+	mb.used += size
+	u := mb.inbox(recipient)
+	u.total += size
+	u.sender[sender] += size
+	if size > 0 {
+		mb.perSender[sender]++
+		return
+	}
+	if u.sender[sender] <= 0 {
+		delete(u.sender, sender)
+	}
+	if u.total <= 0 {
+		delete(mb.inboxes, recipient)
+	}
+	if mb.perSender[sender]--; mb.perSender[sender] <= 0 {
+		delete(mb.perSender, sender)
+	}
+}
+
+// storedMessage remembers who deposited a message, which may differ from
+// the claimed m.From.
+type storedMessage struct {
+	Message
+	Sender peer.ID `json:"sender"`
+	Stored int64   `json:"stored,omitempty"` // unix ms
+	// Signature is the deposit's; older records lack it.
+	Signature *DepositSignature `json:"signature,omitempty"`
+}
+
+// storedRecord is one message file.
+type storedRecord struct {
+	storedMessage
+	id   string
+	size int64
+}
+
+// OpenMailbox loads the mailboxes in dir, creating it if needed. Mailboxes
+// an older version kept as one list per recipient are split into records.
+func OpenMailbox(dir string, limits MailboxLimits) (*Mailbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	mb := &Mailbox{dir: dir, limits: limits, perSender: make(map[peer.ID]int), inboxes: make(map[string]*inboxUsage)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			if err := mb.migrate(strings.TrimSuffix(e.Name(), ".json")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if entries, err = os.ReadDir(dir); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		recs, err := mb.read(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range recs {
+			mb.account(e.Name(), r.Sender, r.size)
+		}
+	}
+	mb.mu.Lock()
+	err = mb.expire()
+	mb.mu.Unlock()
+	return mb, err
+}
+
+// expired reports whether r is past its own expiry or the server's MaxTTL.
+func (mb *Mailbox) expired(r storedRecord, now time.Time) bool {
+	if r.Expired(now) {
+		return true
+	}
+	stored := r.Stored
+	if stored == 0 {
+		stored = r.When
+	}
+	return mb.limits.MaxTTL > 0 && now.After(time.UnixMilli(stored).Add(mb.limits.MaxTTL))
+}
+
+// expire removes every expired message; callers hold mb.mu.
+func (mb *Mailbox) expire() error {
+	entries, err := os.ReadDir(mb.dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		recs, err := mb.read(e.Name())
+		if err != nil {
+			return err
+		}
+		var old []string
+		for _, r := range recs {
+			if mb.expired(r, now) {
+				old = append(old, r.id)
+			}
+		}
+		if len(old) > 0 {
+			log.Debugf("mailbox %s: %d messages expired", e.Name(), len(old))
+			if err := mb.removeLocked(e.Name(), old); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sweep removes expired messages every hour until ctx is done.
+func (mb *Mailbox) Sweep(ctx context.Context) {
+	t := time.NewTicker(mailboxSweep)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		mb.mu.Lock()
+		err := mb.expire()
+		mb.mu.Unlock()
+		if err != nil {
+			log.Warnf("expiring mailbox messages: %s", err)
+		}
+	}
+}
+
+// migrate splits a legacy <recipient>.json list into message records.
+func (mb *Mailbox) migrate(recipient string) error {
+	legacy := filepath.Join(mb.dir, recipient+".json")
+	b, err := os.ReadFile(legacy)
+	if err != nil {
+		return err
+	}
+	var msgs []storedMessage
+	if err := json.Unmarshal(b, &msgs); err != nil {
+		return fmt.Errorf("mailbox %s: %w", recipient, err)
+	}
+	for _, m := range msgs {
+		if _, err := mb.write(recipient, m); err != nil {
+			return err
+		}
+	}
+	return os.Remove(legacy)
+}
+
+// Usage returns the bytes stored and the configured total.
+func (mb *Mailbox) Usage() (used, total int64) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.used, mb.limits.TotalBytes
+}
+
+func (mb *Mailbox) recipientDir(recipient string) string {
+	return filepath.Join(mb.dir, recipient)
+}
+
+// validRecordID accepts the names write gives records, so an ack can't
+// reach outside the recipient's directory.
+func validRecordID(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// write stores m as a new record, atomically, and returns its size.
+func (mb *Mailbox) write(recipient string, m storedMessage) (int64, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	dir := mb.recipientDir(recipient)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	mb.seq++
+	id := fmt.Sprintf("%020d-%d", time.Now().UnixNano(), mb.seq)
+	tmp := filepath.Join(dir, id+".tmp")
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return 0, err
+	}
+	return int64(len(b)), os.Rename(tmp, filepath.Join(dir, id+".json"))
+}
+
+// read returns recipient's records, oldest first.
+func (mb *Mailbox) read(recipient string) ([]storedRecord, error) {
+	entries, err := os.ReadDir(mb.recipientDir(recipient))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var recs []storedRecord
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !validRecordID(id) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(mb.recipientDir(recipient), e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		r := storedRecord{id: id, size: int64(len(b))}
+		if err := json.Unmarshal(b, &r.storedMessage); err != nil {
+			return nil, fmt.Errorf("mailbox %s/%s: %w", recipient, id, err)
+		}
+		recs = append(recs, r)
+	}
+	return recs, nil
+}
+
+// deposit adds m to recipient's mailbox, enforcing the limits. ds is m's
+// sender's signature, so nobody can leave a message in someone else's name.
+func (mb *Mailbox) deposit(sender peer.ID, recipient string, m Message, ds *DepositSignature) error {
+	if _, err := peer.Decode(recipient); err != nil {
+		return fmt.Errorf("bad recipient: %w", err)
+	}
+	if mb.limits.Owner != "" && recipient != mb.limits.Owner.String() {
+		return errors.New("this is a home node; it only holds messages for its owner")
+	}
+	if err := ValidateMessage(m, time.Now()); err != nil {
+		return err
+	}
+	if ds == nil {
+		return errors.New("unsigned deposit; this mailbox needs a newer client")
+	}
+	if err := verifyDeposit(recipient, m, ds); err != nil {
+		return err
+	}
+	if m.Expired(time.Now()) {
+		return errors.New("message has already expired")
+	}
+	if mb.limits.MaxMessage > 0 && len(m.Body) > mb.limits.MaxMessage {
+		return fmt.Errorf("message larger than %d bytes", mb.limits.MaxMessage)
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.limits.PerSender > 0 && mb.perSender[sender] >= mb.limits.PerSender {
+		return fmt.Errorf("you already have %d undelivered messages here", mb.perSender[sender])
+	}
+	sm := storedMessage{Message: m, Sender: sender, Stored: time.Now().UnixMilli(), Signature: ds}
+	b, _ := json.Marshal(sm)
+	size := int64(len(b))
+	if err := mb.makeRoom(sender, recipient, size); err != nil {
+		return err
+	}
+	if mb.limits.TotalBytes > 0 && mb.used+size > mb.limits.TotalBytes {
+		return errors.New("mailbox server is full")
+	}
+	size, err := mb.write(recipient, sm)
+	if err != nil {
+		return err
+	}
+	mb.account(recipient, sender, size)
+	return nil
+}
+
+// makeRoom enforces the inbox quotas for a deposit of size bytes: the
+// sender's share first, then the inbox total, rotating out the oldest
+// messages of whoever else holds the most of it. Callers hold mb.mu.
+func (mb *Mailbox) makeRoom(sender peer.ID, recipient string, size int64) error {
+	if mb.limits.InboxBytes <= 0 {
+		return nil
+	}
+	u := mb.inbox(recipient)
+	if share := mb.limits.InboxBytes * int64(mb.limits.SenderShare) / 100; share > 0 && u.sender[sender]+size > share {
+		return fmt.Errorf("you already fill %d of the %d bytes one sender may use of this inbox", u.sender[sender], share)
+	}
+	for u.total+size > mb.limits.InboxBytes {
+		var heaviest peer.ID
+		for p, n := range u.sender {
+			if n > u.sender[heaviest] {
+				heaviest = p
+			}
+		}
+		if heaviest == "" || heaviest == sender {
+			return errors.New("the recipient's inbox is full")
+		}
+		recs, err := mb.read(recipient)
+		if err != nil {
+			return err
+		}
+		var evict []string
+		freed := int64(0)
+		for _, r := range recs {
+			if r.Sender == heaviest {
+				evict = append(evict, r.id)
+				if freed += r.size; u.total-freed+size <= mb.limits.InboxBytes {
+					break
+				}
+			}
+		}
+		if len(evict) == 0 {
+			return errors.New("the recipient's inbox is full")
+		}
+		log.Infof("mailbox %s full: rotating out %d messages from %s", recipient, len(evict), heaviest)
+		if err := mb.removeLocked(recipient, evict); err != nil {
+			return err
+		}
+		u = mb.inbox(recipient)
+	}
+	return nil
+}
+
+// peek returns recipient's oldest messages, up to mailboxFetchBudget
+// bytes, with their deposit signatures and IDs, and whether more are
+// waiting.
+func (mb *Mailbox) peek(recipient peer.ID) ([]Message, []*DepositSignature, []string, bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	recs, err := mb.read(recipient.String())
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	var (
+		msgs   []Message
+		sigs   []*DepositSignature
+		ids    []string
+		old    []string
+		budget int64
+		now    = time.Now()
+	)
+	defer func() {
+		if len(old) > 0 {
+			_ = mb.removeLocked(recipient.String(), old)
+		}
+	}()
+	for _, r := range recs {
+		if mb.expired(r, now) {
+			old = append(old, r.id)
+			continue
+		}
+		if budget += r.size; budget > mailboxFetchBudget && len(msgs) > 0 {
+			return msgs, sigs, ids, true, nil
+		}
+		msgs = append(msgs, r.Message)
+		sigs = append(sigs, r.Signature)
+		ids = append(ids, r.id)
+	}
+	return msgs, sigs, ids, false, nil
+}
+
+// remove deletes the acknowledged records of recipient.
+func (mb *Mailbox) remove(recipient peer.ID, ids []string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.removeLocked(recipient.String(), ids)
+}
+
+// removeLocked is remove for callers holding mb.mu.
+func (mb *Mailbox) removeLocked(recipient string, ids []string) error {
+	dir := mb.recipientDir(recipient)
+	for _, id := range ids {
+		if !validRecordID(id) {
+			return fmt.Errorf("bad message ID %q", truncate(id, 64))
+		}
+		path := filepath.Join(dir, id+".json")
+		b, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // acknowledged twice
+		}
+		if err != nil {
+			return err
+		}
+		var sm storedMessage
+		_ = json.Unmarshal(b, &sm)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		mb.account(recipient, sm.Sender, -int64(len(b)))
+	}
+	_ = os.Remove(dir) // only succeeds once it's empty
+	return nil
+}
+
+// Serve handles mailbox streams on h.
+func (mb *Mailbox) Serve(h host.Host) {
+	h.SetStreamHandler(MailboxProtocolID, Guard(mb.handleStream))
+}
+
+func (mb *Mailbox) handleStream(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+	var req mailboxRequest
+	var resp mailboxResponse
+	if err := readFrame(s, &req); err != nil {
+		log.Debugf("mailbox request from %s: %s", remote, err)
+		return
+	}
+	switch req.Op {
+	case "deposit":
+		if req.Message == nil {
+			resp.Error = "deposit without a message"
+		} else if err := mb.deposit(remote, req.To, *req.Message, req.Signature); err != nil {
+			resp.Error = err.Error()
+		}
+	case "challenge":
+		mb.fetch(s, remote)
+		return
+	case "fetch":
+		resp.Error = "fetching needs a signed challenge; this mailbox needs a newer client"
+	case "home":
+		if mb.limits.Owner != remote {
+			resp.Error = "not your home node"
+		}
+	default:
+		resp.Error = fmt.Sprintf("unknown op %q", req.Op)
+	}
+	if err := writeFrame(s, resp); err != nil {
+		log.Debugf("mailbox response to %s: %s", remote, err)
+	}
+}
+
+// fetch challenges remote to sign for its mailbox, which only then is
+// sent, and removes what it acknowledges. The stream's remote peer is
+// authenticated by the security handshake already; the signature also
+// proves the caller holds the owner's key, not just a connection in its
+// name.
+func (mb *Mailbox) fetch(s network.Stream, remote peer.ID) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		_ = writeFrame(s, mailboxResponse{Error: err.Error()})
+		return
+	}
+	if err := writeFrame(s, mailboxResponse{Nonce: nonce}); err != nil {
+		return
+	}
+	var req mailboxRequest
+	var resp mailboxResponse
+	if err := readFrame(s, &req); err != nil {
+		log.Debugf("mailbox fetch from %s: %s", remote, err)
+		return
+	}
+	if req.Op != "fetch" || !req.Ack {
+		_ = writeFrame(s, mailboxResponse{Error: "expected a signed fetch"})
+		return
+	}
+	if ok, err := s.Conn().RemotePublicKey().Verify(fetchSignedBytes(s.Conn().LocalPeer(), remote, nonce), req.Sig); err != nil || !ok {
+		log.Debugf("mailbox fetch from %s: bad signature", remote)
+		_ = writeFrame(s, mailboxResponse{Error: "fetch: bad signature"})
+		return
+	}
+	msgs, sigs, ids, more, err := mb.peek(remote)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Messages, resp.Signatures, resp.IDs, resp.More = msgs, sigs, ids, more
+	mb.awaitAck(s, remote, resp)
+}
+
+// awaitAck sends a fetch response and removes what the client then
+// acknowledges. If the stream breaks first, everything stays for the next
+// fetch.
+func (mb *Mailbox) awaitAck(s network.Stream, remote peer.ID, resp mailboxResponse) {
+	if err := writeFrame(s, resp); err != nil || resp.Error != "" {
+		return
+	}
+	var ack mailboxRequest
+	if err := readFrame(s, &ack); err != nil || ack.Op != "ack" {
+		log.Debugf("mailbox of %s: no acknowledgement: %v", remote, err)
+		return
+	}
+	var done mailboxResponse
+	if err := mb.remove(remote, ack.IDs); err != nil {
+		done.Error = err.Error()
+	}
+	_ = writeFrame(s, done)
+}
+
+// Deposit leaves a message for recipient at the mailbox server. A body
+// over MaxBodySize is split into parts (see SplitBody) deposited in turn;
+// if the mailbox refuses one, the error says how many it took.
+func (n *Node) Deposit(ctx context.Context, mailbox peer.ID, recipient, body string) (_ Message, err error) {
+	ctx, span := tracer.Start(ctx, "node.Deposit", trace.WithAttributes(
+		attribute.String("peer.id", recipient), attribute.String("mailbox.id", mailbox.String()),
+		attribute.Int("message.size", len(body))))
+	defer func() { endSpan(span, err) }()
+	parts, err := SplitBody(body)
+	if err != nil {
+		return Message{}, err
+	}
+	from, when := n.host.ID().String(), time.Now().UnixMilli()
+	expires := when + n.storeTTL.Milliseconds()
+	for i := range parts {
+		parts[i].From, parts[i].When, parts[i].Expires = from, when, expires
+		if err := ValidateMessage(parts[i], time.Now()); err != nil {
+			return Message{}, err
+		}
+	}
+	priv := n.host.Peerstore().PrivKey(n.host.ID())
+	for i, m := range parts {
+		err := n.pace.message(ctx, mailbox.String())
+		var ds *DepositSignature
+		if err == nil {
+			ds, err = signDeposit(priv, recipient, m)
+		}
+		if err == nil {
+			_, err = n.mailboxCall(ctx, mailbox, mailboxRequest{Op: "deposit", To: recipient, Message: &m, Signature: ds})
+		}
+		if err != nil {
+			if len(parts) > 1 {
+				return Message{}, fmt.Errorf("mailbox took %d of %d parts: %w", i, len(parts), err)
+			}
+			return Message{}, err
+		}
+	}
+	return Message{From: from, When: when, Body: body, Expires: expires}, nil
+}
+
+// PairHome checks that home is a home node holding messages for us.
+func (n *Node) PairHome(ctx context.Context, home peer.ID) error {
+	_, err := n.mailboxCall(ctx, home, mailboxRequest{Op: "home"})
+	return err
+}
+
+// maxFetchRounds bounds how many batches one FetchMailbox collects.
+const maxFetchRounds = 64
+
+// FetchMailbox collects our messages from the mailbox server, batch by
+// batch, acknowledging each batch once it has arrived so the server only
+// then removes it. Each message's deposit signature is checked, messages
+// fetched before are dropped, and split messages are reassembled.
+func (n *Node) FetchMailbox(ctx context.Context, mailbox peer.ID) (_ []Fetched, err error) {
+	ctx, span := tracer.Start(ctx, "node.FetchMailbox", trace.WithAttributes(attribute.String("mailbox.id", mailbox.String())))
+	defer func() { endSpan(span, err) }()
+	var out []Fetched
+	for round := 0; round < maxFetchRounds; round++ {
+		msgs, more, err := n.fetchBatch(ctx, mailbox)
+		out = append(out, msgs...)
+		if err != nil {
+			if len(out) > 0 {
+				log.Warnf("mailbox %s: %s; fetched %d messages so far", mailbox, err, len(out))
+				return joinFetched(out), nil
+			}
+			return nil, err
+		}
+		if !more {
+			break
+		}
+	}
+	return joinFetched(out), nil
+}
+
+// fetchBatch collects and acknowledges one batch.
+func (n *Node) fetchBatch(ctx context.Context, mailbox peer.ID) ([]Fetched, bool, error) {
+	s, err := n.host.NewStream(ctx, mailbox, MailboxProtocolID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer s.Close()
+	defer bindStream(ctx, s)()
+	if err := writeFrame(s, mailboxRequest{Op: "challenge"}); err != nil {
+		return nil, false, err
+	}
+	var challenge mailboxResponse
+	if err := readFrame(s, &challenge); err != nil {
+		return nil, false, err
+	}
+	if challenge.Error != "" || len(challenge.Nonce) == 0 {
+		return nil, false, fmt.Errorf("mailbox: no challenge: %s", challenge.Error)
+	}
+	sig, err := n.host.Peerstore().PrivKey(n.host.ID()).Sign(fetchSignedBytes(mailbox, n.host.ID(), challenge.Nonce))
+	if err != nil {
+		return nil, false, err
+	}
+	if err := writeFrame(s, mailboxRequest{Op: "fetch", Ack: true, Sig: sig}); err != nil {
+		return nil, false, err
+	}
+	var resp mailboxResponse
+	if err := readFrame(s, &resp); err != nil {
+		return nil, false, err
+	}
+	if resp.Error != "" {
+		return nil, false, fmt.Errorf("mailbox: %s", resp.Error)
+	}
+	if len(resp.Messages) == 0 {
+		return nil, false, nil
+	}
+	// Invalid messages are acknowledged too, or they'd come back forever.
+	if err := writeFrame(s, mailboxRequest{Op: "ack", IDs: resp.IDs}); err != nil {
+		return nil, false, err
+	}
+	// Whatever the server says now, we have the messages; at worst an
+	// unconfirmed batch comes again next time.
+	var done mailboxResponse
+	if err := readFrame(s, &done); err != nil || done.Error != "" {
+		log.Debugf("mailbox %s acknowledgement: %v %s", mailbox, err, done.Error)
+		resp.More = false
+	}
+	// The mailbox server is not trusted to have validated deposits.
+	now := time.Now()
+	var msgs []Fetched
+	for i, m := range resp.Messages {
+		if err := ValidateMessage(m, now); err != nil {
+			log.Warnf("dropping message from mailbox %s: %s", mailbox, err)
+			continue
+		}
+		if m.Expired(now) {
+			log.Debugf("dropping expired message from mailbox %s", mailbox)
+			continue
+		}
+		var ds *DepositSignature
+		if i < len(resp.Signatures) {
+			ds = resp.Signatures[i]
+		}
+		f := n.verifyFetched(m, ds)
+		if f.Verification == Invalid {
+			log.Warnf("message from mailbox %s claiming to be from %s: %s", mailbox, m.From, f.Problem)
+		} else if !n.fetched.add(n.host.ID().String(), m) {
+			log.Debugf("dropping message from mailbox %s fetched before", mailbox)
+			continue
+		}
+		msgs = append(msgs, f)
+	}
+	if err := n.fetched.save(); err != nil {
+		log.Warnf("saving fetched messages: %s", err)
+	}
+	return msgs, resp.More, nil
+}
+
+func (n *Node) mailboxCall(ctx context.Context, mailbox peer.ID, req mailboxRequest) (*mailboxResponse, error) {
+	s, err := n.host.NewStream(ctx, mailbox, MailboxProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	defer bindStream(ctx, s)()
+	if err := writeFrame(s, req); err != nil {
+		return nil, err
+	}
+	var resp mailboxResponse
+	if err := readFrame(s, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("mailbox: %s", resp.Error)
+	}
+	return &resp, nil
+}
+
+// writeFrame and readFrame exchange one newline-terminated JSON value.
+func writeFrame(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+func readFrame(r io.Reader, v any) error {
+	line, err := bufio.NewReader(io.LimitReader(r, maxMailboxFrame)).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
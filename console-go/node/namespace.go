@@ -0,0 +1,137 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DHTVersion is the layout of the records this version publishes: keys
+// under DHTNamespace, values wrapped in a DHTEnvelope.
+const DHTVersion = 2
+
+// DHTNamespace is where current records live; every record prefix
+// (DHTInboxPrefix and the rest) is under it.
+const DHTNamespace = "/p2pchat/v2/"
+
+// LegacyDHTNamespace is where version 1 kept the same records, bare and
+// without a version: /p2pchat/inbox/<peerID> and so on.
+const LegacyDHTNamespace = "/p2pchat/"
+
+// DHTEnvelope is a current-layout DHT value. The record inside is the one
+// its owner signed, unchanged, so anyone holding a valid legacy record can
+// republish it under the current key (see MigrateRecord).
+type DHTEnvelope struct {
+	Version int             `json:"v"`
+	Record  json.RawMessage `json:"record"`
+}
+
+// LegacyDHTKey is where version 1 kept the record stored under key.
+func LegacyDHTKey(key string) string {
+	return LegacyDHTNamespace + strings.TrimPrefix(key, DHTNamespace)
+}
+
+// openRecord unwraps a DHT value of either layout. It returns the key in
+// the current layout and the bare record, for the validator to check.
+func openRecord(key string, value []byte) (string, []byte, error) {
+	if strings.HasPrefix(key, DHTNamespace) {
+		var env DHTEnvelope
+		if err := json.Unmarshal(value, &env); err != nil {
+			return "", nil, fmt.Errorf("dht record: %w", err)
+		}
+		if env.Version != DHTVersion {
+			return "", nil, fmt.Errorf("dht record: version %d stored under a version %d key", env.Version, DHTVersion)
+		}
+		return key, env.Record, nil
+	}
+	rest, ok := strings.CutPrefix(key, LegacyDHTNamespace)
+	if !ok {
+		return "", nil, fmt.Errorf("no p2pchat record type for key %q", key)
+	}
+	if v, _, _ := strings.Cut(rest, "/"); len(v) > 1 && v[0] == 'v' && strings.Trim(v[1:], "0123456789") == "" {
+		return "", nil, fmt.Errorf("unsupported p2pchat record version in key %q", key)
+	}
+	return DHTNamespace + rest, value, nil
+}
+
+// putRecord publishes rec, a bare signed record, under key and, for
+// clients from before DHTVersion, under its legacy key too. Only the
+// current key's result counts.
+func (n *Node) putRecord(ctx context.Context, key string, rec []byte) error {
+	b, err := json.Marshal(DHTEnvelope{Version: DHTVersion, Record: rec})
+	if err != nil {
+		return err
+	}
+	if err := n.putValue(ctx, key, b); err != nil {
+		return err
+	}
+	if err := n.putValue(ctx, LegacyDHTKey(key), rec); err != nil {
+		log.Debugf("publishing legacy %s: %s", LegacyDHTKey(key), err)
+	}
+	return nil
+}
+
+// getRecord looks up the bare record under key, falling back to its legacy
+// key when no current-layout record has been published yet.
+func (n *Node) getRecord(ctx context.Context, key string) ([]byte, error) {
+	val, err := n.getValue(ctx, key)
+	if err == nil {
+		_, rec, err := openRecord(key, val)
+		return rec, err
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	old, lerr := n.getValue(ctx, LegacyDHTKey(key))
+	if lerr != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// MigrateStatus is what MigrateRecord did with a record.
+type MigrateStatus string
+
+const (
+	// Migrated means the legacy record was republished under the current key.
+	Migrated MigrateStatus = "migrated"
+	// Current means the current key already holds that record or a newer one.
+	Current MigrateStatus = "current"
+	// NoLegacy means there is no legacy record to migrate.
+	NoLegacy MigrateStatus = "none"
+)
+
+// MigrateRecord reads the legacy record for key and republishes it in the
+// current layout, unless the current key already holds it or something
+// newer. The record keeps its owner's signature, so this works for other
+// peers' records as well as our own.
+func (n *Node) MigrateRecord(ctx context.Context, key string) (MigrateStatus, error) {
+	if !strings.HasPrefix(key, DHTNamespace) {
+		return "", fmt.Errorf("%q is not a current-layout key", key)
+	}
+	old, err := n.getValue(ctx, LegacyDHTKey(key))
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", err
+		}
+		return NoLegacy, nil
+	}
+	var v RecordValidator
+	if err := v.Validate(LegacyDHTKey(key), old); err != nil {
+		return "", fmt.Errorf("legacy record: %w", err)
+	}
+	b, err := json.Marshal(DHTEnvelope{Version: DHTVersion, Record: old})
+	if err != nil {
+		return "", err
+	}
+	if cur, err := n.getValue(ctx, key); err == nil && v.Validate(key, cur) == nil {
+		if i, err := v.Select(key, [][]byte{cur, b}); err == nil && i == 0 {
+			return Current, nil
+		}
+	}
+	if err := n.putValue(ctx, key, b); err != nil {
+		return "", err
+	}
+	return Migrated, nil
+}
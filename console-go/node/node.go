@@ -0,0 +1,659 @@
+// Package node is the peep-chat protocol core: a libp2p host with the
+// direct-message protocol and the DHT offline inbox. It never reads stdin
+// or prints; callers get results as return values and incoming messages
+// through a callback, so the same code backs the console client and
+// embedded (mobile, GUI) front ends.
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log"
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	host "github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	peerstore "github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// ProtocolID is the direct-message stream protocol.
+	ProtocolID = "/p2pchat/1.0.0"
+	// ByeProtocolID is opened (and closed right away) to tell connected
+	// peers we are going offline on purpose.
+	ByeProtocolID = "/p2pchat/bye/1.0.0"
+)
+
+var log = logging.Logger("p2pchat/node")
+
+// tracer reports spans to whatever OpenTelemetry provider the program
+// installed; without one it is a no-op.
+var tracer = otel.Tracer("p2p-chat/node")
+
+// endSpan marks span failed if err is set, then ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Message is the wire format of a chat message, both on streams
+// (newline-delimited JSON) and in DHT inboxes. It's an envelope: Type says
+// what the message is and Payload carries whatever that type needs, with
+// Body as text for clients that don't know the type. The older typed
+// fields (Files, Sticker, Location, Card) are kept for peers that predate
+// Type.
+type Message struct {
+	From string `json:"from"`
+	When int64  `json:"when"`
+	Body string `json:"body"`
+	Room string `json:"room,omitempty"` // set for room messages
+	// Type is a registered or future message type; empty means Kind
+	// decides from the fields set.
+	Type    string          `json:"type,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Files are attachments, stored as content-addressed blocks the
+	// receiver fetches by CID.
+	Files []FileRef `json:"files,omitempty"`
+	// Part is set on the pieces of a stored message too large for one.
+	Part *Part `json:"part,omitempty"`
+	// Expires (unix ms) is when a stored message may be discarded
+	// undelivered.
+	Expires int64 `json:"expires,omitempty"`
+	// PoW is a proof-of-work nonce, for recipients that ask for one; see
+	// Stamp.
+	PoW uint64 `json:"pow,omitempty"`
+	// Sticker is set when the message sends a sticker; Body then holds
+	// text for clients that don't show stickers.
+	Sticker *Sticker `json:"sticker,omitempty"`
+	// Location is set when the message shares a place.
+	Location *Location `json:"location,omitempty"`
+	// Card is set when the message introduces a contact.
+	Card *ContactCard `json:"card,omitempty"`
+	// Cipher is set on a message to an encrypted room: the message
+	// itself, encrypted with its sender's key; see SenderKey.
+	Cipher *RoomCipher `json:"cipher,omitempty"`
+}
+
+// Expired reports whether m has an expiry and it has passed.
+func (m Message) Expired(now time.Time) bool {
+	return m.Expires != 0 && now.UnixMilli() > m.Expires
+}
+
+// Options configures New.
+type Options struct {
+	// Identity is the node's key. If nil, IdentityPath is loaded (and
+	// created on first use).
+	Identity     crypto.PrivKey
+	IdentityPath string
+	// Passphrase is asked for when the file at IdentityPath is
+	// passphrase protected.
+	Passphrase func() ([]byte, error)
+	// ListenAddrs overrides libp2p's default listen addresses.
+	ListenAddrs []string
+	// Security picks the security transports: SecurityBoth (the
+	// default), SecurityNoise or SecurityTLS.
+	Security string
+	// RefusePlaintext closes any connection that isn't encrypted.
+	RefusePlaintext bool
+	// Libp2p holds extra host options.
+	Libp2p []HostOption
+	// Host, if set, is used instead of creating one; Identity,
+	// ListenAddrs, Security, RefusePlaintext and Libp2p are then ignored. Simulations pass mocknet
+	// hosts here. The node takes ownership and closes it.
+	Host host.Host
+	// DHT holds extra DHT options.
+	DHT []kaddht.Option
+	// StoreTTL is how long messages this node stores for offline peers
+	// live; 0 means DefaultStoreTTL.
+	StoreTTL time.Duration
+	// DelegatedRouting lists Delegated Routing V1 HTTP endpoints used to
+	// find peers and providers. With any set, the DHT runs in client mode:
+	// it still answers lookups made through it but serves no records.
+	DelegatedRouting []string
+	// Pacing bounds how fast messages and DHT writes go out; the zero
+	// value leaves them unlimited.
+	Pacing Pacing
+	// Dialing tunes dial ranking and timeouts; it's ignored with Host.
+	Dialing Dialing
+	// Features are the peep features the node's profile advertises; nil
+	// means FeatureChat alone. Put them in the agent version with
+	// AgentVersion too.
+	Features []Feature
+	// FetchedPath is where the messages collected from mailboxes are
+	// remembered until they expire, so replayed copies are dropped; empty
+	// remembers them for this run only.
+	FetchedPath string
+}
+
+// Node is a running peep-chat node.
+type Node struct {
+	host host.Host
+	dht  *kaddht.IpfsDHT
+	bw   *metrics.BandwidthCounter
+	pace *pacer
+	// dials ranks addresses by how dialing them has gone.
+	dials *dialHistory
+	// sendq counts direct messages in flight, per peer.
+	sendq sendQueue
+	// streams holds the chat streams Send reuses, one per peer.
+	streams streamPool
+	// reputation scores peers' behaviour, throttling and blocking the
+	// worst.
+	reputation *reputation
+	// inbound carries received direct messages from stream handlers to
+	// the one goroutine that hands them to onMessage, in arrival order.
+	inbound chan inboundMessage
+	closed  chan struct{}
+	// delegated is set when Options.DelegatedRouting is.
+	delegated *DelegatedRouter
+
+	mu           sync.RWMutex
+	onMessage    func(from peer.ID, m Message)
+	onBye        func(from peer.ID)
+	onRevocation func(from peer.ID, r Revocation)
+	onRejected   func(from peer.ID, what string, err error)
+	onOffline    func(id peer.ID)
+	offline      map[peer.ID]time.Time // when chat peers went away
+
+	onForwardRequest func(from peer.ID, s Sealed) error
+	onForwarded      func(via peer.ID, s Sealed, m Message)
+
+	profile      Profile
+	features     []Feature
+	presence     presenceBook
+	inboxSeq     uint64 // of the last inbox pointer published
+	directorySeq uint64 // of the last directory record published
+	blocks       *Blockstore
+	fetched      *fetchedLog
+	storeTTL     time.Duration
+	history      func(p peer.ID, room string) ([]HistoryEntry, bool)
+	powFor       func(ctx context.Context, to peer.ID) int
+}
+
+// New starts a libp2p host and DHT.
+func New(ctx context.Context, opts Options) (*Node, error) {
+	bw := metrics.NewBandwidthCounter()
+	dials := newDialHistory(opts.Dialing)
+	fetched, err := loadFetchedLog(opts.FetchedPath)
+	if err != nil {
+		return nil, fmt.Errorf("load fetched messages: %w", err)
+	}
+	h := opts.Host
+	if h == nil {
+		if h, err = newHost(opts, bw, dials); err != nil {
+			return nil, err
+		}
+	}
+	dhtOpts := append(DHTOptions(), opts.DHT...)
+	if len(opts.DelegatedRouting) > 0 {
+		dhtOpts = append([]kaddht.Option{kaddht.Mode(kaddht.ModeClient)}, dhtOpts...)
+	}
+	dht, err := kaddht.New(ctx, h, dhtOpts...)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("create DHT: %w", err)
+	}
+	// Bootstrap the DHT (no external bootstrap nodes used for strict invite-only P2P)
+	if err := dht.Bootstrap(ctx); err != nil {
+		log.Warnf("dht bootstrap error: %s", err)
+	}
+	n := &Node{host: h, dht: dht, bw: bw, storeTTL: opts.StoreTTL, pace: newPacer(opts.Pacing),
+		inbound: make(chan inboundMessage, InboundQueue), closed: make(chan struct{}),
+		offline: make(map[peer.ID]time.Time), dials: dials, reputation: newReputation(), features: opts.Features,
+		fetched: fetched}
+	if len(n.features) == 0 {
+		n.features = []Feature{FeatureChat}
+	}
+	n.presence.peers = make(map[peer.ID]Presence)
+	dials.ps = h.Peerstore()
+	dials.watch(h.Network())
+	go n.deliverInbound()
+	n.watchPeers()
+	n.refuseBlocked()
+	if n.storeTTL <= 0 {
+		n.storeTTL = DefaultStoreTTL
+	}
+	if len(opts.DelegatedRouting) > 0 {
+		n.delegated = NewDelegatedRouter(opts.DelegatedRouting)
+	}
+	h.SetStreamHandler(ProtocolID, Guard(n.handleStream))
+	h.SetStreamHandler(ByeProtocolID, Guard(n.handleBye))
+	h.SetStreamHandler(RevokeProtocolID, Guard(n.handleRevoke))
+	h.SetStreamHandler(ForwardProtocolID, Guard(n.handleForward))
+	h.SetStreamHandler(ProfileProtocolID, Guard(n.handleProfile))
+	h.SetStreamHandler(PresenceProtocolID, Guard(n.handlePresence))
+	return n, nil
+}
+
+func newHost(opts Options, bw *metrics.BandwidthCounter, dials *dialHistory) (host.Host, error) {
+	priv := opts.Identity
+	if priv == nil {
+		if opts.IdentityPath == "" {
+			return nil, errors.New("node: Identity or IdentityPath is required")
+		}
+		var err error
+		if priv, err = loadOrCreateIdentity(opts.IdentityPath, opts.Passphrase); err != nil {
+			return nil, fmt.Errorf("load/create identity: %w", err)
+		}
+	}
+	h, err := buildHost(priv, opts, bw, dials)
+	if err != nil {
+		return nil, fmt.Errorf("create libp2p host: %w", err)
+	}
+	return h, nil
+}
+
+// Host returns the underlying libp2p host.
+func (n *Node) Host() host.Host { return n.host }
+
+// DHT returns the node's DHT.
+func (n *Node) DHT() *kaddht.IpfsDHT { return n.dht }
+
+// Bandwidth returns the host's traffic counters.
+func (n *Node) Bandwidth() *metrics.BandwidthCounter { return n.bw }
+
+// ID returns the node's peer ID.
+func (n *Node) ID() peer.ID { return n.host.ID() }
+
+// Close shuts the DHT and host down.
+func (n *Node) Close() error {
+	close(n.closed)
+	err := n.dht.Close()
+	if herr := n.host.Close(); err == nil {
+		err = herr
+	}
+	return err
+}
+
+// OnMessage sets the callback for incoming direct messages. from is the
+// authenticated remote peer; m.From is whatever the sender claimed.
+func (n *Node) OnMessage(fn func(from peer.ID, m Message)) {
+	n.mu.Lock()
+	n.onMessage = fn
+	n.mu.Unlock()
+}
+
+// OnRejected sets the callback for input dropped because it failed
+// validation: what is "message" or "revocation".
+func (n *Node) OnRejected(fn func(from peer.ID, what string, err error)) {
+	n.mu.Lock()
+	n.onRejected = fn
+	n.mu.Unlock()
+}
+
+// rejected reports bad input from a peer: a message that didn't decode or
+// validate, or a signed revocation or sealed message that didn't verify.
+// Bad signatures and undecodable messages cost the peer reputation; a
+// message that decoded but failed validation doesn't, as a newer version
+// or a skewed clock would get it there.
+func (n *Node) rejected(from peer.ID, what string, err error) {
+	switch {
+	case what != "message":
+		n.penalize(from, OffenseBadSignature, what)
+	case errors.Is(err, ErrUndecodable):
+		n.penalize(from, OffenseMalformed, what)
+	}
+	n.mu.RLock()
+	fn := n.onRejected
+	n.mu.RUnlock()
+	if fn != nil {
+		fn(from, what, err)
+	}
+}
+
+// OnGoodbye sets the callback for peers announcing they're going offline.
+func (n *Node) OnGoodbye(fn func(from peer.ID)) {
+	n.mu.Lock()
+	n.onBye = fn
+	n.mu.Unlock()
+}
+
+// SayGoodbye tells every connected peer that speaks the chat protocol that
+// we're leaving, so they don't have to wait for the connection to time out.
+func (n *Node) SayGoodbye(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range n.host.Network().Peers() {
+		if ok, _ := n.host.Peerstore().SupportsProtocols(p, ByeProtocolID); len(ok) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			s, err := n.host.NewStream(ctx, p, ByeProtocolID)
+			if err != nil {
+				log.Debugf("goodbye to %s: %s", p, err)
+				return
+			}
+			defer s.Close()
+			// Wait for the peer to close its side: it only does so once
+			// the protocol is negotiated, and our host is about to shut
+			// down, which would otherwise cut the negotiation short.
+			if deadline, ok := ctx.Deadline(); ok {
+				_ = s.SetDeadline(deadline)
+			}
+			_ = s.CloseWrite()
+			_, _ = io.Copy(io.Discard, s)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (n *Node) handleBye(s network.Stream) {
+	s.Close()
+	// A goodbye isn't going offline unannounced.
+	n.streams.drop(s.Conn().RemotePeer())
+	n.wentAway(s.Conn().RemotePeer())
+	n.mu.RLock()
+	fn := n.onBye
+	n.mu.RUnlock()
+	if fn != nil {
+		fn(s.Conn().RemotePeer())
+	}
+}
+
+// InviteAddrs returns our listen addresses with /p2p/<id> appended, ready
+// to share with peers.
+func (n *Node) InviteAddrs() []string {
+	var out []string
+	for _, a := range n.host.Addrs() {
+		out = append(out, fmt.Sprintf("%s/p2p/%s", a, n.host.ID()))
+	}
+	return out
+}
+
+// Connect dials a peer given a full multiaddr including /p2p/<peerID>.
+func (n *Node) Connect(ctx context.Context, addr string) (_ peer.ID, err error) {
+	ctx, span := tracer.Start(ctx, "node.Connect", trace.WithAttributes(attribute.String("peer.addr", addr)))
+	defer func() { endSpan(span, err) }()
+	maddr, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return "", err
+	}
+	pi, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return "", err
+	}
+	n.host.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
+	if err := n.host.Connect(ctx, *pi); err != nil {
+		n.dials.noteDialError(err)
+		return "", err
+	}
+	return pi.ID, nil
+}
+
+// Send delivers a direct message over the stream kept open to the peer,
+// opening one if there is none.
+func (n *Node) Send(ctx context.Context, to string, body string) (Message, error) {
+	return n.send(ctx, "node.Send", to, Message{Body: body}, false)
+}
+
+// Deliver is Send, but waits until the peer has read the message and
+// closed its end of the stream, which it only does once the message has
+// been handled. That makes a nil error an acknowledgement.
+func (n *Node) Deliver(ctx context.Context, to string, body string) (Message, error) {
+	return n.send(ctx, "node.Deliver", to, Message{Body: body}, true)
+}
+
+// SendFiles is Deliver for a message with attachments; the files must be
+// in the blockstore passed to ServeBlocks so the peer can fetch them.
+func (n *Node) SendFiles(ctx context.Context, to, body string, files []FileRef) (Message, error) {
+	return n.send(ctx, "node.SendFiles", to, Message{Body: body, Files: files}, true)
+}
+
+func (n *Node) send(ctx context.Context, spanName, to string, m Message, wait bool) (_ Message, err error) {
+	ctx, span := tracer.Start(ctx, spanName, trace.WithAttributes(
+		attribute.String("peer.id", to), attribute.Int("message.size", len(m.Body))))
+	defer func() { endSpan(span, err) }()
+	pid, err := peer.Decode(to)
+	if err != nil {
+		return Message{}, err
+	}
+	m.From, m.When = n.host.ID().String(), time.Now().UnixMilli()
+	if err := ValidateMessage(m, time.Now()); err != nil {
+		return Message{}, err
+	}
+	n.mu.RLock()
+	powFor := n.powFor
+	n.mu.RUnlock()
+	if powFor != nil {
+		if bits := powFor(ctx, pid); bits > 0 {
+			span.SetAttributes(attribute.Int("message.pow_bits", bits))
+			Stamp(&m, to, bits)
+		}
+	}
+	if n.IsOffline(pid) {
+		return Message{}, ErrPeerOffline
+	}
+	done, err := n.sendq.enter(to)
+	if err != nil {
+		return Message{}, err
+	}
+	defer done()
+	if err := n.pace.message(ctx, to); err != nil {
+		return Message{}, err
+	}
+	b, _ := json.Marshal(m)
+	b = append(b, '\n')
+	if !wait {
+		// Nothing to wait for, so the peer's open stream can carry it.
+		if err := n.streams.write(ctx, pid, b); err != nil {
+			n.dials.noteDialError(err)
+			return Message{}, err
+		}
+		return m, nil
+	}
+	s, err := n.host.NewStream(ctx, pid, ProtocolID)
+	if err != nil {
+		n.dials.noteDialError(err)
+		return Message{}, err
+	}
+	defer s.Close()
+	defer bindStream(ctx, s)()
+	if _, err := s.Write(b); err != nil {
+		return Message{}, err
+	}
+	_ = s.CloseWrite()
+	if _, err := io.Copy(io.Discard, s); err != nil {
+		return Message{}, fmt.Errorf("waiting for acknowledgement: %w", err)
+	}
+	return m, nil
+}
+
+// InboundQueue is how many received messages may wait for the OnMessage
+// callback. While it's full, stream handlers stop reading, which slows
+// senders down instead of piling messages up.
+const InboundQueue = 256
+
+type inboundMessage struct {
+	from    peer.ID
+	m       Message
+	handled chan struct{}
+}
+
+// deliverInbound hands received messages to onMessage one at a time, so a
+// slow callback holds up the next message but never a stream handler.
+func (n *Node) deliverInbound() {
+	for {
+		select {
+		case <-n.closed:
+			return
+		case in := <-n.inbound:
+			n.mu.RLock()
+			fn := n.onMessage
+			n.mu.RUnlock()
+			if fn != nil {
+				func() {
+					defer recovered("message delivery")
+					fn(in.from, in.m)
+				}()
+			}
+			close(in.handled)
+		}
+	}
+}
+
+func (n *Node) handleStream(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	sc := bufio.NewScanner(s)
+	sc.Buffer(make([]byte, 4096), MaxMessageSize)
+	// A sender that goes quiet mid-stream is dropped after StreamTimeout.
+	_ = s.SetReadDeadline(time.Now().Add(StreamTimeout))
+	for sc.Scan() {
+		_ = s.SetReadDeadline(time.Now().Add(StreamTimeout))
+		line := bytes.TrimSpace(sc.Bytes())
+		// Empty lines are keep-alives.
+		if len(line) == 0 {
+			continue
+		}
+		if !n.admit(remote) {
+			if n.IsBlocked(remote) {
+				return
+			}
+			log.Debugf("dropping message from throttled %s", remote)
+			continue
+		}
+		m, err := DecodeMessage(line)
+		if err != nil {
+			log.Infof("dropping message from %s: %s", remote, err)
+			n.rejected(remote, "message", err)
+			continue
+		}
+		// Wait until it's handled: closing our end is what Deliver
+		// takes as an acknowledgement.
+		handled := make(chan struct{})
+		select {
+		case n.inbound <- inboundMessage{from: remote, m: m, handled: handled}:
+		case <-n.closed:
+			return
+		}
+		select {
+		case <-handled:
+		case <-n.closed:
+			return
+		}
+		_ = s.SetReadDeadline(time.Now().Add(StreamTimeout))
+	}
+	if err := sc.Err(); err != nil {
+		// Includes lines over MaxMessageSize; the stream is dropped.
+		log.Debugf("stream read from %s: %s", remote, err)
+	}
+}
+
+// StoreOffline leaves a message for an offline recipient at one of the
+// mailboxes its DHT inbox pointer names.
+func (n *Node) StoreOffline(ctx context.Context, recipient string, body string) (_ Message, err error) {
+	ctx, span := tracer.Start(ctx, "node.StoreOffline", trace.WithAttributes(attribute.String("peer.id", recipient)))
+	defer func() { endSpan(span, err) }()
+	p, err := n.ResolveInbox(ctx, recipient)
+	if err != nil {
+		return Message{}, fmt.Errorf("no inbox pointer: %w", err)
+	}
+	span.SetAttributes(attribute.Int64("inbox.seq", int64(p.Seq)))
+	var errs []error
+	for _, mb := range n.inboxMailboxes(p) {
+		m, err := n.Deposit(ctx, mb, recipient, body)
+		if err == nil {
+			return m, nil
+		}
+		errs = append(errs, fmt.Errorf("mailbox %s: %w", mb, err))
+	}
+	if len(errs) == 0 {
+		return Message{}, errors.New("inbox pointer names no mailboxes")
+	}
+	return Message{}, errors.Join(errs...)
+}
+
+// FetchOffline collects our messages from the mailboxes our DHT inbox
+// pointer names. Only the owner of an inbox can collect it.
+func (n *Node) FetchOffline(ctx context.Context, peerID string) (_ []Fetched, err error) {
+	ctx, span := tracer.Start(ctx, "node.FetchOffline", trace.WithAttributes(attribute.String("peer.id", peerID)))
+	defer func() { endSpan(span, err) }()
+	if peerID != n.host.ID().String() {
+		return nil, errors.New("only the owner of an inbox can collect it")
+	}
+	p, err := n.ResolveInbox(ctx, peerID)
+	if err != nil {
+		return nil, fmt.Errorf("no inbox pointer: %w", err)
+	}
+	var msgs []Fetched
+	var errs []error
+	for _, mb := range n.inboxMailboxes(p) {
+		got, err := n.FetchMailbox(ctx, mb)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("mailbox %s: %w", mb, err))
+			continue
+		}
+		msgs = append(msgs, got...)
+	}
+	if len(msgs) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return msgs, nil
+}
+
+// getValue and putValue wrap the DHT calls in their own spans, since DHT
+// queries are usually where the time goes.
+func (n *Node) getValue(ctx context.Context, key string) (_ []byte, err error) {
+	ctx, span := tracer.Start(ctx, "dht.GetValue", trace.WithAttributes(attribute.String("dht.key", key)))
+	defer func() { endSpan(span, err) }()
+	return n.dht.GetValue(ctx, key)
+}
+
+func (n *Node) putValue(ctx context.Context, key string, val []byte) (err error) {
+	ctx, span := tracer.Start(ctx, "dht.PutValue", trace.WithAttributes(attribute.String("dht.key", key)))
+	defer func() { endSpan(span, err) }()
+	if err := n.pace.dhtWrite(ctx); err != nil {
+		return err
+	}
+	return n.dht.PutValue(ctx, key, val)
+}
+
+// LoadOrCreateIdentity loads the node key at path, generating and saving a
+// new Ed25519 key if there is none. Passphrase-protected keys fail with
+// ErrPassphraseRequired.
+func LoadOrCreateIdentity(path string) (crypto.PrivKey, error) {
+	return loadOrCreateIdentity(path, nil)
+}
+
+func loadOrCreateIdentity(path string, passphrase func() ([]byte, error)) (crypto.PrivKey, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return ParseIdentity(b, passphrase)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.Ed25519, -1, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = crypto.MarshalPrivateKey(priv); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
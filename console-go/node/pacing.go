@@ -0,0 +1,176 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Pacing bounds how fast the node sends, so a script or bot can't flood
+// peers or trip their spam protection. Rates are per second; zero leaves
+// one unlimited. Sends over a rate wait their turn rather than fail.
+type Pacing struct {
+	PerPeer float64 // messages to one peer (or room)
+	Global  float64 // messages overall
+	DHT     float64 // DHT writes: records and provider announcements
+	// Burst is how many sends may go at once before pacing starts; 0
+	// means 1.
+	Burst int
+}
+
+// PacingStats is what's waiting on pacing right now.
+type PacingStats struct {
+	Limits   Pacing
+	Messages int            // messages waiting
+	DHT      int            // DHT writes waiting
+	ByPeer   map[string]int // messages waiting, by peer or room
+}
+
+// maxIdleBuckets is how many per-peer buckets are kept before full, idle
+// ones are dropped.
+const maxIdleBuckets = 256
+
+// bucket is a token bucket: tokens refill at the rate up to the burst.
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	waiting int
+}
+
+// take reserves a token and returns how long to wait for it.
+func (b *bucket) take(now time.Time, rate float64, burst int) time.Duration {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// pacer applies a Pacing.
+type pacer struct {
+	limits Pacing
+
+	mu     sync.Mutex
+	global bucket
+	dht    bucket
+	peers  map[string]*bucket
+}
+
+func newPacer(limits Pacing) *pacer {
+	if limits.Burst < 1 {
+		limits.Burst = 1
+	}
+	return &pacer{limits: limits, peers: make(map[string]*bucket)}
+}
+
+// message waits until a message to key may go.
+func (p *pacer) message(ctx context.Context, key string) error {
+	p.mu.Lock()
+	now := time.Now()
+	var wait time.Duration
+	var held []*bucket
+	if p.limits.Global > 0 {
+		wait = max(wait, p.global.take(now, p.limits.Global, p.limits.Burst))
+		held = append(held, &p.global)
+	}
+	if p.limits.PerPeer > 0 {
+		b, ok := p.peers[key]
+		if !ok {
+			p.prune(now)
+			b = new(bucket)
+			p.peers[key] = b
+		}
+		wait = max(wait, b.take(now, p.limits.PerPeer, p.limits.Burst))
+		held = append(held, b)
+	}
+	p.mu.Unlock()
+	return p.await(ctx, wait, held)
+}
+
+// dhtWrite waits until a DHT write may go.
+func (p *pacer) dhtWrite(ctx context.Context) error {
+	if p.limits.DHT <= 0 {
+		return nil
+	}
+	p.mu.Lock()
+	wait := p.dht.take(time.Now(), p.limits.DHT, p.limits.Burst)
+	p.mu.Unlock()
+	return p.await(ctx, wait, []*bucket{&p.dht})
+}
+
+// await sleeps for wait, counted as waiting in held; if ctx ends first the
+// tokens are given back.
+func (p *pacer) await(ctx context.Context, wait time.Duration, held []*bucket) error {
+	if wait <= 0 {
+		return nil
+	}
+	p.mu.Lock()
+	for _, b := range held {
+		b.waiting++
+	}
+	p.mu.Unlock()
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-t.C:
+	}
+	p.mu.Lock()
+	for _, b := range held {
+		b.waiting--
+		if err != nil {
+			b.tokens++
+		}
+	}
+	p.mu.Unlock()
+	return err
+}
+
+// prune drops per-peer buckets that have refilled and have nobody
+// waiting, once there are many. Callers hold p.mu.
+func (p *pacer) prune(now time.Time) {
+	if len(p.peers) < maxIdleBuckets {
+		return
+	}
+	for k, b := range p.peers {
+		if b.waiting == 0 && b.tokens+now.Sub(b.last).Seconds()*p.limits.PerPeer >= float64(p.limits.Burst) {
+			delete(p.peers, k)
+		}
+	}
+}
+
+func (p *pacer) stats() PacingStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := PacingStats{Limits: p.limits, DHT: p.dht.waiting, ByPeer: make(map[string]int)}
+	s.Messages = p.global.waiting
+	for k, b := range p.peers {
+		if b.waiting > 0 {
+			s.ByPeer[k] = b.waiting
+			if p.limits.Global <= 0 {
+				s.Messages += b.waiting
+			}
+		}
+	}
+	return s
+}
+
+// PaceMessage waits until a message to key, a peer ID or a "#room", may
+// go under the node's pacing. Send and Deposit pace themselves; callers
+// that publish elsewhere, like room posts, call it first.
+func (n *Node) PaceMessage(ctx context.Context, key string) error {
+	return n.pace.message(ctx, key)
+}
+
+// PacingStats reports what's waiting on the node's pacing.
+func (n *Node) PacingStats() PacingStats {
+	return n.pace.stats()
+}
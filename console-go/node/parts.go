@@ -0,0 +1,151 @@
+package node
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// MaxParts caps how many parts an oversized offline message is split
+// into, so MaxStoredBody is the largest body a mailbox can be handed.
+const (
+	MaxParts      = 16
+	MaxStoredBody = MaxParts * MaxBodySize
+)
+
+// Part marks a message as one piece of a body too large for a single
+// stored message. Part 0 is the manifest: it carries the total and a hash
+// of the whole body, so the recipient can tell when it has every piece and
+// that they reassemble to what was sent.
+type Part struct {
+	ID    string `json:"id"` // shared by the pieces, 16 hex digits
+	Index int    `json:"index"`
+	Total int    `json:"total,omitempty"` // manifest only
+	Sum   string `json:"sum,omitempty"`   // manifest only: hex SHA-256 of the body
+}
+
+// ErrTooLarge is returned for a body over MaxStoredBody.
+var ErrTooLarge = errors.New("too large for offline delivery")
+
+// SplitBody cuts body into pieces that each fit a message, on UTF-8
+// boundaries, and returns them as messages with Part set. A body that
+// already fits is returned as one message without a Part.
+func SplitBody(body string) ([]Message, error) {
+	if len(body) <= MaxBodySize {
+		return []Message{{Body: body}}, nil
+	}
+	if len(body) > MaxStoredBody {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrTooLarge, len(body), MaxStoredBody)
+	}
+	var pieces []string
+	for rest := body; rest != ""; {
+		cut := min(len(rest), MaxBodySize)
+		for cut < len(rest) && !utf8.RuneStart(rest[cut]) {
+			cut--
+		}
+		pieces = append(pieces, rest[:cut])
+		rest = rest[cut:]
+	}
+	if len(pieces) > MaxParts {
+		return nil, fmt.Errorf("%w: needs %d parts, limit %d", ErrTooLarge, len(pieces), MaxParts)
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(body))
+	msgs := make([]Message, len(pieces))
+	for i, p := range pieces {
+		msgs[i] = Message{Body: p, Part: &Part{ID: hex.EncodeToString(id[:]), Index: i}}
+	}
+	msgs[0].Part.Total, msgs[0].Part.Sum = len(pieces), hex.EncodeToString(sum[:])
+	return msgs, nil
+}
+
+// JoinParts reassembles split messages. Complete sets become one message
+// without a Part, in the place of their manifest; pieces of incomplete or
+// corrupt sets are returned as they are, so nothing silently disappears.
+func JoinParts(msgs []Message) []Message {
+	type set struct {
+		manifest *Message
+		pieces   map[int]string
+	}
+	sets := make(map[string]*set)
+	for i := range msgs {
+		p := msgs[i].Part
+		if p == nil {
+			continue
+		}
+		key := msgs[i].From + "/" + p.ID
+		s := sets[key]
+		if s == nil {
+			s = &set{pieces: make(map[int]string)}
+			sets[key] = s
+		}
+		if p.Index == 0 {
+			s.manifest = &msgs[i]
+		}
+		s.pieces[p.Index] = msgs[i].Body
+	}
+	joined := make(map[string]Message)
+	for key, s := range sets {
+		if s.manifest == nil || len(s.pieces) != s.manifest.Part.Total {
+			continue
+		}
+		var body []byte
+		for i := 0; i < s.manifest.Part.Total; i++ {
+			body = append(body, s.pieces[i]...)
+		}
+		sum := sha256.Sum256(body)
+		if hex.EncodeToString(sum[:]) != s.manifest.Part.Sum {
+			log.Warnf("split message %s doesn't match its hash", key)
+			continue
+		}
+		m := *s.manifest
+		m.Body, m.Part = string(body), nil
+		joined[key] = m
+	}
+	var out []Message
+	for _, m := range msgs {
+		if m.Part == nil {
+			out = append(out, m)
+			continue
+		}
+		key := m.From + "/" + m.Part.ID
+		j, ok := joined[key]
+		switch {
+		case !ok:
+			out = append(out, m)
+		case m.Part.Index == 0:
+			out = append(out, j)
+		}
+	}
+	return out
+}
+
+// validatePart checks a message's Part.
+func validatePart(p *Part) error {
+	if p == nil {
+		return nil
+	}
+	if b, err := hex.DecodeString(p.ID); err != nil || len(b) != 8 {
+		return errors.New("bad part ID")
+	}
+	if p.Index < 0 || p.Index >= MaxParts {
+		return fmt.Errorf("part index %d out of range", p.Index)
+	}
+	if p.Index == 0 {
+		if p.Total < 2 || p.Total > MaxParts {
+			return fmt.Errorf("part total %d out of range", p.Total)
+		}
+		if b, err := hex.DecodeString(p.Sum); err != nil || len(b) != sha256.Size {
+			return errors.New("bad part hash")
+		}
+	} else if p.Total != 0 || p.Sum != "" {
+		return errors.New("only the first part is a manifest")
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"strconv"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// MaxPoWBits caps the proof of work a node may ask of senders; each bit
+// doubles the sender's work, and 28 takes seconds.
+const MaxPoWBits = 28
+
+// powContext is hashed with every stamp so it can't be anything else.
+const powContext = "peep-chat pow:"
+
+// powHash is the hash a stamp must make start with zero bits: it covers
+// the recipient, so a stamp only works for the peer it was made for, and
+// a typed message's payload.
+func powHash(m Message, to string, nonce uint64) [32]byte {
+	h := sha256.New()
+	h.Write([]byte(powContext + to + "\n" + m.From + "\n" + strconv.FormatInt(m.When, 10) + "\n" + m.Room + "\n" + m.Body + "\n"))
+	if m.Type != "" {
+		h.Write([]byte(m.Type + "\n"))
+		h.Write(m.Payload)
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], nonce)
+	h.Write(b[:])
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+func leadingZeros(sum [32]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// Stamp does proof of work on m for recipient to: it finds a nonce making
+// the stamp's hash start with at least n zero bits.
+func Stamp(m *Message, to string, n int) {
+	n = min(n, MaxPoWBits)
+	for nonce := uint64(1); ; nonce++ {
+		if leadingZeros(powHash(*m, to, nonce)) >= n {
+			m.PoW = nonce
+			return
+		}
+	}
+}
+
+// StampBits is how many bits of work m's stamp proves for recipient to;
+// 0 if it has none.
+func StampBits(m Message, to string) int {
+	if m.PoW == 0 {
+		return 0
+	}
+	return leadingZeros(powHash(m, to, m.PoW))
+}
+
+// SetPoW sets how many bits of proof of work a recipient asks of direct
+// messages; they are stamped before sending.
+func (n *Node) SetPoW(bits func(ctx context.Context, to peer.ID) int) {
+	n.mu.Lock()
+	n.powFor = bits
+	n.mu.Unlock()
+}
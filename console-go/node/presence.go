@@ -0,0 +1,170 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// PresenceProtocolID carries a peer's presence to the peers it's
+// connected to.
+const PresenceProtocolID = "/p2pchat/presence/1.0.0"
+
+// Presence states. PresenceOffline is never sent: it's what a peer that
+// went away shows as.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// MaxPresenceStatus caps a presence status message, in bytes.
+const MaxPresenceStatus = 140
+
+// Presence is whether a peer is around, and what it says about itself.
+type Presence struct {
+	State  string `json:"state"`
+	Status string `json:"status,omitempty"`
+	When   int64  `json:"when"` // unix ms
+}
+
+// Validate checks a presence a peer sent.
+func (p Presence) Validate() error {
+	if p.State != PresenceOnline && p.State != PresenceAway {
+		return fmt.Errorf("presence: bad state %q", truncate(p.State, 20))
+	}
+	if len(p.Status) > MaxPresenceStatus {
+		return errors.New("presence: status too long")
+	}
+	if err := checkText(p.Status, ""); err != nil {
+		return fmt.Errorf("presence: status %s", err)
+	}
+	return nil
+}
+
+// presenceBook is our own presence and what peers last told us of theirs.
+type presenceBook struct {
+	mu    sync.Mutex
+	own   Presence
+	quiet bool // don't tell anyone
+	peers map[peer.ID]Presence
+	on    func(from peer.ID, p, prev Presence)
+}
+
+// SetPresence sets our presence and tells connected peers, unless
+// presence is quiet.
+func (n *Node) SetPresence(ctx context.Context, state, status string) error {
+	p := Presence{State: state, Status: status, When: time.Now().UnixMilli()}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	n.presence.mu.Lock()
+	n.presence.own = p
+	n.presence.mu.Unlock()
+	n.AnnouncePresence(ctx, n.host.Network().Peers())
+	return nil
+}
+
+// Presence returns our presence.
+func (n *Node) Presence() Presence {
+	n.presence.mu.Lock()
+	defer n.presence.mu.Unlock()
+	return n.presence.own
+}
+
+// SetPresenceQuiet stops (or restarts) telling peers our presence: while
+// quiet, nothing is announced, so they keep seeing what we said last.
+// Ending it announces our presence again.
+func (n *Node) SetPresenceQuiet(ctx context.Context, quiet bool) {
+	n.presence.mu.Lock()
+	was := n.presence.quiet
+	n.presence.quiet = quiet
+	n.presence.mu.Unlock()
+	if was && !quiet {
+		n.AnnouncePresence(ctx, n.host.Network().Peers())
+	}
+}
+
+// AnnouncePresence tells peers, those of them that speak the presence
+// protocol, our presence. It does nothing while presence is quiet.
+func (n *Node) AnnouncePresence(ctx context.Context, peers []peer.ID) {
+	n.presence.mu.Lock()
+	p, quiet := n.presence.own, n.presence.quiet
+	n.presence.mu.Unlock()
+	if quiet || p.State == "" {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, id := range peers {
+		if ok, _ := n.host.Peerstore().SupportsProtocols(id, PresenceProtocolID); len(ok) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := n.host.NewStream(ctx, id, PresenceProtocolID)
+			if err != nil {
+				log.Debugf("presence to %s: %s", id, err)
+				return
+			}
+			defer s.Close()
+			_ = s.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := writeFrame(s, p); err != nil {
+				log.Debugf("presence to %s: %s", id, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (n *Node) handlePresence(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+	var p Presence
+	if err := readFrame(s, &p); err != nil {
+		log.Debugf("presence from %s: %s", remote, err)
+		return
+	}
+	if err := p.Validate(); err != nil {
+		log.Debugf("dropping presence from %s: %s", remote, err)
+		return
+	}
+	n.presence.mu.Lock()
+	prev := n.presence.peers[remote]
+	n.presence.peers[remote] = p
+	fn := n.presence.on
+	n.presence.mu.Unlock()
+	if fn != nil {
+		fn(remote, p, prev)
+	}
+}
+
+// wentAway shows id as offline from now.
+func (n *Node) wentAway(id peer.ID) {
+	n.presence.mu.Lock()
+	n.presence.peers[id] = Presence{State: PresenceOffline, When: time.Now().UnixMilli()}
+	n.presence.mu.Unlock()
+}
+
+// PeerPresence returns what p last told us of its presence, or offline
+// if it has since gone; ok is false if it never told us.
+func (n *Node) PeerPresence(p peer.ID) (_ Presence, ok bool) {
+	n.presence.mu.Lock()
+	defer n.presence.mu.Unlock()
+	pr, ok := n.presence.peers[p]
+	return pr, ok
+}
+
+// OnPresence sets the callback for peers telling us their presence; prev
+// is what we had for them before, if anything.
+func (n *Node) OnPresence(fn func(from peer.ID, p, prev Presence)) {
+	n.presence.mu.Lock()
+	n.presence.on = fn
+	n.presence.mu.Unlock()
+}
@@ -0,0 +1,57 @@
+package node
+
+import (
+	"runtime/debug"
+	"sync"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+)
+
+var panics struct {
+	mu sync.Mutex
+	fn func(where string, v any, stack []byte)
+}
+
+// OnPanic sets what's told about panics recovered in stream handlers and
+// message delivery, which otherwise are only logged. The node carries on
+// either way; only the stream or message at fault is lost.
+func OnPanic(fn func(where string, v any, stack []byte)) {
+	panics.mu.Lock()
+	panics.fn = fn
+	panics.mu.Unlock()
+}
+
+// recovered is deferred by code that must not take the process down with
+// it. where names what was running.
+func recovered(where string) {
+	if v := recover(); v != nil {
+		reportPanic(where, v)
+	}
+}
+
+// reportPanic logs v with the stack, which still holds the panicking
+// frames when called from a deferred recover, and tells OnPanic.
+func reportPanic(where string, v any) {
+	stack := debug.Stack()
+	log.Errorf("panic in %s: %v\n%s", where, v, stack)
+	panics.mu.Lock()
+	fn := panics.fn
+	panics.mu.Unlock()
+	if fn != nil {
+		fn(where, v, stack)
+	}
+}
+
+// Guard wraps a stream handler so a panic in it resets the stream and is
+// reported through OnPanic instead of crashing the node.
+func Guard(h network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		defer func() {
+			if v := recover(); v != nil {
+				_ = s.Reset()
+				reportPanic("stream handler "+string(s.Protocol()), v)
+			}
+		}()
+		h(s)
+	}
+}
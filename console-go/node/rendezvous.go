@@ -0,0 +1,158 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// RendezvousProtocolID lets peers meet under a shared name (a group, a
+// room) at a well-known node: each registers its addresses there and asks
+// who else is registered.
+const RendezvousProtocolID = "/p2pchat/rendezvous/1.0.0"
+
+// RendezvousTTL is how long a registration lasts unless renewed.
+const RendezvousTTL = 2 * time.Hour
+
+type rendezvousRequest struct {
+	Namespace string   `json:"ns"`
+	Addrs     []string `json:"addrs"`
+}
+
+type rendezvousResponse struct {
+	Error string           `json:"error,omitempty"`
+	Peers []rendezvousPeer `json:"peers,omitempty"`
+}
+
+type rendezvousPeer struct {
+	ID    peer.ID  `json:"id"`
+	Addrs []string `json:"addrs"`
+}
+
+type registration struct {
+	addrs   []string
+	expires time.Time
+}
+
+// Rendezvous is the server side of RendezvousProtocolID.
+type Rendezvous struct {
+	// perPeer caps the namespaces one peer may be registered in.
+	perPeer int
+
+	mu  sync.Mutex
+	reg map[string]map[peer.ID]registration
+}
+
+// NewRendezvous returns an empty rendezvous point.
+func NewRendezvous(perPeer int) *Rendezvous {
+	return &Rendezvous{perPeer: perPeer, reg: make(map[string]map[peer.ID]registration)}
+}
+
+// Serve handles rendezvous streams on h.
+func (rv *Rendezvous) Serve(h host.Host) {
+	h.SetStreamHandler(RendezvousProtocolID, Guard(rv.handleStream))
+}
+
+func (rv *Rendezvous) handleStream(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+	var req rendezvousRequest
+	if err := readFrame(s, &req); err != nil {
+		log.Debugf("rendezvous request from %s: %s", remote, err)
+		return
+	}
+	var resp rendezvousResponse
+	if peers, err := rv.register(remote, req); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Peers = peers
+	}
+	if err := writeFrame(s, resp); err != nil {
+		log.Debugf("rendezvous response to %s: %s", remote, err)
+	}
+}
+
+// register records p under req.Namespace and returns the other live
+// registrations there.
+func (rv *Rendezvous) register(p peer.ID, req rendezvousRequest) ([]rendezvousPeer, error) {
+	if req.Namespace == "" || len(req.Namespace) > 256 {
+		return nil, fmt.Errorf("bad namespace")
+	}
+	if len(req.Addrs) > 32 {
+		req.Addrs = req.Addrs[:32]
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	now := time.Now()
+	count := 0
+	for ns, regs := range rv.reg {
+		for id, r := range regs {
+			if now.After(r.expires) {
+				delete(regs, id)
+			} else if id == p && ns != req.Namespace {
+				count++
+			}
+		}
+		if len(regs) == 0 {
+			delete(rv.reg, ns)
+		}
+	}
+	if rv.perPeer > 0 && count >= rv.perPeer {
+		return nil, fmt.Errorf("registered in too many namespaces (limit %d)", rv.perPeer)
+	}
+	regs := rv.reg[req.Namespace]
+	if regs == nil {
+		regs = make(map[peer.ID]registration)
+		rv.reg[req.Namespace] = regs
+	}
+	regs[p] = registration{addrs: req.Addrs, expires: now.Add(RendezvousTTL)}
+	var out []rendezvousPeer
+	for id, r := range regs {
+		if id != p {
+			out = append(out, rendezvousPeer{ID: id, Addrs: r.addrs})
+		}
+	}
+	return out, nil
+}
+
+// Meet registers our addresses under namespace at the rendezvous point and
+// returns the other peers registered there.
+func (n *Node) Meet(ctx context.Context, point peer.ID, namespace string) ([]peer.AddrInfo, error) {
+	s, err := n.host.NewStream(ctx, point, RendezvousProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	var addrs []string
+	for _, a := range n.host.Addrs() {
+		addrs = append(addrs, a.String())
+	}
+	if err := writeFrame(s, rendezvousRequest{Namespace: namespace, Addrs: addrs}); err != nil {
+		return nil, err
+	}
+	var resp rendezvousResponse
+	if err := readFrame(s, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("rendezvous: %s", resp.Error)
+	}
+	var out []peer.AddrInfo
+	for _, p := range resp.Peers {
+		pi := peer.AddrInfo{ID: p.ID}
+		for _, s := range p.Addrs {
+			if a, err := ma.NewMultiaddr(s); err == nil {
+				pi.Addrs = append(pi.Addrs, a)
+			}
+		}
+		out = append(out, pi)
+	}
+	return out, nil
+}
@@ -0,0 +1,293 @@
+package node
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Reputation scores run from MaxScore down. Offenses cost points, and a
+// point comes back for every ScoreRecovery without one. Below
+// ThrottleScore a peer's messages are rate limited and its relaying and
+// history requests wait behind everyone else's; below BlockScore it's
+// blocked, its connections closed and refused, until Unblock.
+const (
+	MaxScore      = 100
+	ThrottleScore = 50
+	BlockScore    = 0
+	ScoreRecovery = time.Minute
+)
+
+// Offense is something a peer did that costs it reputation.
+type Offense string
+
+const (
+	OffenseMalformed    Offense = "malformed"     // input that didn't decode
+	OffenseFlood        Offense = "flood"         // a message over FloodRate
+	OffenseBadSignature Offense = "bad-signature" // a signature that didn't verify
+	OffenseSpam         Offense = "spam"          // caught by spam rules, or reported
+)
+
+var offenseCost = map[Offense]int{
+	OffenseMalformed:    5,
+	OffenseFlood:        2,
+	OffenseBadSignature: 25,
+	OffenseSpam:         10,
+}
+
+// A peer may send FloodRate messages a second, in bursts of FloodBurst,
+// before each one counts as flooding. A throttled peer gets ThrottledRate
+// and ThrottledBurst, and messages over those are dropped.
+const (
+	FloodRate      = 5.0
+	FloodBurst     = 20
+	ThrottledRate  = 0.2
+	ThrottledBurst = 3
+)
+
+// DeprioritizedDelay is how long a throttled peer's relaying and history
+// requests wait before they're served, one at a time.
+const DeprioritizedDelay = 5 * time.Second
+
+// ErrBlocked is returned to, and for, peers blocked for their reputation.
+var ErrBlocked = errors.New("peer is blocked")
+
+// PeerReputation is a peer's standing.
+type PeerReputation struct {
+	Score    int             `json:"score"`
+	Updated  time.Time       `json:"updated"` // when Score was set; recovery counts from here
+	Offenses map[Offense]int `json:"offenses,omitempty"`
+	Last     string          `json:"last,omitempty"` // the latest offense, with detail
+	Blocked  bool            `json:"blocked,omitempty"`
+}
+
+// At is r's score at now, with what it has recovered.
+func (r PeerReputation) At(now time.Time) int {
+	if r.Updated.IsZero() {
+		return MaxScore
+	}
+	return min(MaxScore, r.Score+int(now.Sub(r.Updated)/ScoreRecovery))
+}
+
+// Throttled reports whether r is rate limited at now.
+func (r PeerReputation) Throttled(now time.Time) bool {
+	return r.Blocked || r.At(now) < ThrottleScore
+}
+
+type reputation struct {
+	mu       sync.Mutex
+	peers    map[peer.ID]PeerReputation
+	floods   map[peer.ID]*bucket
+	throttle map[peer.ID]*bucket
+	onChange func(p peer.ID, r PeerReputation)
+
+	slow sync.Mutex // held while a throttled peer's request is served
+}
+
+func newReputation() *reputation {
+	return &reputation{
+		peers:    make(map[peer.ID]PeerReputation),
+		floods:   make(map[peer.ID]*bucket),
+		throttle: make(map[peer.ID]*bucket),
+	}
+}
+
+// allow takes a token if there is one, without going into debt.
+func (b *bucket) allow(now time.Time, rate float64, burst int) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// penalize charges p for offense and reports whether that blocked it.
+func (n *Node) penalize(p peer.ID, offense Offense, detail string) bool {
+	rp := n.reputation
+	rp.mu.Lock()
+	now := time.Now()
+	r := rp.peers[p]
+	r.Score, r.Updated = r.At(now)-offenseCost[offense], now
+	// Copied, since records handed out share the map.
+	offenses := make(map[Offense]int, len(r.Offenses)+1)
+	for o, c := range r.Offenses {
+		offenses[o] = c
+	}
+	offenses[offense]++
+	r.Offenses = offenses
+	r.Last = string(offense)
+	if detail != "" {
+		r.Last += ": " + detail
+	}
+	blocked := !r.Blocked && r.Score < BlockScore
+	if blocked {
+		r.Blocked = true
+	}
+	rp.peers[p] = r
+	fn := rp.onChange
+	rp.mu.Unlock()
+	log.Debugf("%s: %s (reputation %d)", p, r.Last, r.Score)
+	if blocked {
+		log.Infof("blocked %s for its reputation (%s)", p, r.Last)
+		_ = n.host.Network().ClosePeer(p)
+	}
+	if fn != nil {
+		fn(p, r)
+	}
+	return blocked
+}
+
+// Report charges p for offense, for misbehaviour the node can't see
+// itself, such as spam.
+func (n *Node) Report(p peer.ID, offense Offense, detail string) {
+	n.penalize(p, offense, detail)
+}
+
+// admit decides whether a message from p is taken: not if p is blocked,
+// or throttled and over ThrottledRate. Messages over FloodRate count
+// against it.
+func (n *Node) admit(p peer.ID) bool {
+	rp := n.reputation
+	rp.mu.Lock()
+	now := time.Now()
+	r := rp.peers[p]
+	if r.Blocked {
+		rp.mu.Unlock()
+		return false
+	}
+	if len(rp.floods) > maxIdleBuckets {
+		// Forgetting them only forgives bursts in progress.
+		clear(rp.floods)
+		clear(rp.throttle)
+	}
+	fb := rp.floods[p]
+	if fb == nil {
+		fb = new(bucket)
+		rp.floods[p] = fb
+	}
+	flooding := !fb.allow(now, FloodRate, FloodBurst)
+	ok := true
+	if r.Throttled(now) {
+		tb := rp.throttle[p]
+		if tb == nil {
+			tb = new(bucket)
+			rp.throttle[p] = tb
+		}
+		ok = tb.allow(now, ThrottledRate, ThrottledBurst)
+	}
+	rp.mu.Unlock()
+	if flooding && n.penalize(p, OffenseFlood, "") {
+		return false
+	}
+	return ok
+}
+
+// serve admits a relaying or history request from p: refused if p is
+// blocked, and after DeprioritizedDelay, one at a time, if it's throttled.
+// Call the returned func when done.
+func (n *Node) serve(p peer.ID) (func(), error) {
+	r := n.Reputation(p)
+	if r.Blocked {
+		return nil, ErrBlocked
+	}
+	if !r.Throttled(time.Now()) {
+		return func() {}, nil
+	}
+	time.Sleep(DeprioritizedDelay)
+	n.reputation.slow.Lock()
+	return n.reputation.slow.Unlock, nil
+}
+
+// Reputation returns p's standing, its Score as of now.
+func (n *Node) Reputation(p peer.ID) PeerReputation {
+	n.reputation.mu.Lock()
+	defer n.reputation.mu.Unlock()
+	r := n.reputation.peers[p]
+	r.Score = r.At(time.Now())
+	return r
+}
+
+// Reputations returns every peer with a record, as stored: Score as of
+// Updated, so it can be restored later with RestoreReputations.
+func (n *Node) Reputations() map[peer.ID]PeerReputation {
+	n.reputation.mu.Lock()
+	defer n.reputation.mu.Unlock()
+	out := make(map[peer.ID]PeerReputation, len(n.reputation.peers))
+	for p, r := range n.reputation.peers {
+		out[p] = r
+	}
+	return out
+}
+
+// RestoreReputations loads records saved from Reputations.
+func (n *Node) RestoreReputations(rs map[peer.ID]PeerReputation) {
+	n.reputation.mu.Lock()
+	defer n.reputation.mu.Unlock()
+	for p, r := range rs {
+		n.reputation.peers[p] = r
+	}
+}
+
+// Block blocks p until Unblock, whatever its score.
+func (n *Node) Block(p peer.ID) {
+	n.setBlocked(p, true)
+	_ = n.host.Network().ClosePeer(p)
+}
+
+// Unblock lifts p's block and clears its record.
+func (n *Node) Unblock(p peer.ID) {
+	n.setBlocked(p, false)
+}
+
+func (n *Node) setBlocked(p peer.ID, blocked bool) {
+	rp := n.reputation
+	rp.mu.Lock()
+	r := rp.peers[p]
+	if blocked {
+		now := time.Now()
+		r.Score, r.Updated, r.Blocked = r.At(now), now, true
+		rp.peers[p] = r
+	} else {
+		r = PeerReputation{}
+		delete(rp.peers, p)
+		delete(rp.throttle, p)
+	}
+	fn := rp.onChange
+	rp.mu.Unlock()
+	if fn != nil {
+		fn(p, r)
+	}
+}
+
+// IsBlocked reports whether p is blocked.
+func (n *Node) IsBlocked(p peer.ID) bool {
+	return n.Reputation(p).Blocked
+}
+
+// OnReputation sets the callback for a peer's record changing: an offense
+// charged, or a block set or lifted.
+func (n *Node) OnReputation(fn func(p peer.ID, r PeerReputation)) {
+	n.reputation.mu.Lock()
+	n.reputation.onChange = fn
+	n.reputation.mu.Unlock()
+}
+
+// refuseBlocked closes connections from blocked peers as they're made.
+func (n *Node) refuseBlocked() {
+	n.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			if n.IsBlocked(c.RemotePeer()) {
+				go c.Close()
+			}
+		},
+	})
+}
@@ -0,0 +1,155 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// RevokeProtocolID hands a revocation certificate to a peer.
+	RevokeProtocolID = "/p2pchat/revoke/1.0.0"
+	// DHTRevocationPrefix is where a peer's revocation is published
+	// (/p2pchat/v2/revoked/<peerID>).
+	DHTRevocationPrefix = DHTNamespace + "revoked/"
+)
+
+// revocationContext is signed along with the certificate so the signature
+// can't be passed off as anything else.
+const revocationContext = "peep-chat revocation:"
+
+// Revocation is a certificate, signed by an identity's own key, declaring
+// that key compromised. It can be made ahead of time and kept somewhere
+// safe, then published when the key is lost.
+type Revocation struct {
+	Peer    string `json:"peer"`
+	Created int64  `json:"created"` // unix ms
+	// Since (unix ms) is when the key stopped being trustworthy. Zero
+	// means from whenever a peer first sees the certificate, which is
+	// what a certificate made in advance says.
+	Since  int64  `json:"since,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Sig    []byte `json:"sig"`
+}
+
+// NewRevocation signs a revocation of priv's identity. since may be zero.
+func NewRevocation(priv crypto.PrivKey, reason string, since time.Time) (Revocation, error) {
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return Revocation{}, err
+	}
+	r := Revocation{Peer: id.String(), Created: time.Now().UnixMilli(), Reason: reason}
+	if !since.IsZero() {
+		r.Since = since.UnixMilli()
+	}
+	if r.Sig, err = priv.Sign(r.signedBytes()); err != nil {
+		return Revocation{}, err
+	}
+	return r, nil
+}
+
+func (r Revocation) signedBytes() []byte {
+	r.Sig = nil
+	b, _ := json.Marshal(r)
+	return append([]byte(revocationContext), b...)
+}
+
+// Verify checks that r is signed by the key of the peer it revokes.
+func (r Revocation) Verify() error {
+	id, err := peer.Decode(r.Peer)
+	if err != nil {
+		return fmt.Errorf("revocation: %w", err)
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("revocation: %w", err)
+	}
+	ok, err := pub.Verify(r.signedBytes(), r.Sig)
+	if err != nil {
+		return fmt.Errorf("revocation: %w", err)
+	}
+	if !ok {
+		return errors.New("revocation: bad signature")
+	}
+	return nil
+}
+
+// DecodeRevocation parses and verifies a certificate.
+func DecodeRevocation(b []byte) (Revocation, error) {
+	var r Revocation
+	if err := json.Unmarshal(b, &r); err != nil {
+		return Revocation{}, fmt.Errorf("revocation: %w", err)
+	}
+	return r, r.Verify()
+}
+
+// OnRevocation sets the callback for verified certificates peers hand us.
+func (n *Node) OnRevocation(fn func(from peer.ID, r Revocation)) {
+	n.mu.Lock()
+	n.onRevocation = fn
+	n.mu.Unlock()
+}
+
+func (n *Node) handleRevoke(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+	var r Revocation
+	if err := readFrame(s, &r); err != nil {
+		log.Debugf("revocation from %s: %s", remote, err)
+		return
+	}
+	if err := r.Verify(); err != nil {
+		log.Infof("dropping revocation from %s: %s", remote, err)
+		n.rejected(remote, "revocation", err)
+		return
+	}
+	n.mu.RLock()
+	fn := n.onRevocation
+	n.mu.RUnlock()
+	if fn != nil {
+		fn(remote, r)
+	}
+}
+
+// SendRevocation hands r to one peer.
+func (n *Node) SendRevocation(ctx context.Context, to peer.ID, r Revocation) (err error) {
+	ctx, span := tracer.Start(ctx, "node.SendRevocation", trace.WithAttributes(attribute.String("peer.id", to.String())))
+	defer func() { endSpan(span, err) }()
+	s, err := n.host.NewStream(ctx, to, RevokeProtocolID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return writeFrame(s, r)
+}
+
+// PublishRevocation stores r in the DHT, where FetchRevocation finds it.
+func (n *Node) PublishRevocation(ctx context.Context, r Revocation) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return n.putRecord(ctx, DHTRevocationPrefix+r.Peer, b)
+}
+
+// FetchRevocation looks up a published revocation of peerID.
+func (n *Node) FetchRevocation(ctx context.Context, peerID string) (Revocation, error) {
+	val, err := n.getRecord(ctx, DHTRevocationPrefix+peerID)
+	if err != nil {
+		return Revocation{}, err
+	}
+	r, err := DecodeRevocation(val)
+	if err == nil && r.Peer != peerID {
+		err = errors.New("revocation: stored under the wrong peer")
+	}
+	return r, err
+}
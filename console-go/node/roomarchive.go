@@ -0,0 +1,89 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// roomArchiveContext is signed along with a room archive so the signature
+// can't be passed off as anything else.
+const roomArchiveContext = "peep-chat room archive:"
+
+// MaxArchiveMessages and MaxArchiveChanges bound what one room archive
+// holds.
+const (
+	MaxArchiveMessages = 5000
+	MaxArchiveChanges  = 5000
+)
+
+// MembershipChange is a peer joining or leaving a room, as whoever
+// recorded it saw it happen.
+type MembershipChange struct {
+	Peer   string `json:"peer"`
+	Joined bool   `json:"joined"` // false: left
+	When   int64  `json:"when"`   // unix ms
+}
+
+// RoomArchive is a room's history from Since on, self-contained: its
+// messages in full and the membership changes seen, in time order, signed
+// by the Exporter. The signature vouches for the archive as the exporter
+// had it; the messages themselves are only as trustworthy as the exporter.
+type RoomArchive struct {
+	Room       string             `json:"room"`
+	Since      int64              `json:"since"` // unix ms
+	Exported   int64              `json:"exported"`
+	Exporter   string             `json:"exporter"`
+	Messages   []Message          `json:"messages"`
+	Membership []MembershipChange `json:"membership,omitempty"`
+	Sig        []byte             `json:"sig"`
+}
+
+// SignRoomArchive makes us r's exporter and signs it.
+func (n *Node) SignRoomArchive(r *RoomArchive) error {
+	r.Exporter, r.Exported = n.host.ID().String(), time.Now().UnixMilli()
+	var err error
+	r.Sig, err = n.host.Peerstore().PrivKey(n.host.ID()).Sign(r.signedBytes())
+	return err
+}
+
+func (r RoomArchive) signedBytes() []byte {
+	r.Sig = nil
+	b, _ := json.Marshal(r)
+	return append([]byte(roomArchiveContext), b...)
+}
+
+// Verify checks that r is signed by its exporter and that every message
+// is a valid one of its room, and every membership change well formed.
+func (r RoomArchive) Verify(now time.Time) error {
+	if err := checkRoomName(r.Room); err != nil {
+		return fmt.Errorf("room archive: %w", err)
+	}
+	if len(r.Messages) > MaxArchiveMessages || len(r.Membership) > MaxArchiveChanges {
+		return errors.New("room archive: too large")
+	}
+	id, err := peer.Decode(r.Exporter)
+	if err != nil {
+		return fmt.Errorf("room archive: exporter: %w", err)
+	}
+	if err := verifyBy(id, r.signedBytes(), r.Sig); err != nil {
+		return fmt.Errorf("room archive: %w", err)
+	}
+	for i, m := range r.Messages {
+		if m.Room != r.Room {
+			return fmt.Errorf("room archive: message %d is of room %q", i+1, truncate(m.Room, MaxRoomName))
+		}
+		if err := ValidateMessage(m, now); err != nil {
+			return fmt.Errorf("room archive: message %d: %w", i+1, err)
+		}
+	}
+	for i, c := range r.Membership {
+		if _, err := peer.Decode(c.Peer); err != nil {
+			return fmt.Errorf("room archive: membership change %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package node
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// sealContext is signed and authenticated along with a sealed message so
+// neither can be passed off as anything else.
+const sealContext = "peep-chat sealed:"
+
+// Sealed is a message encrypted for its recipient alone and signed by its
+// sender, so whoever carries it can neither read nor alter it. The key is
+// agreed with X25519 between a fresh ephemeral key and the recipient's
+// Ed25519 identity key; the body is AES-256-GCM.
+type Sealed struct {
+	ID        string `json:"id"` // random; recipients drop copies they've seen
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Created   int64  `json:"created"`           // unix ms
+	Expires   int64  `json:"expires,omitempty"` // unix ms; carriers drop it after
+	Ephemeral []byte `json:"ephemeral"`         // X25519 public key
+	Nonce     []byte `json:"nonce"`
+	Data      []byte `json:"data"`
+	Sig       []byte `json:"sig"`
+}
+
+// Seal encrypts m for to and signs it with priv, the sender's key.
+func Seal(priv crypto.PrivKey, to peer.ID, m Message) (Sealed, error) {
+	from, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return Sealed{}, err
+	}
+	pub, err := to.ExtractPublicKey()
+	if err != nil {
+		return Sealed{}, fmt.Errorf("seal: %w", err)
+	}
+	recipient, err := x25519Public(pub)
+	if err != nil {
+		return Sealed{}, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Sealed{}, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Sealed{}, err
+	}
+	s := Sealed{ID: hex.EncodeToString(id), From: from.String(), To: to.String(),
+		Created: time.Now().UnixMilli(), Expires: m.Expires, Ephemeral: eph.PublicKey().Bytes()}
+	gcm, err := sealCipher(eph, recipient)
+	if err != nil {
+		return Sealed{}, err
+	}
+	s.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return Sealed{}, err
+	}
+	plain, err := json.Marshal(m)
+	if err != nil {
+		return Sealed{}, err
+	}
+	s.Data = gcm.Seal(nil, s.Nonce, plain, s.header())
+	if s.Sig, err = priv.Sign(s.signedBytes()); err != nil {
+		return Sealed{}, err
+	}
+	return s, nil
+}
+
+// header is the authenticated data: everything but the ciphertext and
+// signature.
+func (s Sealed) header() []byte {
+	s.Data, s.Sig = nil, nil
+	b, _ := json.Marshal(s)
+	return append([]byte(sealContext), b...)
+}
+
+func (s Sealed) signedBytes() []byte {
+	s.Sig = nil
+	b, _ := json.Marshal(s)
+	return append([]byte(sealContext), b...)
+}
+
+// Verify checks that s is signed by the key of the peer it is from.
+func (s Sealed) Verify() error {
+	id, err := peer.Decode(s.From)
+	if err != nil {
+		return fmt.Errorf("sealed: %w", err)
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("sealed: %w", err)
+	}
+	ok, err := pub.Verify(s.signedBytes(), s.Sig)
+	if err != nil {
+		return fmt.Errorf("sealed: %w", err)
+	}
+	if !ok {
+		return errors.New("sealed: bad signature")
+	}
+	return nil
+}
+
+// Open verifies s and decrypts it with priv, the recipient's key. The
+// message inside must claim the same sender as the envelope.
+func Open(priv crypto.PrivKey, s Sealed) (Message, error) {
+	if err := s.Verify(); err != nil {
+		return Message{}, err
+	}
+	self, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return Message{}, err
+	}
+	if s.To != self.String() {
+		return Message{}, errors.New("sealed: not addressed to us")
+	}
+	own, err := x25519Private(priv)
+	if err != nil {
+		return Message{}, err
+	}
+	eph, err := ecdh.X25519().NewPublicKey(s.Ephemeral)
+	if err != nil {
+		return Message{}, fmt.Errorf("sealed: %w", err)
+	}
+	gcm, err := sealCipher(own, eph)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(s.Nonce) != gcm.NonceSize() {
+		return Message{}, errors.New("sealed: bad nonce")
+	}
+	plain, err := gcm.Open(nil, s.Nonce, s.Data, s.header())
+	if err != nil {
+		return Message{}, errors.New("sealed: can't decrypt")
+	}
+	m, err := DecodeMessage(plain)
+	if err != nil {
+		return Message{}, err
+	}
+	if m.From != s.From {
+		return Message{}, fmt.Errorf("%w: sealed by %s but claims %s", ErrInvalidMessage, s.From, truncate(m.From, 64))
+	}
+	return m, nil
+}
+
+// sealCipher derives the AES-256-GCM key from an X25519 exchange.
+func sealCipher(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("sealed: %w", err)
+	}
+	key := sha256.Sum256(append([]byte(sealContext), shared...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// curve25519P is the field prime 2^255 - 19.
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// x25519Public converts an Ed25519 identity key to its X25519 form: the
+// Montgomery u = (1 + y) / (1 - y) of the Edwards point.
+func x25519Public(pub crypto.PubKey) (*ecdh.PublicKey, error) {
+	if pub.Type() != crypto.Ed25519 {
+		return nil, errors.New("sealed: only Ed25519 identities can receive sealed messages")
+	}
+	raw, err := pub.Raw()
+	if err != nil {
+		return nil, err
+	}
+	le := make([]byte, len(raw))
+	for i, b := range raw {
+		le[len(raw)-1-i] = b
+	}
+	le[0] &= 0x7f // the sign of x
+	y := new(big.Int).SetBytes(le)
+	num := new(big.Int).Add(big.NewInt(1), y)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, errors.New("sealed: invalid Ed25519 key")
+	}
+	u := num.Mul(num, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return ecdh.X25519().NewPublicKey(out)
+}
+
+// x25519Private converts an Ed25519 identity key to the X25519 scalar
+// matching x25519Public: the hashed seed, which X25519 clamps.
+func x25519Private(priv crypto.PrivKey) (*ecdh.PrivateKey, error) {
+	if priv.Type() != crypto.Ed25519 {
+		return nil, errors.New("sealed: only Ed25519 identities can open sealed messages")
+	}
+	raw, err := priv.Raw()
+	if err != nil {
+		return nil, err
+	}
+	h := sha512.Sum512(raw[:32])
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
@@ -0,0 +1,63 @@
+package node
+
+import (
+	"github.com/libp2p/go-libp2p/core/control"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Security transport choices for Options.Security.
+const (
+	SecurityBoth  = "both"
+	SecurityNoise = "noise"
+	SecurityTLS   = "tls"
+)
+
+// ConnSecurity names what encrypts c: the negotiated security protocol
+// of an upgraded connection (TCP, WebSocket, relayed), or the one built
+// into QUIC, WebTransport and WebRTC. "" means c is plaintext.
+func ConnSecurity(c network.Conn) string {
+	st := c.ConnState()
+	if st.Security != "" {
+		return string(st.Security)
+	}
+	switch st.Transport {
+	case "quic", "quic-v1", "webtransport":
+		return "tls 1.3 (built into " + st.Transport + ")"
+	case "webrtc-direct":
+		return "dtls (built into " + st.Transport + ")"
+	}
+	return ""
+}
+
+// ConnMuxer names the stream multiplexer of c, negotiated or built in.
+func ConnMuxer(c network.Conn) string {
+	st := c.ConnState()
+	if st.StreamMultiplexer != "" {
+		return string(st.StreamMultiplexer)
+	}
+	if st.Transport != "" {
+		return "built into " + st.Transport
+	}
+	return ""
+}
+
+// plaintextGater closes any connection that ConnSecurity finds
+// unencrypted (Options.RefusePlaintext).
+type plaintextGater struct{}
+
+func (plaintextGater) InterceptPeerDial(peer.ID) bool               { return true }
+func (plaintextGater) InterceptAddrDial(peer.ID, ma.Multiaddr) bool { return true }
+func (plaintextGater) InterceptAccept(network.ConnMultiaddrs) bool  { return true }
+func (plaintextGater) InterceptSecured(network.Direction, peer.ID, network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (plaintextGater) InterceptUpgraded(c network.Conn) (bool, control.DisconnectReason) {
+	if ConnSecurity(c) == "" {
+		log.Warnf("refusing plaintext connection with %s over %s", c.RemotePeer(), c.RemoteMultiaddr())
+		return false, 0
+	}
+	return true, 0
+}
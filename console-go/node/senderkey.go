@@ -0,0 +1,347 @@
+package node
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Encrypted rooms. The room's owner signs a roster of its members; every
+// member encrypts what it posts with a sender key of its own, a hash
+// ratchet it hands each other member directly. Whenever the roster changes
+// every member makes a new sender key and hands it only to the members
+// left, so someone removed can't read what is posted after.
+const (
+	// TypeEncrypted is a room message encrypted with its sender's key;
+	// see Message.Cipher.
+	TypeEncrypted = "encrypted"
+	// TypeRoomRoster carries a RoomRoster, from its owner or relayed.
+	TypeRoomRoster = "room.roster"
+	// TypeRoomKey hands a member our SenderKey for the room.
+	TypeRoomKey = "room.key"
+	// TypeRoomKeyRequest asks a member for its current sender key.
+	TypeRoomKeyRequest = "room.keyreq"
+	// TypeRoomPart tells the owner we left the room.
+	TypeRoomPart = "room.part"
+)
+
+// rosterContext is signed along with a roster so the signature can't be
+// passed off as anything else.
+const rosterContext = "peep-chat room roster:"
+
+// MaxRosterMembers bounds an encrypted room's members, and its banned
+// peers.
+const MaxRosterMembers = 100
+
+// MaxSenderKeySkip bounds how far ahead of the last message seen one may
+// be; keys for the messages skipped are kept for when they arrive late.
+const MaxSenderKeySkip = 1000
+
+// RoomRoster is who may read an encrypted room, signed by its owner. Epoch
+// goes up with every change.
+type RoomRoster struct {
+	Room    string   `json:"room"`
+	Owner   string   `json:"owner"`
+	Epoch   uint64   `json:"epoch"`
+	Members []string `json:"members"` // sorted; includes the owner
+	Banned  []string `json:"banned,omitempty"`
+	Sig     []byte   `json:"sig"`
+}
+
+// SignRoomRoster makes us r's owner and signs it.
+func (n *Node) SignRoomRoster(r *RoomRoster) error {
+	r.Owner = n.host.ID().String()
+	slices.Sort(r.Members)
+	slices.Sort(r.Banned)
+	var err error
+	r.Sig, err = n.host.Peerstore().PrivKey(n.host.ID()).Sign(r.signedBytes())
+	return err
+}
+
+func (r RoomRoster) signedBytes() []byte {
+	r.Sig = nil
+	b, _ := json.Marshal(r)
+	return append([]byte(rosterContext), b...)
+}
+
+// Verify checks that r is well formed and signed by its owner.
+func (r RoomRoster) Verify() error {
+	if err := checkRoomName(r.Room); err != nil {
+		return fmt.Errorf("roster: %w", err)
+	}
+	owner, err := peer.Decode(r.Owner)
+	if err != nil {
+		return fmt.Errorf("roster: owner: %w", err)
+	}
+	if len(r.Members) > MaxRosterMembers || len(r.Banned) > MaxRosterMembers {
+		return errors.New("roster: too many peers")
+	}
+	for _, list := range [][]string{r.Members, r.Banned} {
+		for i, p := range list {
+			if _, err := peer.Decode(p); err != nil {
+				return fmt.Errorf("roster: %w", err)
+			}
+			if i > 0 && list[i-1] >= p {
+				return errors.New("roster: peers not sorted or repeated")
+			}
+		}
+	}
+	if !r.Member(r.Owner) {
+		return errors.New("roster: owner not a member")
+	}
+	if err := verifyBy(owner, r.signedBytes(), r.Sig); err != nil {
+		return fmt.Errorf("roster: %w", err)
+	}
+	return nil
+}
+
+// Member reports whether p is on the roster.
+func (r RoomRoster) Member(p string) bool {
+	_, ok := slices.BinarySearch(r.Members, p)
+	return ok
+}
+
+// IsBanned reports whether the owner banned p.
+func (r RoomRoster) IsBanned(p string) bool {
+	_, ok := slices.BinarySearch(r.Banned, p)
+	return ok
+}
+
+// SenderKey is one member's key for what it posts to an encrypted room: a
+// chain key that ratchets forward with every message, at Iteration.
+type SenderKey struct {
+	Room      string `json:"room"`
+	KeyID     string `json:"key_id"` // 16 hex digits, random
+	Epoch     uint64 `json:"epoch"`  // of the roster it was made for
+	Iteration uint32 `json:"iteration"`
+	Chain     []byte `json:"chain"`
+
+	skipped map[uint32][]byte // message keys of messages not seen yet
+}
+
+// NewSenderKey makes a fresh sender key for room.
+func NewSenderKey(room string, epoch uint64) (*SenderKey, error) {
+	id := make([]byte, 8)
+	chain := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(chain); err != nil {
+		return nil, err
+	}
+	return &SenderKey{Room: room, KeyID: hex.EncodeToString(id), Epoch: epoch, Chain: chain}, nil
+}
+
+func (k *SenderKey) validate() error {
+	if err := checkRoomName(k.Room); err != nil {
+		return err
+	}
+	if _, err := hex.DecodeString(k.KeyID); err != nil || len(k.KeyID) != 16 {
+		return errors.New("bad key ID")
+	}
+	if len(k.Chain) != 32 {
+		return errors.New("bad chain key")
+	}
+	return nil
+}
+
+// step returns the key of the message at k's iteration and ratchets on.
+func (k *SenderKey) step() []byte {
+	mk := hmac.New(sha256.New, k.Chain)
+	mk.Write([]byte{1})
+	next := hmac.New(sha256.New, k.Chain)
+	next.Write([]byte{2})
+	k.Chain = next.Sum(nil)
+	k.Iteration++
+	return mk.Sum(nil)
+}
+
+// RoomCipher is an encrypted room message: the message itself, sealed with
+// the key its sender's ratchet had at N.
+type RoomCipher struct {
+	KeyID string `json:"key_id"`
+	Epoch uint64 `json:"epoch"`
+	N     uint32 `json:"n"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// Encrypt seals m, a message for k's room, with the next message key. The
+// result is what goes out on the room's topic.
+func (k *SenderKey) Encrypt(m Message) (Message, error) {
+	plain, err := json.Marshal(m)
+	if err != nil {
+		return Message{}, err
+	}
+	c := RoomCipher{KeyID: k.KeyID, Epoch: k.Epoch, N: k.Iteration}
+	gcm, err := roomCipher(k.step())
+	if err != nil {
+		return Message{}, err
+	}
+	c.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(c.Nonce); err != nil {
+		return Message{}, err
+	}
+	c.Data = gcm.Seal(nil, c.Nonce, plain, cipherHeader(k.Room, m.From, c))
+	return Message{From: m.From, When: m.When, Room: m.Room, Body: "🔒 encrypted", Cipher: &c}, nil
+}
+
+// Decrypt opens c, sent by from with k, and checks the message inside is
+// from them, in k's room.
+func (k *SenderKey) Decrypt(from string, c *RoomCipher) (Message, error) {
+	if c.KeyID != k.KeyID {
+		return Message{}, errors.New("encrypted: wrong key")
+	}
+	var mk []byte
+	switch {
+	case c.N < k.Iteration:
+		if mk = k.skipped[c.N]; mk == nil {
+			return Message{}, errors.New("encrypted: message key used or too old")
+		}
+		delete(k.skipped, c.N)
+	case c.N-k.Iteration > MaxSenderKeySkip:
+		return Message{}, fmt.Errorf("encrypted: %d messages ahead", c.N-k.Iteration)
+	default:
+		if k.skipped == nil {
+			k.skipped = make(map[uint32][]byte)
+		}
+		for k.Iteration < c.N {
+			k.skipped[k.Iteration] = k.step()
+		}
+		mk = k.step()
+		for n := range k.skipped { // drop any surplus, oldest or not
+			if len(k.skipped) <= MaxSenderKeySkip {
+				break
+			}
+			delete(k.skipped, n)
+		}
+	}
+	gcm, err := roomCipher(mk)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(c.Nonce) != gcm.NonceSize() {
+		return Message{}, errors.New("encrypted: bad nonce")
+	}
+	plain, err := gcm.Open(nil, c.Nonce, c.Data, cipherHeader(k.Room, from, *c))
+	if err != nil {
+		return Message{}, errors.New("encrypted: can't decrypt")
+	}
+	m, err := DecodeMessage(plain)
+	if err != nil {
+		return Message{}, err
+	}
+	if m.From != from || m.Room != k.Room {
+		return Message{}, fmt.Errorf("%w: encrypted by %s in #%s but claims %s in #%s",
+			ErrInvalidMessage, from, k.Room, truncate(m.From, 64), truncate(m.Room, MaxRoomName))
+	}
+	if m.Cipher != nil {
+		return Message{}, fmt.Errorf("%w: encrypted twice", ErrInvalidMessage)
+	}
+	return m, nil
+}
+
+// cipherHeader is the authenticated data of an encrypted room message.
+func cipherHeader(room, from string, c RoomCipher) []byte {
+	var n [12]byte
+	binary.BigEndian.PutUint64(n[:8], c.Epoch)
+	binary.BigEndian.PutUint32(n[8:], c.N)
+	return []byte(strings.Join([]string{"peep-chat room message:", room, from, c.KeyID, string(n[:])}, "\x00"))
+}
+
+func roomCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// validateCipher checks an encrypted room message's envelope; what's
+// inside is checked once decrypted.
+func validateCipher(m Message) error {
+	if m.Cipher == nil {
+		return nil
+	}
+	if m.Room == "" {
+		return errors.New("encrypted message outside a room")
+	}
+	if len(m.Cipher.KeyID) != 16 || len(m.Cipher.Nonce) != 12 || len(m.Cipher.Data) == 0 {
+		return errors.New("bad encrypted message")
+	}
+	if len(m.Files) != 0 || m.Sticker != nil || m.Location != nil || m.Card != nil || len(m.Payload) != 0 {
+		return errors.New("encrypted message with cleartext content")
+	}
+	return nil
+}
+
+// RoomKeyRequest asks for the sender key KeyID of Room; Epoch is the
+// roster the asker has, so a newer one can be passed on.
+type RoomKeyRequest struct {
+	Room  string `json:"room"`
+	KeyID string `json:"key_id,omitempty"`
+	Epoch uint64 `json:"epoch"`
+}
+
+// RoomPart is the payload of a room.part message.
+type RoomPart struct {
+	Room string `json:"room"`
+}
+
+func checkRoomName(room string) error {
+	if room == "" || len(room) > MaxRoomName || strings.ContainsAny(room, " /#") || checkText(room, "") != nil {
+		return fmt.Errorf("bad room name %q", truncate(room, MaxRoomName))
+	}
+	return nil
+}
+
+func init() {
+	RegisterType(TypeEncrypted, func(m Message) error {
+		if m.Cipher == nil {
+			return errors.New("nothing encrypted")
+		}
+		return nil
+	})
+	RegisterType(TypeRoomRoster, func(m Message) error {
+		var r RoomRoster
+		if err := m.DecodePayload(&r); err != nil {
+			return err
+		}
+		return r.Verify()
+	})
+	RegisterType(TypeRoomKey, func(m Message) error {
+		var k SenderKey
+		if err := m.DecodePayload(&k); err != nil {
+			return err
+		}
+		return k.validate()
+	})
+	RegisterType(TypeRoomKeyRequest, func(m Message) error {
+		var r RoomKeyRequest
+		if err := m.DecodePayload(&r); err != nil {
+			return err
+		}
+		if r.KeyID != "" && len(r.KeyID) != 16 {
+			return errors.New("bad key ID")
+		}
+		return checkRoomName(r.Room)
+	})
+	RegisterType(TypeRoomPart, func(m Message) error {
+		var p RoomPart
+		if err := m.DecodePayload(&p); err != nil {
+			return err
+		}
+		return checkRoomName(p.Room)
+	})
+}
@@ -0,0 +1,78 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+)
+
+// StreamTimeout bounds reads and writes on a stream when the caller's
+// context has no deadline of its own, so a stalled peer can't hold a send
+// forever.
+const StreamTimeout = 30 * time.Second
+
+// MaxQueuedSends is how many direct messages to one peer may be in flight
+// (waiting on pacing or being written) before Send refuses more.
+const MaxQueuedSends = 32
+
+// ErrBackpressure is returned by sends to a peer that already has
+// MaxQueuedSends in flight.
+var ErrBackpressure = errors.New("too many messages to this peer still sending")
+
+// bindStream puts ctx's deadline, or StreamTimeout from now, on s and
+// resets s if ctx ends first, unblocking any read or write. Call the
+// returned func once done with s.
+func bindStream(ctx context.Context, s network.Stream) (stop func() bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(StreamTimeout)
+	}
+	_ = s.SetDeadline(deadline)
+	return context.AfterFunc(ctx, func() { _ = s.Reset() })
+}
+
+// sendQueue counts the direct messages in flight to each peer.
+type sendQueue struct {
+	mu    sync.Mutex
+	peers map[string]int
+}
+
+// enter counts a send to to, or returns ErrBackpressure if to's queue is
+// full. Call the returned func when the send is done.
+func (q *sendQueue) enter(to string) (done func(), err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.peers[to] >= MaxQueuedSends {
+		return nil, ErrBackpressure
+	}
+	if q.peers == nil {
+		q.peers = make(map[string]int)
+	}
+	q.peers[to]++
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.peers[to]--; q.peers[to] <= 0 {
+			delete(q.peers, to)
+		}
+	}, nil
+}
+
+func (q *sendQueue) snapshot() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make(map[string]int, len(q.peers))
+	for k, v := range q.peers {
+		out[k] = v
+	}
+	return out
+}
+
+// Sending reports how many direct messages are in flight to each peer
+// with any: queued behind pacing, or still being written.
+func (n *Node) Sending() map[string]int {
+	return n.sendq.snapshot()
+}
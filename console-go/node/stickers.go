@@ -0,0 +1,128 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Sticker packs are small: a pack holds at most MaxStickers stickers of
+// at most MaxStickerSize each, so fetching one is cheap.
+const (
+	MaxStickers    = 256
+	MaxStickerSize = 1 << 20
+)
+
+// StickerPack is a named set of stickers, stored as a DAG-JSON block that
+// maps each sticker's name to its file; the block's CID identifies the
+// pack, so receivers fetch and cache it once.
+type StickerPack struct {
+	Name     string             `json:"name"`
+	Stickers map[string]FileRef `json:"stickers"`
+}
+
+// Sticker is set on a message that sends one sticker of a pack.
+type Sticker struct {
+	Pack string `json:"pack"` // CID of the StickerPack block
+	Name string `json:"name"`
+}
+
+// validStickerName reports whether s can name a pack or a sticker.
+func validStickerName(s string) bool {
+	return s != "" && len(s) <= 64 && !strings.ContainsAny(s, "/\\ \t\n") && checkText(s, "") == nil
+}
+
+func (p StickerPack) validate() error {
+	if !validStickerName(p.Name) {
+		return fmt.Errorf("bad sticker pack name %q", truncate(p.Name, 64))
+	}
+	if len(p.Stickers) == 0 || len(p.Stickers) > MaxStickers {
+		return fmt.Errorf("sticker pack has %d stickers, limit %d", len(p.Stickers), MaxStickers)
+	}
+	for name, f := range p.Stickers {
+		if !validStickerName(name) {
+			return fmt.Errorf("bad sticker name %q", truncate(name, 64))
+		}
+		if f.Size > MaxStickerSize {
+			return fmt.Errorf("sticker %s is over the %d KiB limit", name, MaxStickerSize>>10)
+		}
+		if err := validateFiles([]FileRef{f}); err != nil {
+			return fmt.Errorf("sticker %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// PutStickerPack stores p, whose stickers must be stored already, and
+// returns its CID.
+func (bs *Blockstore) PutStickerPack(p StickerPack) (cid.Cid, error) {
+	if err := p.validate(); err != nil {
+		return cid.Undef, err
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return bs.Put(cid.DagJSON, b)
+}
+
+// StickerPack reads the pack block c.
+func (bs *Blockstore) StickerPack(c cid.Cid) (StickerPack, error) {
+	b, err := bs.Get(c)
+	if err != nil {
+		return StickerPack{}, err
+	}
+	var p StickerPack
+	if err := json.Unmarshal(b, &p); err != nil {
+		return StickerPack{}, fmt.Errorf("sticker pack: %w", err)
+	}
+	if err := p.validate(); err != nil {
+		return StickerPack{}, err
+	}
+	return p, nil
+}
+
+// FetchStickerPack gets the pack block c and every sticker in it from
+// whichever of peers have them, and returns the pack.
+func (n *Node) FetchStickerPack(ctx context.Context, peers []peer.ID, c cid.Cid) (StickerPack, error) {
+	if err := n.FetchBlocks(ctx, peers, []cid.Cid{c}); err != nil {
+		return StickerPack{}, err
+	}
+	p, err := n.blocks.StickerPack(c)
+	if err != nil {
+		return StickerPack{}, err
+	}
+	var errs []error
+	for name, f := range p.Stickers {
+		if _, err := n.FetchFile(ctx, peers, f); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return p, errors.Join(errs...)
+}
+
+// SendSticker sends a sticker to a peer, with body as the text clients
+// without sticker support show.
+func (n *Node) SendSticker(ctx context.Context, to, body string, s Sticker) (Message, error) {
+	return n.send(ctx, "node.SendSticker", to, Message{Body: body, Sticker: &s}, true)
+}
+
+// validateSticker checks a message's sticker reference.
+func validateSticker(s *Sticker) error {
+	if s == nil {
+		return nil
+	}
+	if !validStickerName(s.Name) {
+		return fmt.Errorf("bad sticker name %q", truncate(s.Name, 64))
+	}
+	c, err := cid.Decode(s.Pack)
+	if err != nil || c.Type() != cid.DagJSON {
+		return fmt.Errorf("bad sticker pack CID %q", truncate(s.Pack, 100))
+	}
+	return nil
+}
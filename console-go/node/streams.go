@@ -0,0 +1,253 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// StreamIdle is how long a reused chat stream may go without a message
+// before it's closed.
+const StreamIdle = 5 * time.Minute
+
+// KeepAliveInterval is how often an idle chat stream carries a keep-alive,
+// an empty line receivers skip; it's under StreamTimeout, after which the
+// receiving end gives up on a quiet stream. A keep-alive that can't be
+// written within KeepAliveTimeout means the peer is gone.
+const (
+	KeepAliveInterval = 10 * time.Second
+	KeepAliveTimeout  = 5 * time.Second
+)
+
+// DeadPeerHold is how long sends to a peer found gone fail at once, rather
+// than wait on a dial, unless it connects again first.
+const DeadPeerHold = time.Minute
+
+// ErrPeerOffline is returned by sends to a peer that stopped answering
+// keep-alives or dropped its connection mid-conversation.
+var ErrPeerOffline = errors.New("peer is offline")
+
+// streamPool keeps one chat stream per peer open between messages, so a
+// conversation doesn't negotiate a new stream for every line.
+type streamPool struct {
+	mu    sync.Mutex
+	peers map[peer.ID]*chatStream
+
+	host host.Host
+	// dead is called when a keep-alive to a peer fails.
+	dead func(id peer.ID)
+}
+
+// chatStream is a peer's reusable stream; writes to it take turns.
+type chatStream struct {
+	mu   sync.Mutex
+	s    network.Stream // nil until opened, and after it's closed
+	last time.Time      // of the last message
+	tick *time.Timer    // keep-alives and the idle check
+}
+
+func (p *streamPool) get(id peer.ID) *chatStream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cs, ok := p.peers[id]
+	if !ok {
+		if p.peers == nil {
+			p.peers = make(map[peer.ID]*chatStream)
+		}
+		cs = new(chatStream)
+		p.peers[id] = cs
+	}
+	return cs
+}
+
+// write sends b to id over its open stream. If that fails, the stream
+// may have died unseen, so b goes once more over a new one.
+func (p *streamPool) write(ctx context.Context, id peer.ID, b []byte) error {
+	cs := p.get(id)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for {
+		fresh := cs.s == nil
+		if fresh {
+			s, err := p.host.NewStream(ctx, id, ProtocolID)
+			if err != nil {
+				return err
+			}
+			cs.s = s
+		}
+		err := writeBound(ctx, cs.s, b)
+		if err == nil {
+			cs.last = time.Now()
+			if cs.tick == nil {
+				cs.tick = time.AfterFunc(KeepAliveInterval, func() { p.keepAlive(id, cs) })
+			}
+			return nil
+		}
+		_ = cs.s.Reset()
+		cs.s = nil
+		if fresh || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// writeBound writes b to s within ctx's deadline, or StreamTimeout.
+func writeBound(ctx context.Context, s network.Stream, b []byte) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(StreamTimeout)
+	}
+	_ = s.SetWriteDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = s.Reset() })
+	defer stop()
+	_, err := s.Write(b)
+	return err
+}
+
+// keepAlive runs every KeepAliveInterval while cs is open: it closes the
+// stream once idle for StreamIdle, and otherwise writes a keep-alive. If
+// that fails the peer is reported dead.
+func (p *streamPool) keepAlive(id peer.ID, cs *chatStream) {
+	cs.mu.Lock()
+	if cs.s == nil {
+		cs.tick = nil
+		cs.mu.Unlock()
+		return
+	}
+	if time.Since(cs.last) >= StreamIdle {
+		_ = cs.s.Close()
+		cs.s, cs.tick = nil, nil
+		cs.mu.Unlock()
+		p.forget(id, cs)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), KeepAliveTimeout)
+	err := writeBound(ctx, cs.s, []byte{'\n'})
+	if err != nil {
+		// The stream alone may have died; the peer is gone if a new one
+		// can't be opened either.
+		_ = cs.s.Reset()
+		var s network.Stream
+		if s, err = p.host.NewStream(ctx, id, ProtocolID); err == nil {
+			cs.s = s
+			err = writeBound(ctx, s, []byte{'\n'})
+		}
+	}
+	cancel()
+	if err != nil {
+		_ = cs.s.Reset()
+		cs.s, cs.tick = nil, nil
+		cs.mu.Unlock()
+		p.forget(id, cs)
+		log.Debugf("keep-alive to %s: %s", id, err)
+		if p.dead != nil {
+			p.dead(id)
+		}
+		return
+	}
+	cs.tick.Reset(KeepAliveInterval)
+	cs.mu.Unlock()
+}
+
+// forget drops cs from the pool if it's still id's stream.
+func (p *streamPool) forget(id peer.ID, cs *chatStream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers[id] == cs {
+		delete(p.peers, id)
+	}
+}
+
+// drop resets id's kept stream, if any, reporting whether there was one.
+func (p *streamPool) drop(id peer.ID) bool {
+	p.mu.Lock()
+	cs, ok := p.peers[id]
+	delete(p.peers, id)
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	open := cs.s != nil
+	if open {
+		_ = cs.s.Reset()
+		cs.s = nil
+	}
+	return open
+}
+
+// watchPeers notices peers going away: a chat peer whose last connection
+// drops, or who stops answering keep-alives, is offline for DeadPeerHold
+// and reported through OnOffline. Connecting again clears that at once.
+func (n *Node) watchPeers() {
+	n.streams.host = n.host
+	n.streams.dead = func(id peer.ID) {
+		// Closing its connections reports it through DisconnectedF.
+		n.markOffline(id)
+		_ = n.host.Network().ClosePeer(id)
+	}
+	n.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			n.mu.Lock()
+			delete(n.offline, c.RemotePeer())
+			n.mu.Unlock()
+		},
+		DisconnectedF: func(net network.Network, c network.Conn) {
+			id := c.RemotePeer()
+			if net.Connectedness(id) == network.Connected {
+				return
+			}
+			n.wentAway(id)
+			if n.streams.drop(id) {
+				n.markOffline(id)
+			}
+		},
+	})
+}
+
+// markOffline records id as gone and tells OnOffline, once per going.
+func (n *Node) markOffline(id peer.ID) {
+	n.mu.Lock()
+	if t, ok := n.offline[id]; ok && time.Since(t) < DeadPeerHold {
+		n.mu.Unlock()
+		return
+	}
+	n.offline[id] = time.Now()
+	fn := n.onOffline
+	n.mu.Unlock()
+	log.Infof("%s went offline", id)
+	if fn != nil {
+		fn(id)
+	}
+}
+
+// IsOffline reports whether id went offline less than DeadPeerHold ago
+// and hasn't connected since.
+func (n *Node) IsOffline(id peer.ID) bool {
+	n.mu.RLock()
+	t, ok := n.offline[id]
+	n.mu.RUnlock()
+	return ok && time.Since(t) < DeadPeerHold && n.host.Network().Connectedness(id) != network.Connected
+}
+
+// OnOffline sets the callback for a peer we were chatting with going
+// away without a goodbye: its connection dropped or it stopped answering
+// keep-alives.
+func (n *Node) OnOffline(fn func(id peer.ID)) {
+	n.mu.Lock()
+	n.onOffline = fn
+	n.mu.Unlock()
+}
+
+// ChatStreams reports how many peers we're keeping a chat stream open to.
+func (n *Node) ChatStreams() int {
+	n.streams.mu.Lock()
+	defer n.streams.mu.Unlock()
+	return len(n.streams.peers)
+}
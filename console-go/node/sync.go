@@ -0,0 +1,165 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SyncProtocolID reconciles room history: peers compare digests of what
+// they hold and send each other the message CIDs the other lacks.
+const SyncProtocolID = "/p2pchat/sync/1.0.0"
+
+// Reconciliation covers the last SyncWindow of history, in day buckets,
+// and one answer lists at most maxSyncEntries messages; what's left comes
+// in the next round.
+const (
+	SyncWindow     = 30 * 24 * time.Hour
+	syncBucket     = 24 * time.Hour
+	maxSyncEntries = 2000
+)
+
+// HistoryEntry is one message of a room's history: the CID of its block
+// and when it was sent.
+type HistoryEntry struct {
+	CID  string `json:"cid"`
+	When int64  `json:"when"` // unix ms
+}
+
+// HistoryDigest summarises entries within SyncWindow of now: one hash of
+// the sorted CIDs per day bucket, keyed by the bucket's number.
+func HistoryDigest(entries []HistoryEntry, now time.Time) map[string]string {
+	buckets := bucketHistory(entries, now)
+	out := make(map[string]string, len(buckets))
+	for b, cids := range buckets {
+		sort.Strings(cids)
+		h := sha256.New()
+		for _, c := range cids {
+			h.Write([]byte(c))
+			h.Write([]byte{0})
+		}
+		out[b] = hex.EncodeToString(h.Sum(nil))
+	}
+	return out
+}
+
+func bucketHistory(entries []HistoryEntry, now time.Time) map[string][]string {
+	cutoff := now.Add(-SyncWindow).UnixMilli()
+	buckets := make(map[string][]string)
+	for _, e := range entries {
+		if e.When < cutoff {
+			continue
+		}
+		b := strconv.FormatInt(e.When/syncBucket.Milliseconds(), 10)
+		buckets[b] = append(buckets[b], e.CID)
+	}
+	return buckets
+}
+
+type syncRequest struct {
+	Room    string            `json:"room"`
+	Buckets map[string]string `json:"buckets"`
+}
+
+type syncResponse struct {
+	Error   string         `json:"error,omitempty"`
+	Entries []HistoryEntry `json:"entries,omitempty"`
+}
+
+// ServeHistory answers SyncProtocolID requests with history, which
+// returns a room's entries and whether p may have them.
+func (n *Node) ServeHistory(history func(p peer.ID, room string) ([]HistoryEntry, bool)) {
+	n.mu.Lock()
+	n.history = history
+	n.mu.Unlock()
+	n.host.SetStreamHandler(SyncProtocolID, Guard(n.handleSync))
+}
+
+func (n *Node) handleSync(s network.Stream) {
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(time.Minute))
+	var req syncRequest
+	if err := readFrame(s, &req); err != nil {
+		log.Debugf("sync request from %s: %s", s.Conn().RemotePeer(), err)
+		return
+	}
+	release, err := n.serve(s.Conn().RemotePeer())
+	if err != nil {
+		_ = writeFrame(s, syncResponse{Error: err.Error()})
+		return
+	}
+	defer release()
+	n.mu.RLock()
+	history := n.history
+	n.mu.RUnlock()
+	var resp syncResponse
+	entries, ok := history(s.Conn().RemotePeer(), req.Room)
+	if !ok {
+		resp.Error = "not in room " + req.Room
+		_ = writeFrame(s, resp)
+		return
+	}
+	now := time.Now()
+	theirs := req.Buckets
+	cutoff := now.Add(-SyncWindow).UnixMilli()
+	digest := HistoryDigest(entries, now)
+	for _, e := range entries {
+		if e.When < cutoff {
+			continue
+		}
+		b := strconv.FormatInt(e.When/syncBucket.Milliseconds(), 10)
+		if theirs[b] == digest[b] {
+			continue
+		}
+		if len(resp.Entries) == maxSyncEntries {
+			break
+		}
+		resp.Entries = append(resp.Entries, e)
+	}
+	_ = writeFrame(s, resp)
+}
+
+// SyncRoom sends p the digest of our entries of room and returns the
+// entries p holds in buckets that differ, minus those we have.
+func (n *Node) SyncRoom(ctx context.Context, p peer.ID, room string, entries []HistoryEntry) (_ []HistoryEntry, err error) {
+	ctx, span := tracer.Start(ctx, "node.SyncRoom", trace.WithAttributes(
+		attribute.String("peer.id", p.String()), attribute.String("room", room)))
+	defer func() { endSpan(span, err) }()
+	s, err := n.host.NewStream(ctx, p, SyncProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	defer bindStream(ctx, s)()
+	if err := writeFrame(s, syncRequest{Room: room, Buckets: HistoryDigest(entries, time.Now())}); err != nil {
+		return nil, err
+	}
+	var resp syncResponse
+	if err := readFrame(s, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("sync with %s: %s", p, resp.Error)
+	}
+	have := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		have[e.CID] = true
+	}
+	var missing []HistoryEntry
+	for _, e := range resp.Entries {
+		if !have[e.CID] {
+			have[e.CID] = true
+			missing = append(missing, e)
+		}
+	}
+	return missing, nil
+}
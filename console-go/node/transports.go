@@ -0,0 +1,63 @@
+//go:build !js
+
+package node
+
+import (
+	"fmt"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	host "github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	noise "github.com/libp2p/go-libp2p/p2p/security/noise"
+	tls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	tcp "github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	websocket "github.com/libp2p/go-libp2p/p2p/transport/websocket"
+)
+
+// HostOption is an extra option for the libp2p host New creates.
+type HostOption = libp2p.Option
+
+// buildHost creates a libp2p host with its default transports, restricted
+// as opts asks.
+func buildHost(priv crypto.PrivKey, opts Options, bw *metrics.BandwidthCounter, dials *dialHistory) (host.Host, error) {
+	security, err := securityOptions(opts.Security, len(opts.ListenAddrs) == 0)
+	if err != nil {
+		return nil, err
+	}
+	hostOpts := append([]libp2p.Option{libp2p.Identity(priv), libp2p.BandwidthReporter(bw)}, security...)
+	if opts.RefusePlaintext {
+		hostOpts = append(hostOpts, libp2p.ConnectionGater(plaintextGater{}))
+	}
+	if len(opts.ListenAddrs) > 0 {
+		hostOpts = append(hostOpts, libp2p.ListenAddrStrings(opts.ListenAddrs...))
+	}
+	hostOpts = append(hostOpts, libp2p.SwarmOpts(dials.swarmOptions()...))
+	hostOpts = append(hostOpts, opts.Libp2p...)
+	return libp2p.New(hostOpts...)
+}
+
+// securityOptions returns the host options for a security choice. Noise
+// only also leaves out QUIC, WebTransport and WebRTC, whose encryption is
+// built in (TLS 1.3, DTLS) rather than negotiated, keeping TCP and
+// WebSocket (relayed connections ride on them); libp2p then has no default
+// listen addresses, so defaultListen asks for TCP ones.
+func securityOptions(choice string, defaultListen bool) ([]libp2p.Option, error) {
+	switch choice {
+	case "", SecurityBoth:
+		return []libp2p.Option{libp2p.Security(noise.ID, noise.New), libp2p.Security(tls.ID, tls.New)}, nil
+	case SecurityTLS:
+		return []libp2p.Option{libp2p.Security(tls.ID, tls.New)}, nil
+	case SecurityNoise:
+		opts := []libp2p.Option{
+			libp2p.Security(noise.ID, noise.New),
+			libp2p.Transport(tcp.NewTCPTransport),
+			libp2p.Transport(websocket.New),
+		}
+		if defaultListen {
+			opts = append(opts, libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/0", "/ip6/::/tcp/0"))
+		}
+		return opts, nil
+	}
+	return nil, fmt.Errorf("unknown security %q (want noise, tls or both)", choice)
+}
@@ -0,0 +1,112 @@
+//go:build js && wasm
+
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	host "github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/sec"
+	blankhost "github.com/libp2p/go-libp2p/p2p/host/blank"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	yamux "github.com/libp2p/go-libp2p/p2p/muxer/yamux"
+	swarm "github.com/libp2p/go-libp2p/p2p/net/swarm"
+	"github.com/libp2p/go-libp2p/p2p/net/upgrader"
+	identify "github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	noise "github.com/libp2p/go-libp2p/p2p/security/noise"
+)
+
+// HostOption is an extra option for the blank host a browser node runs on.
+type HostOption = blankhost.Option
+
+// buildHost puts a browser node's host together by hand: go-libp2p's
+// constructor brings in QUIC, WebTransport and WebRTC, which are built on
+// UDP sockets and don't compile for js. The host only dials out, over the
+// browser's own WebSocket (see wsTransport), secured with Noise and
+// multiplexed with yamux, and runs identify so peers learn its protocols.
+// Console peers reach it back over the same connection.
+func buildHost(priv crypto.PrivKey, opts Options, bw *metrics.BandwidthCounter, dials *dialHistory) (host.Host, error) {
+	if len(opts.ListenAddrs) > 0 {
+		return nil, errors.New("a browser node can't listen")
+	}
+	switch opts.Security {
+	case "", SecurityBoth, SecurityNoise:
+	default:
+		return nil, fmt.Errorf("security %q isn't available in the browser, only noise", opts.Security)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		return nil, err
+	}
+	if err := ps.AddPrivKey(id, priv); err != nil {
+		return nil, err
+	}
+	if err := ps.AddPubKey(id, priv.GetPublic()); err != nil {
+		return nil, err
+	}
+	var gater connmgr.ConnectionGater
+	swarmOpts := append([]swarm.Option{swarm.WithMetrics(bw)}, dials.swarmOptions()...)
+	if opts.RefusePlaintext {
+		gater = plaintextGater{}
+		swarmOpts = append(swarmOpts, swarm.WithConnectionGater(gater))
+	}
+	bus := eventbus.NewBus()
+	sw, err := swarm.NewSwarm(id, ps, bus, swarmOpts...)
+	if err != nil {
+		return nil, err
+	}
+	muxers := []upgrader.StreamMuxer{{ID: yamux.ID, Muxer: yamux.DefaultTransport}}
+	security, err := noise.New(noise.ID, priv, muxers)
+	if err != nil {
+		sw.Close()
+		return nil, err
+	}
+	rcmgr := &network.NullResourceManager{}
+	up, err := upgrader.New([]sec.SecureTransport{security}, muxers, nil, rcmgr, gater)
+	if err != nil {
+		sw.Close()
+		return nil, err
+	}
+	if err := sw.AddTransport(&wsTransport{upgrader: up, rcmgr: rcmgr}); err != nil {
+		sw.Close()
+		return nil, err
+	}
+	h := blankhost.NewBlankHost(sw, append([]blankhost.Option{blankhost.WithEventBus(bus)}, opts.Libp2p...)...)
+	if h == nil {
+		sw.Close()
+		return nil, errors.New("blank host failed")
+	}
+	features := opts.Features
+	if len(features) == 0 {
+		features = []Feature{FeatureChat}
+	}
+	ids, err := identify.NewIDService(h, identify.UserAgent(AgentVersion("peep-chat/wasm", features)))
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	ids.Start()
+	return &browserHost{BlankHost: h, ids: ids}, nil
+}
+
+// browserHost is a blank host that runs identify.
+type browserHost struct {
+	*blankhost.BlankHost
+	ids identify.IDService
+}
+
+func (h *browserHost) Close() error {
+	h.ids.Close()
+	return h.BlankHost.Close()
+}
@@ -0,0 +1,279 @@
+//go:build js && wasm
+
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall/js"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// wsTransport dials WebSocket multiaddrs (/ws, /wss and /tls/ws) through
+// the browser's WebSocket API. A tab can't accept connections, so it
+// doesn't listen.
+type wsTransport struct {
+	upgrader transport.Upgrader
+	rcmgr    network.ResourceManager
+}
+
+var _ transport.Transport = (*wsTransport)(nil)
+
+func (t *wsTransport) CanDial(a ma.Multiaddr) bool {
+	_, err := wsURL(a)
+	return err == nil
+}
+
+func (t *wsTransport) Protocols() []int { return []int{ma.P_WS, ma.P_WSS} }
+
+func (t *wsTransport) Proxy() bool { return false }
+
+func (t *wsTransport) Listen(ma.Multiaddr) (transport.Listener, error) {
+	return nil, errors.New("a browser can't listen")
+}
+
+func (t *wsTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	scope, err := t.rcmgr.OpenConnection(network.DirOutbound, true, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialWebSocket(ctx, raddr)
+	if err != nil {
+		scope.Done()
+		return nil, err
+	}
+	conn, err := t.upgrader.Upgrade(ctx, t, c, network.DirOutbound, p, scope)
+	if err != nil {
+		c.Close()
+		scope.Done()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// wsURL turns a WebSocket multiaddr, with or without a trailing /p2p, into
+// the URL a browser dials.
+func wsURL(a ma.Multiaddr) (string, error) {
+	var host, port, sni, scheme string
+	var tls, bad bool
+	ma.ForEach(a, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_IP4, ma.P_DNS, ma.P_DNS4, ma.P_DNS6:
+			host = c.Value()
+		case ma.P_IP6:
+			host = "[" + c.Value() + "]"
+		case ma.P_TCP:
+			port = c.Value()
+		case ma.P_TLS:
+			tls = true
+		case ma.P_SNI:
+			sni = c.Value()
+		case ma.P_WS:
+			scheme = "ws"
+			if tls {
+				scheme = "wss"
+			}
+		case ma.P_WSS:
+			scheme = "wss"
+		case ma.P_P2P:
+		default:
+			bad = true
+		}
+		return !bad
+	})
+	if bad || host == "" || port == "" || scheme == "" {
+		return "", fmt.Errorf("not a WebSocket address: %s", a)
+	}
+	if scheme == "wss" && sni != "" {
+		// The browser does the TLS, and takes the name from the URL.
+		host = sni
+	}
+	return scheme + "://" + host + ":" + port, nil
+}
+
+// wsConn is a browser WebSocket as a net.Conn. Incoming frames are
+// buffered by the JS event handlers until Read takes them.
+type wsConn struct {
+	ws    js.Value
+	raddr ma.Multiaddr
+	funcs []js.Func
+
+	mu       sync.Mutex
+	buf      []byte
+	err      error         // what Read returns once buf is drained
+	ready    chan struct{} // signalled when buf, err or the deadline changes
+	deadline time.Time     // for Read
+
+	closeOnce sync.Once
+}
+
+var (
+	_ net.Conn = (*wsConn)(nil)
+	// wsLocalAddr stands in for our end, which the browser doesn't tell.
+	wsLocalAddr = ma.StringCast("/ip4/0.0.0.0/tcp/0/ws")
+)
+
+func dialWebSocket(ctx context.Context, raddr ma.Multiaddr) (*wsConn, error) {
+	u, err := wsURL(raddr)
+	if err != nil {
+		return nil, err
+	}
+	ctor := js.Global().Get("WebSocket")
+	if ctor.Type() != js.TypeFunction {
+		return nil, errors.New("no WebSocket in this JavaScript environment")
+	}
+	c := &wsConn{ws: ctor.New(u), raddr: raddr, ready: make(chan struct{}, 1)}
+	c.ws.Set("binaryType", "arraybuffer")
+	opened := make(chan error, 1)
+	c.on("open", func(js.Value) {
+		opened <- nil
+	})
+	c.on("message", func(e js.Value) {
+		data := js.Global().Get("Uint8Array").New(e.Get("data"))
+		b := make([]byte, data.Length())
+		js.CopyBytesToGo(b, data)
+		c.mu.Lock()
+		c.buf = append(c.buf, b...)
+		c.mu.Unlock()
+		c.signal()
+	})
+	c.on("close", func(e js.Value) {
+		select {
+		case opened <- fmt.Errorf("websocket %s closed (%d)", u, e.Get("code").Int()):
+		default:
+		}
+		c.fail(io.EOF)
+		// No more events come after close.
+		for _, f := range c.funcs {
+			f.Release()
+		}
+	})
+	select {
+	case err := <-opened:
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *wsConn) on(event string, fn func(e js.Value)) {
+	f := js.FuncOf(func(_ js.Value, args []js.Value) any {
+		fn(args[0])
+		return nil
+	})
+	c.funcs = append(c.funcs, f)
+	c.ws.Call("addEventListener", event, f)
+}
+
+func (c *wsConn) signal() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// fail makes Read return err once the buffered data is read, unless it
+// already returns another error.
+func (c *wsConn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.buf) > 0 {
+			n := copy(p, c.buf)
+			c.buf = c.buf[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		err, deadline := c.err, c.deadline
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if deadline.IsZero() {
+			<-c.ready
+			continue
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.ready:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return 0, net.ErrClosed
+	}
+	// 1 is OPEN; send throws in any other state.
+	if c.ws.Get("readyState").Int() != 1 {
+		return 0, net.ErrClosed
+	}
+	a := js.Global().Get("Uint8Array").New(len(p))
+	js.CopyBytesToJS(a, p)
+	c.ws.Call("send", a)
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.fail(net.ErrClosed)
+		c.ws.Call("close")
+	})
+	return nil
+}
+
+func (c *wsConn) LocalMultiaddr() ma.Multiaddr  { return wsLocalAddr }
+func (c *wsConn) RemoteMultiaddr() ma.Multiaddr { return c.raddr }
+func (c *wsConn) LocalAddr() net.Addr           { return wsAddr(wsLocalAddr.String()) }
+func (c *wsConn) RemoteAddr() net.Addr          { return wsAddr(c.raddr.String()) }
+
+func (c *wsConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	c.signal()
+	return nil
+}
+
+// SetWriteDeadline does nothing: Write hands the data to the browser,
+// which buffers it, and never blocks.
+func (c *wsConn) SetWriteDeadline(time.Time) error { return nil }
+
+// wsAddr is a WebSocket multiaddr as a net.Addr.
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/gorilla/websocket"
+
+	"p2p-chat/node"
+)
+
+// nostrConfig is read from nostrConfigFile; the bridge is enabled when the
+// file exists. Only mirror rooms that are meant to be public: everything in
+// them ends up on the relay.
+type nostrConfig struct {
+	Relay  string `json:"relay"` // wss://...
+	Room   string `json:"room"`
+	Tag    string `json:"tag"`    // "t" tag identifying the room on Nostr; default "peep-<room>"
+	Prefix string `json:"prefix"` // prepended to notes relayed into the room
+	// Authors are the hex public keys whose notes are relayed into the
+	// room; with none, anyone posting to the relay with the tag is.
+	Authors []string `json:"authors,omitempty"`
+}
+
+// nostrEvent is a NIP-01 event.
+type nostrEvent struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+const nostrKindTextNote = 1
+
+// nostrBridge mirrors a room to a Nostr relay as signed kind-1 notes tagged
+// with cfg.Tag, and relays notes carrying that tag back into the room.
+type nostrBridge struct {
+	a   *app
+	cfg nostrConfig
+	key *btcec.PrivateKey
+	pub string // hex x-only public key
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	seen map[string]bool
+
+	stop chan struct{}
+}
+
+func loadNostrConfig(path string) (*nostrConfig, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := &nostrConfig{Prefix: "[nostr] "}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Relay == "" || cfg.Room == "" {
+		return nil, fmt.Errorf("%s: relay and room are required", path)
+	}
+	if cfg.Tag == "" {
+		cfg.Tag = "peep-" + cfg.Room
+	}
+	for i, pub := range cfg.Authors {
+		if raw, err := hex.DecodeString(pub); err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("%s: author %q is not a hex public key", path, pub)
+		}
+		cfg.Authors[i] = strings.ToLower(pub)
+	}
+	return cfg, nil
+}
+
+// loadOrCreateNostrKey keeps the bridge's secp256k1 key next to the libp2p
+// identity so the bridge has a stable Nostr identity across restarts.
+func loadOrCreateNostrKey(path string) (*btcec.PrivateKey, error) {
+	if b, err := os.ReadFile(path); err == nil {
+		raw, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("%s: not a hex secp256k1 key", path)
+		}
+		priv, _ := btcec.PrivKeyFromBytes(raw)
+		return priv, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	priv, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(priv.Serialize())), 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+func startNostrBridge(a *app, cfg nostrConfig, key *btcec.PrivateKey) (*nostrBridge, error) {
+	if err := a.rooms.join(cfg.Room); err != nil {
+		return nil, err
+	}
+	b := &nostrBridge{
+		a:    a,
+		cfg:  cfg,
+		key:  key,
+		pub:  hex.EncodeToString(schnorr.SerializePubKey(key.PubKey())),
+		seen: make(map[string]bool),
+		stop: make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+func (b *nostrBridge) run() {
+	backoff := time.Second
+	for {
+		err := b.session()
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+		logger.Warnf("nostr bridge: %s (reconnecting in %s)", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-b.stop:
+			return
+		}
+		if backoff < 5*time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (b *nostrBridge) session() error {
+	conn, _, err := websocket.DefaultDialer.Dial(b.cfg.Relay, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	b.mu.Lock()
+	b.conn = conn
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.conn = nil
+		b.mu.Unlock()
+	}()
+
+	filter := map[string]any{
+		"kinds": []int{nostrKindTextNote},
+		"#t":    []string{b.cfg.Tag},
+		"since": time.Now().Unix(),
+	}
+	if len(b.cfg.Authors) > 0 {
+		filter["authors"] = b.cfg.Authors
+	}
+	if err := b.write([]any{"REQ", "peep", filter}); err != nil {
+		return err
+	}
+	logger.Infof("nostr bridge: connected to %s, mirroring #%s as t=%s", b.cfg.Relay, b.cfg.Room, b.cfg.Tag)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		b.handleFrame(data)
+	}
+}
+
+func (b *nostrBridge) handleFrame(data []byte) {
+	var frame []json.RawMessage
+	if err := json.Unmarshal(data, &frame); err != nil || len(frame) == 0 {
+		return
+	}
+	var typ string
+	_ = json.Unmarshal(frame[0], &typ)
+	switch typ {
+	case "EVENT":
+		if len(frame) < 3 {
+			return
+		}
+		var ev nostrEvent
+		if err := json.Unmarshal(frame[2], &ev); err != nil {
+			return
+		}
+		b.relayIn(ev)
+	case "OK":
+		var ok bool
+		var msg string
+		if len(frame) >= 4 && json.Unmarshal(frame[2], &ok) == nil && !ok {
+			_ = json.Unmarshal(frame[3], &msg)
+			logger.Warnf("nostr bridge: relay rejected event: %s", msg)
+		}
+	case "NOTICE":
+		var msg string
+		if len(frame) >= 2 && json.Unmarshal(frame[1], &msg) == nil {
+			logger.Infof("nostr bridge: relay notice: %s", msg)
+		}
+	}
+}
+
+// relayIn posts a verified note from the relay into the room.
+func (b *nostrBridge) relayIn(ev nostrEvent) {
+	if ev.PubKey == b.pub || ev.Kind != nostrKindTextNote {
+		return
+	}
+	b.mu.Lock()
+	dup := b.seen[ev.ID]
+	if !dup {
+		if len(b.seen) > 10000 {
+			b.seen = make(map[string]bool)
+		}
+		b.seen[ev.ID] = true
+	}
+	b.mu.Unlock()
+	if dup {
+		return
+	}
+	if len(b.cfg.Authors) > 0 && !containsString(b.cfg.Authors, ev.PubKey) {
+		logger.Debugf("nostr bridge: dropping event %s from %s: not in authors", ev.ID, ev.PubKey)
+		return
+	}
+	if err := verifyNostrEvent(ev); err != nil {
+		logger.Debugf("nostr bridge: dropping event %s: %s", ev.ID, err)
+		return
+	}
+	body := fmt.Sprintf("%s<%s> ", b.cfg.Prefix, shortID(ev.PubKey))
+	body += nostrText(ev.Content, node.MaxBodySize-len(body))
+	if _, err := b.a.rooms.publish(b.a.ctx, b.cfg.Room, body); err != nil {
+		logger.Warnf("nostr bridge: dropped event %s, not relayed to #%s: %s", ev.ID, b.cfg.Room, err)
+	}
+}
+
+// nostrText makes a note's content fit for a room message of at most
+// limit bytes: invalid UTF-8 and control and bidi characters other than newlines
+// and tabs, which peers refuse, are dropped, and what's too long is cut
+// with an ellipsis.
+func nostrText(s string, limit int) string {
+	s = strings.Map(func(r rune) rune {
+		if r != '\n' && r != '\t' && (unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) || r == '\u2028' || r == '\u2029') {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(s, ""))
+	if len(s) <= limit {
+		return s
+	}
+	const ellipsis = "…"
+	cut := max(limit-len(ellipsis), 0)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + ellipsis
+}
+
+// roomMessage publishes a room message to the relay as a signed note.
+func (b *nostrBridge) roomMessage(m Message) {
+	if m.Room != b.cfg.Room {
+		return
+	}
+	ev := nostrEvent{
+		PubKey:    b.pub,
+		CreatedAt: m.When / 1000,
+		Kind:      nostrKindTextNote,
+		Tags:      [][]string{{"t", b.cfg.Tag}, {"client", "peep-chat"}},
+		Content:   fmt.Sprintf("<%s> %s", shortID(m.From), m.Body),
+	}
+	if err := signNostrEvent(&ev, b.key); err != nil {
+		logger.Warnf("nostr bridge: signing: %s", err)
+		return
+	}
+	if err := b.write([]any{"EVENT", ev}); err != nil {
+		logger.Warnf("nostr bridge: publishing: %s", err)
+	}
+}
+
+func (b *nostrBridge) write(v any) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return errors.New("not connected")
+	}
+	b.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	return b.conn.WriteJSON(v)
+}
+
+func (b *nostrBridge) status() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := "disconnected"
+	if b.conn != nil {
+		state = "connected"
+	}
+	return fmt.Sprintf("%s t=%s <-> #%s (%s as %s)", b.cfg.Relay, b.cfg.Tag, b.cfg.Room, state, b.pub)
+}
+
+func (b *nostrBridge) close() {
+	close(b.stop)
+	b.mu.Lock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	b.mu.Unlock()
+}
+
+// nostrEventID computes the NIP-01 event id: the sha256 of the compact JSON
+// array [0, pubkey, created_at, kind, tags, content].
+func nostrEventID(ev nostrEvent) ([]byte, error) {
+	tags := ev.Tags
+	if tags == nil {
+		tags = [][]string{}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode([]any{0, ev.PubKey, ev.CreatedAt, ev.Kind, tags, ev.Content}); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return sum[:], nil
+}
+
+func signNostrEvent(ev *nostrEvent, key *btcec.PrivateKey) error {
+	id, err := nostrEventID(*ev)
+	if err != nil {
+		return err
+	}
+	sig, err := schnorr.Sign(key, id)
+	if err != nil {
+		return err
+	}
+	ev.ID = hex.EncodeToString(id)
+	ev.Sig = hex.EncodeToString(sig.Serialize())
+	return nil
+}
+
+func verifyNostrEvent(ev nostrEvent) error {
+	id, err := nostrEventID(ev)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(id) != ev.ID {
+		return errors.New("id mismatch")
+	}
+	pkb, err := hex.DecodeString(ev.PubKey)
+	if err != nil {
+		return err
+	}
+	pub, err := schnorr.ParsePubKey(pkb)
+	if err != nil {
+		return err
+	}
+	sigb, err := hex.DecodeString(ev.Sig)
+	if err != nil {
+		return err
+	}
+	sig, err := schnorr.ParseSignature(sigb)
+	if err != nil {
+		return err
+	}
+	if !sig.Verify(id, pub) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "nostr",
+		Summary: "show Nostr bridge status (configured in " + nostrConfigFile + ")",
+		Run: func(a *app, inv *invocation) error {
+			if a.nostr == nil {
+				fmt.Println("Nostr bridge not configured")
+				return nil
+			}
+			fmt.Println(a.nostr.status())
+			return nil
+		},
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifyIdleAfter is how long the prompt has to sit without input before we
+// assume the terminal is in the background. Terminals don't tell a cooked-mode
+// program about focus changes, so idleness is the best signal we have.
+const notifyIdleAfter = 30 * time.Second
+
+// Notification modes for one conversation.
+const (
+	notifyOn       = "on"
+	notifyOff      = "off"
+	notifyMentions = "mentions" // only messages that mention you or match a watch pattern
+)
+
+// notifier pops desktop notifications for incoming messages using whatever
+// the OS provides (notify-send, osascript, PowerShell toasts). Direct
+// messages notify by default and rooms only on mentions; either can be
+// overridden per conversation.
+type notifier struct {
+	mu        sync.Mutex
+	enabled   bool
+	always    bool              // notify even while the terminal looks focused
+	modes     map[string]string // conversation key (peer ID or #room) -> mode override
+	lastInput time.Time
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		enabled:   true,
+		modes:     make(map[string]string),
+		lastInput: time.Now(),
+	}
+}
+
+// touch records user activity at the prompt.
+func (n *notifier) touch() {
+	n.mu.Lock()
+	n.lastInput = time.Now()
+	n.mu.Unlock()
+}
+
+// shouldNotify reports whether a message in the conversation key should
+// raise a desktop notification right now; mention says whether it
+// mentions you.
+func (n *notifier) shouldNotify(key string, mention bool) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.enabled {
+		return false
+	}
+	mode, ok := n.modes[key]
+	if !ok {
+		mode = notifyOn
+		if strings.HasPrefix(key, "#") {
+			mode = notifyMentions
+		}
+	}
+	switch mode {
+	case notifyOff:
+		return false
+	case notifyMentions:
+		if !mention {
+			return false
+		}
+	}
+	return n.always || time.Since(n.lastInput) > notifyIdleAfter
+}
+
+// messageReceived is called for every message shown in a conversation,
+// direct or room, with key its conversation key.
+func (n *notifier) messageReceived(key string, m Message, mention bool) {
+	if !n.shouldNotify(key, mention) {
+		return
+	}
+	title, body := "peep-chat: "+shortID(m.From), m.Body
+	if m.Room != "" {
+		title, body = "peep-chat: #"+m.Room, shortID(m.From)+": "+m.Body
+	}
+	go func() {
+		if err := desktopNotify(title, body); err != nil {
+			logger.Debugf("desktop notification failed: %s", err)
+		}
+	}()
+}
+
+const notifyUsage = "usage: notify on|off|always|status | notify peer <peerID> on|off|default | notify room <name> on|off|mentions|default"
+
+// command handles `notify on|off|always|status`, `notify peer <peerID>
+// on|off|default` and `notify room <name> on|off|mentions|default`.
+func (n *notifier) command(args []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(args) == 0 {
+		args = []string{"status"}
+	}
+	switch args[0] {
+	case "on":
+		n.enabled = true
+		n.always = false
+	case "off":
+		n.enabled = false
+	case "always":
+		n.enabled = true
+		n.always = true
+	case "peer", "room":
+		if len(args) < 3 {
+			fmt.Println(notifyUsage)
+			return
+		}
+		key := args[1]
+		if args[0] == "room" {
+			key = "#" + strings.TrimPrefix(key, "#")
+		}
+		switch mode := args[2]; mode {
+		case notifyOn, notifyOff:
+			n.modes[key] = mode
+		case notifyMentions:
+			if args[0] != "room" {
+				fmt.Println(notifyUsage)
+				return
+			}
+			n.modes[key] = mode
+		case "default":
+			delete(n.modes, key)
+		default:
+			fmt.Println(notifyUsage)
+			return
+		}
+	case "status":
+	default:
+		fmt.Println(notifyUsage)
+		return
+	}
+	state := "off"
+	if n.enabled {
+		state = "on (when idle)"
+		if n.always {
+			state = "on (always)"
+		}
+	}
+	fmt.Println("notifications:", state, "- direct messages on, rooms on mentions")
+	keys := make([]string, 0, len(n.modes))
+	for k := range n.modes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %s: %s\n", k, n.modes[k])
+	}
+}
+
+// desktopNotify shows a notification through the platform's native tooling.
+func desktopNotify(title, body string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.Command("notify-send", "--app-name=peep-chat", "--", title, body)
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptQuote(body), appleScriptQuote(title))
+		cmd = exec.Command("osascript", "-e", script)
+	case "windows":
+		// The text goes in the environment, never into the script, so
+		// nothing in it can end a string and run as PowerShell.
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", windowsToastScript)
+		cmd.Env = append(os.Environ(), "PEEP_NOTIFY_TITLE="+title, "PEEP_NOTIFY_BODY="+body)
+	default:
+		return fmt.Errorf("desktop notifications not supported on %s", runtime.GOOS)
+	}
+	return cmd.Run()
+}
+
+func appleScriptQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// windowsToastScript shows a toast with the title and body it reads from
+// PEEP_NOTIFY_TITLE and PEEP_NOTIFY_BODY.
+const windowsToastScript = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null;` +
+	`$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02);` +
+	`$x = $t.GetElementsByTagName('text');` +
+	`$x.Item(0).AppendChild($t.CreateTextNode($env:PEEP_NOTIFY_TITLE)) > $null;` +
+	`$x.Item(1).AppendChild($t.CreateTextNode($env:PEEP_NOTIFY_BODY)) > $null;` +
+	`[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('peep-chat').Show([Windows.UI.Notifications.ToastNotification]::new($t))`
+
+// shortID trims a peer ID for display in space-constrained places.
+func shortID(id string) string {
+	if len(id) <= 12 {
+		return id
+	}
+	return id[:6] + "…" + id[len(id)-6:]
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "notify",
+		Usage:   "on|off|always|status | peer <peerID> on|off|default | room <name> on|off|mentions|default",
+		Summary: "desktop notifications for incoming messages",
+		Run: func(a *app, inv *invocation) error {
+			a.notes.command(inv.Args)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const outboxFile = "p2pchat_outbox.json"
+
+// Retry backoff for queued messages: it doubles from outboxRetryMin up to
+// outboxRetryMax, and a peer connecting makes its messages due at once.
+const (
+	outboxRetryMin = 15 * time.Second
+	outboxRetryMax = 30 * time.Minute
+)
+
+// outboxEntry is a message msg couldn't deliver, waiting for a retry.
+type outboxEntry struct {
+	ID       int    `json:"id"`
+	To       string `json:"to"`
+	Body     string `json:"body"`
+	Queued   int64  `json:"queued"` // unix ms
+	Attempts int    `json:"attempts"`
+	Next     int64  `json:"next"` // unix ms of the next retry
+	LastErr  string `json:"last_error,omitempty"`
+}
+
+// outbox queues undelivered direct messages, persisted to outboxFile in
+// the data directory, in the order they were written.
+type outbox struct {
+	mu      sync.Mutex
+	path    string
+	lastID  int
+	entries []*outboxEntry
+	wake    chan struct{}
+}
+
+func loadOutbox(path string) (*outbox, error) {
+	o := &outbox{path: path, wake: make(chan struct{}, 1)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &o.entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, e := range o.entries {
+		o.lastID = max(o.lastID, e.ID)
+	}
+	return o, nil
+}
+
+// add queues body for to after a failed first attempt.
+func (o *outbox) add(to, body string, err error) outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastID++
+	now := time.Now()
+	e := &outboxEntry{ID: o.lastID, To: to, Body: body, Queued: now.UnixMilli(), Attempts: 1,
+		Next: now.Add(outboxRetryMin).UnixMilli(), LastErr: err.Error()}
+	o.entries = append(o.entries, e)
+	o.save()
+	return *e
+}
+
+// due returns the oldest entry of each peer whose retry time has come;
+// later ones wait so a peer gets its messages in order.
+func (o *outbox) due(now time.Time) []outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	seen := make(map[string]bool)
+	var out []outboxEntry
+	for _, e := range o.entries {
+		if seen[e.To] {
+			continue
+		}
+		seen[e.To] = true
+		if e.Next <= now.UnixMilli() {
+			out = append(out, *e)
+		}
+	}
+	return out
+}
+
+// delivered drops entry id.
+func (o *outbox) delivered(id int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, e := range o.entries {
+		if e.ID == id {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			o.save()
+			return
+		}
+	}
+}
+
+// failed backs entry id off after another failed attempt.
+func (o *outbox) failed(id int, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, e := range o.entries {
+		if e.ID == id {
+			e.Attempts++
+			e.LastErr = err.Error()
+			e.Next = time.Now().Add(outboxBackoff(e.Attempts)).UnixMilli()
+			o.save()
+			return
+		}
+	}
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	d := outboxRetryMin
+	for i := 1; i < attempts && d < outboxRetryMax; i++ {
+		d *= 2
+	}
+	return min(d, outboxRetryMax)
+}
+
+// list returns a copy of the queue, oldest first.
+func (o *outbox) list() []outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make([]outboxEntry, len(o.entries))
+	for i, e := range o.entries {
+		out[i] = *e
+	}
+	return out
+}
+
+// cancel drops entry id without delivering it.
+func (o *outbox) cancel(id int) (outboxEntry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, e := range o.entries {
+		if e.ID == id {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			o.save()
+			return *e, true
+		}
+	}
+	return outboxEntry{}, false
+}
+
+// flush makes every entry due now and wakes the retry loop. It returns
+// how many there are.
+func (o *outbox) flush() int {
+	o.mu.Lock()
+	for _, e := range o.entries {
+		e.Next = 0
+	}
+	n := len(o.entries)
+	o.mu.Unlock()
+	o.poke()
+	return n
+}
+
+// peerConnected makes to's messages due now and wakes the retry loop.
+func (o *outbox) peerConnected(to string) {
+	o.mu.Lock()
+	found := false
+	for _, e := range o.entries {
+		if e.To == to {
+			e.Next, found = 0, true
+		}
+	}
+	o.mu.Unlock()
+	if found {
+		o.poke()
+	}
+}
+
+func (o *outbox) poke() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save writes the queue; callers hold o.mu.
+func (o *outbox) save() {
+	data, err := json.MarshalIndent(o.entries, "", "  ")
+	if err == nil {
+		err = os.WriteFile(o.path, data, 0600)
+	}
+	if err != nil {
+		logger.Warnf("saving outbox: %s", err)
+	}
+}
+
+// queueMessage puts a message msg couldn't deliver in the outbox.
+func (a *app) queueMessage(to, body string, err error) {
+	e := a.outbox.add(to, body, err)
+	a.showQueued(e)
+	printResult(map[string]any{"queued": e.ID, "to": to, "error": err.Error()},
+		fmt.Sprintf("%s is unreachable (%s); queued as #%d and will retry", a.conversationLabel(to), err, e.ID))
+}
+
+// runOutbox retries queued messages in the background until ctx ends.
+func (a *app) runOutbox() {
+	for _, e := range a.outbox.list() {
+		a.showQueued(e)
+	}
+	tick := time.NewTicker(5 * time.Second)
+	go func() {
+		defer tick.Stop()
+		for {
+			for _, e := range a.outbox.due(time.Now()) {
+				a.retryQueued(e)
+			}
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-tick.C:
+			case <-a.outbox.wake:
+			}
+		}
+	}()
+}
+
+// retryQueued makes one delivery attempt, waiting for the peer's
+// acknowledgement so a message leaves the outbox only once it arrived.
+func (a *app) retryQueued(e outboxEntry) {
+	ctx, cancel := context.WithTimeout(a.ctx, 30*time.Second)
+	var m Message
+	pi, err := a.contacts.resolve(e.To)
+	if err == nil {
+		err = dialPeer(ctx, a.node, pi)
+	}
+	if err == nil && a.contacts.requiresE2E(e.To) {
+		err = checkEncrypted(a.h, pi.ID)
+	}
+	if err == nil {
+		m, err = a.node.Deliver(ctx, e.To, e.Body)
+	}
+	cancel()
+	if err != nil {
+		logger.Debugf("outbox #%d to %s: %s", e.ID, e.To, err)
+		if a.tryForward(e.To, e.Body) {
+			a.outbox.delivered(e.ID)
+			a.deliveries.advance(a.queuedID(e), stateSent, "contacts, to forward", "")
+			return
+		}
+		a.outbox.failed(e.ID, err)
+		return
+	}
+	a.outbox.delivered(e.ID)
+	a.outbox.poke() // the peer's next message, if any, is due too
+	a.scroll.rekey(e.To, a.queuedID(e), m.ID())
+	a.deliveries.alias(a.queuedID(e), m.ID())
+	a.messageSent(e.To, m)
+	a.deliveries.advance(m.ID(), stateDelivered, fmt.Sprintf("direct, from outbox #%d", e.ID), "")
+	if jsonOutput {
+		printJSON(map[string]any{"event": "outbox_delivered", "id": e.ID, "to": e.To, "message": m})
+		return
+	}
+	fmt.Printf("\nqueued message #%d delivered to %s\n%s", e.ID, a.conversationLabel(e.To), a.prompt())
+}
+
+// state describes where e is in its retries.
+func (e outboxEntry) state() string {
+	if e.Attempts <= 1 {
+		return "pending"
+	}
+	return fmt.Sprintf("failing (%d attempts)", e.Attempts)
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "outbox",
+		Usage:   "[cancel <id> | flush]",
+		Summary: "list queued undelivered messages with their retry state; cancel one, or flush to retry all now",
+		Run: func(a *app, inv *invocation) error {
+			switch {
+			case len(inv.Args) == 0:
+				entries := a.outbox.list()
+				if jsonOutput {
+					printJSON(map[string]any{"outbox": entries})
+					return nil
+				}
+				if len(entries) == 0 {
+					fmt.Println("outbox is empty")
+				}
+				now := time.Now()
+				for _, e := range entries {
+					next := "now"
+					if wait := time.UnixMilli(e.Next).Sub(now); wait > 0 {
+						next = "in " + wait.Round(time.Second).String()
+					}
+					fmt.Printf("#%d to %s, queued %s ago, %s, next try %s\n   %s\n", e.ID, a.conversationLabel(e.To),
+						now.Sub(time.UnixMilli(e.Queued)).Round(time.Second), e.state(), next, e.Body)
+					if e.LastErr != "" {
+						fmt.Println("  ", styles.dim("last error: "+e.LastErr))
+					}
+				}
+			case inv.Args[0] == "cancel" && len(inv.Args) == 2:
+				id, err := strconv.Atoi(strings.TrimPrefix(inv.Args[1], "#"))
+				if err != nil {
+					return fmt.Errorf("invalid id %q", inv.Args[1])
+				}
+				e, ok := a.outbox.cancel(id)
+				if !ok {
+					fmt.Println("no queued message", inv.Args[1])
+					return nil
+				}
+				a.deliveries.advance(a.queuedID(e), stateFailed, "", "cancelled in the outbox")
+				printResult(map[string]any{"cancelled": e.ID}, fmt.Sprintf("cancelled #%d to %s", e.ID, a.conversationLabel(e.To)))
+			case inv.Args[0] == "flush" && len(inv.Args) == 1:
+				n := a.outbox.flush()
+				printResult(map[string]any{"flushed": n}, fmt.Sprintf("retrying %d queued messages now", n))
+			default:
+				fmt.Println("usage: outbox [cancel <id> | flush]")
+			}
+			return nil
+		},
+	})
+}
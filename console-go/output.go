@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"p2p-chat/node"
+)
+
+// jsonOutput is set by --json: commands with structured results print them
+// as one JSON object per line instead of text, and incoming messages and
+// errors become JSON events, so other programs can parse the output.
+var jsonOutput bool
+
+// printJSON writes v as a single line of JSON.
+func printJSON(v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Warnf("encoding output: %s", err)
+		return
+	}
+	fmt.Println(string(b))
+}
+
+// Shapes of the --json output. Every line is an object; events carry an
+// "event" field, command results are keyed by what they report.
+type (
+	startedEvent struct {
+		Event  string   `json:"event"` // "started"
+		PeerID string   `json:"peer_id"`
+		Addrs  []string `json:"addrs"`
+	}
+	messageEvent struct {
+		Event string `json:"event"` // "message"
+		Message
+		Highlight string `json:"highlight,omitempty"` // the watch pattern it matched
+	}
+	peerEvent struct {
+		Event     string `json:"event"` // "connected", "disconnected", "goodbye", "offline", "throttled" or "blocked"
+		Peer      string `json:"peer"`
+		Transport string `json:"transport,omitempty"` // for "connected"
+		Relayed   bool   `json:"relayed,omitempty"`
+	}
+	presenceEvent struct {
+		Event  string `json:"event"` // "presence"
+		Peer   string `json:"peer"`
+		State  string `json:"state"`
+		Status string `json:"status,omitempty"`
+	}
+	errorEvent struct {
+		Event   string `json:"event"` // "error"
+		Command string `json:"command,omitempty"`
+		Error   string `json:"error"`
+	}
+	peerInfo struct {
+		Peer      string  `json:"peer"`
+		LatencyMS float64 `json:"latency_ms,omitempty"`
+		Unread    int     `json:"unread,omitempty"`
+	}
+	fetchResult struct {
+		Source    string    `json:"source"` // "mailbox" or "dht"
+		Messages  []Message `json:"messages"`
+		Untrusted []int     `json:"untrusted,omitempty"` // indexes of messages sent after a key revocation
+		Withheld  []int     `json:"withheld,omitempty"`  // indexes of messages from require-e2e contacts, bodies blanked
+		// Verification is each message's: "verified" or "invalid" (unsigned
+		// or badly signed), whose bodies are blanked unless -show-invalid.
+		Verification []node.Verification `json:"verification"`
+		Invalid      []int               `json:"invalid,omitempty"`
+	}
+)
+
+// printResult prints v in --json mode and text otherwise.
+func printResult(v any, text string) {
+	if jsonOutput {
+		printJSON(v)
+		return
+	}
+	fmt.Println(text)
+}
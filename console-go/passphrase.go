@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"p2p-chat/node"
+)
+
+// identityPassphrase is the client's source for a passphrase-protected
+// key: $PEEP_PASSPHRASE, else a prompt if stdin is a terminal.
+func identityPassphrase() ([]byte, error) {
+	if p, err := node.EnvPassphrase(); err == nil {
+		return p, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return nil, fmt.Errorf("%w; set %s or run from a terminal", node.ErrPassphraseRequired, node.PassphraseEnv)
+	}
+	return readPassphrase(bufio.NewReader(os.Stdin), "Passphrase: ")
+}
+
+// readPassphrase reads one line with terminal echo turned off. The prompt
+// goes to stderr, so it doesn't mix with output such as an exported key.
+// Echo is switched with stty, so where there is none (Windows) it stays on.
+func readPassphrase(r *bufio.Reader, prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if isTerminal(os.Stdin) {
+		setEcho(false)
+		defer func() {
+			setEcho(true)
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := r.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+func setEcho(on bool) {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}
@@ -0,0 +1,219 @@
+// Package paths locates peep-chat's files: configuration under the OS
+// config directory and state (identity, read markers, keys) under the data
+// directory. On Linux these follow XDG ($XDG_CONFIG_HOME, $XDG_DATA_HOME);
+// on macOS and Windows both live in the user's application support or
+// AppData folder. A single override directory replaces both.
+package paths
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// appDir is the per-user subdirectory name.
+const appDir = "peep-chat"
+
+// IdentityFile is the node key's file name inside the data directory.
+const IdentityFile = "p2pchat_id.key"
+
+// Dirs are the directories a node reads and writes.
+type Dirs struct {
+	Config string
+	Data   string
+}
+
+// Resolve returns the standard directories, or override for both if set.
+func Resolve(override string) (Dirs, error) {
+	if override != "" {
+		return Dirs{Config: override, Data: override}, nil
+	}
+	cfg, err := os.UserConfigDir()
+	if err != nil {
+		return Dirs{}, err
+	}
+	data, err := dataHome()
+	if err != nil {
+		return Dirs{}, err
+	}
+	return Dirs{Config: filepath.Join(cfg, appDir), Data: filepath.Join(data, appDir)}, nil
+}
+
+// Ensure creates the directories if needed. They hold private keys, so
+// they are only accessible to the user.
+func (d Dirs) Ensure() error {
+	for _, dir := range []string{d.Config, d.Data} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigFile returns the path of a configuration file.
+func (d Dirs) ConfigFile(name string) string { return filepath.Join(d.Config, name) }
+
+// DataFile returns the path of a state file.
+func (d Dirs) DataFile(name string) string { return filepath.Join(d.Data, name) }
+
+// DefaultIdentityPath is where front ends find the node key when given no
+// directory, after Open has set the directories up; it falls back to the
+// working directory if they can't be.
+func DefaultIdentityPath() string {
+	d, err := Open("")
+	if err != nil {
+		return IdentityFile
+	}
+	return d.DataFile(IdentityFile)
+}
+
+// Open resolves the directories like Resolve, creates them and moves in
+// what versions before them kept in the working directory, so an upgrade
+// doesn't silently start a new identity. Every entry point that loads or
+// creates state goes through it.
+func Open(override string) (Dirs, error) {
+	d, err := Resolve(override)
+	if err != nil {
+		return Dirs{}, err
+	}
+	if err := d.Ensure(); err != nil {
+		return Dirs{}, err
+	}
+	for _, name := range legacyFiles {
+		dst := d.DataFile(name)
+		moved, err := moveLegacy(name, dst)
+		if err != nil {
+			return Dirs{}, fmt.Errorf("move ./%s to %s: %w", name, dst, err)
+		}
+		if moved {
+			fmt.Fprintf(os.Stderr, "moved ./%s to %s\n", name, dst)
+		}
+	}
+	return d, nil
+}
+
+// legacyFiles are the files released versions wrote to the working
+// directory: the node key and the read markers.
+var legacyFiles = []string{IdentityFile, "p2pchat_read.json"}
+
+// moveLegacy moves name from the working directory to dst, unless dst
+// already exists. It copies when the two are on different filesystems.
+// It reports whether a file was moved.
+func moveLegacy(name, dst string) (bool, error) {
+	src, err := filepath.Abs(name)
+	if err != nil {
+		return false, err
+	}
+	if abs, err := filepath.Abs(dst); err == nil && abs == src {
+		return false, nil
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return false, nil
+	}
+	if _, err := os.Stat(src); errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	err = os.Rename(src, dst)
+	if errors.Is(err, syscall.EXDEV) {
+		if err = copyFile(src, dst); err == nil {
+			err = os.Remove(src)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// copyFile copies src to a new file dst with the same permissions and
+// syncs it, removing dst again if anything fails.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+func dataHome() (string, error) {
+	switch runtime.GOOS {
+	case "windows", "darwin", "ios":
+		return os.UserConfigDir()
+	}
+	if d := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(d) {
+		return d, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share"), nil
+}
+
+// profilesDir holds the directories of accounts other than the default,
+// one per profile, under both the config and data directories.
+const profilesDir = "profiles"
+
+// ValidProfile reports whether name can name a profile: letters, digits,
+// '-' and '_', as it becomes a directory name.
+func ValidProfile(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Profile returns the directories of profile name, or d itself for "".
+func (d Dirs) Profile(name string) Dirs {
+	if name == "" {
+		return d
+	}
+	return Dirs{Config: filepath.Join(d.Config, profilesDir, name), Data: filepath.Join(d.Data, profilesDir, name)}
+}
+
+// Profiles lists the profiles that have a data directory under d.
+func (d Dirs) Profiles() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(d.Data, profilesDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && ValidProfile(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,69 @@
+package paths
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenMovesLegacyFiles(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	for _, name := range []string{IdentityFile, "plugins"} {
+		if err := os.WriteFile(name, []byte("old"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(t.TempDir(), "state")
+	d, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(d.DataFile(IdentityFile)); err != nil || string(b) != "old" {
+		t.Fatalf("identity not moved: %q, %v", b, err)
+	}
+	if _, err := os.Stat(IdentityFile); !os.IsNotExist(err) {
+		t.Fatalf("identity left in the working directory: %v", err)
+	}
+	if _, err := os.Stat("plugins"); err != nil {
+		t.Fatalf("unrelated file moved: %v", err)
+	}
+
+	// A key already in place is never overwritten.
+	if err := os.WriteFile(IdentityFile, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(d.DataFile(IdentityFile)); string(b) != "old" {
+		t.Fatalf("identity overwritten with %q", b)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want 0600", info.Mode().Perm())
+	}
+	if err := copyFile(src, dst); err == nil {
+		t.Error("copied over an existing file")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Which peers' connections and disconnections the console announces
+// (--peer-events).
+const (
+	peerEventsKnown = "known" // contacts and open conversations
+	peerEventsAll   = "all"
+	peerEventsNone  = "none"
+)
+
+// departedQuiet is how long after a goodbye or going offline a peer's
+// disconnection isn't announced again.
+const departedQuiet = 10 * time.Second
+
+// peerEvents announces peers connecting and disconnecting.
+type peerEvents struct {
+	show string // peerEvents*
+
+	mu       sync.Mutex
+	departed map[peer.ID]time.Time // announced gone, by goodbye or OnOffline
+}
+
+func newPeerEvents(show string) (*peerEvents, error) {
+	switch show {
+	case peerEventsKnown, peerEventsAll, peerEventsNone:
+	default:
+		return nil, fmt.Errorf("--peer-events: want known, all or none, not %q", show)
+	}
+	return &peerEvents{show: show, departed: make(map[peer.ID]time.Time)}, nil
+}
+
+// departing records that p's going has been announced already.
+func (pe *peerEvents) departing(p peer.ID) {
+	pe.mu.Lock()
+	pe.departed[p] = time.Now()
+	pe.mu.Unlock()
+}
+
+// announced reports whether p's going was announced lately, forgetting it.
+func (pe *peerEvents) announced(p peer.ID) bool {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	t, ok := pe.departed[p]
+	delete(pe.departed, p)
+	return ok && time.Since(t) < departedQuiet
+}
+
+// connRoute names c's transport and whether it goes through a relay.
+func connRoute(c network.Conn) (transport string, relayed bool) {
+	if _, err := c.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT); err == nil {
+		return "relay", true
+	}
+	switch t := c.ConnState().Transport; t {
+	case "tcp":
+		return "TCP", false
+	case "quic", "quic-v1":
+		return "QUIC", false
+	case "webtransport":
+		return "WebTransport", false
+	case "webrtc-direct", "webrtc":
+		return "WebRTC", false
+	case "":
+		return "unknown transport", false
+	default:
+		return t, false
+	}
+}
+
+// shownPeer reports whether --peer-events covers p.
+func (a *app) shownPeer(p peer.ID) bool {
+	switch a.peerEvents.show {
+	case peerEventsAll:
+		return true
+	case peerEventsNone:
+		return false
+	}
+	key := p.String()
+	return a.contacts.nameOf(key) != "" || a.convs.index(key) >= 0
+}
+
+// peerConnected announces c if it's p's first connection, or its first
+// direct one after only relayed ones.
+func (a *app) peerConnected(c network.Conn) {
+	p := c.RemotePeer()
+	transport, relayed := connRoute(c)
+	conns := a.h.Network().ConnsToPeer(p)
+	upgraded := false
+	if len(conns) > 1 {
+		if relayed {
+			return
+		}
+		for _, other := range conns {
+			if other == c {
+				continue
+			}
+			if _, r := connRoute(other); !r {
+				return // already had a direct one
+			}
+		}
+		upgraded = true
+	}
+	a.hooks.fire(hookEvent{Type: eventPeerConnected, Peer: p.String(), Transport: transport, Relayed: relayed})
+	if !a.shownPeer(p) {
+		return
+	}
+	route := "direct"
+	if relayed {
+		route = "relayed"
+	}
+	a.post(func() {
+		if jsonOutput {
+			printJSON(peerEvent{Event: "connected", Peer: p.String(), Transport: transport, Relayed: relayed})
+			return
+		}
+		what := fmt.Sprintf("connected (via %s, %s)", transport, route)
+		if upgraded {
+			what = fmt.Sprintf("now connected directly (via %s)", transport)
+		}
+		a.announcePeer(p, what)
+	})
+}
+
+// peerDisconnected announces p's last connection closing, unless its going
+// was just announced another way.
+func (a *app) peerDisconnected(p peer.ID) {
+	if a.h.Network().Connectedness(p) == network.Connected {
+		return
+	}
+	a.hooks.fire(hookEvent{Type: eventPeerDisconnected, Peer: p.String()})
+	if !a.shownPeer(p) || a.peerEvents.announced(p) {
+		return
+	}
+	a.post(func() {
+		if jsonOutput {
+			printJSON(peerEvent{Event: "disconnected", Peer: p.String()})
+			return
+		}
+		a.announcePeer(p, "disconnected")
+	})
+}
+
+// announcePeer prints a status line about p.
+func (a *app) announcePeer(p peer.ID, what string) {
+	if screenReader {
+		fmt.Printf("\n%s %s.\n%s", a.conversationLabel(p.String()), what, a.prompt())
+		return
+	}
+	fmt.Printf("\n%s\n%s", styles.system("* "+a.conversationLabel(p.String())+" "+what), a.prompt())
+}
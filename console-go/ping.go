@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+// pingPeer sends count libp2p pings to pid, one per second, and prints each
+// RTT followed by a loss/min/avg/max summary. Successful pings also update
+// the peerstore latency shown by 'peers'.
+func pingPeer(ctx context.Context, a *app, pid peer.ID, count int) {
+	var sent, lost int
+	var min, max, sum time.Duration
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		sent++
+		pctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		res := <-ping.Ping(pctx, a.h, pid)
+		cancel()
+		if res.Error != nil {
+			lost++
+			fmt.Printf("ping %s: seq=%d error: %s\n", shortID(pid.String()), i+1, res.Error)
+			continue
+		}
+		fmt.Printf("ping %s: seq=%d rtt=%s\n", shortID(pid.String()), i+1, res.RTT.Round(time.Microsecond))
+		sum += res.RTT
+		if min == 0 || res.RTT < min {
+			min = res.RTT
+		}
+		if res.RTT > max {
+			max = res.RTT
+		}
+	}
+	fmt.Printf("%d sent, %d received, %.0f%% loss", sent, sent-lost, 100*float64(lost)/float64(sent))
+	if ok := sent - lost; ok > 0 {
+		avg := sum / time.Duration(ok)
+		fmt.Printf(", rtt min/avg/max = %s/%s/%s", min.Round(time.Microsecond), avg.Round(time.Microsecond), max.Round(time.Microsecond))
+	}
+	fmt.Println()
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "ping",
+		Usage:   "[-c count] <peerID>",
+		Summary: "measure round-trip time and loss to a peer",
+		MinArgs: 1,
+		Flags: func(fs *flag.FlagSet) {
+			fs.Int("c", 5, "number of pings")
+		},
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			pid, err := peer.Decode(inv.Args[0])
+			if err != nil {
+				return err
+			}
+			pingPeer(inv.Context(), a, pid, max(inv.Int("c"), 1))
+			return nil
+		},
+	})
+}
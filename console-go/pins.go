@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+const pinsFile = "p2pchat_pins.json"
+
+// maxHeld caps the messages kept back per peer while a change awaits
+// 'trust'; older ones are dropped.
+const maxHeld = 100
+
+// pin is what we saw of a peer on first contact: trust on first use.
+type pin struct {
+	Key   string `json:"key"`             // fingerprint of its public key
+	Agent string `json:"agent,omitempty"` // product it claims in identify, e.g. "peep-chat"
+	First int64  `json:"first"`           // unix ms
+	// Changed describes a difference from the pin that hasn't been
+	// confirmed with 'trust'; the peer's messages are held meanwhile.
+	// NewKey and NewAgent are what 'trust' pins.
+	Changed  string `json:"changed,omitempty"`
+	NewKey   string `json:"new_key,omitempty"`
+	NewAgent string `json:"new_agent,omitempty"`
+}
+
+// pinStore pins every peer's key and claimed agent on first contact,
+// persisted to pinsFile in the data directory.
+type pinStore struct {
+	mu   sync.Mutex
+	path string
+	pins map[string]*pin
+	held map[string][]Message
+}
+
+func loadPins(path string) (*pinStore, error) {
+	ps := &pinStore{path: path, pins: make(map[string]*pin), held: make(map[string][]Message)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ps.pins); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ps, nil
+}
+
+// observe compares what a peer presents now with its pin, pinning it if
+// it's new. It returns a description of a newly found change, "" if
+// nothing new is wrong, and whether the peer was pinned just now. An
+// empty agent (identify hasn't finished) matches anything.
+func (ps *pinStore) observe(peerID, key, agent string) (changed string, first bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.pins[peerID]
+	if !ok {
+		ps.pins[peerID] = &pin{Key: key, Agent: agent, First: time.Now().UnixMilli()}
+		ps.save()
+		return "", true
+	}
+	if p.Agent == "" && agent != "" && p.Changed == "" {
+		p.Agent = agent
+		ps.save()
+	}
+	if p.Changed != "" {
+		return "", false
+	}
+	var what []string
+	if key != p.Key {
+		what = append(what, fmt.Sprintf("its key changed from %s to %s", p.Key, key))
+	}
+	if agent != "" && p.Agent != "" && agent != p.Agent {
+		what = append(what, fmt.Sprintf("it now claims to be %q instead of %q", agent, p.Agent))
+	}
+	if len(what) == 0 {
+		return "", false
+	}
+	p.Changed, p.NewKey, p.NewAgent = strings.Join(what, "; "), key, agent
+	ps.save()
+	return p.Changed, false
+}
+
+// hold keeps m back if peerID has an unconfirmed change.
+func (ps *pinStore) hold(peerID string, m Message) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.pins[peerID]
+	if !ok || p.Changed == "" {
+		return false
+	}
+	held := append(ps.held[peerID], m)
+	if len(held) > maxHeld {
+		held = held[len(held)-maxHeld:]
+	}
+	ps.held[peerID] = held
+	return true
+}
+
+// trust accepts peerID's change: what it presents now becomes its pin.
+// It returns the messages held back meanwhile.
+func (ps *pinStore) trust(peerID string) ([]Message, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.pins[peerID]
+	if !ok || p.Changed == "" {
+		return nil, false
+	}
+	p.Key, p.Agent = p.NewKey, p.NewAgent
+	p.Changed, p.NewKey, p.NewAgent = "", "", ""
+	ps.save()
+	held := ps.held[peerID]
+	delete(ps.held, peerID)
+	return held, true
+}
+
+// pending returns the peers awaiting 'trust', with what changed and how
+// many messages are held.
+func (ps *pinStore) pending() []pendingTrust {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var out []pendingTrust
+	for id, p := range ps.pins {
+		if p.Changed != "" {
+			out = append(out, pendingTrust{Peer: id, Changed: p.Changed, Held: len(ps.held[id])})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Peer < out[j].Peer })
+	return out
+}
+
+func (ps *pinStore) get(peerID string) (pin, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.pins[peerID]
+	if !ok {
+		return pin{}, false
+	}
+	return *p, true
+}
+
+// save writes the pins; callers hold ps.mu.
+func (ps *pinStore) save() {
+	data, err := json.MarshalIndent(ps.pins, "", "  ")
+	if err == nil {
+		err = os.WriteFile(ps.path, data, 0600)
+	}
+	if err != nil {
+		logger.Warnf("saving key pins: %s", err)
+	}
+}
+
+type pendingTrust struct {
+	Peer    string `json:"peer"`
+	Changed string `json:"changed"`
+	Held    int    `json:"held"`
+}
+
+// identityChangedEvent is the --json form of a pin mismatch.
+type identityChangedEvent struct {
+	Event   string `json:"event"` // "identity_changed"
+	Peer    string `json:"peer"`
+	Changed string `json:"changed"`
+}
+
+// checkPin compares peerID's key and identify agent with its pin and
+// warns about a new change.
+func (a *app) checkPin(p peer.ID, agent string) {
+	pub := a.h.Peerstore().PubKey(p)
+	if pub == nil {
+		return
+	}
+	fp, err := node.Fingerprint(pub)
+	if err != nil {
+		return
+	}
+	if agent == "" {
+		if v, err := a.h.Peerstore().Get(p, "AgentVersion"); err == nil {
+			agent, _ = v.(string)
+		}
+	}
+	product, _, _ := strings.Cut(agent, "/")
+	changed, first := a.pins.observe(p.String(), fp, product)
+	if first {
+		a.audit.record(auditFirstContact, p.String(), "key "+fp)
+	}
+	if changed != "" {
+		a.audit.record(auditIdentityChanged, p.String(), changed)
+		a.identityChanged(p.String(), changed)
+	}
+}
+
+// identityChanged warns that peerID no longer matches its pin.
+func (a *app) identityChanged(peerID, changed string) {
+	label := a.conversationLabel(peerID)
+	arg := a.contacts.nameOf(peerID)
+	if arg == "" {
+		arg = peerID
+	}
+	switch {
+	case jsonOutput:
+		printJSON(identityChangedEvent{Event: "identity_changed", Peer: peerID, Changed: changed})
+	case screenReader:
+		fmt.Printf("\nSecurity warning: %s has changed: %s. Its messages are held until you type trust %s.\n%s", label, changed, arg, a.prompt())
+	default:
+		fmt.Printf("\n%s\n%s\n%s", styles.err("!!! SECURITY WARNING: "+label+" ("+peerID+") changed: "+changed+"."),
+			styles.err("!!! This may be someone else. Its messages are held until you check and run 'trust "+arg+"'."), a.prompt())
+	}
+}
+
+// watchIdentify checks pins whenever identify finishes with a peer, so
+// changes are noticed on connection and not only on a message.
+func (a *app) watchIdentify() {
+	sub, err := a.h.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
+	if err != nil {
+		logger.Warnf("watching identify: %s", err)
+		return
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case ev := <-sub.Out():
+				e := ev.(event.EvtPeerIdentificationCompleted)
+				a.checkPin(e.Peer, e.AgentVersion)
+				if slices.Contains(e.Protocols, node.PresenceProtocolID) {
+					go a.announcePresence([]peer.ID{e.Peer})
+				}
+				if slices.Contains(e.Protocols, node.ProfileProtocolID) {
+					if a.contacts.nameOf(e.Peer.String()) != "" {
+						go a.learnProfile(e.Peer)
+					} else if _, ok := node.ParseAgentFeatures(e.AgentVersion); !ok {
+						go a.learnFeatures(e.Peer)
+					}
+				}
+			}
+		}
+	}()
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "trust",
+		Usage:   "[<peerID|contact>]",
+		Summary: "accept a peer whose key or claimed identity changed and show its held messages; alone, list such peers",
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) == 0 {
+				pending := a.pins.pending()
+				if jsonOutput {
+					printJSON(map[string]any{"pending": pending})
+					return nil
+				}
+				if len(pending) == 0 {
+					fmt.Println("no peers await trust")
+				}
+				for _, pt := range pending {
+					fmt.Printf(" - %s: %s (%d held)\n", a.conversationLabel(pt.Peer), pt.Changed, pt.Held)
+				}
+				return nil
+			}
+			id := a.contacts.peerID(inv.Args[0])
+			held, ok := a.pins.trust(id)
+			if !ok {
+				fmt.Println(inv.Args[0], "has no unconfirmed change")
+				return nil
+			}
+			p, _ := a.pins.get(id)
+			a.audit.record(auditTrusted, id, "pinned key "+p.Key)
+			fmt.Printf("trusted %s; pinned key %s\n", a.conversationLabel(id), p.Key)
+			for _, m := range held {
+				a.messageAccepted(id, m)
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// WebAssembly plugins live as *.wasm files in the plugins directory. They
+// run sandboxed in wazero and see the node only through the "peep" host
+// module:
+//
+//	log(ptr, len)                              write a line to the log
+//	send(toPtr, toLen, bodyPtr, bodyLen) i32   send a direct message; 0 on success
+//	storage_get(kPtr, kLen, outPtr, outCap) i32
+//	    copy the value for key into out; returns its length (nothing is
+//	    copied if it exceeds outCap) or -1 if unset
+//	storage_set(kPtr, kLen, vPtr, vLen) i32    store a value; 0 on success
+//
+// A plugin exports alloc(size) ptr so the host can hand it data, and
+// optionally on_message(ptr, len), which receives each incoming message as
+// JSON: {"from": "...", "when": 0, "body": "..."}.
+//
+// Each call into a plugin gets pluginCallTimeout and its memory is capped at
+// pluginMemoryPages; a plugin that runs over is shut down. What it writes to
+// stdout and stderr goes to the log, and its storage is capped too.
+const pluginHostModule = "peep"
+
+const (
+	// pluginCallTimeout bounds a single call into a plugin, host
+	// functions such as send included.
+	pluginCallTimeout = 10 * time.Second
+	// pluginMemoryPages caps a plugin's linear memory, in 64 KiB pages
+	// (16 MiB).
+	pluginMemoryPages = 256
+	// maxPluginStorageKeys and maxPluginStorageBytes cap a plugin's
+	// key/value store: how many keys, and their keys and values in all.
+	maxPluginStorageKeys  = 1024
+	maxPluginStorageBytes = 1 << 20
+)
+
+// wasmPlugin is one loaded plugin instance. Instances aren't safe for
+// concurrent calls, so every call into the guest holds mu.
+type wasmPlugin struct {
+	name string
+	mu   sync.Mutex
+	mod  api.Module
+
+	storagePath string
+	storage     map[string]string
+}
+
+// pluginHost owns the wazero runtime and all loaded plugins.
+type pluginHost struct {
+	a       *app
+	runtime wazero.Runtime
+	plugins map[string]*wasmPlugin
+}
+
+// loadPlugins instantiates every *.wasm file in dir. A missing directory just
+// means no plugins; a broken plugin is reported and skipped.
+func loadPlugins(ctx context.Context, a *app, dir string) (*pluginHost, error) {
+	ph := &pluginHost{a: a, plugins: make(map[string]*wasmPlugin)}
+	files, err := filepath.Glob(filepath.Join(dir, "*.wasm"))
+	if err != nil || len(files) == 0 {
+		return ph, err
+	}
+	cfg := wazero.NewRuntimeConfig().WithCloseOnContextDone(true).WithMemoryLimitPages(pluginMemoryPages)
+	ph.runtime = wazero.NewRuntimeWithConfig(ctx, cfg)
+	wasi_snapshot_preview1.MustInstantiate(ctx, ph.runtime)
+	if err := ph.instantiateHostModule(ctx); err != nil {
+		ph.close(ctx)
+		return nil, err
+	}
+	for _, f := range files {
+		p, err := ph.load(ctx, f)
+		if err != nil {
+			logger.Warnf("plugin %s: %s", filepath.Base(f), err)
+			continue
+		}
+		ph.plugins[p.name] = p
+		logger.Infof("loaded plugin %s", p.name)
+	}
+	return ph, nil
+}
+
+func (ph *pluginHost) load(ctx context.Context, path string) (*wasmPlugin, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(path), ".wasm")
+	p := &wasmPlugin{name: name, storagePath: strings.TrimSuffix(path, ".wasm") + ".storage.json", storage: make(map[string]string)}
+	if b, err := os.ReadFile(p.storagePath); err == nil {
+		if err := json.Unmarshal(b, &p.storage); err != nil {
+			return nil, fmt.Errorf("storage: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	compiled, err := ph.runtime.CompileModule(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	cfg := wazero.NewModuleConfig().WithName(name).WithStartFunctions("_initialize").
+		WithStdout(pluginLog{name: name}).WithStderr(pluginLog{name: name, warn: true})
+	ictx, cancel := context.WithTimeout(ctx, pluginCallTimeout)
+	defer cancel()
+	p.mod, err = ph.runtime.InstantiateModule(ictx, compiled, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if p.mod.ExportedFunction("alloc") == nil {
+		p.mod.Close(ctx)
+		return nil, errors.New("plugin must export alloc(size) ptr")
+	}
+	return p, nil
+}
+
+func (ph *pluginHost) instantiateHostModule(ctx context.Context) error {
+	_, err := ph.runtime.NewHostModuleBuilder(pluginHostModule).
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, ptr, n uint32) {
+		if s, ok := readGuestString(m, ptr, n); ok {
+			logger.Infof("plugin %s: %s", m.Name(), s)
+		}
+	}).Export("log").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, toPtr, toLen, bodyPtr, bodyLen uint32) int32 {
+		to, ok1 := readGuestString(m, toPtr, toLen)
+		body, ok2 := readGuestString(m, bodyPtr, bodyLen)
+		if !ok1 || !ok2 {
+			return -1
+		}
+		msg, err := ph.a.node.Send(ctx, to, body)
+		if err != nil {
+			logger.Warnf("plugin %s: send to %s: %s", m.Name(), to, err)
+			return -1
+		}
+		ph.a.messageSent(to, msg)
+		return 0
+	}).Export("send").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kPtr, kLen, outPtr, outCap uint32) int32 {
+		p := ph.plugins[m.Name()]
+		key, ok := readGuestString(m, kPtr, kLen)
+		if p == nil || !ok {
+			return -1
+		}
+		val, ok := p.storage[key]
+		if !ok {
+			return -1
+		}
+		if uint32(len(val)) <= outCap && !m.Memory().Write(outPtr, []byte(val)) {
+			return -1
+		}
+		return int32(len(val))
+	}).Export("storage_get").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kPtr, kLen, vPtr, vLen uint32) int32 {
+		p := ph.plugins[m.Name()]
+		key, ok1 := readGuestString(m, kPtr, kLen)
+		val, ok2 := readGuestString(m, vPtr, vLen)
+		if p == nil || !ok1 || !ok2 {
+			return -1
+		}
+		if err := p.fits(key, val); err != nil {
+			logger.Warnf("plugin %s: storage_set: %s", p.name, err)
+			return -1
+		}
+		p.storage[key] = val
+		if err := p.saveStorage(); err != nil {
+			logger.Warnf("plugin %s: saving storage: %s", p.name, err)
+			return -1
+		}
+		return 0
+	}).Export("storage_set").
+		Instantiate(ctx)
+	return err
+}
+
+func readGuestString(m api.Module, ptr, n uint32) (string, bool) {
+	b, ok := m.Memory().Read(ptr, n)
+	if !ok {
+		return "", false
+	}
+	return string(b), true
+}
+
+// fits checks that storing val under key keeps the plugin's storage within
+// its caps.
+func (p *wasmPlugin) fits(key, val string) error {
+	old, had := p.storage[key]
+	if !had && len(p.storage) >= maxPluginStorageKeys {
+		return fmt.Errorf("storage full (%d keys)", maxPluginStorageKeys)
+	}
+	size := len(key) + len(val)
+	for k, v := range p.storage {
+		size += len(k) + len(v)
+	}
+	if had {
+		size -= len(key) + len(old)
+	}
+	if size > maxPluginStorageBytes {
+		return fmt.Errorf("storage full (%d bytes)", maxPluginStorageBytes)
+	}
+	return nil
+}
+
+// pluginLog sends what a plugin writes to stdout or stderr to the log, a
+// line at a time.
+type pluginLog struct {
+	name string
+	warn bool
+}
+
+func (l pluginLog) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		if l.warn {
+			logger.Warnf("plugin %s: %s", l.name, line)
+		} else {
+			logger.Infof("plugin %s: %s", l.name, line)
+		}
+	}
+	return len(b), nil
+}
+
+// saveStorage persists the plugin's key/value store; callers hold p.mu
+// (host functions only run inside a guest call).
+func (p *wasmPlugin) saveStorage() error {
+	b, err := json.Marshal(p.storage)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.storagePath, b, 0600)
+}
+
+// messageReceived hands an incoming message to every plugin that exports
+// on_message.
+func (ph *pluginHost) messageReceived(m Message) {
+	if len(ph.plugins) == 0 {
+		return
+	}
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	for _, p := range ph.plugins {
+		if err := p.call(ph.a.ctx, "on_message", payload); err != nil {
+			logger.Warnf("plugin %s: on_message: %s", p.name, err)
+		}
+	}
+}
+
+// call copies payload into guest memory and invokes fn(ptr, len), if the
+// plugin exports fn. A call that runs past pluginCallTimeout shuts the
+// plugin down; later calls fail.
+func (p *wasmPlugin) call(ctx context.Context, fn string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mod.IsClosed() {
+		return errors.New("plugin was shut down")
+	}
+	f := p.mod.ExportedFunction(fn)
+	if f == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, pluginCallTimeout)
+	defer cancel()
+	res, err := p.mod.ExportedFunction("alloc").Call(ctx, uint64(len(payload)))
+	if err != nil {
+		return fmt.Errorf("alloc: %w", err)
+	}
+	ptr := uint32(res[0])
+	if !p.mod.Memory().Write(ptr, payload) {
+		return errors.New("alloc returned out-of-range pointer")
+	}
+	_, err = f.Call(ctx, uint64(ptr), uint64(len(payload)))
+	return err
+}
+
+func (ph *pluginHost) list() []string {
+	names := make([]string, 0, len(ph.plugins))
+	for n := range ph.plugins {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ph *pluginHost) close(ctx context.Context) {
+	if ph.runtime != nil {
+		ph.runtime.Close(ctx)
+	}
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "plugins",
+		Summary: "list loaded WebAssembly plugins",
+		Run: func(a *app, inv *invocation) error {
+			names := a.plugins.list()
+			if len(names) == 0 {
+				fmt.Println("no plugins loaded")
+				return nil
+			}
+			for _, n := range names {
+				fmt.Println(" -", n)
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// servePprof exposes Go's profiling handlers under /debug/pprof/ on addr.
+// They get their own mux rather than http.DefaultServeMux so nothing else
+// registered there is exposed with them.
+func servePprof(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("pprof: %s", err)
+		}
+	}()
+	return srv
+}
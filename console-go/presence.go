@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+// presenceTimeout bounds announcing our presence.
+const presenceTimeout = 15 * time.Second
+
+// startPresence shows us online to everyone we're connected to, and
+// shows peers' presence changes as they come.
+func (a *app) startPresence() {
+	a.dnd.quiet = func(on bool) {
+		go func() {
+			ctx, cancel := context.WithTimeout(a.ctx, presenceTimeout)
+			defer cancel()
+			a.node.SetPresenceQuiet(ctx, on)
+		}()
+	}
+	a.node.OnPresence(func(from peer.ID, p, prev node.Presence) {
+		a.post(func() { a.presenceChanged(from, p, prev) })
+	})
+	ctx, cancel := context.WithTimeout(a.ctx, presenceTimeout)
+	defer cancel()
+	if err := a.node.SetPresence(ctx, node.PresenceOnline, ""); err != nil {
+		logger.Warnf("setting presence: %s", err)
+	}
+}
+
+// announcePresence tells peers our presence.
+func (a *app) announcePresence(peers []peer.ID) {
+	ctx, cancel := context.WithTimeout(a.ctx, presenceTimeout)
+	defer cancel()
+	a.node.AnnouncePresence(ctx, peers)
+}
+
+// presenceChanged shows a peer's new presence. Coming back online with
+// nothing to say isn't news: connecting was announced already.
+func (a *app) presenceChanged(from peer.ID, p, prev node.Presence) {
+	if !a.shownPeer(from) || p.State == prev.State && p.Status == prev.Status {
+		return
+	}
+	if p.State == node.PresenceOnline && p.Status == "" && prev.State != node.PresenceAway {
+		return
+	}
+	if jsonOutput {
+		printJSON(presenceEvent{Event: "presence", Peer: from.String(), State: p.State, Status: p.Status})
+		return
+	}
+	line := a.conversationLabel(from.String()) + " is " + describePresence(p)
+	if screenReader {
+		fmt.Printf("\n%s.\n%s", line, a.prompt())
+		return
+	}
+	fmt.Printf("\n%s\n%s", styles.system("* "+line), a.prompt())
+}
+
+// describePresence is e.g. "away: at lunch".
+func describePresence(p node.Presence) string {
+	if p.Status == "" {
+		return p.State
+	}
+	return p.State + ": " + p.Status
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:       "presence",
+		Usage:      "[online|away [status]]",
+		Summary:    "set your presence, told to connected peers (not while do-not-disturb is on); alone, show yours and your contacts'",
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) > 0 {
+				state := inv.Args[0]
+				if state != node.PresenceOnline && state != node.PresenceAway {
+					return errors.New("usage: presence [online|away [status]]")
+				}
+				if err := a.node.SetPresence(inv.Context(), state, inv.Tail(1)); err != nil {
+					return err
+				}
+				p := a.node.Presence()
+				note := ""
+				if a.dnd.active() {
+					note = " (not told to anyone until do-not-disturb ends)"
+				}
+				printResult(p, "you are "+describePresence(p)+note)
+				return nil
+			}
+			type entry struct {
+				Contact string `json:"contact"`
+				Peer    string `json:"peer"`
+				node.Presence
+			}
+			var contacts []entry
+			for _, name := range a.contacts.names() {
+				id, err := peer.Decode(a.contacts.peerID(name))
+				if err != nil {
+					continue
+				}
+				p, ok := a.node.PeerPresence(id)
+				if !ok {
+					continue
+				}
+				contacts = append(contacts, entry{Contact: name, Peer: id.String(), Presence: p})
+			}
+			if jsonOutput {
+				printJSON(map[string]any{"presence": a.node.Presence(), "contacts": contacts})
+				return nil
+			}
+			var b strings.Builder
+			fmt.Fprintf(&b, "you are %s", describePresence(a.node.Presence()))
+			if a.dnd.active() {
+				b.WriteString(" (not broadcast: do-not-disturb)")
+			}
+			for _, c := range contacts {
+				fmt.Fprintf(&b, "\n  %s: %s (since %s)", c.Contact, describePresence(c.Presence), time.UnixMilli(c.When).Format(time.TimeOnly))
+			}
+			fmt.Println(b.String())
+			return nil
+		},
+	})
+}
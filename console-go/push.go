@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// pushRegisterProtocol lets a peer (typically a mobile client) register the
+// UnifiedPush endpoint it wants to be woken through.
+const pushRegisterProtocol = "/p2pchat/push-register/1.0.0"
+
+// pushMinInterval rate-limits wake-ups per recipient.
+const pushMinInterval = time.Minute
+
+// maxPushEndpoints caps how many peers can register an endpoint.
+const maxPushEndpoints = 256
+
+// pushStub is what gets POSTed to a UnifiedPush endpoint. It deliberately
+// carries no message content: the push server and distributor only learn
+// that there is something to fetch and from whom.
+type pushStub struct {
+	Type string `json:"type"` // "messages"
+	From string `json:"from"`
+}
+
+type pushRegistration struct {
+	Endpoint string `json:"endpoint"`
+}
+
+// pushRelay wakes offline recipients through their UnifiedPush endpoint
+// after something was left for them (offline store, email). Only contacts
+// may register, and only https endpoints on public hosts.
+type pushRelay struct {
+	mu        sync.Mutex
+	path      string
+	contacts  *contactBook
+	endpoints map[string]string // peerID -> endpoint URL
+	lastSent  map[string]time.Time
+	client    *http.Client
+}
+
+func loadPushRelay(path string, contacts *contactBook) (*pushRelay, error) {
+	// Endpoints are checked when they're registered, but a public name can
+	// still resolve to a private address, so the dialer checks again.
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: func(network, address string, _ syscall.RawConn) error {
+		ap, err := netip.ParseAddrPort(address)
+		if err != nil || !publicAddr(ap.Addr()) {
+			return fmt.Errorf("push endpoint address %s is not public", address)
+		}
+		return nil
+	}}
+	pr := &pushRelay{
+		path:      path,
+		contacts:  contacts,
+		endpoints: make(map[string]string),
+		lastSent:  make(map[string]time.Time),
+		client: &http.Client{
+			Timeout:   15 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return pr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &pr.endpoints); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return pr, nil
+}
+
+func (pr *pushRelay) register(peerID, endpoint string) error {
+	if err := checkPushEndpoint(endpoint); err != nil {
+		return err
+	}
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if _, ok := pr.endpoints[peerID]; !ok && len(pr.endpoints) >= maxPushEndpoints {
+		return fmt.Errorf("too many push endpoints (%d)", maxPushEndpoints)
+	}
+	pr.endpoints[peerID] = endpoint
+	return pr.save()
+}
+
+// checkPushEndpoint accepts https URLs whose host isn't loopback, private
+// or otherwise local.
+func checkPushEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+		return fmt.Errorf("invalid push endpoint %q: want an https URL", endpoint)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".local") {
+		return fmt.Errorf("invalid push endpoint %q: local host", endpoint)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !publicAddr(ip) {
+		return fmt.Errorf("invalid push endpoint %q: not a public address", endpoint)
+	}
+	return nil
+}
+
+// publicAddr reports whether ip is a public unicast address.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+func (pr *pushRelay) unregister(peerID string) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	delete(pr.endpoints, peerID)
+	return pr.save()
+}
+
+// save writes the endpoints to disk; callers hold pr.mu.
+func (pr *pushRelay) save() error {
+	b, err := json.Marshal(pr.endpoints)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pr.path, b, 0600)
+}
+
+// wake sends a content-free stub to peerID's endpoint, if they registered
+// one and haven't been woken in the last pushMinInterval.
+func (pr *pushRelay) wake(peerID, from string) {
+	pr.mu.Lock()
+	endpoint, ok := pr.endpoints[peerID]
+	// Endpoints saved before they were checked may not pass.
+	if !ok || checkPushEndpoint(endpoint) != nil || time.Since(pr.lastSent[peerID]) < pushMinInterval {
+		pr.mu.Unlock()
+		return
+	}
+	pr.lastSent[peerID] = time.Now()
+	pr.mu.Unlock()
+
+	go func() {
+		body, _ := json.Marshal(pushStub{Type: "messages", From: from})
+		resp, err := pr.client.Post(endpoint, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logger.Warnf("push to %s: %s", peerID, err)
+			return
+		}
+		resp.Body.Close()
+		// 404/410 mean the distributor dropped the registration.
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+			logger.Infof("push endpoint for %s is gone, unregistering", peerID)
+			_ = pr.unregister(peerID)
+			return
+		}
+		if resp.StatusCode/100 != 2 {
+			logger.Warnf("push to %s: %s", peerID, resp.Status)
+		}
+	}()
+}
+
+// handleRegister accepts a registration from the remote peer, if it's a
+// contact. The stream is authenticated, so a peer can only ever register its
+// own endpoint.
+func (pr *pushRelay) handleRegister(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer().String()
+	if pr.contacts.nameOf(remote) == "" {
+		logger.Debugf("push registration from %s: not a contact", remote)
+		s.Reset()
+		return
+	}
+	var reg pushRegistration
+	if err := json.NewDecoder(io.LimitReader(s, 4096)).Decode(&reg); err != nil {
+		s.Reset()
+		return
+	}
+	if reg.Endpoint == "" {
+		_ = pr.unregister(remote)
+		return
+	}
+	if err := pr.register(remote, reg.Endpoint); err != nil {
+		logger.Warnf("push registration from %s: %s", remote, err)
+		s.Reset()
+		return
+	}
+	logger.Infof("%s registered a push endpoint", remote)
+}
+
+// announcePushEndpoint registers our own endpoint with peerID, so it wakes
+// us when it leaves messages while we're offline.
+func announcePushEndpoint(ctx context.Context, a *app, peerIDStr, endpoint string) error {
+	pid, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return err
+	}
+	s, err := a.h.NewStream(ctx, pid, pushRegisterProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return json.NewEncoder(s).Encode(pushRegistration{Endpoint: endpoint})
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "push",
+		Usage:   "[list] | register <peerID> <url> | unregister <peerID> | announce <peerID> <url>",
+		Summary: "manage UnifiedPush wake-up endpoints for offline contacts",
+		Run: func(a *app, inv *invocation) error {
+			args := inv.Args
+			if len(args) == 0 {
+				args = []string{"list"}
+			}
+			switch {
+			case args[0] == "list":
+				a.push.mu.Lock()
+				defer a.push.mu.Unlock()
+				if len(a.push.endpoints) == 0 {
+					fmt.Println("no push endpoints registered")
+					return nil
+				}
+				ids := make([]string, 0, len(a.push.endpoints))
+				for id := range a.push.endpoints {
+					ids = append(ids, id)
+				}
+				sort.Strings(ids)
+				for _, id := range ids {
+					fmt.Printf(" - %s: %s\n", id, a.push.endpoints[id])
+				}
+				return nil
+			case args[0] == "register" && len(args) == 3:
+				return a.push.register(args[1], args[2])
+			case args[0] == "unregister" && len(args) == 2:
+				return a.push.unregister(args[1])
+			case args[0] == "announce" && len(args) == 3:
+				return announcePushEndpoint(inv.Context(), a, args[1], args[2])
+			}
+			fmt.Println("usage: push", "[list] | register <peerID> <url> | unregister <peerID> | announce <peerID> <url>")
+			return nil
+		},
+	})
+}
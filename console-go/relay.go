@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
+	host "github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"p2p-chat/node"
+	"p2p-chat/paths"
+)
+
+// relayIdentityFile keeps the relay's key apart from the chat identity, so
+// running both on one machine doesn't put two hosts on the same peer ID.
+const relayIdentityFile = "p2pchat_relay.key"
+
+const defaultRelayListen = "/ip4/0.0.0.0/tcp/4001,/ip4/0.0.0.0/udp/4001/quic-v1,/ip6/::/tcp/4001,/ip6/::/udp/4001/quic-v1"
+
+// relayConfig holds the settings and limits of a serve-relay node.
+type relayConfig struct {
+	dataDir   string
+	listen    []string
+	public    bool
+	memoryMB  int64
+	fds       int
+	conns     int
+	resources relayv2.Resources
+
+	// supernode adds mailbox storage and a rendezvous point.
+	supernode     bool
+	mailboxMB     int64
+	inboxMB       int64
+	mailbox       node.MailboxLimits
+	rendezvousMax int
+	// home makes it one peer's home node instead: a mailbox for that peer
+	// alone, not announced for discovery.
+	home string
+}
+
+func (c *relayConfig) flags(fs *flag.FlagSet) {
+	c.resources = relayv2.DefaultResources()
+	fs.StringVar(&c.dataDir, "data-dir", "", "keep the relay key (and mailboxes) in this directory instead of the OS data directory")
+	fs.Func("listen", "comma-separated listen multiaddrs (default "+defaultRelayListen+")", func(s string) error {
+		c.listen = splitList(s)
+		return nil
+	})
+	fs.BoolVar(&c.public, "public", true, "assume the host is publicly reachable and start the relay service at once instead of waiting for AutoNAT")
+	fs.Int64Var(&c.memoryMB, "max-memory", 256, "memory libp2p may use, in megabytes")
+	fs.IntVar(&c.fds, "max-fds", 512, "file descriptors libp2p may use")
+	fs.IntVar(&c.conns, "max-conns", 400, "trim connections above this many")
+	fs.IntVar(&c.resources.MaxReservations, "max-reservations", c.resources.MaxReservations, "relay slots held for NATed peers")
+	fs.IntVar(&c.resources.MaxCircuits, "max-circuits", c.resources.MaxCircuits, "open relayed connections per peer")
+	fs.IntVar(&c.resources.MaxReservationsPerIP, "max-reservations-per-ip", c.resources.MaxReservationsPerIP, "relay slots per IP address")
+	fs.DurationVar(&c.resources.Limit.Duration, "circuit-duration", c.resources.Limit.Duration, "reset relayed connections after this long")
+	fs.Int64Var(&c.resources.Limit.Data, "circuit-data", c.resources.Limit.Data, "reset relayed connections after this many bytes each way")
+	fs.BoolVar(&c.supernode, "supernode", false, "also hold offline messages (mailbox) and act as a rendezvous point")
+	fs.Int64Var(&c.mailboxMB, "mailbox-quota", 1024, "disk space for all mailboxes together, in megabytes")
+	fs.IntVar(&c.mailbox.PerSender, "mailbox-per-peer", 500, "undelivered messages one peer may leave across all mailboxes")
+	fs.IntVar(&c.mailbox.MaxMessage, "mailbox-max-message", 64<<10, "largest message body accepted, in bytes")
+	fs.Int64Var(&c.inboxMB, "mailbox-inbox-quota", 16, "disk space for one recipient's mailbox, in megabytes; when full, the oldest messages of its heaviest sender make way")
+	fs.IntVar(&c.mailbox.SenderShare, "mailbox-sender-share", 25, "percentage of one recipient's mailbox a single sender may fill")
+	fs.DurationVar(&c.mailbox.MaxTTL, "mailbox-max-ttl", 30*24*time.Hour, "discard messages after this long even if they ask to be kept longer")
+	fs.IntVar(&c.rendezvousMax, "rendezvous-per-peer", 16, "namespaces one peer may be registered in at the rendezvous point")
+	fs.StringVar(&c.home, "home", "", "run as this peer ID's always-on home node: hold offline messages for it alone (pair with 'home pair' on that client)")
+}
+
+// hostOptions turns the limits into libp2p options: a relay service and a
+// resource manager scaled to the memory and descriptor budget.
+func (c *relayConfig) hostOptions() ([]libp2p.Option, error) {
+	limits := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&limits)
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits.Scale(c.memoryMB<<20, c.fds)))
+	if err != nil {
+		return nil, err
+	}
+	cm, err := connmgr.NewConnManager(c.conns*3/4, c.conns, connmgr.WithGracePeriod(time.Minute))
+	if err != nil {
+		return nil, err
+	}
+	listen := c.listen
+	if len(listen) == 0 {
+		listen = splitList(defaultRelayListen)
+	}
+	opts := []libp2p.Option{
+		libp2p.ListenAddrStrings(listen...),
+		libp2p.ResourceManager(rm),
+		libp2p.ConnectionManager(cm),
+		libp2p.EnableRelayService(relayv2.WithResources(c.resources)),
+		libp2p.EnableNATService(),
+		libp2p.UserAgent(agentVersion()),
+	}
+	if c.public {
+		opts = append(opts, libp2p.ForceReachabilityPublic())
+	}
+	return opts, nil
+}
+
+// serveRelay runs 'serve-relay': a headless node that relays circuits for
+// NATed members and answers DHT queries as a server, with no chat protocol
+// and no UI. With --supernode (also accepted as 'p2p-chat --supernode') it
+// keeps mailboxes and serves rendezvous too, for an always-on VPS a group
+// of friends points their clients at. With --home it is instead one
+// user's home node, holding their offline messages until their client
+// reconnects. It runs until SIGINT or SIGTERM.
+func serveRelay(args []string) int {
+	fs := subcommandFlags("serve-relay")
+	var cfg relayConfig
+	cfg.flags(fs)
+	fs.Parse(args)
+
+	dirs, err := paths.Open(cfg.dataDir)
+	if err != nil {
+		fmt.Println("failed to set up data directory:", err)
+		return exitFailed
+	}
+	priv, err := node.LoadOrCreateIdentity(dirs.DataFile(relayIdentityFile))
+	if err != nil {
+		fmt.Println("failed to load relay identity:", err)
+		return exitFailed
+	}
+	opts, err := cfg.hostOptions()
+	if err != nil {
+		fmt.Println("failed to set up resource limits:", err)
+		return exitFailed
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	h, err := libp2p.New(append(opts, libp2p.Identity(priv))...)
+	if err != nil {
+		fmt.Println("failed to start relay host:", err)
+		return exitFailed
+	}
+	defer h.Close()
+	dht, err := kaddht.New(ctx, h, append(node.DHTOptions(), kaddht.Mode(kaddht.ModeServer))...)
+	if err != nil {
+		fmt.Println("failed to start DHT:", err)
+		return exitFailed
+	}
+	defer dht.Close()
+
+	var mb *node.Mailbox
+	if cfg.supernode || cfg.home != "" {
+		cfg.mailbox.TotalBytes = cfg.mailboxMB << 20
+		cfg.mailbox.InboxBytes = cfg.inboxMB << 20
+		if cfg.home != "" {
+			if cfg.mailbox.Owner, err = peer.Decode(cfg.home); err != nil {
+				fmt.Println("invalid --home:", err)
+				return exitUsage
+			}
+			// All of it is the owner's.
+			cfg.mailbox.InboxBytes = cfg.mailbox.TotalBytes
+		}
+		if mb, err = node.OpenMailbox(dirs.DataFile("mailbox"), cfg.mailbox); err != nil {
+			fmt.Println("failed to open mailboxes:", err)
+			return exitFailed
+		}
+		mb.Serve(h)
+		go mb.Sweep(ctx)
+	}
+	if cfg.supernode && cfg.home == "" {
+		node.NewRendezvous(cfg.rendezvousMax).Serve(h)
+		go node.AnnounceMailbox(ctx, dht)
+	}
+
+	switch {
+	case cfg.home != "":
+		fmt.Printf("Home node of %s running. On that client, run one of:\n", cfg.home)
+	case mb != nil:
+		fmt.Println("Supernode running. Point clients at one of:")
+	default:
+		fmt.Println("Relay running. Point clients at one of:")
+	}
+	for _, a := range h.Addrs() {
+		addr := fmt.Sprintf("%s/p2p/%s", a, h.ID())
+		switch {
+		case cfg.home != "":
+			fmt.Printf("  home pair %s\n", addr)
+		case mb != nil:
+			fmt.Printf("  --relay %s --mailbox %s\n", addr, addr)
+		default:
+			fmt.Printf("  --relay %s\n", addr)
+		}
+	}
+	logRelayStats(ctx, h, dht, mb)
+	fmt.Println("shutting down...")
+	return exitOK
+}
+
+// logRelayStats logs connection and routing table counts, and mailbox
+// usage if there is one, every minute until ctx is done.
+func logRelayStats(ctx context.Context, h host.Host, dht *kaddht.IpfsDHT, mb *node.Mailbox) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			logger.Infof("relay: %d peers connected, %d in routing table", len(h.Network().Peers()), dht.RoutingTable().Size())
+			if mb != nil {
+				used, total := mb.Usage()
+				logger.Infof("mailbox: %s of %s used", formatBytes(float64(used)), formatBytes(float64(total)))
+			}
+		}
+	}
+}
+
+// relayOptions makes a chat node use the given relays: it reserves slots on
+// them when AutoNAT finds it unreachable, and tries hole punching to
+// upgrade relayed connections to direct ones.
+func relayOptions(addrs []string) ([]libp2p.Option, []peer.AddrInfo, error) {
+	var relays []peer.AddrInfo
+	for _, s := range addrs {
+		maddr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("relay %q: %w", s, err)
+		}
+		pi, err := peer.AddrInfoFromP2pAddr(maddr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("relay %q: %w", s, err)
+		}
+		relays = append(relays, *pi)
+	}
+	if len(relays) == 0 {
+		return nil, nil, nil
+	}
+	return []libp2p.Option{
+		libp2p.EnableAutoRelayWithStaticRelays(relays),
+		libp2p.EnableHolePunching(),
+	}, relays, nil
+}
+
+// connectRelays dials the configured relays so the DHT has a server to
+// bootstrap from; failures are only logged.
+func connectRelays(ctx context.Context, h host.Host, relays []peer.AddrInfo) {
+	for _, pi := range relays {
+		if err := h.Connect(ctx, pi); err != nil {
+			logger.Warnf("connect to relay %s: %s", pi.ID, err)
+		}
+	}
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
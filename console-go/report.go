@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Limits on what 'report' bundles.
+const (
+	reportCrashes = 10      // most recent crash reports
+	reportLogTail = 1 << 20 // bytes from the end of --log-file
+)
+
+// reportResult is 'report' in --json mode.
+type reportResult struct {
+	Path    string `json:"path"`
+	Crashes int    `json:"crashes"`
+	Log     bool   `json:"log"`
+}
+
+// writeReport bundles diagnostics for a bug report into a zip at path:
+// build and runtime details, doctor's checks, recent events, the latest
+// crash reports and the tail of the log file. Keys, contacts and messages
+// stay out of it.
+func (a *app) writeReport(inv *invocation, path string) (res reportResult, err error) {
+	res.Path = path
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "peep-chat diagnostics")
+	fmt.Fprintln(&b, "time:       ", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintln(&b, "version:    ", agentVersion())
+	fmt.Fprintln(&b, "go:         ", runtime.Version(), runtime.GOOS+"/"+runtime.GOARCH)
+	fmt.Fprintln(&b, "peer:       ", a.h.ID())
+	fmt.Fprintln(&b, "peers:      ", len(a.h.Network().Peers()))
+	fmt.Fprintln(&b, "streams:    ", a.node.ChatStreams())
+	fmt.Fprintln(&b, "goroutines:", runtime.NumGoroutine())
+	fmt.Fprintln(&b, "\ndoctor:")
+	writeDoctor(&b, runDoctor(inv.Context(), a))
+	fmt.Fprintln(&b, "\nrecent events:")
+	for _, l := range recent.list() {
+		fmt.Fprintln(&b, " ", l)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	zw := zip.NewWriter(f)
+	add := func(name string, r io.Reader) error {
+		w, err := zw.Create(name)
+		if err == nil {
+			_, err = io.Copy(w, r)
+		}
+		return err
+	}
+	if err := add("report.txt", &b); err != nil {
+		return res, err
+	}
+	crashes, err := a.crashes.reports()
+	if err != nil {
+		return res, err
+	}
+	if len(crashes) > reportCrashes {
+		crashes = crashes[len(crashes)-reportCrashes:]
+	}
+	for _, c := range crashes {
+		data, err := os.ReadFile(c)
+		if err != nil {
+			return res, err
+		}
+		if err := add("crashes/"+filepath.Base(c), bytes.NewReader(data)); err != nil {
+			return res, err
+		}
+		res.Crashes++
+	}
+	if a.logFile != "" {
+		if lf, err := os.Open(a.logFile); err == nil {
+			if fi, err := lf.Stat(); err == nil && fi.Size() > reportLogTail {
+				_, _ = lf.Seek(-reportLogTail, io.SeekEnd)
+			}
+			err = add("log/"+filepath.Base(a.logFile), lf)
+			lf.Close()
+			if err != nil {
+				return res, err
+			}
+			res.Log = true
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return res, err
+	}
+	return res, f.Close()
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "report",
+		Usage:   "[-o <file>]",
+		Summary: "bundle diagnostics, recent crash reports and the log tail into a zip for a bug report",
+		Flags: func(fs *flag.FlagSet) {
+			fs.String("o", "", "where to write the zip (default peep-chat-report-<time>.zip here)")
+		},
+		Run: func(a *app, inv *invocation) error {
+			path := inv.String("o")
+			if path == "" {
+				path = "peep-chat-report-" + time.Now().UTC().Format("20060102-150405") + ".zip"
+			}
+			res, err := a.writeReport(inv, path)
+			if err != nil {
+				return err
+			}
+			var with []string
+			switch res.Crashes {
+			case 0:
+			case 1:
+				with = append(with, "1 crash report")
+			default:
+				with = append(with, fmt.Sprintf("%d crash reports", res.Crashes))
+			}
+			if res.Log {
+				with = append(with, "the log tail")
+			}
+			text := "diagnostics written to " + path
+			if len(with) > 0 {
+				text += ", with " + strings.Join(with, " and ")
+			}
+			text += "\nit holds peer IDs and addresses but no keys or messages; look it over before sharing"
+			printResult(res, text)
+			return nil
+		},
+	})
+}
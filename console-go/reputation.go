@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+// reputationFile keeps peers' reputation records across restarts.
+const reputationFile = "p2pchat_reputation.json"
+
+// reputationSaveDelay batches the writes a flood of offenses would cause.
+const reputationSaveDelay = 5 * time.Second
+
+// A peer's standing, worst last.
+const (
+	standingOK = iota
+	standingThrottled
+	standingBlocked
+)
+
+func standingOf(r node.PeerReputation, now time.Time) int {
+	switch {
+	case r.Blocked:
+		return standingBlocked
+	case r.Throttled(now):
+		return standingThrottled
+	}
+	return standingOK
+}
+
+// reputationBook saves the node's reputation records and remembers each
+// peer's standing, to announce it getting worse.
+type reputationBook struct {
+	path string
+
+	mu       sync.Mutex
+	saved    map[peer.ID]node.PeerReputation // as loaded, for the node
+	standing map[peer.ID]int
+	pending  *time.Timer
+}
+
+func loadReputation(path string) (*reputationBook, error) {
+	b := &reputationBook{path: path, saved: make(map[peer.ID]node.PeerReputation), standing: make(map[peer.ID]int)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.saved); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	now := time.Now()
+	for p, r := range b.saved {
+		b.standing[p] = standingOf(r, now)
+	}
+	return b, nil
+}
+
+// note records p's standing, returning the one before.
+func (b *reputationBook) note(p peer.ID, standing int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	was := b.standing[p]
+	b.standing[p] = standing
+	return was
+}
+
+// saveSoon writes n's records a little later, dropping those fully
+// recovered.
+func (b *reputationBook) saveSoon(n *node.Node) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending != nil {
+		return
+	}
+	b.pending = time.AfterFunc(reputationSaveDelay, func() {
+		b.mu.Lock()
+		b.pending = nil
+		b.mu.Unlock()
+		b.save(n)
+	})
+}
+
+// flush writes a save still waiting, as the session ends.
+func (b *reputationBook) flush(n *node.Node) {
+	b.mu.Lock()
+	pending := b.pending != nil && b.pending.Stop()
+	b.pending = nil
+	b.mu.Unlock()
+	if pending {
+		b.save(n)
+	}
+}
+
+func (b *reputationBook) save(n *node.Node) {
+	now := time.Now()
+	records := n.Reputations()
+	for p, r := range records {
+		if !r.Blocked && r.At(now) == node.MaxScore {
+			delete(records, p)
+		}
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err == nil {
+		err = os.WriteFile(b.path, data, 0600)
+	}
+	if err != nil {
+		logger.Warnf("saving reputation: %s", err)
+	}
+}
+
+// reputationChanged saves p's new record and announces it being
+// throttled or blocked.
+func (a *app) reputationChanged(p peer.ID, r node.PeerReputation) {
+	a.reputation.saveSoon(a.node)
+	now := time.Now()
+	standing := standingOf(r, now)
+	if was := a.reputation.note(p, standing); standing <= was {
+		return
+	}
+	score := r.At(now)
+	var event, what string
+	switch standing {
+	case standingThrottled:
+		event = "throttled"
+		what = fmt.Sprintf("is rate limited: its reputation fell to %d (%s)", score, r.Last)
+	case standingBlocked:
+		event = "blocked"
+		what = fmt.Sprintf("was blocked: its reputation fell to %d (%s); 'reputation unblock' lifts it", score, r.Last)
+		a.audit.record(auditBlocked, p.String(), fmt.Sprintf("reputation %d: %s", score, r.Last))
+	}
+	a.post(func() {
+		if jsonOutput {
+			printJSON(peerEvent{Event: event, Peer: p.String()})
+			return
+		}
+		a.announcePeer(p, what)
+	})
+}
+
+// describeReputation summarises r, e.g. "42, rate limited (3 flood, 1
+// spam; last spam: keyword free)".
+func describeReputation(r node.PeerReputation) string {
+	s := fmt.Sprint(r.Score)
+	switch standingOf(r, time.Now()) {
+	case standingBlocked:
+		s += ", blocked"
+	case standingThrottled:
+		s += ", rate limited"
+	}
+	var counts []string
+	for o, c := range r.Offenses {
+		counts = append(counts, fmt.Sprintf("%d %s", c, o))
+	}
+	sort.Strings(counts)
+	if len(counts) == 0 {
+		return s
+	}
+	s += " (" + strings.Join(counts, ", ")
+	if len(counts) > 1 || strings.Contains(r.Last, ":") {
+		s += "; last " + r.Last
+	}
+	return s + ")"
+}
+
+type reputationEntry struct {
+	Peer string `json:"peer"`
+	node.PeerReputation
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "reputation",
+		Usage:   "[<peer> | report <peer> [<reason>] | block <peer> | unblock <peer>]",
+		Summary: "list peers that lost reputation, or one's record; report spam, or block and unblock by hand",
+		Run: func(a *app, inv *invocation) error {
+			peerArg := func(i int) (peer.ID, error) {
+				if len(inv.Args) <= i {
+					return "", errors.New("usage: reputation " + inv.Args[0] + " <peer>")
+				}
+				id, err := peer.Decode(a.contacts.peerID(inv.Args[i]))
+				if err != nil {
+					return "", fmt.Errorf("%q is not a contact or peer ID", inv.Args[i])
+				}
+				return id, nil
+			}
+			if len(inv.Args) == 0 {
+				var out []reputationEntry
+				for p := range a.node.Reputations() {
+					r := a.node.Reputation(p)
+					if r.Blocked || r.Score < node.MaxScore {
+						out = append(out, reputationEntry{p.String(), r})
+					}
+				}
+				sort.Slice(out, func(i, j int) bool { return out[i].Score < out[j].Score })
+				if jsonOutput {
+					printJSON(out)
+					return nil
+				}
+				if len(out) == 0 {
+					fmt.Println("every peer is in good standing")
+				}
+				for _, e := range out {
+					fmt.Printf("  %s: %s\n", a.conversationLabel(e.Peer), describeReputation(e.PeerReputation))
+				}
+				return nil
+			}
+			switch inv.Args[0] {
+			case "report":
+				p, err := peerArg(1)
+				if err != nil {
+					return err
+				}
+				reason := strings.Join(inv.Args[2:], " ")
+				if reason == "" {
+					reason = "reported"
+				}
+				a.node.Report(p, node.OffenseSpam, reason)
+				fmt.Printf("reported %s: reputation now %s\n", a.conversationLabel(p.String()), describeReputation(a.node.Reputation(p)))
+			case "block":
+				p, err := peerArg(1)
+				if err != nil {
+					return err
+				}
+				a.reputation.note(p, standingBlocked)
+				a.node.Block(p)
+				a.audit.record(auditBlocked, p.String(), "blocked by hand")
+				fmt.Printf("blocked %s; 'reputation unblock' lifts it\n", a.conversationLabel(p.String()))
+			case "unblock":
+				p, err := peerArg(1)
+				if err != nil {
+					return err
+				}
+				a.reputation.note(p, standingOK)
+				a.node.Unblock(p)
+				fmt.Printf("unblocked %s; its reputation starts over\n", a.conversationLabel(p.String()))
+			default:
+				p, err := peerArg(0)
+				if err != nil {
+					return err
+				}
+				r := a.node.Reputation(p)
+				printResult(reputationEntry{p.String(), r}, a.conversationLabel(p.String())+": "+describeReputation(r))
+			}
+			return nil
+		},
+	})
+}
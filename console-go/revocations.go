@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+const revocationsFile = "p2pchat_revoked.json"
+
+// revokedPeer is a verified revocation and when we first saw it.
+type revokedPeer struct {
+	Cert node.Revocation `json:"cert"`
+	Seen int64           `json:"seen"` // unix ms
+}
+
+// from is when the key stopped being trusted: the certificate's Since,
+// or for one made in advance, when it reached us.
+func (r revokedPeer) from() int64 {
+	if r.Cert.Since != 0 {
+		return r.Cert.Since
+	}
+	return r.Seen
+}
+
+// revocationList holds the revocations we've seen, persisted to
+// revocationsFile in the data directory.
+type revocationList struct {
+	mu     sync.Mutex
+	path   string
+	byPeer map[string]revokedPeer
+}
+
+func loadRevocations(path string) (*revocationList, error) {
+	l := &revocationList{path: path, byPeer: make(map[string]revokedPeer)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.byPeer); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return l, nil
+}
+
+// add records a verified certificate. It reports whether it is news: the
+// first for its peer, or one that distrusts the key from earlier on.
+func (l *revocationList) add(r node.Revocation) (revokedPeer, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rp := revokedPeer{Cert: r, Seen: time.Now().UnixMilli()}
+	if old, ok := l.byPeer[r.Peer]; ok {
+		rp.Seen = old.Seen
+		if rp.from() >= old.from() {
+			return old, false, nil
+		}
+	}
+	l.byPeer[r.Peer] = rp
+	data, err := json.MarshalIndent(l.byPeer, "", "  ")
+	if err != nil {
+		return rp, true, err
+	}
+	return rp, true, os.WriteFile(l.path, data, 0600)
+}
+
+// untrusted reports whether a message peerID sent at when (unix ms) falls
+// after its key was revoked.
+func (l *revocationList) untrusted(peerID string, when int64) (revokedPeer, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rp, ok := l.byPeer[peerID]
+	return rp, ok && when >= rp.from()
+}
+
+func (l *revocationList) list() []revokedPeer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]revokedPeer, 0, len(l.byPeer))
+	for _, rp := range l.byPeer {
+		out = append(out, rp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seen < out[j].Seen })
+	return out
+}
+
+// revocationEvent is the --json form of a new revocation.
+type revocationEvent struct {
+	Event  string `json:"event"` // "revoked"
+	Peer   string `json:"peer"`
+	Since  int64  `json:"since"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// revocationReceived records r and, if it's news, warns loudly.
+func (a *app) revocationReceived(r node.Revocation) {
+	rp, isNew, err := a.revoked.add(r)
+	if err != nil {
+		logger.Warnf("saving revocation of %s: %s", r.Peer, err)
+	}
+	if !isNew {
+		return
+	}
+	a.audit.record(auditRevocation, r.Peer, r.Reason)
+	if r.Peer == a.h.ID().String() {
+		return
+	}
+	since := time.UnixMilli(rp.from()).Format(time.RFC3339)
+	switch {
+	case jsonOutput:
+		printJSON(revocationEvent{Event: "revoked", Peer: r.Peer, Since: rp.from(), Reason: r.Reason})
+	case screenReader:
+		fmt.Printf("\nSecurity warning: %s has revoked its key. Messages from it after %s are not trusted.\n%s",
+			a.conversationLabel(r.Peer), since, a.prompt())
+	default:
+		reason := ""
+		if r.Reason != "" {
+			reason = " (" + r.Reason + ")"
+		}
+		fmt.Printf("\n%s\n%s\n%s", styles.err("!!! SECURITY WARNING: "+a.conversationLabel(r.Peer)+" ("+r.Peer+") has REVOKED its key"+reason+"."),
+			styles.err("!!! Messages from it sent after "+since+" are not trusted and are shown flagged."), a.prompt())
+	}
+}
+
+// untrustedMessage shows a message sent after its sender's key was
+// revoked. It is flagged and goes no further: no unread count,
+// notification, hook, bot or bridge sees it.
+func (a *app) untrustedMessage(peerID string, m Message) {
+	a.audit.record(auditUntrusted, peerID, "")
+	switch {
+	case jsonOutput:
+		printJSON(messageEvent{Event: "untrusted_message", Message: m})
+	case screenReader:
+		fmt.Printf("\nUntrusted message from %s, whose key is revoked: %s\n%s", a.conversationLabel(peerID), m.Body, a.prompt())
+	default:
+		fmt.Printf("\n%s %s\n%s", styles.err("<UNTRUSTED from="+peerID+", key revoked>"), m.Body, a.prompt())
+	}
+}
+
+// fetchedUntrusted flags stored messages sent after a revocation.
+func (a *app) fetchedUntrusted(m Message) bool {
+	_, bad := a.revoked.untrusted(m.From, m.When)
+	return bad
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "revocation",
+		Usage:   "publish <certfile> | check <peerID|contact> | list",
+		Summary: "publish a revocation certificate (to the DHT, contacts and connected peers), look one up, or list known ones",
+		MinArgs: 1,
+		Run: func(a *app, inv *invocation) error {
+			switch {
+			case inv.Args[0] == "publish" && len(inv.Args) == 2:
+				data, err := os.ReadFile(inv.Args[1])
+				if err != nil {
+					return err
+				}
+				r, err := node.DecodeRevocation(data)
+				if err != nil {
+					return err
+				}
+				a.revocationReceived(r)
+				if err := a.node.PublishRevocation(inv.Context(), r); err != nil {
+					fmt.Println("DHT publish failed:", err)
+				} else {
+					fmt.Println("published to the DHT")
+				}
+				targets := make(map[peer.ID]bool)
+				for _, p := range a.h.Network().Peers() {
+					targets[p] = true
+				}
+				for _, n := range a.contacts.names() {
+					if pi, err := a.contacts.resolve(n); err == nil {
+						targets[pi.ID] = true
+					}
+				}
+				sent := 0
+				for p := range targets {
+					if p.String() == r.Peer {
+						continue
+					}
+					if err := a.node.SendRevocation(inv.Context(), p, r); err != nil {
+						logger.Debugf("revocation to %s: %s", p, err)
+						continue
+					}
+					sent++
+				}
+				fmt.Printf("handed to %d of %d peers\n", sent, len(targets))
+			case inv.Args[0] == "check" && len(inv.Args) == 2:
+				id := a.contacts.peerID(inv.Args[1])
+				if rp, ok := a.revoked.untrusted(id, time.Now().UnixMilli()); ok {
+					fmt.Println(id, "is revoked since", time.UnixMilli(rp.from()).Format(time.RFC3339))
+					return nil
+				}
+				r, err := a.node.FetchRevocation(inv.Context(), id)
+				if err != nil {
+					fmt.Println("no revocation found:", err)
+					return nil
+				}
+				a.revocationReceived(r)
+			case inv.Args[0] == "list":
+				revs := a.revoked.list()
+				if jsonOutput {
+					printJSON(map[string]any{"revoked": revs})
+					return nil
+				}
+				if len(revs) == 0 {
+					fmt.Println("no revoked peers known")
+				}
+				for _, rp := range revs {
+					fmt.Printf(" - %s since %s %s\n", a.conversationLabel(rp.Cert.Peer), time.UnixMilli(rp.from()).Format(time.RFC3339), rp.Cert.Reason)
+				}
+			default:
+				fmt.Println("usage: revocation publish <certfile> | check <peerID|contact> | list")
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	"p2p-chat/node"
+)
+
+// maxArchiveFile bounds the room archive 'room import' reads.
+const maxArchiveFile = 64 << 20
+
+const roomUsage = "export <room> [--since <date>] [-o <file>] | import <file> | membership <room> [--since <date>] | create <room> | add|kick|ban|unban <room> <peer> | members <room>"
+
+// parseInterspersed parses fs's flags wherever they are among args,
+// returning the other arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return rest, nil
+		}
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseSince reads a --since date: 2006-01-02 (local midnight) or RFC 3339.
+// Empty is the beginning of time.
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q (want 2006-01-02 or RFC 3339)", s)
+	}
+	return t, nil
+}
+
+// exportRoom gathers room's history and membership changes from since on
+// and signs them. Messages whose blocks are gone are left out and counted.
+func (a *app) exportRoom(room string, since time.Time) (node.RoomArchive, int, error) {
+	r := node.RoomArchive{Room: room, Since: since.UnixMilli(), Messages: []Message{}}
+	missing := 0
+	for _, e := range a.history.entries(room) {
+		if e.When < r.Since {
+			continue
+		}
+		c, err := cid.Decode(e.CID)
+		if err != nil {
+			return node.RoomArchive{}, 0, err
+		}
+		m, err := a.blocks.GetMessage(c)
+		if err != nil {
+			logger.Debugf("exporting #%s: %s: %s", room, c, err)
+			missing++
+			continue
+		}
+		r.Messages = append(r.Messages, m)
+	}
+	r.Membership = a.roomBook.changes(room, r.Since)
+	if len(r.Messages) == 0 && len(r.Membership) == 0 {
+		return node.RoomArchive{}, 0, fmt.Errorf("no history of #%s to export", room)
+	}
+	return r, missing, a.node.SignRoomArchive(&r)
+}
+
+// writeArchive writes r to path, which mustn't exist.
+func writeArchive(path string, r node.RoomArchive) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// readArchive reads and verifies the room archive at path.
+func readArchive(path string) (node.RoomArchive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return node.RoomArchive{}, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxArchiveFile+1))
+	if err != nil {
+		return node.RoomArchive{}, err
+	}
+	if len(data) > maxArchiveFile {
+		return node.RoomArchive{}, fmt.Errorf("%s: over %d MiB", path, maxArchiveFile>>20)
+	}
+	var r node.RoomArchive
+	if err := json.Unmarshal(data, &r); err != nil {
+		return node.RoomArchive{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, r.Verify(time.Now())
+}
+
+// importRoom adds a verified archive's messages to the room's history and
+// its membership changes to ours, returning how many of each were new.
+func (a *app) importRoom(r node.RoomArchive) (messages, changes int, err error) {
+	x := a.history
+	x.mu.Lock()
+	for _, m := range r.Messages {
+		c, perr := a.blocks.PutMessage(m)
+		if perr != nil {
+			err = perr
+			break
+		}
+		if slices.ContainsFunc(x.Rooms[r.Room], func(h node.HistoryEntry) bool { return h.CID == c.String() }) {
+			continue
+		}
+		x.add(r.Room, node.HistoryEntry{CID: c.String(), When: m.When})
+		messages++
+	}
+	if messages > 0 {
+		x.save()
+	}
+	x.mu.Unlock()
+	return messages, a.roomBook.addChanges(r.Room, r.Membership...), err
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "room",
+		Usage:   roomUsage,
+		Summary: "export a room's history as a signed archive, import one, list who joined and left, or create and manage an encrypted room",
+		MinArgs: 1,
+		Run: func(a *app, inv *invocation) error {
+			fs := flag.NewFlagSet("room "+inv.Args[0], flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			sinceFlag := fs.String("since", "", "")
+			out := fs.String("o", "", "")
+			args, err := parseInterspersed(fs, inv.Args[1:])
+			if err != nil {
+				return fmt.Errorf("%s\nusage: room %s", err, roomUsage)
+			}
+			want := 1
+			switch inv.Args[0] {
+			case "add", "kick", "ban", "unban":
+				want = 2
+			}
+			if len(args) != want {
+				return errors.New("usage: room " + roomUsage)
+			}
+			since, err := parseSince(*sinceFlag)
+			if err != nil {
+				return err
+			}
+			arg := args[0]
+			switch inv.Args[0] {
+			case "export":
+				room := strings.TrimPrefix(arg, "#")
+				r, missing, err := a.exportRoom(room, since)
+				if err != nil {
+					return err
+				}
+				path := *out
+				if path == "" {
+					path = fmt.Sprintf("room-%s-%s.json", room, time.Now().Format("20060102"))
+				}
+				if err := writeArchive(path, r); err != nil {
+					return err
+				}
+				text := fmt.Sprintf("exported %d messages and %d membership changes of #%s to %s", len(r.Messages), len(r.Membership), room, path)
+				if missing > 0 {
+					text += fmt.Sprintf(" (%d messages no longer in the blockstore left out)", missing)
+				}
+				printResult(map[string]any{"exported": path, "room": room, "messages": len(r.Messages), "membership": len(r.Membership), "missing": missing}, text)
+			case "import":
+				r, err := readArchive(arg)
+				if err != nil {
+					return err
+				}
+				messages, changes, err := a.importRoom(r)
+				if err != nil {
+					return err
+				}
+				printResult(map[string]any{"imported": arg, "room": r.Room, "exporter": r.Exporter, "messages": messages, "membership": changes},
+					fmt.Sprintf("verified #%s archive signed by %s on %s; %d of %d messages and %d of %d membership changes were new ('history %s' shows them)",
+						r.Room, a.conversationLabel(r.Exporter), time.UnixMilli(r.Exported).Format(time.DateTime),
+						messages, len(r.Messages), changes, len(r.Membership), r.Room))
+			case "membership":
+				room := strings.TrimPrefix(arg, "#")
+				changes := a.roomBook.changes(room, since.UnixMilli())
+				if jsonOutput {
+					printJSON(map[string]any{"room": room, "membership": changes})
+					return nil
+				}
+				if len(changes) == 0 {
+					fmt.Println("no membership changes seen in #" + room)
+				}
+				for _, c := range changes {
+					what := "left"
+					if c.Joined {
+						what = "joined"
+					}
+					fmt.Printf("  %s  %s %s\n", time.UnixMilli(c.When).Format(time.DateTime), a.conversationLabel(c.Peer), what)
+				}
+			case "create":
+				room := strings.TrimPrefix(arg, "#")
+				if err := a.createRoom(room); err != nil {
+					return err
+				}
+				printResult(map[string]any{"created": room, "encrypted": true},
+					fmt.Sprintf("created encrypted #%s; 'room add %s <peer>' lets members in", room, room))
+			case "add", "kick", "ban", "unban":
+				return a.rosterCommand(inv.Args[0], strings.TrimPrefix(arg, "#"), args[1])
+			case "members":
+				return a.showRoster(strings.TrimPrefix(arg, "#"))
+			default:
+				return errors.New("usage: room " + roomUsage)
+			}
+			return nil
+		},
+	})
+}
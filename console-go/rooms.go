@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"p2p-chat/node"
+)
+
+// roomTopicPrefix namespaces room pubsub topics: /p2pchat/rooms/<name>.
+const roomTopicPrefix = "/p2pchat/rooms/"
+
+const roomsFile = "p2pchat_rooms.json"
+
+// roomRejoinTimeout bounds reconnecting to a rejoined room's members and
+// catching up with them.
+const roomRejoinTimeout = 2 * time.Minute
+
+// roomState is what's kept of a joined room across restarts.
+type roomState struct {
+	Topic   string       `json:"topic"`
+	Joined  int64        `json:"joined"`            // unix ms
+	Members []roomMember `json:"members,omitempty"` // subscribed peers when last saved
+}
+
+// roomMember is a peer in a room, with the addresses we reached it on.
+type roomMember struct {
+	Peer  string   `json:"peer"`
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// roomMembershipKept caps the membership changes kept per room.
+const roomMembershipKept = node.MaxArchiveChanges
+
+// roomChangeSlack is how close in time (ms) two records of the same peer
+// joining or leaving must be to count as one, as when both we and an
+// imported archive saw it.
+const roomChangeSlack = 5000
+
+// roomBook is the rooms we joined, persisted to roomsFile in the data
+// directory so they're rejoined on restart, and the membership changes
+// seen in rooms, kept like their history after leaving.
+type roomBook struct {
+	mu         sync.Mutex
+	path       string
+	Rooms      map[string]roomState               `json:"rooms"`                // by name
+	Membership map[string][]node.MembershipChange `json:"membership,omitempty"` // by room name, oldest first
+	Rosters    map[string]node.RoomRoster         `json:"rosters,omitempty"`    // encrypted rooms, joined or not
+}
+
+func loadRooms(path string) (*roomBook, error) {
+	b := &roomBook{path: path, Rooms: make(map[string]roomState), Membership: make(map[string][]node.MembershipChange),
+		Rosters: make(map[string]node.RoomRoster)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if b.Membership == nil {
+		b.Membership = make(map[string][]node.MembershipChange)
+	}
+	if b.Rosters == nil {
+		b.Rosters = make(map[string]node.RoomRoster)
+	}
+	return b, nil
+}
+
+// save writes the book; callers hold b.mu.
+func (b *roomBook) save() {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err == nil {
+		err = os.WriteFile(b.path, data, 0600)
+	}
+	if err != nil {
+		logger.Warnf("saving rooms: %s", err)
+	}
+}
+
+func (b *roomBook) add(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.Rooms[name]; ok {
+		return
+	}
+	b.Rooms[name] = roomState{Topic: roomTopicPrefix + name, Joined: time.Now().UnixMilli()}
+	b.save()
+}
+
+func (b *roomBook) remove(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.Rooms[name]; ok {
+		delete(b.Rooms, name)
+		b.save()
+	}
+}
+
+// setMembers records who was in room name, if it's one we keep and any
+// were.
+func (b *roomBook) setMembers(name string, members []peer.AddrInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.Rooms[name]
+	if !ok || len(members) == 0 {
+		return
+	}
+	st.Members = make([]roomMember, len(members))
+	for i, pi := range members {
+		st.Members[i] = roomMember{Peer: pi.ID.String()}
+		for _, addr := range pi.Addrs {
+			st.Members[i].Addrs = append(st.Members[i].Addrs, addr.String())
+		}
+	}
+	sort.Slice(st.Members, func(i, j int) bool { return st.Members[i].Peer < st.Members[j].Peer })
+	b.Rooms[name] = st
+	b.save()
+}
+
+// addChanges merges membership changes of room name into what's kept,
+// returning how many were new.
+func (b *roomBook) addChanges(name string, cs ...node.MembershipChange) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := b.Membership[name]
+	added := 0
+	for _, c := range cs {
+		if slices.ContainsFunc(kept, func(k node.MembershipChange) bool {
+			d := k.When - c.When
+			return k.Peer == c.Peer && k.Joined == c.Joined && d > -roomChangeSlack && d < roomChangeSlack
+		}) {
+			continue
+		}
+		i := sort.Search(len(kept), func(i int) bool { return kept[i].When > c.When })
+		kept = slices.Insert(kept, i, c)
+		added++
+	}
+	if added == 0 {
+		return 0
+	}
+	b.Membership[name] = kept[max(len(kept)-roomMembershipKept, 0):]
+	b.save()
+	return added
+}
+
+// changes returns room name's membership changes from since on.
+func (b *roomBook) changes(name string, since int64) []node.MembershipChange {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := b.Membership[name]
+	i := sort.Search(len(kept), func(i int) bool { return kept[i].When >= since })
+	return slices.Clone(kept[i:])
+}
+
+// roster returns the roster of room name, if it's an encrypted room.
+func (b *roomBook) roster(name string) (node.RoomRoster, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, ok := b.Rosters[name]
+	return r, ok
+}
+
+func (b *roomBook) setRoster(r node.RoomRoster) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Rosters[r.Room] = r
+	b.save()
+}
+
+func (b *roomBook) snapshot() map[string]roomState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[string]roomState, len(b.Rooms))
+	for k, v := range b.Rooms {
+		out[k] = v
+	}
+	return out
+}
+
+// room is a joined gossipsub topic.
+type room struct {
+	name   string
+	topic  *pubsub.Topic
+	sub    *pubsub.Subscription
+	events *pubsub.TopicEventHandler // peers joining and leaving; nil for channels
+	cancel context.CancelFunc
+}
+
+// roomManager tracks joined rooms. Room messages are ordinary Message
+// values with Room set, so they flow through the same pipeline as direct
+// messages.
+type roomManager struct {
+	a     *app
+	ps    *pubsub.PubSub
+	mu    sync.Mutex
+	rooms map[string]*room
+}
+
+func newRoomManager(a *app) (*roomManager, error) {
+	ps, err := pubsub.NewGossipSub(a.ctx, a.h, pubsub.WithRawTracer(auditTracer{a}))
+	if err != nil {
+		return nil, err
+	}
+	return &roomManager{a: a, ps: ps, rooms: make(map[string]*room)}, nil
+}
+
+// conversationKey identifies the conversation a message belongs to: the
+// peer ID for direct messages, "#<room>" for rooms.
+func conversationKey(peerID string, m Message) string {
+	if m.Room != "" {
+		return "#" + m.Room
+	}
+	return peerID
+}
+
+func (rm *roomManager) join(name string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if _, ok := rm.rooms[name]; ok {
+		return nil
+	}
+	topic, err := rm.ps.Join(roomTopicPrefix + name)
+	if err != nil {
+		return err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		return err
+	}
+	events, err := topic.EventHandler()
+	if err != nil {
+		sub.Cancel()
+		topic.Close()
+		return err
+	}
+	ctx, cancel := context.WithCancel(rm.a.ctx)
+	r := &room{name: name, topic: topic, sub: sub, events: events, cancel: cancel}
+	rm.rooms[name] = r
+	go rm.readLoop(ctx, r)
+	go rm.watchMembers(ctx, r)
+	return nil
+}
+
+// watchMembers records peers joining and leaving r, as far as we see
+// them: a peer that disconnects leaves too.
+func (rm *roomManager) watchMembers(ctx context.Context, r *room) {
+	for {
+		ev, err := r.events.NextPeerEvent(ctx)
+		if err != nil {
+			return
+		}
+		rm.a.roomBook.addChanges(r.name, node.MembershipChange{
+			Peer: ev.Peer.String(), Joined: ev.Type == pubsub.PeerJoin, When: time.Now().UnixMilli()})
+	}
+}
+
+func (rm *roomManager) leave(name string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	r, ok := rm.rooms[name]
+	if !ok {
+		return fmt.Errorf("not in room %s", name)
+	}
+	r.cancel()
+	r.events.Cancel()
+	r.sub.Cancel()
+	delete(rm.rooms, name)
+	return r.topic.Close()
+}
+
+// publish posts body to a joined room as us.
+func (rm *roomManager) publish(ctx context.Context, name, body string) (Message, error) {
+	return rm.post(ctx, name, Message{Body: body})
+}
+
+// post publishes m, which may carry attachments, to a joined room as us.
+func (rm *roomManager) post(ctx context.Context, name string, m Message) (Message, error) {
+	rm.mu.Lock()
+	r, ok := rm.rooms[name]
+	rm.mu.Unlock()
+	if !ok {
+		return Message{}, fmt.Errorf("not in room %s (use 'join %s')", name, name)
+	}
+	if err := rm.a.node.PaceMessage(ctx, "#"+name); err != nil {
+		return Message{}, err
+	}
+	m.From, m.When, m.Room = rm.a.h.ID().String(), time.Now().UnixMilli(), name
+	// Members drop what doesn't validate, so don't send it.
+	if err := node.ValidateMessage(m, time.Now()); err != nil {
+		return Message{}, err
+	}
+	out, err := rm.a.sealRoomMessage(name, m)
+	if err != nil {
+		return Message{}, err
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return Message{}, err
+	}
+	return m, r.topic.Publish(ctx, b)
+}
+
+func (rm *roomManager) readLoop(ctx context.Context, r *room) {
+	self := rm.a.h.ID()
+	for {
+		msg, err := r.sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		if msg.ReceivedFrom == self {
+			continue
+		}
+		m, err := node.DecodeMessage(msg.Data)
+		if err != nil {
+			logger.Debugf("invalid room message in %s from %s: %s", r.name, msg.GetFrom(), err)
+			continue
+		}
+		// pubsub signs messages, so the author is authoritative, not the
+		// claimed From.
+		m.From = msg.GetFrom().String()
+		m.Room = r.name
+		if m.Cipher != nil {
+			rm.a.post(func() { rm.a.openRoomMessage(r.name, m.From, m) })
+			continue
+		}
+		if _, encrypted := rm.a.roster(r.name); encrypted {
+			logger.Debugf("unencrypted message in encrypted #%s from %s dropped", r.name, m.From)
+			continue
+		}
+		rm.a.post(func() { rm.a.messageReceived(m.From, m, false) })
+	}
+}
+
+// joined reports whether we're in room name.
+func (rm *roomManager) joined(name string) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	_, ok := rm.rooms[name]
+	return ok
+}
+
+// members are the connected peers subscribed to room name.
+func (rm *roomManager) members(name string) []peer.ID {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	r, ok := rm.rooms[name]
+	if !ok {
+		return nil
+	}
+	return r.topic.ListPeers()
+}
+
+func (rm *roomManager) list() []string {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	names := make([]string, 0, len(rm.rooms))
+	for n := range rm.rooms {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// saveRoomMembers records who is in each joined room, for rejoinRooms.
+func (a *app) saveRoomMembers() {
+	for _, name := range a.rooms.list() {
+		var members []peer.AddrInfo
+		for _, p := range a.rooms.members(name) {
+			members = append(members, a.h.Peerstore().PeerInfo(p))
+		}
+		a.roomBook.setMembers(name, members)
+	}
+}
+
+// joinRoom joins room name and keeps it joined across restarts.
+func (a *app) joinRoom(name string) error {
+	if r, ok := a.roster(name); ok && !r.Member(a.h.ID().String()) {
+		return fmt.Errorf("#%s is encrypted and you're not on its roster; ask its owner, %s", name, a.conversationLabel(r.Owner))
+	}
+	already := a.rooms.joined(name)
+	if err := a.rooms.join(name); err != nil {
+		return err
+	}
+	a.roomBook.add(name)
+	if !already {
+		a.roomBook.addChanges(name, node.MembershipChange{Peer: a.h.ID().String(), Joined: true, When: time.Now().UnixMilli()})
+	}
+	return nil
+}
+
+// rejoinRooms joins the rooms we were in last time. In the background it
+// then reconnects to their members as we last saw them, which tells them
+// we're subscribed again, and catches up on the history we missed.
+func (a *app) rejoinRooms() {
+	saved := a.roomBook.snapshot()
+	var names []string
+	for name := range saved {
+		if err := a.rooms.join(name); err != nil {
+			logger.Warnf("rejoining #%s: %s", name, err)
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	printResult(map[string]any{"rejoined": names}, "rejoined #"+strings.Join(names, ", #"))
+	for _, name := range names {
+		go a.catchUpRoom(name, saved[name].Members)
+	}
+}
+
+// catchUpRoom reconnects to room name's last known members and syncs its
+// history with them.
+func (a *app) catchUpRoom(name string, members []roomMember) {
+	ctx, cancel := context.WithTimeout(a.ctx, roomRejoinTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, m := range members {
+		pi, err := a.contacts.resolve(m.Peer)
+		if err != nil || pi.ID == a.h.ID() || a.online(pi.ID) {
+			continue
+		}
+		for _, s := range m.Addrs {
+			if addr, err := ma.NewMultiaddr(s); err == nil {
+				pi.Addrs = append(pi.Addrs, addr)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := dialPeer(ctx, a.node, pi); err != nil {
+				logger.Debugf("#%s member %s: %s", name, shortID(pi.ID.String()), err)
+			}
+		}()
+	}
+	wg.Wait()
+	// Subscriptions are exchanged once connected; give them a moment.
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Second):
+	}
+	a.announcePresence(a.rooms.members(name))
+	added, err := a.syncRoom(ctx, name)
+	if err != nil {
+		logger.Debugf("syncing #%s: %s", name, err)
+	}
+	if added > 0 {
+		a.historyRecovered(name, added)
+	}
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "join",
+		Usage:   "<room>",
+		Summary: "join a room",
+		MinArgs: 1,
+		Run: func(a *app, inv *invocation) error {
+			name := strings.TrimPrefix(inv.Args[0], "#")
+			if err := a.joinRoom(name); err != nil {
+				return err
+			}
+			fmt.Println("joined #" + name)
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "leave",
+		Usage:   "<room>",
+		Summary: "leave a room",
+		MinArgs: 1,
+		Run: func(a *app, inv *invocation) error {
+			name := strings.TrimPrefix(inv.Args[0], "#")
+			if err := a.rooms.leave(name); err != nil {
+				return err
+			}
+			a.roomBook.remove(name)
+			a.partRoom(name)
+			a.roomBook.addChanges(name, node.MembershipChange{Peer: a.h.ID().String(), When: time.Now().UnixMilli()})
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:       "say",
+		Usage:      "<room> <message>",
+		Summary:    "send a message to a room",
+		MinArgs:    2,
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			name := strings.TrimPrefix(inv.Args[0], "#")
+			m, err := a.rooms.publish(inv.Context(), name, inv.Tail(1))
+			if err != nil {
+				return err
+			}
+			a.messageSent("", m)
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "rooms",
+		Summary: "list joined rooms",
+		Run: func(a *app, inv *invocation) error {
+			names := a.rooms.list()
+			if len(names) == 0 {
+				fmt.Println("not in any rooms")
+				return nil
+			}
+			for _, n := range names {
+				if c := a.unread.count("#" + n); c > 0 {
+					fmt.Printf(" - #%s (%d unread)\n", n, c)
+					continue
+				}
+				fmt.Println(" - #" + n)
+			}
+			return nil
+		},
+	})
+}
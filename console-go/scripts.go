@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Starlark scripts (*.star in the scripts directory) are loaded at startup
+// and automate the client: auto-responders, filters and scheduled messages.
+// They get a deliberately small API:
+//
+//	send(to, body)          send a direct message
+//	peers()                 list of connected peer IDs
+//	self_id()               our own peer ID
+//	every(interval, fn)     call fn() every interval ("30m", "1h", ...)
+//	after(delay, fn)        call fn() once after delay
+//	print(...)              write to the log
+//
+// A script may define on_message(msg); msg has .sender, .body and .when
+// (unix millis). Returning False drops the message before it's displayed
+// or passed on to notifications, hooks and bots.
+
+// scriptMaxSteps bounds a single script invocation so a runaway loop can't
+// hang the node.
+const scriptMaxSteps = 5_000_000
+
+type script struct {
+	name    string
+	mu      sync.Mutex // starlark values aren't safe for concurrent use
+	globals starlark.StringDict
+}
+
+type scriptHost struct {
+	a       *app
+	scripts []*script
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// loadScripts executes every *.star file in dir. A script that fails to
+// load is reported and skipped.
+func loadScripts(a *app, dir string) (*scriptHost, error) {
+	sh := &scriptHost{a: a, stop: make(chan struct{})}
+	files, err := filepath.Glob(filepath.Join(dir, "*.star"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		sc := &script{name: strings.TrimSuffix(filepath.Base(f), ".star")}
+		sc.mu.Lock()
+		thread := sh.thread(sc)
+		sc.globals, err = starlark.ExecFile(thread, f, nil, sh.builtins(sc))
+		sc.mu.Unlock()
+		if err != nil {
+			logger.Warnf("script %s: %s", sc.name, err)
+			continue
+		}
+		sh.scripts = append(sh.scripts, sc)
+		logger.Infof("loaded script %s", sc.name)
+	}
+	return sh, nil
+}
+
+func (sh *scriptHost) thread(sc *script) *starlark.Thread {
+	t := &starlark.Thread{
+		Name: sc.name,
+		Print: func(_ *starlark.Thread, msg string) {
+			logger.Infof("script %s: %s", sc.name, msg)
+		},
+	}
+	t.SetMaxExecutionSteps(scriptMaxSteps)
+	return t
+}
+
+func (sh *scriptHost) builtins(sc *script) starlark.StringDict {
+	return starlark.StringDict{
+		"send": starlark.NewBuiltin("send", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var to, body string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "to", &to, "body", &body); err != nil {
+				return nil, err
+			}
+			m, err := sh.a.node.Send(sh.a.ctx, to, body)
+			if err != nil {
+				return nil, err
+			}
+			sh.a.messageSent(to, m)
+			return starlark.None, nil
+		}),
+		"peers": starlark.NewBuiltin("peers", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+				return nil, err
+			}
+			var ids []starlark.Value
+			for _, p := range sh.a.h.Network().Peers() {
+				ids = append(ids, starlark.String(p.String()))
+			}
+			return starlark.NewList(ids), nil
+		}),
+		"self_id": starlark.NewBuiltin("self_id", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			return starlark.String(sh.a.h.ID().String()), nil
+		}),
+		"every": sh.scheduleBuiltin(sc, "every", true),
+		"after": sh.scheduleBuiltin(sc, "after", false),
+	}
+}
+
+// scheduleBuiltin implements every() and after().
+func (sh *scriptHost) scheduleBuiltin(sc *script, name string, repeat bool) *starlark.Builtin {
+	return starlark.NewBuiltin(name, func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var spec string
+		var fn starlark.Callable
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "interval", &spec, "fn", &fn); err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(spec)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s: bad interval %q", name, spec)
+		}
+		sh.wg.Add(1)
+		go func() {
+			defer sh.wg.Done()
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			for {
+				select {
+				case <-timer.C:
+				case <-sh.stop:
+					return
+				}
+				if _, err := sh.call(sc, fn); err != nil {
+					logger.Warnf("script %s: %s: %s", sc.name, name, err)
+				}
+				if !repeat {
+					return
+				}
+				timer.Reset(d)
+			}
+		}()
+		return starlark.None, nil
+	})
+}
+
+func (sh *scriptHost) call(sc *script, fn starlark.Value, args ...starlark.Value) (starlark.Value, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return starlark.Call(sh.thread(sc), fn, args, nil)
+}
+
+// filter runs every script's on_message hook and reports whether the
+// message should be kept.
+func (sh *scriptHost) filter(from string, m Message) bool {
+	keep := true
+	for _, sc := range sh.scripts {
+		fn, ok := sc.globals["on_message"]
+		if !ok {
+			continue
+		}
+		msg := starlarkstruct.FromStringDict(starlark.String("message"), starlark.StringDict{
+			"sender": starlark.String(from),
+			"body":   starlark.String(m.Body),
+			"when":   starlark.MakeInt64(m.When),
+		})
+		res, err := sh.call(sc, fn, msg)
+		if err != nil {
+			logger.Warnf("script %s: on_message: %s", sc.name, err)
+			continue
+		}
+		if res == starlark.False {
+			keep = false
+		}
+	}
+	return keep
+}
+
+func (sh *scriptHost) list() []string {
+	names := make([]string, 0, len(sh.scripts))
+	for _, sc := range sh.scripts {
+		names = append(names, sc.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// close stops all scheduled jobs.
+func (sh *scriptHost) close() {
+	close(sh.stop)
+	sh.wg.Wait()
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "scripts",
+		Summary: "list loaded Starlark scripts",
+		Run: func(a *app, inv *invocation) error {
+			names := a.scripts.list()
+			if len(names) == 0 {
+				fmt.Println("no scripts loaded")
+				return nil
+			}
+			for _, n := range names {
+				fmt.Println(" -", n)
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-chat/node"
+)
+
+// Scrollback limits: lines kept per conversation, and lines per page.
+const (
+	scrollbackLines = node.ChatLogPerConversation
+	scrollbackPage  = 20
+)
+
+// Terminals send these for PageUp and PageDown; in line mode they arrive as
+// a line of their own once Enter is pressed.
+const (
+	pageUpKey   = "\x1b[5~"
+	pageDownKey = "\x1b[6~"
+)
+
+// scrollback keeps the recent messages of every conversation in memory,
+// including those held back while another conversation was current, so
+// they can be paged through with 'more'. The chat log carries them over
+// restarts.
+type scrollback struct {
+	mu     sync.Mutex
+	lines  map[string][]scrollLine // conversation key -> lines, oldest first
+	end    map[string]int          // paging position: lines from the bottom already shown
+	recent []scrollEntry           // the latest messages across conversations, oldest first
+	// mark, if set, is appended to a line when it's shown: the delivery
+	// state of a message we sent.
+	mark func(id string) string
+	// log, if set, keeps what's added across restarts; see node.ChatLog.
+	log *node.ChatLog
+}
+
+// scrollLine is a formatted line and the ID of its message.
+type scrollLine struct {
+	text string
+	id   string
+}
+
+// scrollEntry is a message with the conversation it belongs to.
+type scrollEntry struct {
+	key string
+	m   Message
+}
+
+func newScrollback() *scrollback {
+	return &scrollback{lines: make(map[string][]scrollLine), end: make(map[string]int)}
+}
+
+// load fills the scrollback from the chat log's entries, oldest first,
+// and logs what's added from then on.
+func (s *scrollback) load(log *node.ChatLog, entries []node.ChatEntry) {
+	for _, e := range entries {
+		s.insert(e.Conversation, e.Message)
+	}
+	s.mu.Lock()
+	s.log = log
+	s.mu.Unlock()
+}
+
+// add records a message in conversation key and resets its paging, unless
+// it's there already: a queued message, once delivered.
+func (s *scrollback) add(key string, m Message) {
+	if !s.insert(key, m) {
+		return
+	}
+	s.mu.Lock()
+	log := s.log
+	s.mu.Unlock()
+	if log != nil {
+		if err := log.Append(key, m); err != nil {
+			logger.Warnf("saving chat log: %s", err)
+		}
+	}
+}
+
+// insert is add without the chat log; it reports whether m was new.
+func (s *scrollback) insert(key string, m Message) bool {
+	line := fmt.Sprintf("[%s] <%s> %s", time.UnixMilli(m.When).Format("2006-01-02 15:04"), shortID(m.From), m.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := m.ID()
+	for _, l := range s.lines[key] {
+		if l.id == id {
+			return false
+		}
+	}
+	lines := append(s.lines[key], scrollLine{line, id})
+	if len(lines) > scrollbackLines {
+		lines = lines[len(lines)-scrollbackLines:]
+	}
+	s.lines[key] = lines
+	delete(s.end, key)
+	s.recent = append(s.recent, scrollEntry{key, m})
+	if len(s.recent) > scrollbackLines {
+		s.recent = s.recent[len(s.recent)-scrollbackLines:]
+	}
+	return true
+}
+
+// latest returns the last n messages, of conversation key or, if key is
+// empty, of all of them.
+func (s *scrollback) latest(key string, n int) []scrollEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []scrollEntry
+	for i := len(s.recent) - 1; i >= 0 && len(out) < n; i-- {
+		if key == "" || s.recent[i].key == key {
+			out = append(out, s.recent[i])
+		}
+	}
+	slices.Reverse(out)
+	return out
+}
+
+// find returns the recent message with the given ID (see Message.ID).
+func (s *scrollback) find(id string) (scrollEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.recent) - 1; i >= 0; i-- {
+		if s.recent[i].m.ID() == id {
+			return s.recent[i], true
+		}
+	}
+	return scrollEntry{}, false
+}
+
+// rekey gives the line of message id in conversation key the ID to, as a
+// queued message gets its own on delivery.
+func (s *scrollback) rekey(key, id, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, l := range s.lines[key] {
+		if l.id == id {
+			s.lines[key][i].id = to
+			return
+		}
+	}
+}
+
+// render formats lines for showing; callers hold s.mu.
+func (s *scrollback) render(lines []scrollLine) []string {
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = l.text
+		if s.mark != nil {
+			out[i] += s.mark(l.id)
+		}
+	}
+	return out
+}
+
+// page returns the n lines before the last page shown (or after it, if
+// newer), moving the position, and how many lines are above them. The
+// first call after new messages starts from the bottom; at the top it
+// keeps returning the first page.
+func (s *scrollback) page(key string, n int, newer bool) (lines []string, above int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := s.lines[key]
+	end := s.end[key]
+	if newer {
+		end = max(end-2*n, 0)
+	}
+	end = min(end, max(len(all)-n, 0))
+	from := max(len(all)-end-n, 0)
+	lines = s.render(all[from : len(all)-end])
+	s.end[key] = len(all) - from
+	return lines, from
+}
+
+// last returns the last n lines of conversation key.
+func (s *scrollback) last(key string, n int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := s.lines[key]
+	return s.render(all[max(len(all)-n, 0):])
+}
+
+// showUnread prints what arrived in key since it was last read, up to a
+// page, e.g. when switching into a conversation.
+func (a *app) showUnread(key string) {
+	n := min(a.unread.count(key), scrollbackPage)
+	if n == 0 {
+		return
+	}
+	for _, line := range a.scroll.last(key, n) {
+		fmt.Println(line)
+	}
+}
+
+// scrollKeyLine maps a PageUp or PageDown line to the matching 'more'.
+func scrollKeyLine(text string) string {
+	switch text {
+	case pageUpKey:
+		return "more"
+	case pageDownKey:
+		return "more -newer"
+	}
+	return text
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "more",
+		Usage:   "[-n lines] [-newer] [<peerID|contact|#room>]",
+		Summary: "page back through a conversation's scrollback (PageUp/PageDown then Enter work too)",
+		Flags: func(fs *flag.FlagSet) {
+			fs.Int("n", scrollbackPage, "lines per page")
+			fs.Bool("newer", false, "page forward instead of back")
+		},
+		Run: func(a *app, inv *invocation) error {
+			key, _ := a.convs.active()
+			if len(inv.Args) > 0 {
+				key = inv.Args[0]
+				if !strings.HasPrefix(key, "#") {
+					key = a.contacts.peerID(key)
+				}
+			}
+			if key == "" {
+				fmt.Println("usage: more [<peerID|contact|#room>] (or open a conversation first)")
+				return nil
+			}
+			lines, above := a.scroll.page(key, max(inv.Int("n"), 1), inv.Bool("newer"))
+			if len(lines) == 0 {
+				fmt.Println("no scrollback for", a.conversationLabel(key))
+				return nil
+			}
+			if above > 0 {
+				fmt.Printf("-- %d earlier lines; 'more' for the previous page --\n", above)
+			} else {
+				fmt.Println("-- start of scrollback --")
+			}
+			for _, line := range lines {
+				fmt.Println(line)
+			}
+			return nil
+		},
+	})
+}
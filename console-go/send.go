@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+	"p2p-chat/paths"
+)
+
+// sendOptions are the flags of 'send'.
+type sendOptions struct {
+	dataDir     string
+	mailboxAddr string
+	relayAddrs  string
+	timeout     time.Duration
+	noStore     bool
+	storeTTL    time.Duration
+	routers     string
+}
+
+func (o *sendOptions) flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.dataDir, "data-dir", "", "use the identity and contacts in this directory instead of the OS defaults")
+	fs.StringVar(&o.mailboxAddr, "mailbox", "", "supernode multiaddr to leave the message at if the peer is offline")
+	fs.StringVar(&o.relayAddrs, "relay", "", "comma-separated relay multiaddrs to use when behind NAT")
+	fs.DurationVar(&o.timeout, "timeout", 30*time.Second, "time limit for delivery, and again for storing it offline")
+	fs.BoolVar(&o.noStore, "no-store", false, "fail instead of storing the message when the peer is offline")
+	fs.DurationVar(&o.storeTTL, "store-ttl", node.DefaultStoreTTL, "how long a stored message lives before it is discarded undelivered")
+	fs.StringVar(&o.routers, "delegated-routing", "", "comma-separated Delegated Routing V1 HTTP endpoints to find the peer with")
+}
+
+// sendOnce runs 'send': start a node, deliver one message, wait for the
+// peer to acknowledge it and exit. If the peer can't be reached the
+// message is left at a mailbox: the --mailbox supernode, else one the
+// recipient's profile or DHT inbox pointer names, else our own. The exit
+// code says which happened, so scripts and alerts can rely on it.
+func sendOnce(args []string) int {
+	fs := subcommandFlags("send")
+	var opts sendOptions
+	opts.flags(fs)
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return exitUsage
+	}
+	body := strings.Join(fs.Args()[1:], " ")
+	if body == "-" {
+		b, err := io.ReadAll(io.LimitReader(os.Stdin, node.MaxStoredBody+1))
+		if err != nil {
+			fmt.Println("reading the message:", err)
+			return exitFailed
+		}
+		body = string(b)
+	}
+	if len(body) > node.MaxStoredBody {
+		fmt.Printf("message %s: over %d bytes\n", node.ErrTooLarge, node.MaxStoredBody)
+		return exitUsage
+	}
+
+	dirs, err := paths.Open(opts.dataDir)
+	if err != nil {
+		fmt.Println("failed to set up data directory:", err)
+		return exitFailed
+	}
+	contacts, err := loadContacts(dirs.ConfigFile(contactsFile))
+	if err != nil {
+		fmt.Println("failed to load contacts:", err)
+		return exitFailed
+	}
+	cfg, err := loadClientConfig(dirs.ConfigFile(clientConfigFile))
+	if err != nil {
+		fmt.Println("failed to load config:", err)
+		return exitFailed
+	}
+	if opts.relayAddrs == "" {
+		opts.relayAddrs = strings.Join(cfg.Relays, ",")
+	}
+	to, err := contacts.resolve(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	// Unless told otherwise, leave the message where the recipient said
+	// to: its profile, else its DHT inbox pointer, else our own mailbox.
+	if theirs := contacts.mailboxesOf(to.ID.String()); opts.mailboxAddr == "" && len(theirs) > 0 {
+		opts.mailboxAddr = theirs[0]
+	}
+	own := cfg.Mailbox
+	if own == "" && len(cfg.Mailboxes) > 0 {
+		own = cfg.Mailboxes[0]
+	}
+	relayOpts, relays, err := relayOptions(splitList(opts.relayAddrs))
+	if err != nil {
+		fmt.Println("invalid --relay:", err)
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	n, err := newClientNode(ctx, dirs, node.Options{
+		DelegatedRouting: splitList(opts.routers),
+		StoreTTL:         opts.storeTTL,
+	}, relayOpts)
+	if err != nil {
+		fmt.Println("failed to start node:", err)
+		return exitFailed
+	}
+	defer n.Close()
+	connectRelays(ctx, n.Host(), relays)
+	mailbox, err := connectMailbox(ctx, n.Host(), opts.mailboxAddr)
+	if err != nil {
+		fmt.Println("invalid --mailbox:", err)
+		return exitUsage
+	}
+
+	e2e := contacts.requiresE2E(to.ID.String())
+	dctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	err = dialPeer(dctx, n, to)
+	if err == nil && len(body) > node.MaxBodySize {
+		// Only stored messages can be split into parts.
+		err = fmt.Errorf("%d bytes is over the %d byte limit for a direct message", len(body), node.MaxBodySize)
+	}
+	if err == nil && e2e {
+		err = checkEncrypted(n.Host(), to.ID)
+	}
+	if err == nil {
+		_, err = n.Deliver(dctx, to.ID.String(), body)
+	}
+	cancel()
+	if err == nil {
+		fmt.Println("delivered")
+		return exitOK
+	}
+	fmt.Println("not delivered:", err)
+	if e2e {
+		fmt.Println("the contact requires end-to-end encryption, so the message isn't stored offline")
+	}
+	if opts.noStore || e2e || ctx.Err() != nil {
+		return exitFailed
+	}
+
+	sctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+	if mailbox != "" {
+		_, err = n.Deposit(sctx, mailbox, to.ID.String(), body)
+	} else if _, err = n.StoreOffline(sctx, to.ID.String(), body); err != nil && own != "" {
+		logger.Debugf("inbox pointer of %s: %s", to.ID, err)
+		var ownID peer.ID
+		if ownID, err = connectMailbox(sctx, n.Host(), own); err == nil {
+			_, err = n.Deposit(sctx, ownID, to.ID.String(), body)
+		}
+	}
+	if err != nil {
+		fmt.Println("store error:", err)
+		return exitFailed
+	}
+	fmt.Println("stored for offline delivery")
+	return exitStored
+}
+
+// dialPeer connects to pi, asking the delegated routers or the DHT for
+// addresses if none are known.
+func dialPeer(ctx context.Context, n *node.Node, pi peer.AddrInfo) error {
+	if len(pi.Addrs) == 0 {
+		if found, err := n.FindPeer(ctx, pi.ID); err == nil {
+			pi = found
+		}
+	}
+	return n.Host().Connect(ctx, pi)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"p2p-chat/node"
+)
+
+// sendingNotice is how long a send may take before we say it's still
+// going, so a slow or stalled peer doesn't look like a hung console.
+const sendingNotice = time.Second
+
+// sendingLabel is the prompt's note for a conversation with messages still
+// going out, e.g. " sending…2".
+func (a *app) sendingLabel(key string) string {
+	n := a.node.Sending()[key]
+	switch {
+	case n == 0:
+		return ""
+	case n == 1:
+		return " sending…"
+	}
+	return fmt.Sprintf(" sending…%d", n)
+}
+
+// noticeSlowSend says a send to target is still going once it has taken
+// sendingNotice; call the returned func when it's done.
+func (a *app) noticeSlowSend(target string) (done func()) {
+	t := time.AfterFunc(sendingNotice, func() {
+		n := a.node.Sending()[target]
+		logger.Infof("still sending to %s (%d in flight, limit %d)", a.conversationLabel(target), n, node.MaxQueuedSends)
+	})
+	return func() { t.Stop() }
+}
+
+// printSending lists the peers with direct messages still going out.
+func printSending(sending map[string]int, label func(string) string) {
+	if len(sending) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(sending))
+	for k := range sending {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return sending[keys[i]] > sending[keys[j]] })
+	fmt.Printf("sending (limit %d per peer):\n", node.MaxQueuedSends)
+	for _, k := range keys {
+		fmt.Printf("  %-28s %d in flight\n", label(k), sending[k])
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	host "github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+	"p2p-chat/paths"
+)
+
+const clientConfigFile = "p2pchat_client.json"
+
+// clientConfig holds defaults written by 'init'; the matching flags
+// override them.
+type clientConfig struct {
+	Listen    []string `json:"listen,omitempty"`
+	Relays    []string `json:"relays,omitempty"`
+	Mailbox   string   `json:"mailbox,omitempty"`
+	Bootstrap []string `json:"bootstrap,omitempty"`
+	// Mailboxes are the servers mailbox discovery picked; Mailbox, when
+	// set, is used instead.
+	Mailboxes []string `json:"mailboxes,omitempty"`
+	// Home is the /p2p multiaddr of the home node 'home pair' paired.
+	Home string `json:"home,omitempty"`
+}
+
+func loadClientConfig(path string) (clientConfig, error) {
+	var c clientConfig
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c clientConfig) save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// fill sets the client flags left empty on the command line.
+func (c clientConfig) fill(o *clientOptions) {
+	if o.listenAddrs == "" {
+		o.listenAddrs = strings.Join(c.Listen, ",")
+	}
+	if o.relayAddrs == "" {
+		o.relayAddrs = strings.Join(c.Relays, ",")
+	}
+	if o.mailboxAddr == "" {
+		o.mailboxAddr = c.Mailbox
+	}
+	if o.bootstrap == "" {
+		o.bootstrap = strings.Join(c.Bootstrap, ",")
+	}
+}
+
+// connectBootstrap dials the peers named in --bootstrap, so the DHT and
+// rooms have someone to start from; failures are only logged.
+func connectBootstrap(ctx context.Context, h host.Host, addrs []string) {
+	for _, s := range addrs {
+		pi, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			logger.Warnf("bootstrap peer %q: %s", s, err)
+			continue
+		}
+		cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		if err := h.Connect(cctx, *pi); err != nil {
+			logger.Warnf("connect to bootstrap peer %s: %s", pi.ID, err)
+		}
+		cancel()
+	}
+}
+
+func setupFlags(fs *flag.FlagSet) *string {
+	return fs.String("data-dir", "", "set up this directory instead of the OS defaults")
+}
+
+// setupWizard runs 'init': it asks for everything a first start would
+// otherwise default silently, writes the identity and clientConfigFile,
+// and prints an invite.
+func setupWizard(args []string) int {
+	fs := subcommandFlags("init")
+	dataDir := setupFlags(fs)
+	fs.Parse(args)
+	dirs, err := paths.Open(*dataDir)
+	if err != nil {
+		fmt.Println("failed to set up data directory:", err)
+		return exitFailed
+	}
+	cfgPath := dirs.ConfigFile(clientConfigFile)
+	cfg, err := loadClientConfig(cfgPath)
+	if err != nil {
+		fmt.Println("failed to load config:", err)
+		return exitFailed
+	}
+	w := &wizard{in: bufio.NewReader(os.Stdin)}
+
+	fmt.Println("Setting up peep-chat. Press Enter to accept the [default].")
+	fmt.Println()
+	priv, err := w.identity(dirs.DataFile(identityFile))
+	if err != nil {
+		fmt.Println("identity error:", err)
+		return exitFailed
+	}
+
+	fmt.Println()
+	fmt.Println("Listening")
+	port, public := 0, true
+	if len(cfg.Listen) > 0 {
+		port, public = listenChoice(cfg.Listen[0])
+	}
+	port = w.port("Port to listen on; 0 picks a free one each start, a fixed one keeps invites valid", port)
+	public = w.yesNo("Accept connections from other machines?", public)
+	cfg.Listen = listenAddrs(port, public)
+
+	fmt.Println()
+	fmt.Println("Other nodes (all optional)")
+	cfg.Relays = w.addrList("Relays to use when behind NAT, comma-separated /p2p multiaddrs", cfg.Relays)
+	cfg.Bootstrap = w.addrList("Peers to connect to at startup, comma-separated /p2p multiaddrs", cfg.Bootstrap)
+	if mb := w.addrList("Mailbox supernode for offline messages, a /p2p multiaddr", splitList(cfg.Mailbox)); len(mb) > 0 {
+		cfg.Mailbox = mb[0]
+	} else {
+		cfg.Mailbox = ""
+	}
+	if err := cfg.save(cfgPath); err != nil {
+		fmt.Println("failed to save config:", err)
+		return exitFailed
+	}
+	fmt.Println()
+	fmt.Println("Wrote", cfgPath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	n, err := node.New(ctx, node.Options{Identity: priv, ListenAddrs: cfg.Listen})
+	if err != nil {
+		fmt.Println("failed to start node:", err)
+		return exitFailed
+	}
+	defer n.Close()
+	fmt.Println()
+	fmt.Println("Your peer ID is", n.ID())
+	fmt.Println("Your first invite:")
+	printInvite(n)
+	if port == 0 {
+		fmt.Println("The port changes on every start; 'invite' in the client prints the current addresses.")
+	}
+	start := progName()
+	if *dataDir != "" {
+		start += " --data-dir " + *dataDir
+	}
+	fmt.Printf("\nAll set. Start chatting with: %s\n", start)
+	return exitOK
+}
+
+// wizard asks the questions of 'init'. At end of input every question
+// takes its default, so 'init </dev/null' sets up without a passphrase.
+type wizard struct {
+	in *bufio.Reader
+}
+
+func (w *wizard) ask(question, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	line, err := w.in.ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Println()
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def
+	}
+	return line
+}
+
+func (w *wizard) yesNo(question string, def bool) bool {
+	d := "y/N"
+	if def {
+		d = "Y/n"
+	}
+	for {
+		ans := w.ask(question, d)
+		if ans == d {
+			return def
+		}
+		switch strings.ToLower(ans) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+		fmt.Println("please answer y or n")
+	}
+}
+
+func (w *wizard) port(question string, def int) int {
+	for {
+		p, err := strconv.Atoi(w.ask(question, strconv.Itoa(def)))
+		if err == nil && p >= 0 && p <= 65535 {
+			return p
+		}
+		fmt.Println("a port is a number from 0 to 65535")
+	}
+}
+
+// addrList asks for comma-separated /p2p multiaddrs until they all parse.
+func (w *wizard) addrList(question string, def []string) []string {
+	for {
+		addrs := splitList(w.ask(question, strings.Join(def, ",")))
+		var bad error
+		for _, s := range addrs {
+			if _, err := peer.AddrInfoFromString(s); err != nil {
+				bad = fmt.Errorf("%q: %w", s, err)
+				break
+			}
+		}
+		if bad == nil {
+			return addrs
+		}
+		fmt.Println("invalid address", bad)
+	}
+}
+
+// identity keeps or replaces the key at path, offering to protect it
+// with a passphrase, and returns it.
+func (w *wizard) identity(path string) (crypto.PrivKey, error) {
+	fmt.Println("Identity")
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		priv, err := node.ParseIdentity(data, func() ([]byte, error) {
+			return readPassphrase(w.in, "The existing identity is protected; passphrase: ")
+		})
+		if err != nil {
+			return nil, err
+		}
+		id, _ := peer.IDFromPrivateKey(priv)
+		fmt.Println("An identity already exists at", path)
+		fmt.Println("  peer ID:", id)
+		if w.yesNo("Keep it?", true) {
+			if node.IsEncryptedIdentity(data) || !w.yesNo("It isn't passphrase protected; add a passphrase now?", false) {
+				return priv, nil
+			}
+			return priv, w.saveIdentity(path, priv)
+		}
+		backup, err := backupIdentity(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Moved the old identity to", backup)
+	}
+	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.Ed25519, -1, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.saveIdentity(path, priv); err != nil {
+		return nil, err
+	}
+	id, _ := peer.IDFromPrivateKey(priv)
+	fmt.Println("Created identity", id)
+	return priv, nil
+}
+
+// saveIdentity asks for a passphrase (twice) and writes priv to path,
+// encrypted unless the passphrase is empty.
+func (w *wizard) saveIdentity(path string, priv crypto.PrivKey) error {
+	var pass []byte
+	for {
+		pass, _ = readPassphrase(w.in, "Passphrase to protect the key (Enter for none): ")
+		if len(pass) == 0 {
+			break
+		}
+		again, _ := readPassphrase(w.in, "Repeat the passphrase: ")
+		if bytes.Equal(pass, again) {
+			break
+		}
+		fmt.Println("the passphrases don't match; try again")
+	}
+	var data []byte
+	var err error
+	if len(pass) == 0 {
+		fmt.Println("The key is stored unencrypted; anyone who can read", path, "can be you.")
+		data, err = crypto.MarshalPrivateKey(priv)
+	} else {
+		fmt.Printf("The client will ask for the passphrase at start; scripts can set %s.\n", node.PassphraseEnv)
+		data, err = node.EncryptIdentity(priv, pass)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// listenAddrs are the TCP and QUIC addresses for port, on every
+// interface or only loopback.
+func listenAddrs(port int, public bool) []string {
+	ip := "127.0.0.1"
+	if public {
+		ip = "0.0.0.0"
+	}
+	return []string{
+		fmt.Sprintf("/ip4/%s/tcp/%d", ip, port),
+		fmt.Sprintf("/ip4/%s/udp/%d/quic-v1", ip, port),
+	}
+}
+
+// listenChoice recovers the answers that produced addr.
+func listenChoice(addr string) (port int, public bool) {
+	parts := strings.Split(addr, "/")
+	if len(parts) >= 5 {
+		port, _ = strconv.Atoi(parts[4])
+		public = parts[2] != "127.0.0.1"
+	}
+	return port, public
+}
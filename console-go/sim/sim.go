@@ -0,0 +1,218 @@
+// Package sim runs peep-chat nodes on an in-memory libp2p network
+// (mocknet), so delivery, rooms and offline paths can be exercised without
+// real sockets. Every node is a full node.Node; the harness records what
+// each one receives and can take nodes offline and back.
+package sim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	"p2p-chat/node"
+)
+
+// roomTopicPrefix matches the console client's room topics.
+const roomTopicPrefix = "/p2pchat/rooms/"
+
+// Received is one message as a node saw it.
+type Received struct {
+	From    peer.ID
+	Message node.Message
+}
+
+// Network is a set of nodes on one mocknet, all linked to each other.
+type Network struct {
+	ctx   context.Context
+	mn    mocknet.Mocknet
+	Nodes []*node.Node
+	ps    []*pubsub.PubSub
+
+	mu       sync.Mutex
+	received [][]Received
+}
+
+// New starts n nodes with the given link latency and connects them all.
+// DHTs run in server mode, since mocknet addresses never look public.
+func New(ctx context.Context, n int, latency time.Duration) (*Network, error) {
+	mn := mocknet.New()
+	mn.SetLinkDefaults(mocknet.LinkOptions{Latency: latency})
+	nw := &Network{ctx: ctx, mn: mn, received: make([][]Received, n)}
+	for i := 0; i < n; i++ {
+		h, err := mn.GenPeer()
+		if err != nil {
+			nw.Close()
+			return nil, err
+		}
+		nd, err := node.New(ctx, node.Options{Host: h, DHT: []kaddht.Option{kaddht.Mode(kaddht.ModeServer)}})
+		if err != nil {
+			nw.Close()
+			return nil, err
+		}
+		i := i
+		nd.OnMessage(func(from peer.ID, m node.Message) { nw.record(i, from, m) })
+		ps, err := pubsub.NewGossipSub(ctx, h)
+		if err != nil {
+			nw.Close()
+			return nil, err
+		}
+		nw.Nodes = append(nw.Nodes, nd)
+		nw.ps = append(nw.ps, ps)
+	}
+	if err := mn.LinkAll(); err != nil {
+		nw.Close()
+		return nil, err
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		nw.Close()
+		return nil, err
+	}
+	for _, nd := range nw.Nodes {
+		if err := nd.DHT().Bootstrap(ctx); err != nil {
+			nw.Close()
+			return nil, err
+		}
+	}
+	return nw, nil
+}
+
+func (nw *Network) record(i int, from peer.ID, m node.Message) {
+	nw.mu.Lock()
+	nw.received[i] = append(nw.received[i], Received{From: from, Message: m})
+	nw.mu.Unlock()
+}
+
+// Received returns what node i has received so far, in arrival order.
+func (nw *Network) Received(i int) []Received {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	return append([]Received(nil), nw.received[i]...)
+}
+
+// Reset forgets everything received so far.
+func (nw *Network) Reset() {
+	nw.mu.Lock()
+	nw.received = make([][]Received, len(nw.Nodes))
+	nw.mu.Unlock()
+}
+
+// WaitFor waits until node i has received at least count messages.
+func (nw *Network) WaitFor(ctx context.Context, i, count int) error {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		if got := len(nw.Received(i)); got >= count {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("node %d: got %d of %d messages: %w", i, len(nw.Received(i)), count, ctx.Err())
+		case <-t.C:
+		}
+	}
+}
+
+// Offline cuts node i off from every other node. Dials already in flight
+// when the links go can still land, so it keeps disconnecting until none
+// are left.
+func (nw *Network) Offline(i int) error {
+	self := nw.Nodes[i].ID()
+	for j, other := range nw.Nodes {
+		if j == i {
+			continue
+		}
+		if err := nw.mn.UnlinkPeers(self, other.ID()); err != nil {
+			return err
+		}
+	}
+	for tries := 0; ; tries++ {
+		connected := false
+		for j, other := range nw.Nodes {
+			if j == i || len(nw.mn.Net(self).ConnsToPeer(other.ID())) == 0 {
+				continue
+			}
+			connected = true
+			if err := nw.mn.DisconnectPeers(self, other.ID()); err != nil {
+				return err
+			}
+		}
+		if !connected {
+			return nil
+		}
+		if tries == 100 {
+			return fmt.Errorf("node %d still connected after unlinking", i)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Online links node i again and reconnects it to everyone.
+func (nw *Network) Online(i int) error {
+	self := nw.Nodes[i].ID()
+	for j, other := range nw.Nodes {
+		if j == i {
+			continue
+		}
+		if _, err := nw.mn.LinkPeers(self, other.ID()); err != nil {
+			return err
+		}
+		if _, err := nw.mn.ConnectPeers(self, other.ID()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JoinRoom subscribes every node to room; messages from others are
+// recorded like direct ones. It returns a publish function per node.
+func (nw *Network) JoinRoom(name string) ([]func(body string) error, error) {
+	pubs := make([]func(string) error, len(nw.Nodes))
+	for i, ps := range nw.ps {
+		topic, err := ps.Join(roomTopicPrefix + name)
+		if err != nil {
+			return nil, err
+		}
+		sub, err := topic.Subscribe()
+		if err != nil {
+			return nil, err
+		}
+		self := nw.Nodes[i].ID()
+		go func(i int) {
+			for {
+				msg, err := sub.Next(nw.ctx)
+				if err != nil {
+					return
+				}
+				if msg.ReceivedFrom == self {
+					continue
+				}
+				m, err := node.DecodeMessage(msg.Data)
+				if err != nil {
+					continue
+				}
+				m.From, m.Room = msg.GetFrom().String(), name
+				nw.record(i, msg.GetFrom(), m)
+			}
+		}(i)
+		pubs[i] = func(body string) error {
+			b, _ := json.Marshal(node.Message{From: self.String(), When: time.Now().UnixMilli(), Body: body, Room: name})
+			return topic.Publish(nw.ctx, b)
+		}
+	}
+	return pubs, nil
+}
+
+// Close stops every node and the network.
+func (nw *Network) Close() error {
+	for _, nd := range nw.Nodes {
+		nd.Close()
+	}
+	return nw.mn.Close()
+}
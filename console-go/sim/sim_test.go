@@ -0,0 +1,155 @@
+package sim
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"p2p-chat/node"
+)
+
+const perSender = 10
+
+func newNetwork(t *testing.T, n int) (context.Context, *Network) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	t.Cleanup(cancel)
+	nw, err := New(ctx, n, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nw.Close() })
+	return ctx, nw
+}
+
+// checkOrder asserts got holds perSender messages from each sender, with
+// From matching, in the order each sender sent them.
+func checkOrder(t *testing.T, nw *Network, got []Received, senders ...int) {
+	t.Helper()
+	if len(got) != perSender*len(senders) {
+		t.Fatalf("got %d messages, want %d", len(got), perSender*len(senders))
+	}
+	next := make(map[string]int)
+	for _, s := range senders {
+		next[nw.Nodes[s].ID().String()] = 0
+	}
+	for _, r := range got {
+		from := r.Message.From
+		k, ok := next[from]
+		if !ok {
+			t.Fatalf("message from unexpected sender %s", from)
+		}
+		if r.From.String() != from {
+			t.Fatalf("message claiming to be from %s came from %s", from, r.From)
+		}
+		if want := fmt.Sprintf("msg %d", k); r.Message.Body != want {
+			t.Fatalf("from %s: got %q, want %q", from, r.Message.Body, want)
+		}
+		next[from] = k + 1
+	}
+}
+
+func TestDirectDeliveryInOrder(t *testing.T) {
+	ctx, nw := newNetwork(t, 3)
+	to := nw.Nodes[0].ID().String()
+	errs := make(chan error, 2)
+	for _, s := range []int{1, 2} {
+		go func() {
+			for k := 0; k < perSender; k++ {
+				if _, err := nw.Nodes[s].Send(ctx, to, fmt.Sprintf("msg %d", k)); err != nil {
+					errs <- fmt.Errorf("node %d, message %d: %w", s, k, err)
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nw.WaitFor(ctx, 0, 2*perSender); err != nil {
+		t.Fatal(err)
+	}
+	checkOrder(t, nw, nw.Received(0), 1, 2)
+}
+
+func TestRoomDelivery(t *testing.T) {
+	ctx, nw := newNetwork(t, 3)
+	pubs, err := nw.JoinRoom("lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Gossipsub builds its mesh on the first heartbeat.
+	time.Sleep(1500 * time.Millisecond)
+	for k := 0; k < perSender; k++ {
+		if err := pubs[0](fmt.Sprintf("msg %d", k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range []int{1, 2} {
+		if err := nw.WaitFor(ctx, i, perSender); err != nil {
+			t.Fatal(err)
+		}
+		got := nw.Received(i)
+		for _, r := range got {
+			if r.Message.Room != "lobby" {
+				t.Fatalf("node %d got a message for room %q", i, r.Message.Room)
+			}
+		}
+		checkOrder(t, nw, got, 0)
+	}
+}
+
+func TestOfflineFetch(t *testing.T) {
+	ctx, nw := newNetwork(t, 3)
+	mb, err := node.OpenMailbox(t.TempDir(), node.MailboxLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	box := nw.Nodes[2]
+	mb.Serve(box.Host())
+	sender, recipient := nw.Nodes[0], nw.Nodes[1]
+
+	if err := nw.Offline(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Send(ctx, recipient.ID().String(), "are you there?"); err == nil {
+		t.Fatal("direct send to an offline node succeeded")
+	}
+	for k := 0; k < perSender; k++ {
+		if _, err := sender.Deposit(ctx, box.ID(), recipient.ID().String(), fmt.Sprintf("msg %d", k)); err != nil {
+			t.Fatalf("deposit %d: %v", k, err)
+		}
+	}
+	if err := nw.Online(1); err != nil {
+		t.Fatal(err)
+	}
+
+	fetched, err := recipient.FetchMailbox(ctx, box.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]Received, len(fetched))
+	for i, f := range fetched {
+		if f.Verification != node.Verified {
+			t.Fatalf("stored message %d is %s: %s", i, f.Verification, f.Problem)
+		}
+		got[i] = Received{From: sender.ID(), Message: f.Message}
+	}
+	checkOrder(t, nw, got, 0)
+
+	// Fetching takes the messages: they don't come again.
+	again, err := recipient.FetchMailbox(ctx, box.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 0 {
+		t.Fatalf("second fetch got %d messages", len(again))
+	}
+	if n := len(nw.Received(1)); n != 0 {
+		t.Fatalf("node 1 received %d messages directly while offline", n)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+	"p2p-chat/sim"
+)
+
+// simulation is one run of 'simulate'. Scenario bodies are "<sender>:<seq>"
+// so receivers can check completeness and per-sender order.
+type simulation struct {
+	nw       *sim.Network
+	messages int
+}
+
+var simScenarios = map[string]func(*simulation, context.Context) error{
+	"direct":  (*simulation).direct,
+	"rooms":   (*simulation).rooms,
+	"mailbox": (*simulation).mailbox,
+	"dht":     (*simulation).dht,
+}
+
+// simOptions are the flags of 'simulate'.
+type simOptions struct {
+	nodes     int
+	messages  int
+	latency   time.Duration
+	timeout   time.Duration
+	scenarios string
+}
+
+func (o *simOptions) flags(fs *flag.FlagSet) {
+	fs.IntVar(&o.nodes, "n", 5, "number of nodes")
+	fs.IntVar(&o.messages, "messages", 20, "messages each sender sends per scenario")
+	fs.DurationVar(&o.latency, "latency", 5*time.Millisecond, "link latency")
+	fs.DurationVar(&o.timeout, "timeout", 30*time.Second, "time limit per scenario")
+	fs.StringVar(&o.scenarios, "scenarios", "direct,rooms,mailbox", "comma-separated scenarios to run (direct, rooms, mailbox, dht)")
+}
+
+// simulate runs 'simulate': N nodes on an in-memory network exchange
+// scripted messages and every scenario asserts delivery and ordering. It
+// exits non-zero if any scenario fails, so CI can run it.
+func simulate(args []string) int {
+	fs := subcommandFlags("simulate")
+	var opts simOptions
+	opts.flags(fs)
+	fs.Parse(args)
+	if opts.nodes < 3 {
+		fmt.Println("simulate needs at least 3 nodes")
+		return exitUsage
+	}
+
+	ctx := context.Background()
+	failed := 0
+	for _, name := range splitList(opts.scenarios) {
+		run, ok := simScenarios[name]
+		if !ok {
+			fmt.Printf("unknown scenario %q\n", name)
+			return exitUsage
+		}
+		// A fresh network per scenario keeps failures from leaking.
+		nw, err := sim.New(ctx, opts.nodes, opts.latency)
+		if err != nil {
+			fmt.Println("failed to start simulated network:", err)
+			return exitFailed
+		}
+		s := &simulation{nw: nw, messages: opts.messages}
+		start := time.Now()
+		sctx, cancel := context.WithTimeout(ctx, opts.timeout)
+		err = run(s, sctx)
+		cancel()
+		nw.Close()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %-8s %s (%s)\n", name, err, time.Since(start).Round(time.Millisecond))
+			continue
+		}
+		fmt.Printf("ok   %-8s (%s)\n", name, time.Since(start).Round(time.Millisecond))
+	}
+	if failed > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// direct: every node sends to the next one in a ring.
+func (s *simulation) direct(ctx context.Context) error {
+	n := len(s.nw.Nodes)
+	for i, nd := range s.nw.Nodes {
+		to := s.nw.Nodes[(i+1)%n].ID().String()
+		for k := 0; k < s.messages; k++ {
+			if _, err := nd.Send(ctx, to, simBody(i, k)); err != nil {
+				return fmt.Errorf("node %d send %d: %w", i, k, err)
+			}
+		}
+	}
+	for i := range s.nw.Nodes {
+		if err := s.nw.WaitFor(ctx, i, s.messages); err != nil {
+			return err
+		}
+		if err := s.checkOrder(i, s.nw.Received(i), 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rooms: every node publishes to one room and must see everyone else's
+// messages.
+func (s *simulation) rooms(ctx context.Context) error {
+	pubs, err := s.nw.JoinRoom("sim")
+	if err != nil {
+		return err
+	}
+	// Let gossipsub build its mesh before publishing.
+	select {
+	case <-time.After(time.Second):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for k := 0; k < s.messages; k++ {
+		for i, pub := range pubs {
+			if err := pub(simBody(i, k)); err != nil {
+				return fmt.Errorf("node %d publish %d: %w", i, k, err)
+			}
+		}
+		// Paced like people typing; a burst overflows gossipsub's
+		// per-peer queues, which then drop messages.
+		time.Sleep(10 * time.Millisecond)
+	}
+	others := len(s.nw.Nodes) - 1
+	reordered := 0
+	for i := range s.nw.Nodes {
+		if err := s.nw.WaitFor(ctx, i, others*s.messages); err != nil {
+			return err
+		}
+		// Gossip takes different paths, so rooms only promise delivery:
+		// count late arrivals, then check completeness in sequence order.
+		got := s.nw.Received(i)
+		latest := make(map[string]int)
+		for _, r := range got {
+			sender, seq, _ := parseSimBody(r.Message.Body)
+			key := simBody(sender, 0)
+			if last, ok := latest[key]; ok && seq < last {
+				reordered++
+				continue
+			}
+			latest[key] = seq
+		}
+		sort.SliceStable(got, func(a, b int) bool {
+			sa, qa, _ := parseSimBody(got[a].Message.Body)
+			sb, qb, _ := parseSimBody(got[b].Message.Body)
+			return sa < sb || sa == sb && qa < qb
+		})
+		if err := s.checkOrder(i, got, others); err != nil {
+			return err
+		}
+	}
+	if reordered > 0 {
+		fmt.Printf("     rooms: %d messages arrived after a later one from the same sender\n", reordered)
+	}
+	return nil
+}
+
+// mailbox: node 1 goes offline, node 0 finds it unreachable and deposits
+// at a mailbox on the last node; node 1 comes back and collects.
+func (s *simulation) mailbox(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "peep-sim-mailbox")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	mb, err := node.OpenMailbox(dir, node.MailboxLimits{})
+	if err != nil {
+		return err
+	}
+	box := s.nw.Nodes[len(s.nw.Nodes)-1]
+	mb.Serve(box.Host())
+	return s.offline(ctx, func(sender *node.Node, to string, body string) error {
+		_, err := sender.Deposit(ctx, box.ID(), to, body)
+		return err
+	}, func(recipient *node.Node) ([]node.Fetched, error) {
+		return recipient.FetchMailbox(ctx, box.ID())
+	})
+}
+
+// dht: like mailbox, but the sender finds the mailbox through the
+// recipient's DHT inbox pointer.
+func (s *simulation) dht(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "peep-sim-inbox")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	mb, err := node.OpenMailbox(dir, node.MailboxLimits{})
+	if err != nil {
+		return err
+	}
+	box := s.nw.Nodes[len(s.nw.Nodes)-1]
+	mb.Serve(box.Host())
+	addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: box.ID(), Addrs: box.Host().Addrs()})
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("mailbox address: %v", err)
+	}
+	// Routing tables fill in once identify has run between the nodes.
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if s.nw.Nodes[0].DHT().RoutingTable().Size() > 0 && s.nw.Nodes[1].DHT().RoutingTable().Size() > 0 {
+			break
+		}
+	}
+	if _, err := s.nw.Nodes[1].PublishInbox(ctx, []string{addrs[0].String()}); err != nil {
+		return fmt.Errorf("publish inbox pointer: %w", err)
+	}
+	return s.offline(ctx, func(sender *node.Node, to string, body string) error {
+		_, err := sender.StoreOffline(ctx, to, body)
+		return err
+	}, func(recipient *node.Node) ([]node.Fetched, error) {
+		return recipient.FetchOffline(ctx, recipient.ID().String())
+	})
+}
+
+func (s *simulation) offline(ctx context.Context, store func(*node.Node, string, string) error, fetch func(*node.Node) ([]node.Fetched, error)) error {
+	sender, recipient := s.nw.Nodes[0], s.nw.Nodes[1]
+	if err := s.nw.Offline(1); err != nil {
+		return err
+	}
+	if _, err := sender.Send(ctx, recipient.ID().String(), "are you there?"); err == nil {
+		return errors.New("direct send to an offline node succeeded")
+	}
+	for k := 0; k < s.messages; k++ {
+		if err := store(sender, recipient.ID().String(), simBody(0, k)); err != nil {
+			return fmt.Errorf("store %d: %w", k, err)
+		}
+	}
+	if err := s.nw.Online(1); err != nil {
+		return err
+	}
+	msgs, err := fetch(recipient)
+	if err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+	got := make([]sim.Received, len(msgs))
+	for i, m := range msgs {
+		if m.Verification != node.Verified {
+			return fmt.Errorf("stored message %d is %s", i, m.Verification)
+		}
+		// Stored messages carry only the claimed sender, signed.
+		from, _ := peer.Decode(m.From)
+		got[i] = sim.Received{From: from, Message: m.Message}
+	}
+	if len(got) != s.messages {
+		return fmt.Errorf("node 1 fetched %d of %d messages", len(got), s.messages)
+	}
+	return s.checkOrder(1, got, 1)
+}
+
+// checkOrder verifies node i got exactly s.messages from each of senders
+// senders, each sender's in sequence, with From matching the sender.
+func (s *simulation) checkOrder(i int, got []sim.Received, senders int) error {
+	next := make(map[int]int)
+	for _, r := range got {
+		sender, seq, ok := parseSimBody(r.Message.Body)
+		if !ok || sender >= len(s.nw.Nodes) {
+			return fmt.Errorf("node %d: unexpected message %q", i, r.Message.Body)
+		}
+		if want := s.nw.Nodes[sender].ID(); r.From != want {
+			return fmt.Errorf("node %d: message %q from %s, expected %s", i, r.Message.Body, r.From, want)
+		}
+		if seq != next[sender] {
+			return fmt.Errorf("node %d: from node %d got message %d, expected %d (out of order or lost)", i, sender, seq, next[sender])
+		}
+		next[sender]++
+	}
+	if len(next) != senders {
+		return fmt.Errorf("node %d: heard from %d senders, expected %d", i, len(next), senders)
+	}
+	for sender, count := range next {
+		if count != s.messages {
+			return fmt.Errorf("node %d: %d of %d messages from node %d", i, count, s.messages, sender)
+		}
+	}
+	return nil
+}
+
+func simBody(sender, seq int) string { return fmt.Sprintf("%d:%d", sender, seq) }
+
+func parseSimBody(body string) (sender, seq int, ok bool) {
+	a, b, found := strings.Cut(body, ":")
+	if !found {
+		return 0, 0, false
+	}
+	sender, err1 := strconv.Atoi(a)
+	seq, err2 := strconv.Atoi(b)
+	return sender, seq, err1 == nil && err2 == nil
+}
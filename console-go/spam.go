@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+// spamRulesFile holds the spam filter's rules, one per line; the first
+// that matches a message decides what happens to it:
+//
+//	quarantine stranger
+//	drop keyword free crypto
+//	drop regex (?i)click\s+here
+//	quarantine rate 10/1m
+//	pow 20 stranger
+//
+// Actions: drop discards the message, quarantine puts it in the spam
+// folder, and pow <bits> lets it through only with that much proof of work
+// (otherwise it's quarantined). Conditions: stranger (the sender isn't a
+// contact), keyword <text> (case-insensitive), regex <expression> (on the
+// body) and rate <n>/<duration> (more than n messages from one sender
+// within the duration). Lines starting with # are comments.
+const spamRulesFile = "p2pchat_spam.conf"
+
+// spamFile is the spam folder: quarantined messages, oldest first.
+const spamFile = "p2pchat_spam.json"
+
+// maxQuarantined caps the spam folder; older messages are dropped.
+const maxQuarantined = 500
+
+// powAskTTL is how long we remember how much proof of work a peer asks.
+const powAskTTL = time.Hour
+
+type spamRule struct {
+	action string // drop, quarantine or pow
+	bits   int    // pow
+	cond   string // stranger, keyword, regex or rate
+	arg    string
+	re     *regexp.Regexp
+	count  int // rate
+	per    time.Duration
+}
+
+func parseSpamRule(line string) (spamRule, error) {
+	var r spamRule
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return r, errors.New("expected '<action> <condition>'")
+	}
+	r.action, fields = fields[0], fields[1:]
+	switch r.action {
+	case "drop", "quarantine":
+	case "pow":
+		bits, err := strconv.Atoi(fields[0])
+		if err != nil || bits < 1 || bits > node.MaxPoWBits || len(fields) < 2 {
+			return r, fmt.Errorf("expected 'pow <bits> <condition>', bits 1 to %d", node.MaxPoWBits)
+		}
+		r.bits, fields = bits, fields[1:]
+	default:
+		return r, fmt.Errorf("unknown action %q (drop, quarantine or pow)", r.action)
+	}
+	r.cond, r.arg = fields[0], strings.Join(fields[1:], " ")
+	switch r.cond {
+	case "stranger":
+		if r.arg != "" {
+			return r, errors.New("stranger takes no argument")
+		}
+	case "keyword":
+		if r.arg == "" {
+			return r, errors.New("expected 'keyword <text>'")
+		}
+	case "regex":
+		re, err := regexp.Compile(r.arg)
+		if err != nil {
+			return r, err
+		}
+		r.re = re
+	case "rate":
+		n, per, ok := strings.Cut(r.arg, "/")
+		count, err := strconv.Atoi(n)
+		d, derr := time.ParseDuration(per)
+		if !ok || err != nil || derr != nil || count < 1 || d <= 0 {
+			return r, errors.New("expected 'rate <n>/<duration>', e.g. rate 10/1m")
+		}
+		r.count, r.per = count, d
+	default:
+		return r, fmt.Errorf("unknown condition %q (stranger, keyword, regex or rate)", r.cond)
+	}
+	return r, nil
+}
+
+func (r spamRule) String() string {
+	s := r.action
+	if r.action == "pow" {
+		s += " " + strconv.Itoa(r.bits)
+	}
+	return strings.TrimSpace(s + " " + r.cond + " " + r.arg)
+}
+
+// quarantined is a message in the spam folder.
+type quarantined struct {
+	Peer    string  `json:"peer"`
+	Rule    string  `json:"rule"`
+	At      int64   `json:"at"` // unix ms
+	Message Message `json:"message"`
+}
+
+type powAsk struct {
+	bits int
+	at   time.Time
+}
+
+// spamFilter applies the rules in spamRulesFile to incoming messages and
+// keeps the spam folder. It also remembers how much proof of work other
+// peers ask of our messages.
+type spamFilter struct {
+	mu        sync.Mutex
+	rulesPath string
+	path      string
+	rules     []spamRule
+	recent    map[string][]time.Time // arrivals per sender, for rate rules
+	folder    []quarantined
+	asked     map[string]powAsk
+}
+
+func loadSpamFilter(rulesPath, path string) (*spamFilter, error) {
+	f := &spamFilter{rulesPath: rulesPath, path: path, recent: make(map[string][]time.Time), asked: make(map[string]powAsk)}
+	if err := f.loadRules(); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.folder); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+func (f *spamFilter) loadRules() error {
+	file, err := os.Open(f.rulesPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sc := bufio.NewScanner(file)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseSpamRule(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", f.rulesPath, n, err)
+		}
+		f.rules = append(f.rules, r)
+	}
+	return sc.Err()
+}
+
+// saveRules rewrites the rules file; callers hold f.mu.
+func (f *spamFilter) saveRules() error {
+	var b strings.Builder
+	b.WriteString("# peep-chat spam rules, first match wins; managed with the spam command\n")
+	for _, r := range f.rules {
+		b.WriteString(r.String() + "\n")
+	}
+	return os.WriteFile(f.rulesPath, []byte(b.String()), 0600)
+}
+
+func (f *spamFilter) addRule(line string) error {
+	r, err := parseSpamRule(line)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, r)
+	return f.saveRules()
+}
+
+// removeRule removes the i'th rule, counting from 1.
+func (f *spamFilter) removeRule(i int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i < 1 || i > len(f.rules) {
+		return fmt.Errorf("no rule %d", i)
+	}
+	f.rules = append(f.rules[:i-1], f.rules[i:]...)
+	return f.saveRules()
+}
+
+func (f *spamFilter) ruleLines() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lines := make([]string, len(f.rules))
+	for i, r := range f.rules {
+		lines[i] = r.String()
+	}
+	return lines
+}
+
+// powBits is the most proof of work our rules ask for, which our profile
+// announces.
+func (f *spamFilter) powBits() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bits := 0
+	for _, r := range f.rules {
+		if r.action == "pow" {
+			bits = max(bits, r.bits)
+		}
+	}
+	return bits
+}
+
+// judge returns the action the first matching rule takes on m from peerID
+// ("" lets it through) and that rule. stamped is the proof of work m
+// carries for us; live is false for messages that couldn't have been
+// stamped (room posts and stored messages), which pow rules skip.
+func (f *spamFilter) judge(peerID string, m Message, contact, live bool, stamped int) (string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.rules) == 0 {
+		return "", ""
+	}
+	now := time.Now()
+	var window time.Duration
+	for _, r := range f.rules {
+		window = max(window, r.per)
+	}
+	if window > 0 {
+		recent := f.recent[peerID]
+		for len(recent) > 0 && now.Sub(recent[0]) > window {
+			recent = recent[1:]
+		}
+		f.recent[peerID] = append(recent, now)
+	}
+	body := strings.ToLower(m.Body)
+	for _, r := range f.rules {
+		var match bool
+		switch r.cond {
+		case "stranger":
+			match = !contact
+		case "keyword":
+			match = strings.Contains(body, strings.ToLower(r.arg))
+		case "regex":
+			match = r.re.MatchString(m.Body)
+		case "rate":
+			n := 0
+			for _, t := range f.recent[peerID] {
+				if now.Sub(t) <= r.per {
+					n++
+				}
+			}
+			match = n > r.count
+		}
+		if !match || (r.action == "pow" && !live) {
+			continue
+		}
+		if r.action == "pow" {
+			if stamped >= r.bits {
+				return "", ""
+			}
+			return "quarantine", r.String()
+		}
+		return r.action, r.String()
+	}
+	return "", ""
+}
+
+// quarantine puts m in the spam folder.
+func (f *spamFilter) quarantine(peerID, rule string, m Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.folder = append(f.folder, quarantined{Peer: peerID, Rule: rule, At: time.Now().UnixMilli(), Message: m})
+	if len(f.folder) > maxQuarantined {
+		f.folder = f.folder[len(f.folder)-maxQuarantined:]
+	}
+	f.save()
+}
+
+func (f *spamFilter) list() []quarantined {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]quarantined{}, f.folder...)
+}
+
+// take removes the i'th message of the spam folder, counting from 1, or
+// all of them for 0.
+func (f *spamFilter) take(i int) ([]quarantined, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i == 0 {
+		out := f.folder
+		f.folder = nil
+		f.save()
+		return out, nil
+	}
+	if i < 1 || i > len(f.folder) {
+		return nil, fmt.Errorf("no message %d in the spam folder", i)
+	}
+	q := f.folder[i-1]
+	f.folder = append(f.folder[:i-1], f.folder[i:]...)
+	f.save()
+	return []quarantined{q}, nil
+}
+
+// save writes the spam folder; callers hold f.mu.
+func (f *spamFilter) save() {
+	data, err := json.MarshalIndent(f.folder, "", "  ")
+	if err == nil {
+		err = os.WriteFile(f.path, data, 0600)
+	}
+	if err != nil {
+		logger.Warnf("saving spam folder: %s", err)
+	}
+}
+
+// learnedPoW records how much proof of work p's profile asks for.
+func (f *spamFilter) learnedPoW(p string, bits int) {
+	f.mu.Lock()
+	f.asked[p] = powAsk{bits: bits, at: time.Now()}
+	f.mu.Unlock()
+}
+
+// filterSpam runs m through the spam rules and reports whether it was
+// dropped or quarantined.
+func (a *app) filterSpam(peerID string, m Message, live bool) bool {
+	stamped := 0
+	if live {
+		stamped = node.StampBits(m, a.h.ID().String())
+	}
+	action, rule := a.spam.judge(peerID, m, a.contacts.nameOf(peerID) != "", live, stamped)
+	switch action {
+	case "drop":
+		logger.Debugf("dropped message from %s: %s", peerID, rule)
+	case "quarantine":
+		logger.Debugf("quarantined message from %s: %s", peerID, rule)
+		a.spam.quarantine(peerID, rule, m)
+	default:
+		return false
+	}
+	if p, err := peer.Decode(peerID); err == nil {
+		a.node.Report(p, node.OffenseSpam, rule)
+	}
+	return true
+}
+
+// screenFetched leaves out the stored messages the spam rules catch.
+// Invalid ones don't count against their claimed sender.
+func (a *app) screenFetched(msgs []node.Fetched) []node.Fetched {
+	var out []node.Fetched
+	for _, m := range msgs {
+		if m.Verification == node.Invalid || !a.filterSpam(m.From, m.Message, false) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// powFor is how many bits of proof of work p asks of our messages, from
+// its profile, fetched if we haven't lately.
+func (a *app) powFor(ctx context.Context, p peer.ID) int {
+	a.spam.mu.Lock()
+	ask, ok := a.spam.asked[p.String()]
+	a.spam.mu.Unlock()
+	if ok && time.Since(ask.at) < powAskTTL {
+		return ask.bits
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	prof, err := a.node.FetchProfile(ctx, p)
+	if err != nil {
+		logger.Debugf("profile of %s: %s", p, err)
+	}
+	a.spam.learnedPoW(p.String(), prof.PoW)
+	return prof.PoW
+}
+
+// profile is what we tell peers about ourselves.
+func (a *app) profile() node.Profile {
+	prof := a.mailbox.profile()
+	prof.PoW = a.spam.powBits()
+	return prof
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "spam",
+		Usage:   "[release <n>|all | delete <n>|all | rules | rule <rule> | rule -d <n>]",
+		Summary: "list the spam folder, release or delete its messages, or show, add (saved to the config dir) and remove spam rules",
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) == 0 {
+				folder := a.spam.list()
+				if jsonOutput {
+					printJSON(map[string]any{"spam": folder})
+					return nil
+				}
+				if len(folder) == 0 {
+					fmt.Println("the spam folder is empty")
+				}
+				for i, q := range folder {
+					fmt.Printf("%d) from=%s at=%s (%s)\n   %s\n", i+1, a.conversationLabel(q.Peer),
+						time.UnixMilli(q.Message.When).Format(time.RFC3339), q.Rule, q.Message.Body)
+				}
+				return nil
+			}
+			switch sub := inv.Args[0]; sub {
+			case "release", "delete":
+				if len(inv.Args) != 2 {
+					return fmt.Errorf("usage: spam %s <n>|all", sub)
+				}
+				i := 0
+				if inv.Args[1] != "all" {
+					var err error
+					if i, err = strconv.Atoi(inv.Args[1]); err != nil || i < 1 {
+						return fmt.Errorf("not a message number: %s", inv.Args[1])
+					}
+				}
+				taken, err := a.spam.take(i)
+				if err != nil {
+					return err
+				}
+				if sub == "release" {
+					for _, q := range taken {
+						a.messageAccepted(q.Peer, q.Message)
+					}
+				}
+				done := map[string]string{"release": "released", "delete": "deleted"}[sub]
+				printResult(map[string]int{done: len(taken)}, fmt.Sprintf("%s %d messages", done, len(taken)))
+				return nil
+			case "rules":
+				lines := a.spam.ruleLines()
+				if jsonOutput {
+					printJSON(map[string]any{"rules": lines})
+					return nil
+				}
+				if len(lines) == 0 {
+					fmt.Println("no spam rules")
+				}
+				for i, l := range lines {
+					fmt.Printf("%d) %s\n", i+1, l)
+				}
+				return nil
+			case "rule":
+				var err error
+				if len(inv.Args) == 3 && inv.Args[1] == "-d" {
+					i, aerr := strconv.Atoi(inv.Args[2])
+					if aerr != nil {
+						return fmt.Errorf("not a rule number: %s", inv.Args[2])
+					}
+					err = a.spam.removeRule(i)
+				} else {
+					err = a.spam.addRule(strings.TrimSpace(strings.TrimPrefix(inv.text, "rule")))
+				}
+				if err != nil {
+					return err
+				}
+				a.node.SetProfile(a.profile())
+				return nil
+			}
+			return fmt.Errorf("unknown spam subcommand %q", inv.Args[0])
+		},
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/libp2p/go-libp2p/core/metrics"
+
+	"p2p-chat/node"
+)
+
+// formatBytes renders n with a binary unit, e.g. 1.5 MiB.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+func formatStats(s metrics.Stats) string {
+	return fmt.Sprintf("in %s (%s/s)  out %s (%s/s)",
+		formatBytes(float64(s.TotalIn)), formatBytes(s.RateIn),
+		formatBytes(float64(s.TotalOut)), formatBytes(s.RateOut))
+}
+
+// printStatsTable prints rows sorted by total traffic, busiest first.
+func printStatsTable(title string, rows map[string]metrics.Stats, label func(string) string) {
+	if len(rows) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := rows[keys[i]], rows[keys[j]]
+		return a.TotalIn+a.TotalOut > b.TotalIn+b.TotalOut
+	})
+	fmt.Println(title + ":")
+	for _, k := range keys {
+		fmt.Printf("  %-28s %s\n", label(k), formatStats(rows[k]))
+	}
+}
+
+// printPacing shows the send pacing limits and the queues behind them.
+func printPacing(s node.PacingStats, label func(string) string) {
+	rate := func(r float64, unit string) string {
+		if r <= 0 {
+			return "unlimited"
+		}
+		return strconv.FormatFloat(r, 'g', -1, 64) + " " + unit + "/s"
+	}
+	fmt.Printf("pacing: %s per peer, %s overall, %s (burst %d)\n",
+		rate(s.Limits.PerPeer, "msg"), rate(s.Limits.Global, "msg"), rate(s.Limits.DHT, "DHT write"), s.Limits.Burst)
+	fmt.Printf("  waiting: %d messages, %d DHT writes\n", s.Messages, s.DHT)
+	keys := make([]string, 0, len(s.ByPeer))
+	for k := range s.ByPeer {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return s.ByPeer[keys[i]] > s.ByPeer[keys[j]] })
+	for _, k := range keys {
+		fmt.Printf("  %-28s %d waiting\n", label(k), s.ByPeer[k])
+	}
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "stats",
+		Summary: "show bandwidth totals and rates, per peer and per protocol, what's waiting on send pacing and what's still sending",
+		Run: func(a *app, inv *invocation) error {
+			bw := a.node.Bandwidth()
+			fmt.Println("total:", formatStats(bw.GetBandwidthTotals()))
+			byPeer := make(map[string]metrics.Stats)
+			for p, s := range bw.GetBandwidthByPeer() {
+				byPeer[p.String()] = s
+			}
+			printStatsTable("by peer", byPeer, shortID)
+			byProto := make(map[string]metrics.Stats)
+			for p, s := range bw.GetBandwidthByProtocol() {
+				byProto[string(p)] = s
+			}
+			printStatsTable("by protocol", byProto, func(s string) string {
+				if s == "" {
+					return "(negotiation)" // bytes before a protocol is agreed
+				}
+				return s
+			})
+			printPacing(a.node.PacingStats(), a.conversationLabel)
+			printSending(a.node.Sending(), a.conversationLabel)
+			fmt.Printf("chat streams kept open: %d\n", a.node.ChatStreams())
+			return nil
+		},
+	})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	"p2p-chat/node"
+)
+
+// stickersFile records the sticker packs we can send from, by name, and
+// which received packs are fully fetched.
+const stickersFile = "p2pchat_stickers.json"
+
+// stickerExts are the image files 'sticker import' takes.
+var stickerExts = map[string]bool{".png": true, ".gif": true, ".jpg": true, ".jpeg": true, ".webp": true}
+
+// stickerIndex is the stickersFile contents.
+type stickerIndex struct {
+	mu     sync.Mutex
+	path   string
+	Packs  map[string]string `json:"packs"`  // pack name -> CID
+	Cached map[string]bool   `json:"cached"` // pack CIDs whose stickers are all stored
+}
+
+func loadStickers(path string) (*stickerIndex, error) {
+	x := &stickerIndex{path: path, Packs: make(map[string]string), Cached: make(map[string]bool)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return x, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, x); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return x, nil
+}
+
+// save writes the index; callers hold x.mu.
+func (x *stickerIndex) save() {
+	data, err := json.MarshalIndent(x, "", "  ")
+	if err == nil {
+		err = os.WriteFile(x.path, data, 0600)
+	}
+	if err != nil {
+		logger.Warnf("saving sticker packs: %s", err)
+	}
+}
+
+// add records a stored pack. A received pack is named only if we have no
+// pack of that name already.
+func (x *stickerIndex) add(name string, c cid.Cid, replace bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, taken := x.Packs[name]; replace || !taken {
+		x.Packs[name] = c.String()
+	}
+	x.Cached[c.String()] = true
+	x.save()
+}
+
+func (x *stickerIndex) lookup(name string) (cid.Cid, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	c, err := cid.Decode(x.Packs[name])
+	return c, err == nil
+}
+
+func (x *stickerIndex) cached(c cid.Cid) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.Cached[c.String()]
+}
+
+func (x *stickerIndex) names() map[string]string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	out := make(map[string]string, len(x.Packs))
+	for k, v := range x.Packs {
+		out[k] = v
+	}
+	return out
+}
+
+// importStickers makes a pack of the image files in dir.
+func (a *app) importStickers(dir, name string) (node.StickerPack, cid.Cid, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return node.StickerPack{}, cid.Undef, err
+	}
+	pack := node.StickerPack{Name: name, Stickers: make(map[string]node.FileRef)}
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || !stickerExts[ext] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return pack, cid.Undef, err
+		}
+		if info.Size() > node.MaxStickerSize {
+			return pack, cid.Undef, fmt.Errorf("%s is over the %d KiB sticker limit", e.Name(), node.MaxStickerSize>>10)
+		}
+		ref, err := a.attachFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return pack, cid.Undef, err
+		}
+		pack.Stickers[strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))] = ref
+	}
+	c, err := a.blocks.PutStickerPack(pack)
+	if err != nil {
+		return pack, cid.Undef, err
+	}
+	a.stickers.add(name, c, true)
+	return pack, c, nil
+}
+
+// stickerPack returns pack c, fetching it and all its stickers from from
+// and any connected peer that has them the first time.
+func (a *app) stickerPack(c cid.Cid, from string) (node.StickerPack, error) {
+	if a.stickers.cached(c) {
+		return a.blocks.StickerPack(c)
+	}
+	peers := a.blockPeers(from)
+	if len(peers) == 0 {
+		return node.StickerPack{}, fmt.Errorf("don't have sticker pack %s and nobody to ask for it", c)
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, 2*time.Minute)
+	defer cancel()
+	pack, err := a.node.FetchStickerPack(ctx, peers, c)
+	if err != nil {
+		return pack, err
+	}
+	a.stickers.add(pack.Name, c, false)
+	return pack, nil
+}
+
+// parseStickerName splits "<pack>/<name>".
+func parseStickerName(s string) (pack, name string, err error) {
+	pack, name, ok := strings.Cut(s, "/")
+	if !ok || pack == "" || name == "" {
+		return "", "", fmt.Errorf("expected <pack>/<name>, got %q", s)
+	}
+	return pack, name, nil
+}
+
+// stickerReceived caches the pack of a received sticker and, if the
+// terminal can show images and m is on screen, draws it.
+func (a *app) stickerReceived(key string, m Message) {
+	if m.Sticker == nil {
+		return
+	}
+	c, err := cid.Decode(m.Sticker.Pack)
+	if err != nil {
+		return
+	}
+	show := !jsonOutput && !a.convs.background(key) && inlineImages() != ""
+	go func() {
+		pack, err := a.stickerPack(c, m.From)
+		if err != nil {
+			logger.Warnf("fetching sticker pack %s: %s", c, err)
+			return
+		}
+		if show {
+			a.drawSticker(pack, m.Sticker.Name)
+		}
+	}()
+}
+
+// drawSticker shows a sticker of a stored pack inline.
+func (a *app) drawSticker(pack node.StickerPack, name string) error {
+	ref, ok := pack.Stickers[name]
+	if !ok {
+		return fmt.Errorf("pack %s has no sticker %s", pack.Name, name)
+	}
+	c, err := cid.Decode(ref.CID)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := a.blocks.WriteFile(c, &buf); err != nil {
+		return err
+	}
+	img := inlineImage(buf.Bytes(), strings.EqualFold(filepath.Ext(ref.Name), ".png"))
+	if img == "" {
+		return errors.New("this terminal can't show the sticker")
+	}
+	fmt.Printf("\n%s\n%s", img, a.prompt())
+	return nil
+}
+
+// inlineImages is the inline image protocol the terminal speaks: "iterm"
+// (iTerm2, WezTerm), "kitty", or "" if it can't show images or output
+// isn't styled.
+func inlineImages() string {
+	if !styles.on {
+		return ""
+	}
+	switch {
+	case os.Getenv("TERM_PROGRAM") == "iTerm.app" || os.Getenv("TERM_PROGRAM") == "WezTerm":
+		return "iterm"
+	case os.Getenv("TERM") == "xterm-kitty" || os.Getenv("KITTY_WINDOW_ID") != "":
+		return "kitty"
+	}
+	return ""
+}
+
+// inlineImage is the escape sequence drawing data a few lines high, or ""
+// if the terminal can't. kitty only takes PNG this way.
+func inlineImage(data []byte, png bool) string {
+	enc := base64.StdEncoding.EncodeToString(data)
+	switch inlineImages() {
+	case "iterm":
+		return "\x1b]1337;File=inline=1;height=6;size=" + strconv.Itoa(len(data)) + ":" + enc + "\a"
+	case "kitty":
+		if !png {
+			return ""
+		}
+		var b strings.Builder
+		for i := 0; i < len(enc); i += 4096 {
+			more := 0
+			if i+4096 < len(enc) {
+				more = 1
+			}
+			if i == 0 {
+				fmt.Fprintf(&b, "\x1b_Ga=T,f=100,r=6,m=%d;", more)
+			} else {
+				fmt.Fprintf(&b, "\x1b_Gm=%d;", more)
+			}
+			b.WriteString(enc[i:min(i+4096, len(enc))] + "\x1b\\")
+		}
+		return b.String()
+	}
+	return ""
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:       "sticker",
+		Usage:      "send <pack>/<name> [<peerID|contact|#room>] | show <pack>/<name> | import <dir> <pack> | packs | list <pack>",
+		Summary:    "send stickers from content-addressed packs receivers fetch once; import a directory of images as a pack",
+		MinArgs:    1,
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			switch inv.Args[0] {
+			case "import":
+				if len(inv.Args) != 3 {
+					return errors.New("usage: sticker import <dir> <pack>")
+				}
+				pack, c, err := a.importStickers(inv.Args[1], inv.Args[2])
+				if err != nil {
+					return err
+				}
+				printResult(map[string]any{"pack": pack.Name, "cid": c.String(), "stickers": len(pack.Stickers)},
+					fmt.Sprintf("imported %d stickers as pack %s (%s)", len(pack.Stickers), pack.Name, c))
+				return nil
+			case "packs":
+				packs := a.stickers.names()
+				if jsonOutput {
+					printJSON(map[string]any{"packs": packs})
+					return nil
+				}
+				if len(packs) == 0 {
+					fmt.Println("no sticker packs ('sticker import <dir> <pack>' makes one)")
+				}
+				names := make([]string, 0, len(packs))
+				for n := range packs {
+					names = append(names, n)
+				}
+				sort.Strings(names)
+				for _, n := range names {
+					fmt.Printf(" - %s (%s)\n", n, packs[n])
+				}
+				return nil
+			case "list":
+				if len(inv.Args) != 2 {
+					return errors.New("usage: sticker list <pack>")
+				}
+				c, ok := a.stickers.lookup(inv.Args[1])
+				if !ok {
+					return fmt.Errorf("no sticker pack %s", inv.Args[1])
+				}
+				pack, err := a.blocks.StickerPack(c)
+				if err != nil {
+					return err
+				}
+				names := make([]string, 0, len(pack.Stickers))
+				for n := range pack.Stickers {
+					names = append(names, n)
+				}
+				sort.Strings(names)
+				if jsonOutput {
+					printJSON(map[string]any{"pack": pack.Name, "stickers": names})
+					return nil
+				}
+				for _, n := range names {
+					fmt.Printf(" - %s/%s\n", pack.Name, n)
+				}
+				return nil
+			case "show", "send":
+				if len(inv.Args) < 2 {
+					return fmt.Errorf("usage: sticker %s <pack>/<name>", inv.Args[0])
+				}
+				packName, name, err := parseStickerName(inv.Args[1])
+				if err != nil {
+					return err
+				}
+				c, ok := a.stickers.lookup(packName)
+				if !ok {
+					return fmt.Errorf("no sticker pack %s", packName)
+				}
+				pack, err := a.blocks.StickerPack(c)
+				if err != nil {
+					return err
+				}
+				if _, ok := pack.Stickers[name]; !ok {
+					return fmt.Errorf("pack %s has no sticker %s", packName, name)
+				}
+				if inv.Args[0] == "show" {
+					return a.drawSticker(pack, name)
+				}
+				to, _ := a.convs.active()
+				if len(inv.Args) > 2 {
+					to = inv.Args[2]
+				}
+				if to == "" {
+					return errors.New("name a peer or #room, or open a conversation first")
+				}
+				s := node.Sticker{Pack: c.String(), Name: name}
+				body := "[sticker " + packName + "/" + name + "]"
+				var (
+					m      Message
+					target string // empty for a room
+				)
+				if room, ok := strings.CutPrefix(to, "#"); ok {
+					m, err = a.rooms.post(inv.Context(), room, Message{Body: body, Sticker: &s})
+				} else {
+					target = a.contacts.peerID(to)
+					if err = a.e2eReady(target); err == nil {
+						ctx, cancel := context.WithTimeout(inv.Context(), 30*time.Second)
+						m, err = a.node.SendSticker(ctx, target, body, s)
+						cancel()
+					}
+				}
+				if err != nil {
+					return err
+				}
+				a.messageSent(target, m)
+				printResult(map[string]any{"sent": to, "sticker": s}, "sent "+packName+"/"+name)
+				return nil
+			}
+			return fmt.Errorf("unknown sticker subcommand %q", inv.Args[0])
+		},
+	})
+}
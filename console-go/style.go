@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+)
+
+// theme is a set of ANSI SGR codes for the console output.
+type theme struct {
+	peers     []string // one is picked per peer by hashing its ID
+	dim       string   // timestamps and other secondary text
+	room      string
+	mention   string // messages that mention you
+	system    string // status lines such as "went offline"
+	errorText string
+}
+
+var themes = map[string]theme{
+	"dark": {
+		peers:     []string{"31", "32", "33", "34", "35", "36", "91", "92", "93", "94", "95", "96"},
+		dim:       "2",
+		room:      "1;36",
+		mention:   "1;93;41",
+		system:    "2;3",
+		errorText: "1;31",
+	},
+	"light": {
+		peers:     []string{"31", "32", "34", "35", "36", "33"},
+		dim:       "2",
+		room:      "1;34",
+		mention:   "1;97;41",
+		system:    "2;3",
+		errorText: "1;31",
+	},
+	// mono keeps emphasis but no colours, for terminals where colours clash.
+	"mono": {
+		peers:     []string{"1"},
+		dim:       "2",
+		room:      "1",
+		mention:   "7",
+		system:    "2",
+		errorText: "1",
+	},
+}
+
+// styler applies the chosen theme. With colour off (--no-color, NO_COLOR,
+// or stdout not being a terminal) every method returns the text as is.
+type styler struct {
+	on       bool
+	t        theme
+	mentions []string // words that count as mentioning you
+}
+
+// styles is the output styling in effect; setupStyles configures it.
+var styles = &styler{}
+
+// setupStyles picks the theme. self is our peer ID, which always counts as
+// a mention (in full or abbreviated) along with the extra words.
+func setupStyles(name string, noColor bool, self string, words []string) error {
+	t, ok := themes[name]
+	if !ok {
+		names := make([]string, 0, len(themes))
+		for n := range themes {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown theme %q (have %s)", name, strings.Join(names, ", "))
+	}
+	on := !noColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout) && !jsonOutput
+	styles = &styler{on: on, t: t, mentions: append([]string{self, shortID(self)}, words...)}
+	return nil
+}
+
+func (s *styler) paint(code, text string) string {
+	if !s.on || code == "" {
+		return text
+	}
+	return "\x1b[" + code + "m" + text + "\x1b[0m"
+}
+
+// peer colours a peer ID (or name) by a hash of id, so each peer keeps
+// its colour.
+func (s *styler) peer(id, text string) string {
+	if !s.on {
+		return text
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return s.paint(s.t.peers[h.Sum32()%uint32(len(s.t.peers))], text)
+}
+
+func (s *styler) dim(text string) string    { return s.paint(s.t.dim, text) }
+func (s *styler) room(text string) string   { return s.paint(s.t.room, text) }
+func (s *styler) system(text string) string { return s.paint(s.t.system, text) }
+func (s *styler) err(text string) string    { return s.paint(s.t.errorText, text) }
+
+// highlight paints text the way a mention is.
+func (s *styler) highlight(text string) string { return s.paint(s.t.mention, text) }
+
+// body highlights a message body that mentions you.
+func (s *styler) body(text string) string {
+	if !s.on {
+		return text
+	}
+	if s.mentioned(text) {
+		return s.paint(s.t.mention, text)
+	}
+	return text
+}
+
+// mentioned reports whether text mentions you.
+func (s *styler) mentioned(text string) bool {
+	lower := strings.ToLower(text)
+	for _, w := range s.mentions {
+		if w != "" && strings.Contains(lower, strings.ToLower(w)) {
+			return true
+		}
+	}
+	return false
+}
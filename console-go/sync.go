@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+// Room history is reconciled with room members this often, and shortly
+// after startup.
+const (
+	historySyncInterval = 5 * time.Minute
+	historySyncWait     = 20 * time.Second
+)
+
+// serveHistory lets room members reconcile with us, for rooms we're in.
+// An encrypted room's history goes only to those on its roster.
+func (a *app) serveHistory() {
+	a.node.ServeHistory(func(p peer.ID, room string) ([]node.HistoryEntry, bool) {
+		if !a.rooms.joined(room) {
+			return nil, false
+		}
+		if r, ok := a.roster(room); ok && !r.Member(p.String()) {
+			return nil, false
+		}
+		return a.history.entries(room), true
+	})
+}
+
+// syncRoom compares history digests with every member of room we're
+// connected to and fetches the messages they have and we don't. It
+// returns how many were added.
+func (a *app) syncRoom(ctx context.Context, room string) (int, error) {
+	var (
+		added int
+		errs  []error
+	)
+	roster, encrypted := a.roster(room)
+	for _, p := range a.rooms.members(room) {
+		if ok, _ := a.h.Peerstore().SupportsProtocols(p, node.SyncProtocolID); len(ok) == 0 {
+			continue
+		}
+		if encrypted && !roster.Member(p.String()) {
+			continue
+		}
+		missing, err := a.node.SyncRoom(ctx, p, room, a.history.entries(room))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		cids := make([]cid.Cid, 0, len(missing))
+		for _, e := range missing {
+			if c, err := cid.Decode(e.CID); err == nil && c.Type() == cid.DagJSON {
+				cids = append(cids, c)
+			}
+		}
+		if err := a.node.FetchBlocks(ctx, a.blockPeers(p.String()), cids); err != nil {
+			errs = append(errs, err)
+		}
+		added += a.addSynced(room, cids, p)
+	}
+	return added, errors.Join(errs...)
+}
+
+// addSynced puts fetched messages into room's history. Blocks that aren't
+// valid messages of that room are left out.
+func (a *app) addSynced(room string, cids []cid.Cid, from peer.ID) int {
+	now := time.Now()
+	x := a.history
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	added := 0
+	for _, c := range cids {
+		if !a.blocks.Has(c) {
+			continue
+		}
+		m, err := a.blocks.GetMessage(c)
+		if err == nil && m.Room != room {
+			err = fmt.Errorf("message of room %q", m.Room)
+		}
+		if err == nil {
+			err = node.ValidateMessage(m, now)
+		}
+		if err != nil {
+			logger.Debugf("history block %s from %s: %s", c, from, err)
+			continue
+		}
+		for _, f := range m.Files {
+			if _, ok := x.Sources[f.CID]; !ok {
+				x.Sources[f.CID] = m.From
+			}
+		}
+		x.add(room, node.HistoryEntry{CID: c.String(), When: m.When})
+		added++
+	}
+	if added > 0 {
+		x.save()
+	}
+	return added
+}
+
+// keepHistorySynced reconciles every joined room with its members in the
+// background, so history converges after time offline.
+func (a *app) keepHistorySynced() {
+	go func() {
+		wait := historySyncWait
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			wait = historySyncInterval
+			a.saveRoomMembers()
+			for _, room := range a.rooms.list() {
+				ctx, cancel := context.WithTimeout(a.ctx, 2*time.Minute)
+				added, err := a.syncRoom(ctx, room)
+				cancel()
+				if err != nil {
+					logger.Debugf("syncing #%s: %s", room, err)
+				}
+				if added > 0 {
+					a.historyRecovered(room, added)
+				}
+			}
+		}
+	}()
+}
+
+// historyRecovered tells the user that missed messages came in.
+func (a *app) historyRecovered(room string, added int) {
+	if jsonOutput {
+		printJSON(map[string]any{"event": "history_synced", "room": room, "added": added})
+		return
+	}
+	fmt.Printf("\n%s\n%s", styles.system(fmt.Sprintf("* %d missed messages in #%s recovered from room members ('history %s' shows them)", added, room, room)), a.prompt())
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:       "sync",
+		Usage:      "[room]",
+		Summary:    "reconcile room history with connected members now (all joined rooms by default)",
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			rooms := a.rooms.list()
+			if len(inv.Args) > 0 {
+				rooms = []string{strings.TrimPrefix(inv.Args[0], "#")}
+			}
+			results := make(map[string]int)
+			for _, room := range rooms {
+				if !a.rooms.joined(room) {
+					return fmt.Errorf("not in room %s (use 'join %s')", room, room)
+				}
+				ctx, cancel := context.WithTimeout(inv.Context(), 2*time.Minute)
+				added, err := a.syncRoom(ctx, room)
+				cancel()
+				if err != nil && added == 0 {
+					fmt.Printf(" - #%s: %s\n", room, err)
+				}
+				results[room] = added
+			}
+			if jsonOutput {
+				printJSON(map[string]any{"added": results})
+				return nil
+			}
+			for _, room := range rooms {
+				fmt.Printf(" - #%s: %d messages added\n", room, results[room])
+			}
+			return nil
+		},
+	})
+}
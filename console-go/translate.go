@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const translateFile = "p2pchat_translate.json"
+
+// translateTimeout bounds one translation; the original is shown first,
+// so a slow backend only delays the translated line.
+const translateTimeout = 30 * time.Second
+
+// Translator turns text into the language lang (a code such as "en" or
+// "pt-BR"). Backends are configured with --translator or --translate-url.
+type Translator interface {
+	Translate(ctx context.Context, text, lang string) (string, error)
+}
+
+// commandTranslator runs a shell command, e.g. a local model, with the
+// text on stdin and PEEP_TRANSLATE_TO set to the language; its output is
+// the translation.
+type commandTranslator struct {
+	cmdline string
+}
+
+func (t commandTranslator) Translate(ctx context.Context, text, lang string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", t.cmdline)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", t.cmdline)
+	}
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Env = append(os.Environ(), "PEEP_TRANSLATE_TO="+lang)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// httpTranslator speaks the LibreTranslate API: POST /translate with the
+// text, target language and optional API key.
+type httpTranslator struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+func (t httpTranslator) Translate(ctx context.Context, text, lang string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"q": text, "source": "auto", "target": lang, "format": "text", "api_key": t.key})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(t.url, "/")+"/translate", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		TranslatedText string `json:"translatedText"`
+		Error          string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&res); err != nil {
+		return "", fmt.Errorf("%s: %w", resp.Status, err)
+	}
+	if res.Error != "" {
+		return "", errors.New(res.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+	return res.TranslatedText, nil
+}
+
+// newTranslator picks the backend from the flags; nil if none is set.
+func newTranslator(command, url, key string) Translator {
+	switch {
+	case command != "":
+		return commandTranslator{cmdline: command}
+	case url != "":
+		return httpTranslator{url: url, key: key, client: &http.Client{Timeout: translateTimeout}}
+	}
+	return nil
+}
+
+// translations is which conversations are translated, and into what,
+// persisted to translateFile in the data directory.
+type translations struct {
+	mu    sync.Mutex
+	path  string
+	langs map[string]string // conversation key -> language
+}
+
+func loadTranslations(path string) (*translations, error) {
+	t := &translations{path: path, langs: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.langs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// set translates conversation key into lang, or stops with lang "".
+func (t *translations) set(key, lang string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if lang == "" {
+		delete(t.langs, key)
+	} else {
+		t.langs[key] = lang
+	}
+	data, err := json.Marshal(t.langs)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(t.path, data, 0600)
+}
+
+func (t *translations) lang(key string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.langs[key]
+}
+
+func (t *translations) list() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]string, len(t.langs))
+	for k, v := range t.langs {
+		out[k] = v
+	}
+	return out
+}
+
+// translateReceived shows a translation of m under it, if conversation
+// key is translated and on screen.
+func (a *app) translateReceived(key string, m Message) {
+	lang := a.translations.lang(key)
+	if lang == "" || a.translator == nil || strings.TrimSpace(m.Body) == "" || (!jsonOutput && a.convs.background(key)) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(a.ctx, translateTimeout)
+		defer cancel()
+		text, err := a.translator.Translate(ctx, m.Body, lang)
+		if err != nil {
+			logger.Warnf("translating a message in %s: %s", a.conversationLabel(key), err)
+			return
+		}
+		switch {
+		case jsonOutput:
+			printJSON(map[string]any{"event": "translation", "conversation": key, "from": m.From, "when": m.When, "lang": lang, "text": text})
+		case screenReader:
+			fmt.Printf("\nTranslated into %s: %s\n%s", lang, text, a.prompt())
+		default:
+			fmt.Printf("\n  %s %s\n%s", styles.dim("["+lang+"]"), text, a.prompt())
+		}
+	}()
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "translate",
+		Usage:   "[on <lang> | off] [<peerID|contact|#room>]",
+		Summary: "show incoming messages of a conversation (the open one by default) translated into lang alongside the original; alone, list translated conversations",
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) == 0 {
+				langs := a.translations.list()
+				if jsonOutput {
+					printJSON(map[string]any{"translate": langs})
+					return nil
+				}
+				if len(langs) == 0 {
+					fmt.Println("no conversations are translated")
+				}
+				keys := make([]string, 0, len(langs))
+				for k := range langs {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					fmt.Printf(" - %s: %s\n", a.conversationLabel(k), langs[k])
+				}
+				return nil
+			}
+			var lang string
+			rest := inv.Args[1:]
+			switch inv.Args[0] {
+			case "on":
+				if len(rest) == 0 {
+					return errors.New("usage: translate on <lang> [<peerID|contact|#room>]")
+				}
+				lang, rest = rest[0], rest[1:]
+			case "off":
+			default:
+				return errors.New("usage: translate [on <lang> | off] [<peerID|contact|#room>]")
+			}
+			key, _ := a.convs.active()
+			if len(rest) > 0 {
+				key = rest[0]
+				if !strings.HasPrefix(key, "#") {
+					key = a.contacts.peerID(key)
+				}
+			}
+			if key == "" {
+				return errors.New("name a conversation or open one first")
+			}
+			if lang != "" && a.translator == nil {
+				return errors.New("no translation backend: start with --translator <command> or --translate-url <url>")
+			}
+			if err := a.translations.set(key, lang); err != nil {
+				return err
+			}
+			if lang == "" {
+				fmt.Println("not translating", a.conversationLabel(key))
+			} else {
+				fmt.Printf("translating %s into %s\n", a.conversationLabel(key), lang)
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// triggersFile holds trigger rules, one per line: the conversation they
+// watch (any, #room, or a peer ID or contact), a regular expression and,
+// after =>, what to do when an incoming message matches it:
+//
+//	any ^!ping$ => reply pong
+//	#ops (?i)alert: (.*) => forward alice $from in $conv: $1
+//	bob backup (done|failed) => run notify-send "backup $1"
+//
+// reply answers in the same conversation and forward sends to another
+// peer or #room (by default "$from in $conv: $body"); both expand $from,
+// $conv, $body and the regexp's groups $0..$9. run runs a shell command
+// with the message as JSON on stdin, like a hook; the command itself isn't
+// expanded, so message text never reaches the shell. Lines starting with #
+// followed by a space are comments.
+const triggersFile = "p2pchat_triggers.conf"
+
+// Each trigger fires at most triggerBurst times per triggerWindow, so two
+// clients that answer each other can't loop for long.
+const (
+	triggerBurst  = 5
+	triggerWindow = time.Minute
+)
+
+// eventTriggerMatched is the hook event type a run trigger's command gets.
+const eventTriggerMatched = "trigger.matched"
+
+type trigger struct {
+	conv   string // any, #room, or a peer ID or contact
+	re     *regexp.Regexp
+	action string // reply, forward or run
+	target string // forward
+	arg    string // template, or command for run
+	fired  []time.Time
+}
+
+func parseTrigger(line string) (*trigger, error) {
+	match, action, ok := strings.Cut(line, " => ")
+	conv, expr, _ := strings.Cut(strings.TrimSpace(match), " ")
+	expr = strings.TrimSpace(expr)
+	if !ok || conv == "" || expr == "" {
+		return nil, errors.New("expected '<conversation> <regexp> => <action>'")
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	t := &trigger{conv: conv, re: re}
+	t.action, t.arg, _ = strings.Cut(strings.TrimSpace(action), " ")
+	t.arg = strings.TrimSpace(t.arg)
+	switch t.action {
+	case "reply", "run":
+		if t.arg == "" {
+			return nil, fmt.Errorf("expected '%s <%s>'", t.action, map[string]string{"reply": "template", "run": "command"}[t.action])
+		}
+	case "forward":
+		t.target, t.arg, _ = strings.Cut(t.arg, " ")
+		if t.target == "" {
+			return nil, errors.New("expected 'forward <peer|#room> [template]'")
+		}
+		if t.arg = strings.TrimSpace(t.arg); t.arg == "" {
+			t.arg = "$from in $conv: $body"
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q (reply, forward or run)", t.action)
+	}
+	return t, nil
+}
+
+func (t *trigger) String() string {
+	action := t.action
+	if t.target != "" {
+		action += " " + t.target
+	}
+	return t.conv + " " + t.re.String() + " => " + action + " " + t.arg
+}
+
+// allow records a firing if the trigger hasn't used up its burst.
+func (t *trigger) allow(now time.Time) bool {
+	for len(t.fired) > 0 && now.Sub(t.fired[0]) > triggerWindow {
+		t.fired = t.fired[1:]
+	}
+	if len(t.fired) >= triggerBurst {
+		return false
+	}
+	t.fired = append(t.fired, now)
+	return true
+}
+
+// triggerSet is the rules in triggersFile.
+type triggerSet struct {
+	mu    sync.Mutex
+	path  string
+	rules []*trigger
+}
+
+func loadTriggers(path string) (*triggerSet, error) {
+	ts := &triggerSet{path: path}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line == "#" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+		t, err := parseTrigger(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		ts.rules = append(ts.rules, t)
+	}
+	return ts, sc.Err()
+}
+
+// save rewrites the triggers file; callers hold ts.mu.
+func (ts *triggerSet) save() error {
+	var b strings.Builder
+	b.WriteString("# peep-chat triggers, managed with the trigger command\n")
+	for _, t := range ts.rules {
+		b.WriteString(t.String() + "\n")
+	}
+	return os.WriteFile(ts.path, []byte(b.String()), 0600)
+}
+
+func (ts *triggerSet) add(line string) error {
+	t, err := parseTrigger(line)
+	if err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.rules = append(ts.rules, t)
+	return ts.save()
+}
+
+// remove removes the i'th trigger, counting from 1.
+func (ts *triggerSet) remove(i int) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if i < 1 || i > len(ts.rules) {
+		return fmt.Errorf("no trigger %d", i)
+	}
+	ts.rules = append(ts.rules[:i-1], ts.rules[i:]...)
+	return ts.save()
+}
+
+func (ts *triggerSet) list() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	lines := make([]string, len(ts.rules))
+	for i, t := range ts.rules {
+		lines[i] = t.String()
+	}
+	return lines
+}
+
+// triggered is a trigger that matched a message, with what to send.
+type triggered struct {
+	action, target, text, command string
+}
+
+// match returns what the triggers watching conversation key make of m.
+// peerOf resolves a rule's contact name to a peer ID.
+func (ts *triggerSet) match(key string, m Message, vars map[string]string, peerOf func(string) string) []triggered {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	now := time.Now()
+	var out []triggered
+	for _, t := range ts.rules {
+		if t.conv != "any" && t.conv != key && peerOf(t.conv) != key {
+			continue
+		}
+		groups := t.re.FindStringSubmatch(m.Body)
+		if groups == nil || !t.allow(now) {
+			continue
+		}
+		if t.action == "run" {
+			out = append(out, triggered{action: t.action, command: t.arg})
+			continue
+		}
+		pairs := []string{"$from", vars["from"], "$conv", vars["conv"], "$body", m.Body}
+		for i := 0; i <= 9; i++ {
+			g := ""
+			if i < len(groups) {
+				g = groups[i]
+			}
+			pairs = append(pairs, "$"+strconv.Itoa(i), g)
+		}
+		out = append(out, triggered{action: t.action, target: t.target, text: strings.NewReplacer(pairs...).Replace(t.arg)})
+	}
+	return out
+}
+
+// runTriggers carries out the triggers an incoming message in
+// conversation key matches.
+func (a *app) runTriggers(peerID, key string, m Message) {
+	vars := map[string]string{"from": a.conversationLabel(peerID), "conv": a.conversationLabel(key)}
+	for _, t := range a.triggers.match(key, m, vars, a.contacts.peerID) {
+		var err error
+		switch t.action {
+		case "run":
+			err = runHook(t.command, hookEvent{Type: eventTriggerMatched, Peer: peerID, When: m.When, Message: &m})
+		case "reply":
+			err = a.triggerSend(key, t.text)
+		case "forward":
+			err = a.triggerSend(t.target, t.text)
+		}
+		if err != nil {
+			logger.Warnf("trigger %s in %s failed: %s", t.action, a.conversationLabel(key), err)
+		}
+	}
+}
+
+// triggerSend sends text to a peer or contact the way the send command
+// does, or posts it to a #room.
+func (a *app) triggerSend(to, text string) error {
+	if room, ok := strings.CutPrefix(to, "#"); ok {
+		m, err := a.rooms.publish(a.ctx, room, text)
+		if err == nil {
+			a.messageSent("", m)
+		}
+		return err
+	}
+	_, err := a.send(a.ctx, a.contacts.peerID(to), text)
+	return err
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "trigger",
+		Usage:   "[<any|peer|#room> <regexp> => reply <template> | forward <peer|#room> [template] | run <command>] | -d <n>",
+		Summary: "add a trigger acting on matching incoming messages (saved to the config dir; no arguments lists them)",
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) == 0 {
+				lines := a.triggers.list()
+				if jsonOutput {
+					printJSON(map[string]any{"triggers": lines})
+					return nil
+				}
+				if len(lines) == 0 {
+					fmt.Println("no triggers")
+				}
+				for i, l := range lines {
+					fmt.Printf("%d) %s\n", i+1, l)
+				}
+				return nil
+			}
+			if inv.Args[0] == "-d" && len(inv.Args) == 2 {
+				i, err := strconv.Atoi(inv.Args[1])
+				if err != nil {
+					return fmt.Errorf("not a trigger number: %s", inv.Args[1])
+				}
+				return a.triggers.remove(i)
+			}
+			return a.triggers.add(inv.text)
+		},
+	})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-chat/node"
+)
+
+// typeHandler takes a received message of one type once it's accepted.
+// chat says whether it's also shown as a chat line, counted unread and
+// passed on to bots and triggers; if not, note (if any) is shown as a
+// one-line event instead.
+type typeHandler func(a *app, key string, m Message) (note string, chat bool)
+
+var typeHandlers = map[string]typeHandler{}
+
+// handleType registers the handler for messages of type typ; node
+// validates their payload before it runs.
+func handleType(typ string, h typeHandler) {
+	if _, dup := typeHandlers[typ]; dup {
+		panic("message type handled twice: " + typ)
+	}
+	typeHandlers[typ] = h
+}
+
+// handleTyped runs m's type handler. Messages of types this client doesn't
+// know are shown by their body, if they have one.
+func (a *app) handleTyped(key string, m Message) (note string, chat bool) {
+	if h := typeHandlers[m.Kind()]; h != nil {
+		return h(a, key, m)
+	}
+	if !node.KnownType(m.Kind()) {
+		logger.Debugf("%s message from %s: type unknown to this version", m.Kind(), m.From)
+	}
+	return "", m.Body != ""
+}
+
+// sendTyped sends a typed message to a peer or posts it to a #room.
+func (a *app) sendTyped(to, typ, body string, payload any) (Message, error) {
+	if room, ok := strings.CutPrefix(to, "#"); ok {
+		m, err := node.NewTyped(typ, body, payload)
+		if err != nil {
+			return Message{}, err
+		}
+		return a.rooms.post(a.ctx, room, m)
+	}
+	if err := a.e2eReady(to); err != nil {
+		return Message{}, err
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, 30*time.Second)
+	defer cancel()
+	return a.node.SendTyped(ctx, to, typ, body, payload)
+}
+
+// quote is a message's body cut to fit in a one-line note.
+func quote(body string) string {
+	body = strings.Join(strings.Fields(body), " ")
+	if len([]rune(body)) > 40 {
+		body = string([]rune(body)[:40]) + "…"
+	}
+	return "“" + body + "”"
+}
+
+// pollState is a poll seen in a conversation, with the votes cast.
+type pollState struct {
+	key   string // conversation
+	poll  node.Poll
+	votes map[string]int // voter peer ID -> option
+}
+
+func (p *pollState) tally() string {
+	counts := make([]int, len(p.poll.Options))
+	for _, c := range p.votes {
+		counts[c]++
+	}
+	parts := make([]string, len(counts))
+	for i, n := range counts {
+		parts[i] = fmt.Sprintf("%s: %d", p.poll.Options[i], n)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// polls are the polls seen this session, oldest first.
+type polls struct {
+	mu    sync.Mutex
+	byID  map[string]*pollState
+	order []string
+}
+
+func newPolls() *polls { return &polls{byID: make(map[string]*pollState)} }
+
+func (ps *polls) ask(key string, p node.Poll) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, seen := ps.byID[p.ID]; !seen {
+		ps.byID[p.ID] = &pollState{key: key, poll: p, votes: make(map[string]int)}
+		ps.order = append(ps.order, p.ID)
+	}
+}
+
+// vote records voter's choice and returns the poll, or false if it's
+// unknown or the choice isn't one of its options.
+func (ps *polls) vote(id, voter string, choice int) (pollState, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.byID[id]
+	if !ok || choice >= len(p.poll.Options) {
+		return pollState{}, false
+	}
+	p.votes[voter] = choice
+	return *p, true
+}
+
+// get returns poll n, counting from 1 in the order they were seen.
+func (ps *polls) get(n int) (*pollState, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if n < 1 || n > len(ps.order) {
+		return nil, false
+	}
+	return ps.byID[ps.order[n-1]], true
+}
+
+func (ps *polls) list() []pollState {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	out := make([]pollState, 0, len(ps.order))
+	for _, id := range ps.order {
+		out = append(out, *ps.byID[id])
+	}
+	return out
+}
+
+func init() {
+	handleType(node.TypeReaction, func(a *app, key string, m Message) (string, bool) {
+		var r node.Reaction
+		if m.DecodePayload(&r) != nil {
+			return "", false
+		}
+		what := "a message"
+		if e, ok := a.scroll.find(r.Target); ok {
+			what = quote(e.m.Body)
+		}
+		if r.Remove {
+			return fmt.Sprintf("%s took %s off %s", shortID(m.From), r.Emoji, what), false
+		}
+		return fmt.Sprintf("%s reacted %s to %s", shortID(m.From), r.Emoji, what), false
+	})
+	handleType(node.TypeReceipt, func(a *app, key string, m Message) (string, bool) {
+		var r node.Receipt
+		if m.DecodePayload(&r) == nil {
+			logger.Debugf("%s: %d messages %s", a.conversationLabel(key), len(r.Targets), r.Status)
+			a.receiptReceived(m.From, r)
+		}
+		return "", false
+	})
+	handleType(node.TypePoll, func(a *app, key string, m Message) (string, bool) {
+		var p node.Poll
+		if m.DecodePayload(&p) != nil {
+			return "", false
+		}
+		if p.Choice == nil {
+			a.polls.ask(key, p)
+			return "", true
+		}
+		st, ok := a.polls.vote(p.ID, m.From, *p.Choice)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("%s voted %s in %s (%s)", shortID(m.From), quote(st.poll.Options[*p.Choice]), quote(st.poll.Question), st.tally()), false
+	})
+
+	commands.mustRegister(&command{
+		Name:    "react",
+		Usage:   "[-d] [-n <n>] <peerID|contact|#room> <emoji>",
+		Summary: "react with an emoji to the latest message from the others in a conversation, or the nth latest with -n; -d takes the reaction off",
+		MinArgs: 2,
+		Flags: func(fs *flag.FlagSet) {
+			fs.Bool("d", false, "take the reaction off")
+			fs.Int("n", 1, "react to the nth latest message")
+		},
+		Run: func(a *app, inv *invocation) error {
+			to := inv.Args[0]
+			if !strings.HasPrefix(to, "#") {
+				to = a.contacts.peerID(to)
+			}
+			self := a.h.ID().String()
+			var target Message
+			found := 0
+			entries := a.scroll.latest(to, scrollbackLines)
+			for i := len(entries) - 1; i >= 0 && found < inv.Int("n"); i-- {
+				if entries[i].m.From != self {
+					target = entries[i].m
+					found++
+				}
+			}
+			if found == 0 || found < inv.Int("n") {
+				return fmt.Errorf("no message to react to in %s", a.conversationLabel(to))
+			}
+			r := node.Reaction{Target: target.ID(), Emoji: inv.Args[1], Remove: inv.Bool("d")}
+			body := "reacted " + r.Emoji + " to " + quote(target.Body)
+			if r.Remove {
+				body = "took " + r.Emoji + " off " + quote(target.Body)
+			}
+			if _, err := a.sendTyped(to, node.TypeReaction, body, r); err != nil {
+				return err
+			}
+			printResult(map[string]any{"sent": to, "reaction": r}, body)
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "poll",
+		Usage:   "<peerID|contact|#room> <question> | <option> | <option>...",
+		Summary: "ask a poll; answers come back with 'vote'",
+		MinArgs: 2,
+		Run: func(a *app, inv *invocation) error {
+			to := inv.Args[0]
+			if !strings.HasPrefix(to, "#") {
+				to = a.contacts.peerID(to)
+			}
+			parts := strings.Split(inv.Tail(1), "|")
+			for i := range parts {
+				parts[i] = strings.TrimSpace(parts[i])
+			}
+			if len(parts) < 3 || len(parts) > node.MaxPollOptions+1 {
+				return fmt.Errorf("usage: poll <peer|#room> <question> | <option> | <option>... (2 to %d options)", node.MaxPollOptions)
+			}
+			var id [8]byte
+			if _, err := rand.Read(id[:]); err != nil {
+				return err
+			}
+			p := node.Poll{ID: hex.EncodeToString(id[:]), Question: parts[0], Options: parts[1:]}
+			body := "📊 " + p.Question
+			for i, o := range p.Options {
+				body += fmt.Sprintf("\n  %d) %s", i+1, o)
+			}
+			m, err := a.sendTyped(to, node.TypePoll, body, p)
+			if err != nil {
+				return err
+			}
+			a.messageSent(to, m)
+			a.polls.ask(conversationKey(to, m), p)
+			printResult(map[string]any{"sent": to, "poll": p}, "asked "+a.conversationLabel(to)+" "+quote(p.Question))
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "vote",
+		Usage:   "[<poll> <option>]",
+		Summary: "vote in a poll, both by number; alone, list the polls seen this session with their votes",
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) == 0 {
+				all := a.polls.list()
+				if jsonOutput {
+					out := make([]map[string]any, len(all))
+					for i, p := range all {
+						out[i] = map[string]any{"conversation": p.key, "poll": p.poll, "votes": p.votes}
+					}
+					printJSON(map[string]any{"polls": out})
+					return nil
+				}
+				if len(all) == 0 {
+					fmt.Println("no polls")
+				}
+				for i, p := range all {
+					fmt.Printf("%d) %s in %s\n", i+1, quote(p.poll.Question), a.conversationLabel(p.key))
+					counts := make([]int, len(p.poll.Options))
+					for _, c := range p.votes {
+						counts[c]++
+					}
+					for j, o := range p.poll.Options {
+						fmt.Printf("   %d) %s: %d\n", j+1, o, counts[j])
+					}
+				}
+				return nil
+			}
+			if len(inv.Args) != 2 {
+				return errors.New("usage: vote <poll> <option>")
+			}
+			n, _ := strconv.Atoi(inv.Args[0])
+			p, ok := a.polls.get(n)
+			if !ok {
+				return fmt.Errorf("no poll %s; 'vote' lists them", inv.Args[0])
+			}
+			choice, err := strconv.Atoi(inv.Args[1])
+			if err != nil || choice < 1 || choice > len(p.poll.Options) {
+				return fmt.Errorf("pick an option from 1 to %d", len(p.poll.Options))
+			}
+			choice--
+			v := node.Poll{ID: p.poll.ID, Choice: &choice}
+			body := "voted " + quote(p.poll.Options[choice]) + " in " + quote(p.poll.Question)
+			if _, err := a.sendTyped(p.key, node.TypePoll, body, v); err != nil {
+				return err
+			}
+			st, _ := a.polls.vote(p.poll.ID, a.h.ID().String(), choice)
+			printResult(map[string]any{"sent": p.key, "vote": v}, body+" ("+st.tally()+")")
+			return nil
+		},
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// readCursor is the per-conversation read state persisted to readStateFile.
+type readCursor struct {
+	ReadAt int64 `json:"read_at"` // unix millis of the last mark-as-read
+	Unread int   `json:"unread"`
+}
+
+// unreadTracker keeps read cursors per conversation (currently keyed by
+// peer ID) and counts messages that arrived after them.
+type unreadTracker struct {
+	mu    sync.Mutex
+	path  string
+	convs map[string]*readCursor
+}
+
+func loadUnreadTracker(path string) (*unreadTracker, error) {
+	u := &unreadTracker{path: path, convs: make(map[string]*readCursor)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &u.convs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return u, nil
+}
+
+// received counts a message in conv unless it predates the read cursor.
+func (u *unreadTracker) received(conv string, when int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c := u.cursor(conv)
+	if when <= c.ReadAt {
+		return
+	}
+	c.Unread++
+	u.save()
+}
+
+// markRead moves the cursor of conv to now.
+func (u *unreadTracker) markRead(conv string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c := u.cursor(conv)
+	c.ReadAt = time.Now().UnixMilli()
+	c.Unread = 0
+	u.save()
+}
+
+// count returns the number of unread messages in conv.
+func (u *unreadTracker) count(conv string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if c, ok := u.convs[conv]; ok {
+		return c.Unread
+	}
+	return 0
+}
+
+// printUnread lists every conversation with unread messages.
+func (u *unreadTracker) printUnread() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var convs []string
+	for id, c := range u.convs {
+		if c.Unread > 0 {
+			convs = append(convs, id)
+		}
+	}
+	if jsonOutput {
+		counts := make(map[string]int, len(convs))
+		for _, id := range convs {
+			counts[id] = u.convs[id].Unread
+		}
+		printJSON(map[string]any{"unread": counts})
+		return
+	}
+	if len(convs) == 0 {
+		fmt.Println("no unread messages")
+		return
+	}
+	sort.Strings(convs)
+	for _, id := range convs {
+		fmt.Printf(" - %s: %d unread\n", id, u.convs[id].Unread)
+	}
+}
+
+// keys returns every conversation with read state, sorted.
+func (u *unreadTracker) keys() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	keys := make([]string, 0, len(u.convs))
+	for k := range u.convs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (u *unreadTracker) cursor(conv string) *readCursor {
+	c, ok := u.convs[conv]
+	if !ok {
+		c = &readCursor{}
+		u.convs[conv] = c
+	}
+	return c
+}
+
+// save writes the cursors to disk; callers hold u.mu.
+func (u *unreadTracker) save() {
+	b, err := json.Marshal(u.convs)
+	if err != nil {
+		logger.Warnf("encoding read state: %s", err)
+		return
+	}
+	if err := os.WriteFile(u.path, b, 0600); err != nil {
+		logger.Warnf("saving read state: %s", err)
+	}
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "unread",
+		Summary: "list conversations with unread messages",
+		Run: func(a *app, inv *invocation) error {
+			a.unread.printUnread()
+			return nil
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "read",
+		Usage:   "<peerID>",
+		Summary: "mark a conversation as read",
+		MinArgs: 1,
+		Run: func(a *app, inv *invocation) error {
+			a.markRead(inv.Args[0])
+			return nil
+		},
+	})
+}
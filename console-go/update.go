@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Release signing. updatePublicKey is the base64 Ed25519 key release
+// manifests are signed with, and updateURL the manifest location; both are
+// set at build time (-X main.updatePublicKey=... -X main.updateURL=...).
+// PEEP_UPDATE_URL overrides the URL.
+var (
+	updatePublicKey = ""
+	updateURL       = ""
+)
+
+// maxUpdateBinary caps a downloaded binary.
+const maxUpdateBinary = 200 << 20
+
+// releaseManifest is served at updateURL, with its detached base64 Ed25519
+// signature at updateURL + ".sig".
+type releaseManifest struct {
+	Version  string                   `json:"version"`
+	Binaries map[string]releaseBinary `json:"binaries"` // keyed by GOOS/GOARCH
+}
+
+type releaseBinary struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+func httpGet(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := updateClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("GET %s: response too large", url)
+	}
+	return b, nil
+}
+
+// fetchManifest downloads the release manifest and checks its signature.
+func fetchManifest(ctx context.Context, url string) (*releaseManifest, error) {
+	pub, err := base64.StdEncoding.DecodeString(updatePublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("this build has no valid update signing key")
+	}
+	body, err := httpGet(ctx, url, 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	sigText, err := httpGet(ctx, url+".sig", 4096)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigText)))
+	if err != nil {
+		return nil, fmt.Errorf("bad signature encoding: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), body, sig) {
+		return nil, errors.New("release manifest signature does not verify")
+	}
+	var m releaseManifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// installUpdate replaces the running executable with the verified binary.
+// The old one is kept as <exe>.old until the new one has answered
+// --version; any failure puts the old one back.
+func installUpdate(ctx context.Context, bin releaseBinary) error {
+	want, err := hex.DecodeString(bin.SHA256)
+	if err != nil || len(want) != sha256.Size {
+		return errors.New("manifest has a malformed sha256")
+	}
+	data, err := httpGet(ctx, bin.URL, maxUpdateBinary)
+	if err != nil {
+		return err
+	}
+	if got := sha256.Sum256(data); string(got[:]) != string(want) {
+		return errors.New("downloaded binary does not match the signed checksum")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	newPath, oldPath := exe+".new", exe+".old"
+	if err := os.WriteFile(newPath, data, 0755); err != nil {
+		return err
+	}
+	defer os.Remove(newPath)
+	_ = os.Remove(oldPath)
+	if err := os.Rename(exe, oldPath); err != nil {
+		return err
+	}
+	rollback := func(cause error) error {
+		_ = os.Remove(exe)
+		if err := os.Rename(oldPath, exe); err != nil {
+			return fmt.Errorf("%w; rollback failed too, previous binary is at %s: %s", cause, oldPath, err)
+		}
+		return fmt.Errorf("%w (rolled back)", cause)
+	}
+	if err := os.Rename(newPath, exe); err != nil {
+		return rollback(err)
+	}
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if out, err := exec.CommandContext(cctx, exe, "--version").CombinedOutput(); err != nil {
+		return rollback(fmt.Errorf("new binary failed to start: %s: %s", err, strings.TrimSpace(string(out))))
+	}
+	// On Windows the running binary can't be deleted; it's cleaned up by
+	// the next update instead.
+	_ = os.Remove(oldPath)
+	return nil
+}
+
+func selfUpdate(ctx context.Context, checkOnly bool) error {
+	url := updateURL
+	if env := os.Getenv("PEEP_UPDATE_URL"); env != "" {
+		url = env
+	}
+	if url == "" {
+		return errors.New("no update URL configured (PEEP_UPDATE_URL)")
+	}
+	m, err := fetchManifest(ctx, url)
+	if err != nil {
+		return err
+	}
+	// The manifest is signed but not dated, so an old one replayed would
+	// install an old release; only a strictly newer one is taken.
+	newer, err := newerVersion(m.Version, version)
+	if err != nil {
+		return fmt.Errorf("release manifest: %w", err)
+	}
+	if !newer {
+		fmt.Printf("already up to date: %s (latest release %s)\n", version, m.Version)
+		return nil
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	bin, ok := m.Binaries[platform]
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s", m.Version, platform)
+	}
+	if checkOnly {
+		fmt.Printf("update available: %s -> %s\n", version, m.Version)
+		return nil
+	}
+	fmt.Printf("updating %s -> %s...\n", version, m.Version)
+	if err := installUpdate(ctx, bin); err != nil {
+		return err
+	}
+	fmt.Println("updated to", m.Version, "- restart peep-chat to use it")
+	return nil
+}
+
+// newerVersion reports whether release, a version like v1.2.3 or
+// v1.2.3-rc.1, is newer than current. A dev build is older than any
+// release; any other current version that doesn't parse is an error, as is
+// a release that doesn't.
+func newerVersion(release, current string) (bool, error) {
+	r, err := parseVersion(release)
+	if err != nil {
+		return false, err
+	}
+	if current == "dev" {
+		return true, nil
+	}
+	c, err := parseVersion(current)
+	if err != nil {
+		return false, fmt.Errorf("this build's version: %w", err)
+	}
+	for i := range 3 {
+		if r.core[i] != c.core[i] {
+			return r.core[i] > c.core[i], nil
+		}
+	}
+	return comparePrerelease(r.pre, c.pre) > 0, nil
+}
+
+type semver struct {
+	core [3]int
+	pre  string // without the '-'; "" for a release
+}
+
+func parseVersion(v string) (semver, error) {
+	s := strings.TrimPrefix(v, "v")
+	s, _, _ = strings.Cut(s, "+") // build metadata doesn't order
+	core, pre, hasPre := strings.Cut(s, "-")
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 || hasPre && pre == "" {
+		return semver{}, fmt.Errorf("bad version %q", v)
+	}
+	var sv semver
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || p != strconv.Itoa(n) {
+			return semver{}, fmt.Errorf("bad version %q", v)
+		}
+		sv.core[i] = n
+	}
+	sv.pre = pre
+	return sv, nil
+}
+
+// comparePrerelease orders pre-release tags as semver does: no tag is
+// newest, then dot-separated identifiers compare numerically when both
+// are numbers and as text otherwise.
+func comparePrerelease(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				return cmp.Compare(an, bn)
+			}
+		case aerr == nil:
+			return -1 // numbers sort before text
+		case berr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return cmp.Compare(len(as), len(bs))
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "update",
+		Usage:   "[check]",
+		Summary: "check for, verify and install a new release (restart afterwards)",
+		Run: func(a *app, inv *invocation) error {
+			return selfUpdate(inv.Context(), len(inv.Args) > 0 && inv.Args[0] == "check")
+		},
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"p2p-chat/node"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=v0.3.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// When they're left empty, the VCS info Go stamps into the binary is used.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// fillBuildInfo fills commit and buildDate from the binary's VCS stamp when
+// the linker didn't set them.
+func fillBuildInfo() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && commit == "":
+			commit = s.Value
+			if len(commit) > 12 {
+				commit = commit[:12]
+			}
+		case s.Key == "vcs.time" && buildDate == "":
+			buildDate = s.Value
+		}
+	}
+}
+
+// agentVersion is what identify tells other peers we run.
+func agentVersion() string {
+	v := "peep-chat/" + version
+	if commit != "" {
+		v += "+" + commit
+	}
+	return v
+}
+
+// supportedProtocols lists the wire protocols this build speaks.
+func supportedProtocols() []string {
+	return []string{
+		node.ProtocolID,
+		pushRegisterProtocol,
+		string(node.DHTProtocol),
+		roomTopicPrefix + "<room> (gossipsub)",
+	}
+}
+
+func printVersion() {
+	fmt.Println("peep-chat", version)
+	if commit != "" {
+		fmt.Println("  commit:    ", commit)
+	}
+	if buildDate != "" {
+		fmt.Println("  built:     ", buildDate)
+	}
+	fmt.Println("  go:        ", runtime.Version(), runtime.GOOS+"/"+runtime.GOARCH)
+	fmt.Println("  agent:     ", node.AgentVersion(agentVersion(), node.AllFeatures))
+	fmt.Println("  protocols:")
+	for _, p := range supportedProtocols() {
+		fmt.Println("    ", p)
+	}
+}
+
+func init() {
+	fillBuildInfo()
+	commands.mustRegister(&command{
+		Name:    "version",
+		Summary: "show version, build info and supported protocols",
+		Run: func(a *app, inv *invocation) error {
+			printVersion()
+			return nil
+		},
+	})
+}
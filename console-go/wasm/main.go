@@ -0,0 +1,223 @@
+//go:build js && wasm
+
+// Command wasm runs a peep node inside a browser tab. Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o peep.wasm ./wasm
+//
+// and load it with Go's wasm_exec.js. It installs globalThis.peep:
+//
+//	peep.start(identity, onMessage, options) -> Promise<{peerId, identity}>
+//	peep.connect(addr)              -> Promise<peerId>
+//	peep.findPeer(peerId)           -> Promise<[addr]>
+//	peep.send(peerId, body)         -> Promise<when>
+//	peep.store(peerId, body)        -> Promise<when>
+//	peep.fetch(peerId)              -> Promise<[{from, when, body}]>
+//	peep.stop()                     -> Promise
+//
+// identity is a base64 private key returned by an earlier start (keep it in
+// localStorage), or "" to generate a new one. onMessage(from, body, when)
+// is called for each incoming direct message. options is optional;
+// options.delegatedRouting lists Delegated Routing V1 HTTP endpoints
+// (e.g. ["https://delegated-ipfs.dev"]) that findPeer asks, since a tab
+// can't take part in the DHT properly.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"syscall/js"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+var (
+	ctx = context.Background()
+	n   *node.Node
+)
+
+func main() {
+	js.Global().Set("peep", js.ValueOf(map[string]any{
+		"start":    js.FuncOf(start),
+		"connect":  js.FuncOf(connect),
+		"findPeer": js.FuncOf(findPeer),
+		"send":     js.FuncOf(send),
+		"store":    js.FuncOf(store),
+		"fetch":    js.FuncOf(fetch),
+		"stop":     js.FuncOf(stop),
+	}))
+	select {}
+}
+
+func start(_ js.Value, args []js.Value) any {
+	return promise(func() (any, error) {
+		if n != nil {
+			return nil, errors.New("already started")
+		}
+		if len(args) < 2 || args[1].Type() != js.TypeFunction {
+			return nil, errors.New("usage: peep.start(identity, onMessage)")
+		}
+		priv, err := identity(args[0].String())
+		if err != nil {
+			return nil, err
+		}
+		opts := node.Options{Identity: priv}
+		if len(args) > 2 && args[2].Type() == js.TypeObject {
+			if routers := args[2].Get("delegatedRouting"); routers.Type() == js.TypeObject {
+				for i := 0; i < routers.Length(); i++ {
+					opts.DelegatedRouting = append(opts.DelegatedRouting, routers.Index(i).String())
+				}
+			}
+		}
+		if n, err = node.New(ctx, opts); err != nil {
+			return nil, err
+		}
+		onMessage := args[1]
+		n.OnMessage(func(from peer.ID, m node.Message) {
+			onMessage.Invoke(from.String(), m.Body, m.When)
+		})
+		raw, err := crypto.MarshalPrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{
+			"peerId":   n.ID().String(),
+			"identity": base64.StdEncoding.EncodeToString(raw),
+		}, nil
+	})
+}
+
+// identity decodes a stored key, or makes a new one when s is empty.
+func identity(s string) (crypto.PrivKey, error) {
+	if s == "" || s == "undefined" || s == "null" {
+		priv, _, err := crypto.GenerateKeyPairWithReader(crypto.Ed25519, -1, rand.Reader)
+		return priv, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnmarshalPrivateKey(raw)
+}
+
+func connect(_ js.Value, args []js.Value) any {
+	return promise(func() (any, error) {
+		if err := need(args, 1); err != nil {
+			return nil, err
+		}
+		id, err := n.Connect(ctx, args[0].String())
+		if err != nil {
+			return nil, err
+		}
+		return id.String(), nil
+	})
+}
+
+func findPeer(_ js.Value, args []js.Value) any {
+	return promise(func() (any, error) {
+		if err := need(args, 1); err != nil {
+			return nil, err
+		}
+		id, err := peer.Decode(args[0].String())
+		if err != nil {
+			return nil, err
+		}
+		pi, err := n.FindPeer(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]any, len(pi.Addrs))
+		for i, addr := range pi.Addrs {
+			out[i] = addr.String()
+		}
+		return out, nil
+	})
+}
+
+func send(_ js.Value, args []js.Value) any {
+	return promise(func() (any, error) {
+		if err := need(args, 2); err != nil {
+			return nil, err
+		}
+		m, err := n.Send(ctx, args[0].String(), args[1].String())
+		if err != nil {
+			return nil, err
+		}
+		return m.When, nil
+	})
+}
+
+func store(_ js.Value, args []js.Value) any {
+	return promise(func() (any, error) {
+		if err := need(args, 2); err != nil {
+			return nil, err
+		}
+		m, err := n.StoreOffline(ctx, args[0].String(), args[1].String())
+		if err != nil {
+			return nil, err
+		}
+		return m.When, nil
+	})
+}
+
+func fetch(_ js.Value, args []js.Value) any {
+	return promise(func() (any, error) {
+		if err := need(args, 1); err != nil {
+			return nil, err
+		}
+		msgs, err := n.FetchOffline(ctx, args[0].String())
+		if err != nil {
+			return nil, err
+		}
+		out := make([]any, len(msgs))
+		for i, m := range msgs {
+			out[i] = map[string]any{"from": m.From, "when": m.When, "body": m.Body}
+		}
+		return out, nil
+	})
+}
+
+func stop(_ js.Value, _ []js.Value) any {
+	return promise(func() (any, error) {
+		if n == nil {
+			return nil, nil
+		}
+		err := n.Close()
+		n = nil
+		return nil, err
+	})
+}
+
+func need(args []js.Value, count int) error {
+	if n == nil {
+		return errors.New("node not started")
+	}
+	if len(args) < count {
+		return errors.New("missing arguments")
+	}
+	return nil
+}
+
+// promise runs fn off the JS event loop (libp2p calls block) and settles a
+// Promise with its result.
+func promise(fn func() (any, error)) js.Value {
+	var executor js.Func
+	executor = js.FuncOf(func(_ js.Value, args []js.Value) any {
+		resolve, reject := args[0], args[1]
+		go func() {
+			defer executor.Release()
+			v, err := fn()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(v)
+		}()
+		return nil
+	})
+	return js.Global().Get("Promise").New(executor)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchFile holds watch patterns, one per line:
+//
+//	keyword alice
+//	regex (?i)\brelease\b
+//
+// A keyword matches anywhere in a message, ignoring case; a regex is a Go
+// regular expression. Lines starting with # are comments.
+const watchFile = "p2pchat_watch.conf"
+
+// maxHighlights caps the highlights kept; older ones are dropped.
+const maxHighlights = 200
+
+type watchPattern struct {
+	kind string // keyword or regex
+	arg  string
+	re   *regexp.Regexp
+}
+
+func parseWatchPattern(line string) (watchPattern, error) {
+	kind, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	p := watchPattern{kind: kind, arg: strings.TrimSpace(arg)}
+	if p.arg == "" {
+		return p, errors.New("expected 'keyword <text>' or 'regex <expression>'")
+	}
+	switch kind {
+	case "keyword":
+	case "regex":
+		re, err := regexp.Compile(p.arg)
+		if err != nil {
+			return p, err
+		}
+		p.re = re
+	default:
+		return p, fmt.Errorf("expected 'keyword' or 'regex', got %q", kind)
+	}
+	return p, nil
+}
+
+func (p watchPattern) String() string { return p.kind + " " + p.arg }
+
+func (p watchPattern) match(body string) bool {
+	if p.re != nil {
+		return p.re.MatchString(body)
+	}
+	return strings.Contains(strings.ToLower(body), strings.ToLower(p.arg))
+}
+
+// highlight is a message that matched a watch pattern.
+type highlight struct {
+	Conversation string  `json:"conversation"`
+	Pattern      string  `json:"pattern"`
+	Message      Message `json:"message"`
+}
+
+// watchList is the watch patterns in watchFile and the recent messages
+// that matched them, across all conversations.
+type watchList struct {
+	mu       sync.Mutex
+	path     string
+	patterns []watchPattern
+	hits     []highlight // oldest first
+}
+
+func loadWatchList(path string) (*watchList, error) {
+	w := &watchList{path: path}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := parseWatchPattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		w.patterns = append(w.patterns, p)
+	}
+	return w, sc.Err()
+}
+
+// save rewrites the watch file; callers hold w.mu.
+func (w *watchList) save() error {
+	var b strings.Builder
+	b.WriteString("# peep-chat watch list, managed with the watch command\n")
+	for _, p := range w.patterns {
+		b.WriteString(p.String() + "\n")
+	}
+	return os.WriteFile(w.path, []byte(b.String()), 0600)
+}
+
+func (w *watchList) add(line string) error {
+	p, err := parseWatchPattern(line)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.patterns = append(w.patterns, p)
+	return w.save()
+}
+
+// remove removes the i'th pattern, counting from 1.
+func (w *watchList) remove(i int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if i < 1 || i > len(w.patterns) {
+		return fmt.Errorf("no watch pattern %d", i)
+	}
+	w.patterns = append(w.patterns[:i-1], w.patterns[i:]...)
+	return w.save()
+}
+
+func (w *watchList) list() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	lines := make([]string, len(w.patterns))
+	for i, p := range w.patterns {
+		lines[i] = p.String()
+	}
+	return lines
+}
+
+// match returns the first pattern m's body matches and records m as a
+// highlight of conversation key; "" if none does.
+func (w *watchList) match(key string, m Message) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, p := range w.patterns {
+		if !p.match(m.Body) {
+			continue
+		}
+		w.hits = append(w.hits, highlight{Conversation: key, Pattern: p.String(), Message: m})
+		if len(w.hits) > maxHighlights {
+			w.hits = w.hits[len(w.hits)-maxHighlights:]
+		}
+		return p.String()
+	}
+	return ""
+}
+
+// recent returns the last n highlights, oldest first.
+func (w *watchList) recent(n int) []highlight {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]highlight(nil), w.hits[max(len(w.hits)-n, 0):]...)
+}
+
+func (w *watchList) clear() {
+	w.mu.Lock()
+	w.hits = nil
+	w.mu.Unlock()
+}
+
+// highlighted surfaces a watched message that arrived in a background
+// conversation, where it would otherwise only count as unread.
+func (a *app) highlighted(key string, m Message) {
+	label := a.conversationLabel(key)
+	if screenReader {
+		fmt.Printf("\nWatched message in %s.\n%s", label, a.prompt())
+		return
+	}
+	fmt.Printf("\n%s %s: %s\n%s", styles.system("* watched in "+label+" from"), styles.peer(m.From, shortID(m.From)), styles.highlight(m.Body), a.prompt())
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "watch",
+		Usage:   "[keyword <text> | regex <expression> | -d <n>]",
+		Summary: "add a watch pattern: matching messages in any conversation are highlighted and listed by 'highlights' (no arguments lists them)",
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) == 0 {
+				lines := a.watch.list()
+				if jsonOutput {
+					printJSON(map[string]any{"watch": lines})
+					return nil
+				}
+				if len(lines) == 0 {
+					fmt.Println("no watch patterns")
+				}
+				for i, l := range lines {
+					fmt.Printf("%d) %s\n", i+1, l)
+				}
+				return nil
+			}
+			if inv.Args[0] == "-d" && len(inv.Args) == 2 {
+				i, err := strconv.Atoi(inv.Args[1])
+				if err != nil {
+					return fmt.Errorf("not a pattern number: %s", inv.Args[1])
+				}
+				return a.watch.remove(i)
+			}
+			return a.watch.add(inv.text)
+		},
+	})
+	commands.mustRegister(&command{
+		Name:    "highlights",
+		Usage:   "[-n N] [clear]",
+		Summary: "list recent messages that matched a watch pattern, across conversations",
+		Flags: func(fs *flag.FlagSet) {
+			fs.Int("n", scrollbackPage, "how many")
+		},
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) > 0 && inv.Args[0] == "clear" {
+				a.watch.clear()
+				return nil
+			}
+			hits := a.watch.recent(max(inv.Int("n"), 1))
+			if jsonOutput {
+				printJSON(map[string]any{"highlights": hits})
+				return nil
+			}
+			if len(hits) == 0 {
+				fmt.Println("no highlights")
+			}
+			for _, h := range hits {
+				fmt.Printf("[%s] %s <%s> %s %s\n", time.UnixMilli(h.Message.When).Format("2006-01-02 15:04"),
+					a.conversationLabel(h.Conversation), shortID(h.Message.From), styles.highlight(h.Message.Body), styles.dim("("+h.Pattern+")"))
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhookTimeout bounds a single webhook POST.
+const webhookTimeout = 10 * time.Second
+
+// webhook is one outgoing webhook from webhooksFile. Empty filters match
+// everything. Peers match the sender, in rooms too; Rooms, with or
+// without the #, match room messages only, so a hook can follow one room;
+// keywords match case-insensitively anywhere in the body.
+type webhook struct {
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret,omitempty"`
+	Peers    []string `json:"peers,omitempty"`
+	Rooms    []string `json:"rooms,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+}
+
+func (w *webhook) matches(peerID string, m Message) bool {
+	if len(w.Peers) > 0 && !containsString(w.Peers, peerID) {
+		return false
+	}
+	if len(w.Rooms) > 0 && (m.Room == "" || !containsString(w.Rooms, m.Room) && !containsString(w.Rooms, "#"+m.Room)) {
+		return false
+	}
+	if len(w.Keywords) == 0 {
+		return true
+	}
+	body := strings.ToLower(m.Body)
+	for _, k := range w.Keywords {
+		if strings.Contains(body, strings.ToLower(k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookSender POSTs received messages to the configured endpoints. The
+// body is the same JSON event hooks get on stdin; when a secret is set the
+// request carries X-Peep-Signature: sha256=<hex HMAC of the body>.
+type webhookSender struct {
+	mu     sync.Mutex
+	path   string
+	hooks  []webhook
+	client *http.Client
+}
+
+func loadWebhooks(path string) (*webhookSender, error) {
+	ws := &webhookSender{path: path, client: &http.Client{Timeout: webhookTimeout}}
+	return ws, ws.reload()
+}
+
+func (ws *webhookSender) reload() error {
+	var hooks []webhook
+	b, err := os.ReadFile(ws.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &hooks); err != nil {
+			return fmt.Errorf("%s: %w", ws.path, err)
+		}
+	}
+	for i, w := range hooks {
+		if w.URL == "" {
+			return fmt.Errorf("%s: webhook %d has no url", ws.path, i+1)
+		}
+	}
+	ws.mu.Lock()
+	ws.hooks = hooks
+	ws.mu.Unlock()
+	return nil
+}
+
+// messageReceived posts the message to every matching webhook in the
+// background.
+func (ws *webhookSender) messageReceived(peerID string, m Message) {
+	ws.mu.Lock()
+	hooks := append([]webhook(nil), ws.hooks...)
+	ws.mu.Unlock()
+	var payload []byte
+	for _, w := range hooks {
+		if !w.matches(peerID, m) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			payload, err = json.Marshal(hookEvent{Type: eventMessageReceived, Peer: peerID, When: m.When, Message: &m})
+			if err != nil {
+				return
+			}
+		}
+		go func(w webhook) {
+			if err := ws.post(w, payload); err != nil {
+				logger.Warnf("webhook %s: %s", w.URL, err)
+			}
+		}(w)
+	}
+}
+
+func (ws *webhookSender) post(w webhook, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Peep-Event", eventMessageReceived)
+	if w.Secret != "" {
+		req.Header.Set("X-Peep-Signature", "sha256="+signPayload(w.Secret, payload))
+	}
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signPayload returns the hex HMAC-SHA256 of payload under secret.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:    "webhooks",
+		Usage:   "[reload]",
+		Summary: "list outgoing webhooks, or reload them from " + webhooksFile,
+		Run: func(a *app, inv *invocation) error {
+			if len(inv.Args) > 0 && inv.Args[0] == "reload" {
+				if err := a.webhooks.reload(); err != nil {
+					return err
+				}
+			}
+			a.webhooks.mu.Lock()
+			defer a.webhooks.mu.Unlock()
+			if len(a.webhooks.hooks) == 0 {
+				fmt.Println("no webhooks configured")
+				return nil
+			}
+			for i, w := range a.webhooks.hooks {
+				fmt.Printf("%d) %s", i+1, w.URL)
+				if len(w.Peers) > 0 {
+					fmt.Printf(" peers=%s", strings.Join(w.Peers, ","))
+				}
+				if len(w.Rooms) > 0 {
+					fmt.Printf(" rooms=%s", strings.Join(w.Rooms, ","))
+				}
+				if len(w.Keywords) > 0 {
+					fmt.Printf(" keywords=%s", strings.Join(w.Keywords, ","))
+				}
+				if w.Secret != "" {
+					fmt.Print(" (signed)")
+				}
+				fmt.Println()
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxWebhookBody caps the size of an incoming webhook request.
+const maxWebhookBody = 64 << 10
+
+// webhookRequest is the JSON body accepted by the incoming webhook.
+type webhookRequest struct {
+	To   string `json:"to"` // peer ID, contact or #room
+	Body string `json:"body"`
+}
+
+type webhookResponse struct {
+	OK    bool   `json:"ok"`
+	When  int64  `json:"when,omitempty"` // set when the message went out directly or to a room
+	Error string `json:"error,omitempty"`
+}
+
+// serveIncomingWebhook listens on addr for authenticated POST /send requests
+// and delivers them as chat messages, so CI jobs and scripts can reach
+// people and rooms over peep-chat. Direct messages take the same way as the
+// send command. Requests must carry "Authorization: Bearer <token>".
+func serveIncomingWebhook(a *app, addr, token string) (*http.Server, error) {
+	if token == "" {
+		return nil, errors.New("incoming webhook needs a token (--webhook-token or PEEP_WEBHOOK_TOKEN)")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeWebhookResponse(w, http.StatusMethodNotAllowed, webhookResponse{Error: "POST only"})
+			return
+		}
+		got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			a.audit.record(auditBlocked, "", "incoming webhook: bad token from "+r.RemoteAddr)
+			writeWebhookResponse(w, http.StatusUnauthorized, webhookResponse{Error: "bad token"})
+			return
+		}
+		var req webhookRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookBody)).Decode(&req); err != nil {
+			writeWebhookResponse(w, http.StatusBadRequest, webhookResponse{Error: err.Error()})
+			return
+		}
+		if req.To == "" || req.Body == "" {
+			writeWebhookResponse(w, http.StatusBadRequest, webhookResponse{Error: "to and body are required"})
+			return
+		}
+		var m Message
+		var err error
+		if room, ok := strings.CutPrefix(req.To, "#"); ok {
+			if m, err = a.rooms.publish(r.Context(), room, req.Body); err == nil {
+				a.messageSent("", m)
+			}
+		} else {
+			m, err = a.send(r.Context(), a.contacts.peerID(req.To), req.Body)
+		}
+		if err != nil {
+			writeWebhookResponse(w, http.StatusBadGateway, webhookResponse{Error: err.Error()})
+			return
+		}
+		writeWebhookResponse(w, http.StatusOK, webhookResponse{OK: true, When: m.When})
+	})
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("incoming webhook: %s", err)
+		}
+	}()
+	return srv, nil
+}
+
+func writeWebhookResponse(w http.ResponseWriter, status int, resp webhookResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"p2p-chat/node"
+)
+
+// seenTracker remembers when each peer was last connected or sent us
+// something during this session.
+type seenTracker struct {
+	mu   sync.Mutex
+	last map[peer.ID]time.Time
+}
+
+func newSeenTracker() *seenTracker {
+	return &seenTracker{last: make(map[peer.ID]time.Time)}
+}
+
+func (st *seenTracker) touch(p peer.ID) {
+	st.mu.Lock()
+	st.last[p] = time.Now()
+	st.mu.Unlock()
+}
+
+func (st *seenTracker) get(p peer.ID) (time.Time, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, ok := st.last[p]
+	return t, ok
+}
+
+// whoisInfo is what whois reports; it's also the --json shape.
+type whoisInfo struct {
+	Peer            string     `json:"peer"`
+	Status          string     `json:"status"` // connected, limited, not connected
+	Conns           []connInfo `json:"conns,omitempty"`
+	LastSeen        *time.Time `json:"last_seen,omitempty"`
+	LatencyMS       float64    `json:"latency_ms,omitempty"`
+	AgentVersion    string     `json:"agent_version,omitempty"`
+	ProtocolVersion string     `json:"protocol_version,omitempty"`
+	// Presence is what the peer last told us of its presence.
+	Presence *node.Presence `json:"presence,omitempty"`
+	// Features are the peep features the peer advertised.
+	Features node.PeerFeatures `json:"features"`
+	Addrs    []string          `json:"addrs,omitempty"`
+	// Dials is how dialing each address has gone this session.
+	Dials     map[string]node.AddrHistory `json:"dials,omitempty"`
+	Protocols []string                    `json:"protocols,omitempty"`
+	Unread    int                         `json:"unread,omitempty"`
+	// Reputation is how the peer has behaved towards us.
+	Reputation node.PeerReputation `json:"reputation"`
+}
+
+type connInfo struct {
+	Addr      string    `json:"addr"`
+	Direction string    `json:"direction"`
+	Limited   bool      `json:"limited,omitempty"`
+	Opened    time.Time `json:"opened"`
+	Security  string    `json:"security"` // "" if plaintext
+	Muxer     string    `json:"muxer,omitempty"`
+}
+
+// online reports whether p is connected.
+func (a *app) online(p peer.ID) bool {
+	return a.h.Network().Connectedness(p) == network.Connected
+}
+
+// lookupPeer collects what the peerstore, identify and this session know
+// about p.
+func lookupPeer(a *app, p peer.ID) whoisInfo {
+	ps := a.h.Peerstore()
+	info := whoisInfo{Peer: p.String(), Status: "not connected"}
+	if conns := a.h.Network().ConnsToPeer(p); len(conns) > 0 {
+		info.Status = "connected"
+		for _, c := range conns {
+			dir := "outbound"
+			if c.Stat().Direction == network.DirInbound {
+				dir = "inbound"
+			}
+			info.Conns = append(info.Conns, connInfo{Addr: c.RemoteMultiaddr().String(), Direction: dir,
+				Limited: c.Stat().Limited, Opened: c.Stat().Opened, Security: node.ConnSecurity(c), Muxer: node.ConnMuxer(c)})
+		}
+	} else if a.h.Network().Connectedness(p) == network.Limited {
+		info.Status = "limited"
+	}
+	if t, ok := a.seen.get(p); ok {
+		info.LastSeen = &t
+	}
+	if rtt := ps.LatencyEWMA(p); rtt > 0 {
+		info.LatencyMS = float64(rtt.Microseconds()) / 1000
+	}
+	if v, err := ps.Get(p, "AgentVersion"); err == nil {
+		info.AgentVersion, _ = v.(string)
+	}
+	if v, err := ps.Get(p, "ProtocolVersion"); err == nil {
+		info.ProtocolVersion, _ = v.(string)
+	}
+	info.Features = a.node.PeerFeatures(p)
+	if pr, ok := a.node.PeerPresence(p); ok {
+		info.Presence = &pr
+	}
+	for _, addr := range ps.Addrs(p) {
+		info.Addrs = append(info.Addrs, addr.String())
+	}
+	info.Dials = a.node.AddrHistory(p)
+	if protos, err := ps.GetProtocols(p); err == nil {
+		for _, pr := range protos {
+			info.Protocols = append(info.Protocols, string(pr))
+		}
+		sort.Strings(info.Protocols)
+	}
+	info.Unread = a.unread.count(p.String())
+	info.Reputation = a.node.Reputation(p)
+	return info
+}
+
+// whois prints what is known about p.
+func whois(a *app, p peer.ID) {
+	info := lookupPeer(a, p)
+	if jsonOutput {
+		printJSON(info)
+		return
+	}
+	fmt.Println("peer:", info.Peer)
+	switch info.Status {
+	case "connected":
+		fmt.Println("status: connected")
+		for _, c := range info.Conns {
+			limited := ""
+			if c.Limited {
+				limited = ", relayed/limited"
+			}
+			security := c.Security
+			if security == "" {
+				security = styles.err("PLAINTEXT")
+			}
+			fmt.Printf("  %s (%s%s, opened %s ago)\n    security: %s, muxer: %s\n", c.Addr, c.Direction, limited,
+				time.Since(c.Opened).Round(time.Second), security, c.Muxer)
+		}
+	case "limited":
+		fmt.Println("status: limited connection")
+	default:
+		fmt.Println("status: not connected")
+	}
+	if pr := info.Presence; pr != nil {
+		fmt.Printf("presence: %s (since %s)\n", describePresence(*pr), time.UnixMilli(pr.When).Format(time.RFC3339))
+	}
+	if t := info.LastSeen; t != nil {
+		fmt.Printf("last seen: %s (%s ago)\n", t.Format(time.RFC3339), time.Since(*t).Round(time.Second))
+	}
+	if rtt := a.h.Peerstore().LatencyEWMA(p); rtt > 0 {
+		fmt.Println("latency:", rtt.Round(time.Millisecond))
+	}
+	if r := info.Reputation; r.Blocked || r.Score < node.MaxScore {
+		fmt.Println("reputation:", describeReputation(r))
+	}
+	if info.AgentVersion != "" {
+		fmt.Println("agentVersion:", info.AgentVersion)
+	}
+	if info.ProtocolVersion != "" {
+		fmt.Println("protocolVersion:", info.ProtocolVersion)
+	}
+	fmt.Println("features:", describeFeatures(info.Features))
+	if len(info.Addrs) > 0 {
+		fmt.Println("known addresses:")
+		for _, addr := range info.Addrs {
+			fmt.Println("  ", addr+dialSummary(info.Dials[addr]))
+		}
+	}
+	if len(info.Protocols) > 0 {
+		fmt.Println("protocols:")
+		for _, n := range info.Protocols {
+			fmt.Println("  ", n)
+		}
+	}
+	if info.Unread > 0 {
+		fmt.Printf("unread: %d\n", info.Unread)
+	}
+}
+
+// describeFeatures lists the peep features a peer has and lacks, e.g.
+// "chat, rooms (no e2e, files, receipts)".
+func describeFeatures(pf node.PeerFeatures) string {
+	if !pf.Known {
+		return "not advertised (an older or non-peep client; all assumed)"
+	}
+	var have []string
+	for _, f := range pf.Features {
+		have = append(have, string(f))
+	}
+	s := strings.Join(have, ", ")
+	if missing := pf.Missing(); len(missing) > 0 {
+		var no []string
+		for _, f := range missing {
+			no = append(no, string(f))
+		}
+		s += " (no " + strings.Join(no, ", ") + ")"
+	}
+	return s
+}
+
+// supports reports whether peerID has feature f, as far as we know:
+// peers that haven't said are assumed to.
+func (a *app) supports(peerID string, f node.Feature) bool {
+	p, err := peer.Decode(peerID)
+	if err != nil {
+		return true
+	}
+	return a.node.PeerFeatures(p).Supports(f)
+}
+
+// dialSummary describes how dialing an address has gone, e.g. " (3 ok,
+// 1 failed; last worked 2m ago)", or "" if it hasn't been dialled.
+func dialSummary(h node.AddrHistory) string {
+	if h.Last.IsZero() {
+		return ""
+	}
+	last := "failed"
+	if h.LastOK {
+		last = "worked"
+	}
+	return fmt.Sprintf(" (%d ok, %d failed; last %s %s ago)", h.Successes, h.Failures, last, time.Since(h.Last).Round(time.Second))
+}
+
+func init() {
+	commands.mustRegister(&command{
+		Name:       "whois",
+		Usage:      "<peerID>",
+		Summary:    "show what is known about a peer (connections with their security and muxer, addresses, protocols, agent, peep features, latency, last seen)",
+		MinArgs:    1,
+		Background: true,
+		Run: func(a *app, inv *invocation) error {
+			p, err := peer.Decode(inv.Args[0])
+			if err != nil {
+				return err
+			}
+			whois(a, p)
+			return nil
+		},
+	})
+}